@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/acme_cert"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const defaultACMEHTTPAddr = ":80"
+
+// ACMEConfig enables the automatic certificate management of tls
+// listeners that have "acme: true".
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains"`       // Enables ACME if not empty.
+	Email        string   `yaml:"email"`         // Optional.
+	Challenge    string   `yaml:"challenge"`     // "tls-alpn-01" (default), "http-01" or "dns-01".
+	HTTPAddr     string   `yaml:"http_addr"`     // Used by http-01. Default is ":80".
+	CacheDir     string   `yaml:"cache_dir"`     // Default is "acme".
+	DirectoryURL string   `yaml:"directory_url"` // Default is Let's Encrypt.
+	CertName     string   `yaml:"cert_name"`     // The cache name of the dns-01 certificate. Default is derived from domains.
+}
+
+func (m *Mosdns) initACME(cfg *ACMEConfig) error {
+	cacheDir := cfg.CacheDir
+	if len(cacheDir) == 0 {
+		cacheDir = "acme"
+	}
+	lg := m.logger.Named("acme")
+	am, err := acme_cert.NewManager(acme_cert.Opts{
+		Domains:      cfg.Domains,
+		Email:        cfg.Email,
+		Challenge:    cfg.Challenge,
+		CacheDir:     cacheDir,
+		DirectoryURL: cfg.DirectoryURL,
+		CertName:     cfg.CertName,
+		Logger:       lg,
+	})
+	if err != nil {
+		return err
+	}
+	m.acme = am
+	if m.dryRun {
+		return nil
+	}
+
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-closeSignal
+			cancel()
+		}()
+		am.Run(ctx)
+	})
+
+	if h := am.HTTPHandler(); h != nil {
+		addr := cfg.HTTPAddr
+		if len(addr) == 0 {
+			addr = defaultACMEHTTPAddr
+		}
+		hs := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: time.Second * 5}
+		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			errChan := make(chan error, 1)
+			go func() {
+				lg.Info("starting acme http-01 server", zap.String("addr", addr))
+				errChan <- hs.ListenAndServe()
+			}()
+			select {
+			case err := <-errChan:
+				m.sc.SendCloseSignal(fmt.Errorf("acme http-01 server exited, %w", err))
+			case <-closeSignal:
+				hs.Close()
+			}
+		})
+	}
+	return nil
+}
+
+// ACMEChallengeTXT returns the TXT records of the pending ACME dns-01
+// challenges of fqdn. It returns nil if ACME is not enabled.
+func (m *Mosdns) ACMEChallengeTXT(fqdn string) []string {
+	if m == nil || m.acme == nil {
+		return nil
+	}
+	return m.acme.ChallengeTXT(fqdn)
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// APIPermission is a permission of an api token.
+type APIPermission string
+
+const (
+	// APIPermRead allows read-only requests, e.g. stats and metrics.
+	APIPermRead APIPermission = "read"
+	// APIPermCacheFlush allows flushing caches.
+	APIPermCacheFlush APIPermission = "cache_flush"
+	// APIPermRuleOverride allows modifying rules at runtime, e.g. ip sets.
+	APIPermRuleOverride APIPermission = "rule_override"
+	// APIPermFull allows everything.
+	APIPermFull APIPermission = "full"
+)
+
+func parseAPIPermission(s string) (APIPermission, error) {
+	switch p := APIPermission(s); p {
+	case APIPermRead, APIPermCacheFlush, APIPermRuleOverride, APIPermFull:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid permission %s", s)
+	}
+}
+
+// APIPermissionRequirer is an optional interface of plugins that
+// implement http.Handler. It returns the permission that req requires.
+// If a plugin does not implement it, GET and HEAD requests require
+// APIPermRead, others require APIPermFull.
+type APIPermissionRequirer interface {
+	RequiredAPIPermission(req *http.Request) APIPermission
+}
+
+type apiToken struct {
+	name  string
+	token []byte
+	perms map[APIPermission]struct{}
+}
+
+func (t *apiToken) allows(p APIPermission) bool {
+	_, full := t.perms[APIPermFull]
+	_, ok := t.perms[p]
+	return full || ok
+}
+
+// apiAuth authenticates api requests with bearer tokens and
+// logs the actions of tokens.
+type apiAuth struct {
+	logger *zap.Logger
+	mux    *http.ServeMux
+	tokens []*apiToken
+}
+
+func newAPIAuth(logger *zap.Logger, mux *http.ServeMux, cfgs []APITokenConfig) (*apiAuth, error) {
+	a := &apiAuth{logger: logger, mux: mux}
+	dupName := make(map[string]struct{})
+	for i, c := range cfgs {
+		if len(c.Name) == 0 || len(c.Token) == 0 {
+			return nil, fmt.Errorf("token #%d: missing name or token", i)
+		}
+		if _, dup := dupName[c.Name]; dup {
+			return nil, fmt.Errorf("duplicated token name %s", c.Name)
+		}
+		dupName[c.Name] = struct{}{}
+		if len(c.Permissions) == 0 {
+			return nil, fmt.Errorf("token %s: no permission", c.Name)
+		}
+		t := &apiToken{name: c.Name, token: []byte(c.Token), perms: make(map[APIPermission]struct{})}
+		for _, s := range c.Permissions {
+			p, err := parseAPIPermission(s)
+			if err != nil {
+				return nil, fmt.Errorf("token %s: %w", c.Name, err)
+			}
+			t.perms[p] = struct{}{}
+		}
+		a.tokens = append(a.tokens, t)
+	}
+	return a, nil
+}
+
+var errInvalidToken = errors.New("missing or invalid api token")
+
+// lookup returns the token in the Authorization header of req.
+func (a *apiAuth) lookup(req *http.Request) *apiToken {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return nil
+	}
+	b := []byte(h[len(prefix):])
+	var found *apiToken
+	for _, t := range a.tokens {
+		// Always compare all tokens.
+		if subtle.ConstantTimeCompare(b, t.token) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+func (a *apiAuth) requiredPermission(req *http.Request) APIPermission {
+	if strings.HasPrefix(req.URL.Path, "/debug/") {
+		return APIPermFull
+	}
+	if h, _ := a.mux.Handler(req); h != nil {
+		if r, ok := h.(APIPermissionRequirer); ok {
+			return r.RequiredAPIPermission(req)
+		}
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return APIPermRead
+	}
+	return APIPermFull
+}
+
+func (a *apiAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	perm := a.requiredPermission(req)
+	t := a.lookup(req)
+
+	var tokenName string
+	switch {
+	case t == nil:
+		a.logger.Warn("api request denied", zap.String("remote", req.RemoteAddr), zap.String("method", req.Method), zap.String("path", req.URL.Path), zap.Error(errInvalidToken))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	case !t.allows(perm):
+		a.logger.Warn("api request denied", zap.String("token", t.name), zap.String("remote", req.RemoteAddr), zap.String("method", req.Method), zap.String("path", req.URL.Path), zap.String("required_permission", string(perm)))
+		http.Error(w, fmt.Sprintf("token %s has no permission %s", t.name, perm), http.StatusForbidden)
+		return
+	default:
+		tokenName = t.name
+	}
+
+	if perm == APIPermRead {
+		a.mux.ServeHTTP(w, req)
+		return
+	}
+
+	// Audit the action.
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	a.mux.ServeHTTP(sw, req)
+	a.logger.Info("api action", zap.String("token", tokenName), zap.String("remote", req.RemoteAddr), zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.String("permission", string(perm)), zap.Int("status", sw.status))
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
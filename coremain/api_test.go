@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type permHandler struct{}
+
+func (permHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {}
+
+func (permHandler) RequiredAPIPermission(req *http.Request) APIPermission {
+	if req.Method == http.MethodGet {
+		return APIPermRead
+	}
+	return APIPermRuleOverride
+}
+
+func Test_apiAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("/scheduler/", func(http.ResponseWriter, *http.Request) {})
+	mux.Handle("/plugins/rules/", permHandler{})
+
+	a, err := newAPIAuth(zap.NewNop(), mux, []APITokenConfig{
+		{Name: "dashboard", Token: "t1", Permissions: []string{"read"}},
+		{Name: "automation", Token: "t2", Permissions: []string{"rule_override"}},
+		{Name: "admin", Token: "t3", Permissions: []string{"full"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"", http.MethodGet, "/metrics", http.StatusUnauthorized},
+		{"bad", http.MethodGet, "/metrics", http.StatusUnauthorized},
+		{"t1", http.MethodGet, "/metrics", http.StatusOK},
+		{"t1", http.MethodPost, "/scheduler/run", http.StatusForbidden},
+		{"t1", http.MethodGet, "/debug/pprof/", http.StatusForbidden},
+		{"t1", http.MethodPost, "/plugins/rules/add", http.StatusForbidden},
+		{"t2", http.MethodGet, "/metrics", http.StatusForbidden},
+		{"t2", http.MethodPost, "/plugins/rules/add", http.StatusOK},
+		{"t2", http.MethodPost, "/scheduler/run", http.StatusForbidden},
+		{"t3", http.MethodPost, "/scheduler/run", http.StatusOK},
+		{"t3", http.MethodPost, "/plugins/rules/add", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if len(tt.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s %s: want status %d, got %d", tt.token, tt.method, tt.path, tt.want, w.Code)
+		}
+	}
+}
+
+func Test_newAPIAuth_err(t *testing.T) {
+	for name, cfgs := range map[string][]APITokenConfig{
+		"missing token":      {{Name: "a", Permissions: []string{"read"}}},
+		"duplicated name":    {{Name: "a", Token: "1", Permissions: []string{"read"}}, {Name: "a", Token: "2", Permissions: []string{"read"}}},
+		"no permission":      {{Name: "a", Token: "1"}},
+		"invalid permission": {{Name: "a", Token: "1", Permissions: []string{"write"}}},
+	} {
+		if _, err := newAPIAuth(zap.NewNop(), http.NewServeMux(), cfgs); err == nil {
+			t.Errorf("%s: want err", name)
+		}
+	}
+}
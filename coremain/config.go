@@ -26,12 +26,30 @@ import (
 )
 
 type Config struct {
-	Log           mlog.LogConfig                     `yaml:"log"`
-	Include       []string                           `yaml:"include"`
+	Log mlog.LogConfig `yaml:"log"`
+
+	// Include is a list of config files, directories or glob patterns.
+	// Their data providers, plugins and servers are merged. See mergeInclude.
+	Include []string `yaml:"include"`
+
 	DataProviders []data_provider.DataProviderConfig `yaml:"data_providers"`
 	Plugins       []PluginConfig                     `yaml:"plugins"`
 	Servers       []ServerConfig                     `yaml:"servers"`
 	API           APIConfig                          `yaml:"api"`
+	SelfTest      SelfTestConfig                     `yaml:"self_test"`
+	ACME          ACMEConfig                         `yaml:"acme"`
+	Trace         TraceConfig                        `yaml:"trace"`
+
+	// DrainTimeout (sec) is the time to wait for in-flight queries on
+	// SIGTERM or SIGINT. Default is 5.
+	DrainTimeout uint `yaml:"drain_timeout"`
+
+	// User ("user" or "user:group") is the user that mosdns switches to
+	// after all servers are started. It allows mosdns to be started as
+	// root to bind privileged ports, and then run without privileges.
+	// Files (e.g. certificates, data files) that are loaded later must be
+	// readable by this user. Linux only.
+	User string `yaml:"user"`
 
 	// Experimental
 	Security SecurityConfig `yaml:"security"`
@@ -55,6 +73,19 @@ type ServerConfig struct {
 	Exec      string                  `yaml:"exec"`
 	Timeout   uint                    `yaml:"timeout"` // (sec) query timeout.
 	Listeners []*ServerListenerConfig `yaml:"listeners"`
+
+	// MaxPendingQueries limits the number of queries that are being
+	// processed by this server. MaxPendingQueriesPerClient limits it for
+	// each client ip. Zero means no limit.
+	// OverflowPolicy is the policy of queries that exceed the limits.
+	// Can be "drop" (default), "servfail" or "refused".
+	MaxPendingQueries          int    `yaml:"max_pending_queries"`
+	MaxPendingQueriesPerClient int    `yaml:"max_pending_queries_per_client"`
+	OverflowPolicy             string `yaml:"overflow_policy"`
+
+	// NSID is the server identity that is sent to clients that
+	// request it with the NSID option (RFC 5001). e.g. the hostname.
+	NSID string `yaml:"nsid"`
 }
 
 type ServerListenerConfig struct {
@@ -67,20 +98,111 @@ type ServerListenerConfig struct {
 	Protocol string `yaml:"protocol"`
 
 	// Addr: server "host:port" addr.
+	// "systemd:<name>" uses the socket passed by systemd socket activation,
+	// name is the FileDescriptorName= of the socket or the index of it.
 	// Addr cannot be empty.
 	Addr string `yaml:"addr"`
 
-	Cert                string `yaml:"cert"`                    // certificate path, used by dot, doh
-	Key                 string `yaml:"key"`                     // certificate key path, used by dot, doh
-	URLPath             string `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled.
-	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http.
-	ProxyProtocol       bool   `yaml:"proxy_protocol"`          // accepting the PROXYProtocol
+	Cert                string   `yaml:"cert"`                    // certificate path, used by dot, doh. Reloaded on change.
+	Key                 string   `yaml:"key"`                     // certificate key path, used by dot, doh
+	URLPath             string   `yaml:"url_path"`                // used by doh, http. If it and URLPaths are empty, any path will be handled.
+	URLPaths            []string `yaml:"url_paths"`               // used by doh, http. Additional paths.
+	GetUserIPFromHeader string   `yaml:"get_user_ip_from_header"` // used by doh, http.
+
+	// TrustedProxies are the ip addresses or CIDRs of the reverse proxies
+	// in front of the doh, http server. If set, the client ip is read from
+	// X-Forwarded-For, Forwarded or X-Real-IP headers (or the header of
+	// GetUserIPFromHeader) of requests from them only.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ClientCA enables the mutual tls authentication. Clients must present
+	// a certificate signed by one of these CAs. Used by dot, doh.
+	ClientCA []string `yaml:"client_ca"`
+
+	// ACME gets the certificate from the ACME manager. See Config.ACME.
+	// Used by dot, doh.
+	ACME bool `yaml:"acme"`
+
+	// AuthTokens and BasicAuth ("user:password") enable the http
+	// authentication. Clients must send one of the credentials in the
+	// Authorization header. Used by doh, http.
+	AuthTokens    []string `yaml:"auth_tokens"`
+	BasicAuth     []string `yaml:"basic_auth"`
+	ProxyProtocol bool     `yaml:"proxy_protocol"` // accepting the PROXYProtocol (v1 and v2). Used by tcp, dot, http, doh.
+
+	// ProxyProtocolTrusted limits the sources (ip or cidr) that can send
+	// PROXY protocol headers. Connections from other sources are served
+	// directly, and are closed if they send a header. If empty, all
+	// connections must send a header.
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
 
 	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh as connection idle timeout.
+
+	// TCPFastOpen enables TCP Fast Open on the listener. TCPKeepAlive
+	// (sec, negative disables) is the keep-alive period of client
+	// connections. TCPUserTimeout (sec) closes client connections
+	// that have unacknowledged data for this long. Used by tcp, dot, http,
+	// doh. TCPFastOpen and TCPUserTimeout are linux only.
+	TCPFastOpen    bool `yaml:"tcp_fast_open"`
+	TCPKeepAlive   int  `yaml:"tcp_keepalive"`
+	TCPUserTimeout uint `yaml:"tcp_user_timeout"`
+
+	// ReusePort opens this number of sockets on Addr with SO_REUSEPORT,
+	// each is served by its own accept/read loop. It removes the single
+	// socket bottleneck on multi-core machines. Linux only.
+	ReusePort int `yaml:"reuseport"`
+
+	// HotCacheSize enables a per-socket cache that answers repeated
+	// queries without running the plugins. Only use it if responses do
+	// not depend on clients. Queries will not be logged or counted by
+	// plugins. HotCacheTTL (sec, default 5) limits the lifetime of cached
+	// responses, their TTLs are not decreased. Used by udp.
+	HotCacheSize int  `yaml:"hot_cache_size"`
+	HotCacheTTL  uint `yaml:"hot_cache_ttl"`
 }
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+
+	// Tokens enables the token authentication of the api. Requests must
+	// have a "Authorization: Bearer <token>" header. Actions that require
+	// permissions other than "read" are logged.
+	// If empty, the api is open to everyone.
+	Tokens []APITokenConfig `yaml:"tokens"`
+
+	// Dashboard enables the web dashboard at "/dashboard/".
+	Dashboard bool `yaml:"dashboard"`
+
+	// HotSwap enables the plugin hot swap api at "/hot_swap/". It can
+	// replace the args of any plugin, so Tokens must not be empty.
+	HotSwap bool `yaml:"hot_swap"`
+}
+
+type APITokenConfig struct {
+	Name  string `yaml:"name"` // Name is used in logs.
+	Token string `yaml:"token"`
+
+	// Permissions can be "read", "cache_flush", "rule_override" and "full".
+	Permissions []string `yaml:"permissions"`
+}
+
+// SelfTestConfig configures the canary queries that are resolved
+// after start. The self-test is disabled if Queries is empty.
+type SelfTestConfig struct {
+	Entry    string                `yaml:"entry"` // Default is the exec of the first server.
+	Queries  []SelfTestQueryConfig `yaml:"queries"`
+	Timeout  int                   `yaml:"timeout"`  // (sec) Default is 5.
+	Interval int                   `yaml:"interval"` // (sec) Re-run the self-test periodically. Default is 0, run once only.
+	Fatal    bool                  `yaml:"fatal"`    // Exit if the first self-test failed.
+}
+
+type SelfTestQueryConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // Default is "A".
+}
+
+func (c *SelfTestConfig) Init() {
+	utils.SetDefaultNum(&c.Timeout, 5)
 }
 
 type SecurityConfig struct {
@@ -104,3 +226,39 @@ func (c *BadIPObserverConfig) Init() {
 	utils.SetDefaultNum(&c.IPv4Mask, 32)
 	utils.SetDefaultNum(&c.IPv6Mask, 48)
 }
+
+// TraceConfig configures the query tracing. Queries can always be traced
+// by the api "/trace/".
+type TraceConfig struct {
+	// EDNSOption is the code of an EDNS0 local option (65001~65534).
+	// Queries that carry this option are traced. The data of the option,
+	// if any, is used as the trace id. Zero disables it.
+	EDNSOption uint16 `yaml:"edns_option"`
+
+	// Size is the number of recent traces that are kept. Default is 64.
+	Size int `yaml:"size"`
+
+	// OTLP exports traces to an OpenTelemetry collector.
+	OTLP OTLPConfig `yaml:"otlp"`
+}
+
+// OTLPConfig configures the export of query traces with the OTLP/HTTP
+// protocol in the JSON encoding. Each query is a trace, and each plugin
+// and upstream exchange is a span.
+type OTLPConfig struct {
+	// Endpoint is the traces url of the collector, e.g.
+	// "http://127.0.0.1:4318/v1/traces". Empty disables the export.
+	Endpoint string `yaml:"endpoint"`
+
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+
+	// ServiceName is the service.name of the traces. Default is "mosdns".
+	ServiceName string `yaml:"service_name"`
+
+	// SampleRatio is the ratio of queries that are traced, 0~1. Queries
+	// that are traced by the api or the EDNS0 option are always exported.
+	// Tracing records every plugin execution, which is expensive for
+	// busy servers. Default is 0, no query is sampled.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package coremain
+
+import (
+	_ "embed"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+// withDashboardPage serves the dashboard page at "/dashboard/" without
+// authentication and passes other requests to h. The page has no data,
+// it calls the api with the token that the user entered.
+func withDashboardPage(h http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.Handle("/dashboard/api/", h)
+	mux.HandleFunc("/dashboard/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/dashboard/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write(dashboardPage)
+	})
+	return mux
+}
+
+type dashboardSummary struct {
+	UptimeSec       float64             `json:"uptime_sec"`
+	QueriesTotal    float64             `json:"queries_total"`
+	SelfTestHealthy *float64            `json:"self_test_healthy,omitempty"` // nil if the self-test is disabled
+	Plugins         []hotSwapPluginInfo `json:"plugins"`
+	Caches          []dashboardCache    `json:"caches"`
+	Upstreams       []dashboardUpstream `json:"upstreams"`
+	DataProviders   []string            `json:"data_providers"`
+}
+
+type dashboardCache struct {
+	Tag      string  `json:"tag"`
+	Queries  float64 `json:"queries"`
+	Hits     float64 `json:"hits"`
+	LazyHits float64 `json:"lazy_hits"`
+	Size     float64 `json:"size"`
+}
+
+type dashboardUpstream struct {
+	Tag              string  `json:"tag"`
+	Upstream         string  `json:"upstream"`
+	OpenConns        float64 `json:"open_conns"`
+	Dials            float64 `json:"dials"`
+	DialErrors       float64 `json:"dial_errors"`
+	InvalidResponses float64 `json:"invalid_responses"`
+	Retries          float64 `json:"retries"`
+}
+
+// dashboardAPI serves the data of the dashboard.
+//
+//	GET /dashboard/api/summary
+type dashboardAPI struct {
+	m *Mosdns
+}
+
+func (a *dashboardAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.Trim(strings.TrimPrefix(req.URL.Path, "/dashboard/api/"), "/") != "summary" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s, err := a.summary()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// summary builds the summary from the metrics. Caches are the plugins
+// that have the cache metrics. Upstreams are the plugins that have the
+// upstream connection metrics.
+func (a *dashboardAPI) summary() (*dashboardSummary, error) {
+	mfs, err := a.m.metricsReg.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics, %w", err)
+	}
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+
+	s := &dashboardSummary{
+		UptimeSec:     time.Since(a.m.startTime).Seconds(),
+		QueriesTotal:  familyValue(families["mosdns_queries_total"], nil),
+		Plugins:       make([]hotSwapPluginInfo, 0, len(a.m.hotSwapPlugins)),
+		Caches:        []dashboardCache{},
+		Upstreams:     []dashboardUpstream{},
+		DataProviders: a.m.dataManager.Names(),
+	}
+	if mf := families["mosdns_self_test_healthy"]; mf != nil {
+		v := familyValue(mf, nil)
+		s.SelfTestHealthy = &v
+	}
+	for _, h := range a.m.hotSwapPlugins {
+		s.Plugins = append(s.Plugins, hotSwapPluginInfo{Tag: h.tag, Type: h.typ})
+	}
+	sort.Slice(s.Plugins, func(i, j int) bool { return s.Plugins[i].Tag < s.Plugins[j].Tag })
+
+	for _, p := range s.Plugins {
+		prefix := "mosdns_plugin_" + p.Tag + "_"
+		if families[prefix+"query_total"] != nil && families[prefix+"hit_total"] != nil {
+			s.Caches = append(s.Caches, dashboardCache{
+				Tag:      p.Tag,
+				Queries:  familyValue(families[prefix+"query_total"], nil),
+				Hits:     familyValue(families[prefix+"hit_total"], nil),
+				LazyHits: familyValue(families[prefix+"lazy_hit_total"], nil),
+				Size:     familyValue(families[prefix+"cache_size"], nil),
+			})
+		}
+		if mf := families[prefix+"conn_dials_total"]; mf != nil {
+			for _, m := range mf.GetMetric() {
+				label := upstreamLabel(m)
+				if label == nil {
+					continue
+				}
+				s.Upstreams = append(s.Upstreams, dashboardUpstream{
+					Tag:              p.Tag,
+					Upstream:         label.GetValue(),
+					OpenConns:        familyValue(families[prefix+"open_conns"], label),
+					Dials:            metricValue(m),
+					DialErrors:       familyValue(families[prefix+"conn_dial_errors_total"], label),
+					InvalidResponses: familyValue(families[prefix+"invalid_responses_total"], label),
+					Retries:          familyValue(families[prefix+"retries_total"], label),
+				})
+			}
+		}
+	}
+	return s, nil
+}
+
+func upstreamLabel(m *dto.Metric) *dto.LabelPair {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == "upstream" {
+			return l
+		}
+	}
+	return nil
+}
+
+// familyValue returns the value of the metric of mf that has label. If
+// label is nil, it returns the value of the first metric. It returns 0
+// if mf is nil or there is no such metric.
+func familyValue(mf *dto.MetricFamily, label *dto.LabelPair) float64 {
+	if mf == nil {
+		return 0
+	}
+	for _, m := range mf.GetMetric() {
+		if label == nil {
+			return metricValue(m)
+		}
+		for _, l := range m.GetLabel() {
+			if l.GetName() == label.GetName() && l.GetValue() == label.GetValue() {
+				return metricValue(m)
+			}
+		}
+	}
+	return 0
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package coremain
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_dashboardAPI(t *testing.T) {
+	m := newMosdns(zap.NewNop())
+	defer m.scheduler.Close()
+	m.hotSwapPlugins["c"] = &hotSwapPlugin{m: m, tag: "c", typ: "cache"}
+	m.hotSwapPlugins["f"] = &hotSwapPlugin{m: m, tag: "f", typ: "fast_forward"}
+
+	cacheReg := prometheus.WrapRegistererWithPrefix("plugin_c_", m.GetMetricsReg())
+	queries := prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"})
+	hits := prometheus.NewCounter(prometheus.CounterOpts{Name: "hit_total"})
+	cacheReg.MustRegister(queries, hits)
+	queries.Add(4)
+	hits.Add(3)
+
+	upstreamReg := prometheus.WrapRegistererWithPrefix("plugin_f_", m.GetMetricsReg())
+	dials := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "conn_dials_total"}, []string{"upstream"})
+	dialErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "conn_dial_errors_total"}, []string{"upstream"})
+	upstreamReg.MustRegister(dials, dialErrors)
+	dials.WithLabelValues("a").Add(2)
+	dials.WithLabelValues("b").Add(5)
+	dialErrors.WithLabelValues("b").Add(1)
+	m.queriesTotal.Add(10)
+
+	w := httptest.NewRecorder()
+	(&dashboardAPI{m: m}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/api/summary", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, %s", w.Code, w.Body)
+	}
+	s := new(dashboardSummary)
+	if err := json.Unmarshal(w.Body.Bytes(), s); err != nil {
+		t.Fatal(err)
+	}
+	if s.QueriesTotal != 10 || s.SelfTestHealthy != nil || len(s.Plugins) != 2 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	if len(s.Caches) != 1 || s.Caches[0] != (dashboardCache{Tag: "c", Queries: 4, Hits: 3}) {
+		t.Fatalf("unexpected caches %+v", s.Caches)
+	}
+	if len(s.Upstreams) != 2 {
+		t.Fatalf("unexpected upstreams %+v", s.Upstreams)
+	}
+	for _, u := range s.Upstreams {
+		if u.Upstream == "b" && (u.Dials != 5 || u.DialErrors != 1) {
+			t.Fatalf("unexpected upstream %+v", u)
+		}
+	}
+}
+
+func Test_withDashboardPage(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	h := withDashboardPage(api)
+	for path, want := range map[string]int{
+		"/dashboard/":            http.StatusOK,
+		"/dashboard/other":       http.StatusNotFound,
+		"/dashboard/api/summary": http.StatusUnauthorized,
+		"/metrics":               http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Fatalf("%s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func Test_dataProviderAPI(t *testing.T) {
+	m := newMosdns(zap.NewNop())
+	defer m.scheduler.Close()
+	api := &dataProviderAPI{m: m}
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/data_providers/", http.StatusOK},
+		{http.MethodPost, "/data_providers/", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/data_providers/x/reload", http.StatusNotFound},
+		{http.MethodGet, "/data_providers/x/reload", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/data_providers/x/other", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Fatalf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
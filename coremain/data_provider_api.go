@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package coremain
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// dataProviderAPI serves the data provider api.
+//
+//	GET  /data_providers/              lists the data providers.
+//	POST /data_providers/<tag>/reload  reloads the data provider from disk.
+type dataProviderAPI struct {
+	m *Mosdns
+}
+
+func (a *dataProviderAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/data_providers/"), "/")
+	if len(path) == 0 {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, a.m.dataManager.Names())
+		return
+	}
+
+	tag, op, _ := strings.Cut(path, "/")
+	if op != "reload" {
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown operation %s", op))
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dp := a.m.dataManager.GetDataProvider(tag)
+	if dp == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("data provider %s not found", tag))
+		return
+	}
+	if err := dp.Reload(); err != nil {
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("failed to reload, %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func newGraphCmd() *cobra.Command {
+	sf := new(serverFlags)
+	var format string
+	c := &cobra.Command{
+		Use:   "graph [-c config_file] [-d working_dir] [--format dot|mermaid]",
+		Short: "Print the reference graph of servers and plugins.",
+		Long: "Print the reference graph of servers and plugins in Graphviz DOT or Mermaid. " +
+			"Edges are labeled with the args that refer to the plugin, e.g. \"exec[1].else_exec\". " +
+			"Plugins that are referred by conditions are drawn as matchers. No plugin will be loaded.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGraphCmd(sf, format, cmd.OutOrStdout())
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&sf.c, "config", "c", "", "config file")
+	fs.StringVarP(&sf.dir, "dir", "d", "", "working dir")
+	fs.StringVar(&format, "format", "dot", "output format, dot or mermaid")
+	markConfigFlags(c)
+	return c
+}
+
+func runGraphCmd(sf *serverFlags, format string, out io.Writer) error {
+	if len(sf.dir) > 0 {
+		if err := os.Chdir(sf.dir); err != nil {
+			return fmt.Errorf("failed to change the current working directory, %w", err)
+		}
+	}
+	cfg, fileUsed, err := loadConfig(sf.c)
+	if err != nil {
+		return fmt.Errorf("fail to load config, %w", err)
+	}
+	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+		return fmt.Errorf("failed to load sub config file, %w", err)
+	}
+
+	g := buildPluginGraph(cfg)
+	switch format {
+	case "dot":
+		g.writeDOT(out)
+	case "mermaid":
+		g.writeMermaid(out)
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+	return nil
+}
+
+// pluginGraph is the reference graph of servers and plugins. It is built
+// from the config statically.
+type pluginGraph struct {
+	nodes []*graphNode
+	index map[string]*graphNode // by id
+	edges []graphEdge
+}
+
+type graphNode struct {
+	id      string // The plugin tag, or "server #<index>".
+	label   string
+	kind    string // "server", "plugin" or "preset"
+	matcher bool   // The node is referred by a condition.
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+	cond     bool // The edge is from a condition expression.
+}
+
+// conditionArgs are the args that contain condition expressions.
+// See executable_seq.NewConditionMatcher.
+var conditionArgs = map[string]bool{"if": true, "if_and": true, "expr": true}
+
+func buildPluginGraph(cfg *Config) *pluginGraph {
+	g := &pluginGraph{index: make(map[string]*graphNode)}
+	presets := LoadNewPersetPluginFuncs()
+	tags := make(map[string]bool)
+	for _, pc := range cfg.Plugins {
+		if len(pc.Tag) > 0 {
+			tags[pc.Tag] = true
+		}
+	}
+	for tag := range presets {
+		tags[tag] = true
+	}
+
+	for i, sc := range cfg.Servers {
+		id := "server #" + strconv.Itoa(i)
+		label := []string{id}
+		for _, lc := range sc.Listeners {
+			proto := lc.Protocol
+			if len(proto) == 0 {
+				proto = "udp"
+			}
+			label = append(label, proto+" "+lc.Addr)
+		}
+		g.addNode(&graphNode{id: id, label: strings.Join(label, "\n"), kind: "server"})
+		if len(sc.Exec) > 0 {
+			g.addEdge(graphEdge{from: id, to: sc.Exec, label: "exec"})
+		}
+	}
+	for _, pc := range cfg.Plugins {
+		if len(pc.Tag) == 0 {
+			continue
+		}
+		g.addNode(&graphNode{id: pc.Tag, label: pc.Tag + "\n(" + pc.Type + ")", kind: "plugin"})
+		g.walkArgs(pc.Tag, pc.Args, "", "", tags)
+	}
+
+	// Add nodes of presets and missing plugins that are referred.
+	for _, e := range g.edges {
+		if g.index[e.to] != nil {
+			continue
+		}
+		if _, ok := presets[e.to]; ok {
+			g.addNode(&graphNode{id: e.to, label: e.to, kind: "preset"})
+		} else {
+			g.addNode(&graphNode{id: e.to, label: e.to + "\n(not found)", kind: "plugin"})
+		}
+	}
+	for _, e := range g.edges {
+		if e.cond {
+			g.index[e.to].matcher = true
+		}
+	}
+	return g
+}
+
+// buildRefGraph builds the reference graph of plugins from their args,
+// which are keyed by plugin tags.
+func buildRefGraph(args map[string]interface{}) *pluginGraph {
+	g := &pluginGraph{index: make(map[string]*graphNode)}
+	tags := make(map[string]bool, len(args))
+	for tag := range args {
+		tags[tag] = true
+	}
+	for tag, a := range args {
+		g.walkArgs(tag, a, "", "", tags)
+	}
+	return g
+}
+
+// findCycle returns a reference loop that starts and ends at id,
+// e.g. ["a", "b", "a"]. It returns nil if there is no such loop.
+func (g *pluginGraph) findCycle(id string) []string {
+	refs := make(map[string][]string)
+	for _, e := range g.edges {
+		refs[e.from] = append(refs[e.from], e.to)
+	}
+
+	visited := make(map[string]bool)
+	var path []string
+	var dfs func(n string) bool
+	dfs = func(n string) bool {
+		path = append(path, n)
+		for _, to := range refs[n] {
+			if to == id {
+				path = append(path, to)
+				return true
+			}
+			if !visited[to] {
+				visited[to] = true
+				if dfs(to) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if dfs(id) {
+		return path
+	}
+	return nil
+}
+
+func (g *pluginGraph) addNode(n *graphNode) {
+	if g.index[n.id] != nil {
+		return
+	}
+	g.nodes = append(g.nodes, n)
+	g.index[n.id] = n
+}
+
+func (g *pluginGraph) addEdge(e graphEdge) {
+	for _, oe := range g.edges {
+		if oe == e {
+			return
+		}
+	}
+	g.edges = append(g.edges, e)
+}
+
+// walkArgs adds edges from plugin from to the plugins that are referred by
+// v. v is the arg at path. key is the name of the innermost map key of path.
+func (g *pluginGraph) walkArgs(from string, v interface{}, path, key string, tags map[string]bool) {
+	label := strings.TrimPrefix(path, ".")
+	if len(label) == 0 {
+		label = "args"
+	}
+	switch v := v.(type) {
+	case string:
+		if conditionArgs[key] {
+			for _, ident := range executable_seq.ExprIdents(v) {
+				if tags[ident] {
+					g.addEdge(graphEdge{from: from, to: ident, label: label, cond: true})
+				}
+			}
+			return
+		}
+		if tags[v] {
+			g.addEdge(graphEdge{from: from, to: v, label: label})
+		}
+	case []interface{}:
+		for i, e := range v {
+			g.walkArgs(from, e, path+"["+strconv.Itoa(i)+"]", key, tags)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			g.walkArgs(from, v[k], path+"."+k, k, tags)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = e
+		}
+		g.walkArgs(from, m, path, key, tags)
+	}
+}
+
+func (g *pluginGraph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph mosdns {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, n := range g.nodes {
+		attrs := "shape=box"
+		switch {
+		case n.kind == "server":
+			attrs = "shape=box, style=rounded"
+		case n.matcher:
+			attrs = "shape=diamond"
+		case n.kind == "preset":
+			attrs = "shape=box, style=dashed"
+		}
+		fmt.Fprintf(w, "  %s [%s, label=%s];\n", strconv.Quote(n.id), attrs, strconv.Quote(n.label))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s -> %s [label=%s];\n", strconv.Quote(e.from), strconv.Quote(e.to), strconv.Quote(e.label))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func (g *pluginGraph) writeMermaid(w io.Writer) {
+	// Tags may contain chars that are not allowed in mermaid ids.
+	ids := make(map[string]string, len(g.nodes))
+	for i, n := range g.nodes {
+		ids[n.id] = "n" + strconv.Itoa(i)
+	}
+	esc := strings.NewReplacer(`"`, "#quot;", "\n", "<br/>")
+	fmt.Fprintln(w, "flowchart LR")
+	for _, n := range g.nodes {
+		open, closing := "[", "]"
+		switch {
+		case n.kind == "server":
+			open, closing = "([", "])"
+		case n.matcher:
+			open, closing = "{", "}"
+		case n.kind == "preset":
+			open, closing = "[/", "/]"
+		}
+		fmt.Fprintf(w, "  %s%s\"%s\"%s\n", ids[n.id], open, esc.Replace(n.label), closing)
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s -->|\"%s\"| %s\n", ids[e.from], esc.Replace(e.label), ids[e.to])
+	}
+}
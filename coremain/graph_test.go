@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_pluginGraph(t *testing.T) {
+	cfg := &Config{
+		Plugins: []PluginConfig{
+			{Tag: "local_domain", Type: "query_matcher"},
+			{Tag: "forward_local", Type: "fast_forward"},
+			{Tag: "forward_remote", Type: "fast_forward"},
+			{Tag: "main", Type: "sequence", Args: map[string]interface{}{
+				"exec": []interface{}{
+					map[string]interface{}{
+						"if":        "local_domain && !qtype in (AAAA)",
+						"exec":      "forward_local",
+						"else_exec": []interface{}{"forward_remote", "not_a_tag"},
+					},
+					"forward_remote",
+				},
+			}},
+		},
+		Servers: []ServerConfig{
+			{Exec: "main", Listeners: []*ServerListenerConfig{{Addr: "127.0.0.1:53"}}},
+			{Exec: "missing"},
+		},
+	}
+	g := buildPluginGraph(cfg)
+
+	b := new(bytes.Buffer)
+	g.writeDOT(b)
+	for _, s := range []string{
+		`"server #0" [shape=box, style=rounded, label="server #0\nudp 127.0.0.1:53"];`,
+		`"local_domain" [shape=diamond, label="local_domain\n(query_matcher)"];`,
+		`"missing" [shape=box, label="missing\n(not found)"];`,
+		`"server #0" -> "main" [label="exec"];`,
+		`"main" -> "local_domain" [label="exec[0].if"];`,
+		`"main" -> "forward_local" [label="exec[0].exec"];`,
+		`"main" -> "forward_remote" [label="exec[0].else_exec[0]"];`,
+		`"main" -> "forward_remote" [label="exec[1]"];`,
+		`"server #1" -> "missing" [label="exec"];`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("dot output does not contain %s:\n%s", s, b)
+		}
+	}
+
+	b.Reset()
+	g.writeMermaid(b)
+	for _, s := range []string{
+		"flowchart LR",
+		`n0(["server #0<br/>udp 127.0.0.1:53"])`,
+		`n2{"local_domain<br/>(query_matcher)"}`,
+		`n0 -->|"exec"| n5`,
+		`n5 -->|"exec[0].if"| n2`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("mermaid output does not contain %s:\n%s", s, b)
+		}
+	}
+}
+
+func Test_pluginGraph_findCycle(t *testing.T) {
+	g := buildRefGraph(map[string]interface{}{
+		"a": map[string]interface{}{"exec": []interface{}{"b", "c"}},
+		"b": map[string]interface{}{"exec": "d"},
+		"c": map[string]interface{}{"if": "d", "exec": "a"},
+		"d": nil,
+		"e": map[string]interface{}{"exec": "e"},
+	})
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"a", "a -> c -> a"},
+		{"c", "c -> a -> c"},
+		{"b", ""},
+		{"d", ""},
+		{"e", "e -> e"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(g.findCycle(tt.id), " -> "); got != tt.want {
+			t.Errorf("findCycle(%s) = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
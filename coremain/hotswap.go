@@ -0,0 +1,323 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hotSwapGracePeriod is the delay before a replaced plugin instance is
+// closed, so that in-flight queries can finish.
+const hotSwapGracePeriod = time.Second * 30
+
+// hotSwapPlugin holds a plugin instance that can be replaced at runtime
+// with new args. Other plugins keep referring to the hotSwapPlugin, so
+// the rest of the graph does not need to be rebuilt.
+type hotSwapPlugin struct {
+	m        *Mosdns
+	tag, typ string
+
+	swapMu sync.Mutex
+	v      atomic.Value // *pluginInstance
+}
+
+type pluginInstance struct {
+	p    Plugin
+	args interface{}
+}
+
+func newHotSwapPlugin(m *Mosdns, c *PluginConfig, p Plugin) *hotSwapPlugin {
+	h := &hotSwapPlugin{m: m, tag: c.Tag, typ: c.Type}
+	h.v.Store(&pluginInstance{p: p, args: c.Args})
+	return h
+}
+
+func (h *hotSwapPlugin) current() *pluginInstance {
+	return h.v.Load().(*pluginInstance)
+}
+
+func (h *hotSwapPlugin) Tag() string {
+	return h.tag
+}
+
+func (h *hotSwapPlugin) Type() string {
+	return h.typ
+}
+
+func (h *hotSwapPlugin) Close() error {
+	return closePlugin(h.current().p)
+}
+
+// swap inits a new instance with args and replaces the current one.
+// The current instance keeps running if the new one cannot be initialized.
+func (h *hotSwapPlugin) swap(args interface{}) error {
+	h.swapMu.Lock()
+	defer h.swapMu.Unlock()
+
+	h.m.notifySystemd("RELOADING=1")
+	defer h.m.notifySystemd("READY=1")
+
+	// Sequences can refer to any plugin now. Make sure that the new
+	// args don't form a loop.
+	pluginArgs := make(map[string]interface{}, len(h.m.hotSwapPlugins))
+	for tag, p := range h.m.hotSwapPlugins {
+		pluginArgs[tag] = p.current().args
+	}
+	pluginArgs[h.tag] = args
+	if loop := buildRefGraph(pluginArgs).findCycle(h.tag); loop != nil {
+		return fmt.Errorf("new args form a reference loop %s", strings.Join(loop, " -> "))
+	}
+
+	old := h.current().p
+	// Tasks of the old instance have the same names as the new ones.
+	taskPrefix := fmt.Sprintf("plugin/%s/", h.tag)
+	tasks := h.m.scheduler.CancelPrefix(taskPrefix)
+
+	bp := NewBP(h.tag, h.typ, h.m.logger, h.m)
+	bp.stagedMetrics = newStagingRegisterer()
+	p, err := newPlugin(&PluginConfig{Tag: h.tag, Type: h.typ, Args: args}, bp)
+	if err == nil && !samePluginKind(old, p) {
+		closePlugin(p)
+		err = fmt.Errorf("new instance does not implement the same interfaces")
+	}
+	if err != nil {
+		h.m.scheduler.CancelPrefix(taskPrefix) // added by the new instance, if any
+		for _, opts := range tasks {
+			if _, err := h.m.scheduler.Add(opts); err != nil {
+				h.m.logger.Error("failed to restore plugin task", zap.String("task", opts.Name), zap.Error(err))
+			}
+		}
+		return err
+	}
+
+	if err := bp.stagedMetrics.commit(h.m.GetMetricsReg()); err != nil {
+		h.m.logger.Warn("failed to register metrics of the new instance", zap.String("tag", h.tag), zap.Error(err))
+	}
+	h.v.Store(&pluginInstance{p: p, args: args})
+	time.AfterFunc(hotSwapGracePeriod, func() {
+		if err := closePlugin(old); err != nil {
+			h.m.logger.Warn("failed to close replaced plugin", zap.String("tag", h.tag), zap.Error(err))
+		}
+	})
+	return nil
+}
+
+func samePluginKind(a, b Plugin) bool {
+	_, ae := a.(executable_seq.Executable)
+	_, be := b.(executable_seq.Executable)
+	_, am := a.(executable_seq.Matcher)
+	_, bm := b.(executable_seq.Matcher)
+	_, ah := a.(http.Handler)
+	_, bh := b.(http.Handler)
+	return ae == be && am == bm && ah == bh
+}
+
+// closePlugin closes p. Plugins that hold resources implement Shutdown.
+func closePlugin(p Plugin) error {
+	if s, ok := p.(interface{ Shutdown() error }); ok {
+		if err := s.Shutdown(); err != nil {
+			return err
+		}
+	}
+	return p.Close()
+}
+
+// hotSwapExec is the ExecutablePlugin view of a hotSwapPlugin.
+type hotSwapExec struct {
+	*hotSwapPlugin
+}
+
+var _ AnswerModifier = (*hotSwapExec)(nil)
+var _ DNSSECPassthroughEnabler = (*hotSwapExec)(nil)
+
+func (e *hotSwapExec) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	return e.current().p.(executable_seq.Executable).Exec(ctx, qCtx, next)
+}
+
+func (e *hotSwapExec) ModifiesAnswer() bool {
+	m, ok := e.current().p.(AnswerModifier)
+	return ok && m.ModifiesAnswer()
+}
+
+func (e *hotSwapExec) EnablesDNSSECPassthrough() bool {
+	d, ok := e.current().p.(DNSSECPassthroughEnabler)
+	return ok && d.EnablesDNSSECPassthrough()
+}
+
+// hotSwapMatcher is the MatcherPlugin view of a hotSwapPlugin.
+type hotSwapMatcher struct {
+	*hotSwapPlugin
+}
+
+func (m *hotSwapMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	return m.current().p.(executable_seq.Matcher).Match(ctx, qCtx)
+}
+
+// hotSwapHandler is the http.Handler view of a hotSwapPlugin.
+type hotSwapHandler struct {
+	*hotSwapPlugin
+}
+
+var _ APIPermissionRequirer = (*hotSwapHandler)(nil)
+
+func (s *hotSwapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.current().p.(http.Handler).ServeHTTP(w, req)
+}
+
+func (s *hotSwapHandler) RequiredAPIPermission(req *http.Request) APIPermission {
+	if r, ok := s.current().p.(APIPermissionRequirer); ok {
+		return r.RequiredAPIPermission(req)
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return APIPermRead
+	}
+	return APIPermFull
+}
+
+// addHotSwapPlugin adds the views of h that the current instance implements.
+func (m *Mosdns) addHotSwapPlugin(h *hotSwapPlugin) {
+	m.hotSwapPlugins[h.tag] = h
+	p := h.current().p
+	if _, ok := p.(executable_seq.Executable); ok {
+		m.addPlugin(&hotSwapExec{h})
+	}
+	if _, ok := p.(executable_seq.Matcher); ok {
+		m.addPlugin(&hotSwapMatcher{h})
+	}
+	if _, ok := p.(http.Handler); ok {
+		m.httpAPIMux.Handle(fmt.Sprintf("/plugins/%s/", h.tag), &hotSwapHandler{h})
+	}
+}
+
+type hotSwapPluginInfo struct {
+	Tag  string      `json:"tag"`
+	Type string      `json:"type"`
+	Args interface{} `json:"args,omitempty"`
+}
+
+// hotSwapAPI serves the plugin hot swap api.
+//
+//	GET /hot_swap/       lists the plugins that can be replaced.
+//	GET /hot_swap/<tag>  shows the current args of the plugin. Args may
+//	                     hold secrets, so it requires the full permission.
+//	PUT /hot_swap/<tag>  replaces the plugin with new args. The body is
+//	                     the args in yaml or json. The replaced instance
+//	                     is closed after 30s. Metrics of the plugin are reset.
+type hotSwapAPI struct {
+	m *Mosdns
+}
+
+var _ APIPermissionRequirer = (*hotSwapAPI)(nil)
+
+// initHotSwapAPI mounts the hot swap api if it is enabled. The api can
+// run hooks and scripts with new args, so it is refused without tokens.
+func (m *Mosdns) initHotSwapAPI(cfg *APIConfig) error {
+	if !cfg.HotSwap {
+		return nil
+	}
+	if len(cfg.Tokens) == 0 {
+		return errors.New("api.hot_swap requires api.tokens")
+	}
+	m.httpAPIMux.Handle("/hot_swap/", &hotSwapAPI{m: m})
+	return nil
+}
+
+func (a *hotSwapAPI) RequiredAPIPermission(req *http.Request) APIPermission {
+	tag := strings.Trim(strings.TrimPrefix(req.URL.Path, "/hot_swap/"), "/")
+	if len(tag) == 0 && req.Method == http.MethodGet {
+		return APIPermRead
+	}
+	return APIPermFull
+}
+
+func (a *hotSwapAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tag := strings.Trim(strings.TrimPrefix(req.URL.Path, "/hot_swap/"), "/")
+	if len(tag) == 0 {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		l := make([]hotSwapPluginInfo, 0, len(a.m.hotSwapPlugins))
+		for _, h := range a.m.hotSwapPlugins {
+			l = append(l, hotSwapPluginInfo{Tag: h.tag, Type: h.typ})
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i].Tag < l[j].Tag })
+		writeJSON(w, l)
+		return
+	}
+
+	h := a.m.hotSwapPlugins[tag]
+	if h == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("plugin %s not found", tag))
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, hotSwapPluginInfo{Tag: h.tag, Type: h.typ, Args: h.current().args})
+	case http.MethodPut:
+		b, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		var args interface{}
+		if err := yaml.Unmarshal(b, &args); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid args, %w", err))
+			return
+		}
+		if err := h.swap(args); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("failed to init new instance, %w", err))
+			return
+		}
+		a.m.logger.Info("plugin replaced", zap.String("tag", h.tag), zap.String("type", h.typ))
+		writeJSON(w, hotSwapPluginInfo{Tag: h.tag, Type: h.typ, Args: args})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_hotSwap(t *testing.T) {
+	cfg := &Config{
+		Plugins: []PluginConfig{
+			{Tag: "local", Type: "test_answer", Args: map[string]interface{}{"ip": "192.168.1.1"}},
+			{Tag: "remote", Type: "test_answer", Args: map[string]interface{}{"ip": "1.1.1.1"}},
+			{Tag: "main", Type: "test_router", Args: map[string]interface{}{"local": "local", "remote": "remote"}},
+		},
+	}
+	m := newMosdns(zap.NewNop())
+	defer m.scheduler.Close()
+	if err := m.loadPlugins(cfg); err != nil {
+		t.Fatal(err)
+	}
+	api := &hotSwapAPI{m: m}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	resolve := func() string {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		if err := m.execs["main"].Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R().Answer[0].(*dns.A).A.String()
+	}
+
+	if got := resolve(); got != "1.1.1.1" {
+		t.Fatalf("want 1.1.1.1, got %s", got)
+	}
+
+	if w := do(http.MethodPut, "/hot_swap/remote", "ip: 2.2.2.2"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d, %s", w.Code, w.Body)
+	}
+	if got := resolve(); got != "2.2.2.2" {
+		t.Fatalf("want 2.2.2.2, got %s", got)
+	}
+	if m.scheduler.Get("plugin/remote/noop") == nil {
+		t.Fatal("task of the new instance is missing")
+	}
+	if w := do(http.MethodGet, "/hot_swap/remote", ""); !strings.Contains(w.Body.String(), "2.2.2.2") {
+		t.Fatalf("unexpected args %s", w.Body)
+	}
+
+	// Invalid args keep the current instance.
+	if w := do(http.MethodPut, "/hot_swap/remote", `{"ip": "invalid"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if got := resolve(); got != "2.2.2.2" {
+		t.Fatalf("want 2.2.2.2, got %s", got)
+	}
+	if m.scheduler.Get("plugin/remote/noop") == nil {
+		t.Fatal("task of the current instance is not restored")
+	}
+	if !hasMetric(t, m, "mosdns_plugin_remote_query_total") {
+		t.Fatal("metrics of the current instance are unregistered")
+	}
+
+	// Args that refer to the plugin itself form a loop.
+	if w := do(http.MethodPut, "/hot_swap/main", "{local: local, remote: main}"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "main -> main") {
+		t.Fatalf("unexpected status %d, %s", w.Code, w.Body)
+	}
+	if got := resolve(); got != "2.2.2.2" {
+		t.Fatalf("want 2.2.2.2, got %s", got)
+	}
+
+	if w := do(http.MethodPut, "/hot_swap/not_exist", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/hot_swap/", ""); !strings.Contains(w.Body.String(), `"tag":"main"`) {
+		t.Fatalf("unexpected list %s", w.Body)
+	}
+
+	// Args may hold expanded secrets.
+	if p := api.RequiredAPIPermission(httptest.NewRequest(http.MethodGet, "/hot_swap/remote", nil)); p != APIPermFull {
+		t.Fatalf("args require %s", p)
+	}
+	if p := api.RequiredAPIPermission(httptest.NewRequest(http.MethodGet, "/hot_swap/", nil)); p != APIPermRead {
+		t.Fatalf("list requires %s", p)
+	}
+}
+
+func hasMetric(t *testing.T, m *Mosdns, name string) bool {
+	t.Helper()
+	mfs, err := m.metricsReg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_initHotSwapAPI(t *testing.T) {
+	routed := func(m *Mosdns) bool {
+		_, pattern := m.httpAPIMux.Handler(httptest.NewRequest(http.MethodGet, "/hot_swap/", nil))
+		return pattern == "/hot_swap/"
+	}
+	tokens := []APITokenConfig{{Name: "admin", Token: "secret", Permissions: []string{"full"}}}
+	tests := []struct {
+		name       string
+		cfg        APIConfig
+		wantErr    bool
+		wantRouted bool
+	}{
+		{name: "disabled", cfg: APIConfig{Tokens: tokens}},
+		{name: "no tokens", cfg: APIConfig{HotSwap: true}, wantErr: true},
+		{name: "enabled", cfg: APIConfig{HotSwap: true, Tokens: tokens}, wantRouted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMosdns(zap.NewNop())
+			defer m.scheduler.Close()
+			if err := m.initHotSwapAPI(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Fatalf("initHotSwapAPI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := routed(m); got != tt.wantRouted {
+				t.Fatalf("want routed %v, got %v", tt.wantRouted, got)
+			}
+		})
+	}
+}
@@ -42,3 +42,16 @@ type MatcherPlugin interface {
 	Plugin
 	executable_seq.Matcher
 }
+
+// AnswerModifier is an optional interface of ExecutablePlugin.
+// It is implemented by plugins that rewrite records of responses
+// even if the DNSSEC pass-through mode is enabled.
+type AnswerModifier interface {
+	ModifiesAnswer() bool
+}
+
+// DNSSECPassthroughEnabler is an optional interface of ExecutablePlugin.
+// It is implemented by plugins that enable the DNSSEC pass-through mode.
+type DNSSECPassthroughEnabler interface {
+	EnablesDNSSECPassthrough() bool
+}
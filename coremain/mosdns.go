@@ -20,23 +20,50 @@
 package coremain
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/acme_cert"
 	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server"
+	"github.com/IrineSistiana/mosdns/v4/pkg/systemd"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const defaultDrainTimeout = time.Second * 5
+
+var shutdownRequest struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func init() {
+	shutdownRequest.c = make(chan struct{})
+}
+
+// requestShutdown asks the running mosdns to shut down gracefully, as
+// SIGTERM does.
+func requestShutdown() {
+	shutdownRequest.once.Do(func() { close(shutdownRequest.c) })
+}
+
 type Mosdns struct {
 	logger *zap.Logger
 
@@ -44,32 +71,42 @@ type Mosdns struct {
 	dataManager *data_provider.DataManager
 
 	// Plugins
-	execs    map[string]executable_seq.Executable
-	matchers map[string]executable_seq.Matcher
+	execs          map[string]executable_seq.Executable
+	matchers       map[string]executable_seq.Matcher
+	hotSwapPlugins map[string]*hotSwapPlugin
 
 	httpAPIMux    *http.ServeMux
 	httpAPIServer *http.Server
 
-	metricsReg *prometheus.Registry
+	metricsReg   *prometheus.Registry
+	scheduler    *scheduler.Scheduler
+	startTime    time.Time
+	queriesTotal prometheus.Counter // queries of all servers
+
+	sc      *safe_close.SafeClose
+	servers []*server.Server
+
+	// queryTracer traces selected queries. It is nil if the Mosdns is not
+	// created by RunMosdns.
+	queryTracer *queryTracer
+
+	// dryRun is set by "mosdns validate". Servers and background services
+	// are checked but not started.
+	dryRun bool
 
-	sc *safe_close.SafeClose
+	// acme is nil if ACME is not enabled.
+	acme *acme_cert.Manager
 }
 
 func RunMosdns(cfg *Config) error {
-	lg, err := mlog.NewLogger(&cfg.Log)
+	lg, closeLog, err := mlog.NewLogger(&cfg.Log)
 	if err != nil {
 		return fmt.Errorf("failed to init logger: %w", err)
 	}
+	defer closeLog()
 
-	m := &Mosdns{
-		logger:      lg,
-		dataManager: data_provider.NewDataManager(),
-		execs:       make(map[string]executable_seq.Executable),
-		matchers:    make(map[string]executable_seq.Matcher),
-		httpAPIMux:  http.NewServeMux(),
-		metricsReg:  newMetricsReg(),
-		sc:          safe_close.NewSafeClose(),
-	}
+	m := newMosdns(lg)
+	defer m.scheduler.Close()
 
 	m.httpAPIMux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
 	m.httpAPIMux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -77,79 +114,95 @@ func RunMosdns(cfg *Config) error {
 	m.httpAPIMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	m.httpAPIMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	m.httpAPIMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.httpAPIMux.Handle("/scheduler/", m.scheduler)
+	if err := m.initHotSwapAPI(&cfg.API); err != nil {
+		return fmt.Errorf("failed to init hot swap api, %w", err)
+	}
+	m.httpAPIMux.Handle("/plugin_types", pluginCapabilitiesAPI{})
+	m.queryTracer = newQueryTracer(m, &cfg.Trace)
+	if err := m.initOTLP(&cfg.Trace.OTLP); err != nil {
+		return fmt.Errorf("failed to init otlp trace export, %w", err)
+	}
+	m.httpAPIMux.Handle("/trace/", m.queryTracer)
+	m.httpAPIMux.Handle("/data_providers/", &dataProviderAPI{m: m})
+	if cfg.API.Dashboard {
+		m.httpAPIMux.Handle("/dashboard/api/", &dashboardAPI{m: m})
+	}
 
-	// Init data manager
-	dupTag := make(map[string]struct{})
-	for _, dpc := range cfg.DataProviders {
-		if len(dpc.Tag) == 0 {
-			continue
-		}
-		if _, ok := dupTag[dpc.Tag]; ok {
-			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
-		}
-		dupTag[dpc.Tag] = struct{}{}
-
-		dp, err := data_provider.NewDataProvider(lg, dpc)
+	var apiHandler http.Handler = m.httpAPIMux
+	if len(cfg.API.Tokens) > 0 {
+		auth, err := newAPIAuth(lg.Named("api"), m.httpAPIMux, cfg.API.Tokens)
 		if err != nil {
-			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
+			return fmt.Errorf("failed to init api tokens, %w", err)
 		}
-		m.dataManager.AddDataProvider(dpc.Tag, dp)
+		apiHandler = auth
+	}
+	if cfg.API.Dashboard {
+		// The page itself has no data. It asks the user for the api token.
+		apiHandler = withDashboardPage(apiHandler)
 	}
 
-	// Init preset plugins
-	for tag, f := range LoadNewPersetPluginFuncs() {
-		p, err := f(NewBP(tag, "preset", m.logger, m))
-		if err != nil {
-			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
+	if len(cfg.ACME.Domains) > 0 {
+		if err := m.initACME(&cfg.ACME); err != nil {
+			return fmt.Errorf("failed to init acme, %w", err)
 		}
-		m.addPlugin(p)
 	}
 
-	// Init plugins
-	dupTag = make(map[string]struct{})
-	for i, pc := range cfg.Plugins {
-		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
-			continue
+	if err := m.loadPlugins(cfg); err != nil {
+		return err
+	}
+
+	if len(cfg.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	m.queryTracer.defaultEntry = cfg.Servers[0].Exec
+
+	var st *selfTest
+	if stc := &cfg.SelfTest; len(stc.Queries) > 0 {
+		tag := stc.Entry
+		if len(tag) == 0 {
+			tag = cfg.Servers[0].Exec
 		}
-		if _, dup := dupTag[pc.Tag]; dup {
-			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+		entry := m.execs[tag]
+		if entry == nil {
+			return fmt.Errorf("cannot find self-test entry %s", tag)
 		}
-		dupTag[pc.Tag] = struct{}{}
-
-		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
-		p, err := NewPlugin(&pc, m.logger, m)
+		st, err = newSelfTest(lg.Named("self_test"), entry, stc)
 		if err != nil {
-			return fmt.Errorf("failed to init plugin #%d, %w", i, err)
-		}
-
-		m.addPlugin(p)
-		// Also add it to api mux if plugin implements http.Handler.
-		if h, ok := p.(http.Handler); ok {
-			m.httpAPIMux.Handle(fmt.Sprintf("/plugins/%s/", p.Tag()), h)
+			return fmt.Errorf("failed to init self-test, %w", err)
 		}
+		m.GetMetricsReg().MustRegister(st.healthy)
+		m.httpAPIMux.Handle("/self_test", st)
 	}
 
-	if len(cfg.Servers) == 0 {
-		return errors.New("no server is configured")
-	}
 	for i, sc := range cfg.Servers {
 		if err := m.startServers(&sc); err != nil {
 			return fmt.Errorf("failed to start server #%d, %w", i, err)
 		}
 	}
+	if st != nil {
+		if err := m.startSelfTest(st, time.Duration(cfg.SelfTest.Interval)*time.Second, cfg.SelfTest.Fatal); err != nil {
+			return fmt.Errorf("failed to start self-test, %w", err)
+		}
+	}
 
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
 		httpServer := &http.Server{
 			Addr:    httpAddr,
-			Handler: m.httpAPIMux,
+			Handler: apiHandler,
+		}
+		// Listens here, so the port is bound before the privilege is dropped.
+		l, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start api http server, %w", err)
 		}
 		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
 			errChan := make(chan error, 1)
 			go func() {
 				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
+				errChan <- httpServer.Serve(l)
 			}()
 			select {
 			case err := <-errChan:
@@ -160,23 +213,227 @@ func RunMosdns(cfg *Config) error {
 		})
 	}
 
+	if len(cfg.User) > 0 {
+		if err := dropPrivilege(cfg.User); err != nil {
+			return fmt.Errorf("failed to switch to user %s, %w", cfg.User, err)
+		}
+		m.logger.Info("switched user", zap.String("user", cfg.User))
+	}
+
 	time.AfterFunc(time.Second*1, func() {
 		runtime.GC()
 		debug.FreeOSMemory()
 	})
-	<-m.sc.ReceiveCloseSignal()
+	m.notifySystemd("READY=1")
+	if err := m.startWatchdog(); err != nil {
+		m.logger.Warn("failed to start systemd watchdog", zap.Error(err))
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	graceful := true
+	select {
+	case sig := <-sigChan:
+		m.logger.Info("signal received", zap.Stringer("signal", sig))
+	case <-shutdownRequest.c:
+		m.logger.Info("shutdown requested")
+	case <-m.sc.ReceiveCloseSignal():
+		graceful = false
+	}
+	if graceful {
+		drainTimeout := defaultDrainTimeout
+		if cfg.DrainTimeout > 0 {
+			drainTimeout = time.Duration(cfg.DrainTimeout) * time.Second
+		}
+		m.logger.Info("draining in-flight queries", zap.Duration("timeout", drainTimeout))
+		m.notifySystemd("STOPPING=1")
+		m.shutdownServers(drainTimeout)
+		m.sc.SendCloseSignal(nil)
+	}
 	m.sc.Done()
 	m.sc.CloseWait()
+	m.closePlugins()
 	return m.sc.Err()
 }
 
+// shutdownServers stops servers from accepting new queries and waits
+// for in-flight queries to be answered within timeout.
+func (m *Mosdns) shutdownServers(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	wg := new(sync.WaitGroup)
+	for _, s := range m.servers {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				m.logger.Warn("failed to drain in-flight queries", zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// notifySystemd sends state to systemd if mosdns is a notify service.
+func (m *Mosdns) notifySystemd(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		m.logger.Warn("failed to notify systemd", zap.String("state", state), zap.Error(err))
+	}
+}
+
+// startWatchdog sends keepalives to the systemd watchdog if it is enabled.
+func (m *Mosdns) startWatchdog() error {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	_, err = m.scheduler.Add(scheduler.TaskOpts{
+		Name: "systemd/watchdog",
+		Func: func(context.Context) error {
+			m.notifySystemd("WATCHDOG=1")
+			return nil
+		},
+		Schedule: scheduler.Every(interval / 2),
+	})
+	return err
+}
+
+// closePlugins closes all plugins, e.g. connections of upstreams.
+func (m *Mosdns) closePlugins() {
+	for tag, p := range m.hotSwapPlugins {
+		if err := p.Close(); err != nil {
+			m.logger.Warn("failed to close plugin", zap.String("tag", tag), zap.Error(err))
+		}
+	}
+}
+
+func newMosdns(lg *zap.Logger) *Mosdns {
+	m := &Mosdns{
+		logger:         lg,
+		dataManager:    data_provider.NewDataManager(),
+		execs:          make(map[string]executable_seq.Executable),
+		matchers:       make(map[string]executable_seq.Matcher),
+		hotSwapPlugins: make(map[string]*hotSwapPlugin),
+		httpAPIMux:     http.NewServeMux(),
+		metricsReg:     newMetricsReg(),
+		scheduler:      scheduler.NewScheduler(lg.Named("scheduler")),
+		startTime:      time.Now(),
+		queriesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "queries_total",
+			Help: "The total number of queries received by all servers",
+		}),
+		sc: safe_close.NewSafeClose(),
+	}
+	m.GetMetricsReg().MustRegister(m.queriesTotal)
+	return m
+}
+
+// loadPlugins inits data providers and plugins from cfg. It stops at the
+// first error.
+func (m *Mosdns) loadPlugins(cfg *Config) error {
+	var err error
+	m.initPlugins(cfg, func(e *configError) bool {
+		err = e.err
+		return false
+	})
+	return err
+}
+
+// configError is an error of an entry of the config.
+type configError struct {
+	section string // e.g. "plugins", "servers"
+	tag     string // The tag, "#<index>" of servers, or empty for top-level entries.
+	err     error
+}
+
+func (e *configError) Error() string {
+	if len(e.tag) == 0 {
+		return fmt.Sprintf("%s: %v", e.section, e.err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.section, e.tag, e.err)
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// initPlugins inits data providers and plugins from cfg. Errors are
+// passed to onErr. It stops if onErr returns false.
+func (m *Mosdns) initPlugins(cfg *Config, onErr func(e *configError) (keepGoing bool)) {
+	// Init data manager
+	dupTag := make(map[string]struct{})
+	for _, dpc := range cfg.DataProviders {
+		if len(dpc.Tag) == 0 {
+			continue
+		}
+		if _, ok := dupTag[dpc.Tag]; ok {
+			if !onErr(&configError{section: "data_providers", tag: dpc.Tag, err: fmt.Errorf("duplicated provider tag %s", dpc.Tag)}) {
+				return
+			}
+			continue
+		}
+		dupTag[dpc.Tag] = struct{}{}
+
+		dp, err := data_provider.NewDataProvider(m.logger, m.scheduler, dpc)
+		if err != nil {
+			if !onErr(&configError{section: "data_providers", tag: dpc.Tag, err: fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)}) {
+				return
+			}
+			continue
+		}
+		m.GetMetricsReg().MustRegister(dp.Collectors()...)
+		m.dataManager.AddDataProvider(dpc.Tag, dp)
+	}
+
+	// Init preset plugins
+	for tag, f := range LoadNewPersetPluginFuncs() {
+		p, err := f(NewBP(tag, "preset", m.logger, m))
+		if err != nil {
+			if !onErr(&configError{section: "preset", tag: tag, err: fmt.Errorf("failed to init preset plugin %s, %w", tag, err)}) {
+				return
+			}
+			continue
+		}
+		m.addPlugin(p)
+	}
+
+	// Init plugins
+	dupTag = make(map[string]struct{})
+	for i, pc := range cfg.Plugins {
+		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
+			continue
+		}
+		if _, dup := dupTag[pc.Tag]; dup {
+			if !onErr(&configError{section: "plugins", tag: pc.Tag, err: fmt.Errorf("duplicated plugin tag %s", pc.Tag)}) {
+				return
+			}
+			continue
+		}
+		dupTag[pc.Tag] = struct{}{}
+
+		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
+		p, err := NewPlugin(&pc, m.logger, m)
+		if err != nil {
+			if !onErr(&configError{section: "plugins", tag: pc.Tag, err: fmt.Errorf("failed to init plugin #%d, %w", i, err)}) {
+				return
+			}
+			continue
+		}
+
+		// Plugins can be replaced at runtime by the hot swap api.
+		m.addHotSwapPlugin(newHotSwapPlugin(m, &pc, p))
+	}
+}
+
 func (m *Mosdns) addPlugin(p Plugin) {
 	t := p.Tag()
 	if p, ok := p.(ExecutablePlugin); ok {
-		m.execs[t] = p
+		m.execs[t] = &queryTraceExec{ExecutablePlugin: p}
 	}
 	if p, ok := p.(MatcherPlugin); ok {
-		m.matchers[p.Tag()] = p
+		m.matchers[p.Tag()] = &queryTraceMatcher{MatcherPlugin: p}
 	}
 }
 
@@ -188,6 +445,12 @@ func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
 	return m.sc
 }
 
+// GetScheduler returns the scheduler of periodic tasks. Task status is
+// available at api "/scheduler/tasks".
+func (m *Mosdns) GetScheduler() *scheduler.Scheduler {
+	return m.scheduler
+}
+
 func (m *Mosdns) GetExecutables() map[string]executable_seq.Executable {
 	return m.execs
 }
@@ -0,0 +1,345 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	otlpQueueSize     = 4096
+	otlpBatchSize     = 256
+	otlpFlushInterval = time.Second * 5
+	otlpTimeout       = time.Second * 10
+)
+
+// Span kinds and status codes of OTLP.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpStatusError      = 2
+)
+
+// otlpExporter sends query traces to an OTLP/HTTP collector in the JSON
+// encoding. Traces are queued and sent in batches. They are dropped if
+// the queue is full, so a slow collector will not block queries.
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	logger      *zap.Logger
+
+	queue     chan []otlpSpan
+	flushTask *scheduler.Task // triggered when a batch is queued
+
+	droppedTotal prometheus.Counter
+	errorsTotal  prometheus.Counter
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpString(k, v string) otlpAttribute {
+	return otlpAttribute{Key: k, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpBool(k string, v bool) otlpAttribute {
+	return otlpAttribute{Key: k, Value: otlpValue{BoolValue: &v}}
+}
+
+func newOTLPExporter(cfg *OTLPConfig, logger *zap.Logger) *otlpExporter {
+	serviceName := cfg.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = "mosdns"
+	}
+	return &otlpExporter{
+		endpoint:    cfg.Endpoint,
+		headers:     cfg.Headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: otlpTimeout},
+		logger:      logger,
+		queue:       make(chan []otlpSpan, otlpQueueSize),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "otlp_dropped_traces_total",
+			Help: "The total number of traces that were dropped because the export queue was full",
+		}),
+		errorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "otlp_export_errors_total",
+			Help: "The total number of failed trace exports",
+		}),
+	}
+}
+
+func (e *otlpExporter) collectors() []prometheus.Collector {
+	return []prometheus.Collector{e.droppedTotal, e.errorsTotal}
+}
+
+// export converts the trace of qCtx to spans and queues them. err is the
+// error of the entry.
+func (e *otlpExporter) export(qCtx *query_context.Context, resp *dns.Msg, err error, r *traceRecord) {
+	spans := otlpSpans(qCtx, resp, err, r)
+	select {
+	case e.queue <- spans:
+		if len(e.queue) >= otlpBatchSize && e.flushTask != nil {
+			e.flushTask.Trigger()
+		}
+	default:
+		e.droppedTotal.Inc()
+	}
+}
+
+// otlpSpans returns the root span of the query and a span of each event
+// of r. Events are nested by their parents, e.g. the plugins of a
+// sequence are children of the sequence.
+func otlpSpans(qCtx *query_context.Context, resp *dns.Msg, err error, r *traceRecord) []otlpSpan {
+	traceID := otlpRandomID(16)
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            otlpRandomID(8),
+		Name:              "query",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: otlpTime(r.Time),
+		EndTimeUnixNano:   otlpTime(r.Time.Add(time.Duration(r.DurationUs) * time.Microsecond)),
+		Attributes:        []otlpAttribute{otlpString("mosdns.trace_id", r.ID)},
+	}
+	if q := qCtx.QReadOnly(); len(q.Question) > 0 {
+		root.Attributes = append(root.Attributes,
+			otlpString("dns.question.name", q.Question[0].Name),
+			otlpString("dns.question.type", dns.TypeToString[q.Question[0].Qtype]),
+		)
+	}
+	if addr := qCtx.ReqMeta().ClientAddr; addr.IsValid() {
+		root.Attributes = append(root.Attributes, otlpString("client.address", addr.String()))
+	}
+	if resp != nil {
+		root.Attributes = append(root.Attributes, otlpString("dns.response.code", dns.RcodeToString[resp.Rcode]))
+	}
+	switch {
+	case err != nil:
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	case resp != nil && resp.Rcode == dns.RcodeServerFailure:
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: "SERVFAIL"}
+	}
+
+	spans := make([]otlpSpan, 0, len(r.Events)+1)
+	spans = append(spans, root)
+	spanIDs := make(map[int]string, len(r.Events)) // of event ids
+	for _, ev := range r.Events {
+		parentID := root.SpanID
+		if id, ok := spanIDs[ev.Parent]; ok {
+			parentID = id
+		}
+		start := r.Time.Add(time.Duration(ev.StartUs) * time.Microsecond)
+		s := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            otlpRandomID(8),
+			ParentSpanID:      parentID,
+			StartTimeUnixNano: otlpTime(start),
+			EndTimeUnixNano:   otlpTime(start.Add(time.Duration(ev.DurationUs) * time.Microsecond)),
+		}
+		if ev.Kind == "upstream" {
+			s.Name = "exchange " + ev.Tag
+			s.Kind = otlpSpanKindClient
+			s.Attributes = []otlpAttribute{otlpString("server.address", ev.Tag)}
+		} else {
+			s.Name = ev.Tag
+			s.Kind = otlpSpanKindInternal
+			s.Attributes = []otlpAttribute{
+				otlpString("mosdns.plugin.tag", ev.Tag),
+				otlpString("mosdns.plugin.type", ev.Type),
+				otlpString("mosdns.plugin.kind", ev.Kind),
+			}
+			if ev.Matched != nil {
+				s.Attributes = append(s.Attributes, otlpBool("mosdns.plugin.matched", *ev.Matched))
+			}
+		}
+		if len(ev.Err) > 0 {
+			s.Status = &otlpStatus{Code: otlpStatusError, Message: ev.Err}
+		}
+		spanIDs[ev.ID] = s.SpanID
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+func otlpRandomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// flush sends the queued spans in batches of otlpBatchSize.
+func (e *otlpExporter) flush(ctx context.Context) error {
+	var batch []otlpSpan
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := e.send(ctx, batch)
+		if err != nil {
+			e.errorsTotal.Inc()
+			e.logger.Warn("failed to export traces", zap.Error(err))
+		}
+		batch = nil
+		return err
+	}
+	var lastErr error
+	for {
+		select {
+		case spans := <-e.queue:
+			batch = append(batch, spans...)
+			if len(batch) >= otlpBatchSize {
+				if err := send(); err != nil {
+					lastErr = err
+				}
+			}
+		default:
+			if err := send(); err != nil {
+				lastErr = err
+			}
+			return lastErr
+		}
+	}
+}
+
+func (e *otlpExporter) send(ctx context.Context, spans []otlpSpan) error {
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{{Spans: spans}}}
+	rs.Resource.Attributes = []otlpAttribute{otlpString("service.name", e.serviceName)}
+	rs.ScopeSpans[0].Scope.Name = "mosdns"
+	b, err := json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{ResourceSpans: []resourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s, %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// initOTLP starts the export of traces if it is configured.
+func (m *Mosdns) initOTLP(cfg *OTLPConfig) error {
+	if len(cfg.Endpoint) == 0 {
+		if cfg.SampleRatio != 0 {
+			return errors.New("sample_ratio requires an otlp endpoint")
+		}
+		return nil
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("invalid sample_ratio %v, must be 0~1", cfg.SampleRatio)
+	}
+	e := newOTLPExporter(cfg, m.logger.Named("otlp"))
+	m.GetMetricsReg().MustRegister(e.collectors()...)
+	m.queryTracer.exporter = e
+	m.queryTracer.sampleRatio = cfg.SampleRatio
+	var err error
+	e.flushTask, err = m.scheduler.Add(scheduler.TaskOpts{
+		Name:     "otlp/flush",
+		Func:     e.flush,
+		Schedule: scheduler.Every(otlpFlushInterval),
+	})
+	if err != nil {
+		return err
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		<-closeSignal
+		// Send the remaining spans.
+		e.flushTask.Cancel()
+		_ = e.flush(context.Background())
+	})
+	return nil
+}
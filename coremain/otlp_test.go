@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_otlpExporter(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	m, qt := newTestTraceMosdns(t, &TraceConfig{})
+	e := newOTLPExporter(&OTLPConfig{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer x"}}, zap.NewNop())
+	qt.exporter = e
+	qt.sampleRatio = 1
+
+	q := new(dns.Msg)
+	q.SetQuestion("nas.local.", dns.TypeA)
+	qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("10.0.0.1")})
+	qt.StartTrace(qCtx)
+	if !qCtx.Trace().Sampled() {
+		t.Fatal("query is not sampled")
+	}
+	if err := m.execs["main"].Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+	ev := qCtx.Trace().Begin(context.Background(), "udp://1.1.1.1", "upstream", "upstream")
+	qCtx.Trace().Update(ev, func(ev *query_context.TraceEvent) { ev.Err = "timeout" })
+	qt.FinishTrace(qCtx, qCtx.R(), nil)
+	if len(qt.recent) != 0 {
+		t.Fatal("sampled trace should not be kept")
+	}
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer x" {
+		t.Fatalf("unexpected header %q", auth)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected body %+v", got)
+	}
+	if a := got.ResourceSpans[0].Resource.Attributes; len(a) != 1 || *a[0].Value.StringValue != "mosdns" {
+		t.Fatalf("unexpected resource %+v", a)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	root := spans[0]
+	if root.Name != "query" || root.Kind != otlpSpanKindServer || len(root.TraceID) != 32 || len(root.SpanID) != 16 {
+		t.Fatalf("unexpected root span %+v", root)
+	}
+	attrs := make(map[string]string)
+	for _, a := range root.Attributes {
+		attrs[a.Key] = *a.Value.StringValue
+	}
+	if attrs["dns.question.name"] != "nas.local." || attrs["client.address"] != "10.0.0.1" || attrs["dns.response.code"] != "NOERROR" {
+		t.Fatalf("unexpected root attributes %v", attrs)
+	}
+	if root.Status != nil {
+		t.Fatalf("unexpected root status %+v", root.Status)
+	}
+	for _, s := range spans[1:] {
+		if s.TraceID != root.TraceID {
+			t.Fatalf("span %s is not in the trace", s.Name)
+		}
+	}
+	// local is executed by main.
+	if spans[1].ParentSpanID != root.SpanID || spans[2].ParentSpanID != spans[1].SpanID || spans[3].ParentSpanID != root.SpanID {
+		t.Fatalf("unexpected span parents %+v", spans)
+	}
+	if spans[1].Name != "main" || spans[2].Name != "local" || spans[1].Kind != otlpSpanKindInternal {
+		t.Fatalf("unexpected plugin spans %+v", spans[1:3])
+	}
+	if u := spans[3]; u.Name != "exchange udp://1.1.1.1" || u.Kind != otlpSpanKindClient || u.Status == nil || u.Status.Code != otlpStatusError {
+		t.Fatalf("unexpected upstream span %+v", u)
+	}
+}
+
+func Test_otlpSpans_status(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	qCtx.SetTrace(query_context.NewSampledTrace("s1"))
+	r := &traceRecord{Time: time.Now()}
+
+	servfail := new(dns.Msg)
+	servfail.SetRcode(q, dns.RcodeServerFailure)
+	if s := otlpSpans(qCtx, servfail, nil, r)[0].Status; s == nil || s.Code != otlpStatusError || s.Message != "SERVFAIL" {
+		t.Fatalf("unexpected status of SERVFAIL %+v", s)
+	}
+	if s := otlpSpans(qCtx, servfail, errors.New("entry failed"), r)[0].Status; s == nil || s.Message != "entry failed" {
+		t.Fatalf("unexpected status of the entry error %+v", s)
+	}
+	ok := new(dns.Msg)
+	ok.SetReply(q)
+	if s := otlpSpans(qCtx, ok, nil, r)[0].Status; s != nil {
+		t.Fatalf("unexpected status of NOERROR %+v", s)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const filePlaceholderPrefix = "file:"
+
+// expandPlaceholders expands placeholders in all string values of v,
+// which is a value decoded from the config. path is the key of v, it is
+// used in errors.
+func expandPlaceholders(v interface{}, path string) (interface{}, error) {
+	join := func(k string) string {
+		if len(path) == 0 {
+			return k
+		}
+		return path + "." + k
+	}
+	switch v := v.(type) {
+	case string:
+		s, err := expandString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return s, nil
+	case map[string]interface{}:
+		for k, e := range v {
+			ne, err := expandPlaceholders(e, join(k))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ne
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			ne, err := expandPlaceholders(e, join(fmt.Sprint(k)))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ne
+		}
+	case []interface{}:
+		for i, e := range v {
+			ne, err := expandPlaceholders(e, join(strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = ne
+		}
+	}
+	return v, nil
+}
+
+// expandString expands placeholders in s.
+// "${NAME}" is replaced by the environment variable NAME. It is an error
+// if NAME is not set.
+// "${file:/path}" is replaced by the content of the file, without the
+// trailing newline. e.g. a secret mounted by docker or systemd.
+// "$${" is an escaped "${".
+func expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	b := new(strings.Builder)
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' { // escaped
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed placeholder in %q", s)
+		}
+		name := s[i+2 : i+end]
+		v, err := placeholderValue(name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		s = s[i+end+1:]
+	}
+}
+
+func placeholderValue(name string) (string, error) {
+	if strings.HasPrefix(name, filePlaceholderPrefix) {
+		p := strings.TrimPrefix(name, filePlaceholderPrefix)
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("failed to read placeholder file, %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if len(name) == 0 {
+		return "", errors.New("empty placeholder")
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
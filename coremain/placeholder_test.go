@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_expandString(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_ADDR", "1.1.1.1")
+	t.Setenv("MOSDNS_TEST_EMPTY", "")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "no placeholder", want: "no placeholder"},
+		{s: "udp://${MOSDNS_TEST_ADDR}:53", want: "udp://1.1.1.1:53"},
+		{s: "${MOSDNS_TEST_ADDR}${MOSDNS_TEST_EMPTY}${MOSDNS_TEST_ADDR}", want: "1.1.1.11.1.1.1"},
+		{s: "Bearer ${file:" + secret + "}", want: "Bearer token"},
+		{s: "$${MOSDNS_TEST_ADDR}", want: "${MOSDNS_TEST_ADDR}"},
+		{s: "$ {} $", want: "$ {} $"},
+		{s: "${MOSDNS_TEST_NOT_SET}", wantErr: true},
+		{s: "${file:" + secret + ".not_exist}", wantErr: true},
+		{s: "${MOSDNS_TEST_ADDR", wantErr: true},
+		{s: "${}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandString(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("expandString(%q) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Fatalf("expandString(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_loadConfig_placeholder(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_TOKEN", "secret")
+	f := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(f, []byte(`
+api:
+  http: "127.0.0.1:${MOSDNS_TEST_PORT}"
+  tokens:
+    - token: ${MOSDNS_TEST_TOKEN}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := loadConfig(f)
+	if err == nil {
+		t.Fatal("want err of missing variable")
+	}
+	if want := "api.http: environment variable MOSDNS_TEST_PORT is not set"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("want err contains %q, got %v", want, err)
+	}
+
+	t.Setenv("MOSDNS_TEST_PORT", "8080")
+	cfg, _, err := loadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.API.HTTP != "127.0.0.1:8080" || cfg.API.Tokens[0].Token != "secret" {
+		t.Fatalf("unexpected api config %+v", cfg.API)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// PluginCapabilities describes the plugins that are compiled into this build.
+type PluginCapabilities struct {
+	Types   []PluginTypeSchema `json:"types"`
+	Presets []string           `json:"presets"` // tags of preset plugins
+}
+
+// PluginTypeSchema describes the args of a plugin type.
+type PluginTypeSchema struct {
+	Type string `json:"type"`
+
+	// Args is the schema of the args. It is nil if the plugin type
+	// has no args.
+	Args *ArgSchema `json:"args,omitempty"`
+}
+
+// ArgSchema describes an arg. It is generated from the args struct and
+// its yaml tags.
+type ArgSchema struct {
+	Name string `json:"name,omitempty"` // Empty for the root, list elems and map values.
+
+	// Type is one of "string", "bool", "int", "uint", "float", "list",
+	// "map", "object" and "any".
+	Type string `json:"type"`
+
+	Fields []*ArgSchema `json:"fields,omitempty"` // Fields of an object.
+	Elem   *ArgSchema   `json:"elem,omitempty"`   // Elem of a list or value of a map.
+}
+
+// GetPluginCapabilities returns the capabilities of this build. Types and
+// presets are sorted.
+func GetPluginCapabilities() *PluginCapabilities {
+	c := new(PluginCapabilities)
+	for _, typ := range GetAllPluginTypes() {
+		info, _ := GetPluginType(typ)
+		s := PluginTypeSchema{Type: typ}
+		if info.NewArgs != nil {
+			s.Args = argSchemaOf(reflect.TypeOf(info.NewArgs()), nil)
+		}
+		c.Types = append(c.Types, s)
+	}
+	sort.Slice(c.Types, func(i, j int) bool { return c.Types[i].Type < c.Types[j].Type })
+	for tag := range LoadNewPersetPluginFuncs() {
+		c.Presets = append(c.Presets, tag)
+	}
+	sort.Strings(c.Presets)
+	return c
+}
+
+// argSchemaOf generates the schema of t. visiting contains the struct
+// types that are being generated, to stop at recursive types.
+func argSchemaOf(t reflect.Type, visiting map[reflect.Type]bool) *ArgSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &ArgSchema{Type: "string"}
+	case reflect.Bool:
+		return &ArgSchema{Type: "bool"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &ArgSchema{Type: "int"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &ArgSchema{Type: "uint"}
+	case reflect.Float32, reflect.Float64:
+		return &ArgSchema{Type: "float"}
+	case reflect.Slice, reflect.Array:
+		return &ArgSchema{Type: "list", Elem: argSchemaOf(t.Elem(), visiting)}
+	case reflect.Map:
+		return &ArgSchema{Type: "map", Elem: argSchemaOf(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return &ArgSchema{Type: "object"}
+		}
+		if visiting == nil {
+			visiting = make(map[reflect.Type]bool)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		s := &ArgSchema{Type: "object"}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if len(name) == 0 {
+				name = f.Name
+			}
+			fs := argSchemaOf(f.Type, visiting)
+			fs.Name = name
+			s.Fields = append(s.Fields, fs)
+		}
+		return s
+	default:
+		return &ArgSchema{Type: "any"}
+	}
+}
+
+// String returns the type in a short form, e.g. "list<string>".
+func (s *ArgSchema) String() string {
+	switch s.Type {
+	case "list", "map":
+		return fmt.Sprintf("%s<%s>", s.Type, s.Elem)
+	default:
+		return s.Type
+	}
+}
+
+// writeText writes the fields of s as an indented tree.
+func (s *ArgSchema) writeText(w io.Writer, indent string) {
+	for s.Type == "list" || s.Type == "map" {
+		s = s.Elem
+	}
+	for _, f := range s.Fields {
+		fmt.Fprintf(w, "%s%s: %s\n", indent, f.Name, f)
+		f.writeText(w, indent+"  ")
+	}
+}
+
+// JSONSchema returns s as a JSON Schema. Objects with known fields do not
+// allow additional properties, as the config decoder rejects unused keys.
+func (s *ArgSchema) JSONSchema() map[string]interface{} {
+	switch s.Type {
+	case "string":
+		return map[string]interface{}{"type": "string"}
+	case "bool":
+		return map[string]interface{}{"type": "boolean"}
+	case "int":
+		return map[string]interface{}{"type": "integer"}
+	case "uint":
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case "float":
+		return map[string]interface{}{"type": "number"}
+	case "list":
+		return map[string]interface{}{"type": "array", "items": s.Elem.JSONSchema()}
+	case "map":
+		return map[string]interface{}{"type": "object", "additionalProperties": s.Elem.JSONSchema()}
+	case "object":
+		js := map[string]interface{}{"type": "object"}
+		if len(s.Fields) > 0 {
+			props := make(map[string]interface{}, len(s.Fields))
+			for _, f := range s.Fields {
+				props[f.Name] = f.JSONSchema()
+			}
+			js["properties"] = props
+			js["additionalProperties"] = false
+		}
+		return js
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// ConfigJSONSchema returns the JSON Schema of the config. Args of plugins
+// are checked against the schema of their types.
+func ConfigJSONSchema() map[string]interface{} {
+	c := GetPluginCapabilities()
+	var types []string
+	var argsSchemas []interface{}
+	for _, t := range c.Types {
+		types = append(types, t.Type)
+		if t.Args == nil {
+			continue
+		}
+		argsSchemas = append(argsSchemas, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"type": map[string]interface{}{"const": t.Type}},
+				"required":   []string{"type"},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"args": t.Args.JSONSchema()},
+			},
+		})
+	}
+	plugin := argSchemaOf(reflect.TypeOf(PluginConfig{}), nil).JSONSchema()
+	plugin["properties"].(map[string]interface{})["type"] = map[string]interface{}{"enum": types}
+	plugin["required"] = []string{"tag", "type"}
+	plugin["allOf"] = argsSchemas
+
+	js := argSchemaOf(reflect.TypeOf(Config{}), nil).JSONSchema()
+	js["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	js["title"] = "mosdns config"
+	js["properties"].(map[string]interface{})["plugins"] = map[string]interface{}{
+		"type":  "array",
+		"items": plugin,
+	}
+	return js
+}
+
+// WriteConfigJSONSchema writes the indented ConfigJSONSchema to w.
+func WriteConfigJSONSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ConfigJSONSchema())
+}
+
+func newPluginsCmd() *cobra.Command {
+	var asJSON bool
+	c := &cobra.Command{
+		Use:   "plugins [--json]",
+		Short: "List plugin types and their args supported by this build.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writePluginCapabilities(cmd.OutOrStdout(), asJSON)
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	c.Flags().BoolVar(&asJSON, "json", false, "output in json")
+	return c
+}
+
+func writePluginCapabilities(w io.Writer, asJSON bool) error {
+	c := GetPluginCapabilities()
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	}
+	for _, t := range c.Types {
+		fmt.Fprintln(w, t.Type)
+		if t.Args != nil {
+			t.Args.writeText(w, "  ")
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "preset plugins:")
+	for _, tag := range c.Presets {
+		fmt.Fprintf(w, "  %s\n", tag)
+	}
+	return nil
+}
+
+// pluginCapabilitiesAPI serves "GET /plugin_types", the api equivalent
+// of "mosdns plugins --json".
+type pluginCapabilitiesAPI struct{}
+
+func (pluginCapabilitiesAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, GetPluginCapabilities())
+}
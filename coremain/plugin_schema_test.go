@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testSchemaArgs struct {
+	Name     string              `yaml:"name"`
+	Ignored  string              `yaml:"-"`
+	NoTag    int                 ``
+	Rules    []testSchemaRule    `yaml:"rules,omitempty"`
+	Values   map[string][]uint32 `yaml:"values"`
+	Any      interface{}         `yaml:"any"`
+	Next     *testSchemaArgs     `yaml:"next"`
+	internal bool
+}
+
+type testSchemaRule struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+func Test_argSchemaOf(t *testing.T) {
+	s := argSchemaOf(reflect.TypeOf(new(testSchemaArgs)), nil)
+	b := new(bytes.Buffer)
+	s.writeText(b, "")
+	want := `name: string
+NoTag: int
+rules: list<object>
+  enabled: bool
+values: map<list<uint>>
+any: any
+next: object
+`
+	if got := b.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func Test_ConfigJSONSchema(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := WriteConfigJSONSchema(b); err != nil {
+		t.Fatal(err)
+	}
+	js := make(map[string]interface{})
+	if err := json.Unmarshal(b.Bytes(), &js); err != nil {
+		t.Fatal(err)
+	}
+	props := js["properties"].(map[string]interface{})
+	for _, k := range []string{"log", "include", "plugins", "servers", "api"} {
+		if _, ok := props[k]; !ok {
+			t.Fatalf("missing property %s", k)
+		}
+	}
+
+	plugin := props["plugins"].(map[string]interface{})["items"].(map[string]interface{})
+	types := plugin["properties"].(map[string]interface{})["type"].(map[string]interface{})["enum"].([]interface{})
+	if len(types) != len(GetAllPluginTypes()) {
+		t.Fatalf("want %d plugin types, got %d", len(GetAllPluginTypes()), len(types))
+	}
+	if len(plugin["allOf"].([]interface{})) == 0 {
+		t.Fatal("missing args schemas")
+	}
+}
+
+func TestArgSchema_JSONSchema(t *testing.T) {
+	s := argSchemaOf(reflect.TypeOf(new(testSchemaArgs)), nil).JSONSchema()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"additionalProperties":false,"properties":{"NoTag":{"type":"integer"},"any":{},"name":{"type":"string"},` +
+		`"next":{"type":"object"},"rules":{"items":{"additionalProperties":false,"properties":{"enabled":{"type":"boolean"}},"type":"object"},"type":"array"},` +
+		`"values":{"additionalProperties":{"items":{"minimum":0,"type":"integer"},"type":"array"},"type":"object"}},"type":"object"}`
+	if string(b) != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, b)
+	}
+}
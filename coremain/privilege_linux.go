@@ -0,0 +1,81 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivilege switches the process to the user of s ("user" or
+// "user:group").
+func dropPrivilege(s string) error {
+	uid, gid, err := lookupUser(s)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() == uid && os.Getegid() == gid {
+		return nil
+	}
+	// The order matters. Groups cannot be changed after the uid is changed.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups, %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid, %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid, %w", err)
+	}
+	return nil
+}
+
+// lookupUser returns the uid and gid of s ("user" or "user:group").
+// The primary group of the user is used if s has no group.
+func lookupUser(s string) (uid, gid int, err error) {
+	userName, groupName, _ := strings.Cut(s, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if len(groupName) > 0 {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid %s", u.Uid)
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid %s", gidStr)
+	}
+	return uid, gid, nil
+}
@@ -20,6 +20,7 @@
 package coremain
 
 import (
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -87,13 +88,15 @@ func GetPluginType(typ string) (PluginTypeInfo, bool) {
 
 // NewPlugin initialize a Plugin from c.
 func NewPlugin(c *PluginConfig, lg *zap.Logger, m *Mosdns) (p Plugin, err error) {
+	return newPlugin(c, NewBP(c.Tag, c.Type, lg, m))
+}
+
+func newPlugin(c *PluginConfig, bp *BP) (p Plugin, err error) {
 	typeInfo, ok := GetPluginType(c.Type)
 	if !ok {
 		return nil, fmt.Errorf("plugin type %s not defined", c.Type)
 	}
 
-	bp := NewBP(c.Tag, c.Type, lg, m)
-
 	// parse args
 	if typeInfo.NewArgs != nil {
 		args := typeInfo.NewArgs()
@@ -167,6 +170,11 @@ type BP struct {
 	s *zap.SugaredLogger
 
 	m *Mosdns
+
+	// stagedMetrics, if not nil, indicates that the plugin replaces a
+	// running instance. Its metrics are kept here until it is initialized,
+	// and then replace the registered ones.
+	stagedMetrics *stagingRegisterer
 }
 
 // NewBP creates a new BP and initials its logger.
@@ -200,9 +208,70 @@ func (p *BP) M() *Mosdns {
 
 // GetMetricsReg return a prometheus.Registerer with a prefix of "plugin_${plugin_tag}_]"
 func (p *BP) GetMetricsReg() prometheus.Registerer {
+	if p.stagedMetrics != nil {
+		return prometheus.WrapRegistererWithPrefix(fmt.Sprintf("plugin_%s_", p.tag), p.stagedMetrics)
+	}
 	return prometheus.WrapRegistererWithPrefix(fmt.Sprintf("plugin_%s_", p.tag), p.m.GetMetricsReg())
 }
 
+// stagingRegisterer keeps the collectors of a new plugin instance, so
+// the metrics of the running instance are not touched if the new one
+// fails to initialize.
+type stagingRegisterer struct {
+	check *prometheus.Registry // finds collisions among the new collectors
+	cs    []prometheus.Collector
+}
+
+func newStagingRegisterer() *stagingRegisterer {
+	return &stagingRegisterer{check: prometheus.NewRegistry()}
+}
+
+func (r *stagingRegisterer) Register(c prometheus.Collector) error {
+	if err := r.check.Register(c); err != nil {
+		return err
+	}
+	r.cs = append(r.cs, c)
+	return nil
+}
+
+func (r *stagingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *stagingRegisterer) Unregister(c prometheus.Collector) bool {
+	if !r.check.Unregister(c) {
+		return false
+	}
+	for i, e := range r.cs {
+		if e == c {
+			r.cs = append(r.cs[:i], r.cs[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// commit registers the collectors to reg. They replace the registered
+// collectors that collide with them.
+func (r *stagingRegisterer) commit(reg prometheus.Registerer) error {
+	for _, c := range r.cs {
+		err := reg.Register(c)
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			reg.Unregister(are.ExistingCollector)
+			err = reg.Register(c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *BP) Close() error {
 	return nil
 }
@@ -28,7 +28,9 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 )
 
@@ -65,6 +67,7 @@ func init() {
 	fs := startCmd.Flags()
 	fs.StringVarP(&sf.c, "config", "c", "", "config file")
 	fs.StringVarP(&sf.dir, "dir", "d", "", "working dir")
+	markConfigFlags(startCmd)
 	fs.IntVar(&sf.cpu, "cpu", 0, "set runtime.GOMAXPROCS")
 	fs.BoolVar(&sf.asService, "as-service", false, "start as a service")
 	fs.MarkHidden("as-service")
@@ -83,6 +86,21 @@ func init() {
 		newSvcStatusCmd(),
 	)
 	rootCmd.AddCommand(serviceCmd)
+	rootCmd.AddCommand(newTestCmd())
+	rootCmd.AddCommand(newValidateCmd())
+	rootCmd.AddCommand(newGraphCmd())
+	rootCmd.AddCommand(newPluginsCmd())
+}
+
+// markConfigFlags adds shell completion hints to the config and dir flags
+// of c.
+func markConfigFlags(c *cobra.Command) {
+	exts := make([]string, 0, len(configExts))
+	for _, ext := range configExts {
+		exts = append(exts, strings.TrimPrefix(ext, "."))
+	}
+	c.MarkFlagFilename("config", exts...)
+	c.MarkFlagDirname("dir")
 }
 
 func AddSubCmd(c *cobra.Command) {
@@ -121,56 +139,136 @@ func StartServer(sf *serverFlags) error {
 	return nil
 }
 
+// configExts are the extensions of supported config formats. All formats
+// share the same schema, which uses the yaml field names.
+var configExts = []string{".yaml", ".yml", ".json", ".toml"}
+
+// isConfigFile reports whether the format of file is supported.
+func isConfigFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range configExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
 // loadConfig load a config from a file. If filePath is empty, it will
-// automatically search and load a file which name start with "config".
+// automatically search and load a file named "config" with one of
+// configExts in the current directory. The format is detected by the
+// file extension.
+// Placeholders in string values are expanded. See expandString.
 func loadConfig(filePath string) (*Config, string, error) {
-	v := viper.New()
-
-	if len(filePath) > 0 {
-		v.SetConfigFile(filePath)
-	} else {
-		v.SetConfigName("config")
-		v.AddConfigPath(".")
+	if len(filePath) == 0 {
+		for _, ext := range configExts {
+			if _, err := os.Stat("config" + ext); err == nil {
+				filePath = "config" + ext
+				break
+			}
+		}
+		if len(filePath) == 0 {
+			return nil, "", fmt.Errorf("cannot find config file config{%s} in the current directory", strings.Join(configExts, ","))
+		}
 	}
+	if !isConfigFile(filePath) {
+		return nil, "", fmt.Errorf("unsupported config format of %s, extension must be one of %v", filePath, configExts)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(filePath)
 
 	if err := v.ReadInConfig(); err != nil {
 		return nil, "", fmt.Errorf("failed to read config: %w", err)
 	}
 
-	decoderOpt := func(cfg *mapstructure.DecoderConfig) {
-		cfg.ErrorUnused = true
-		cfg.TagName = "yaml"
-		cfg.WeaklyTypedInput = true
+	settings, err := expandPlaceholders(v.AllSettings(), "")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to expand config: %w", err)
 	}
 
 	cfg := new(Config)
-	if err := v.Unmarshal(cfg, decoderOpt); err != nil {
+	// Same as viper.Unmarshal, but with the expanded settings.
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		ErrorUnused:      true,
+		Result:           cfg,
+		TagName:          "yaml",
+		WeaklyTypedInput: true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := decoder.Decode(settings); err != nil {
 		return nil, "", fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 	return cfg, v.ConfigFileUsed(), nil
 }
 
+// mergeInclude loads the files included by cfg and merges their data
+// providers, plugins and servers into cfg. Entries of included files come
+// first, in the order of cfg.Include. An include entry can be a file, a
+// directory (all its config files in lexical order, see configExts) or a
+// glob pattern (matched files in lexical order).
 func mergeInclude(cfg *Config, depth int, paths []string) error {
+	return mergeIncludeFiles(cfg, depth, paths, make(map[string]string))
+}
+
+// mergeIncludeFiles is mergeInclude that records the files of tags in
+// tagFiles to detect duplicated tags across files.
+func mergeIncludeFiles(cfg *Config, depth int, paths []string, tagFiles map[string]string) error {
 	depth++
 	if depth > 8 {
 		return fmt.Errorf("maximun include depth reached, include path is %s", strings.Join(paths, " -> "))
 	}
 
-	includedCfg := new(Config)
-	for _, subCfgFile := range cfg.Include {
-		subPaths := append(paths, subCfgFile)
-		mlog.L().Info("reading sub config", zap.String("file", subCfgFile))
-		subCfg, _, err := loadConfig(subCfgFile)
-		if err != nil {
-			return fmt.Errorf("failed to load sub config, %w", err)
+	file := paths[len(paths)-1]
+	checkDup := func(kind, tag string) error {
+		if len(tag) == 0 {
+			return nil
+		}
+		k := kind + "/" + tag
+		if f, dup := tagFiles[k]; dup {
+			return fmt.Errorf("duplicated %s tag %s in %s and %s", kind, tag, f, file)
 		}
-		if err := mergeInclude(subCfg, depth, subPaths); err != nil {
+		tagFiles[k] = file
+		return nil
+	}
+	for _, dpc := range cfg.DataProviders {
+		if err := checkDup("provider", dpc.Tag); err != nil {
 			return err
 		}
+	}
+	for _, pc := range cfg.Plugins {
+		if err := checkDup("plugin", pc.Tag); err != nil {
+			return err
+		}
+	}
+
+	includedCfg := new(Config)
+	for _, include := range cfg.Include {
+		files, err := expandInclude(include)
+		if err != nil {
+			return fmt.Errorf("invalid include %s, %w", include, err)
+		}
+		for _, subCfgFile := range files {
+			subPaths := append(paths[:len(paths):len(paths)], subCfgFile)
+			mlog.L().Info("reading sub config", zap.String("file", subCfgFile))
+			subCfg, _, err := loadConfig(subCfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load sub config, %w", err)
+			}
+			if err := mergeIncludeFiles(subCfg, depth, subPaths, tagFiles); err != nil {
+				return err
+			}
 
-		includedCfg.DataProviders = append(includedCfg.DataProviders, subCfg.DataProviders...)
-		includedCfg.Plugins = append(includedCfg.Plugins, subCfg.Plugins...)
-		includedCfg.Servers = append(includedCfg.Servers, subCfg.Servers...)
+			includedCfg.DataProviders = append(includedCfg.DataProviders, subCfg.DataProviders...)
+			includedCfg.Plugins = append(includedCfg.Plugins, subCfg.Plugins...)
+			includedCfg.Servers = append(includedCfg.Servers, subCfg.Servers...)
+		}
 	}
 
 	cfg.DataProviders = append(includedCfg.DataProviders, cfg.DataProviders...)
@@ -178,3 +276,37 @@ func mergeInclude(cfg *Config, depth int, paths []string) error {
 	cfg.Servers = append(includedCfg.Servers, cfg.Servers...)
 	return nil
 }
+
+// expandInclude returns the config files of an include entry s.
+// See mergeInclude.
+func expandInclude(s string) ([]string, error) {
+	if strings.ContainsAny(s, "*?[") {
+		files, err := filepath.Glob(s)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	fi, err := os.Stat(s)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{s}, nil
+	}
+	entries, err := os.ReadDir(s) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if isConfigFile(e.Name()) {
+			files = append(files, filepath.Join(s, e.Name()))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_mergeInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	write("conf.d/b.yaml", "plugins:\n  - tag: b\n    type: t\n")
+	write("conf.d/a.yml", "plugins:\n  - tag: a\n    type: t\n")
+	write("conf.d/c.json", `{"plugins": [{"tag": "c", "type": "t"}]}`)
+	write("conf.d/ignored.txt", "plugins:\n  - tag: ignored\n    type: t\n")
+	write("extra/x_1.yaml", "servers:\n  - exec: x1\n")
+	write("extra/x_2.yaml", "servers:\n  - exec: x2\n")
+
+	tags := func(cfg *Config) string {
+		var s []string
+		for _, pc := range cfg.Plugins {
+			s = append(s, pc.Tag)
+		}
+		for _, sc := range cfg.Servers {
+			s = append(s, sc.Exec)
+		}
+		return strings.Join(s, ",")
+	}
+
+	cfg := &Config{
+		Include: []string{filepath.Join(dir, "conf.d"), filepath.Join(dir, "extra", "x_*.yaml")},
+		Plugins: []PluginConfig{{Tag: "main", Type: "t"}},
+		Servers: []ServerConfig{{Exec: "main"}},
+	}
+	if err := mergeInclude(cfg, 0, []string{"config.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags(cfg), "a,b,c,main,x1,x2,main"; got != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	dup := write("dup.yaml", "plugins:\n  - tag: a\n    type: t\n")
+	cfg = &Config{Include: []string{filepath.Join(dir, "conf.d"), dup}}
+	err := mergeInclude(cfg, 0, []string{"config.yaml"})
+	if err == nil || !strings.Contains(err.Error(), "duplicated plugin tag a") {
+		t.Fatalf("want duplicated tag err, got %v", err)
+	}
+
+	cfg = &Config{Include: []string{filepath.Join(dir, "not_exist")}}
+	if err := mergeInclude(cfg, 0, []string{"config.yaml"}); err == nil {
+		t.Fatal("want err of missing include")
+	}
+}
+
+func Test_loadConfig_formats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": `
+plugins:
+  - tag: main
+    type: sequence
+    args:
+      exec: [_new_nxdomain_response]
+servers:
+  - exec: main
+    timeout: 3
+    listeners:
+      - addr: 127.0.0.1:53
+`,
+		"config.json": `{
+  "plugins": [{"tag": "main", "type": "sequence", "args": {"exec": ["_new_nxdomain_response"]}}],
+  "servers": [{"exec": "main", "timeout": 3, "listeners": [{"addr": "127.0.0.1:53"}]}]
+}`,
+		"config.toml": `
+[[plugins]]
+tag = "main"
+type = "sequence"
+args = { exec = ["_new_nxdomain_response"] }
+
+[[servers]]
+exec = "main"
+timeout = 3
+[[servers.listeners]]
+addr = "127.0.0.1:53"
+`,
+	}
+	var want *Config
+	for name, s := range files {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := loadConfig(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want == nil {
+			want = cfg
+			continue
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Fatalf("%s: want %+v, got %+v", name, want, cfg)
+		}
+	}
+
+	f := filepath.Join(dir, "config.ini")
+	if err := os.WriteFile(f, []byte("[log]\nlevel = debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadConfig(f); err == nil {
+		t.Fatal("want err of unsupported format")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	selfTestStatusPending  = "pending"
+	selfTestStatusOK       = "ok"
+	selfTestStatusDegraded = "degraded"
+)
+
+type selfTestQuery struct {
+	name  string
+	qtype uint16
+}
+
+type selfTestResult struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	OK      bool     `json:"ok"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers []string `json:"answers,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Latency string   `json:"latency"`
+}
+
+type selfTestStatus struct {
+	Status  string           `json:"status"`
+	LastRun time.Time        `json:"last_run"`
+	Results []selfTestResult `json:"results"`
+}
+
+// selfTest resolves canary names through the entry executable and
+// reports whether they are resolved. A name is resolved if the response
+// is NOERROR and has at least one answer.
+// The status is available at api "/self_test".
+type selfTest struct {
+	logger  *zap.Logger
+	entry   executable_seq.Executable
+	queries []selfTestQuery
+	timeout time.Duration
+
+	healthy prometheus.Gauge
+
+	mu     sync.Mutex
+	status selfTestStatus
+}
+
+func newSelfTest(lg *zap.Logger, entry executable_seq.Executable, cfg *SelfTestConfig) (*selfTest, error) {
+	cfg.Init()
+	t := &selfTest{
+		logger:  lg,
+		entry:   entry,
+		timeout: time.Duration(cfg.Timeout) * time.Second,
+		healthy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "self_test_healthy",
+			Help: "Whether the last self-test passed. 1 for passed, 0 for failed or not run yet",
+		}),
+		status: selfTestStatus{Status: selfTestStatusPending, Results: []selfTestResult{}},
+	}
+	for _, q := range cfg.Queries {
+		if _, ok := dns.IsDomainName(q.Name); !ok || len(q.Name) == 0 {
+			return nil, fmt.Errorf("invalid self-test name %s", q.Name)
+		}
+		qtype := dns.TypeA
+		if len(q.Type) > 0 {
+			var err error
+			qtype, err = dnsutils.ParseRRType(q.Type)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.queries = append(t.queries, selfTestQuery{name: dns.Fqdn(q.Name), qtype: qtype})
+	}
+	return t, nil
+}
+
+// run runs all the queries. It returns an error if any
+// of them failed.
+func (t *selfTest) run(ctx context.Context) error {
+	results := make([]selfTestResult, len(t.queries))
+	var wg sync.WaitGroup
+	for i, q := range t.queries {
+		i, q := i, q
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = t.resolve(ctx, q)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+			t.logger.Warn("self-test failed", zap.String("name", r.Name), zap.String("type", r.Type), zap.String("rcode", r.Rcode), zap.String("error", r.Error))
+		}
+	}
+
+	t.mu.Lock()
+	t.status.LastRun = time.Now()
+	t.status.Results = results
+	if failed == 0 {
+		t.status.Status = selfTestStatusOK
+	} else {
+		t.status.Status = selfTestStatusDegraded
+	}
+	t.mu.Unlock()
+
+	if failed > 0 {
+		t.healthy.Set(0)
+		return fmt.Errorf("%d of %d self-test queries failed", failed, len(results))
+	}
+	t.healthy.Set(1)
+	t.logger.Info("self-test passed", zap.Int("queries", len(results)))
+	return nil
+}
+
+// startSelfTest runs the self-test once, and then every interval if interval > 0.
+// If fatal is true and the first run failed, mosdns will exit.
+func (m *Mosdns) startSelfTest(t *selfTest, interval time.Duration, fatal bool) error {
+	go func() {
+		if err := t.run(context.Background()); err != nil && fatal {
+			m.sc.SendCloseSignal(fmt.Errorf("self-test failed, %w", err))
+		}
+	}()
+	if interval <= 0 {
+		return nil
+	}
+	_, err := m.scheduler.Add(scheduler.TaskOpts{
+		Name:     "self_test",
+		Func:     t.run,
+		Schedule: scheduler.Every(interval),
+	})
+	return err
+}
+
+func (t *selfTest) resolve(ctx context.Context, q selfTestQuery) selfTestResult {
+	res := selfTestResult{Name: q.name, Type: dnsutils.QtypeToString(q.qtype)}
+
+	m := new(dns.Msg)
+	m.SetQuestion(q.name, q.qtype)
+	qCtx := query_context.NewContext(m, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	start := time.Now()
+	err := t.entry.Exec(ctx, qCtx, nil)
+	res.Latency = time.Since(start).String()
+
+	r := qCtx.R()
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case r == nil:
+		res.Error = "no response"
+	default:
+		res.Rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			res.Answers = append(res.Answers, rr.String())
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			res.Error = "unexpected rcode"
+		} else if len(r.Answer) == 0 {
+			res.Error = "empty answer"
+		} else {
+			res.OK = true
+		}
+	}
+	return res
+}
+
+// ServeHTTP serves the self-test api.
+//
+//	GET /self_test  shows the last results. The status code is 503
+//	                if the last self-test failed.
+func (t *selfTest) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	t.mu.Lock()
+	b, err := json.Marshal(t.status)
+	status := t.status.Status
+	t.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == selfTestStatusDegraded {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
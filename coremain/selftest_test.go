@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeEntry struct{}
+
+func (fakeEntry) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if q.Question[0].Name == "ok.example." {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	} else {
+		r.Rcode = dns.RcodeNameError
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_selfTest(t *testing.T) {
+	newTest := func(names ...string) *selfTest {
+		cfg := &SelfTestConfig{}
+		for _, n := range names {
+			cfg.Queries = append(cfg.Queries, SelfTestQueryConfig{Name: n})
+		}
+		st, err := newSelfTest(zap.NewNop(), fakeEntry{}, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	getStatus := func(st *selfTest) int {
+		w := httptest.NewRecorder()
+		st.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/self_test", nil))
+		return w.Code
+	}
+
+	st := newTest("ok.example")
+	if err := st.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st.status.Status != selfTestStatusOK || getStatus(st) != http.StatusOK {
+		t.Fatalf("unexpected status %v", st.status)
+	}
+
+	st = newTest("ok.example", "nx.example")
+	if err := st.run(context.Background()); err == nil {
+		t.Fatal("want err")
+	}
+	if st.status.Status != selfTestStatusDegraded || getStatus(st) != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %v", st.status)
+	}
+	if r := st.status.Results[1]; r.OK || r.Rcode != "NXDOMAIN" {
+		t.Fatalf("unexpected result %v", r)
+	}
+
+	if _, err := newSelfTest(zap.NewNop(), fakeEntry{}, &SelfTestConfig{Queries: []SelfTestQueryConfig{{Name: "a.example", Type: "BAD"}}}); err == nil {
+		t.Fatal("want err")
+	}
+}
@@ -20,14 +20,27 @@
 package coremain
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cert_reloader"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/http_handler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/systemd"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -56,14 +69,31 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 
 	dnsHandlerOpts := dns_handler.EntryHandlerOpts{
 		Logger:             m.logger,
-		Entry:              entry,
+		Entry:              &countingExec{Executable: entry, c: m.queriesTotal},
 		QueryTimeout:       queryTimeout,
 		RecursionAvailable: true,
+		NSID:               cfg.NSID,
 	}
-	dnsHandler, err := dns_handler.NewEntryHandler(dnsHandlerOpts)
+	if m.queryTracer != nil {
+		dnsHandlerOpts.Tracer = m.queryTracer
+	}
+	entryHandler, err := dns_handler.NewEntryHandler(dnsHandlerOpts)
 	if err != nil {
 		return fmt.Errorf("failed to init entry handler, %w", err)
 	}
+	var dnsHandler dns_handler.Handler = entryHandler
+	if cfg.MaxPendingQueries > 0 || cfg.MaxPendingQueriesPerClient > 0 {
+		dnsHandler, err = dns_handler.NewLimitHandler(dns_handler.LimitHandlerOpts{
+			Logger:           m.logger,
+			Handler:          dnsHandler,
+			MaxQueries:       cfg.MaxPendingQueries,
+			MaxClientQueries: cfg.MaxPendingQueriesPerClient,
+			Overflow:         cfg.OverflowPolicy,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to init query limiter, %w", err)
+		}
+	}
 
 	for _, lc := range cfg.Listeners {
 		if err := m.startServerListener(lc, dnsHandler); err != nil {
@@ -73,6 +103,17 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 	return nil
 }
 
+// countingExec counts the queries of a server entry.
+type countingExec struct {
+	executable_seq.Executable
+	c prometheus.Counter
+}
+
+func (e *countingExec) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	e.c.Inc()
+	return e.Executable.Exec(ctx, qCtx, next)
+}
+
 func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_handler.Handler) error {
 	if len(cfg.Addr) == 0 {
 		return errors.New("no address to bind")
@@ -86,10 +127,14 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 	}
 
 	httpOpts := http_handler.HandlerOpts{
-		DNSHandler:  dnsHandler,
-		Path:        cfg.URLPath,
-		SrcIPHeader: cfg.GetUserIPFromHeader,
-		Logger:      m.logger,
+		DNSHandler:     dnsHandler,
+		Path:           cfg.URLPath,
+		Paths:          cfg.URLPaths,
+		AuthTokens:     cfg.AuthTokens,
+		BasicAuth:      cfg.BasicAuth,
+		SrcIPHeader:    cfg.GetUserIPFromHeader,
+		TrustedProxies: cfg.TrustedProxies,
+		Logger:         m.logger,
 	}
 
 	httpHandler, err := http_handler.NewHandler(httpOpts)
@@ -97,77 +142,156 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 		return fmt.Errorf("failed to init http handler, %w", err)
 	}
 
+	switch cfg.Protocol {
+	case "tls", "dot", "https", "doh":
+	default:
+		if len(cfg.ClientCA) > 0 {
+			return fmt.Errorf("client_ca is not supported by protocol [%s]", cfg.Protocol)
+		}
+		if cfg.ACME {
+			return fmt.Errorf("acme is not supported by protocol [%s]", cfg.Protocol)
+		}
+	}
+	switch cfg.Protocol {
+	case "", "udp":
+		if cfg.ProxyProtocol {
+			return errors.New("proxy protocol is not supported by udp")
+		}
+	default:
+		if cfg.HotCacheSize > 0 {
+			return fmt.Errorf("hot_cache_size is not supported by protocol [%s]", cfg.Protocol)
+		}
+	}
+	switch cfg.Protocol {
+	case "http", "https", "doh":
+	default:
+		if len(cfg.AuthTokens)+len(cfg.BasicAuth) > 0 {
+			return fmt.Errorf("http authentication is not supported by protocol [%s]", cfg.Protocol)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if len(cfg.ClientCA) > 0 {
+		clientCAs, err := utils.LoadCertPool(cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to load client ca, %w", err)
+		}
+		tlsConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	if cfg.ACME {
+		if m.acme == nil {
+			return errors.New("acme is not configured")
+		}
+		if len(cfg.Cert)+len(cfg.Key) > 0 {
+			return errors.New("acme listener cannot have cert or key")
+		}
+		tlsConfig = m.acme.TLSConfig(tlsConfig)
+	}
+
+	switch cfg.Protocol {
+	case "tls", "dot", "https", "doh":
+		if len(cfg.Cert)+len(cfg.Key) > 0 && !cfg.ACME {
+			cr, err := m.startCertReloader(cfg.Cert, cfg.Key)
+			if err != nil {
+				return fmt.Errorf("failed to load certificate, %w", err)
+			}
+			if tlsConfig == nil {
+				tlsConfig = new(tls.Config)
+			}
+			tlsConfig.GetCertificate = cr.GetCertificate
+		}
+	}
+
 	opts := server.ServerOpts{
 		DNSHandler:  dnsHandler,
 		HttpHandler: httpHandler,
-		Cert:        cfg.Cert,
-		Key:         cfg.Key,
+		TLSConfig:   tlsConfig,
 		IdleTimeout: idleTimeout,
 		Logger:      m.logger,
+
+		UDPHotCacheSize: cfg.HotCacheSize,
+		UDPHotCacheTTL:  time.Duration(cfg.HotCacheTTL) * time.Second,
 	}
 	s := server.NewServer(opts)
+	m.servers = append(m.servers, s)
 
 	// helper func for proxy protocol listener
-	requirePP := func(_ net.Addr) (proxyproto.Policy, error) {
-		return proxyproto.REQUIRE, nil
+	requirePP, err := proxyProtocolPolicy(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_protocol_trusted, %w", err)
 	}
 
-	var run func() error
+	var runs []func() error
 	switch cfg.Protocol {
 	case "", "udp":
-		conn, err := net.ListenPacket("udp", cfg.Addr)
-		if err != nil {
-			return err
+		if m.dryRun {
+			break
 		}
-		run = func() error { return s.ServeUDP(conn) }
-	case "tcp":
-		l, err := net.Listen("tcp", cfg.Addr)
+		conns, err := listenPacket(cfg.Addr, cfg.ReusePort)
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+		for _, c := range conns {
+			c := c
+			runs = append(runs, func() error { return s.ServeUDP(c) })
 		}
-		run = func() error { return s.ServeTCP(l) }
-	case "tls", "dot":
-		l, err := net.Listen("tcp", cfg.Addr)
-		if err != nil {
-			return err
+	case "tcp", "tls", "dot", "http", "https", "doh":
+		var serve func(l net.Listener) error
+		switch cfg.Protocol {
+		case "tcp":
+			serve = s.ServeTCP
+		case "tls", "dot":
+			serve = s.ServeTLS
+		case "http":
+			serve = s.ServeHTTP
+		default:
+			serve = s.ServeHTTPS
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
-		}
-		run = func() error { return s.ServeTLS(l) }
-	case "http":
-		l, err := net.Listen("tcp", cfg.Addr)
-		if err != nil {
-			return err
+		if m.dryRun {
+			break
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+		tcpOpts := server.TCPOpts{
+			FastOpen:    cfg.TCPFastOpen,
+			KeepAlive:   time.Duration(cfg.TCPKeepAlive) * time.Second,
+			UserTimeout: time.Duration(cfg.TCPUserTimeout) * time.Second,
 		}
-		run = func() error { return s.ServeHTTP(l) }
-	case "https", "doh":
-		l, err := net.Listen("tcp", cfg.Addr)
+		ls, err := listen(cfg.Addr, cfg.ReusePort, tcpOpts)
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+		for _, l := range ls {
+			if cfg.ProxyProtocol {
+				l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+			}
+			l := l
+			runs = append(runs, func() error { return serve(l) })
 		}
-		run = func() error { return s.ServeHTTPS(l) }
 	default:
 		return fmt.Errorf("unknown protocol: [%s]", cfg.Protocol)
 	}
+	if m.dryRun {
+		return nil
+	}
 
 	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		defer done()
-		errChan := make(chan error, 1)
-		go func() {
-			errChan <- run()
-		}()
+		errChan := make(chan error, len(runs))
+		for _, run := range runs {
+			run := run
+			go func() {
+				errChan <- run()
+			}()
+		}
 		select {
 		case err := <-errChan:
+			if err == server.ErrServerClosed { // shutdown
+				<-closeSignal
+				return
+			}
 			m.sc.SendCloseSignal(fmt.Errorf("server exited, %w", err))
 		case <-closeSignal:
 		}
@@ -175,3 +299,145 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 
 	return nil
 }
+
+// systemdAddrPrefix is the prefix of listener addresses that refer to
+// sockets passed by systemd socket activation.
+const systemdAddrPrefix = "systemd:"
+
+var activation struct {
+	once  sync.Once
+	files []*os.File
+}
+
+// systemdFile returns the activated socket named by addr. The name can
+// be the FileDescriptorName= of the socket unit or the index of the socket.
+func systemdFile(addr string) (*os.File, error) {
+	activation.once.Do(func() { activation.files = systemd.Files() })
+	name := strings.TrimPrefix(addr, systemdAddrPrefix)
+	for i, f := range activation.files {
+		if f != nil && (f.Name() == name || strconv.Itoa(i) == name) {
+			activation.files[i] = nil // a socket can only be used by one listener.
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find socket %s from systemd", name)
+}
+
+// listen opens a tcp listener on addr, or n listeners with SO_REUSEPORT
+// if n > 1.
+func listen(addr string, n int, opts server.TCPOpts) ([]net.Listener, error) {
+	if strings.HasPrefix(addr, systemdAddrPrefix) {
+		if n > 1 {
+			return nil, errors.New("reuseport is not supported by systemd sockets")
+		}
+		if !opts.IsZero() {
+			return nil, errors.New("tcp options are not supported by systemd sockets")
+		}
+		f, err := systemdFile(addr)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	if n > 1 {
+		return server.ListenReusePort(addr, n, opts)
+	}
+	l, err := server.ListenTCP(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// listenPacket opens an udp socket on addr, or n sockets with SO_REUSEPORT
+// if n > 1.
+func listenPacket(addr string, n int) ([]net.PacketConn, error) {
+	if strings.HasPrefix(addr, systemdAddrPrefix) {
+		if n > 1 {
+			return nil, errors.New("reuseport is not supported by systemd sockets")
+		}
+		f, err := systemdFile(addr)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{c}, nil
+	}
+	if n > 1 {
+		return server.ListenPacketReusePort(addr, n)
+	}
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.PacketConn{c}, nil
+}
+
+// startCertReloader loads the certificate and reloads it when its files
+// are changed.
+func (m *Mosdns) startCertReloader(cert, key string) (*cert_reloader.Reloader, error) {
+	lg := m.logger.Named("cert_reloader")
+	cr, err := cert_reloader.New(cert, key, lg)
+	if err != nil {
+		return nil, err
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-closeSignal
+			cancel()
+		}()
+		if err := cr.Run(ctx); err != nil {
+			lg.Warn("failed to watch certificate files, auto reload is disabled", zap.String("cert", cert), zap.Error(err))
+		}
+	})
+	return cr, nil
+}
+
+// proxyProtocolPolicy returns the PROXY protocol policy of listeners.
+// Connections from trusted sources must send a header. Others must not.
+// All sources are trusted if trusted is empty.
+func proxyProtocolPolicy(trusted []string) (proxyproto.PolicyFunc, error) {
+	if len(trusted) == 0 {
+		return func(_ net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		}, nil
+	}
+	var prefixes []netip.Prefix
+	for _, s := range trusted {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if ta, ok := upstream.(*net.TCPAddr); ok {
+			addr := ta.AddrPort().Addr().Unmap()
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					return proxyproto.REQUIRE, nil
+				}
+			}
+		}
+		return proxyproto.REJECT, nil
+	}, nil
+}
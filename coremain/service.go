@@ -40,20 +40,37 @@ var (
 	}
 )
 
+// serviceStopTimeout is the maximum time that serverService.Stop waits
+// for mosdns to drain in-flight queries.
+const serviceStopTimeout = time.Second * 15
+
 type serverService struct {
-	f *serverFlags
+	f    *serverFlags
+	done chan struct{}
 }
 
 func (ss *serverService) Start(s service.Service) error {
 	mlog.L().Info("starting service", zap.String("platform", s.Platform()))
+	ss.done = make(chan struct{})
 	go func() {
-		err := StartServer(ss.f)
-		mlog.L().Fatal("server exited", zap.Error(err))
+		defer close(ss.done)
+		if err := StartServer(ss.f); err != nil {
+			mlog.L().Fatal("server exited", zap.Error(err))
+		}
 	}()
 	return nil
 }
 
+// Stop is called by the service manager, e.g. Windows SCM. It shuts
+// down mosdns gracefully as SIGTERM does.
 func (ss *serverService) Stop(s service.Service) error {
+	mlog.L().Info("stopping service")
+	requestShutdown()
+	select {
+	case <-ss.done:
+	case <-time.After(serviceStopTimeout):
+		mlog.L().Warn("service is not stopped in time")
+	}
 	return nil
 }
 
@@ -100,6 +117,7 @@ func newSvcInstallCmd() *cobra.Command {
 	}
 	c.Flags().StringVarP(&sf.dir, "dir", "d", "", "working dir")
 	c.Flags().StringVarP(&sf.c, "config", "c", "", "config path")
+	markConfigFlags(c)
 	return c
 }
 
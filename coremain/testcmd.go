@@ -0,0 +1,349 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TestFile is the file of test cases of "mosdns test".
+type TestFile struct {
+	Entry   string     `yaml:"entry"`   // Default is the exec of the first server.
+	Timeout int        `yaml:"timeout"` // (sec) Timeout of each case. Default is 5.
+	Cases   []TestCase `yaml:"cases"`
+}
+
+type TestCase struct {
+	Name   string     `yaml:"name"`
+	Query  TestQuery  `yaml:"query"`
+	Expect TestExpect `yaml:"expect"`
+}
+
+type TestQuery struct {
+	Name     string `yaml:"name"`      // required
+	Type     string `yaml:"type"`      // Default is "A".
+	ClientIP string `yaml:"client_ip"` // Optional.
+}
+
+// TestExpect specifies the expected results. Empty fields are not checked.
+type TestExpect struct {
+	// Rcode is the expected rcode. e.g. "NOERROR", "NXDOMAIN".
+	Rcode string `yaml:"rcode"`
+
+	// Answers is the expected data of answer records, regardless of order.
+	// e.g. "1.1.1.1" for A records, "example.com." for CNAME records.
+	// Use an empty list to expect no answer.
+	Answers []string `yaml:"answers"`
+
+	// Upstream is the tag of the executable plugin that produced
+	// the response. e.g. the tag of a fast_forward plugin.
+	Upstream string `yaml:"upstream"`
+
+	// Branch is a list of tags of executable plugins that must be
+	// executed in this order. Other plugins may be executed in between.
+	Branch []string `yaml:"branch"`
+
+	// NotExecuted is a list of tags of executable plugins that must
+	// not be executed.
+	NotExecuted []string `yaml:"not_executed"`
+}
+
+func newTestCmd() *cobra.Command {
+	sf := new(serverFlags)
+	var testFile string
+	var verbose bool
+	c := &cobra.Command{
+		Use:   "test -t test_file [-c config_file] [-d working_dir]",
+		Short: "Run test cases against the config.",
+		Long: "Load the config and run the test cases in the test file against it. " +
+			"No server will be started. Exit with a non-zero code if any case failed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTestCmd(sf, testFile, verbose, cmd.OutOrStdout())
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&testFile, "test", "t", "", "test file")
+	fs.StringVarP(&sf.c, "config", "c", "", "config file")
+	fs.StringVarP(&sf.dir, "dir", "d", "", "working dir")
+	markConfigFlags(c)
+	c.MarkFlagFilename("test", "yaml", "yml")
+	fs.BoolVarP(&verbose, "verbose", "v", false, "show mosdns logs and results of passed cases")
+	c.MarkFlagRequired("test")
+	return c
+}
+
+func runTestCmd(sf *serverFlags, testFile string, verbose bool, out io.Writer) error {
+	b, err := os.ReadFile(testFile)
+	if err != nil {
+		return fmt.Errorf("failed to read test file, %w", err)
+	}
+	tf := new(TestFile)
+	dec := yaml.NewDecoder(strings.NewReader(string(b)))
+	dec.KnownFields(true)
+	if err := dec.Decode(tf); err != nil {
+		return fmt.Errorf("failed to decode test file, %w", err)
+	}
+
+	if len(sf.dir) > 0 {
+		if err := os.Chdir(sf.dir); err != nil {
+			return fmt.Errorf("failed to change the current working directory, %w", err)
+		}
+	}
+	cfg, fileUsed, err := loadConfig(sf.c)
+	if err != nil {
+		return fmt.Errorf("fail to load config, %w", err)
+	}
+	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+		return fmt.Errorf("failed to load sub config file, %w", err)
+	}
+
+	lg := zap.NewNop()
+	if verbose {
+		var closeLog func()
+		lg, closeLog, err = mlog.NewLogger(&cfg.Log)
+		if err != nil {
+			return fmt.Errorf("failed to init logger: %w", err)
+		}
+		defer closeLog()
+	}
+	failed, err := runTestFile(lg, cfg, tf, verbose, out)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cases failed", failed, len(tf.Cases))
+	}
+	return nil
+}
+
+// runTestFile loads plugins from cfg and runs the cases of tf. It returns
+// the number of failed cases.
+func runTestFile(lg *zap.Logger, cfg *Config, tf *TestFile, verbose bool, out io.Writer) (int, error) {
+	m := newMosdns(lg)
+	defer func() {
+		m.sc.SendCloseSignal(nil)
+		m.sc.Done()
+		m.sc.CloseWait()
+		m.scheduler.Close()
+	}()
+	if err := m.loadPlugins(cfg); err != nil {
+		return 0, err
+	}
+
+	tag := tf.Entry
+	if len(tag) == 0 {
+		if len(cfg.Servers) == 0 {
+			return 0, errors.New("no entry is specified and no server is configured")
+		}
+		tag = cfg.Servers[0].Exec
+	}
+	entry := m.execs[tag]
+	if entry == nil {
+		return 0, fmt.Errorf("cannot find entry %s", tag)
+	}
+	timeout := time.Duration(tf.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+
+	failed := 0
+	for i, tc := range tf.Cases {
+		name := tc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%d", i)
+		}
+		res, errs := runTestCase(entry, &tc, timeout)
+		if len(errs) > 0 {
+			failed++
+			fmt.Fprintf(out, "FAIL %s\n", name)
+			for _, err := range errs {
+				fmt.Fprintf(out, "    %v\n", err)
+			}
+			fmt.Fprintf(out, "    got: %s\n", res)
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", name)
+		if verbose {
+			fmt.Fprintf(out, "    got: %s\n", res)
+		}
+	}
+	fmt.Fprintf(out, "%d passed, %d failed\n", len(tf.Cases)-failed, failed)
+	return failed, nil
+}
+
+type testResult struct {
+	rcode    string
+	answers  []string
+	upstream string
+	execs    []string
+}
+
+func (r *testResult) String() string {
+	return fmt.Sprintf("rcode=%s answers=%v upstream=%s executed=%v", r.rcode, r.answers, r.upstream, r.execs)
+}
+
+func runTestCase(entry executable_seq.Executable, tc *TestCase, timeout time.Duration) (*testResult, []error) {
+	q, meta, err := tc.Query.build()
+	if err != nil {
+		return &testResult{}, []error{err}
+	}
+	qCtx := query_context.NewContext(q, meta)
+	qCtx.SetTrace(query_context.NewTrace("test"))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err = entry.Exec(ctx, qCtx, nil)
+	cancel()
+	events := qCtx.Trace().Events()
+
+	res := new(testResult)
+	for _, e := range events {
+		if e.Kind == "exec" {
+			res.execs = append(res.execs, e.Tag)
+		}
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, fmt.Errorf("exec err: %w", err))
+	}
+	r := qCtx.R()
+	if r != nil {
+		res.rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			res.answers = append(res.answers, rrData(rr))
+		}
+		res.upstream = responder(events, r)
+	}
+
+	e := &tc.Expect
+	if len(e.Rcode) > 0 && !strings.EqualFold(e.Rcode, res.rcode) {
+		errs = append(errs, fmt.Errorf("want rcode %s, got %s", e.Rcode, res.rcode))
+	}
+	if e.Answers != nil && !sameSet(e.Answers, res.answers) {
+		errs = append(errs, fmt.Errorf("want answers %v, got %v", e.Answers, res.answers))
+	}
+	if len(e.Upstream) > 0 && e.Upstream != res.upstream {
+		errs = append(errs, fmt.Errorf("want upstream %s, got %s", e.Upstream, res.upstream))
+	}
+	if len(e.Branch) > 0 && !isSubsequence(e.Branch, res.execs) {
+		errs = append(errs, fmt.Errorf("want branch %v, got %v", e.Branch, res.execs))
+	}
+	for _, tag := range e.NotExecuted {
+		for _, executed := range res.execs {
+			if tag == executed {
+				errs = append(errs, fmt.Errorf("%s should not be executed", tag))
+				break
+			}
+		}
+	}
+	return res, errs
+}
+
+func (tq *TestQuery) build() (*dns.Msg, *query_context.RequestMeta, error) {
+	if _, ok := dns.IsDomainName(tq.Name); !ok || len(tq.Name) == 0 {
+		return nil, nil, fmt.Errorf("invalid query name %s", tq.Name)
+	}
+	qtype := dns.TypeA
+	if len(tq.Type) > 0 {
+		var err error
+		qtype, err = dnsutils.ParseRRType(tq.Type)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(tq.Name), qtype)
+
+	meta := &query_context.RequestMeta{Protocol: query_context.ProtocolUDP, FromUDP: true}
+	if len(tq.ClientIP) > 0 {
+		addr, err := netip.ParseAddr(tq.ClientIP)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client ip, %w", err)
+		}
+		meta.ClientAddr = addr
+	}
+	return q, meta, nil
+}
+
+// rrData returns the rdata of rr in presentation format.
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubsequence reports whether s is a subsequence of l.
+func isSubsequence(s, l []string) bool {
+	i := 0
+	for _, v := range l {
+		if i < len(s) && s[i] == v {
+			i++
+		}
+	}
+	return i == len(s)
+}
+
+// responder returns the tag of the innermost plugin that set r. The
+// plugins that executed it, e.g. sequences, also see r as their new
+// response.
+func responder(events []query_context.TraceEvent, r *dns.Msg) string {
+	outer := make(map[int]bool)
+	for _, e := range events {
+		if e.Response == r {
+			outer[e.Parent] = true
+		}
+	}
+	for _, e := range events {
+		if e.Response == r && !outer[e.ID] {
+			return e.Tag
+		}
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAnswerPlugin responds A queries with IP.
+type testAnswerPlugin struct {
+	*BP
+	ip net.IP
+}
+
+type testAnswerArgs struct {
+	IP string `yaml:"ip"`
+}
+
+func (p *testAnswerPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   p.ip,
+	})
+	qCtx.SetResponse(r)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// testRouterPlugin executes Local for names under "local.", Remote otherwise.
+type testRouterPlugin struct {
+	*BP
+	local, remote executable_seq.Executable
+}
+
+type testRouterArgs struct {
+	Local  string `yaml:"local"`
+	Remote string `yaml:"remote"`
+}
+
+func (p *testRouterPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	e := p.remote
+	if strings.HasSuffix(qCtx.Q().Question[0].Name, ".local.") {
+		e = p.local
+	}
+	if err := e.Exec(ctx, qCtx, nil); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func init() {
+	RegNewPluginFunc("test_answer", func(bp *BP, args interface{}) (Plugin, error) {
+		// Registers metrics before the args are checked, like plugins
+		// that fail in the middle of their init.
+		bp.GetMetricsReg().MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}))
+		ip := net.ParseIP(args.(*testAnswerArgs).IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", args.(*testAnswerArgs).IP)
+		}
+		_, err := bp.M().GetScheduler().Add(scheduler.TaskOpts{
+			Name:     fmt.Sprintf("plugin/%s/noop", bp.Tag()),
+			Func:     func(context.Context) error { return nil },
+			Schedule: scheduler.Every(time.Hour),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &testAnswerPlugin{BP: bp, ip: ip}, nil
+	}, func() interface{} { return new(testAnswerArgs) })
+	RegNewPluginFunc("test_router", func(bp *BP, args interface{}) (Plugin, error) {
+		a := args.(*testRouterArgs)
+		execs := bp.M().GetExecutables()
+		return &testRouterPlugin{BP: bp, local: execs[a.Local], remote: execs[a.Remote]}, nil
+	}, func() interface{} { return new(testRouterArgs) })
+}
+
+func Test_runTestFile(t *testing.T) {
+	cfg := &Config{
+		Plugins: []PluginConfig{
+			{Tag: "local", Type: "test_answer", Args: map[string]interface{}{"ip": "192.168.1.1"}},
+			{Tag: "remote", Type: "test_answer", Args: map[string]interface{}{"ip": "1.1.1.1"}},
+			{Tag: "main", Type: "test_router", Args: map[string]interface{}{"local": "local", "remote": "remote"}},
+		},
+		Servers: []ServerConfig{{Exec: "main"}},
+	}
+	tf := &TestFile{Cases: []TestCase{
+		{
+			Name:  "local",
+			Query: TestQuery{Name: "nas.local"},
+			Expect: TestExpect{
+				Rcode:       "NOERROR",
+				Answers:     []string{"192.168.1.1"},
+				Upstream:    "local",
+				Branch:      []string{"main", "local"},
+				NotExecuted: []string{"remote"},
+			},
+		},
+		{
+			Name:   "remote",
+			Query:  TestQuery{Name: "example.com", ClientIP: "10.0.0.1"},
+			Expect: TestExpect{Answers: []string{"1.1.1.1"}, Upstream: "remote"},
+		},
+		{
+			Name:   "wrong upstream",
+			Query:  TestQuery{Name: "example.com"},
+			Expect: TestExpect{Upstream: "local", NotExecuted: []string{"remote"}},
+		},
+		{
+			Name:   "wrong answers",
+			Query:  TestQuery{Name: "example.com"},
+			Expect: TestExpect{Rcode: "NXDOMAIN", Answers: []string{}},
+		},
+		{
+			Name:  "invalid query",
+			Query: TestQuery{Name: "example.com", Type: "INVALID"},
+		},
+	}}
+
+	out := new(bytes.Buffer)
+	failed, err := runTestFile(zap.NewNop(), cfg, tf, false, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 3 {
+		t.Fatalf("want 3 failed cases, got %d, output:\n%s", failed, out)
+	}
+	for _, s := range []string{
+		"PASS local",
+		"PASS remote",
+		"FAIL wrong upstream",
+		"want upstream local, got remote",
+		"remote should not be executed",
+		"want rcode NXDOMAIN, got NOERROR",
+		"FAIL invalid query",
+		"2 passed, 3 failed",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Fatalf("output does not contain %q:\n%s", s, out)
+		}
+	}
+
+	tf.Entry = "not_exist"
+	if _, err := runTestFile(zap.NewNop(), cfg, tf, false, out); err == nil {
+		t.Fatal("want entry err")
+	}
+}
+
+func Test_responder(t *testing.T) {
+	r1, r2 := new(dns.Msg), new(dns.Msg)
+	// main(seq) executes fallback, which executes primary and secondary.
+	// The response of primary is the final response.
+	events := []query_context.TraceEvent{
+		{ID: 1, Tag: "main", Response: r1},
+		{ID: 2, Parent: 1, Tag: "fallback", Response: r1},
+		{ID: 3, Parent: 2, Tag: "primary", Response: r1},
+		{ID: 4, Parent: 2, Tag: "secondary", Response: r2},
+		{ID: 5, Parent: 1, Tag: "ttl"},
+	}
+	if got := responder(events, r1); got != "primary" {
+		t.Fatalf("want primary, got %s", got)
+	}
+	if got := responder(events, r2); got != "secondary" {
+		t.Fatalf("want secondary, got %s", got)
+	}
+	if got := responder(events, new(dns.Msg)); got != "" {
+		t.Fatalf("want empty responder, got %s", got)
+	}
+}
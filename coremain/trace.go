@@ -0,0 +1,486 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTraceSize     = 64
+	traceAPIQueryTimeout = time.Second * 5
+)
+
+// queryTracer traces queries that are armed by the api or carry the trace
+// EDNS0 option (see TraceConfig), and keeps the recent traces. A trace
+// records every plugin that the query passed through, results of
+// matchers, timing and changes of the query and response.
+//
+//	GET  /trace/       lists recent traces, newest first, without events.
+//	GET  /trace/<id>   shows a trace.
+//	POST /trace/arm    traces the next queries of a domain. Params are
+//	                   name (required), client (ip) and count (default 1).
+//	POST /trace/query  executes a query and returns its trace, like
+//	                   "dig +trace" for plugins. Params are name (required),
+//	                   type (default A), client_ip and entry (default is
+//	                   the exec of the first server).
+type queryTracer struct {
+	m            *Mosdns
+	optCode      uint16
+	size         int
+	defaultEntry string
+
+	seq    uint64 // atomic
+	armedN int32  // atomic, number of armed queries
+
+	// Queries are sampled and exported by exporter. Sampled traces are
+	// not kept in recent.
+	sampleRatio float64
+	exporter    *otlpExporter // nil if the export is disabled
+
+	mu     sync.Mutex
+	armed  []*traceArm
+	recent []*traceRecord // oldest first
+}
+
+type traceArm struct {
+	name      string // lower case fqdn
+	client    netip.Addr
+	remaining int
+}
+
+type traceRecord struct {
+	ID         string                     `json:"id"`
+	Time       time.Time                  `json:"time"`
+	Query      string                     `json:"query"`
+	DurationUs int64                      `json:"duration_us"`
+	Response   []string                   `json:"response,omitempty"`
+	Events     []query_context.TraceEvent `json:"events,omitempty"`
+}
+
+func newQueryTracer(m *Mosdns, cfg *TraceConfig) *queryTracer {
+	size := cfg.Size
+	if size <= 0 {
+		size = defaultTraceSize
+	}
+	return &queryTracer{m: m, optCode: cfg.EDNSOption, size: size}
+}
+
+func (t *queryTracer) newTrace(id string) *query_context.Trace {
+	if len(id) == 0 {
+		id = "q" + strconv.FormatUint(atomic.AddUint64(&t.seq, 1), 10)
+	}
+	return query_context.NewTrace(id)
+}
+
+// StartTrace implements dns_handler.QueryTracer.
+func (t *queryTracer) StartTrace(qCtx *query_context.Context) {
+	if t.optCode == 0 && atomic.LoadInt32(&t.armedN) == 0 && t.sampleRatio == 0 {
+		return
+	}
+	if t.optCode != 0 {
+		if opt := qCtx.QReadOnly().IsEdns0(); opt != nil {
+			for i, o := range opt.Option {
+				if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == t.optCode {
+					qCtx.SetTrace(t.newTrace(sanitizeTraceID(l.Data)))
+					// Removes the option, so it will not be forwarded to upstreams.
+					opt := qCtx.Q().IsEdns0()
+					opt.Option = append(opt.Option[:i:i], opt.Option[i+1:]...)
+					return
+				}
+			}
+		}
+	}
+	if atomic.LoadInt32(&t.armedN) > 0 && t.takeArmed(qCtx) {
+		qCtx.SetTrace(t.newTrace(""))
+		return
+	}
+	if t.sampleRatio > 0 && rand.Float64() < t.sampleRatio {
+		qCtx.SetTrace(query_context.NewSampledTrace("s" + strconv.FormatUint(atomic.AddUint64(&t.seq, 1), 10)))
+	}
+}
+
+// takeArmed reports whether qCtx matches an armed trace, and consumes it.
+func (t *queryTracer) takeArmed(qCtx *query_context.Context) bool {
+	q := qCtx.QReadOnly()
+	if len(q.Question) == 0 {
+		return false
+	}
+	name := strings.ToLower(q.Question[0].Name)
+	client := qCtx.ReqMeta().ClientAddr.Unmap()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, a := range t.armed {
+		if a.name != name || a.client.IsValid() && a.client != client {
+			continue
+		}
+		a.remaining--
+		if a.remaining <= 0 {
+			t.armed = append(t.armed[:i], t.armed[i+1:]...)
+		}
+		atomic.AddInt32(&t.armedN, -1)
+		return true
+	}
+	return false
+}
+
+func (t *queryTracer) arm(name string, client netip.Addr, count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.armed = append(t.armed, &traceArm{name: strings.ToLower(dns.Fqdn(name)), client: client, remaining: count})
+	atomic.AddInt32(&t.armedN, int32(count))
+}
+
+// FinishTrace implements dns_handler.QueryTracer.
+func (t *queryTracer) FinishTrace(qCtx *query_context.Context, resp *dns.Msg, err error) {
+	r := t.record(qCtx, resp, err)
+	if !qCtx.Trace().Sampled() {
+		t.store(r)
+	}
+	if t.exporter != nil {
+		t.exporter.export(qCtx, resp, err, r)
+	}
+}
+
+// record returns the trace of qCtx. resp can be nil, err is the error
+// of the entry.
+func (t *queryTracer) record(qCtx *query_context.Context, resp *dns.Msg, err error) *traceRecord {
+	tr := qCtx.Trace()
+	r := &traceRecord{
+		ID:         tr.ID(),
+		Time:       tr.StartTime(),
+		Query:      qCtx.String(),
+		DurationUs: time.Since(tr.StartTime()).Microseconds(),
+		Response:   traceMsgLines(resp, true),
+		Events:     tr.Events(),
+	}
+	if err != nil {
+		r.Response = append(r.Response, "error: "+err.Error())
+	}
+	return r
+}
+
+func (t *queryTracer) store(r *traceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.recent) >= t.size {
+		t.recent = append(t.recent[:0], t.recent[len(t.recent)-t.size+1:]...)
+	}
+	t.recent = append(t.recent, r)
+}
+
+func (t *queryTracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/trace/"), "/")
+	switch {
+	case req.Method == http.MethodGet && len(p) == 0:
+		t.mu.Lock()
+		l := make([]traceRecord, 0, len(t.recent))
+		for i := len(t.recent) - 1; i >= 0; i-- {
+			r := *t.recent[i]
+			r.Events = nil
+			l = append(l, r)
+		}
+		t.mu.Unlock()
+		writeJSON(w, l)
+	case req.Method == http.MethodGet:
+		t.mu.Lock()
+		var r *traceRecord
+		for _, e := range t.recent {
+			if e.ID == p {
+				r = e
+			}
+		}
+		t.mu.Unlock()
+		if r == nil {
+			apiError(w, http.StatusNotFound, fmt.Errorf("trace %s not found", p))
+			return
+		}
+		writeJSON(w, r)
+	case req.Method == http.MethodPost && p == "arm":
+		t.serveArm(w, req)
+	case req.Method == http.MethodPost && p == "query":
+		t.serveQuery(w, req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *queryTracer) serveArm(w http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid name %s", name))
+		return
+	}
+	var client netip.Addr
+	if s := req.FormValue("client"); len(s) > 0 {
+		var err error
+		client, err = netip.ParseAddr(s)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid client, %w", err))
+			return
+		}
+		client = client.Unmap()
+	}
+	count := 1
+	if s := req.FormValue("count"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > t.size {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("count must be 1~%d", t.size))
+			return
+		}
+		count = n
+	}
+	t.arm(name, client, count)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *queryTracer) serveQuery(w http.ResponseWriter, req *http.Request) {
+	tq := TestQuery{Name: req.FormValue("name"), Type: req.FormValue("type"), ClientIP: req.FormValue("client_ip")}
+	q, meta, err := tq.build()
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	tag := req.FormValue("entry")
+	if len(tag) == 0 {
+		tag = t.defaultEntry
+	}
+	entry := t.m.execs[tag]
+	if entry == nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("cannot find entry %s", tag))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), traceAPIQueryTimeout)
+	defer cancel()
+	qCtx := query_context.NewContext(q, meta)
+	qCtx.SetTrace(t.newTrace(""))
+	err = entry.Exec(ctx, qCtx, nil)
+	r := t.record(qCtx, qCtx.RReadOnly(), err)
+	t.store(r)
+	writeJSON(w, r)
+}
+
+// sanitizeTraceID returns b as a trace id if it is printable and short.
+// Otherwise, it returns an empty string.
+func sanitizeTraceID(b []byte) string {
+	if len(b) == 0 || len(b) > 64 {
+		return ""
+	}
+	for _, c := range b {
+		if c <= ' ' || c > '~' || c == '/' {
+			return ""
+		}
+	}
+	return string(b)
+}
+
+// traceMsgLines returns the records of m in lines for traces.
+// It returns nil if m is nil.
+func traceMsgLines(m *dns.Msg, isResponse bool) []string {
+	if m == nil {
+		return nil
+	}
+	var l []string
+	if isResponse {
+		l = append(l, "rcode: "+dns.RcodeToString[m.Rcode])
+	}
+	for _, q := range m.Question {
+		l = append(l, "question: "+strings.TrimPrefix(q.String(), ";"))
+	}
+	sections := [...]struct {
+		name string
+		rrs  []dns.RR
+	}{{"answer", m.Answer}, {"ns", m.Ns}, {"extra", m.Extra}}
+	for _, s := range sections {
+		for _, rr := range s.rrs {
+			if opt, ok := rr.(*dns.OPT); ok {
+				l = append(l, fmt.Sprintf("edns: udp %d do %t", opt.UDPSize(), opt.Do()))
+				for _, o := range opt.Option {
+					l = append(l, fmt.Sprintf("edns option %d: %s", o.Option(), o.String()))
+				}
+				continue
+			}
+			l = append(l, s.name+": "+strings.ReplaceAll(rr.String(), "\t", " "))
+		}
+	}
+	return l
+}
+
+// traceSnapshot returns the lines of the query and response of qCtx.
+func traceSnapshot(qCtx *query_context.Context) []string {
+	var l []string
+	for _, s := range traceMsgLines(qCtx.QReadOnly(), false) {
+		l = append(l, "query "+s)
+	}
+	for _, s := range traceMsgLines(qCtx.RReadOnly(), true) {
+		l = append(l, "response "+s)
+	}
+	return l
+}
+
+// traceDiff returns the removed lines with "- " prefixes and the added
+// lines with "+ " prefixes.
+func traceDiff(before, after []string) []string {
+	count := make(map[string]int, len(before))
+	for _, s := range before {
+		count[s]++
+	}
+	var added []string
+	for _, s := range after {
+		if count[s] > 0 {
+			count[s]--
+			continue
+		}
+		added = append(added, "+ "+s)
+	}
+	var diff []string
+	for _, s := range before {
+		if count[s] > 0 {
+			count[s]--
+			diff = append(diff, "- "+s)
+		}
+	}
+	return append(diff, added...)
+}
+
+// queryTraceExec records the executions of traced queries.
+type queryTraceExec struct {
+	ExecutablePlugin
+}
+
+var _ AnswerModifier = (*queryTraceExec)(nil)
+var _ DNSSECPassthroughEnabler = (*queryTraceExec)(nil)
+
+func (e *queryTraceExec) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	tr := qCtx.Trace()
+	if tr == nil {
+		return e.ExecutablePlugin.Exec(ctx, qCtx, next)
+	}
+
+	ev := tr.Begin(ctx, e.Tag(), e.Type(), "exec")
+	start := time.Now()
+	before := traceSnapshot(qCtx)
+	r0 := qCtx.R()
+	done := false
+	finish := func(err error) {
+		done = true
+		d := time.Since(start).Microseconds()
+		diff := traceDiff(before, traceSnapshot(qCtx))
+		r := qCtx.R()
+		tr.Update(ev, func(ev *query_context.TraceEvent) {
+			ev.DurationUs = d
+			ev.Diff = diff
+			if r != nil && r != r0 {
+				ev.Response = r
+			}
+			if err != nil {
+				ev.Err = err.Error()
+			}
+		})
+	}
+	// The plugins executed by e, e.g. the sub sequences, are its children.
+	// The plugins after e are its siblings.
+	parent := query_context.TraceParentEvent(ctx, tr)
+	n := &tracedNode{next: next, f: func() { finish(nil) }, ctx: func(ctx context.Context) context.Context {
+		return query_context.WithTraceParent(ctx, tr, parent)
+	}}
+	err := e.ExecutablePlugin.Exec(query_context.WithTraceParent(ctx, tr, ev), qCtx, n)
+	if !done {
+		finish(err)
+	}
+	return err
+}
+
+func (e *queryTraceExec) ModifiesAnswer() bool {
+	m, ok := e.ExecutablePlugin.(AnswerModifier)
+	return ok && m.ModifiesAnswer()
+}
+
+func (e *queryTraceExec) EnablesDNSSECPassthrough() bool {
+	d, ok := e.ExecutablePlugin.(DNSSECPassthroughEnabler)
+	return ok && d.EnablesDNSSECPassthrough()
+}
+
+// queryTraceMatcher records the results of traced queries.
+type queryTraceMatcher struct {
+	MatcherPlugin
+}
+
+func (m *queryTraceMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	tr := qCtx.Trace()
+	if tr == nil {
+		return m.MatcherPlugin.Match(ctx, qCtx)
+	}
+	ev := tr.Begin(ctx, m.Tag(), m.Type(), "match")
+	start := time.Now()
+	ok, err := m.MatcherPlugin.Match(ctx, qCtx)
+	d := time.Since(start).Microseconds()
+	tr.Update(ev, func(ev *query_context.TraceEvent) {
+		ev.DurationUs = d
+		ev.Matched = &ok
+		if err != nil {
+			ev.Err = err.Error()
+		}
+	})
+	return ok, err
+}
+
+// tracedNode calls f before the chain is passed to next.
+type tracedNode struct {
+	next executable_seq.ExecutableChainNode
+	f    func()
+	ctx  func(ctx context.Context) context.Context // maybe nil, rewrites the ctx for next
+}
+
+func (n *tracedNode) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	n.f()
+	if n.ctx != nil {
+		ctx = n.ctx(ctx)
+	}
+	if n.next == nil {
+		return nil
+	}
+	return n.next.Exec(ctx, qCtx, next)
+}
+
+func (n *tracedNode) Next() executable_seq.ExecutableChainNode {
+	if n.next == nil {
+		return nil
+	}
+	return n.next.Next()
+}
+
+func (n *tracedNode) LinkNext(executable_seq.ExecutableChainNode) {
+	panic("tracedNode: cannot link next")
+}
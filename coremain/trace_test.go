@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func newTestTraceMosdns(t *testing.T, cfg *TraceConfig) (*Mosdns, *queryTracer) {
+	t.Helper()
+	m := newMosdns(zap.NewNop())
+	t.Cleanup(func() {
+		m.sc.SendCloseSignal(nil)
+		m.sc.Done()
+		m.sc.CloseWait()
+		m.scheduler.Close()
+	})
+	err := m.loadPlugins(&Config{Plugins: []PluginConfig{
+		{Tag: "local", Type: "test_answer", Args: map[string]interface{}{"ip": "192.168.1.1"}},
+		{Tag: "remote", Type: "test_answer", Args: map[string]interface{}{"ip": "1.1.1.1"}},
+		{Tag: "main", Type: "test_router", Args: map[string]interface{}{"local": "local", "remote": "remote"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt := newQueryTracer(m, cfg)
+	qt.defaultEntry = "main"
+	return m, qt
+}
+
+func Test_queryTracer_api(t *testing.T) {
+	_, qt := newTestTraceMosdns(t, &TraceConfig{})
+
+	w := httptest.NewRecorder()
+	qt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trace/query?name=nas.local", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d, %s", w.Code, w.Body)
+	}
+	r := new(traceRecord)
+	if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Events) != 2 || r.Events[0].Tag != "main" || r.Events[1].Tag != "local" {
+		t.Fatalf("unexpected events %+v", r.Events)
+	}
+	if r.Events[0].Parent != 0 || r.Events[1].Parent != r.Events[0].ID {
+		t.Fatalf("local should be a child of main, %+v", r.Events)
+	}
+	if d := strings.Join(r.Events[1].Diff, "\n"); !strings.Contains(d, "+ response answer: nas.local. 60 IN A 192.168.1.1") {
+		t.Fatalf("unexpected diff:\n%s", d)
+	}
+
+	w = httptest.NewRecorder()
+	qt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trace/"+r.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d, %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	qt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trace/", nil))
+	var l []traceRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].ID != r.ID || l[0].Events != nil {
+		t.Fatalf("unexpected list %+v", l)
+	}
+}
+
+func Test_queryTracer_StartTrace(t *testing.T) {
+	_, qt := newTestTraceMosdns(t, &TraceConfig{EDNSOption: 65001, Size: 2})
+	newQCtx := func(name string, opt bool) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if opt {
+			q.SetEdns0(1232, false)
+			o := q.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte("my-id")})
+		}
+		return query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("10.0.0.1")})
+	}
+
+	qCtx := newQCtx("example.com.", true)
+	qt.StartTrace(qCtx)
+	if qCtx.Trace() == nil || qCtx.Trace().ID() != "my-id" {
+		t.Fatal("query with the option should be traced")
+	}
+	if len(qCtx.QReadOnly().IsEdns0().Option) != 0 {
+		t.Fatal("trace option should be removed")
+	}
+
+	qt.arm("Example.com", netip.MustParseAddr("10.0.0.1"), 1)
+	qt.arm("example.com", netip.MustParseAddr("10.0.0.2"), 1)
+	qCtx = newQCtx("example.org.", false)
+	if qt.StartTrace(qCtx); qCtx.Trace() != nil {
+		t.Fatal("query should not be traced")
+	}
+	qCtx = newQCtx("example.com.", false)
+	if qt.StartTrace(qCtx); qCtx.Trace() == nil {
+		t.Fatal("armed query should be traced")
+	}
+	qCtx = newQCtx("example.com.", false)
+	if qt.StartTrace(qCtx); qCtx.Trace() != nil {
+		t.Fatal("armed trace should be consumed")
+	}
+
+	qCtx.SetTrace(qt.newTrace(""))
+	for i := 0; i < 3; i++ {
+		qt.FinishTrace(qCtx, nil, nil)
+	}
+	if len(qt.recent) != 2 {
+		t.Fatalf("want 2 recent traces, got %d", len(qt.recent))
+	}
+}
+
+func Test_traceDiff(t *testing.T) {
+	got := traceDiff([]string{"a", "b", "b"}, []string{"b", "c", "a"})
+	want := []string{"- b", "+ c"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
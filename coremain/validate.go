@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strings"
+)
+
+func newValidateCmd() *cobra.Command {
+	sf := new(serverFlags)
+	var verbose bool
+	c := &cobra.Command{
+		Use:   "validate [-c config_file] [-d working_dir]",
+		Short: "Check the config without starting mosdns.",
+		Long: "Load the config, init all data providers and plugins and check all servers. " +
+			"No socket will be opened. Every error is reported with the file and line of its config entry. " +
+			"Exit with a non-zero code if any error is found.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runValidateCmd(sf, verbose, cmd.OutOrStdout())
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&sf.c, "config", "c", "", "config file")
+	fs.StringVarP(&sf.dir, "dir", "d", "", "working dir")
+	markConfigFlags(c)
+	fs.BoolVarP(&verbose, "verbose", "v", false, "show mosdns logs")
+	return c
+}
+
+func runValidateCmd(sf *serverFlags, verbose bool, out io.Writer) error {
+	if len(sf.dir) > 0 {
+		if err := os.Chdir(sf.dir); err != nil {
+			return fmt.Errorf("failed to change the current working directory, %w", err)
+		}
+	}
+	cfg, fileUsed, err := loadConfig(sf.c)
+	if err != nil {
+		return fmt.Errorf("fail to load config, %w", err)
+	}
+	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+		return fmt.Errorf("failed to load sub config file, %w", err)
+	}
+
+	lg := zap.NewNop()
+	if verbose {
+		var closeLog func()
+		lg, closeLog, err = mlog.NewLogger(&cfg.Log)
+		if err != nil {
+			return fmt.Errorf("failed to init logger: %w", err)
+		}
+		defer closeLog()
+	}
+	errs := validateConfig(lg, cfg)
+	locs := configLocations(fileUsed)
+	for _, e := range errs {
+		if loc, ok := locs[e.section+"/"+e.tag]; ok {
+			fmt.Fprintf(out, "%s: %v\n", loc, e)
+		} else {
+			fmt.Fprintf(out, "%v\n", e)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors found", len(errs))
+	}
+	fmt.Fprintln(out, "config is valid")
+	return nil
+}
+
+// validateConfig inits everything of cfg in dry run mode and returns all
+// errors.
+func validateConfig(lg *zap.Logger, cfg *Config) []*configError {
+	m := newMosdns(lg)
+	m.dryRun = true
+	defer func() {
+		m.sc.SendCloseSignal(nil)
+		m.sc.Done()
+		m.sc.CloseWait()
+		m.closePlugins()
+		m.scheduler.Close()
+	}()
+
+	var errs []*configError
+	addErr := func(section, tag string, err error) {
+		errs = append(errs, &configError{section: section, tag: tag, err: err})
+	}
+
+	if len(cfg.API.Tokens) > 0 {
+		if _, err := newAPIAuth(lg, m.httpAPIMux, cfg.API.Tokens); err != nil {
+			addErr("api", "", err)
+		}
+	}
+	if err := m.initHotSwapAPI(&cfg.API); err != nil {
+		addErr("api", "", err)
+	}
+	if len(cfg.ACME.Domains) > 0 {
+		if err := m.initACME(&cfg.ACME); err != nil {
+			addErr("acme", "", err)
+		}
+	}
+	if len(cfg.User) > 0 {
+		if _, _, err := lookupUser(cfg.User); err != nil {
+			addErr("user", "", err)
+		}
+	}
+
+	m.initPlugins(cfg, func(e *configError) bool {
+		errs = append(errs, e)
+		return true
+	})
+
+	// Plugins can only refer to the plugins before them, so a loop is
+	// reported as missing plugins by initPlugins. Report the loop as well.
+	g := buildPluginGraph(cfg)
+	inLoop := make(map[string]bool)
+	for _, pc := range cfg.Plugins {
+		if len(pc.Tag) == 0 || inLoop[pc.Tag] {
+			continue
+		}
+		if loop := g.findCycle(pc.Tag); loop != nil {
+			for _, tag := range loop {
+				inLoop[tag] = true
+			}
+			addErr("plugins", pc.Tag, fmt.Errorf("reference loop %s", strings.Join(loop, " -> ")))
+		}
+	}
+
+	if len(cfg.Servers) == 0 {
+		addErr("servers", "", errors.New("no server is configured"))
+	}
+	for i := range cfg.Servers {
+		if err := m.startServers(&cfg.Servers[i]); err != nil {
+			addErr("servers", fmt.Sprintf("#%d", i), err)
+		}
+	}
+
+	if stc := &cfg.SelfTest; len(stc.Queries) > 0 {
+		tag := stc.Entry
+		if len(tag) == 0 && len(cfg.Servers) > 0 {
+			tag = cfg.Servers[0].Exec
+		}
+		if entry := m.execs[tag]; entry == nil {
+			addErr("self_test", "", fmt.Errorf("cannot find self-test entry %s", tag))
+		} else if _, err := newSelfTest(lg, entry, stc); err != nil {
+			addErr("self_test", "", err)
+		}
+	}
+	return errs
+}
+
+// configLocations returns the "file:line" of config entries in file and
+// its included files. The keys are "<section>/<tag>". Servers, which have
+// no tag, are keyed by "servers/#<index>" in the order of the merged config.
+// Top-level entries of file are keyed by "<section>/".
+// Files that cannot be parsed as yaml (e.g. toml files) are ignored. Json
+// is a subset of yaml.
+func configLocations(file string) map[string]string {
+	locs := make(map[string]string)
+	var servers []string
+	collectLocations(file, 0, locs, &servers)
+	for i, loc := range servers {
+		locs[fmt.Sprintf("servers/#%d", i)] = loc
+	}
+	return locs
+}
+
+func collectLocations(file string, depth int, locs map[string]string, servers *[]string) {
+	if depth > 8 {
+		return
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	doc := new(yaml.Node)
+	if err := yaml.Unmarshal(b, doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return
+	}
+	loc := func(n *yaml.Node) string {
+		return fmt.Sprintf("%s:%d", file, n.Line)
+	}
+
+	// Entries of included files come first, same as mergeInclude.
+	var ownServers []string
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		if depth == 0 {
+			locs[k.Value+"/"] = loc(k)
+		}
+		switch k.Value {
+		case "include":
+			for _, n := range v.Content {
+				files, _ := expandInclude(n.Value)
+				for _, f := range files {
+					collectLocations(f, depth+1, locs, servers)
+				}
+			}
+		case "plugins", "data_providers":
+			for _, n := range v.Content {
+				tag := mappingValue(n, "tag")
+				if len(tag) == 0 {
+					continue
+				}
+				if _, dup := locs[k.Value+"/"+tag]; !dup {
+					locs[k.Value+"/"+tag] = loc(n)
+				}
+			}
+		case "servers":
+			for _, n := range v.Content {
+				ownServers = append(ownServers, loc(n))
+			}
+		}
+	}
+	*servers = append(*servers, ownServers...)
+}
+
+// mappingValue returns the scalar value of key in mapping node n.
+func mappingValue(n *yaml.Node, key string) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_validateConfig(t *testing.T) {
+	// Servers must not bind their addresses in dry run mode.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	addr := c.LocalAddr().String()
+
+	cfg := &Config{
+		API: APIConfig{HotSwap: true},
+		Plugins: []PluginConfig{
+			{Tag: "local", Type: "test_answer", Args: map[string]interface{}{"ip": "192.168.1.1"}},
+			{Tag: "remote", Type: "test_answer", Args: map[string]interface{}{"ip": "invalid"}},
+			{Tag: "local", Type: "test_answer", Args: map[string]interface{}{"ip": "1.1.1.1"}},
+			{Tag: "unknown", Type: "not_exist"},
+		},
+		Servers: []ServerConfig{
+			{Exec: "local", Listeners: []*ServerListenerConfig{{Protocol: "udp", Addr: addr}}},
+			{Exec: "remote", Listeners: []*ServerListenerConfig{{Protocol: "udp", Addr: addr}}},
+			{Exec: "local", Listeners: []*ServerListenerConfig{{Protocol: "quic", Addr: addr}}},
+		},
+	}
+	errs := validateConfig(zap.NewNop(), cfg)
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.section+"/"+e.tag)
+	}
+	want := []string{"api/", "plugins/remote", "plugins/local", "plugins/unknown", "servers/#1", "servers/#2"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want errors of %v, got %v", want, errs)
+	}
+}
+
+func Test_configLocations(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub.yaml")
+	mainFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(sub, []byte(`
+plugins:
+  - tag: sub
+    type: test_answer
+servers:
+  - exec: sub
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mainFile, []byte(`
+servers:
+  - exec: main
+include:
+  - `+sub+`
+plugins:
+  - tag: main
+    type: test_answer
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	locs := configLocations(mainFile)
+	for k, want := range map[string]string{
+		"plugins/sub":  sub + ":3",
+		"plugins/main": mainFile + ":7",
+		"servers/#0":   sub + ":6",
+		"servers/#1":   mainFile + ":3",
+		"include/":     mainFile + ":4",
+	} {
+		if got := locs[k]; got != want {
+			t.Errorf("location of %s: want %s, got %s", k, want, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"bytes"
+	"go.uber.org/zap/zapcore"
+	"strings"
+)
+
+// levelOverrideCore filters the logs of Core by the levels of their
+// logger names. Core must be enabled at the lowest level.
+type levelOverrideCore struct {
+	zapcore.Core
+	lvl    zapcore.Level            // level of loggers that are not in levels
+	levels map[string]zapcore.Level // logger names to levels
+}
+
+func (c *levelOverrideCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelOverrideCore{Core: c.Core.With(fields), lvl: c.lvl, levels: c.levels}
+}
+
+func (c *levelOverrideCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level < c.levelOf(ent.LoggerName) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// levelOf returns the level of the logger name. Sub loggers, e.g.
+// "tag.sub", have the level of their parents.
+func (c *levelOverrideCore) levelOf(name string) zapcore.Level {
+	for len(name) > 0 {
+		if l, ok := c.levels[name]; ok {
+			return l
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return c.lvl
+}
+
+// debugSamplerCore sends the debug logs to sampled, and others to Core.
+type debugSamplerCore struct {
+	zapcore.Core
+	sampled zapcore.Core // sampler of Core
+}
+
+func (c *debugSamplerCore) With(fields []zapcore.Field) zapcore.Core {
+	return &debugSamplerCore{Core: c.Core.With(fields), sampled: c.sampled.With(fields)}
+}
+
+func (c *debugSamplerCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level == zapcore.DebugLevel {
+		return c.sampled.Check(ent, ce)
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// levelWriter writes a log message with its level.
+type levelWriter interface {
+	WriteLevel(lvl zapcore.Level, msg []byte) error
+	Close() error
+}
+
+// levelCore is a zapcore.Core that writes logs to a levelWriter.
+type levelCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   levelWriter
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &levelCore{LevelEnabler: c.LevelEnabler, enc: enc, w: c.w}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *levelCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	return c.w.WriteLevel(ent.Level, bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+func (c *levelCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends logs with the native protocol of journald.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/.
+type journaldWriter struct {
+	c *net.UnixConn
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newJournaldWriter() (levelWriter, error) {
+	return dialJournald(journaldSocket)
+}
+
+func dialJournald(socket string) (*journaldWriter, error) {
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{c: c}, nil
+}
+
+func (j *journaldWriter) WriteLevel(lvl zapcore.Level, msg []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.buf.Reset()
+	appendJournaldField(&j.buf, "MESSAGE", msg)
+	appendJournaldField(&j.buf, "PRIORITY", []byte(strconv.Itoa(journaldPriority(lvl))))
+	appendJournaldField(&j.buf, "SYSLOG_IDENTIFIER", []byte("mosdns"))
+	_, err := j.c.Write(j.buf.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		// The message is larger than a datagram.
+		return j.writeMemfd(j.buf.Bytes())
+	}
+	return err
+}
+
+// writeMemfd sends b in a sealed memfd, which is how journald receives
+// large messages.
+func (j *journaldWriter) writeMemfd(b []byte) error {
+	fd, err := unix.MemfdCreate("mosdns-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return fmt.Errorf("failed to create memfd, %w", err)
+	}
+	defer unix.Close(fd)
+	for len(b) > 0 {
+		n, err := unix.Write(fd, b)
+		if err != nil {
+			return fmt.Errorf("failed to write memfd, %w", err)
+		}
+		b = b[n:]
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals); err != nil {
+		return fmt.Errorf("failed to seal memfd, %w", err)
+	}
+	// WriteMsgUnix does not work with a connected datagram socket.
+	rc, err := j.c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = rc.Write(func(s uintptr) bool {
+		sendErr = unix.Sendmsg(int(s), nil, unix.UnixRights(fd), nil, 0)
+		return sendErr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+func (j *journaldWriter) Close() error {
+	return j.c.Close()
+}
+
+// appendJournaldField appends a field to b. Values that contain newlines
+// are encoded with their lengths.
+func appendJournaldField(b *bytes.Buffer, k string, v []byte) {
+	b.WriteString(k)
+	if bytes.IndexByte(v, '\n') >= 0 {
+		b.WriteByte('\n')
+		var l [8]byte
+		binary.LittleEndian.PutUint64(l[:], uint64(len(v)))
+		b.Write(l[:])
+	} else {
+		b.WriteByte('=')
+	}
+	b.Write(v)
+	b.WriteByte('\n')
+}
+
+// journaldPriority returns the syslog priority of lvl.
+func journaldPriority(lvl zapcore.Level) int {
+	switch {
+	case lvl <= zapcore.DebugLevel:
+		return 7
+	case lvl == zapcore.InfoLevel:
+		return 6
+	case lvl == zapcore.WarnLevel:
+		return 4
+	case lvl == zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
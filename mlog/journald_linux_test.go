@@ -0,0 +1,96 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"bytes"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_journaldWriter(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.socket")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	j, err := dialJournald(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// read returns the fields of the next message, from the datagram or
+	// the memfd.
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, unix.CmsgSpace(4))
+	read := func() []byte {
+		n, oobn, _, _, err := l.ReadMsgUnix(buf, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oobn == 0 {
+			return append([]byte(nil), buf[:n]...)
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds, err := unix.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := os.NewFile(uintptr(fds[0]), "memfd")
+		defer f.Close()
+		// The offset is shared with the writer. journald maps the file.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if _, err := b.ReadFrom(f); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	if err := j.WriteLevel(zapcore.WarnLevel, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if b := read(); !bytes.Contains(b, []byte("MESSAGE=hello\n")) || !bytes.Contains(b, []byte("PRIORITY=4\n")) {
+		t.Fatalf("unexpected message %q", b)
+	}
+
+	// Larger than the max datagram size.
+	large := bytes.Repeat([]byte("x"), 4<<20)
+	if err := j.WriteLevel(zapcore.InfoLevel, large); err != nil {
+		t.Fatal(err)
+	}
+	if b := read(); !bytes.Contains(b, large) {
+		t.Fatalf("large message is not received, got %d bytes", len(b))
+	}
+}
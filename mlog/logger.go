@@ -24,6 +24,7 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"os"
+	"time"
 )
 
 type LogConfig struct {
@@ -40,10 +41,44 @@ type LogConfig struct {
 	// OmitTime omits the time in log.
 	OmitTime bool `yaml:"omit_time"`
 
+	// Sink is where logs are written. Can be "syslog" or "journald".
+	// Default is File or stderr. Syslog and journald record the time and
+	// the level by themselves, so they are omitted from the messages.
+	Sink string `yaml:"sink"`
+
+	// Syslog configures the "syslog" sink.
+	Syslog SyslogConfig `yaml:"syslog"`
+
+	// Plugins overrides Level for the logs of plugins. Keys are plugin
+	// tags, values are levels.
+	Plugins map[string]string `yaml:"plugins"`
+
+	// Sampling samples debug logs.
+	Sampling SamplingConfig `yaml:"sampling"`
+
 	// parsed level
 	lvl zapcore.Level
 }
 
+type SyslogConfig struct {
+	// Network and Addr of the syslog server, e.g. "udp" and
+	// "192.168.1.1:514". Default is the local syslog server.
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+
+	// Tag of the messages. Default is "mosdns".
+	Tag string `yaml:"tag"`
+}
+
+// SamplingConfig samples the debug logs that have the same message.
+// In every second, the first Initial logs are written, then every
+// Thereafter-th log is written. Other logs are dropped.
+type SamplingConfig struct {
+	// Initial enables the sampling if it is > 0.
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
 var (
 	stderr = zapcore.Lock(os.Stderr)
 
@@ -52,37 +87,96 @@ var (
 	s   = l.Sugar()
 )
 
-func NewLogger(lc *LogConfig) (*zap.Logger, error) {
+// NewLogger creates a logger from lc. The returned func flushes and
+// closes the file or the sink of the logger. It must be called when the
+// logger is no longer used, e.g. on shutdown.
+func NewLogger(lc *LogConfig) (*zap.Logger, func(), error) {
 	lvl, err := zapcore.ParseLevel(lc.Level)
 	if err != nil {
-		return nil, fmt.Errorf("invalid log level: %w", err)
+		return nil, nil, fmt.Errorf("invalid log level: %w", err)
 	}
 	lc.lvl = lvl
 
 	return newLoggerFromCfg(lc)
 }
 
-func newLoggerFromCfg(lc *LogConfig) (*zap.Logger, error) {
-	var out zapcore.WriteSyncer
-	if lf := lc.File; len(lf) > 0 {
-		f, _, err := zap.Open(lf)
+func newLoggerFromCfg(lc *LogConfig) (*zap.Logger, func(), error) {
+	// The core is enabled at the lowest level, levelOverrideCore filters
+	// logs by their logger names.
+	minLvl := lc.lvl
+	levels := make(map[string]zapcore.Level, len(lc.Plugins))
+	for tag, s := range lc.Plugins {
+		l, err := zapcore.ParseLevel(s)
 		if err != nil {
-			return nil, fmt.Errorf("open log file: %w", err)
+			return nil, nil, fmt.Errorf("invalid log level of plugin %s: %w", tag, err)
 		}
-		out = zapcore.Lock(f)
-	} else {
-		out = stderr
+		levels[tag] = l
+		if l < minLvl {
+			minLvl = l
+		}
+	}
+	if sc := lc.Sampling; sc.Initial > 0 && sc.Thereafter < 0 {
+		return nil, nil, fmt.Errorf("invalid sampling thereafter %d", sc.Thereafter)
 	}
 
 	ec := defaultEncoderConfig()
 	if lc.OmitTime {
 		ec.TimeKey = ""
 	}
-
+	encoderFactory := zapcore.NewConsoleEncoder
 	if lc.Production {
-		return newLogger(zapcore.NewJSONEncoder, ec, lc.lvl, out), nil
+		encoderFactory = zapcore.NewJSONEncoder
+	}
+
+	var core zapcore.Core
+	closeOut := func() {}
+	switch lc.Sink {
+	case "":
+		var out zapcore.WriteSyncer
+		if lf := lc.File; len(lf) > 0 {
+			f, closeFile, err := zap.Open(lf)
+			if err != nil {
+				return nil, nil, fmt.Errorf("open log file: %w", err)
+			}
+			out = zapcore.Lock(f)
+			closeOut = closeFile
+		} else {
+			out = stderr
+		}
+		core = zapcore.NewCore(encoderFactory(ec), out, minLvl)
+	case "syslog", "journald":
+		if len(lc.File) > 0 {
+			return nil, nil, fmt.Errorf("file cannot be used with the %s sink", lc.Sink)
+		}
+		ec.TimeKey = ""
+		ec.LevelKey = ""
+		var w levelWriter
+		var err error
+		if lc.Sink == "syslog" {
+			w, err = newSyslogWriter(&lc.Syslog)
+		} else {
+			w, err = newJournaldWriter()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("open %s: %w", lc.Sink, err)
+		}
+		core = &levelCore{LevelEnabler: minLvl, enc: encoderFactory(ec), w: w}
+		closeOut = func() { _ = w.Close() }
+	default:
+		return nil, nil, fmt.Errorf("invalid log sink %s", lc.Sink)
+	}
+
+	if sc := lc.Sampling; sc.Initial > 0 {
+		core = &debugSamplerCore{Core: core, sampled: zapcore.NewSamplerWithOptions(core, time.Second, sc.Initial, sc.Thereafter)}
+	}
+	if len(levels) > 0 {
+		core = &levelOverrideCore{Core: core, lvl: lc.lvl, levels: levels}
 	}
-	return newLogger(zapcore.NewConsoleEncoder, ec, lc.lvl, out), nil
+	lg := zap.New(core)
+	return lg, func() {
+		_ = lg.Sync()
+		closeOut()
+	}, nil
 }
 
 func newLogger(
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_levelOverrideCore(t *testing.T) {
+	obs, logs := observer.New(zapcore.DebugLevel)
+	lg := zap.New(&levelOverrideCore{
+		Core:   obs,
+		lvl:    zapcore.WarnLevel,
+		levels: map[string]zapcore.Level{"cache": zapcore.DebugLevel, "forward": zapcore.ErrorLevel},
+	})
+
+	lg.Info("dropped")
+	lg.Warn("root warn")
+	lg.Named("cache").Debug("cache debug")
+	lg.Named("cache").Named("sub").With(zap.Int("k", 1)).Debug("cache sub debug")
+	lg.Named("forward").Warn("dropped")
+	lg.Named("forward").Error("forward error")
+	lg.Named("cache_2").Info("dropped")
+
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+	}
+	want := []string{"root warn", "cache debug", "cache sub debug", "forward error"}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func Test_debugSamplerCore(t *testing.T) {
+	obs, logs := observer.New(zapcore.DebugLevel)
+	lg := zap.New(&debugSamplerCore{Core: obs, sampled: zapcore.NewSamplerWithOptions(obs, time.Minute, 2, 0)})
+	for i := 0; i < 10; i++ {
+		lg.Debug("debug")
+		lg.Info("info")
+	}
+	if n := logs.FilterMessage("debug").Len(); n != 2 {
+		t.Fatalf("want 2 debug logs, got %d", n)
+	}
+	if n := logs.FilterMessage("info").Len(); n != 10 {
+		t.Fatalf("want 10 info logs, got %d", n)
+	}
+}
+
+func Test_NewLogger(t *testing.T) {
+	if _, _, err := NewLogger(&LogConfig{Level: "info", Plugins: map[string]string{"cache": "x"}}); err == nil {
+		t.Fatal("invalid plugin level should fail")
+	}
+	if _, _, err := NewLogger(&LogConfig{Level: "info", Sink: "x"}); err == nil {
+		t.Fatal("invalid sink should fail")
+	}
+	if _, _, err := NewLogger(&LogConfig{Level: "info", Sink: "syslog", File: "mosdns.log"}); err == nil {
+		t.Fatal("file with the syslog sink should fail")
+	}
+	lg, closeLog, err := NewLogger(&LogConfig{Level: "info", Plugins: map[string]string{"cache": "debug"}, Sampling: SamplingConfig{Initial: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeLog()
+	if ce := lg.Named("cache").Check(zapcore.DebugLevel, "x"); ce == nil {
+		t.Fatal("debug log of cache should be enabled")
+	}
+	if ce := lg.Check(zapcore.DebugLevel, "x"); ce != nil {
+		t.Fatal("debug log should be disabled")
+	}
+}
+
+func Test_NewLogger_file(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "mosdns.log")
+	lg, closeLog, err := NewLogger(&LogConfig{Level: "info", File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg.Info("hello")
+	closeLog()
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "hello") {
+		t.Fatalf("unexpected log file %q", b)
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !windows && !plan9
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"go.uber.org/zap/zapcore"
+	"log/syslog"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter(cfg *SyslogConfig) (levelWriter, error) {
+	tag := cfg.Tag
+	if len(tag) == 0 {
+		tag = "mosdns"
+	}
+	w, err := syslog.Dial(cfg.Network, cfg.Addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) WriteLevel(lvl zapcore.Level, msg []byte) error {
+	m := string(msg)
+	switch {
+	case lvl <= zapcore.DebugLevel:
+		return s.w.Debug(m)
+	case lvl == zapcore.InfoLevel:
+		return s.w.Info(m)
+	case lvl == zapcore.WarnLevel:
+		return s.w.Warning(m)
+	case lvl == zapcore.ErrorLevel:
+		return s.w.Err(m)
+	default:
+		return s.w.Crit(m)
+	}
+}
+
+func (s *syslogWriter) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package acme_cert obtains and renews tls certificates from an ACME CA,
+// e.g. Let's Encrypt.
+package acme_cert
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"strings"
+)
+
+// Supported challenge types.
+const (
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeDNS01     = "dns-01"
+)
+
+type Opts struct {
+	// Domains are the domains of the certificate. Required.
+	Domains []string
+
+	// Email is the contact email of the ACME account. Optional.
+	Email string
+
+	// Challenge is the challenge type. Default is ChallengeTLSALPN01.
+	// tls-alpn-01 is solved by tls listeners that use GetConfigForClient.
+	// http-01 is solved by HTTPHandler, which must be served on port 80.
+	// dns-01 is solved by answering TXT queries with ChallengeTXT, which
+	// requires mosdns to be the authoritative server of "_acme-challenge"
+	// names (e.g. by a NS or CNAME delegation).
+	Challenge string
+
+	// CacheDir is the directory that certificates and the account key
+	// are stored in. Required.
+	CacheDir string
+
+	// DirectoryURL is the ACME directory url.
+	// Default is Let's Encrypt production directory.
+	DirectoryURL string
+
+	// CertName is the name of the dns-01 certificate in CacheDir.
+	// Default is derived from all Domains, so that certificates of
+	// different domain sets do not overwrite each other.
+	CertName string
+
+	// Logger is optional.
+	Logger *zap.Logger
+}
+
+// Manager manages the certificate of Opts.Domains.
+type Manager struct {
+	opts Opts
+
+	autocert *autocert.Manager // for tls-alpn-01 and http-01
+	dns01    *dns01Manager     // for dns-01
+}
+
+func NewManager(opts Opts) (*Manager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("no domain")
+	}
+	if len(opts.CacheDir) == 0 {
+		return nil, errors.New("no cache dir")
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	for i, d := range opts.Domains {
+		opts.Domains[i] = strings.ToLower(strings.TrimSuffix(d, "."))
+	}
+
+	m := &Manager{opts: opts}
+	client := &acme.Client{DirectoryURL: opts.DirectoryURL}
+	switch opts.Challenge {
+	case "", ChallengeTLSALPN01, ChallengeHTTP01:
+		m.autocert = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.CacheDir),
+			HostPolicy: autocert.HostWhitelist(opts.Domains...),
+			Client:     client,
+			Email:      opts.Email,
+		}
+	case ChallengeDNS01:
+		m.dns01 = newDNS01Manager(client, opts)
+	default:
+		return nil, fmt.Errorf("unsupported challenge type %s", opts.Challenge)
+	}
+	return m, nil
+}
+
+// Challenge returns the challenge type of m.
+func (m *Manager) Challenge() string {
+	if len(m.opts.Challenge) == 0 {
+		return ChallengeTLSALPN01
+	}
+	return m.opts.Challenge
+}
+
+// GetCertificate returns the certificate. It can be used as
+// tls.Config.GetCertificate, so renewed certificates are used by new
+// connections without restart.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.dns01 != nil {
+		return m.dns01.getCertificate()
+	}
+	if len(hello.ServerName) == 0 {
+		// Clients that connect to the ip address do not send a sni.
+		hello.ServerName = m.opts.Domains[0]
+	}
+	return m.autocert.GetCertificate(hello)
+}
+
+// TLSConfig returns a copy of c that gets certificates from m. If the
+// challenge type is tls-alpn-01, challenge handshakes are handled
+// by m, others use c as it is.
+func (m *Manager) TLSConfig(c *tls.Config) *tls.Config {
+	if c == nil {
+		c = new(tls.Config)
+	} else {
+		c = c.Clone()
+	}
+	c.GetCertificate = m.GetCertificate
+	if m.Challenge() != ChallengeTLSALPN01 {
+		return c
+	}
+
+	challenge := &tls.Config{
+		NextProtos:     []string{acme.ALPNProto},
+		GetCertificate: m.GetCertificate,
+	}
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, p := range hello.SupportedProtos {
+			if p == acme.ALPNProto {
+				return challenge, nil
+			}
+		}
+		return nil, nil // use c
+	}
+	return c
+}
+
+// HTTPHandler returns a handler that answers http-01 challenges. Other
+// requests will be redirected to https.
+// It returns nil if the challenge type is not http-01.
+func (m *Manager) HTTPHandler() http.Handler {
+	if m.Challenge() != ChallengeHTTP01 {
+		return nil
+	}
+	return m.autocert.HTTPHandler(nil)
+}
+
+// ChallengeTXT returns the TXT records of the pending dns-01 challenges
+// of fqdn, e.g. "_acme-challenge.example.com.".
+func (m *Manager) ChallengeTXT(fqdn string) []string {
+	if m.dns01 == nil {
+		return nil
+	}
+	return m.dns01.records.get(fqdn)
+}
+
+// Run obtains the certificate and renews it before it expires until ctx
+// is done. It is only required by the dns-01 challenge. Certificates of
+// other challenges are obtained on demand by GetCertificate.
+func (m *Manager) Run(ctx context.Context) {
+	if m.dns01 != nil {
+		m.dns01.run(ctx)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acme_cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/acme"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestNewManager(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewManager(Opts{CacheDir: dir}); err == nil {
+		t.Fatal("no domain should fail")
+	}
+	if _, err := NewManager(Opts{Domains: []string{"example.com"}}); err == nil {
+		t.Fatal("no cache dir should fail")
+	}
+	if _, err := NewManager(Opts{Domains: []string{"example.com"}, CacheDir: dir, Challenge: "tls-sni-01"}); err == nil {
+		t.Fatal("unsupported challenge should fail")
+	}
+
+	m, err := NewManager(Opts{Domains: []string{"Example.com."}, CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Challenge() != ChallengeTLSALPN01 || m.HTTPHandler() != nil {
+		t.Fatal("unexpected default challenge")
+	}
+	if m.opts.Domains[0] != "example.com" {
+		t.Fatalf("domain is not normalized, %s", m.opts.Domains[0])
+	}
+
+	c := m.TLSConfig(&tls.Config{NextProtos: []string{"h2"}})
+	if c.GetCertificate == nil {
+		t.Fatal("missing GetCertificate")
+	}
+	cc, err := c.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || cc == nil || cc.NextProtos[0] != acme.ALPNProto {
+		t.Fatalf("unexpected config for challenge handshakes, %v", err)
+	}
+	cc, err = c.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2"}})
+	if err != nil || cc != nil {
+		t.Fatalf("normal handshakes should use the original config, %v", err)
+	}
+}
+
+func Test_txtRecords(t *testing.T) {
+	r := new(txtRecords)
+	r.add("_acme-challenge.example.com.", "a")
+	r.add("_acme-challenge.example.com.", "b")
+	if got := r.get("_ACME-challenge.example.com."); len(got) != 2 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	r.remove("_acme-challenge.example.com.", "a")
+	if got := r.get("_acme-challenge.example.com."); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("unexpected records %v", got)
+	}
+	r.remove("_acme-challenge.example.com.", "b")
+	if got := r.get("_acme-challenge.example.com."); got != nil {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func Test_dns01Manager_cache(t *testing.T) {
+	m, err := NewManager(Opts{Domains: []string{"example.com"}, CacheDir: t.TempDir(), Challenge: ChallengeDNS01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{}); err != errCertNotReady {
+		t.Fatalf("want errCertNotReady, got %v", err)
+	}
+	d := m.dns01
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour * 24 * 90).Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCertificate([][]byte{der}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := d.storeCert(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := d.loadCert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Leaf.NotAfter.Equal(notAfter) {
+		t.Fatalf("unexpected NotAfter %s", loaded.Leaf.NotAfter)
+	}
+
+	d.setCertificate(loaded)
+	if got, err := m.GetCertificate(&tls.ClientHelloInfo{}); err != nil || got != loaded {
+		t.Fatalf("unexpected certificate, %v", err)
+	}
+
+	if needsRenewal(loaded.Leaf, time.Now()) {
+		t.Fatal("fresh certificate should not be renewed")
+	}
+	if !needsRenewal(loaded.Leaf, notAfter.Add(-time.Hour*24)) {
+		t.Fatal("expiring certificate should be renewed")
+	}
+}
+
+func Test_dns01Manager_certName(t *testing.T) {
+	name := func(opts Opts) string {
+		return newDNS01Manager(nil, opts).certName()
+	}
+	a := name(Opts{Domains: []string{"example.com", "www.example.com"}})
+	if b := name(Opts{Domains: []string{"www.example.com", "example.com"}}); a != b {
+		t.Fatalf("name depends on the order of domains, %s %s", a, b)
+	}
+	if b := name(Opts{Domains: []string{"example.com"}}); a == b {
+		t.Fatalf("different domain sets have the same name %s", a)
+	}
+	if b := name(Opts{Domains: []string{"example.com"}, CertName: "my_cert"}); b != "my_cert" {
+		t.Fatalf("CertName is not used, got %s", b)
+	}
+}
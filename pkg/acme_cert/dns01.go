@@ -0,0 +1,359 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acme_cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// renewBefore is the time before expiry that the certificate
+	// will be renewed.
+	renewBefore = time.Hour * 24 * 30
+
+	checkInterval = time.Hour * 12
+	retryInterval = time.Minute * 10
+
+	accountKeyName = "acme_account+key"
+)
+
+var errCertNotReady = errors.New("acme certificate is not ready")
+
+// txtRecords stores the TXT records of pending dns-01 challenges.
+type txtRecords struct {
+	m sync.Mutex
+	r map[string][]string // fqdn -> values
+}
+
+func (r *txtRecords) add(fqdn, v string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.r == nil {
+		r.r = make(map[string][]string)
+	}
+	r.r[fqdn] = append(r.r[fqdn], v)
+}
+
+func (r *txtRecords) remove(fqdn, v string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s := r.r[fqdn]
+	for i := range s {
+		if s[i] == v {
+			s = append(s[:i], s[i+1:]...)
+			break
+		}
+	}
+	if len(s) == 0 {
+		delete(r.r, fqdn)
+	} else {
+		r.r[fqdn] = s
+	}
+}
+
+func (r *txtRecords) get(fqdn string) []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s := r.r[strings.ToLower(fqdn)]
+	if len(s) == 0 {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+type dns01Manager struct {
+	client *acme.Client
+	opts   Opts
+	cache  autocert.Cache
+
+	records txtRecords
+
+	m    sync.Mutex
+	cert *tls.Certificate
+}
+
+func newDNS01Manager(client *acme.Client, opts Opts) *dns01Manager {
+	return &dns01Manager{
+		client: client,
+		opts:   opts,
+		cache:  autocert.DirCache(opts.CacheDir),
+	}
+}
+
+func (d *dns01Manager) certName() string {
+	if len(d.opts.CertName) > 0 {
+		return d.opts.CertName
+	}
+	return defaultCertName(d.opts.Domains)
+}
+
+// defaultCertName returns the cache name of the certificate of domains.
+// It does not depend on the order of domains.
+func defaultCertName(domains []string) string {
+	sorted := append([]string(nil), domains...)
+	sort.Strings(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return sorted[0] + "+" + hex.EncodeToString(h[:8]) + "+dns01"
+}
+
+func (d *dns01Manager) getCertificate() (*tls.Certificate, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.cert == nil {
+		return nil, errCertNotReady
+	}
+	return d.cert, nil
+}
+
+func (d *dns01Manager) setCertificate(c *tls.Certificate) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.cert = c
+}
+
+func (d *dns01Manager) run(ctx context.Context) {
+	if c, err := d.loadCert(ctx); err == nil {
+		d.setCertificate(c)
+	} else if !errors.Is(err, autocert.ErrCacheMiss) {
+		d.opts.Logger.Warn("failed to load cached certificate", zap.Error(err))
+	}
+
+	for {
+		next := checkInterval
+		if c, _ := d.getCertificate(); c == nil || needsRenewal(c.Leaf, time.Now()) {
+			if err := d.obtain(ctx); err != nil {
+				d.opts.Logger.Error("failed to obtain certificate", zap.Strings("domains", d.opts.Domains), zap.Error(err))
+				next = retryInterval
+			}
+		}
+		select {
+		case <-time.After(next):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// needsRenewal reports whether leaf is about to expire.
+func needsRenewal(leaf *x509.Certificate, now time.Time) bool {
+	return leaf == nil || now.Add(renewBefore).After(leaf.NotAfter)
+}
+
+func (d *dns01Manager) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	if err := d.register(ctx); err != nil {
+		return fmt.Errorf("failed to register acme account, %w", err)
+	}
+
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(d.opts.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create order, %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := d.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if _, err := d.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("order failed, %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: d.opts.Domains}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order, %w", err)
+	}
+	c, err := newCertificate(der, key)
+	if err != nil {
+		return err
+	}
+	d.setCertificate(c)
+	d.opts.Logger.Info("certificate obtained", zap.Strings("domains", d.opts.Domains), zap.Time("not_after", c.Leaf.NotAfter))
+
+	if err := d.storeCert(ctx, c); err != nil {
+		d.opts.Logger.Warn("failed to store certificate", zap.Error(err))
+	}
+	return nil
+}
+
+// register registers the acme account. The account key is created and
+// stored in the cache if it does not exist.
+func (d *dns01Manager) register(ctx context.Context) error {
+	if d.client.Key != nil {
+		return nil
+	}
+	key, err := d.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	d.client.Key = key
+	var contact []string
+	if len(d.opts.Email) > 0 {
+		contact = []string{"mailto:" + d.opts.Email}
+	}
+	_, err = d.client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		d.client.Key = nil
+		return err
+	}
+	return nil
+}
+
+// accountKey loads the account key that shares the same format as
+// autocert.Manager, or generates a new one.
+func (d *dns01Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	b, err := d.cache.Get(ctx, accountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("invalid cached account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.cache.Put(ctx, accountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *dns01Manager) authorize(ctx context.Context, u string) error {
+	authz, err := d.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == ChallengeDNS01 {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	v, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// Wildcard identifiers are validated at the base domain.
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	d.records.add(fqdn, v)
+	defer d.records.remove(fqdn, v)
+
+	if _, err := d.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s, %w", authz.Identifier.Value, err)
+	}
+	if _, err := d.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization of %s failed, %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// loadCert loads the certificate from the cache.
+func (d *dns01Manager) loadCert(ctx context.Context) (*tls.Certificate, error) {
+	b, err := d.cache.Get(ctx, d.certName())
+	if err != nil {
+		return nil, err
+	}
+	c, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// storeCert stores c to the cache in a PEM file, with the private key
+// followed by the certificate chain.
+func (d *dns01Manager) storeCert(ctx context.Context, c *tls.Certificate) error {
+	key, ok := c.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	for _, der := range c.Certificate {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return d.cache.Put(ctx, d.certName(), buf.Bytes())
+}
+
+func newCertificate(der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
+	"time"
 )
 
 type Upstream interface {
@@ -55,10 +56,11 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 		logger = nopLogger
 	}
 
-	q := qCtx.Q()
+	q := qCtx.QReadOnly()
 	t := len(upstreams)
+	tr := qCtx.Trace()
 	if t == 1 {
-		return upstreams[0].Exchange(ctx, q)
+		return exchangeTraced(ctx, tr, upstreams[0], q)
 	}
 
 	c := make(chan *parallelResult, t) // use buf chan to avoid blocking.
@@ -66,7 +68,7 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	for _, u := range upstreams {
 		u := u
 		go func() {
-			r, err := u.Exchange(ctx, qCopy)
+			r, err := exchangeTraced(ctx, tr, u, qCopy)
 			c <- &parallelResult{
 				r:    r,
 				err:  err,
@@ -98,3 +100,22 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	}
 	return nil, ErrAllFailed
 }
+
+// exchangeTraced calls u.Exchange and records the exchange to tr as an
+// "upstream" event. tr can be nil.
+func exchangeTraced(ctx context.Context, tr *query_context.Trace, u Upstream, q *dns.Msg) (*dns.Msg, error) {
+	if tr == nil {
+		return u.Exchange(ctx, q)
+	}
+	ev := tr.Begin(ctx, u.Address(), "upstream", "upstream")
+	start := time.Now()
+	r, err := u.Exchange(ctx, q)
+	d := time.Since(start).Microseconds()
+	tr.Update(ev, func(ev *query_context.TraceEvent) {
+		ev.DurationUs = d
+		if err != nil {
+			ev.Err = err.Error()
+		}
+	})
+	return r, err
+}
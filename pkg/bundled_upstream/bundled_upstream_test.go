@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package bundled_upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type dummyUpstream struct {
+	latency time.Duration
+	rcode   int
+	err     error
+	queries int32
+}
+
+func (u *dummyUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	select {
+	case <-time.After(u.latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, u.rcode)
+	return r, nil
+}
+
+func (u *dummyUpstream) Trusted() bool {
+	return false
+}
+
+func (u *dummyUpstream) Address() string {
+	return "dummy"
+}
+
+func TestExchangeHedged(t *testing.T) {
+	er := errors.New("err")
+	tests := []struct {
+		name        string
+		us          []*dummyUpstream
+		wantQueries []int32
+		wantWin     bool
+		wantErr     bool
+	}{
+		{"first is fast", []*dummyUpstream{{latency: 0}, {latency: 0}}, []int32{1, 0}, false, false},
+		{"first is slow", []*dummyUpstream{{latency: 200 * time.Millisecond}, {latency: 0}}, []int32{1, 1}, true, false},
+		{"first failed", []*dummyUpstream{{err: er}, {latency: 0}, {latency: 0}}, []int32{1, 1, 0}, true, false},
+		{"first servfail", []*dummyUpstream{{rcode: dns.RcodeServerFailure}, {latency: 0}}, []int32{1, 1}, true, false},
+		{"all failed", []*dummyUpstream{{err: er}, {err: er}}, []int32{1, 1}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var us []Upstream
+			for _, u := range tt.us {
+				us = append(us, u)
+			}
+			hedges := prometheus.NewCounter(prometheus.CounterOpts{Name: "hedges"})
+			wins := prometheus.NewCounter(prometheus.CounterOpts{Name: "wins"})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, err := ExchangeHedged(context.Background(), query_context.NewContext(q, nil), us, HedgeOpts{
+				Delay:     50 * time.Millisecond,
+				Hedges:    hedges,
+				HedgeWins: wins,
+			}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExchangeHedged() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			var sent int32
+			for i, u := range tt.us {
+				if got := atomic.LoadInt32(&u.queries); got != tt.wantQueries[i] {
+					t.Fatalf("upstream #%d received %d queries, want %d", i, got, tt.wantQueries[i])
+				}
+				sent += tt.wantQueries[i]
+			}
+			if got := testutil.ToFloat64(hedges); got != float64(sent-1) {
+				t.Fatalf("hedges = %v, want %v", got, sent-1)
+			}
+			if got := testutil.ToFloat64(wins) == 1; got != tt.wantWin {
+				t.Fatalf("hedge win = %v, want %v", got, tt.wantWin)
+			}
+		})
+	}
+}
+
+func TestRetryUpstream(t *testing.T) {
+	u := &dummyUpstream{err: errors.New("err")}
+	retries := prometheus.NewCounter(prometheus.CounterOpts{Name: "retries"})
+	ru := &RetryUpstream{Upstream: u, Retries: 2, Backoff: 10 * time.Millisecond, RetryCounter: retries}
+
+	start := time.Now()
+	if _, err := ru.Exchange(context.Background(), new(dns.Msg)); err == nil {
+		t.Fatal("want err")
+	}
+	if u.queries != 3 || testutil.ToFloat64(retries) != 2 {
+		t.Fatalf("want 3 queries and 2 retries, got %d and %v", u.queries, testutil.ToFloat64(retries))
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatal("backoff is not applied")
+	}
+
+	u.err = nil
+	if _, err := ru.Exchange(context.Background(), new(dns.Msg)); err != nil || u.queries != 4 {
+		t.Fatalf("unexpected err %v or queries %d", err, u.queries)
+	}
+}
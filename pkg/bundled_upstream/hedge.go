@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package bundled_upstream
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"time"
+)
+
+// HedgeOpts configures ExchangeHedged.
+type HedgeOpts struct {
+	// Delay is the time to wait for a response before the query is also
+	// sent to the next upstream.
+	Delay time.Duration
+
+	// Hedges counts the queries that were sent to the upstreams except
+	// the first one. Optional.
+	Hedges prometheus.Counter
+	// HedgeWins counts the responses that were from the upstreams except
+	// the first one. Optional.
+	HedgeWins prometheus.Counter
+}
+
+// ExchangeHedged sends the query to upstreams one by one. The query is sent
+// to the next upstream if the upstreams that were queried have no
+// acceptable response after opts.Delay, or all of them failed. Unlike
+// ExchangeParallel, upstreams except the first one are queried only when
+// the first one is slow or broken. Pending queries are cancelled once a
+// response is accepted.
+func ExchangeHedged(ctx context.Context, qCtx *query_context.Context, upstreams []Upstream, opts HedgeOpts, logger *zap.Logger) (*dns.Msg, error) {
+	if logger == nil {
+		logger = nopLogger
+	}
+
+	q := qCtx.QReadOnly()
+	t := len(upstreams)
+	tr := qCtx.Trace()
+	if t == 1 {
+		return exchangeTraced(ctx, tr, upstreams[0], q)
+	}
+
+	hCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan *parallelResult, t) // use buf chan to avoid blocking.
+	qCopy := q.Copy()                  // qCtx is not safe for concurrent use.
+	sent := 0
+	send := func() {
+		u := upstreams[sent]
+		if sent > 0 && opts.Hedges != nil {
+			opts.Hedges.Inc()
+		}
+		sent++
+		go func() {
+			r, err := exchangeTraced(hCtx, tr, u, qCopy)
+			c <- &parallelResult{
+				r:    r,
+				err:  err,
+				from: u,
+			}
+		}()
+	}
+
+	timer := pool.GetTimer(opts.Delay)
+	defer pool.ReleaseTimer(timer)
+
+	send()
+	for received := 0; received < t; {
+		select {
+		case res := <-c:
+			received++
+			if res.err != nil {
+				logger.Warn("upstream err", qCtx.InfoField(), zap.String("addr", res.from.Address()), zap.Error(res.err))
+			} else if res.r != nil && (res.from.Trusted() || res.r.Rcode == dns.RcodeSuccess) {
+				if res.from != upstreams[0] && opts.HedgeWins != nil {
+					opts.HedgeWins.Inc()
+				}
+				return res.r, nil
+			}
+
+			// All queried upstreams failed, don't wait for the timer.
+			if received == sent && sent < t {
+				send()
+				pool.ResetAndDrainTimer(timer, opts.Delay)
+			}
+
+		case <-timer.C:
+			if sent < t {
+				send()
+				timer.Reset(opts.Delay)
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, ErrAllFailed
+}
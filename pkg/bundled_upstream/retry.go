@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package bundled_upstream
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// RetryUpstream retries the failed queries of an Upstream.
+type RetryUpstream struct {
+	Upstream
+
+	// Retries is the max number of retries of a query.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles on each
+	// retry. Zero means no delay.
+	Backoff time.Duration
+	// RetryCounter counts the retries. Optional.
+	RetryCounter prometheus.Counter
+}
+
+func (u *RetryUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	backoff := u.Backoff
+	for i := 0; ; i++ {
+		r, err := u.Upstream.Exchange(ctx, q)
+		if err == nil || i >= u.Retries || ctx.Err() != nil {
+			return r, err
+		}
+
+		if backoff > 0 {
+			timer := pool.GetTimer(backoff)
+			select {
+			case <-timer.C:
+				pool.ReleaseTimer(timer)
+			case <-ctx.Done():
+				pool.ReleaseTimer(timer)
+				return nil, err
+			}
+			backoff *= 2
+		}
+		if u.RetryCounter != nil {
+			u.RetryCounter.Inc()
+		}
+	}
+}
@@ -26,16 +26,17 @@ import (
 )
 
 const (
-	shardSize              = 64
-	defaultCleanerInterval = time.Minute
+	shardSize = 64
+
+	// CleanInterval is the suggested interval to call Clean.
+	CleanInterval = time.Minute
 )
 
 // MemCache is a simple LRU cache that stores values in memory.
 // It is safe for concurrent use.
 type MemCache struct {
-	closed           uint32
-	closeCleanerChan chan struct{}
-	lru              *concurrent_lru.ShardedLRU[*elem]
+	closed uint32
+	lru    *concurrent_lru.ShardedLRU[*elem]
 }
 
 type elem struct {
@@ -46,32 +47,26 @@ type elem struct {
 
 // NewMemCache initializes a MemCache.
 // The minimum size is 1024.
-// cleanerInterval specifies the interval that MemCache scans
-// and discards expired values. If cleanerInterval <= 0, a default
-// interval will be used.
-func NewMemCache(size int, cleanerInterval time.Duration) *MemCache {
+// Expired values are not discarded until Clean is called. Callers
+// should call Clean periodically, e.g. by a scheduler task.
+func NewMemCache(size int) *MemCache {
 	sizePerShard := size / shardSize
 	if sizePerShard < 16 {
 		sizePerShard = 16
 	}
 
-	c := &MemCache{
-		closeCleanerChan: make(chan struct{}),
-		lru:              concurrent_lru.NewShardedLRU[*elem](shardSize, sizePerShard, nil),
+	return &MemCache{
+		lru: concurrent_lru.NewShardedLRU[*elem](shardSize, sizePerShard, nil),
 	}
-	go c.startCleaner(cleanerInterval)
-	return c
 }
 
 func (c *MemCache) isClosed() bool {
 	return atomic.LoadUint32(&c.closed) != 0
 }
 
-// Close closes the cache and its cleaner.
+// Close closes the cache.
 func (c *MemCache) Close() error {
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
-		close(c.closeCleanerChan)
-	}
+	atomic.StoreUint32(&c.closed, 1)
 	return nil
 }
 
@@ -110,20 +105,9 @@ func (c *MemCache) Store(key string, v []byte, storedTime, expirationTime time.T
 	return
 }
 
-func (c *MemCache) startCleaner(interval time.Duration) {
-	if interval <= 0 {
-		interval = defaultCleanerInterval
-	}
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-c.closeCleanerChan:
-			return
-		case <-ticker.C:
-			c.lru.Clean(c.cleanFunc())
-		}
-	}
+// Clean discards expired values.
+func (c *MemCache) Clean() {
+	c.lru.Clean(c.cleanFunc())
 }
 
 func (c *MemCache) cleanFunc() func(_ string, v *elem) bool {
@@ -133,6 +117,11 @@ func (c *MemCache) cleanFunc() func(_ string, v *elem) bool {
 	}
 }
 
+// Flush removes all entries.
+func (c *MemCache) Flush() {
+	c.lru.Clean(func(_ string, _ *elem) bool { return true })
+}
+
 func (c *MemCache) Len() int {
 	return c.lru.Len()
 }
@@ -27,7 +27,7 @@ import (
 )
 
 func Test_memCache(t *testing.T) {
-	c := NewMemCache(1024, 0)
+	c := NewMemCache(1024)
 	for i := 0; i < 128; i++ {
 		key := strconv.Itoa(i)
 		c.Store(key, []byte{byte(i)}, time.Now(), time.Now().Add(time.Millisecond*200))
@@ -48,22 +48,35 @@ func Test_memCache(t *testing.T) {
 	}
 }
 
+func Test_memCache_Flush(t *testing.T) {
+	c := NewMemCache(1024)
+	defer c.Close()
+	for i := 0; i < 64; i++ {
+		c.Store(strconv.Itoa(i), []byte{}, time.Now(), time.Now().Add(time.Minute))
+	}
+	c.Flush()
+	if c.Len() != 0 {
+		t.Fatal("cache is not flushed")
+	}
+}
+
 func Test_memCache_cleaner(t *testing.T) {
-	c := NewMemCache(1024, time.Millisecond*10)
+	c := NewMemCache(1024)
 	defer c.Close()
 	for i := 0; i < 64; i++ {
 		key := strconv.Itoa(i)
 		c.Store(key, make([]byte, 0), time.Now(), time.Now().Add(time.Millisecond*10))
 	}
 
-	time.Sleep(time.Millisecond * 100)
+	time.Sleep(time.Millisecond * 20)
+	c.Clean()
 	if c.Len() != 0 {
 		t.Fatal()
 	}
 }
 
 func Test_memCache_race(t *testing.T) {
-	c := NewMemCache(1024, -1)
+	c := NewMemCache(1024)
 	defer c.Close()
 
 	wg := sync.WaitGroup{}
@@ -74,7 +87,7 @@ func Test_memCache_race(t *testing.T) {
 			for i := 0; i < 256; i++ {
 				c.Store(strconv.Itoa(i), []byte{}, time.Now(), time.Now().Add(time.Minute))
 				_, _, _ = c.Get(strconv.Itoa(i))
-				c.lru.Clean(c.cleanFunc())
+				c.Clean()
 			}
 		}()
 	}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cert_reloader keeps a tls certificate in sync with its files
+// on disk, so renewed certificates take effect without a restart.
+package cert_reloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const reloadDelay = time.Second
+
+// Reloader loads a certificate from Cert and Key files and reloads it
+// when the files change.
+type Reloader struct {
+	cert, key string
+	logger    *zap.Logger
+
+	m               sync.RWMutex
+	c               *tls.Certificate
+	certPEM, keyPEM []byte
+}
+
+// New loads the certificate. logger is optional.
+func New(cert, key string, logger *zap.Logger) (*Reloader, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &Reloader{cert: cert, key: key, logger: logger}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.c, nil
+}
+
+// Reload reloads the certificate from disk. It reports whether the files
+// were changed. If the files are invalid, the old certificate is kept.
+func (r *Reloader) Reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.cert)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(r.key)
+	if err != nil {
+		return false, err
+	}
+
+	r.m.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.m.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("failed to load key pair, %w", err)
+	}
+	r.m.Lock()
+	r.c, r.certPEM, r.keyPEM = &c, certPEM, keyPEM
+	r.m.Unlock()
+	return true, nil
+}
+
+// Run watches the certificate files until ctx is done.
+// The directories of the files are watched instead of the files, because
+// certificate tools usually replace files by renaming (or, in kubernetes,
+// by swapping symlinks), which removes watches on the files.
+func (r *Reloader) Run(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, dir := range []string{filepath.Dir(r.cert), filepath.Dir(r.key)} {
+		if err := w.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s, %w", dir, err)
+		}
+	}
+
+	delayReloadTimer := time.NewTimer(reloadDelay)
+	delayReloadTimer.Stop()
+	defer delayReloadTimer.Stop()
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			r.logger.Debug("fs event", zap.Stringer("event", e.Op), zap.String("file", e.Name))
+			if !delayReloadTimer.Stop() {
+				select {
+				case <-delayReloadTimer.C:
+				default:
+				}
+			}
+			delayReloadTimer.Reset(reloadDelay)
+
+		case <-delayReloadTimer.C:
+			changed, err := r.Reload()
+			if err != nil {
+				r.logger.Error("failed to reload certificate, old certificate is still in use", zap.String("cert", r.cert), zap.Error(err))
+			} else if changed {
+				r.logger.Info("certificate reloaded", zap.String("cert", r.cert))
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			r.logger.Error("fs notify error", zap.Error(err))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
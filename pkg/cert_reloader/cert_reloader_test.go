@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cert_reloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new certificate to dir and returns its DER.
+func writeCert(t *testing.T, dir string) []byte {
+	t.Helper()
+	c, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the files by renaming, like most certificate tools do.
+	for name, b := range map[string][]byte{
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}),
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	} {
+		tmp := filepath.Join(dir, name+".tmp")
+		if err := os.WriteFile(tmp, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c.Certificate[0]
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	der := writeCert(t, dir)
+	r, err := New(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentDER := func() []byte {
+		c, _ := r.GetCertificate(nil)
+		return c.Certificate[0]
+	}
+	if !bytes.Equal(currentDER(), der) {
+		t.Fatal("unexpected certificate")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	time.Sleep(time.Millisecond * 100) // wait for the watcher
+
+	// Invalid files should not replace the certificate.
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("invalid key should be rejected")
+	}
+	if !bytes.Equal(currentDER(), der) {
+		t.Fatal("certificate should not be replaced by invalid files")
+	}
+
+	der = writeCert(t, dir)
+	deadline := time.Now().Add(time.Second * 5)
+	for !bytes.Equal(currentDER(), der) {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
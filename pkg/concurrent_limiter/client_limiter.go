@@ -24,7 +24,6 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/concurrent_map"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"net/netip"
-	"sync"
 	"time"
 )
 
@@ -45,9 +44,6 @@ type HPLimiterOpts struct {
 	// IP masks to aggregate a IP range.
 	IPv4Mask int // Default is 32.
 	IPv6Mask int // Default is 48.
-
-	// Default is 10s. Negative value disables the cleaner.
-	CleanerInterval time.Duration
 }
 
 func (opts *HPLimiterOpts) Init() error {
@@ -55,7 +51,6 @@ func (opts *HPLimiterOpts) Init() error {
 		panic("client_limiter: negative rate")
 	}
 	utils.SetDefaultNum(&opts.Interval, time.Second)
-	utils.SetDefaultNum(&opts.CleanerInterval, time.Second*10)
 
 	if m := opts.IPv4Mask; m < 0 || m > 32 {
 		return fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
@@ -72,12 +67,11 @@ func (opts *HPLimiterOpts) Init() error {
 var _ ClientLimiter = (*HPClientLimiter)(nil)
 
 // HPClientLimiter is a ClientLimiter for heavy workload.
-// It uses sharded locks.
+// It uses sharded locks. Callers should call GC periodically to
+// remove idle clients, e.g. by a scheduler task.
 type HPClientLimiter struct {
-	opts        HPLimiterOpts
-	closeOnce   sync.Once
-	closeNotify chan struct{}
-	m           *concurrent_map.Map[netAddrHash, *counter]
+	opts HPLimiterOpts
+	m    *concurrent_map.Map[netAddrHash, *counter]
 }
 
 type netAddrHash netip.Addr
@@ -95,31 +89,12 @@ func NewHPClientLimiter(opts HPLimiterOpts) (*HPClientLimiter, error) {
 		return nil, err
 	}
 	l := &HPClientLimiter{
-		opts:        opts,
-		closeNotify: make(chan struct{}),
-		m:           concurrent_map.NewMap[netAddrHash, *counter](),
-	}
-
-	if opts.CleanerInterval > 0 {
-		go l.cleanerLoop()
+		opts: opts,
+		m:    concurrent_map.NewMap[netAddrHash, *counter](),
 	}
-
 	return l, nil
 }
 
-func (l *HPClientLimiter) cleanerLoop() {
-	ticker := time.NewTicker(l.opts.CleanerInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case now := <-ticker.C:
-			l.GC(now)
-		case <-l.closeNotify:
-			return
-		}
-	}
-}
-
 func (l *HPClientLimiter) AcquireToken(addr netip.Addr) bool {
 	addr = l.ApplyMask(addr).Addr()
 	now := time.Now()
@@ -169,15 +144,6 @@ func (l *HPClientLimiter) GC(now time.Time) {
 	l.m.RangeDo(f)
 }
 
-// Close closes HPClientLimiter's cleaner (if it was started).
-// Close always returns a nil error.
-func (l *HPClientLimiter) Close() error {
-	l.closeOnce.Do(func() {
-		close(l.closeNotify)
-	})
-	return nil
-}
-
 type counter struct {
 	c         int
 	startTime time.Time
@@ -20,15 +20,26 @@
 package data_provider
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
 	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	// reloadDelay is the debounce delay between the last fs event and
+	// the actual reload. Editors usually emit several events for one save.
+	reloadDelay = time.Second
+)
+
 type DataManager struct {
 	pm sync.RWMutex
 	ps map[string]*DataProvider
@@ -56,42 +67,190 @@ func (m *DataManager) GetDataProvider(name string) *DataProvider {
 	return m.ps[name]
 }
 
+// Names returns the sorted names of all data providers.
+func (m *DataManager) Names() []string {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	names := make([]string, 0, len(m.ps))
+	for name := range m.ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type DataProviderConfig struct {
 	Tag        string `yaml:"tag"`
 	File       string `yaml:"file"`
 	AutoReload bool   `yaml:"auto_reload"`
+
+	// URL, if set, the data will be downloaded from it. File is required
+	// and is used as the local cache.
+	URL             string `yaml:"url"`
+	RefreshInterval int    `yaml:"refresh_interval"` // (sec) Default is 86400 (1 day).
+
+	// XFR, if set, the data is a zone transferred over AXFR/IXFR. File
+	// is required and is used as the local cache. Transfers follow the
+	// refresh/retry timers of the zone SOA.
+	XFR *XFRConfig `yaml:"xfr"`
 }
 
 type DataProvider struct {
 	logger     *zap.Logger
+	sched      *scheduler.Scheduler
+	tag        string
 	file       string
 	autoReload bool
 
+	url             string
+	refreshInterval time.Duration
+	pendingData     []byte      // fetched data that no listener has accepted yet, guarded by reloadMu
+	pendingMeta     *remoteMeta // validators of the fetched data that no listener has accepted yet, guarded by reloadMu
+	xfr             *xfrClient
+
+	reloadMu  sync.Mutex // serializes reloads
 	lm        sync.Mutex
 	listeners map[DataListener]struct{}
 
-	sc *safe_close.SafeClose
+	reloadTotal      prometheus.Counter
+	reloadErrTotal   prometheus.Counter
+	lastReloadTime   prometheus.Gauge
+	lastReloadStatus prometheus.Gauge
+	fetchTotal       prometheus.Counter
+	fetchErrTotal    prometheus.Counter
+
+	tasks []*scheduler.Task
+	sc    *safe_close.SafeClose
 }
 
-func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, error) {
+// NewDataProvider creates a DataProvider. Periodic refreshes of
+// remote data are run by s.
+func NewDataProvider(lg *zap.Logger, s *scheduler.Scheduler, cfg DataProviderConfig) (*DataProvider, error) {
 	dp := new(DataProvider)
 	dp.logger = lg
+	dp.sched = s
+	dp.tag = cfg.Tag
 	dp.file = cfg.File
 	dp.autoReload = cfg.AutoReload
+	dp.url = cfg.URL
+	dp.refreshInterval = time.Duration(cfg.RefreshInterval) * time.Second
+	if dp.refreshInterval <= 0 {
+		dp.refreshInterval = defaultRefreshInterval
+	}
+	if len(dp.url) > 0 && len(dp.file) == 0 {
+		return nil, errors.New("file is required as the local cache of url")
+	}
+	if cfg.XFR != nil {
+		if len(dp.url) > 0 {
+			return nil, errors.New("url and xfr cannot be used together")
+		}
+		if len(dp.file) == 0 {
+			return nil, errors.New("file is required as the local cache of xfr")
+		}
+		c, err := newXFRClient(cfg.XFR)
+		if err != nil {
+			return nil, err
+		}
+		dp.xfr = c
+	}
+
+	constLabels := prometheus.Labels{"tag": cfg.Tag}
+	dp.reloadTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "data_provider_reload_total",
+		Help:        "The total number of reloads",
+		ConstLabels: constLabels,
+	})
+	dp.reloadErrTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "data_provider_reload_err_total",
+		Help:        "The total number of failed reloads",
+		ConstLabels: constLabels,
+	})
+	dp.lastReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "data_provider_last_reload_timestamp_seconds",
+		Help:        "The unix timestamp of the last successful reload",
+		ConstLabels: constLabels,
+	})
+	dp.lastReloadStatus = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "data_provider_last_reload_success",
+		Help:        "Whether the last reload succeeded (1) or failed (0)",
+		ConstLabels: constLabels,
+	})
+
+	dp.fetchTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "data_provider_fetch_total",
+		Help:        "The total number of remote fetches",
+		ConstLabels: constLabels,
+	})
+	dp.fetchErrTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "data_provider_fetch_err_total",
+		Help:        "The total number of failed remote fetches",
+		ConstLabels: constLabels,
+	})
 
 	dp.sc = safe_close.NewSafeClose()
 
 	if err := dp.init(); err != nil {
+		dp.Close()
 		return nil, err
 	}
 	return dp, nil
 }
 
 func (ds *DataProvider) init() error {
+	if len(ds.url) > 0 {
+		b, meta, err := ds.fetch(context.Background())
+		if err == nil && b != nil {
+			// There is no listener to validate the data yet. It is saved
+			// after the first listener accepts it, see loadListener.
+			// Without a local copy, there is nothing to protect, and the
+			// data is saved now. But its validators are still pending.
+			if _, statErr := os.Stat(ds.file); statErr == nil {
+				ds.pendingData = b
+			} else {
+				err = ds.saveRemoteCache(b, nil)
+			}
+			ds.pendingMeta = meta
+		}
+		if err != nil {
+			if _, statErr := os.Stat(ds.file); statErr != nil {
+				return fmt.Errorf("failed to fetch %s and there is no local cache, %w", ds.url, err)
+			}
+			ds.logger.Warn(
+				"failed to fetch remote data, using local cache",
+				zap.String("url", ds.url),
+				zap.String("file", ds.file),
+				zap.Error(err),
+			)
+		}
+		if err := ds.startRefresher(); err != nil {
+			return err
+		}
+	}
+	if ds.xfr != nil {
+		ds.xfr.loadCache(ds.file)
+		_, err := ds.fetchXFR(context.Background())
+		if err != nil {
+			if ds.xfr.soa() == nil {
+				return fmt.Errorf("failed to transfer zone %s and there is no local cache, %w", ds.xfr.zone, err)
+			}
+			ds.logger.Warn(
+				"failed to transfer zone, using local cache",
+				zap.String("zone", ds.xfr.zone),
+				zap.String("server", ds.xfr.server),
+				zap.Error(err),
+			)
+		}
+		if err := ds.startXFRRefresher(err); err != nil {
+			return err
+		}
+	}
+
 	_, err := ds.loadFromDisk()
 	if err != nil {
 		return err
 	}
+	ds.lastReloadTime.SetToCurrentTime()
+	ds.lastReloadStatus.Set(1)
 
 	if ds.autoReload {
 		if err := ds.startFsWatcher(); err != nil {
@@ -101,7 +260,18 @@ func (ds *DataProvider) init() error {
 	return nil
 }
 
+// Collectors returns the reload metrics of this DataProvider.
+func (ds *DataProvider) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		ds.reloadTotal, ds.reloadErrTotal, ds.lastReloadTime, ds.lastReloadStatus,
+		ds.fetchTotal, ds.fetchErrTotal,
+	}
+}
+
 func (ds *DataProvider) Close() {
+	for _, t := range ds.tasks {
+		t.Cancel()
+	}
 	ds.sc.Done()
 	ds.sc.CloseWait()
 }
@@ -109,12 +279,10 @@ func (ds *DataProvider) Close() {
 // LoadAndAddListener loads the DataListener, returns any error that occurs, and
 // add this DataListener to this DataProvider.
 func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
-	b, err := ds.GetData()
-	if err != nil {
-		return err
-	}
+	ds.reloadMu.Lock()
+	defer ds.reloadMu.Unlock()
 
-	if err := l.Update(b); err != nil {
+	if err := ds.loadListener(l); err != nil {
 		return err
 	}
 
@@ -127,6 +295,49 @@ func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
 	return nil
 }
 
+// loadListener loads the data to l. The fetched data that no listener
+// has accepted yet is tried first and is saved if l accepts it.
+// Otherwise, l falls back to the local copy.
+// Caller must hold reloadMu.
+func (ds *DataProvider) loadListener(l DataListener) error {
+	if b := ds.pendingData; b != nil {
+		meta := ds.pendingMeta
+		ds.pendingData, ds.pendingMeta = nil, nil
+		err := l.Update(b)
+		if err == nil {
+			if err := ds.saveRemoteCache(b, meta); err != nil {
+				ds.logger.Warn("failed to save remote data", zap.Error(err))
+			}
+			return nil
+		}
+		ds.logger.Warn(
+			"remote data is rejected, using local cache",
+			zap.String("url", ds.url),
+			zap.String("file", ds.file),
+			zap.Error(err),
+		)
+		// Same as updateRemote, the next fetch downloads the full data.
+		if rmErr := os.Remove(ds.metaFile()); rmErr != nil && !os.IsNotExist(rmErr) {
+			ds.logger.Warn("failed to remove local cache meta", zap.Error(rmErr))
+		}
+	}
+
+	b, err := ds.GetData()
+	if err != nil {
+		return err
+	}
+	if err := l.Update(b); err != nil {
+		return err
+	}
+	if ds.pendingMeta != nil {
+		if err := ds.saveRemoteMeta(ds.pendingMeta); err != nil {
+			ds.logger.Warn("failed to save local cache meta", zap.Error(err))
+		}
+		ds.pendingMeta = nil
+	}
+	return nil
+}
+
 func (ds *DataProvider) DeleteListener(l DataListener) {
 	ds.lm.Lock()
 	defer ds.lm.Unlock()
@@ -137,8 +348,37 @@ func (ds *DataProvider) GetData() ([]byte, error) {
 	return os.ReadFile(ds.file)
 }
 
+// Reload reads the file from disk and pushes it to all listeners.
+// Listeners are expected to build their new data first and swap it
+// in only on success. So if the new file is broken, listeners keep
+// serving their old data.
+func (ds *DataProvider) Reload() error {
+	ds.reloadMu.Lock()
+	defer ds.reloadMu.Unlock()
+
+	ds.reloadTotal.Inc()
+	err := ds.reload()
+	if err != nil {
+		ds.reloadErrTotal.Inc()
+		ds.lastReloadStatus.Set(0)
+		return err
+	}
+	ds.lastReloadTime.SetToCurrentTime()
+	ds.lastReloadStatus.Set(1)
+	return nil
+}
+
+func (ds *DataProvider) reload() error {
+	v, err := ds.loadFromDisk()
+	if err != nil {
+		return err
+	}
+	return ds.pushData(v)
+}
+
 // pushData notify the notifier and trigger all listeners.
-func (ds *DataProvider) pushData(newData []byte) {
+// It returns the first error from the listeners, if any.
+func (ds *DataProvider) pushData(newData []byte) error {
 	ds.lm.Lock()
 	ls := make([]DataListener, 0, len(ds.listeners))
 	for listener := range ds.listeners {
@@ -146,14 +386,20 @@ func (ds *DataProvider) pushData(newData []byte) {
 	}
 	ds.lm.Unlock()
 
+	var firstErr error
+	failed := 0
 	for _, l := range ls {
 		if err := l.Update(newData); err != nil {
-			ds.logger.Error(
-				"failed to update data listener",
-				zap.Error(err),
-			)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to update %d of %d data listeners, %w", failed, len(ls), firstErr)
+	}
+	return nil
 }
 
 func (ds *DataProvider) loadFromDisk() ([]byte, error) {
@@ -166,58 +412,73 @@ func (ds *DataProvider) startFsWatcher() error {
 		return err
 	}
 	if err := w.Add(ds.file); err != nil {
+		w.Close()
 		return err
 	}
 
 	go func() {
 		defer w.Close()
 
-		var delayReloadTimer *time.Timer
+		delayReloadTimer := time.NewTimer(reloadDelay)
+		delayReloadTimer.Stop()
+		defer delayReloadTimer.Stop()
+
+		// Some editors save files by writing a tmp file and renaming it
+		// to the original path. The watch is lost in that case and the
+		// file has to be watched again.
+		needRewatch := false
 		for {
 			select {
 			case e, ok := <-w.Events:
 				if !ok {
 					return
 				}
-				ds.logger.Info(
+				ds.logger.Debug(
 					"fs event",
 					zap.Stringer("event", e.Op),
 					zap.String("file", e.Name),
 				)
-
-				if delayReloadTimer != nil {
-					delayReloadTimer.Stop()
+				if hasOp(e, fsnotify.Remove) || hasOp(e, fsnotify.Rename) {
+					needRewatch = true
 				}
-				delayReloadTimer = time.AfterFunc(time.Second, func() {
-					if hasOp(e, fsnotify.Remove) {
-						_ = w.Remove(ds.file)
-						if err := w.Add(ds.file); err != nil {
-							ds.logger.Error(
-								"failed to re-watch file, auto reload may not work anymore",
-								zap.String("file", ds.file),
-								zap.Error(err),
-							)
-						}
+				if !delayReloadTimer.Stop() {
+					select {
+					case <-delayReloadTimer.C:
+					default:
 					}
+				}
+				delayReloadTimer.Reset(reloadDelay)
 
-					ds.logger.Info(
-						"reloading file",
-						zap.String("file", ds.file),
-					)
-					if v, err := ds.loadFromDisk(); err != nil {
+			case <-delayReloadTimer.C:
+				if needRewatch {
+					_ = w.Remove(ds.file)
+					if err := w.Add(ds.file); err != nil {
 						ds.logger.Error(
-							"failed to reload file",
+							"failed to re-watch file, auto reload may not work anymore",
 							zap.String("file", ds.file),
 							zap.Error(err),
 						)
 					} else {
-						ds.logger.Info(
-							"file reloaded",
-							zap.String("file", ds.file),
-						)
-						ds.pushData(v)
+						needRewatch = false
 					}
-				})
+				}
+
+				ds.logger.Info(
+					"reloading file",
+					zap.String("file", ds.file),
+				)
+				if err := ds.Reload(); err != nil {
+					ds.logger.Error(
+						"failed to reload file, old data is still in use",
+						zap.String("file", ds.file),
+						zap.Error(err),
+					)
+				} else {
+					ds.logger.Info(
+						"file reloaded",
+						zap.String("file", ds.file),
+					)
+				}
 
 			case err, ok := <-w.Errors:
 				if !ok {
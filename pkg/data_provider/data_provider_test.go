@@ -0,0 +1,321 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testListener struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (l *testListener) Update(b []byte) error {
+	if string(b) == "bad" {
+		return errors.New("bad data")
+	}
+	l.mu.Lock()
+	l.data = b
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *testListener) get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return string(l.data)
+}
+
+func TestDataProvider_Reload(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(f, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), DataProviderConfig{Tag: "t", File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.get(); got != "v1" {
+		t.Fatalf("want v1, got %s", got)
+	}
+
+	if err := os.WriteFile(f, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.get(); got != "v2" {
+		t.Fatalf("want v2, got %s", got)
+	}
+
+	// Broken data must not replace the old data.
+	if err := os.WriteFile(f, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Reload(); err == nil {
+		t.Fatal("want an error")
+	}
+	if got := l.get(); got != "v2" {
+		t.Fatalf("want v2, got %s", got)
+	}
+
+	if v := testutil.ToFloat64(dp.reloadTotal); v != 2 {
+		t.Fatalf("want 2 reloads, got %v", v)
+	}
+	if v := testutil.ToFloat64(dp.reloadErrTotal); v != 1 {
+		t.Fatalf("want 1 failed reload, got %v", v)
+	}
+	if v := testutil.ToFloat64(dp.lastReloadStatus); v != 0 {
+		t.Fatalf("want last reload status 0, got %v", v)
+	}
+}
+
+func TestDataProvider_AutoReload(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "data")
+	if err := os.WriteFile(f, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), DataProviderConfig{Tag: "t", File: f, AutoReload: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file by renaming, like most editors do.
+	tmp := filepath.Join(dir, "data.tmp")
+	if err := os.WriteFile(tmp, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, f); err != nil {
+		t.Fatal(err)
+	}
+	waitData(t, l, "v2")
+
+	// The file should still be watched after the rename.
+	if err := os.WriteFile(f, []byte("v3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitData(t, l, "v3")
+}
+
+func waitData(t *testing.T, l *testListener, want string) {
+	t.Helper()
+	deadline := time.Now().Add(reloadDelay * 5)
+	for time.Now().Before(deadline) {
+		if l.get() == want {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("timeout waiting for data %s, got %s", want, l.get())
+}
+
+func TestDataProvider_Remote(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		data     = "v1"
+		fail     bool
+		requests int
+		notMod   int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		etag := `"` + data + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+
+	f := filepath.Join(t.TempDir(), "data")
+	cfg := DataProviderConfig{Tag: "t", File: f, URL: srv.URL}
+	dp, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.get(); got != "v1" {
+		t.Fatalf("want v1, got %s", got)
+	}
+
+	// Not modified.
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if notMod != 1 {
+		t.Fatalf("want 1 not modified response, got %d", notMod)
+	}
+
+	mu.Lock()
+	data = "v2"
+	mu.Unlock()
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.get(); got != "v2" {
+		t.Fatalf("want v2, got %s", got)
+	}
+
+	// Data that listeners reject is not saved, and its validators are
+	// dropped.
+	mu.Lock()
+	data = "bad"
+	mu.Unlock()
+	if err := dp.refresh(context.Background()); err == nil {
+		t.Fatal("refresh should fail")
+	}
+	if b, _ := os.ReadFile(f); string(b) != "v2" {
+		t.Fatalf("want cached v2, got %s", b)
+	}
+	if m := dp.loadMeta(); m != nil {
+		t.Fatalf("validators of rejected data are saved, %+v", m)
+	}
+	mu.Lock()
+	data = "v2"
+	mu.Unlock()
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m := dp.loadMeta(); m == nil || m.ETag != `"v2"` {
+		t.Fatalf("unexpected validators %+v", m)
+	}
+
+	// Failed fetches keep the old data.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if err := dp.refresh(context.Background()); err == nil {
+		t.Fatal("refresh should fail")
+	}
+	if got := l.get(); got != "v2" {
+		t.Fatalf("want v2, got %s", got)
+	}
+	if v := testutil.ToFloat64(dp.fetchErrTotal); v != 1 {
+		t.Fatalf("want 1 failed fetch, got %v", v)
+	}
+
+	// A new provider falls back to the local cache.
+	dp2, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp2.Close()
+	b, err := dp2.GetData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "v2" {
+		t.Fatalf("want cached v2, got %s", b)
+	}
+}
+
+func TestDataProvider_RemoteStartup(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		wantData string
+		wantETag string
+	}{
+		{name: "accepted", remote: "v2", wantData: "v2", wantETag: `"v2"`},
+		{name: "rejected", remote: "bad", wantData: "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"`+tt.remote+`"`)
+				io.WriteString(w, tt.remote)
+			}))
+			defer srv.Close()
+
+			f := filepath.Join(t.TempDir(), "data")
+			if err := os.WriteFile(f, []byte("v1"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := DataProviderConfig{Tag: "t", File: f, URL: srv.URL}
+			dp, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dp.Close()
+
+			// The fetched data is not saved before a listener accepts it.
+			if b, _ := os.ReadFile(f); string(b) != "v1" {
+				t.Fatalf("local cache is overwritten by %s", b)
+			}
+			l := new(testListener)
+			if err := dp.LoadAndAddListener(l); err != nil {
+				t.Fatal(err)
+			}
+			if got := l.get(); got != tt.wantData {
+				t.Fatalf("want %s, got %s", tt.wantData, got)
+			}
+			if b, _ := os.ReadFile(f); string(b) != tt.wantData {
+				t.Fatalf("want cached %s, got %s", tt.wantData, b)
+			}
+			var etag string
+			if m := dp.loadMeta(); m != nil {
+				etag = m.ETag
+			}
+			if etag != tt.wantETag {
+				t.Fatalf("want etag %q, got %q", tt.wantETag, etag)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultRefreshInterval = time.Hour * 24
+	fetchTimeout           = time.Minute
+	maxRemoteDataSize      = 64 << 20 // 64M
+)
+
+// remoteMeta is the cache validators of the local copy. It is stored
+// next to the local copy as "file.meta".
+type remoteMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (ds *DataProvider) metaFile() string {
+	return ds.file + ".meta"
+}
+
+// loadMeta returns the validators of the local copy. It returns nil
+// if the local copy does not exist or it was downloaded from another url.
+func (ds *DataProvider) loadMeta() *remoteMeta {
+	if _, err := os.Stat(ds.file); err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(ds.metaFile())
+	if err != nil {
+		return nil
+	}
+	m := new(remoteMeta)
+	if err := json.Unmarshal(b, m); err != nil || m.URL != ds.url {
+		return nil
+	}
+	return m
+}
+
+// fetch downloads the data from ds.url. The local copy is revalidated
+// with ETag/Last-Modified. It returns nil data if the local copy is not
+// modified. The data is not saved, see saveRemoteCache.
+func (ds *DataProvider) fetch(ctx context.Context) ([]byte, *remoteMeta, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	ds.fetchTotal.Inc()
+	b, meta, err := ds.fetchCtx(ctx)
+	if err != nil {
+		ds.fetchErrTotal.Inc()
+	}
+	return b, meta, err
+}
+
+func (ds *DataProvider) fetchCtx(ctx context.Context) ([]byte, *remoteMeta, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ds.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m := ds.loadMeta(); m != nil {
+		if len(m.ETag) > 0 {
+			req.Header.Set("If-None-Match", m.ETag)
+		}
+		if len(m.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", m.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteDataSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) > maxRemoteDataSize {
+		return nil, nil, fmt.Errorf("remote data is larger than %d bytes", maxRemoteDataSize)
+	}
+	if resp.ContentLength >= 0 && int64(len(b)) != resp.ContentLength {
+		return nil, nil, fmt.Errorf("remote data is truncated, got %d of %d bytes", len(b), resp.ContentLength)
+	}
+	meta := &remoteMeta{
+		URL:          ds.url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return b, meta, nil
+}
+
+// saveRemoteCache saves b as the local copy. If meta is not nil, it is
+// saved as the validators of the local copy. Otherwise, the old
+// validators are dropped, so the next fetch downloads the full data.
+func (ds *DataProvider) saveRemoteCache(b []byte, meta *remoteMeta) error {
+	// Drops the old validators first, so they never validate new data.
+	if err := os.Remove(ds.metaFile()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove local cache meta, %w", err)
+	}
+	if err := writeFileAtomic(ds.file, b); err != nil {
+		return fmt.Errorf("failed to write local cache, %w", err)
+	}
+	if meta != nil {
+		return ds.saveRemoteMeta(meta)
+	}
+	return nil
+}
+
+func (ds *DataProvider) saveRemoteMeta(meta *remoteMeta) error {
+	b, _ := json.Marshal(meta)
+	if err := writeFileAtomic(ds.metaFile(), b); err != nil {
+		return fmt.Errorf("failed to write local cache meta, %w", err)
+	}
+	return nil
+}
+
+func (ds *DataProvider) startRefresher() error {
+	t, err := ds.sched.Add(scheduler.TaskOpts{
+		Name:     fmt.Sprintf("data_provider/%s/fetch", ds.tag),
+		Func:     ds.refresh,
+		Schedule: scheduler.Every(ds.refreshInterval),
+	})
+	if err != nil {
+		return err
+	}
+	ds.tasks = append(ds.tasks, t)
+	return nil
+}
+
+func (ds *DataProvider) refresh(ctx context.Context) error {
+	b, meta, err := ds.fetch(ctx)
+	if err != nil {
+		ds.logger.Warn(
+			"failed to fetch remote data, old data is still in use",
+			zap.String("url", ds.url),
+			zap.Error(err),
+		)
+		return err
+	}
+	if b == nil {
+		ds.logger.Debug("remote data not modified", zap.String("url", ds.url))
+		return nil
+	}
+
+	ds.logger.Info("remote data updated, reloading", zap.String("url", ds.url))
+	if err := ds.updateRemote(b, meta); err != nil {
+		ds.logger.Error(
+			"failed to reload remote data, old data is still in use",
+			zap.String("url", ds.url),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// updateRemote validates the fetched data by pushing it to the listeners.
+// The data is saved only if all listeners accept it. Otherwise, the
+// validators of the local copy are dropped, so the rejected data will
+// not be revalidated by them.
+func (ds *DataProvider) updateRemote(b []byte, meta *remoteMeta) error {
+	ds.reloadMu.Lock()
+	defer ds.reloadMu.Unlock()
+
+	ds.reloadTotal.Inc()
+	if err := ds.pushData(b); err != nil {
+		ds.reloadErrTotal.Inc()
+		ds.lastReloadStatus.Set(0)
+		if rmErr := os.Remove(ds.metaFile()); rmErr != nil && !os.IsNotExist(rmErr) {
+			ds.logger.Warn("failed to remove local cache meta", zap.Error(rmErr))
+		}
+		return err
+	}
+	ds.lastReloadTime.SetToCurrentTime()
+	ds.lastReloadStatus.Set(1)
+	return ds.saveRemoteCache(b, meta)
+}
+
+// writeFileAtomic writes b to a temp file and renames it to file. So
+// readers never see a partially written file.
+func writeFileAtomic(file string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
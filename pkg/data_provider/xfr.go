@@ -0,0 +1,362 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	xfrMinRefresh = time.Second * 30
+	xfrTimeout    = time.Second * 30
+)
+
+// XFRConfig configures a zone transfer source.
+type XFRConfig struct {
+	Server        string `yaml:"server"` // Port defaults to 53.
+	Zone          string `yaml:"zone"`
+	IXFR          bool   `yaml:"ixfr"` // Use incremental transfer if possible.
+	TSIGName      string `yaml:"tsig_name"`
+	TSIGSecret    string `yaml:"tsig_secret"`    // base64 encoded
+	TSIGAlgorithm string `yaml:"tsig_algorithm"` // Default is hmac-sha256.
+}
+
+// xfrClient transfers a zone over AXFR/IXFR and keeps a copy of it in
+// memory for incremental transfers. It is not concurrent safe.
+type xfrClient struct {
+	server  string
+	zone    string
+	ixfr    bool
+	tsigKey string
+	tsigAlg string
+	secret  map[string]string
+
+	records []dns.RR // records[0] is the SOA
+}
+
+func newXFRClient(cfg *XFRConfig) (*xfrClient, error) {
+	if len(cfg.Server) == 0 || len(cfg.Zone) == 0 {
+		return nil, errors.New("xfr server and zone are required")
+	}
+	c := &xfrClient{
+		server: cfg.Server,
+		zone:   dns.CanonicalName(cfg.Zone),
+		ixfr:   cfg.IXFR,
+	}
+	if _, _, err := net.SplitHostPort(c.server); err != nil {
+		c.server = net.JoinHostPort(c.server, "53")
+	}
+	if len(cfg.TSIGName) > 0 {
+		c.tsigKey = dns.CanonicalName(cfg.TSIGName)
+		c.tsigAlg = dns.HmacSHA256
+		if len(cfg.TSIGAlgorithm) > 0 {
+			c.tsigAlg = dns.CanonicalName(cfg.TSIGAlgorithm)
+		}
+		c.secret = map[string]string{c.tsigKey: cfg.TSIGSecret}
+	}
+	return c, nil
+}
+
+func (c *xfrClient) soa() *dns.SOA {
+	if len(c.records) == 0 {
+		return nil
+	}
+	return c.records[0].(*dns.SOA)
+}
+
+// loadCache restores the zone from its local copy, so the next transfer
+// can be incremental. Broken or foreign copies are ignored.
+func (c *xfrClient) loadCache(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	parser := dns.NewZoneParser(f, c.zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if parser.Err() != nil || len(rrs) == 0 {
+		return
+	}
+	if soa, ok := rrs[0].(*dns.SOA); !ok || !strings.EqualFold(soa.Hdr.Name, c.zone) {
+		return
+	}
+	c.records = rrs
+}
+
+// sign appends a TSIG to m if a key is configured. It must be called
+// after the id of m is set.
+func (c *xfrClient) sign(m *dns.Msg) {
+	if len(c.tsigKey) > 0 {
+		m.SetTsig(c.tsigKey, c.tsigAlg, 300, time.Now().Unix())
+	}
+}
+
+// querySerial queries the SOA serial of the zone from the server.
+func (c *xfrClient) querySerial(ctx context.Context) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(c.zone, dns.TypeSOA)
+	c.sign(m)
+	client := &dns.Client{Net: "tcp", Timeout: xfrTimeout, TsigSecret: c.secret}
+	r, _, err := client.ExchangeContext(ctx, m, c.server)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("server returned %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, errors.New("no soa in the response")
+}
+
+// transfer checks the SOA serial and transfers the zone if the server
+// has a newer one. It reports whether the zone was updated. The transfer
+// is aborted if ctx is done.
+func (c *xfrClient) transfer(ctx context.Context) (bool, error) {
+	if old := c.soa(); old != nil {
+		soa, err := c.querySerial(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to query soa, %w", err)
+		}
+		if !serialNewer(soa.Serial, old.Serial) {
+			return false, nil
+		}
+	}
+
+	m := new(dns.Msg)
+	ixfr := c.ixfr && c.soa() != nil
+	if ixfr {
+		old := c.soa()
+		m.SetIxfr(c.zone, old.Serial, old.Ns, old.Mbox)
+	} else {
+		m.SetAxfr(c.zone)
+	}
+	c.sign(m)
+
+	d := &net.Dialer{Timeout: xfrTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.server)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // interrupts the transfer
+		case <-stop:
+		}
+	}()
+
+	t := &dns.Transfer{
+		Conn:         &dns.Conn{Conn: conn},
+		ReadTimeout:  xfrTimeout,
+		WriteTimeout: xfrTimeout,
+		TsigSecret:   c.secret,
+	}
+	ch, err := t.In(m, c.server)
+	if err != nil {
+		return false, err
+	}
+	var rrs []dns.RR
+	for e := range ch {
+		if e.Error != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	if len(rrs) == 0 {
+		return false, errors.New("empty transfer")
+	}
+	newSOA, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return false, errors.New("transfer does not start with a soa")
+	}
+	if ixfr && len(rrs) == 1 {
+		return false, nil // up to date
+	}
+	last, ok := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok || last.Serial != newSOA.Serial {
+		return false, errors.New("transfer does not end with the soa")
+	}
+
+	if ixfr && len(rrs) > 2 && rrs[1].Header().Rrtype == dns.TypeSOA {
+		records, err := applyIXFR(c.records, rrs)
+		if err != nil {
+			return false, err
+		}
+		c.records = records
+		return true, nil
+	}
+	c.records = rrs[:len(rrs)-1] // full zone
+	return true, nil
+}
+
+// applyIXFR applies the incremental transfer rrs to records. rrs is
+// formatted as: new SOA, [old SOA, deletions, new SOA, additions]..., new SOA.
+func applyIXFR(records, rrs []dns.RR) ([]dns.RR, error) {
+	out := make([]dns.RR, 0, len(records))
+	out = append(out, records[1:]...)
+
+	deleting := false
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			deleting = !deleting
+			continue
+		}
+		if deleting {
+			for i := range out {
+				if dns.IsDuplicate(out[i], rr) {
+					out = append(out[:i], out[i+1:]...)
+					break
+				}
+			}
+		} else {
+			out = append(out, rr)
+		}
+	}
+	if deleting {
+		return nil, errors.New("incomplete incremental transfer")
+	}
+	return append([]dns.RR{rrs[0]}, out...), nil
+}
+
+// serialNewer reports whether serial a is newer than b, see RFC 1982.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// zoneText formats the zone as a zone file.
+func (c *xfrClient) zoneText() []byte {
+	b := new(bytes.Buffer)
+	for _, rr := range c.records {
+		b.WriteString(rr.String())
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// refreshTiming returns the refresh and retry interval from the SOA.
+func (c *xfrClient) refreshTiming() (refresh, retry time.Duration) {
+	refresh, retry = defaultRefreshInterval, xfrMinRefresh
+	if soa := c.soa(); soa != nil {
+		refresh = time.Duration(soa.Refresh) * time.Second
+		retry = time.Duration(soa.Retry) * time.Second
+	}
+	if refresh < xfrMinRefresh {
+		refresh = xfrMinRefresh
+	}
+	if retry < xfrMinRefresh {
+		retry = xfrMinRefresh
+	}
+	return refresh, retry
+}
+
+// fetchXFR transfers the zone to ds.file. It reports whether the local
+// copy was updated.
+func (ds *DataProvider) fetchXFR(ctx context.Context) (bool, error) {
+	ds.fetchTotal.Inc()
+	updated, err := ds.xfr.transfer(ctx)
+	if err != nil {
+		ds.fetchErrTotal.Inc()
+		return false, err
+	}
+	if updated {
+		if err := writeFileAtomic(ds.file, ds.xfr.zoneText()); err != nil {
+			return false, fmt.Errorf("failed to write local cache, %w", err)
+		}
+	}
+	return updated, nil
+}
+
+// startXFRRefresher schedules transfers following the refresh and
+// retry timers of the zone SOA. lastErr is the result of the first transfer.
+func (ds *DataProvider) startXFRRefresher(lastErr error) error {
+	schedule := func(err error) time.Duration {
+		refresh, retry := ds.xfr.refreshTiming()
+		if err != nil {
+			return retry
+		}
+		return refresh
+	}
+	t, err := ds.sched.Add(scheduler.TaskOpts{
+		Name:     fmt.Sprintf("data_provider/%s/xfr", ds.tag),
+		Func:     ds.refreshXFR,
+		Schedule: schedule,
+		Delay:    schedule(lastErr),
+	})
+	if err != nil {
+		return err
+	}
+	ds.tasks = append(ds.tasks, t)
+	return nil
+}
+
+func (ds *DataProvider) refreshXFR(ctx context.Context) error {
+	updated, err := ds.fetchXFR(ctx)
+	if err != nil {
+		ds.logger.Warn(
+			"failed to transfer zone, old data is still in use",
+			zap.String("zone", ds.xfr.zone),
+			zap.String("server", ds.xfr.server),
+			zap.Error(err),
+		)
+		return err
+	}
+	if !updated {
+		return nil
+	}
+	ds.logger.Info(
+		"zone updated, reloading",
+		zap.String("zone", ds.xfr.zone),
+		zap.Uint32("serial", ds.xfr.soa().Serial),
+	)
+	if err := ds.Reload(); err != nil {
+		ds.logger.Error(
+			"failed to reload zone, old data is still in use",
+			zap.String("zone", ds.xfr.zone),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTSIGName   = "key."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+type testXFRServer struct {
+	mu        sync.Mutex
+	serial    uint32
+	zone      map[uint32][]dns.RR // serial -> records, without soa
+	ixfrTotal int
+}
+
+func (s *testXFRServer) soa(serial uint32) dns.RR {
+	rr, _ := dns.NewRR("example. 300 IN SOA ns.example. admin.example. 0 3600 600 86400 300")
+	rr.(*dns.SOA).Serial = serial
+	return rr
+}
+
+func (s *testXFRServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.TsigStatus() != nil {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNotAuth)
+		w.WriteMsg(r)
+		return
+	}
+
+	var rrs []dns.RR
+	switch q.Question[0].Qtype {
+	case dns.TypeSOA:
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{s.soa(s.serial)}
+		r.SetTsig(testTSIGName, dns.HmacSHA256, 300, time.Now().Unix())
+		w.WriteMsg(r)
+		return
+	case dns.TypeAXFR:
+		rrs = append(rrs, s.soa(s.serial))
+		rrs = append(rrs, s.zone[s.serial]...)
+		rrs = append(rrs, s.soa(s.serial))
+	case dns.TypeIXFR:
+		s.ixfrTotal++
+		from := q.Ns[0].(*dns.SOA).Serial
+		rrs = append(rrs, s.soa(s.serial))
+		if from != s.serial {
+			rrs = append(rrs, s.soa(from))
+			rrs = append(rrs, diff(s.zone[from], s.zone[s.serial])...)
+			rrs = append(rrs, s.soa(s.serial))
+			rrs = append(rrs, diff(s.zone[s.serial], s.zone[from])...)
+			rrs = append(rrs, s.soa(s.serial))
+		}
+	}
+
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+	tr := new(dns.Transfer)
+	tr.Out(w, q, ch)
+	w.Hijack()
+}
+
+// diff returns records in a but not in b.
+func diff(a, b []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range a {
+		found := false
+		for _, rr2 := range b {
+			if dns.IsDuplicate(rr, rr2) {
+				found = true
+			}
+		}
+		if !found {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func TestDataProvider_XFR(t *testing.T) {
+	s := &testXFRServer{
+		serial: 1,
+		zone: map[uint32][]dns.RR{
+			1: {mustRR("a.example. 300 IN A 192.0.2.1")},
+			2: {mustRR("b.example. 300 IN A 192.0.2.2")},
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener:   l,
+		Handler:    s,
+		TsigSecret: map[string]string{testTSIGName: testTSIGSecret},
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	f := filepath.Join(t.TempDir(), "zone")
+	cfg := DataProviderConfig{
+		Tag:  "t",
+		File: f,
+		XFR: &XFRConfig{
+			Server:     l.Addr().String(),
+			Zone:       "example",
+			IXFR:       true,
+			TSIGName:   testTSIGName,
+			TSIGSecret: testTSIGSecret,
+		},
+	}
+
+	badCfg := cfg
+	badXFR := *cfg.XFR
+	badXFR.TSIGSecret = "d3JvbmdzZWNyZXQ="
+	badCfg.XFR = &badXFR
+	if _, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), badCfg); err == nil {
+		t.Fatal("transfer with a bad tsig secret should fail")
+	}
+
+	dp, err := NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	tl := new(testListener)
+	if err := dp.LoadAndAddListener(tl); err != nil {
+		t.Fatal(err)
+	}
+	if got := tl.get(); !strings.Contains(got, "192.0.2.1") {
+		t.Fatalf("unexpected zone data %s", got)
+	}
+
+	// Not updated.
+	if updated, err := dp.fetchXFR(context.Background()); err != nil || updated {
+		t.Fatalf("want not updated, got %v, %v", updated, err)
+	}
+
+	s.mu.Lock()
+	s.serial = 2
+	s.mu.Unlock()
+	if updated, err := dp.fetchXFR(context.Background()); err != nil || !updated {
+		t.Fatalf("want updated, got %v, %v", updated, err)
+	}
+	if err := dp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	got := tl.get()
+	if strings.Contains(got, "192.0.2.1") || !strings.Contains(got, "192.0.2.2") {
+		t.Fatalf("unexpected zone data after ixfr %s", got)
+	}
+	if s.ixfrTotal != 1 {
+		t.Fatalf("want 1 ixfr, got %d", s.ixfrTotal)
+	}
+
+	// A new provider restores the zone from the local cache.
+	dp.Close()
+	dp, err = NewDataProvider(zap.NewNop(), scheduler.NewScheduler(nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soa := dp.xfr.soa(); soa == nil || soa.Serial != 2 {
+		t.Fatalf("zone is not restored from local cache, %v", soa)
+	}
+	if s.ixfrTotal != 1 {
+		t.Fatal("up to date zone should not be transferred again")
+	}
+}
+
+func Test_applyIXFR(t *testing.T) {
+	soa := func(serial uint32) dns.RR {
+		return (&testXFRServer{}).soa(serial)
+	}
+	records := []dns.RR{soa(1), mustRR("a.example. 300 IN A 192.0.2.1"), mustRR("b.example. 300 IN A 192.0.2.2")}
+	rrs := []dns.RR{
+		soa(3),
+		soa(1), mustRR("a.example. 300 IN A 192.0.2.1"), soa(2), mustRR("c.example. 300 IN A 192.0.2.3"),
+		soa(2), mustRR("b.example. 300 IN A 192.0.2.2"), soa(3),
+		soa(3),
+	}
+	out, err := applyIXFR(records, rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].(*dns.SOA).Serial != 3 || out[1].(*dns.A).A.String() != "192.0.2.3" {
+		t.Fatalf("unexpected result %v", out)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dns_cookie implements DNS cookies (RFC 7873). Server cookies are
+// interoperable server cookies of RFC 9018, so servers that share a secret
+// accept cookies of each other.
+package dns_cookie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	ClientCookieLen = 8
+	ServerCookieLen = 16 // Length of the server cookies of RFC 9018.
+	SecretLen       = 16
+
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+
+	version = 1
+
+	// A cookie older than maxAge or more than maxSkew in the future is
+	// invalid. A new cookie is generated if the cookie is older than
+	// refreshAge.
+	maxAge     = time.Hour
+	maxSkew    = time.Minute * 5
+	refreshAge = time.Minute * 30
+)
+
+var errInvalidCookie = errors.New("invalid cookie option")
+
+// Parse parses the client cookie and the server cookie of o.
+// server is nil if o only has a client cookie.
+func Parse(o *dns.EDNS0_COOKIE) (client, server []byte, err error) {
+	b, err := hex.DecodeString(o.Cookie)
+	if err != nil {
+		return nil, nil, errInvalidCookie
+	}
+	if len(b) == ClientCookieLen {
+		return b, nil, nil
+	}
+	if len(b) < ClientCookieLen+minServerCookieLen || len(b) > ClientCookieLen+maxServerCookieLen {
+		return nil, nil, errInvalidCookie
+	}
+	return b[:ClientCookieLen], b[ClientCookieLen:], nil
+}
+
+// NewOption returns a COOKIE option. server can be nil.
+func NewOption(client, server []byte) *dns.EDNS0_COOKIE {
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(client) + hex.EncodeToString(server),
+	}
+}
+
+// Server generates and verifies server cookies.
+type Server struct {
+	k0, k1 uint64
+}
+
+// NewServer returns a Server. secret must be SecretLen bytes.
+func NewServer(secret []byte) (*Server, error) {
+	if len(secret) != SecretLen {
+		return nil, fmt.Errorf("secret must be %d bytes, but got %d", SecretLen, len(secret))
+	}
+	return &Server{
+		k0: binary.LittleEndian.Uint64(secret[:8]),
+		k1: binary.LittleEndian.Uint64(secret[8:]),
+	}, nil
+}
+
+// NewRandomServer returns a Server with a random secret.
+func NewRandomServer() *Server {
+	secret := make([]byte, SecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	s, _ := NewServer(secret)
+	return s
+}
+
+// Generate returns a server cookie for the client cookie from ip.
+func (s *Server) Generate(client []byte, ip netip.Addr, now time.Time) []byte {
+	b := make([]byte, ServerCookieLen)
+	b[0] = version
+	binary.BigEndian.PutUint32(b[4:8], uint32(now.Unix()))
+	binary.LittleEndian.PutUint64(b[8:], s.hash(client, b[:8], ip))
+	return b
+}
+
+// Verify reports whether server is a valid server cookie for the client
+// cookie from ip. fresh reports whether the cookie is new enough to be
+// sent back as is.
+func (s *Server) Verify(client, server []byte, ip netip.Addr, now time.Time) (valid, fresh bool) {
+	if len(server) != ServerCookieLen || server[0] != version {
+		return false, false
+	}
+	// Timestamps use serial number arithmetic, RFC 1982.
+	age := time.Duration(int32(uint32(now.Unix())-binary.BigEndian.Uint32(server[4:8]))) * time.Second
+	if age > maxAge || age < -maxSkew {
+		return false, false
+	}
+	if binary.LittleEndian.Uint64(server[8:]) != s.hash(client, server[:8], ip) {
+		return false, false
+	}
+	return true, age < refreshAge
+}
+
+func (s *Server) hash(client, header []byte, ip netip.Addr) uint64 {
+	p := make([]byte, 0, ClientCookieLen+8+16)
+	p = append(p, client...)
+	p = append(p, header...)
+	p = append(p, ip.Unmap().AsSlice()...)
+	return siphash24(s.k0, s.k1, p)
+}
+
+// Client holds the client cookie of an upstream and the last server cookie
+// from it. It is safe for concurrent use.
+type Client struct {
+	client []byte
+
+	mu     sync.Mutex
+	server []byte
+}
+
+// NewClient returns a Client with a random client cookie.
+func NewClient() *Client {
+	c := make([]byte, ClientCookieLen)
+	if _, err := rand.Read(c); err != nil {
+		panic(err)
+	}
+	return &Client{client: c}
+}
+
+// Option returns the COOKIE option for the next query.
+func (c *Client) Option() *dns.EDNS0_COOKIE {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return NewOption(c.client, c.server)
+}
+
+// Update checks the COOKIE option o of a response and remembers its server
+// cookie. It returns an error if o does not have the client cookie, which
+// means the response may be spoofed.
+func (c *Client) Update(o *dns.EDNS0_COOKIE) error {
+	client, server, err := Parse(o)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(client, c.client) {
+		return errors.New("client cookie mismatched")
+	}
+	if server != nil {
+		c.mu.Lock()
+		c.server = server
+		c.mu.Unlock()
+	}
+	return nil
+}
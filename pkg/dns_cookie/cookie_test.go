@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_cookie
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Test vector from RFC 9018 Appendix A.1.
+func TestServer_Generate(t *testing.T) {
+	tests := []struct {
+		client, ip, secret string
+		ts                 int64
+		want               string
+	}{
+		{"2464c4abcf10c957", "198.51.100.100", "e5e973e5a6b2a43f48e7dc849e37bfcf", 1559731985, "010000005cf79f111f8130c3eee29480"},
+	}
+	for _, tt := range tests {
+		secret, _ := hex.DecodeString(tt.secret)
+		s, err := NewServer(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, _ := hex.DecodeString(tt.client)
+		ip := netip.MustParseAddr(tt.ip)
+		now := time.Unix(tt.ts, 0)
+		got := s.Generate(client, ip, now)
+		if hex.EncodeToString(got) != tt.want {
+			t.Fatalf("want %s, got %x", tt.want, got)
+		}
+		if valid, fresh := s.Verify(client, got, ip, now.Add(time.Minute)); !valid || !fresh {
+			t.Fatal("cookie should be valid and fresh")
+		}
+		if valid, fresh := s.Verify(client, got, ip, now.Add(time.Minute*40)); !valid || fresh {
+			t.Fatal("cookie should be valid and stale")
+		}
+		if valid, _ := s.Verify(client, got, ip, now.Add(time.Hour*2)); valid {
+			t.Fatal("expired cookie should be invalid")
+		}
+		if valid, _ := s.Verify(client, got, netip.MustParseAddr("192.0.2.1"), now); valid {
+			t.Fatal("cookie of another ip should be invalid")
+		}
+	}
+}
+
+func TestClient_Update(t *testing.T) {
+	c := NewClient()
+	if _, server, _ := Parse(c.Option()); server != nil {
+		t.Fatal("first option should not have a server cookie")
+	}
+	s := NewRandomServer()
+	client, _, _ := Parse(c.Option())
+	server := s.Generate(client, netip.MustParseAddr("127.0.0.1"), time.Now())
+	if err := c.Update(NewOption(client, server)); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, _ := Parse(c.Option()); hex.EncodeToString(got) != hex.EncodeToString(server) {
+		t.Fatal("server cookie should be remembered")
+	}
+	if err := c.Update(NewOption(make([]byte, 8), server)); err == nil {
+		t.Fatal("mismatched client cookie should fail")
+	}
+	if _, _, err := Parse(NewOption(client, make([]byte, 4))); err == nil {
+		t.Fatal("short server cookie should fail")
+	}
+}
@@ -58,3 +58,20 @@ func PadToMinimum(m *dns.Msg, minLen int) (upgraded, newPadding bool) {
 	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLen)})
 	return true, true
 }
+
+// PadToBlock pads m to a multiple of blockLen as the Block-Length Padding
+// strategy of RFC 8467. An existing Padding option of m is replaced.
+// upgraded indicates the m was upgraded to an EDNS0 msg.
+func PadToBlock(m *dns.Msg, blockLen int) (upgraded bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(m)
+		upgraded = true
+	} else {
+		RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+	}
+	l := m.Len() + 4 // a Padding option has a 4 bytes header.
+	paddingLen := (blockLen - l%blockLen) % blockLen
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLen)})
+	return upgraded
+}
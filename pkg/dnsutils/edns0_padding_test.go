@@ -67,3 +67,36 @@ func TestPadToMinimum(t *testing.T) {
 		})
 	}
 }
+
+func TestPadToBlock(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeA)
+
+	qPadded := q.Copy()
+	UpgradeEDNS0(qPadded)
+	PadToMinimum(qPadded, 200)
+
+	qLarge := new(dns.Msg)
+	qLarge.SetQuestion(strings.Repeat("a.", 100), dns.TypeA)
+
+	tests := []struct {
+		name         string
+		q            *dns.Msg
+		wantLen      int
+		wantUpgraded bool
+	}{
+		{"no edns0", q.Copy(), 128, true},
+		{"shrink padding", qPadded.Copy(), 128, false},
+		{"large", qLarge.Copy(), 256, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PadToBlock(tt.q, 128); got != tt.wantUpgraded {
+				t.Errorf("PadToBlock() upgraded = %v, want %v", got, tt.wantUpgraded)
+			}
+			if l := tt.q.Len(); l != tt.wantLen {
+				t.Errorf("PadToBlock() len = %d, want %d", l, tt.wantLen)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -130,6 +131,21 @@ func QtypeToString(u uint16) string {
 	return uint16Conv(u, dns.TypeToString)
 }
 
+// QuestionMatched reports whether r has the same question as q.
+// The names are compared case-insensitively.
+func QuestionMatched(q, r *dns.Msg) bool {
+	if len(q.Question) != len(r.Question) {
+		return false
+	}
+	for i := range q.Question {
+		qq, rq := q.Question[i], r.Question[i]
+		if qq.Qtype != rq.Qtype || qq.Qclass != rq.Qclass || !strings.EqualFold(qq.Name, rq.Name) {
+			return false
+		}
+	}
+	return true
+}
+
 func GenEmptyReply(q *dns.Msg, rcode int) *dns.Msg {
 	r := new(dns.Msg)
 	r.SetRcode(q, rcode)
@@ -175,6 +191,84 @@ func GetMsgKey(m *dns.Msg, salt uint16) (string, error) {
 	return utils.BytesToStringUnsafe(wireMsg), nil
 }
 
+// GetQueryKey returns a cache key of the query m without packing it.
+// The key is derived from the canonical qname, qtype, qclass, opcode,
+// header flags, the DO bit and the ECS option. Keys of queries that only
+// differ in id, qname case and padding are the same.
+// ok is false if m is not a plain query, e.g. it has more than one
+// question, records other than an OPT, or EDNS0 options other than ECS
+// and padding. The caller should fall back to GetMsgKey in this case.
+// The key never equals a key from GetMsgKey with a zero salt.
+func GetQueryKey(m *dns.Msg) (key string, ok bool) {
+	if len(m.Question) != 1 || len(m.Answer) != 0 || len(m.Ns) != 0 || len(m.Extra) > 1 {
+		return "", false
+	}
+
+	var flags byte
+	if m.RecursionDesired {
+		flags |= 1 << 0
+	}
+	if m.CheckingDisabled {
+		flags |= 1 << 1
+	}
+	if m.AuthenticatedData {
+		flags |= 1 << 2
+	}
+
+	var ecs *dns.EDNS0_SUBNET
+	if len(m.Extra) == 1 {
+		opt, isOpt := m.Extra[0].(*dns.OPT)
+		if !isOpt || opt.Version() != 0 || opt.ExtendedRcode() != 0 {
+			return "", false
+		}
+		flags |= 1 << 3
+		if opt.Do() {
+			flags |= 1 << 4
+		}
+		for _, o := range opt.Option {
+			switch o := o.(type) {
+			case *dns.EDNS0_SUBNET:
+				if ecs != nil {
+					return "", false
+				}
+				ecs = o
+			case *dns.EDNS0_PADDING:
+			default:
+				return "", false
+			}
+		}
+	}
+
+	q := m.Question[0]
+	b := make([]byte, 0, 32+len(q.Name))
+	// A packed msg starts with its id, which is always zero in keys from
+	// GetMsgKey with a zero salt.
+	b = append(b, 0xff, byte(m.Opcode), flags, byte(q.Qtype>>8), byte(q.Qtype), byte(q.Qclass>>8), byte(q.Qclass))
+	if ecs != nil {
+		var bits int
+		var addr net.IP
+		switch ecs.Family {
+		case 1:
+			bits, addr = 32, ecs.Address.To4()
+		case 2:
+			bits, addr = 128, ecs.Address.To16()
+		}
+		if addr == nil || int(ecs.SourceNetmask) > bits {
+			return "", false
+		}
+		b = append(b, byte(ecs.Family), ecs.SourceNetmask)
+		b = append(b, addr.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))...)
+	}
+	for i := 0; i < len(q.Name); i++ {
+		c := q.Name[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b = append(b, c)
+	}
+	return utils.BytesToStringUnsafe(b), true
+}
+
 // GetMsgKeyWithBytesSalt unpacks m and appends salt to the string.
 func GetMsgKeyWithBytesSalt(m *dns.Msg, salt []byte) (string, error) {
 	wireMsg, buf, err := pool.PackBuffer(m)
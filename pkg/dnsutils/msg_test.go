@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestGetQueryKey(t *testing.T) {
+	newQ := func(name string, f func(q *dns.Msg)) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if f != nil {
+			f(q)
+		}
+		return q
+	}
+	withECS := func(ip string, mask uint8) func(q *dns.Msg) {
+		return func(q *dns.Msg) {
+			q.SetEdns0(1232, false)
+			AddECS(q.IsEdns0(), NewEDNS0Subnet(net.ParseIP(ip), mask, false), true)
+		}
+	}
+
+	key := func(q *dns.Msg) string {
+		k, ok := GetQueryKey(q)
+		if !ok {
+			t.Fatalf("no fast key for %s", q)
+		}
+		return k
+	}
+
+	base := key(newQ("example.com.", nil))
+	if k := key(newQ("ExAmple.COM.", func(q *dns.Msg) { q.Id = 1 })); k != base {
+		t.Fatal("id and qname case should not change the key")
+	}
+	for name, f := range map[string]func(q *dns.Msg){
+		"edns0": func(q *dns.Msg) { q.SetEdns0(1232, false) },
+		"do":    func(q *dns.Msg) { q.SetEdns0(1232, true) },
+		"cd":    func(q *dns.Msg) { q.CheckingDisabled = true },
+		"ecs":   withECS("1.2.3.4", 24),
+	} {
+		if key(newQ("example.com.", f)) == base {
+			t.Fatalf("%s should change the key", name)
+		}
+	}
+	if key(newQ("example.com.", withECS("1.2.3.4", 24))) != key(newQ("example.com.", withECS("1.2.3.5", 24))) {
+		t.Fatal("ecs addresses in the same subnet should have the same key")
+	}
+	if key(newQ("example.com.", withECS("1.2.3.4", 24))) == key(newQ("example.com.", withECS("1.2.4.4", 24))) {
+		t.Fatal("ecs addresses in different subnets should have different keys")
+	}
+
+	cookie := newQ("example.com.", func(q *dns.Msg) {
+		q.SetEdns0(1232, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	})
+	if _, ok := GetQueryKey(cookie); ok {
+		t.Fatal("query with unusual options should fall back")
+	}
+	k, err := GetMsgKey(newQ("example.com.", nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k == base {
+		t.Fatal("fast key collides with packed key")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// ParseSVCBKey parses a SvcParamKey from its name (e.g. "ech", "ipv6hint")
+// or its generic "keyNNNNN" format.
+func ParseSVCBKey(s string) (dns.SVCBKey, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for k := dns.SVCB_MANDATORY; k <= dns.SVCB_DOHPATH; k++ {
+		if k.String() == s {
+			return k, nil
+		}
+	}
+	if strings.HasPrefix(s, "key") {
+		k, err := strconv.ParseUint(s[3:], 10, 16)
+		if err == nil && k != 65535 {
+			return dns.SVCBKey(k), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid svcb param key %s", s)
+}
+
+// SVCBOf returns the SVCB data of rr if rr is a SVCB or HTTPS record.
+// Otherwise, it returns nil.
+func SVCBOf(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	default:
+		return nil
+	}
+}
+
+// HasSVCBParams reports whether rr is a SVCB or HTTPS record that has a
+// param whose key is in keys.
+func HasSVCBParams(rr dns.RR, keys map[dns.SVCBKey]struct{}) bool {
+	svcb := SVCBOf(rr)
+	if svcb == nil {
+		return false
+	}
+	for _, v := range svcb.Value {
+		if _, ok := keys[v.Key()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// StripSVCBParams removes the params whose keys are in keys from rr if
+// rr is a SVCB or HTTPS record.
+func StripSVCBParams(rr dns.RR, keys map[dns.SVCBKey]struct{}) {
+	svcb := SVCBOf(rr)
+	if svcb == nil {
+		return
+	}
+	values := svcb.Value[:0]
+	for _, v := range svcb.Value {
+		if _, ok := keys[v.Key()]; !ok {
+			values = append(values, v)
+		}
+	}
+	svcb.Value = values
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestParseSVCBKey(t *testing.T) {
+	for s, want := range map[string]dns.SVCBKey{"ech": dns.SVCB_ECHCONFIG, "IPv6Hint": dns.SVCB_IPV6HINT, "key65000": 65000} {
+		got, err := ParseSVCBKey(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSVCBKey(%s) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"x", "key", "key65535"} {
+		if _, err := ParseSVCBKey(s); err == nil {
+			t.Errorf("ParseSVCBKey(%s) should fail", s)
+		}
+	}
+}
+
+func TestStripSVCBParams(t *testing.T) {
+	rr, err := dns.NewRR("a.com. 60 IN HTTPS 1 . alpn=h2 ipv6hint=::1 ech=AEX+DQBB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[dns.SVCBKey]struct{}{dns.SVCB_ECHCONFIG: {}, dns.SVCB_IPV6HINT: {}}
+	if !HasSVCBParams(rr, keys) {
+		t.Fatal("rr should have the params")
+	}
+	StripSVCBParams(rr, keys)
+	if HasSVCBParams(rr, keys) {
+		t.Fatal("params should be stripped")
+	}
+	if want := "a.com.\t60\tIN\tHTTPS\t1 . alpn=\"h2\""; rr.String() != want {
+		t.Fatalf("want %s, got %s", want, rr)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// TTLRuleConfig limits the ttl of the records whose types are in Types.
+// Zero MaximumTTL or MinimalTTL means no limit.
+type TTLRuleConfig struct {
+	Types      []string `yaml:"types"`
+	MaximumTTL uint32   `yaml:"maximum_ttl"`
+	MinimalTTL uint32   `yaml:"minimal_ttl"`
+}
+
+type ttlLimit struct {
+	max, min uint32
+}
+
+func (l ttlLimit) apply(ttl uint32) uint32 {
+	if l.max > 0 && ttl > l.max {
+		ttl = l.max
+	}
+	if l.min > 0 && ttl < l.min {
+		ttl = l.min
+	}
+	return ttl
+}
+
+// TTLPolicy applies record type aware ttl limits to msgs.
+type TTLPolicy struct {
+	rules map[uint16]ttlLimit
+	def   ttlLimit
+}
+
+// NewTTLPolicy creates a TTLPolicy. If a type appears in multiple rules,
+// the first one wins. Records that have no rule are limited by
+// maximumTTL and minimalTTL.
+func NewTTLPolicy(rules []TTLRuleConfig, maximumTTL, minimalTTL uint32) (*TTLPolicy, error) {
+	p := &TTLPolicy{
+		rules: make(map[uint16]ttlLimit),
+		def:   ttlLimit{max: maximumTTL, min: minimalTTL},
+	}
+	for i, rule := range rules {
+		if len(rule.Types) == 0 {
+			return nil, fmt.Errorf("rule #%d has no type", i)
+		}
+		for _, s := range rule.Types {
+			typ, err := ParseRRType(s)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d: %w", i, err)
+			}
+			if _, dup := p.rules[typ]; !dup {
+				p.rules[typ] = ttlLimit{max: rule.MaximumTTL, min: rule.MinimalTTL}
+			}
+		}
+	}
+	return p, nil
+}
+
+// Apply applies the policy to m.
+// The rule of a RRSIG record is selected by the type it covers, so
+// signatures always share the ttl of their rrset.
+func (p *TTLPolicy) Apply(m *dns.Msg) {
+	for _, section := range [...][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue // opt record ttl is not ttl.
+			}
+			typ := hdr.Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				typ = sig.TypeCovered
+			}
+			l, ok := p.rules[typ]
+			if !ok {
+				l = p.def
+			}
+			hdr.Ttl = l.apply(hdr.Ttl)
+		}
+	}
+}
+
+// ParseRRType parses a record type from its mnemonic (e.g. "AAAA", "TYPE65")
+// or its number (e.g. "28").
+func ParseRRType(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if typ, ok := dns.StringToType[s]; ok {
+		return typ, nil
+	}
+	n := strings.TrimPrefix(s, "TYPE")
+	typ, err := strconv.ParseUint(n, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid record type %s", s)
+	}
+	return uint16(typ), nil
+}
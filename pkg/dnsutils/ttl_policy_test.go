@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestTTLPolicy_Apply(t *testing.T) {
+	p, err := NewTTLPolicy([]TTLRuleConfig{
+		{Types: []string{"a", "AAAA"}, MaximumTTL: 300},
+		{Types: []string{"DNSKEY", "DS", "NS"}},
+		{Types: []string{"A"}, MaximumTTL: 1}, // ignored, A is already in the first rule
+	}, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	m.Answer = []dns.RR{
+		mustRR("example. 3600 IN A 192.0.2.1"),
+		mustRR("example. 3600 IN RRSIG A 8 1 3600 20300101000000 20200101000000 1 example. AAAA"),
+		mustRR("example. 10 IN AAAA 2001:db8::1"),
+		mustRR("example. 86400 IN DNSKEY 257 3 8 AAAA"),
+		mustRR("example. 10 IN TXT txt"),
+	}
+	m.Ns = []dns.RR{mustRR("example. 5 IN NS ns.example.")}
+	m.SetEdns0(1232, false)
+
+	p.Apply(m)
+	want := []uint32{300, 300, 10, 86400, 60}
+	for i, rr := range m.Answer {
+		if rr.Header().Ttl != want[i] {
+			t.Errorf("answer #%d ttl = %d, want %d", i, rr.Header().Ttl, want[i])
+		}
+	}
+	if ttl := m.Ns[0].Header().Ttl; ttl != 5 {
+		t.Errorf("ns ttl = %d, want 5", ttl)
+	}
+	if ttl := m.IsEdns0().Hdr.Ttl; ttl != 0 {
+		t.Errorf("opt ttl changed to %d", ttl)
+	}
+
+	if _, err := NewTTLPolicy([]TTLRuleConfig{{Types: []string{"NOTATYPE"}}}, 0, 0); err == nil {
+		t.Error("invalid type should fail")
+	}
+	if _, err := NewTTLPolicy([]TTLRuleConfig{{MaximumTTL: 1}}, 0, 0); err == nil {
+		t.Error("rule without type should fail")
+	}
+}
+
+func TestParseRRType(t *testing.T) {
+	for s, want := range map[string]uint16{
+		"A":      dns.TypeA,
+		"aaaa":   dns.TypeAAAA,
+		"TYPE65": dns.TypeHTTPS,
+		"type99": 99,
+		"64":     dns.TypeSVCB,
+	} {
+		got, err := ParseRRType(s)
+		if err != nil || got != want {
+			t.Errorf("ParseRRType(%s) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "TYPE", "65536", "XX"} {
+		if _, err := ParseRRType(s); err == nil {
+			t.Errorf("ParseRRType(%s) should fail", s)
+		}
+	}
+}
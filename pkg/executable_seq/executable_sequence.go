@@ -31,7 +31,7 @@ import (
 // BuildExecutableLogicTree parses in into a ExecutableChainNode.
 // in can be: (a / a slice of) Executable,
 // (a / a slice of) string that map to an Executable in execs,
-// (a / a slice of) map[string]interface{}, which can be parsed to FallbackConfig, ParallelConfig or ConditionNodeConfig,
+// (a / a slice of) map[string]interface{}, which can be parsed to FallbackConfig, ParallelConfig, LimitConfig or ConditionNodeConfig,
 // a []interface{} that contains all the above.
 func BuildExecutableLogicTree(
 	in interface{},
@@ -93,6 +93,12 @@ func BuildExecutableLogicTree(
 				return nil, fmt.Errorf("invalid load balance section: %w", err)
 			}
 			return ec, nil
+		case hasKey(v, "limit"): // concurrency limit
+			ec, err := parseLimitNodeFromMap(v, logger, execs, matchers)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit section: %w", err)
+			}
+			return ec, nil
 		case hasKey(v, "primary") || hasKey(v, "secondary"): // fallback
 			ec, err := parseFallbackNodeFromMap(v, logger, execs, matchers)
 			if err != nil {
@@ -184,6 +190,25 @@ func parseLBNodeFromMap(
 	return e, nil
 }
 
+func parseLimitNodeFromMap(
+	m map[string]interface{},
+	logger *zap.Logger,
+	execs map[string]Executable,
+	matchers map[string]Matcher,
+) (ExecutableChainNode, error) {
+	conf := new(LimitConfig)
+	err := utils.WeakDecode(m, conf)
+	if err != nil {
+		return nil, err
+	}
+	e, err := ParseLimitNode(conf, logger, execs, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapExecutable(e), nil
+}
+
 func hasKey(m map[string]interface{}, key string) bool {
 	_, ok := m[key]
 	return ok
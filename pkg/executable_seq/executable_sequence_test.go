@@ -288,3 +288,32 @@ exec:
 		})
 	}
 }
+
+// loopExecutable executes itself again.
+type loopExecutable struct {
+	n int
+}
+
+func (l *loopExecutable) Exec(ctx context.Context, qCtx *query_context.Context, _ ExecutableChainNode) error {
+	l.n++
+	return ExecChainNode(ctx, qCtx, WrapExecutable(l))
+}
+
+func Test_ExecChainNode_loop(t *testing.T) {
+	l := new(loopExecutable)
+	qCtx := query_context.NewContext(new(dns.Msg), nil)
+	err := ExecChainNode(context.Background(), qCtx, WrapExecutable(l))
+	if !errors.Is(err, ErrTooManyExecSteps) {
+		t.Fatalf("want ErrTooManyExecSteps, got %v", err)
+	}
+	if l.n != MaxExecSteps {
+		t.Fatalf("want %d steps, got %d", MaxExecSteps, l.n)
+	}
+
+	// Copies share the steps.
+	l.n = 0
+	err = ExecChainNode(context.Background(), qCtx.Copy(), WrapExecutable(l))
+	if !errors.Is(err, ErrTooManyExecSteps) || l.n != 0 {
+		t.Fatalf("copy of the query should have no step left, err = %v, steps = %d", err, l.n)
+	}
+}
@@ -0,0 +1,563 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// Condition expression syntax:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison | operand
+//	comparison = field ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) literal
+//	           | field "in" "(" literal { "," literal } ")"
+//	operand    = matcher_tag | bool_field | "meta." key
+//
+// A matcher tag that contains special chars can be wrapped in brackets,
+// e.g. "[my-matcher]". Literals can be quoted by ' or ".
+// If a bare identifier is both a matcher tag and a bool field,
+// the matcher wins.
+// "meta.KEY" is a string field of the value of KEY that was set by
+// Context.SetValue. A bare "meta.KEY" tests whether KEY exists.
+
+// exprNode is a node of a compiled condition expression.
+type exprNode interface {
+	eval(ctx context.Context, qCtx *query_context.Context) (bool, error)
+}
+
+type orNode struct{ l, r exprNode }
+
+func (n *orNode) eval(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := n.l.eval(ctx, qCtx)
+	if err != nil || ok {
+		return ok, err
+	}
+	return n.r.eval(ctx, qCtx)
+}
+
+type andNode struct{ l, r exprNode }
+
+func (n *andNode) eval(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := n.l.eval(ctx, qCtx)
+	if err != nil || !ok {
+		return ok, err
+	}
+	return n.r.eval(ctx, qCtx)
+}
+
+type notNode struct{ n exprNode }
+
+func (n *notNode) eval(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := n.n.eval(ctx, qCtx)
+	return !ok, err
+}
+
+type matcherNode struct {
+	tag string
+	m   Matcher
+}
+
+func (n *matcherNode) eval(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := n.m.Match(ctx, qCtx)
+	if err != nil {
+		return false, fmt.Errorf("matcher %s: %w", n.tag, err)
+	}
+	return ok, nil
+}
+
+type fieldKind uint8
+
+const (
+	fieldNum fieldKind = iota
+	fieldStr
+	fieldBool
+)
+
+// exprField is a query metadata that can be used in expressions.
+type exprField struct {
+	kind fieldKind
+
+	// num returns the value of a fieldNum or fieldBool (1 means true) field.
+	num func(qCtx *query_context.Context) uint64
+	// str returns the value of a fieldStr field.
+	str func(qCtx *query_context.Context) string
+	// parse parses a literal of a fieldNum field.
+	// If nil, literals must be numbers.
+	parse func(s string) (uint64, error)
+	// caseSensitive indicates that the literals of a fieldStr field
+	// should not be lower-cased.
+	caseSensitive bool
+}
+
+const metaFieldPrefix = "meta."
+
+// lookupField returns the field of name, or nil if there is no such field.
+func lookupField(name string) *exprField {
+	if key := strings.TrimPrefix(name, metaFieldPrefix); len(key) < len(name) && len(key) > 0 {
+		return &exprField{
+			kind: fieldStr,
+			str: func(qCtx *query_context.Context) string {
+				v, _ := qCtx.GetValue(key)
+				return v
+			},
+			caseSensitive: true,
+		}
+	}
+	return exprFields[name]
+}
+
+type metaExistsNode struct{ key string }
+
+func (n *metaExistsNode) eval(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	_, ok := qCtx.GetValue(n.key)
+	return ok, nil
+}
+
+func firstQuestion(qCtx *query_context.Context) (dns.Question, bool) {
+	if q := qCtx.QReadOnly(); len(q.Question) > 0 {
+		return q.Question[0], true
+	}
+	return dns.Question{}, false
+}
+
+func boolToNum(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// exprFields contains all available fields. qtype and qclass are read from
+// the current query. EDNS0 fields are read from the original query, so they
+// reflect what the client sent.
+var exprFields = map[string]*exprField{
+	"qtype": {
+		kind: fieldNum,
+		num: func(qCtx *query_context.Context) uint64 {
+			q, _ := firstQuestion(qCtx)
+			return uint64(q.Qtype)
+		},
+		parse: func(s string) (uint64, error) {
+			t, err := dnsutils.ParseRRType(s)
+			return uint64(t), err
+		},
+	},
+	"qclass": {
+		kind: fieldNum,
+		num: func(qCtx *query_context.Context) uint64 {
+			q, _ := firstQuestion(qCtx)
+			return uint64(q.Qclass)
+		},
+		parse: parseRRClass,
+	},
+	"client_port": {
+		kind: fieldNum,
+		num: func(qCtx *query_context.Context) uint64 {
+			return uint64(qCtx.ReqMeta().ClientPort)
+		},
+	},
+	"protocol": {
+		kind: fieldStr,
+		str: func(qCtx *query_context.Context) string {
+			return qCtx.ReqMeta().Protocol
+		},
+	},
+	"edns": {
+		kind: fieldBool,
+		num: func(qCtx *query_context.Context) uint64 {
+			return boolToNum(qCtx.OriginalQuery().IsEdns0() != nil)
+		},
+	},
+	"edns_do": {
+		kind: fieldBool,
+		num: func(qCtx *query_context.Context) uint64 {
+			opt := qCtx.OriginalQuery().IsEdns0()
+			return boolToNum(opt != nil && opt.Do())
+		},
+	},
+	"edns_udp_size": {
+		kind: fieldNum,
+		num: func(qCtx *query_context.Context) uint64 {
+			if opt := qCtx.OriginalQuery().IsEdns0(); opt != nil {
+				return uint64(opt.UDPSize())
+			}
+			return 0
+		},
+	},
+	"edns_version": {
+		kind: fieldNum,
+		num: func(qCtx *query_context.Context) uint64 {
+			if opt := qCtx.OriginalQuery().IsEdns0(); opt != nil {
+				return uint64(opt.Version())
+			}
+			return 0
+		},
+	},
+}
+
+func parseRRClass(s string) (uint64, error) {
+	s = strings.ToUpper(s)
+	if c, ok := dns.StringToClass[s]; ok {
+		return uint64(c), nil
+	}
+	c, err := strconv.ParseUint(strings.TrimPrefix(s, "CLASS"), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid class %s", s)
+	}
+	return c, nil
+}
+
+type cmpNode struct {
+	name  string
+	field *exprField
+	op    string
+	nums  []uint64
+	strs  []string
+}
+
+func (n *cmpNode) eval(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	if n.field.kind == fieldStr {
+		v := n.field.str(qCtx)
+		for _, s := range n.strs {
+			if v == s {
+				return n.op != "!=", nil
+			}
+		}
+		return n.op == "!=", nil
+	}
+
+	v := n.field.num(qCtx)
+	switch n.op {
+	case "==", "in":
+		for _, u := range n.nums {
+			if v == u {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "!=":
+		return v != n.nums[0], nil
+	case "<":
+		return v < n.nums[0], nil
+	case "<=":
+		return v <= n.nums[0], nil
+	case ">":
+		return v > n.nums[0], nil
+	case ">=":
+		return v >= n.nums[0], nil
+	default:
+		return false, fmt.Errorf("invalid operator %s", n.op)
+	}
+}
+
+// parseLiteral parses s into n according to the kind of the field.
+func (n *cmpNode) parseLiteral(s string) error {
+	switch n.field.kind {
+	case fieldStr:
+		if !n.field.caseSensitive {
+			s = strings.ToLower(s)
+		}
+		n.strs = append(n.strs, s)
+	case fieldBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool value %s for field %s", s, n.name)
+		}
+		n.nums = append(n.nums, boolToNum(b))
+	default:
+		var u uint64
+		var err error
+		if n.field.parse != nil {
+			u, err = n.field.parse(s)
+		} else {
+			u, err = strconv.ParseUint(s, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %s for field %s: %w", s, n.name, err)
+		}
+		n.nums = append(n.nums, u)
+	}
+	return nil
+}
+
+type tokenType uint8
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	typ tokenType
+	s   string
+	pos int
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.'
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{typ: tokenLParen, s: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{typ: tokenRParen, s: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{typ: tokenComma, s: ",", pos: i})
+			i++
+		case c == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ at %d", i)
+			}
+			tokens = append(tokens, token{typ: tokenIdent, s: s[i+1 : i+end], pos: i})
+			i += end + 1
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed quote at %d", i)
+			}
+			tokens = append(tokens, token{typ: tokenString, s: s[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case isIdentChar(c):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{typ: tokenIdent, s: s[i:j], pos: i})
+			i = j
+		default:
+			var op string
+			for _, o := range [...]string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("unexpected char %q at %d", c, i)
+			}
+			tokens = append(tokens, token{typ: tokenOp, s: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{typ: tokenEOF, pos: len(s)}), nil
+}
+
+// ExprIdents returns the identifiers in the condition expression s,
+// which include the referenced matcher tags. It returns nil if s cannot
+// be tokenized.
+func ExprIdents(s string) []string {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil
+	}
+	var idents []string
+	for _, t := range tokens {
+		if t.typ == tokenIdent {
+			idents = append(idents, t.s)
+		}
+	}
+	return idents
+}
+
+type exprParser struct {
+	tokens   []token
+	i        int
+	matchers map[string]Matcher
+}
+
+// compileExpr compiles s. All referenced matchers are looked up from matchers,
+// an error will be returned if a matcher is missing.
+func compileExpr(s string, matchers map[string]Matcher) (exprNode, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, matchers: matchers}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t.s, t.pos)
+	}
+	return n, nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.i]
+	if t.typ != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.typ == tokenOp && t.s == "||"; t = p.peek() {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &orNode{l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.typ == tokenOp && t.s == "&&"; t = p.peek() {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &andNode{l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	t := p.next()
+	switch {
+	case t.typ == tokenOp && t.s == "!":
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n: n}, nil
+	case t.typ == tokenLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if rt := p.next(); rt.typ != tokenRParen {
+			return nil, fmt.Errorf("missing ) at %d", rt.pos)
+		}
+		return n, nil
+	case t.typ == tokenIdent:
+		nt := p.peek()
+		if nt.typ == tokenOp && isCmpOp(nt.s) || nt.typ == tokenIdent && nt.s == "in" {
+			return p.parseComparison(t)
+		}
+		if m := p.matchers[t.s]; m != nil {
+			return &matcherNode{tag: t.s, m: m}, nil
+		}
+		if strings.HasPrefix(t.s, metaFieldPrefix) && len(t.s) > len(metaFieldPrefix) {
+			return &metaExistsNode{key: t.s[len(metaFieldPrefix):]}, nil
+		}
+		if f := exprFields[t.s]; f != nil {
+			if f.kind != fieldBool {
+				return nil, fmt.Errorf("field %s at %d must be compared with a value", t.s, t.pos)
+			}
+			return &cmpNode{name: t.s, field: f, op: "==", nums: []uint64{1}}, nil
+		}
+		return nil, fmt.Errorf("cannot find matcher %s", t.s)
+	case t.typ == tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %s at %d", t.s, t.pos)
+	}
+}
+
+func isCmpOp(s string) bool {
+	switch s {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseComparison(ft token) (exprNode, error) {
+	f := lookupField(ft.s)
+	if f == nil {
+		return nil, fmt.Errorf("unknown field %s at %d", ft.s, ft.pos)
+	}
+	op := p.next()
+	n := &cmpNode{name: ft.s, field: f, op: op.s}
+	if f.kind != fieldNum && op.s != "==" && op.s != "!=" && op.s != "in" {
+		return nil, fmt.Errorf("operator %s at %d is not supported by field %s", op.s, op.pos, ft.s)
+	}
+
+	parseLit := func() error {
+		t := p.next()
+		if t.typ != tokenIdent && t.typ != tokenString {
+			return fmt.Errorf("expect a value at %d", t.pos)
+		}
+		return n.parseLiteral(t.s)
+	}
+
+	if op.s != "in" {
+		if err := parseLit(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	if t := p.next(); t.typ != tokenLParen {
+		return nil, fmt.Errorf("expect ( at %d", t.pos)
+	}
+	for {
+		if err := parseLit(); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		if t.typ == tokenRParen {
+			return n, nil
+		}
+		if t.typ != tokenComma {
+			return nil, fmt.Errorf("expect , or ) at %d", t.pos)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+)
+
+func Test_conditionMatcher(t *testing.T) {
+	mErr := errors.New("mErr")
+	matchers := map[string]Matcher{
+		"t":         &DummyMatcher{Matched: true},
+		"f":         &DummyMatcher{Matched: false},
+		"m-1":       &DummyMatcher{Matched: true},
+		"err":       &DummyMatcher{WantErr: mErr},
+		"edns":      &DummyMatcher{Matched: false}, // shadows the edns field
+		"qtype_tag": &DummyMatcher{Matched: true},
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeAAAA)
+	q.SetEdns0(1232, true)
+	meta := &query_context.RequestMeta{ClientPort: 5353, Protocol: query_context.ProtocolUDP}
+
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr error
+	}{
+		{expr: "t", want: true},
+		{expr: "!t", want: false},
+		{expr: "t && f", want: false},
+		{expr: "t || f", want: true},
+		{expr: "f || t && f", want: false},
+		{expr: "(f || t) && t", want: true},
+		{expr: "!(f || f)", want: true},
+		{expr: "[m-1] && m-1", want: true},
+		{expr: "t || err", want: true}, // short-circuit
+		{expr: "f && err", want: false},
+		{expr: "f || err", wantErr: mErr},
+		{expr: "qtype == AAAA", want: true},
+		{expr: "qtype == 28 && qtype_tag", want: true},
+		{expr: "qtype != aaaa", want: false},
+		{expr: "qtype in (A, AAAA, 'HTTPS')", want: true},
+		{expr: "qtype in (A, HTTPS)", want: false},
+		{expr: "qclass == IN", want: true},
+		{expr: "client_port >= 1024 && client_port < 5354", want: true},
+		{expr: "client_port > 5353", want: false},
+		{expr: `protocol == "UDP"`, want: true},
+		{expr: "protocol in (tcp, tls)", want: false},
+		{expr: "edns", want: false},
+		{expr: "edns_do && edns_udp_size == 1232 && edns_version == 0", want: true},
+		{expr: "edns_do != true", want: false},
+		{expr: "meta.mark == cn", want: true},
+		{expr: "meta.mark == CN", want: false},
+		{expr: "meta.mark in (us, cn) && meta.empty == ''", want: true},
+		{expr: "meta.mark && meta.empty && !meta.missing", want: true},
+		{expr: "meta.missing != ''", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			m, err := newConditionMatcher(nil, tt.expr, matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qCtx := query_context.NewContext(q, meta)
+			qCtx.SetValue("mark", "cn")
+			qCtx.SetValue("empty", "")
+			got, err := m.Match(context.Background(), qCtx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Match() err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compileExpr_err(t *testing.T) {
+	matchers := map[string]Matcher{"t": &DummyMatcher{Matched: true}}
+	for _, s := range []string{
+		"",
+		"missing",
+		"t &&",
+		"t || || t",
+		"(t",
+		"t)",
+		"t t",
+		"[t",
+		"qtype",
+		"qtype == NOTATYPE",
+		"qtype ==",
+		"qtype in A",
+		"qtype in (A AAAA)",
+		"client_port == -1",
+		"protocol > udp",
+		"edns_do == yes",
+		"unknown == 1",
+		"t & t",
+		"'t",
+		"meta. == 1",
+		"meta.mark > a",
+	} {
+		if _, err := compileExpr(s, matchers); err == nil {
+			t.Errorf("compileExpr(%q) should fail", s)
+		}
+	}
+}
+
+func TestExprIdents(t *testing.T) {
+	got := ExprIdents(`m1 && !([my-m2] || qtype in (A, AAAA)) && meta.k == "v"`)
+	want := []string{"m1", "my-m2", "qtype", "in", "A", "AAAA", "meta.k"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if got := ExprIdents("[unclosed"); got != nil {
+		t.Fatalf("want nil, got %v", got)
+	}
+}
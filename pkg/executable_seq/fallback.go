@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"sync"
 	"time"
@@ -44,14 +45,56 @@ type FallbackConfig struct {
 
 	// AlwaysStandby: secondary should always stand by in fast fallback.
 	AlwaysStandby bool `yaml:"always_standby"`
+
+	// FallbackOn lists the classes of primary responses that are treated
+	// as failures, in addition to errors and missing responses.
+	// Can be "servfail", "empty" (NOERROR without answer), "polluted"
+	// and "timeout". A failed response of primary is dropped and secondary
+	// is executed.
+	FallbackOn []string `yaml:"fallback_on"`
+
+	// PrimaryTimeout is the time limit of primary in milliseconds. Primary
+	// that does not return in time fails, and secondary is executed with the
+	// rest of the query's time. Required by the "timeout" class.
+	PrimaryTimeout int `yaml:"primary_timeout"`
+
+	// Polluted is a condition expression (see expr.go). The response of
+	// primary is polluted if its query matches it. Required by the
+	// "polluted" class.
+	Polluted string `yaml:"polluted"`
+
+	// MetaKey is the query metadata key that records the branch
+	// ("primary" or "secondary") of the response. Default is "fallback_branch".
+	MetaKey string `yaml:"meta_key"`
 }
 
+const (
+	fallbackOnServfail = "servfail"
+	fallbackOnEmpty    = "empty"
+	fallbackOnPolluted = "polluted"
+	fallbackOnTimeout  = "timeout"
+
+	defaultFallbackMetaKey = "fallback_branch"
+)
+
+// Sequence ids in results of FallbackNode.
+const (
+	fromPrimary = iota + 1
+	fromSecondary
+)
+
 type FallbackNode struct {
 	primary              ExecutableChainNode
 	secondary            ExecutableChainNode
 	fastFallbackDuration time.Duration
 	alwaysStandby        bool
 
+	failOnServfail bool
+	failOnEmpty    bool
+	polluted       Matcher       // nil if "polluted" class is disabled
+	primaryTimeout time.Duration // zero if "timeout" class is disabled
+	metaKey        string
+
 	primaryST *statusTracker // nil if normal fallback is disabled
 	logger    *zap.Logger    // not nil
 }
@@ -134,6 +177,41 @@ func ParseFallbackNode(
 		secondary:            secondaryECS,
 		fastFallbackDuration: time.Duration(c.FastFallback) * time.Millisecond,
 		alwaysStandby:        c.AlwaysStandby,
+		metaKey:              c.MetaKey,
+	}
+	if len(fallbackECS.metaKey) == 0 {
+		fallbackECS.metaKey = defaultFallbackMetaKey
+	}
+
+	for _, class := range c.FallbackOn {
+		switch class {
+		case fallbackOnServfail:
+			fallbackECS.failOnServfail = true
+		case fallbackOnEmpty:
+			fallbackECS.failOnEmpty = true
+		case fallbackOnPolluted:
+			if len(c.Polluted) == 0 {
+				return nil, errors.New("fallback on polluted response requires a polluted condition")
+			}
+			m, err := newConditionMatcher(logger.Named("polluted"), c.Polluted, matchers)
+			if err != nil {
+				return nil, fmt.Errorf("invalid polluted condition: %w", err)
+			}
+			fallbackECS.polluted = m
+		case fallbackOnTimeout:
+			if c.PrimaryTimeout <= 0 {
+				return nil, errors.New("fallback on timeout requires a primary_timeout")
+			}
+			fallbackECS.primaryTimeout = time.Duration(c.PrimaryTimeout) * time.Millisecond
+		default:
+			return nil, fmt.Errorf("invalid fallback_on class %s", class)
+		}
+	}
+	if len(c.Polluted) > 0 && fallbackECS.polluted == nil {
+		return nil, errors.New("polluted condition is set but fallback_on has no polluted class")
+	}
+	if c.PrimaryTimeout > 0 && fallbackECS.primaryTimeout == 0 {
+		return nil, errors.New("primary_timeout is set but fallback_on has no timeout class")
 	}
 
 	if c.StatLength > 0 {
@@ -160,26 +238,86 @@ func (f *FallbackNode) Exec(ctx context.Context, qCtx *query_context.Context, ne
 }
 
 func (f *FallbackNode) exec(ctx context.Context, qCtx *query_context.Context) error {
+	var from int
+	var err error
 	if f.primaryST == nil || f.primaryST.good() {
 		if f.fastFallbackDuration > 0 {
-			return f.doFastFallback(ctx, qCtx)
+			from, err = f.doFastFallback(ctx, qCtx)
 		} else {
-			return f.doPrimary(ctx, qCtx)
+			from, err = f.doPrimaryThenSecondary(ctx, qCtx)
 		}
+	} else {
+		f.logger.Debug("primary is not good", qCtx.InfoField())
+		from, err = f.doFallback(ctx, qCtx)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch from {
+	case fromPrimary:
+		qCtx.SetValue(f.metaKey, "primary")
+	case fromSecondary:
+		qCtx.SetValue(f.metaKey, "secondary")
 	}
-	f.logger.Debug("primary is not good", qCtx.InfoField())
-	return f.doFallback(ctx, qCtx)
+	return nil
 }
 
 func (f *FallbackNode) isolateDoPrimary(ctx context.Context, qCtx *query_context.Context) (err error) {
 	qCtxCopy := qCtx.Copy()
-	err = f.doPrimary(ctx, qCtxCopy)
+	_, err = f.doPrimary(ctx, qCtxCopy)
 	qCtx.SetResponse(qCtxCopy.R())
 	return err
 }
 
-func (f *FallbackNode) doPrimary(ctx context.Context, qCtx *query_context.Context) (err error) {
+// doPrimaryThenSecondary executes primary. Secondary is executed if primary
+// returns an error, times out or its response is rejected by the fallback_on
+// classes. fromSecondary is returned only if secondary returns a response.
+func (f *FallbackNode) doPrimaryThenSecondary(ctx context.Context, qCtx *query_context.Context) (int, error) {
+	rejected, err := f.doPrimary(ctx, qCtx)
+	if err == nil && !rejected {
+		return fromPrimary, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil { // No time left for secondary.
+			return 0, err
+		}
+		class := "error"
+		if errors.Is(err, context.DeadlineExceeded) {
+			class = fallbackOnTimeout
+		}
+		f.logger.Debug("primary failed", qCtx.InfoField(), zap.String("class", class), zap.Error(err))
+		qCtx.SetResponse(nil)
+	}
+
+	if err := f.doSecondary(ctx, qCtx); err != nil {
+		return 0, err
+	}
+	if qCtx.R() == nil {
+		return 0, nil
+	}
+	return fromSecondary, nil
+}
+
+// doPrimary executes primary within the primary_timeout. If the response
+// of primary is rejected by the fallback_on classes, it will be removed
+// from qCtx.
+func (f *FallbackNode) doPrimary(ctx context.Context, qCtx *query_context.Context) (rejected bool, err error) {
+	if f.primaryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.primaryTimeout)
+		defer cancel()
+	}
+
 	err = ExecChainNode(ctx, qCtx, f.primary)
+	if err == nil {
+		if class := f.classifyResponse(ctx, qCtx); len(class) > 0 {
+			f.logger.Debug("primary response rejected", qCtx.InfoField(), zap.String("class", class))
+			qCtx.SetResponse(nil)
+			rejected = true
+		}
+	}
+
 	if f.primaryST != nil {
 		if err != nil || qCtx.R() == nil {
 			f.primaryST.update(1)
@@ -188,7 +326,33 @@ func (f *FallbackNode) doPrimary(ctx context.Context, qCtx *query_context.Contex
 		}
 	}
 
-	return err
+	return rejected, err
+}
+
+// classifyResponse returns the fallback_on class of the response in qCtx.
+// It returns an empty string if the response is not a failure.
+func (f *FallbackNode) classifyResponse(ctx context.Context, qCtx *query_context.Context) string {
+	r := qCtx.RReadOnly()
+	if r == nil {
+		return ""
+	}
+	if f.failOnServfail && r.Rcode == dns.RcodeServerFailure {
+		return fallbackOnServfail
+	}
+	if f.failOnEmpty && r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0 {
+		return fallbackOnEmpty
+	}
+	if f.polluted != nil {
+		ok, err := f.polluted.Match(ctx, qCtx)
+		if err != nil {
+			f.logger.Warn("failed to match polluted condition", qCtx.InfoField(), zap.Error(err))
+			return ""
+		}
+		if ok {
+			return fallbackOnPolluted
+		}
+	}
+	return ""
 }
 
 func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, func()) {
@@ -199,7 +363,7 @@ func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, fu
 	return context.WithDeadline(context.Background(), ddl)
 }
 
-func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.Context) (err error) {
+func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.Context) (int, error) {
 	c := make(chan *parallelECSResult, 2)
 	primFailed := make(chan struct{}) // will be closed if primary returns an error.
 	primDone := make(chan struct{})
@@ -207,7 +371,7 @@ func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.C
 	go func() {
 		cCtx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
 		defer cancel()
-		err := f.doPrimary(cCtx, qCtxP)
+		_, err := f.doPrimary(cCtx, qCtxP)
 		if err != nil || qCtxP.R() == nil {
 			close(primFailed)
 		} else {
@@ -216,7 +380,7 @@ func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.C
 		c <- &parallelECSResult{
 			qCtx: qCtxP,
 			err:  err,
-			from: 1,
+			from: fromPrimary,
 		}
 	}()
 
@@ -239,7 +403,7 @@ func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.C
 		res := &parallelECSResult{
 			qCtx: qCtxS,
 			err:  err,
-			from: 2,
+			from: fromSecondary,
 		}
 
 		if f.alwaysStandby { // always standby
@@ -258,25 +422,25 @@ func (f *FallbackNode) doFastFallback(ctx context.Context, qCtx *query_context.C
 		}
 	}()
 
-	return asyncWait(ctx, qCtx, f.logger, c, 2)
+	return asyncWait(ctx, qCtx, f.logger, c, 2, nil)
 }
 
 func (f *FallbackNode) doSecondary(ctx context.Context, qCtx *query_context.Context) (err error) {
 	return ExecChainNode(ctx, qCtx, f.secondary)
 }
 
-func (f *FallbackNode) doFallback(ctx context.Context, qCtx *query_context.Context) error {
+func (f *FallbackNode) doFallback(ctx context.Context, qCtx *query_context.Context) (int, error) {
 	c := make(chan *parallelECSResult, 2) // buf size is 2, avoid blocking.
 
 	qCtxP := qCtx.Copy()
 	go func() {
 		cCtx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
 		defer cancel()
-		err := f.doPrimary(cCtx, qCtxP)
+		_, err := f.doPrimary(cCtx, qCtxP)
 		c <- &parallelECSResult{
 			qCtx: qCtxP,
 			err:  err,
-			from: 0,
+			from: fromPrimary,
 		}
 	}()
 
@@ -288,9 +452,9 @@ func (f *FallbackNode) doFallback(ctx context.Context, qCtx *query_context.Conte
 		c <- &parallelECSResult{
 			qCtx: qCtxS,
 			err:  err,
-			from: 1,
+			from: fromSecondary,
 		}
 	}()
 
-	return asyncWait(ctx, qCtx, f.logger, c, 2)
+	return asyncWait(ctx, qCtx, f.logger, c, 2, nil)
 }
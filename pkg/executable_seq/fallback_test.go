@@ -43,14 +43,14 @@ func Test_FallbackECS_fallback(t *testing.T) {
 		wantR   *dns.Msg
 		wantErr bool
 	}{
-		{"failed 0", nil, er, r2, nil, nil, true}, // warm up
-		{"failed 1", nil, er, r2, nil, nil, true},
+		{"failed 0", nil, er, r2, nil, r2, false}, // warm up, secondary is executed on error
+		{"failed 1", nil, er, r2, nil, r2, false},
 		{"failed 2", nil, er, r2, nil, r2, false}, // trigger fallback
 		{"failed 3", nil, nil, r2, nil, r2, false},
 		{"failed 3", r1, nil, nil, nil, r1, false}, // primary success
 		{"success 1 failed 2", r1, nil, nil, nil, r1, false},
-		{"success 2 failed 1", nil, er, nil, nil, nil, true}, // end of fallback, but primary returns an error again
-		{"success 1 failed 2", nil, er, nil, er, nil, true},  // no response
+		{"success 2 failed 1", nil, er, nil, nil, nil, false}, // end of fallback, but primary returns an error again
+		{"success 1 failed 2", nil, er, nil, er, nil, true},   // no response
 	}
 	conf := &FallbackConfig{
 		Primary:       []interface{}{"p1"},
@@ -181,6 +181,142 @@ func Test_FallbackECS_fast_fallback(t *testing.T) {
 	}
 }
 
+func Test_FallbackECS_fallbackOn(t *testing.T) {
+	newResp := func(rcode int, answer bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.Rcode = rcode
+		if answer {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA}})
+		}
+		return r
+	}
+	good := newResp(dns.RcodeSuccess, true)
+	servfail := newResp(dns.RcodeServerFailure, false)
+	empty := newResp(dns.RcodeSuccess, false)
+	r2 := newResp(dns.RcodeSuccess, true)
+
+	tests := []struct {
+		name         string
+		fallbackOn   []string
+		polluted     string
+		r1           *dns.Msg
+		fastFallback int
+		wantR        *dns.Msg
+		wantBranch   string
+	}{
+		{"good", []string{"servfail", "empty"}, "", good, 0, good, "primary"},
+		{"servfail", []string{"servfail"}, "", servfail, 0, r2, "secondary"},
+		{"servfail not selected", []string{"empty"}, "", servfail, 0, servfail, "primary"},
+		{"empty", []string{"empty"}, "", empty, 0, r2, "secondary"},
+		{"polluted", []string{"polluted"}, "is_polluted", good, 0, r2, "secondary"},
+		{"not polluted", []string{"polluted"}, "!is_polluted", good, 0, good, "primary"},
+		{"fast fallback servfail", []string{"servfail"}, "", servfail, 100, r2, "secondary"},
+		{"fast fallback good", []string{"servfail"}, "", good, 100, good, "primary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &FallbackConfig{
+				Primary:      []interface{}{"p1"},
+				Secondary:    []interface{}{"p2"},
+				FastFallback: tt.fastFallback,
+				FallbackOn:   tt.fallbackOn,
+				Polluted:     tt.polluted,
+			}
+			execs := map[string]Executable{
+				"p1": &DummyExecutable{WantR: tt.r1},
+				"p2": &DummyExecutable{WantR: r2},
+			}
+			matchers := map[string]Matcher{
+				"is_polluted": &DummyMatcher{Matched: true},
+			}
+
+			fallbackECS, err := ParseFallbackNode(conf, zap.NewNop(), execs, matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qCtx := query_context.NewContext(new(dns.Msg), nil)
+			if err := ExecChainNode(context.Background(), qCtx, WrapExecutable(fallbackECS)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantR != qCtx.R() {
+				t.Fatalf("qCtx.R() = %p, wantR %p", qCtx.R(), tt.wantR)
+			}
+			if v, _ := qCtx.GetValue("fallback_branch"); v != tt.wantBranch {
+				t.Fatalf("fallback_branch = %s, want %s", v, tt.wantBranch)
+			}
+		})
+	}
+
+	invalid := []*FallbackConfig{
+		{Primary: []interface{}{"p1"}, Secondary: []interface{}{"p2"}, FallbackOn: []string{"unknown"}},
+		{Primary: []interface{}{"p1"}, Secondary: []interface{}{"p2"}, FallbackOn: []string{"polluted"}},
+		{Primary: []interface{}{"p1"}, Secondary: []interface{}{"p2"}, Polluted: "is_polluted"},
+		{Primary: []interface{}{"p1"}, Secondary: []interface{}{"p2"}, FallbackOn: []string{"timeout"}},
+		{Primary: []interface{}{"p1"}, Secondary: []interface{}{"p2"}, PrimaryTimeout: 100},
+	}
+	for i, conf := range invalid {
+		if _, err := ParseFallbackNode(conf, zap.NewNop(), map[string]Executable{"p1": &DummyExecutable{}, "p2": &DummyExecutable{}}, map[string]Matcher{"is_polluted": &DummyMatcher{}}); err == nil {
+			t.Fatalf("invalid config #%d: want err", i)
+		}
+	}
+}
+
+// blockingExecutable blocks until ctx is done.
+type blockingExecutable struct{}
+
+func (blockingExecutable) Exec(ctx context.Context, _ *query_context.Context, _ ExecutableChainNode) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_FallbackECS_primaryFailure(t *testing.T) {
+	r2 := new(dns.Msg)
+	tests := []struct {
+		name       string
+		fallbackOn []string
+		timeout    int
+		p1         Executable
+		p2         Executable
+		wantR      *dns.Msg
+		wantBranch string
+	}{
+		{"error", nil, 0, &DummyExecutable{WantErr: errors.New("err")}, &DummyExecutable{WantR: r2}, r2, "secondary"},
+		{"timeout", []string{"timeout"}, 50, blockingExecutable{}, &DummyExecutable{WantR: r2}, r2, "secondary"},
+		{"no secondary response", nil, 0, &DummyExecutable{WantErr: errors.New("err")}, &DummyExecutable{}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &FallbackConfig{
+				Primary:        []interface{}{"p1"},
+				Secondary:      []interface{}{"p2"},
+				FallbackOn:     tt.fallbackOn,
+				PrimaryTimeout: tt.timeout,
+			}
+			execs := map[string]Executable{"p1": tt.p1, "p2": tt.p2}
+			fallbackECS, err := ParseFallbackNode(conf, zap.NewNop(), execs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			qCtx := query_context.NewContext(new(dns.Msg), nil)
+			if err := ExecChainNode(ctx, qCtx, WrapExecutable(fallbackECS)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantR != qCtx.R() {
+				t.Fatalf("qCtx.R() = %p, wantR %p", qCtx.R(), tt.wantR)
+			}
+			if v, _ := qCtx.GetValue("fallback_branch"); v != tt.wantBranch {
+				t.Fatalf("fallback_branch = %s, want %s", v, tt.wantBranch)
+			}
+		})
+	}
+}
+
 func Test_statusTracker(t *testing.T) {
 	tests := []struct {
 		name string
@@ -23,9 +23,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
-	"github.com/Knetic/govaluate"
 	"go.uber.org/zap"
-	"sync"
 )
 
 // ConditionNodeConfig is a config to build a ConditionNode.
@@ -96,134 +94,43 @@ func ParseConditionNode(
 }
 
 type conditionMatcher struct {
-	lg           *zap.Logger
-	expr         *govaluate.EvaluableExpression
-	matchers     map[string]Matcher
-	paramsPHPool sync.Pool
+	lg   *zap.Logger
+	expr string
+	root exprNode
 }
 
-func newConditionMatcher(lg *zap.Logger, s string, matchers map[string]Matcher) (*conditionMatcher, error) {
-	cm := &conditionMatcher{
-		lg:           lg,
-		matchers:     make(map[string]Matcher),
-		paramsPHPool: sync.Pool{},
-	}
-
-	expr, err := govaluate.NewEvaluableExpression(s)
-	if err != nil {
-		return nil, err
-	}
-
-	cm.expr = expr
-	vs := expr.Vars()
-	for _, tag := range vs {
-		m := matchers[tag]
-		if m == nil {
-			return nil, fmt.Errorf("cannot find matcher %s", tag)
-		}
-		cm.matchers[tag] = m
-	}
-
-	// params type check
-	expr.ChecksTypes = true
-	params := make(govaluate.MapParameters)
-	for tag := range cm.matchers {
-		params[tag] = true
-	}
-	if _, err := expr.Eval(params); err != nil {
-		return nil, fmt.Errorf("invalid param, %w", err)
-	}
-
-	return cm, nil
-}
-
-type exprResult int
-
-const (
-	exprResultNull exprResult = iota
-	exprResultFalse
-	exprResultTrue
-)
-
-func (r exprResult) String() string {
-	switch r {
-	case exprResultNull:
-		return "nil"
-	case exprResultFalse:
-		return "false"
-	case exprResultTrue:
-		return "true"
-	default:
-		return "invalid"
-	}
+// NewConditionMatcher compiles the condition expression s into a Matcher.
+// All matchers referenced by s must be in matchers.
+// See expr.go for the syntax.
+func NewConditionMatcher(lg *zap.Logger, s string, matchers map[string]Matcher) (Matcher, error) {
+	return newConditionMatcher(lg, s, matchers)
 }
 
-type exprParamsPlaceHolder struct {
-	f   map[string]func() (bool, error)
-	res map[string]exprResult
-}
-
-func newExprParamsPlaceHolder() *exprParamsPlaceHolder {
-	return &exprParamsPlaceHolder{
-		f:   make(map[string]func() (bool, error)),
-		res: make(map[string]exprResult),
-	}
-}
-
-func (e *exprParamsPlaceHolder) Get(name string) (interface{}, error) {
-	f, ok := e.f[name]
-	if !ok {
-		return nil, fmt.Errorf("cannot find var %s", name)
+func newConditionMatcher(lg *zap.Logger, s string, matchers map[string]Matcher) (*conditionMatcher, error) {
+	if lg == nil {
+		lg = zap.NewNop()
 	}
-	res, err := f()
+	root, err := compileExpr(s, matchers)
 	if err != nil {
-		return nil, err
-	}
-	if res == true {
-		e.res[name] = exprResultTrue
-	} else {
-		e.res[name] = exprResultFalse
-	}
-	return res, nil
-}
-
-func (e *exprParamsPlaceHolder) setCall(name string, f func() (bool, error)) {
-	e.f[name] = f
-}
-
-// A helper func for better log.
-func (e *exprParamsPlaceHolder) makeResultZapFields(queryInfoField zap.Field, res bool) []zap.Field {
-	o := make([]zap.Field, 2, len(e.res)+2)
-	o[0] = queryInfoField
-	o[1] = zap.Bool("result", res)
-	for s, result := range e.res {
-		o = append(o, zap.Stringer(s, result))
+		return nil, fmt.Errorf("invalid expression %s, %w", s, err)
 	}
-	return o
+	return &conditionMatcher{
+		lg:   lg,
+		expr: s,
+		root: root,
+	}, nil
 }
 
 func (m *conditionMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
-	paramsPH, ok := m.paramsPHPool.Get().(*exprParamsPlaceHolder)
-	if !ok {
-		paramsPH = newExprParamsPlaceHolder()
-	}
-	defer m.paramsPHPool.Put(paramsPH)
-
-	for tag, matcher := range m.matchers {
-		matcher := matcher
-		f := func() (bool, error) {
-			return matcher.Match(ctx, qCtx)
-		}
-		paramsPH.setCall(tag, f)
-	}
-	out, err := m.expr.Eval(paramsPH)
+	res, err := m.root.eval(ctx, qCtx)
 	if err != nil {
 		return false, err
 	}
-	res := out.(bool)
 	m.lg.Debug(
 		"condition matcher result",
-		paramsPH.makeResultZapFields(qCtx.InfoField(), res)...,
+		qCtx.InfoField(),
+		zap.String("expr", m.expr),
+		zap.Bool("result", res),
 	)
 	return res, nil
 }
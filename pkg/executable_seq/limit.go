@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"time"
+)
+
+type LimitConfig struct {
+	// Limit is the limited sub sequence.
+	Limit interface{} `yaml:"limit"`
+
+	// Concurrency is the maximum number of queries that can execute
+	// Limit concurrently.
+	Concurrency int `yaml:"concurrency"`
+
+	// WaitTimeout in milliseconds. Queries wait up to WaitTimeout for a free
+	// slot. Zero means queries do not wait.
+	WaitTimeout int `yaml:"wait_timeout"`
+
+	// Fallback is executed instead of Limit when there is no free slot.
+	// If it is empty, Limit is skipped.
+	Fallback interface{} `yaml:"fallback"`
+}
+
+// LimitNode caps the number of queries that execute a sub sequence
+// concurrently.
+type LimitNode struct {
+	limit       ExecutableChainNode
+	fallback    ExecutableChainNode // may be nil
+	slots       chan struct{}
+	waitTimeout time.Duration
+	logger      *zap.Logger // not nil
+}
+
+func ParseLimitNode(
+	c *LimitConfig,
+	logger *zap.Logger,
+	execs map[string]Executable,
+	matchers map[string]Matcher,
+) (*LimitNode, error) {
+	if c.Limit == nil {
+		return nil, errors.New("limit is empty")
+	}
+	if c.Concurrency <= 0 {
+		return nil, errors.New("concurrency must be greater than 0")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	limit, err := BuildExecutableLogicTree(c.Limit, logger.Named("limit"), execs, matchers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limit sequence: %w", err)
+	}
+	n := &LimitNode{
+		limit:       limit,
+		slots:       make(chan struct{}, c.Concurrency),
+		waitTimeout: time.Duration(c.WaitTimeout) * time.Millisecond,
+		logger:      logger,
+	}
+	if c.Fallback != nil {
+		n.fallback, err = BuildExecutableLogicTree(c.Fallback, logger.Named("fallback"), execs, matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback sequence: %w", err)
+		}
+	}
+	return n, nil
+}
+
+func (l *LimitNode) Exec(ctx context.Context, qCtx *query_context.Context, next ExecutableChainNode) error {
+	if err := l.exec(ctx, qCtx); err != nil {
+		return err
+	}
+	return ExecChainNode(ctx, qCtx, next)
+}
+
+func (l *LimitNode) exec(ctx context.Context, qCtx *query_context.Context) error {
+	ok, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		l.logger.Debug("limit is saturated", qCtx.InfoField())
+		if l.fallback != nil {
+			return ExecChainNode(ctx, qCtx, l.fallback)
+		}
+		return nil
+	}
+	defer l.release()
+	return ExecChainNode(ctx, qCtx, l.limit)
+}
+
+// acquire acquires a slot. It reports whether a slot was acquired.
+func (l *LimitNode) acquire(ctx context.Context) (bool, error) {
+	select {
+	case l.slots <- struct{}{}:
+		return true, nil
+	default:
+	}
+	if l.waitTimeout <= 0 {
+		return false, nil
+	}
+
+	timer := pool.GetTimer(l.waitTimeout)
+	defer pool.ReleaseTimer(timer)
+	select {
+	case l.slots <- struct{}{}:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (l *LimitNode) release() {
+	<-l.slots
+}
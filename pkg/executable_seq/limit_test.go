@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_LimitNode(t *testing.T) {
+	limited := new(dns.Msg)
+	fallback := new(dns.Msg)
+	execs := map[string]Executable{
+		"slow":     &DummyExecutable{WantSleep: time.Millisecond * 100, WantR: limited},
+		"fallback": &DummyExecutable{WantR: fallback},
+	}
+
+	tests := []struct {
+		name         string
+		waitTimeout  int
+		fallback     interface{}
+		wantLimited  int
+		wantFallback int
+		wantNil      int
+	}{
+		{"fallback", 0, "fallback", 2, 1, 0},
+		{"skip", 0, nil, 2, 0, 1},
+		{"wait", 500, "fallback", 3, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := BuildExecutableLogicTree(map[string]interface{}{
+				"limit":        "slow",
+				"concurrency":  2,
+				"wait_timeout": tt.waitTimeout,
+				"fallback":     tt.fallback,
+			}, zap.NewNop(), execs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			got := make(map[*dns.Msg]int)
+			wg := new(sync.WaitGroup)
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					qCtx := query_context.NewContext(new(dns.Msg), nil)
+					if err := ExecChainNode(context.Background(), qCtx, n); err != nil {
+						t.Error(err)
+					}
+					mu.Lock()
+					got[qCtx.R()]++
+					mu.Unlock()
+				}()
+				if i == 1 {
+					time.Sleep(time.Millisecond * 20) // let the first two queries take the slots
+				}
+			}
+			wg.Wait()
+			if got[limited] != tt.wantLimited || got[fallback] != tt.wantFallback || got[nil] != tt.wantNil {
+				t.Fatalf("unexpected result: limited %d, fallback %d, nil %d", got[limited], got[fallback], got[nil])
+			}
+		})
+	}
+}
@@ -30,6 +30,7 @@ import (
 
 type ParallelNode struct {
 	s       []ExecutableChainNode
+	accept  Matcher // nil if all responses are accepted
 	timeout time.Duration
 
 	logger *zap.Logger // not nil
@@ -39,8 +40,20 @@ const (
 	defaultParallelTimeout = time.Second * 5
 )
 
+// ParallelConfig runs sub-sequences concurrently on copies of the query.
+// The first accepted response is used, and the other sub-sequences are
+// cancelled.
 type ParallelConfig struct {
 	Parallel []interface{} `yaml:"parallel"`
+
+	// Accept is a condition expression (see expr.go). A response is
+	// accepted only if the query of its sub-sequence matches it.
+	// Empty accepts all responses.
+	Accept string `yaml:"accept"`
+
+	// Timeout of sub-sequences in milliseconds. Default is 5s, and it is
+	// limited by the deadline of the query.
+	Timeout int `yaml:"timeout"`
 }
 
 func ParseParallelNode(
@@ -61,10 +74,19 @@ func ParseParallelNode(
 		ps = append(ps, es)
 	}
 
-	return &ParallelNode{
-		s:      ps,
-		logger: logger,
-	}, nil
+	p := &ParallelNode{
+		s:       ps,
+		timeout: time.Duration(c.Timeout) * time.Millisecond,
+		logger:  logger,
+	}
+	if len(c.Accept) > 0 {
+		m, err := newConditionMatcher(logger.Named("accept"), c.Accept, matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid accept condition: %w", err)
+		}
+		p.accept = m
+	}
+	return p, nil
 }
 
 type parallelECSResult struct {
@@ -85,28 +107,21 @@ func (p *ParallelNode) exec(ctx context.Context, qCtx *query_context.Context) er
 		return nil
 	}
 
+	timeout := p.timeout
+	if timeout <= 0 {
+		timeout = defaultParallelTimeout
+	}
+	// Cancels the losers once exec returns.
+	pCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	t := len(p.s)
 	c := make(chan *parallelECSResult, len(p.s)) // use buf chan to avoid blocking.
-
 	for i, n := range p.s {
 		i := i
 		n := n
 		qCtxCopy := qCtx.Copy()
-
-		var pCtx context.Context
-		var cancel func()
-		if p.timeout > 0 {
-			pCtx, cancel = context.WithTimeout(context.Background(), p.timeout)
-		} else {
-			if ddl, ok := ctx.Deadline(); ok {
-				pCtx, cancel = context.WithDeadline(ctx, ddl)
-			}
-			pCtx, cancel = context.WithTimeout(ctx, defaultParallelTimeout)
-		}
-
 		go func() {
-			defer cancel()
-
 			err := ExecChainNode(pCtx, qCtxCopy, n)
 			c <- &parallelECSResult{
 				qCtx: qCtxCopy,
@@ -116,5 +131,6 @@ func (p *ParallelNode) exec(ctx context.Context, qCtx *query_context.Context) er
 		}()
 	}
 
-	return asyncWait(ctx, qCtx, p.logger, c, t)
+	_, err := asyncWait(pCtx, qCtx, p.logger, c, t, p.accept)
+	return err
 }
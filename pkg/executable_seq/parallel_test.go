@@ -26,6 +26,7 @@ import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"testing"
+	"time"
 )
 
 func Test_ParallelNode(t *testing.T) {
@@ -86,3 +87,62 @@ func Test_ParallelNode(t *testing.T) {
 		})
 	}
 }
+
+type rcodeMatcher int
+
+func (m rcodeMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	r := qCtx.RReadOnly()
+	return r != nil && r.Rcode == int(m), nil
+}
+
+// waitCancelExecutable waits until the ctx is cancelled.
+type waitCancelExecutable struct {
+	cancelled chan struct{}
+}
+
+func (e *waitCancelExecutable) Exec(ctx context.Context, _ *query_context.Context, _ ExecutableChainNode) error {
+	<-ctx.Done()
+	close(e.cancelled)
+	return ctx.Err()
+}
+
+func Test_ParallelNode_accept(t *testing.T) {
+	nx := new(dns.Msg)
+	nx.Rcode = dns.RcodeNameError
+	ok := new(dns.Msg)
+	slow := &waitCancelExecutable{cancelled: make(chan struct{})}
+	execs := map[string]Executable{
+		"nx":   &DummyExecutable{WantR: nx},
+		"ok":   &DummyExecutable{WantSleep: time.Millisecond * 50, WantR: ok},
+		"slow": slow,
+	}
+	matchers := map[string]Matcher{"noerror": rcodeMatcher(dns.RcodeSuccess)}
+
+	pc := &ParallelConfig{
+		Parallel: []interface{}{"nx", "ok", "slow"},
+		Accept:   "noerror",
+		Timeout:  5000,
+	}
+	parallelNode, err := ParseParallelNode(pc, zap.NewNop(), execs, matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qCtx := query_context.NewContext(new(dns.Msg), nil)
+	if err := ExecChainNode(context.Background(), qCtx, WrapExecutable(parallelNode)); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() != ok {
+		t.Fatal("the nxdomain response should not be accepted")
+	}
+	select {
+	case <-slow.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow sequence is not cancelled")
+	}
+
+	pc.Accept = "not_exist"
+	if _, err := ParseParallelNode(pc, zap.NewNop(), execs, matchers); err == nil {
+		t.Fatal("want invalid accept err")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"time"
+)
+
+const defaultProbeTimeout = time.Second * 5
+
+// ProbeReference executes qCtx and a reference query, which is a copy of
+// qCtx with qtype refQtype, by next in parallel. It reports whether the
+// reference response has refQtype records, which is accepted only before
+// the original query finishes or within waitTimeout after that.
+// If hasRef is false, qCtx holds the result of the original query and err
+// is its error. If hasRef is true, the original query is dropped and qCtx
+// is not modified.
+func ProbeReference(
+	ctx context.Context,
+	qCtx *query_context.Context,
+	next ExecutableChainNode,
+	refQtype uint16,
+	waitTimeout time.Duration,
+	logger *zap.Logger,
+) (hasRef bool, err error) {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultProbeTimeout)
+	}
+
+	// start reference goroutine
+	qCtxRef := qCtx.Copy()
+	qCtxRef.Q().Question[0].Qtype = refQtype
+	shouldBlock := make(chan struct{})
+	shouldPass := make(chan struct{})
+	go func() {
+		defer qCtxRef.Release()
+		ctxRef, cancelRef := context.WithDeadline(context.Background(), ddl)
+		defer cancelRef()
+		err := ExecChainNode(ctxRef, qCtxRef, next)
+		if err != nil {
+			logger.Warn("reference query routine err", qCtxRef.InfoField(), zap.Error(err))
+			close(shouldPass)
+			return
+		}
+		if r := qCtxRef.R(); r != nil && msgAnsHasRR(r, refQtype) {
+			close(shouldBlock)
+			return
+		}
+		close(shouldPass)
+	}()
+
+	// start original query goroutine
+	doneChan := make(chan error, 1)
+	qCtxSub := qCtx.Copy()
+	ctxSub, cancelSub := context.WithDeadline(context.Background(), ddl)
+	defer cancelSub()
+	go func() {
+		doneChan <- ExecChainNode(ctxSub, qCtxSub, next)
+	}()
+	// releaseSub releases qCtxSub once the original query is done.
+	releaseSub := func() {
+		go func() {
+			<-doneChan
+			qCtxSub.Release()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		releaseSub()
+		return false, ctx.Err()
+	case <-shouldBlock: // Reference indicates we should block this query before the original query finished.
+		releaseSub()
+		return true, nil
+	case err := <-doneChan: // The original query finished. Waiting for reference.
+		waitTimeoutTimer := pool.GetTimer(waitTimeout)
+		defer pool.ReleaseTimer(waitTimeoutTimer)
+		select {
+		case <-ctx.Done():
+			qCtxSub.Release()
+			return false, ctx.Err()
+		case <-shouldBlock:
+			qCtxSub.Release()
+			return true, nil
+		case <-shouldPass:
+		case <-waitTimeoutTimer.C:
+			// We have been waiting the reference query for too long.
+			// Something may go wrong. We accept the original reply.
+		}
+		*qCtx = *qCtxSub
+		return false, err
+	}
+}
+
+func msgAnsHasRR(m *dns.Msg, t uint16) bool {
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
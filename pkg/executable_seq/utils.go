@@ -22,6 +22,7 @@ package executable_seq
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -29,7 +30,11 @@ import (
 	"time"
 )
 
-func asyncWait(ctx context.Context, qCtx *query_context.Context, logger *zap.Logger, c chan *parallelECSResult, total int) error {
+// asyncWait waits for the first response from c and sets it to qCtx.
+// It returns the sequence id of the response.
+// If accept is not nil, responses of the queries that don't match it are
+// skipped.
+func asyncWait(ctx context.Context, qCtx *query_context.Context, logger *zap.Logger, c chan *parallelECSResult, total int, accept Matcher) (int, error) {
 	for i := 0; i < total; i++ {
 		select {
 		case res := <-c:
@@ -39,21 +44,28 @@ func asyncWait(ctx context.Context, qCtx *query_context.Context, logger *zap.Log
 			}
 
 			if r := res.qCtx.R(); r != nil {
+				if accept != nil {
+					ok, err := accept.Match(ctx, res.qCtx)
+					if err != nil || !ok {
+						logger.Debug("sequence response is not accepted", qCtx.InfoField(), zap.Int("sequence", res.from), zap.Error(err))
+						continue
+					}
+				}
 				logger.Debug("sequence returned a response", qCtx.InfoField(), zap.Int("sequence", res.from))
 				qCtx.SetResponse(r)
-				return nil
+				return res.from, nil
 			}
 
 			logger.Debug("sequence returned with an empty response", qCtx.InfoField(), zap.Int("sequence", res.from))
 			continue
 
 		case <-ctx.Done():
-			return ctx.Err()
+			return 0, ctx.Err()
 		}
 	}
 
 	// No response
-	return errors.New("no response")
+	return 0, errors.New("no response")
 }
 
 // LastNode returns the Latest node of chain of n.
@@ -68,10 +80,22 @@ func LastNode(n ExecutableChainNode) ExecutableChainNode {
 	}
 }
 
+// MaxExecSteps is the max number of nodes that a query, including its
+// copies, can execute. It stops the queries that are caught in loops
+// between sequences.
+const MaxExecSteps = 10000
+
+// ErrTooManyExecSteps is returned by ExecChainNode if the query has
+// executed more than MaxExecSteps nodes.
+var ErrTooManyExecSteps = fmt.Errorf("query executed more than %d nodes, sequences may have a loop", MaxExecSteps)
+
 func ExecChainNode(ctx context.Context, qCtx *query_context.Context, n ExecutableChainNode) error {
 	if n == nil {
 		return nil
 	}
+	if qCtx.AddExecStep() > MaxExecSteps {
+		return ErrTooManyExecSteps
+	}
 
 	// TODO: Error logging
 	return n.Exec(ctx, qCtx, n.Next())
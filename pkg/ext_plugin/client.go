@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ext_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync/atomic"
+	"time"
+)
+
+// ServiceName is the name of the Plugin service. It is used in health checks.
+const ServiceName = "mosdns.plugin.v1.Plugin"
+
+var ErrUnhealthy = errors.New("plugin is unhealthy")
+
+type ClientOpts struct {
+	// Addr is the gRPC target of the plugin, e.g. "127.0.0.1:5000"
+	// or "unix:///run/plugin.sock".
+	Addr string
+	TLS  bool
+
+	// Tag is sent to the plugin in every request.
+	Tag string
+
+	// Timeout is the deadline of each call. Default is 1s.
+	Timeout time.Duration
+}
+
+// Client is the host side adapter of an out-of-process plugin.
+type Client struct {
+	opts ClientOpts
+	conn *grpc.ClientConn
+	pc   PluginClient
+	hc   healthpb.HealthClient
+
+	unhealthy uint32
+}
+
+func NewClient(opts ClientOpts) (*Client, error) {
+	if len(opts.Addr) == 0 {
+		return nil, errors.New("missing addr")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second
+	}
+	creds := insecure.NewCredentials()
+	if opts.TLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(opts.Addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		opts: opts,
+		conn: conn,
+		pc:   NewPluginClient(conn),
+		hc:   healthpb.NewHealthClient(conn),
+	}, nil
+}
+
+// Exec calls the plugin and applies the changes to qCtx.
+// It returns true if the plugin wants to stop the execution.
+func (c *Client) Exec(ctx context.Context, qCtx *query_context.Context) (stop bool, err error) {
+	if !c.Healthy() {
+		return false, ErrUnhealthy
+	}
+	pqc, err := EncodeQueryContext(qCtx)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	resp, err := c.pc.Exec(ctx, &ExecRequest{Tag: c.opts.Tag, Qctx: pqc})
+	if err != nil {
+		return false, err
+	}
+	if err := ApplyExecResponse(qCtx, resp); err != nil {
+		return false, err
+	}
+	return resp.GetStop(), nil
+}
+
+// Match calls the plugin to match qCtx.
+func (c *Client) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	if !c.Healthy() {
+		return false, ErrUnhealthy
+	}
+	pqc, err := EncodeQueryContext(qCtx)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	resp, err := c.pc.Match(ctx, &MatchRequest{Tag: c.opts.Tag, Qctx: pqc})
+	if err != nil {
+		return false, err
+	}
+	return resp.GetMatched(), nil
+}
+
+// CheckHealth checks the health of the plugin with the standard gRPC
+// health service and updates the health status. The status of ServiceName
+// is checked, or the overall status of the server if the plugin does not
+// report it. Plugins that do not
+// implement the health service are considered healthy if they are
+// reachable.
+// Calls are rejected with ErrUnhealthy if the last check failed.
+func (c *Client) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	resp, err := c.hc.Check(ctx, &healthpb.HealthCheckRequest{Service: ServiceName})
+	if status.Code(err) == codes.NotFound {
+		// Fallback to the overall health of the server.
+		resp, err = c.hc.Check(ctx, &healthpb.HealthCheckRequest{})
+	}
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		err = nil
+	case err != nil:
+	case resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+		err = fmt.Errorf("plugin status is %s", resp.GetStatus())
+	}
+	if err != nil {
+		atomic.StoreUint32(&c.unhealthy, 1)
+		return err
+	}
+	atomic.StoreUint32(&c.unhealthy, 0)
+	return nil
+}
+
+// Healthy reports whether the last health check passed.
+func (c *Client) Healthy() bool {
+	return atomic.LoadUint32(&c.unhealthy) == 0
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// EncodeQueryContext serializes qCtx.
+func EncodeQueryContext(qCtx *query_context.Context) (*QueryContext, error) {
+	q, err := qCtx.Q().Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query, %w", err)
+	}
+	pqc := &QueryContext{
+		Id:     qCtx.Id(),
+		Query:  q,
+		Values: qCtx.Values(),
+	}
+	if r := qCtx.R(); r != nil {
+		if pqc.Response, err = r.Pack(); err != nil {
+			return nil, fmt.Errorf("failed to pack response, %w", err)
+		}
+	}
+	meta := qCtx.ReqMeta()
+	if meta.ClientAddr.IsValid() {
+		pqc.ClientIp = meta.ClientAddr.String()
+	}
+	pqc.ClientPort = uint32(meta.ClientPort)
+	pqc.Protocol = meta.Protocol
+	return pqc, nil
+}
+
+// ApplyExecResponse applies the changes in resp to qCtx.
+func ApplyExecResponse(qCtx *query_context.Context, resp *ExecResponse) error {
+	if b := resp.GetQuery(); len(b) > 0 {
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			return fmt.Errorf("invalid query from plugin, %w", err)
+		}
+		q.Id = qCtx.Q().Id
+		*qCtx.Q() = *q
+	}
+	if b := resp.GetResponse(); len(b) > 0 {
+		r := new(dns.Msg)
+		if err := r.Unpack(b); err != nil {
+			return fmt.Errorf("invalid response from plugin, %w", err)
+		}
+		r.Id = qCtx.Q().Id
+		qCtx.SetResponse(r)
+	} else if resp.GetDropResponse() {
+		qCtx.SetResponse(nil)
+	}
+	for k, v := range resp.GetSetValues() {
+		qCtx.SetValue(k, v)
+	}
+	for _, k := range resp.GetDeleteValues() {
+		qCtx.DeleteValue(k)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ext_plugin
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"testing"
+	"time"
+)
+
+type testPlugin struct {
+	UnimplementedPluginServer
+}
+
+func (testPlugin) Exec(_ context.Context, req *ExecRequest) (*ExecResponse, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(req.GetQctx().GetQuery()); err != nil {
+		return nil, err
+	}
+	if q.Question[0].Name != "blocked.example." {
+		return &ExecResponse{SetValues: map[string]string{"seen_by": req.GetTag()}}, nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeRefused)
+	b, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &ExecResponse{Response: b, Stop: true, DeleteValues: []string{"k"}}, nil
+}
+
+func (testPlugin) Match(_ context.Context, req *MatchRequest) (*MatchResponse, error) {
+	return &MatchResponse{Matched: req.GetQctx().GetValues()["k"] == "v"}, nil
+}
+
+func newQCtx(name string) *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	qCtx.SetValue("k", "v")
+	return qCtx
+}
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	RegisterPluginServer(s, testPlugin{})
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(l)
+	defer s.Stop()
+
+	c, err := NewClient(ClientOpts{Addr: l.Addr().String(), Tag: "p", Timeout: time.Second * 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	qCtx := newQCtx("blocked.example.")
+	stop, err := c.Exec(ctx, qCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); !stop || r == nil || r.Rcode != dns.RcodeRefused || r.Id != qCtx.Q().Id {
+		t.Fatalf("unexpected result, stop: %v, response: %v", stop, r)
+	}
+	if _, ok := qCtx.GetValue("k"); ok {
+		t.Fatal("value should be deleted")
+	}
+
+	qCtx = newQCtx("a.example.")
+	stop, err = c.Exec(ctx, qCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := qCtx.GetValue("seen_by"); stop || qCtx.R() != nil || v != "p" {
+		t.Fatalf("unexpected result, stop: %v, value: %s", stop, v)
+	}
+
+	matched, err := c.Match(ctx, newQCtx("a.example."))
+	if err != nil || !matched {
+		t.Fatalf("want matched, got %v, %v", matched, err)
+	}
+
+	if err := c.CheckHealth(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hs.SetServingStatus(ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := c.CheckHealth(ctx); err == nil {
+		t.Fatal("want health check err")
+	}
+	if _, err := c.Exec(ctx, newQCtx("a.example.")); !errors.Is(err, ErrUnhealthy) {
+		t.Fatalf("want ErrUnhealthy, got %v", err)
+	}
+}
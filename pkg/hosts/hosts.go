@@ -31,6 +31,7 @@ import (
 
 type Hosts struct {
 	matcher domain.Matcher[*IPs]
+	https   domain.Matcher[*dns.HTTPS] // maybe nil
 }
 
 // NewHosts creates a hosts using m.
@@ -40,6 +41,11 @@ func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	}
 }
 
+// SetHTTPS sets the matcher of HTTPS records. See ParseHTTPS.
+func (h *Hosts) SetHTTPS(m domain.Matcher[*dns.HTTPS]) {
+	h.https = m
+}
+
 func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	ips, ok := h.matcher.Match(fqdn)
 	if !ok {
@@ -55,7 +61,13 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	if q.Qclass != dns.ClassINET || (typ != dns.TypeA && typ != dns.TypeAAAA) {
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if typ == dns.TypeHTTPS {
+		return h.lookupHTTPS(m)
+	}
+	if typ != dns.TypeA && typ != dns.TypeAAAA {
 		return nil
 	}
 
@@ -103,6 +115,29 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	return r
 }
 
+func (h *Hosts) lookupHTTPS(m *dns.Msg) *dns.Msg {
+	if h.https == nil {
+		return nil
+	}
+	fqdn := m.Question[0].Name
+	rr, ok := h.https.Match(fqdn)
+	if !ok {
+		return nil
+	}
+	rr = dns.Copy(rr).(*dns.HTTPS)
+	rr.Hdr = dns.RR_Header{
+		Name:   fqdn,
+		Rrtype: dns.TypeHTTPS,
+		Class:  dns.ClassINET,
+		Ttl:    10,
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.RecursionAvailable = true
+	r.Answer = []dns.RR{rr}
+	return r
+}
+
 type IPs struct {
 	IPv4 []netip.Addr
 	IPv6 []netip.Addr
@@ -133,3 +168,20 @@ func ParseIPs(s string) (string, *IPs, error) {
 
 	return pattern, v, nil
 }
+
+var _ domain.ParseStringFunc[*dns.HTTPS] = ParseHTTPS
+
+// ParseHTTPS parses a "pattern rdata" line, e.g.
+// "example.com 1 . alpn=h2,h3 ipv4hint=192.168.1.1", where rdata is the
+// presentation format of a HTTPS record.
+func ParseHTTPS(s string) (string, *dns.HTTPS, error) {
+	f := strings.Fields(s)
+	if len(f) < 3 {
+		return "", nil, errors.New("https record must have at least 3 fields")
+	}
+	rr, err := dns.NewRR(". 0 IN HTTPS " + strings.Join(f[1:], " "))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid https record, %w", err)
+	}
+	return f[0], rr.(*dns.HTTPS), nil
+}
@@ -103,3 +103,34 @@ func Test_hostsContainer_Match(t *testing.T) {
 		})
 	}
 }
+
+func Test_hosts_LookupHTTPS(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	h := NewHosts(m)
+	hm := domain.NewMixMatcher[*dns.HTTPS]()
+	hm.SetDefaultMatcher(domain.MatcherFull)
+	err := domain.LoadFromTextReader[*dns.HTTPS](hm, bytes.NewBufferString("nas.lan 1 . alpn=h2 ipv4hint=192.168.1.2\n"), ParseHTTPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetHTTPS(hm)
+
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeHTTPS)
+	r := h.LookupMsg(q)
+	if r == nil || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if want := "nas.lan.\t10\tIN\tHTTPS\t1 . alpn=\"h2\" ipv4hint=\"192.168.1.2\""; r.Answer[0].String() != want {
+		t.Fatalf("want %s, got %s", want, r.Answer[0])
+	}
+
+	q.SetQuestion("other.lan.", dns.TypeHTTPS)
+	if r := h.LookupMsg(q); r != nil {
+		t.Fatal("unexpected response")
+	}
+	if _, _, err := ParseHTTPS("nas.lan 1"); err == nil {
+		t.Fatal("ParseHTTPS should fail")
+	}
+}
@@ -0,0 +1,218 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlink_utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	HdrLen   = 16 // sizeof(struct nlmsghdr)
+	errnoLen = 4  // the errno of struct nlmsgerr
+
+	recvBufSize = 64 * 1024
+)
+
+// NativeEndian is the byte order of netlink messages.
+var NativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// NewMsg returns a netlink message of typ and flags with a zero body of
+// bodyLen bytes. The length and sequence number are set by Conn.
+func NewMsg(typ uint16, flags uint16, bodyLen int) []byte {
+	b := make([]byte, HdrLen+bodyLen)
+	NativeEndian.PutUint16(b[4:6], typ)
+	NativeEndian.PutUint16(b[6:8], syscall.NLM_F_REQUEST|flags)
+	return b
+}
+
+// AppendAttr appends a rtattr of typ and data to b.
+func AppendAttr(b []byte, typ uint16, data []byte) []byte {
+	l := 4 + len(data)
+	attr := make([]byte, (l+3)&^3) // rtattrs are aligned to 4 bytes.
+	NativeEndian.PutUint16(attr[0:2], uint16(l))
+	NativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[4:], data)
+	return append(b, attr...)
+}
+
+// ParseAttrs parses the rtattrs in b. Malformed trailing data is ignored.
+func ParseAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var attrs []syscall.NetlinkRouteAttr
+	for len(b) >= 4 {
+		l := int(NativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			break
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{
+			Attr:  syscall.RtAttr{Len: uint16(l), Type: NativeEndian.Uint16(b[2:4])},
+			Value: b[4:l],
+		})
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
+
+// Uint32Bytes returns v in NativeEndian.
+func Uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	NativeEndian.PutUint32(b, v)
+	return b
+}
+
+// Conn is a NETLINK_ROUTE socket. It is not safe for concurrent use.
+type Conn struct {
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+// Dial opens a Conn. Sends and receives fail if they take longer than
+// timeout. Zero timeout means no timeout.
+func Dial(timeout time.Duration) (*Conn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket, %w", err)
+	}
+	if timeout > 0 {
+		tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+		for _, opt := range [...]int{syscall.SO_RCVTIMEO, syscall.SO_SNDTIMEO} {
+			if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, opt, &tv); err != nil {
+				syscall.Close(fd)
+				return nil, fmt.Errorf("failed to set netlink socket timeout, %w", err)
+			}
+		}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket, %w", err)
+	}
+	return &Conn{fd: fd, buf: make([]byte, recvBufSize)}, nil
+}
+
+func (c *Conn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// Execute sends msg with NLM_F_ACK and waits for its ack. The kernel
+// error of the ack is returned as a syscall.Errno.
+func (c *Conn) Execute(msg []byte) error {
+	NativeEndian.PutUint16(msg[6:8], NativeEndian.Uint16(msg[6:8])|syscall.NLM_F_ACK)
+	seq, err := c.send(msg)
+	if err != nil {
+		return err
+	}
+	for {
+		msgs, err := c.recv()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			return parseErrno(m)
+		}
+	}
+}
+
+// Dump sends msg with NLM_F_DUMP and returns the replied messages.
+func (c *Conn) Dump(msg []byte) ([]syscall.NetlinkMessage, error) {
+	NativeEndian.PutUint16(msg[6:8], NativeEndian.Uint16(msg[6:8])|syscall.NLM_F_DUMP)
+	seq, err := c.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	var res []syscall.NetlinkMessage
+	for {
+		msgs, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return res, nil
+			case syscall.NLMSG_ERROR:
+				if err := parseErrno(m); err != nil {
+					return nil, err
+				}
+			default:
+				// m.Data is in c.buf, which is reused by the next recv.
+				m.Data = append([]byte(nil), m.Data...)
+				res = append(res, m)
+			}
+		}
+	}
+}
+
+func (c *Conn) send(msg []byte) (uint32, error) {
+	c.seq++
+	NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	NativeEndian.PutUint32(msg[8:12], c.seq)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return 0, fmt.Errorf("failed to send netlink message, %w", err)
+	}
+	return c.seq, nil
+}
+
+func (c *Conn) recv() ([]syscall.NetlinkMessage, error) {
+	n, _, err := syscall.Recvfrom(c.fd, c.buf, 0)
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return nil, errors.New("netlink socket timed out")
+		}
+		return nil, fmt.Errorf("failed to read netlink message, %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(c.buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netlink message, %w", err)
+	}
+	return msgs, nil
+}
+
+func parseErrno(m syscall.NetlinkMessage) error {
+	if len(m.Data) < errnoLen {
+		return errors.New("invalid netlink error message")
+	}
+	if errno := int32(NativeEndian.Uint32(m.Data[:errnoLen])); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
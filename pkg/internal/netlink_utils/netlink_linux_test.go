@@ -0,0 +1,67 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlink_utils
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseAttrs(t *testing.T) {
+	var b []byte
+	b = AppendAttr(b, 1, []byte{1, 2, 3})
+	b = AppendAttr(b, 2, Uint32Bytes(7))
+	b = append(b, 0xff) // malformed trailing data
+	attrs := ParseAttrs(b)
+	if len(attrs) != 2 {
+		t.Fatalf("want 2 attrs, got %d", len(attrs))
+	}
+	if a := attrs[0]; a.Attr.Type != 1 || string(a.Value) != "\x01\x02\x03" {
+		t.Fatalf("unexpected attr %+v", a)
+	}
+	if a := attrs[1]; a.Attr.Type != 2 || NativeEndian.Uint32(a.Value) != 7 {
+		t.Fatalf("unexpected attr %+v", a)
+	}
+}
+
+func TestConn_Dump(t *testing.T) {
+	c, err := Dial(time.Second)
+	if err != nil {
+		t.Skipf("netlink is not available, %v", err)
+	}
+	defer c.Close()
+
+	// The loopback interface always exists.
+	msgs, err := c.Dump(NewMsg(syscall.RTM_GETLINK, 0, syscall.SizeofIfInfomsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 0 {
+		t.Fatal("empty link dump")
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWLINK {
+			t.Fatalf("unexpected msg type %d", m.Header.Type)
+		}
+	}
+}
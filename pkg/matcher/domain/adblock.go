@@ -0,0 +1,340 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// AdblockRule is a DNS rule of the AdBlock/AdGuard filter syntax.
+type AdblockRule struct {
+	Type      string // MatcherFull, MatcherDomain, MatcherRegexp or MatcherKeyword.
+	Pattern   string
+	Exception bool // "@@" rule.
+	Important bool // "$important" modifier.
+}
+
+// ParseAdblockRule parses a trimmed, non-comment line of a filter list.
+// It returns false if the rule is not a DNS blocking rule or it has
+// unsupported modifiers.
+// Supported syntax:
+//
+//	||example.com^   example.com and its subdomains.
+//	|example.com^    example.com only.
+//	/regexp/         regexp.
+//	example          keyword.
+//	0.0.0.0 example.com   hosts style, example.com only.
+//	@@rule           exception.
+//	rule$important   important rule.
+//
+// Patterns with "*" wildcards are converted to regexp.
+func ParseAdblockRule(s string) (*AdblockRule, bool) {
+	r := new(AdblockRule)
+	if strings.HasPrefix(s, "@@") {
+		r.Exception = true
+		s = s[2:]
+	}
+
+	// Cosmetic rules.
+	if strings.Contains(s, "##") || strings.Contains(s, "#@#") || strings.Contains(s, "#?#") || strings.Contains(s, "#$#") {
+		return nil, false
+	}
+
+	// Regexp rules may contain "$", so modifiers are parsed after them.
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		r.Type, r.Pattern = MatcherRegexp, s[1:len(s)-1]
+		return r, isValidRegexp(r.Pattern)
+	}
+
+	if i := strings.LastIndexByte(s, '$'); i >= 0 {
+		for _, m := range strings.Split(s[i+1:], ",") {
+			if m != "important" {
+				return nil, false
+			}
+			r.Important = true
+		}
+		s = s[:i]
+	}
+
+	// Hosts style rule.
+	if f := strings.Fields(s); len(f) == 2 {
+		if _, err := netip.ParseAddr(f[0]); err == nil && isPlainAdblockDomain(f[1]) && !isLocalHostsName(f[1]) {
+			r.Type, r.Pattern = MatcherFull, strings.ToLower(f[1])
+			return r, true
+		}
+		return nil, false
+	}
+
+	var prefix string
+	switch {
+	case strings.HasPrefix(s, "||"):
+		prefix, s = "||", s[2:]
+	case strings.HasPrefix(s, "|"):
+		prefix, s = "|", s[1:]
+	}
+	suffix := ""
+	switch {
+	case strings.HasSuffix(s, "^|"):
+		suffix, s = "^", s[:len(s)-2]
+	case strings.HasSuffix(s, "^"), strings.HasSuffix(s, "|"):
+		suffix, s = s[len(s)-1:], s[:len(s)-1]
+	}
+	if len(s) == 0 {
+		return nil, false
+	}
+
+	if isPlainAdblockDomain(s) {
+		switch {
+		case prefix == "||" && len(suffix) > 0:
+			r.Type = MatcherDomain
+		case prefix == "|" && len(suffix) > 0:
+			r.Type = MatcherFull
+		case len(prefix) == 0 && len(suffix) == 0:
+			r.Type = MatcherKeyword
+		}
+		if len(r.Type) > 0 {
+			r.Pattern = strings.ToLower(s)
+			return r, true
+		}
+	}
+
+	// Convert to regexp.
+	if strings.Trim(s, "*") == "" || !isAdblockWildcardPattern(s) {
+		return nil, false
+	}
+	b := new(strings.Builder)
+	switch prefix {
+	case "||":
+		b.WriteString(`(^|\.)`)
+	case "|":
+		b.WriteString("^")
+	}
+	for i, p := range strings.Split(strings.ToLower(s), "*") {
+		if i > 0 {
+			b.WriteString(".*")
+		}
+		b.WriteString(regexp.QuoteMeta(p))
+	}
+	if len(suffix) > 0 {
+		b.WriteString("$")
+	}
+	r.Type, r.Pattern = MatcherRegexp, b.String()
+	return r, true
+}
+
+func isValidRegexp(s string) bool {
+	_, err := regexp.Compile(s)
+	return err == nil
+}
+
+func isPlainAdblockDomain(s string) bool {
+	return len(s) > 0 && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_") == ""
+}
+
+// isLocalHostsName reports whether s is one of the local entries
+// that hosts files usually have at the beginning.
+func isLocalHostsName(s string) bool {
+	switch strings.ToLower(s) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "0.0.0.0":
+		return true
+	}
+	return strings.HasPrefix(s, "ip6-")
+}
+
+func isAdblockWildcardPattern(s string) bool {
+	return strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_*") == ""
+}
+
+// AdblockMatcher matches domains with the AdBlock filter rules.
+// A domain is matched if it is blocked by a rule and is not
+// excepted by an exception rule. Important rules take precedence
+// over normal rules.
+type AdblockMatcher struct {
+	block, allow                   *MixMatcher[struct{}]
+	importantBlock, importantAllow *MixMatcher[struct{}]
+}
+
+func NewAdblockMatcher() *AdblockMatcher {
+	return &AdblockMatcher{
+		block:          NewMixMatcher[struct{}](),
+		allow:          NewMixMatcher[struct{}](),
+		importantBlock: NewMixMatcher[struct{}](),
+		importantAllow: NewMixMatcher[struct{}](),
+	}
+}
+
+// Add adds a rule to m.
+func (m *AdblockMatcher) Add(r *AdblockRule) error {
+	var mm *MixMatcher[struct{}]
+	switch {
+	case r.Exception && r.Important:
+		mm = m.importantAllow
+	case r.Exception:
+		mm = m.allow
+	case r.Important:
+		mm = m.importantBlock
+	default:
+		mm = m.block
+	}
+	sm := mm.GetSubMatcher(r.Type)
+	if sm == nil {
+		return fmt.Errorf("unsupported match type [%s]", r.Type)
+	}
+	return sm.Add(r.Pattern, struct{}{})
+}
+
+func (m *AdblockMatcher) Match(s string) (v struct{}, ok bool) {
+	return v, matchAdblock(s, m)
+}
+
+// matchAdblock matches s with the rules of ms as if they were one list.
+// Nil matchers are skipped.
+func matchAdblock(s string, ms ...*AdblockMatcher) bool {
+	stages := [...]struct {
+		get   func(m *AdblockMatcher) *MixMatcher[struct{}]
+		block bool
+	}{
+		{func(m *AdblockMatcher) *MixMatcher[struct{}] { return m.importantAllow }, false},
+		{func(m *AdblockMatcher) *MixMatcher[struct{}] { return m.importantBlock }, true},
+		{func(m *AdblockMatcher) *MixMatcher[struct{}] { return m.allow }, false},
+		{func(m *AdblockMatcher) *MixMatcher[struct{}] { return m.block }, true},
+	}
+	for _, st := range stages {
+		for _, m := range ms {
+			if m == nil {
+				continue
+			}
+			if _, ok := st.get(m).Match(s); ok {
+				return st.block
+			}
+		}
+	}
+	return false
+}
+
+// Len returns the number of blocking rules.
+func (m *AdblockMatcher) Len() int {
+	return m.block.Len() + m.importantBlock.Len()
+}
+
+// ParseAdblockFile parses a filter list. Unsupported rules are skipped.
+func ParseAdblockFile(in []byte) (*AdblockMatcher, error) {
+	return parseAdblockFile(in, false)
+}
+
+// ParseAdblockAllowFile parses an allowlist. All its rules, with or
+// without "@@", are important exceptions, like the allowlists of
+// AdGuard Home.
+func ParseAdblockAllowFile(in []byte) (*AdblockMatcher, error) {
+	return parseAdblockFile(in, true)
+}
+
+func parseAdblockFile(in []byte, allow bool) (*AdblockMatcher, error) {
+	m := NewAdblockMatcher()
+	lineCounter := 0
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	for scanner.Scan() {
+		lineCounter++
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || s[0] == '!' || s[0] == '[' || s[0] == '#' {
+			continue
+		}
+		s = strings.TrimSpace(utils.RemoveComment(s, " #"))
+		r, ok := ParseAdblockRule(s)
+		if !ok {
+			continue
+		}
+		if allow {
+			r.Exception, r.Important = true, true
+		}
+		if err := m.Add(r); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineCounter, err)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// AdblockGroup matches domains with several filter lists as if they
+// were one list, so the exception rules of a list also apply to the
+// rules of other lists. It is safe for concurrent use.
+type AdblockGroup struct {
+	mu sync.RWMutex
+	ms []*AdblockMatcher
+}
+
+// AddList adds a list to g and returns its listener. The list is empty
+// until the listener is updated. If allow is true, the list is parsed
+// by ParseAdblockAllowFile.
+func (g *AdblockGroup) AddList(allow bool) *AdblockList {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ms = append(g.ms, nil)
+	return &AdblockList{g: g, i: len(g.ms) - 1, allow: allow}
+}
+
+func (g *AdblockGroup) Match(s string) (v struct{}, ok bool) {
+	g.mu.RLock()
+	ms := g.ms
+	g.mu.RUnlock()
+	return v, matchAdblock(s, ms...)
+}
+
+// Len returns the number of blocking rules.
+func (g *AdblockGroup) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	n := 0
+	for _, m := range g.ms {
+		if m != nil {
+			n += m.Len()
+		}
+	}
+	return n
+}
+
+// AdblockList is a list of an AdblockGroup. It implements
+// data_provider.DataListener.
+type AdblockList struct {
+	g     *AdblockGroup
+	i     int
+	allow bool
+}
+
+func (l *AdblockList) Update(b []byte) error {
+	m, err := parseAdblockFile(b, l.allow)
+	if err != nil {
+		return err
+	}
+	l.g.mu.Lock()
+	defer l.g.mu.Unlock()
+	// Copies the slice, so Match can read it without the lock.
+	ms := make([]*AdblockMatcher, len(l.g.ms))
+	copy(ms, l.g.ms)
+	ms[l.i] = m
+	l.g.ms = ms
+	return nil
+}
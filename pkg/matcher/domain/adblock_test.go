@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAdblockRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		want   *AdblockRule
+		wantOk bool
+	}{
+		{"domain", "||example.com^", &AdblockRule{Type: MatcherDomain, Pattern: "example.com"}, true},
+		{"full", "|example.com^", &AdblockRule{Type: MatcherFull, Pattern: "example.com"}, true},
+		{"keyword", "example", &AdblockRule{Type: MatcherKeyword, Pattern: "example"}, true},
+		{"regexp", "/^ad[0-9]+\\./", &AdblockRule{Type: MatcherRegexp, Pattern: "^ad[0-9]+\\."}, true},
+		{"hosts", "0.0.0.0 Example.com", &AdblockRule{Type: MatcherFull, Pattern: "example.com"}, true},
+		{"hosts localhost", "127.0.0.1 localhost", nil, false},
+		{"exception", "@@||example.com^", &AdblockRule{Type: MatcherDomain, Pattern: "example.com", Exception: true}, true},
+		{"important", "||example.com^$important", &AdblockRule{Type: MatcherDomain, Pattern: "example.com", Important: true}, true},
+		{"wildcard", "||ad*.example.com^", &AdblockRule{Type: MatcherRegexp, Pattern: `(^|\.)ad.*\.example\.com$`}, true},
+		{"unsupported modifier", "||example.com^$client=127.0.0.1", nil, false},
+		{"cosmetic", "example.com##.ad", nil, false},
+		{"url", "||example.com/ads/*", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseAdblockRule(tt.s)
+			if ok != tt.wantOk {
+				t.Fatalf("ParseAdblockRule() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAdblockRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAdblockFile(t *testing.T) {
+	list := `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+@@||good.ads.example.com^
+||tracker.com^$important
+@@||tracker.com^
+@@||safe.tracker.com^$important
+0.0.0.0 hosts.example.org # comment
+`
+	m, err := ParseAdblockFile([]byte(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"ads.example.com.", true},
+		{"x.ads.example.com", true},
+		{"good.ads.example.com", false},
+		{"example.com", false},
+		{"tracker.com", true},
+		{"safe.tracker.com", false},
+		{"hosts.example.org", true},
+		{"sub.hosts.example.org", false},
+	}
+	for _, tt := range tests {
+		if _, ok := m.Match(tt.domain); ok != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, ok, tt.want)
+		}
+	}
+}
+
+func TestAdblockGroup(t *testing.T) {
+	g := new(AdblockGroup)
+	lists := []struct {
+		allow bool
+		data  string
+	}{
+		{false, "||ads.example.com^\n||tracker.com^$important\n"},
+		{false, "@@||good.ads.example.com^\n@@||tracker.com^\n"},
+		{true, "||allowed.ads.example.com^\n@@||safe.tracker.com^\n"},
+	}
+	for _, l := range lists {
+		if err := g.AddList(l.allow).Update([]byte(l.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"ads.example.com", true},
+		{"good.ads.example.com", false},
+		{"allowed.ads.example.com", false},
+		{"tracker.com", true},
+		{"safe.tracker.com", false},
+	}
+	for _, tt := range tests {
+		if _, ok := g.Match(tt.domain); ok != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, ok, tt.want)
+		}
+	}
+}
@@ -146,6 +146,17 @@ func BatchLoadProvider[T any](
 }
 
 // BatchLoadDomainProvider loads multiple domain entries.
+// Entries can be
+//
+//	"provider:tag"              text domain list from a data provider.
+//	"provider:tag:v2suffix"     v2ray domain data from a data provider.
+//	"adblock:tag"               AdBlock filter list from a data provider.
+//	"adblock_allow:tag"         AdBlock allowlist from a data provider.
+//	other                       a domain pattern.
+//
+// All the AdBlock lists of e are matched as one list, so exception rules
+// and allowlists apply to the rules of all the lists.
+//
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
 func BatchLoadDomainProvider(
@@ -155,14 +166,12 @@ func BatchLoadDomainProvider(
 	mg := new(MatcherGroup[struct{}])
 	staticMatcher := NewDomainMixMatcher()
 	mg.Append(staticMatcher)
+	var adblockGroup *AdblockGroup
 	for _, s := range e {
-		if strings.HasPrefix(s, "provider:") {
+		switch {
+		case strings.HasPrefix(s, "provider:"):
 			providerTag := strings.TrimPrefix(s, "provider:")
 			providerTag, v2suffix, _ := strings.Cut(providerTag, ":")
-			provider := dm.GetDataProvider(providerTag)
-			if provider == nil {
-				return nil, fmt.Errorf("cannot find provider %s", providerTag)
-			}
 			var parseFunc func(b []byte) (Matcher[struct{}], error)
 			if len(v2suffix) > 0 {
 				parseFunc = func(b []byte) (Matcher[struct{}], error) {
@@ -173,15 +182,27 @@ func BatchLoadDomainProvider(
 					return ParseTextDomainFile(b)
 				}
 			}
-			m := NewDynamicMatcher[struct{}](parseFunc)
-			if err := provider.LoadAndAddListener(m); err != nil {
+			if err := loadDynamicMatcher(mg, providerTag, dm, parseFunc); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(s, "adblock:"), strings.HasPrefix(s, "adblock_allow:"):
+			kind, providerTag, _ := strings.Cut(s, ":")
+			if adblockGroup == nil {
+				adblockGroup = new(AdblockGroup)
+				mg.Append(adblockGroup)
+			}
+			provider := dm.GetDataProvider(providerTag)
+			if provider == nil {
+				return nil, fmt.Errorf("cannot find provider %s", providerTag)
+			}
+			l := adblockGroup.AddList(kind == "adblock_allow")
+			if err := provider.LoadAndAddListener(l); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
 			}
-			mg.Append(m)
 			mg.AppendCloser(func() {
-				provider.DeleteListener(m)
+				provider.DeleteListener(l)
 			})
-		} else {
+		default:
 			err := Load[struct{}](staticMatcher, s, nil)
 			if err != nil {
 				return nil, fmt.Errorf("failed to load data %s: %w", s, err)
@@ -191,6 +212,29 @@ func BatchLoadDomainProvider(
 	return mg, nil
 }
 
+// loadDynamicMatcher appends a DynamicMatcher that listens to the
+// provider to mg.
+func loadDynamicMatcher(
+	mg *MatcherGroup[struct{}],
+	providerTag string,
+	dm *data_provider.DataManager,
+	parseFunc func(b []byte) (Matcher[struct{}], error),
+) error {
+	provider := dm.GetDataProvider(providerTag)
+	if provider == nil {
+		return fmt.Errorf("cannot find provider %s", providerTag)
+	}
+	m := NewDynamicMatcher[struct{}](parseFunc)
+	if err := provider.LoadAndAddListener(m); err != nil {
+		return fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
+	}
+	mg.Append(m)
+	mg.AppendCloser(func() {
+		provider.DeleteListener(m)
+	})
+	return nil
+}
+
 type DynamicMatcher[T any] struct {
 	parserFunc func(b []byte) (Matcher[T], error)
 	l          sync.RWMutex
@@ -46,6 +46,23 @@ func (m *ClientIPMatcher) Match(_ context.Context, qCtx *query_context.Context)
 	return m.ipMatcher.Match(clientAddr)
 }
 
+// ServerIPMatcher matches the local address that received the query.
+type ServerIPMatcher struct {
+	ipMatcher netlist.Matcher
+}
+
+func NewServerIPMatcher(ipMatcher netlist.Matcher) *ServerIPMatcher {
+	return &ServerIPMatcher{ipMatcher: ipMatcher}
+}
+
+func (m *ServerIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	serverAddr := qCtx.ReqMeta().ServerAddr
+	if !serverAddr.IsValid() {
+		return false, nil
+	}
+	return m.ipMatcher.Match(serverAddr)
+}
+
 type ClientECSMatcher struct {
 	ipMatcher netlist.Matcher
 }
@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// ip2asn TSV format, see https://iptoasn.com/.
+// range_start	range_end	AS_number	country_code	AS_description
+
+// IsIP2ASN reports whether b looks like an ip2asn TSV file. The file
+// can be gzip compressed.
+func IsIP2ASN(b []byte) bool {
+	if isGzip(b) {
+		return true // checked by ParseIP2ASN
+	}
+	line := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line = b[:i]
+	}
+	f := strings.Split(strings.TrimSpace(string(line)), "\t")
+	if len(f) < 3 {
+		return false
+	}
+	_, err := netip.ParseAddr(f[0])
+	return err == nil
+}
+
+func isGzip(b []byte) bool {
+	return len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// ParseIP2ASN builds a List from an ip2asn TSV file.
+// The format of args is "asn1,asn2,...", e.g. "13335,as15169".
+func ParseIP2ASN(b []byte, args string) (*List, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if isGzip(b) {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	asns := parseASNs(args)
+	if len(asns) == 0 {
+		return nil, fmt.Errorf("no asn is specified")
+	}
+
+	l := NewList()
+	scanner := bufio.NewScanner(r)
+	lineCounter := 0
+	for scanner.Scan() {
+		lineCounter++
+		f := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(f) < 3 {
+			continue
+		}
+		if _, ok := asns[f[2]]; !ok {
+			continue
+		}
+		start, err := netip.ParseAddr(f[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid data at line #%d: %w", lineCounter, err)
+		}
+		end, err := netip.ParseAddr(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid data at line #%d: %w", lineCounter, err)
+		}
+		prefixes, err := rangeToPrefixes(start, end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data at line #%d: %w", lineCounter, err)
+		}
+		l.Append(prefixes...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	l.Sort()
+	return l, nil
+}
+
+// parseASNs parses "asn1,asn2,...". The "as" prefix is optional.
+func parseASNs(args string) map[string]struct{} {
+	m := make(map[string]struct{})
+	for _, s := range strings.Split(args, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		s = strings.TrimPrefix(s, "as")
+		if len(s) > 0 {
+			m[s] = struct{}{}
+		}
+	}
+	return m
+}
+
+// rangeToPrefixes returns the minimal prefixes that cover [start, end].
+func rangeToPrefixes(start, end netip.Addr) ([]netip.Prefix, error) {
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return nil, fmt.Errorf("invalid range %s-%s", start, end)
+	}
+	bitLen := start.BitLen()
+	s, e := addrToU128(start), addrToU128(end)
+	var out []netip.Prefix
+	for {
+		// The largest block that starts at s and does not exceed e.
+		size := s.trailingZeros(bitLen)
+		for size > 0 && s.add(u128{}.setBit(size).sub1()).greater(e) {
+			size--
+		}
+		out = append(out, netip.PrefixFrom(u128ToAddr(s, bitLen), bitLen-size))
+		last := s.add(u128{}.setBit(size).sub1())
+		if !e.greater(last) {
+			return out, nil
+		}
+		s = last.add(u128{lo: 1})
+	}
+}
+
+type u128 struct{ hi, lo uint64 }
+
+func addrToU128(a netip.Addr) u128 {
+	if a.Is4() {
+		b := a.As4()
+		return u128{lo: uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])}
+	}
+	b := a.As16()
+	var u u128
+	for i := 0; i < 8; i++ {
+		u.hi = u.hi<<8 | uint64(b[i])
+		u.lo = u.lo<<8 | uint64(b[i+8])
+	}
+	return u
+}
+
+func u128ToAddr(u u128, bitLen int) netip.Addr {
+	if bitLen == 32 {
+		return netip.AddrFrom4([4]byte{byte(u.lo >> 24), byte(u.lo >> 16), byte(u.lo >> 8), byte(u.lo)})
+	}
+	var b [16]byte
+	for i := 0; i < 8; i++ {
+		b[7-i] = byte(u.hi >> (8 * i))
+		b[15-i] = byte(u.lo >> (8 * i))
+	}
+	return netip.AddrFrom16(b)
+}
+
+func (u u128) trailingZeros(max int) int {
+	var n int
+	if u.lo != 0 {
+		n = bits.TrailingZeros64(u.lo)
+	} else if u.hi != 0 {
+		n = 64 + bits.TrailingZeros64(u.hi)
+	} else {
+		n = 128
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+func (u u128) setBit(n int) u128 {
+	switch {
+	case n >= 128:
+		return u128{} // overflow, only used as 1<<128 - 1 below
+	case n >= 64:
+		u.hi |= 1 << (n - 64)
+	default:
+		u.lo |= 1 << n
+	}
+	return u
+}
+
+func (u u128) sub1() u128 {
+	if u.lo == 0 {
+		return u128{hi: u.hi - 1, lo: ^uint64(0)}
+	}
+	return u128{hi: u.hi, lo: u.lo - 1}
+}
+
+func (u u128) add(v u128) u128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	hi, _ := bits.Add64(u.hi, v.hi, carry)
+	return u128{hi: hi, lo: lo}
+}
+
+func (u u128) greater(v u128) bool {
+	return u.hi > v.hi || u.hi == v.hi && u.lo > v.lo
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func Test_rangeToPrefixes(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       []string
+		wantErr    bool
+	}{
+		{"1.0.0.0", "1.0.0.255", []string{"1.0.0.0/24"}, false},
+		{"1.0.0.1", "1.0.0.1", []string{"1.0.0.1/32"}, false},
+		{"1.0.0.1", "1.0.0.6", []string{"1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32"}, false},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}, false},
+		{"2001:db8::", "2001:db8::ffff", []string{"2001:db8::/112"}, false},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}, false},
+		{"1.0.0.2", "1.0.0.1", nil, true},
+		{"1.0.0.1", "2001:db8::", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.start+"-"+tt.end, func(t *testing.T) {
+			got, err := rangeToPrefixes(netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rangeToPrefixes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var gotS []string
+			for _, p := range got {
+				gotS = append(gotS, p.String())
+			}
+			if !reflect.DeepEqual(gotS, tt.want) {
+				t.Fatalf("rangeToPrefixes() = %v, want %v", gotS, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIP2ASN(t *testing.T) {
+	tsv := []byte("1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+		"8.8.8.0\t8.8.8.255\t15169\tUS\tGOOGLE\n" +
+		"2606:4700::\t2606:4700:ffff:ffff:ffff:ffff:ffff:ffff\t13335\tUS\tCLOUDFLARENET\n")
+	gz := new(bytes.Buffer)
+	gw := gzip.NewWriter(gz)
+	gw.Write(tsv)
+	gw.Close()
+
+	for name, b := range map[string][]byte{"plain": tsv, "gzip": gz.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			if !IsIP2ASN(b) {
+				t.Fatal("IsIP2ASN() = false")
+			}
+			l, err := ParseIP2ASN(b, "AS13335")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for addr, want := range map[string]bool{
+				"1.0.0.1":      true,
+				"1.0.1.1":      false,
+				"8.8.8.8":      false,
+				"2606:4700::1": true,
+				"2001:db8::1":  false,
+			} {
+				got, _ := l.Match(netip.MustParseAddr(addr))
+				if got != want {
+					t.Errorf("Match(%s) = %v, want %v", addr, got, want)
+				}
+			}
+		})
+	}
+
+	if IsIP2ASN([]byte("geosite data")) {
+		t.Fatal("IsIP2ASN() = true for invalid data")
+	}
+	if _, err := ParseIP2ASN(tsv, ""); err == nil {
+		t.Fatal("ParseIP2ASN() should fail without asn")
+	}
+}
@@ -93,6 +93,8 @@ func (d *DynamicMatcher) Len() int {
 }
 
 // BatchLoadProvider is a helper func to load multiple files using Load.
+// The data of "provider:tag:code" can be a v2ray geoip.dat, a MaxMind DB
+// or an ip2asn TSV file.
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
 func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup, error) {
@@ -100,6 +102,11 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 	staticMatcher := NewList()
 	mg.g = append(mg.g, staticMatcher)
 	for _, s := range e {
+		// "geoip:cn" and "asn:13335" are short for "provider:geoip:cn"
+		// and "provider:asn:13335".
+		if strings.HasPrefix(s, "geoip:") || strings.HasPrefix(s, "asn:") {
+			s = "provider:" + s
+		}
 		if strings.HasPrefix(s, "provider:") {
 			providerName := strings.TrimPrefix(s, "provider:")
 			providerName, v2suffix, _ := strings.Cut(providerName, ":")
@@ -110,6 +117,12 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 			var parseFunc func(in []byte) (*List, error)
 			if len(v2suffix) > 0 {
 				parseFunc = func(in []byte) (*List, error) {
+					switch {
+					case IsMMDB(in):
+						return ParseMMDB(in, v2suffix)
+					case IsIP2ASN(in):
+						return ParseIP2ASN(in, v2suffix)
+					}
 					return ParseV2rayIPDat(in, v2suffix)
 				}
 			} else {
@@ -0,0 +1,418 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// MaxMind DB format, see https://maxmind.github.io/MaxMind-DB/.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSectionSeparator = 16
+
+// IsMMDB reports whether b looks like a MaxMind DB.
+func IsMMDB(b []byte) bool {
+	return bytes.LastIndex(b, mmdbMetadataMarker) >= 0
+}
+
+// ParseMMDB builds a List from a MaxMind DB.
+// The format of args is "code1,code2,...". For country and city
+// databases, code is the country iso code (e.g. "cn"). For asn databases,
+// code is the autonomous system number (e.g. "13335" or "as13335").
+func ParseMMDB(b []byte, args string) (*List, error) {
+	db, err := openMMDB(b)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFunc := mmdbCountryCode
+	codes := make(map[string]struct{})
+	if strings.Contains(strings.ToLower(db.databaseType), "asn") {
+		keyFunc = mmdbASN
+		codes = parseASNs(args)
+	} else {
+		for _, code := range strings.Split(args, ",") {
+			code = strings.ToLower(strings.TrimSpace(code))
+			if len(code) > 0 {
+				codes[code] = struct{}{}
+			}
+		}
+	}
+	if len(codes) == 0 {
+		return nil, errors.New("no code is specified")
+	}
+
+	l := NewList()
+	// Many networks share the same record.
+	keyCache := make(map[uint]string)
+	err = db.walk(func(prefix netip.Prefix, dataOffset uint) error {
+		key, ok := keyCache[dataOffset]
+		if !ok {
+			v, _, err := db.decode(db.data, dataOffset, 0)
+			if err != nil {
+				return fmt.Errorf("failed to decode data record, %w", err)
+			}
+			key = keyFunc(v)
+			keyCache[dataOffset] = key
+		}
+		if _, ok := codes[key]; ok {
+			l.Append(prefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.Sort()
+	return l, nil
+}
+
+func mmdbCountryCode(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	for _, k := range [...]string{"country", "registered_country"} {
+		c, _ := m[k].(map[string]interface{})
+		if code, ok := c["iso_code"].(string); ok {
+			return strings.ToLower(code)
+		}
+	}
+	return ""
+}
+
+func mmdbASN(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	if asn, ok := m["autonomous_system_number"].(uint64); ok {
+		return strconv.FormatUint(asn, 10)
+	}
+	return ""
+}
+
+type mmdb struct {
+	tree         []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+}
+
+func openMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid mmdb, metadata not found")
+	}
+	db := new(mmdb)
+	metaSection := b[i+len(mmdbMetadataMarker):]
+	v, _, err := db.decode(metaSection, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mmdb metadata, %w", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata")
+	}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	db.databaseType, _ = meta["database_type"].(string)
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported mmdb record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported mmdb ip version %d", db.ipVersion)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+mmdbDataSectionSeparator > uint(i) {
+		return nil, errors.New("invalid mmdb, search tree is out of range")
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+mmdbDataSectionSeparator : i]
+	return db, nil
+}
+
+func (db *mmdb) readNode(node uint, bit uint) uint {
+	off := node * db.recordSize * 2 / 8
+	b := db.tree[off:]
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:]))
+	}
+}
+
+// walk calls f with every network in the tree and the offset of its
+// data record in the data section.
+func (db *mmdb) walk(f func(prefix netip.Prefix, dataOffset uint) error) error {
+	bitLen := 32
+	if db.ipVersion == 6 {
+		bitLen = 128
+	}
+	// IPv6 databases alias the IPv4 subtree (e.g. at ::ffff:0:0/96).
+	// Every node is visited only once.
+	visited := make([]bool, db.nodeCount)
+	var ip [16]byte
+
+	var walk func(node uint, depth int) error
+	walk = func(node uint, depth int) error {
+		if node >= db.nodeCount {
+			return db.record(ip, depth, bitLen, node, f)
+		}
+		if visited[node] {
+			return nil
+		}
+		visited[node] = true
+		if depth >= bitLen {
+			return errors.New("invalid mmdb, search tree is too deep")
+		}
+		for bit := uint(0); bit < 2; bit++ {
+			byteIdx, mask := depth/8, byte(0x80>>(depth%8))
+			if bit == 1 {
+				ip[byteIdx] |= mask
+			} else {
+				ip[byteIdx] &^= mask
+			}
+			if err := walk(db.readNode(node, bit), depth+1); err != nil {
+				return err
+			}
+		}
+		ip[depth/8] &^= byte(0x80 >> (depth % 8))
+		return nil
+	}
+	return walk(0, 0)
+}
+
+func (db *mmdb) record(ip [16]byte, depth, bitLen int, node uint, f func(prefix netip.Prefix, dataOffset uint) error) error {
+	if node == db.nodeCount {
+		return nil // empty
+	}
+	dataOffset := node - db.nodeCount - mmdbDataSectionSeparator
+	if dataOffset >= uint(len(db.data)) {
+		return errors.New("invalid mmdb, data pointer is out of range")
+	}
+
+	var prefix netip.Prefix
+	if bitLen == 32 {
+		prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte{ip[0], ip[1], ip[2], ip[3]}), depth)
+	} else {
+		addr := netip.AddrFrom16(ip)
+		if depth >= 96 && (isZero(ip[:12]) || addr.Is4In6()) {
+			// Networks in ::/96 are ipv4 networks.
+			a4 := addr.As16()
+			prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte{a4[12], a4[13], a4[14], a4[15]}), depth-96)
+		} else {
+			prefix = netip.PrefixFrom(addr, depth)
+		}
+	}
+	return f(prefix, dataOffset)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+
+	mmdbMaxDepth = 32
+)
+
+var errMMDBData = errors.New("invalid mmdb data")
+
+// decode decodes the value at offset off of section. It returns the
+// value and the offset after it. Maps are decoded to map[string]interface{},
+// arrays to []interface{}, unsigned integers to uint64.
+func (db *mmdb) decode(section []byte, off uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("mmdb data is nested too deep")
+	}
+	if off >= uint(len(section)) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := section[off]
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ss := uint(ctrl>>3) & 0x3
+		vvv := uint(ctrl & 0x7)
+		n := ss + 1
+		if off+n > uint(len(section)) {
+			return nil, 0, errMMDBData
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(section[off])
+		case 1:
+			p = (vvv<<16 | uint(section[off])<<8 | uint(section[off+1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(section[off])<<16 | uint(section[off+1])<<8 | uint(section[off+2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(section[off:]))
+		}
+		v, _, err := db.decode(section, p, depth+1)
+		return v, off + n, err
+	}
+
+	if typ == 0 { // extended type
+		if off >= uint(len(section)) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + uint(section[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(section)) {
+			return nil, 0, errMMDBData
+		}
+		var v uint
+		for i := uint(0); i < n; i++ {
+			v = v<<8 | uint(section[off+i])
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := db.decode(section, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("mmdb map key is not a string")
+			}
+			v, next, err := db.decode(section, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+			off = next
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := db.decode(section, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	case mmdbEndMarker, mmdbContainer:
+		return nil, off, nil
+	}
+
+	if off+size > uint(len(section)) {
+		return nil, 0, errMMDBData
+	}
+	b := section[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case mmdbInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), off, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown mmdb data type %d", typ)
+	}
+}
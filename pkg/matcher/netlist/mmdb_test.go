@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"bytes"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+// mmdbWriter writes minimal MaxMind DBs for tests.
+type mmdbWriter struct {
+	root *mmdbNode
+	data bytes.Buffer
+}
+
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  [2]int // data offset + 1, 0 means empty
+	id    int
+}
+
+func (w *mmdbWriter) insert(prefix netip.Prefix, dataOffset int) {
+	if w.root == nil {
+		w.root = new(mmdbNode)
+	}
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4() {
+		bits += 96
+	}
+	ip := addr.As16()
+	if addr.Is4() {
+		ip = [16]byte{12: ip[12], 13: ip[13], 14: ip[14], 15: ip[15]}
+	}
+	n := w.root
+	for i := 0; i < bits-1; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = new(mmdbNode)
+		}
+		n = n.child[bit]
+	}
+	i := bits - 1
+	n.data[ip[i/8]>>(7-i%8)&1] = dataOffset + 1
+}
+
+func mmdbCtrl(b *bytes.Buffer, typ, size int) {
+	if typ <= 7 {
+		b.WriteByte(byte(typ<<5 | size))
+		return
+	}
+	b.WriteByte(byte(size))
+	b.WriteByte(byte(typ - 7))
+}
+
+func mmdbEncode(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		mmdbCtrl(b, mmdbString, len(v))
+		b.WriteString(v)
+	case uint16:
+		mmdbCtrl(b, mmdbUint16, 2)
+		b.Write([]byte{byte(v >> 8), byte(v)})
+	case uint32:
+		mmdbCtrl(b, mmdbUint32, 4)
+		b.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case int: // pointer
+		b.WriteByte(byte(mmdbPointer<<5 | (v>>8)&0x7))
+		b.WriteByte(byte(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		mmdbCtrl(b, mmdbMap, len(v))
+		for _, k := range keys {
+			mmdbEncode(b, k)
+			mmdbEncode(b, v[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+// addData adds a data record and returns its offset.
+func (w *mmdbWriter) addData(v interface{}) int {
+	off := w.data.Len()
+	mmdbEncode(&w.data, v)
+	return off
+}
+
+func (w *mmdbWriter) bytes(dbType string) []byte {
+	var nodes []*mmdbNode
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		n.id = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				number(c)
+			}
+		}
+	}
+	number(w.root)
+
+	nodeCount := len(nodes)
+	out := new(bytes.Buffer)
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			v := nodeCount
+			switch {
+			case n.child[bit] != nil:
+				v = n.child[bit].id
+			case n.data[bit] > 0:
+				v = nodeCount + mmdbDataSectionSeparator + n.data[bit] - 1
+			}
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, mmdbDataSectionSeparator))
+	out.Write(w.data.Bytes())
+	out.Write(mmdbMetadataMarker)
+	mmdbEncode(out, map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(6),
+		"database_type": dbType,
+	})
+	return out.Bytes()
+}
+
+func TestParseMMDB(t *testing.T) {
+	w := new(mmdbWriter)
+	cn := w.addData(map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}})
+	us := w.addData(map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}})
+	// registered_country only, via a pointer.
+	jp := w.addData(map[string]interface{}{"registered_country": w.addData(map[string]interface{}{"iso_code": "JP"})})
+	w.insert(netip.MustParsePrefix("1.0.1.0/24"), cn)
+	w.insert(netip.MustParsePrefix("1.0.8.0/21"), cn)
+	w.insert(netip.MustParsePrefix("8.8.8.0/24"), us)
+	w.insert(netip.MustParsePrefix("2001:db8::/32"), cn)
+	w.insert(netip.MustParsePrefix("2001:db9::/32"), jp)
+	b := w.bytes("GeoLite2-Country")
+
+	if !IsMMDB(b) {
+		t.Fatal("IsMMDB failed")
+	}
+	l, err := ParseMMDB(b, "cn,jp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"1.0.1.1", true},
+		{"1.0.15.255", true},
+		{"1.0.16.1", false},
+		{"8.8.8.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", true},
+		{"2001:dba::1", false},
+	}
+	for _, tt := range tests {
+		got, err := l.Match(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	w = new(mmdbWriter)
+	cf := w.addData(map[string]interface{}{"autonomous_system_number": uint32(13335)})
+	w.insert(netip.MustParsePrefix("1.1.1.0/24"), cf)
+	l, err = ParseMMDB(w.bytes("GeoLite2-ASN"), "13335")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Match(netip.MustParseAddr("1.1.1.1")); !ok || l.Len() != 1 {
+		t.Fatal("asn match failed")
+	}
+}
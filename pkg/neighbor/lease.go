@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Lease is a dhcp lease.
+type Lease struct {
+	MAC      net.HardwareAddr // nil for dhcpv6 leases.
+	Hostname string           // lower case, empty if unknown.
+}
+
+// Leases is a dhcp lease table. It implements data_provider.DataListener.
+// It is safe for concurrent use.
+type Leases struct {
+	mu sync.RWMutex
+	m  map[netip.Addr]*Lease
+
+	closer func() // maybe nil
+}
+
+// LoadLeases loads the dnsmasq lease file s. If s has a "provider:" prefix,
+// the leases are loaded from the data provider and are updated with it.
+func LoadLeases(s string, dm *data_provider.DataManager) (*Leases, error) {
+	l := new(Leases)
+	if strings.HasPrefix(s, "provider:") {
+		providerName := strings.TrimPrefix(s, "provider:")
+		provider := dm.GetDataProvider(providerName)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find provider %s", providerName)
+		}
+		if err := provider.LoadAndAddListener(l); err != nil {
+			return nil, fmt.Errorf("failed to load leases from provider %s, %w", providerName, err)
+		}
+		l.closer = func() { provider.DeleteListener(l) }
+		return l, nil
+	}
+	b, err := os.ReadFile(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.Update(b); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close detaches l from its data provider.
+func (l *Leases) Close() error {
+	if l.closer != nil {
+		l.closer()
+	}
+	return nil
+}
+
+// Update replaces the leases with the dnsmasq lease file b.
+func (l *Leases) Update(b []byte) error {
+	m, err := ParseDnsmasqLeases(b)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.m = m
+	l.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the lease of addr. It returns nil if addr has no lease.
+func (l *Leases) Lookup(addr netip.Addr) *Lease {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.m[addr.Unmap()]
+}
+
+// Range calls f for each lease until f returns false.
+func (l *Leases) Range(f func(addr netip.Addr, lease *Lease) bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for addr, lease := range l.m {
+		if !f(addr, lease) {
+			return
+		}
+	}
+}
+
+// ParseDnsmasqLeases parses a dnsmasq lease file. Lines of dhcpv4 leases
+// are "<expiry> <mac> <ip> <hostname> <client id>". Lines of dhcpv6 leases
+// have the iaid instead of the mac.
+func ParseDnsmasqLeases(b []byte) (map[netip.Addr]*Lease, error) {
+	m := make(map[netip.Addr]*Lease)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		fs := strings.Fields(s.Text())
+		if len(fs) == 0 || fs[0] == "duid" {
+			continue
+		}
+		if len(fs) < 4 {
+			return nil, fmt.Errorf("invalid lease at line %d", line)
+		}
+		addr, err := netip.ParseAddr(fs[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease ip at line %d, %w", line, err)
+		}
+		lease := new(Lease)
+		if addr.Is4() {
+			if lease.MAC, err = net.ParseMAC(fs[1]); err != nil {
+				return nil, fmt.Errorf("invalid lease mac at line %d, %w", line, err)
+			}
+		}
+		if fs[3] != "*" {
+			lease.Hostname = strings.ToLower(fs[3])
+		}
+		m[addr] = lease
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package neighbor looks up the link layer addresses and dhcp hostnames
+// of clients in the same LAN.
+package neighbor
+
+import (
+	"golang.org/x/sync/singleflight"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAge is the age of the table after which it is reloaded.
+	maxAge = time.Second * 30
+
+	// minRefreshInterval limits the reload of the table on cache misses.
+	minRefreshInterval = time.Second
+)
+
+// Table is a cache of the neighbor table (ARP and NDP) of the system.
+// The table is dumped outside the lock, and one dump is shared by the
+// concurrent lookups. It is safe for concurrent use.
+type Table struct {
+	readTable func() (map[netip.Addr]net.HardwareAddr, error)
+	sf        singleflight.Group
+
+	mu        sync.Mutex
+	m         map[netip.Addr]net.HardwareAddr // read only
+	updatedAt time.Time
+}
+
+// NewTable returns a Table of the system neighbor table.
+func NewTable() *Table {
+	return &Table{readTable: readTable}
+}
+
+var defaultTable = NewTable()
+
+// DefaultTable returns the Table shared by the callers.
+func DefaultTable() *Table {
+	return defaultTable
+}
+
+// ClientMAC returns the mac of the client addr. It is looked up in
+// leases, which can be nil, then t.
+func ClientMAC(addr netip.Addr, leases *Leases, t *Table) (net.HardwareAddr, error) {
+	if leases != nil {
+		if l := leases.Lookup(addr); l != nil && l.MAC != nil {
+			return l.MAC, nil
+		}
+	}
+	return t.Lookup(addr)
+}
+
+// Lookup returns the link layer address of addr. It returns nil if addr
+// is not a neighbor. A stale entry is returned while the table is
+// reloaded in the background.
+func (t *Table) Lookup(addr netip.Addr) (net.HardwareAddr, error) {
+	addr = addr.Unmap()
+	t.mu.Lock()
+	m, updatedAt := t.m, t.updatedAt
+	t.mu.Unlock()
+
+	age := time.Since(updatedAt)
+	mac, ok := m[addr]
+	switch {
+	case ok && age < maxAge, !ok && age < minRefreshInterval:
+		return mac, nil
+	case ok:
+		t.sf.DoChan("", t.reload)
+		return mac, nil
+	}
+	v, err, _ := t.sf.Do("", t.reload)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[netip.Addr]net.HardwareAddr)[addr], nil
+}
+
+// reload dumps the table. The cached table is kept if the dump failed.
+func (t *Table) reload() (interface{}, error) {
+	m, err := t.readTable()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.updatedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	t.m = m
+	return m, nil
+}
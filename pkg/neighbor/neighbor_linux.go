@@ -0,0 +1,83 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/internal/netlink_utils"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	ndMsgLen = 12 // sizeof(struct ndmsg)
+
+	ndaDst    = 1
+	ndaLLAddr = 2
+
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+	nudNoARP      = 0x40
+
+	netlinkTimeout = time.Second * 5
+)
+
+// readTable dumps the neighbor table with netlink.
+func readTable() (map[netip.Addr]net.HardwareAddr, error) {
+	c, err := netlink_utils.Dial(netlinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	msgs, err := c.Dump(netlink_utils.NewMsg(syscall.RTM_GETNEIGH, 0, ndMsgLen))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump neighbor table, %w", err)
+	}
+
+	m := make(map[netip.Addr]net.HardwareAddr)
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < ndMsgLen {
+			continue
+		}
+		state := netlink_utils.NativeEndian.Uint16(msg.Data[8:10])
+		if state&(nudIncomplete|nudFailed|nudNoARP) != 0 {
+			continue
+		}
+
+		var addr netip.Addr
+		var mac net.HardwareAddr
+		for _, attr := range netlink_utils.ParseAttrs(msg.Data[ndMsgLen:]) {
+			switch attr.Attr.Type {
+			case ndaDst:
+				addr, _ = netip.AddrFromSlice(attr.Value)
+			case ndaLLAddr:
+				mac = append(net.HardwareAddr(nil), attr.Value...)
+			}
+		}
+		if addr.IsValid() && len(mac) > 0 {
+			m[addr.Unmap()] = mac
+		}
+	}
+	return m, nil
+}
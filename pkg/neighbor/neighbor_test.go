@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	data := `1667900000 aa:bb:cc:dd:ee:01 192.168.1.10 Kids-iPad 01:aa:bb:cc:dd:ee:01
+1667900000 aa:bb:cc:dd:ee:02 192.168.1.11 * *
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:ff
+1667900000 1234567 fd00::10 kids-ipad 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:01
+`
+	f := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(f, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadLeases(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease := l.Lookup(netip.MustParseAddr("::ffff:192.168.1.10")); lease == nil || lease.Hostname != "kids-ipad" || lease.MAC.String() != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("unexpected lease %v", lease)
+	}
+	if lease := l.Lookup(netip.MustParseAddr("192.168.1.11")); lease == nil || lease.Hostname != "" {
+		t.Fatalf("unexpected lease %v", lease)
+	}
+	if lease := l.Lookup(netip.MustParseAddr("fd00::10")); lease == nil || lease.MAC != nil || lease.Hostname != "kids-ipad" {
+		t.Fatalf("unexpected lease %v", lease)
+	}
+	if l.Lookup(netip.MustParseAddr("192.168.1.12")) != nil {
+		t.Fatal("unexpected lease")
+	}
+	if err := l.Update([]byte("1667900000 not-a-mac 192.168.1.10 h *")); err == nil {
+		t.Fatal("invalid mac should fail")
+	}
+}
+
+func TestTable_Lookup(t *testing.T) {
+	reads := 0
+	var readErr error
+	tab := &Table{readTable: func() (map[netip.Addr]net.HardwareAddr, error) {
+		reads++
+		mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+		return map[netip.Addr]net.HardwareAddr{netip.MustParseAddr("192.168.1.10"): mac}, readErr
+	}}
+
+	if mac, err := tab.Lookup(netip.MustParseAddr("192.168.1.10")); err != nil || mac == nil {
+		t.Fatalf("unexpected result %v, %v", mac, err)
+	}
+	if mac, _ := tab.Lookup(netip.MustParseAddr("192.168.1.11")); mac != nil || reads != 1 {
+		t.Fatal("cache miss should not reload the table within the interval")
+	}
+	readErr = errors.New("test")
+	if _, err := tab.Lookup(netip.MustParseAddr("192.168.1.10")); err != nil || reads != 1 {
+		t.Fatal("cached entry should be used")
+	}
+}
+
+func TestTable_Lookup_stale(t *testing.T) {
+	var reads int32
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	tab := &Table{readTable: func() (map[netip.Addr]net.HardwareAddr, error) {
+		atomic.AddInt32(&reads, 1)
+		return map[netip.Addr]net.HardwareAddr{netip.MustParseAddr("192.168.1.10"): mac}, nil
+	}}
+	addr := netip.MustParseAddr("192.168.1.10")
+	if _, err := tab.Lookup(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	tab.mu.Lock()
+	tab.updatedAt = time.Now().Add(-maxAge * 2)
+	tab.mu.Unlock()
+	if got, err := tab.Lookup(addr); err != nil || got.String() != mac.String() {
+		t.Fatalf("stale entry should be returned, got %v, %v", got, err)
+	}
+	// Waits for the background reload.
+	tab.sf.Do("", func() (interface{}, error) { return nil, nil })
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Fatalf("want 2 reads, got %d", n)
+	}
+}
@@ -82,8 +82,26 @@ func (h *NftSetHandler) getSet() (*nftables.Set, error) {
 	return set, nil
 }
 
+// Elem is a set element.
+type Elem struct {
+	Prefix netip.Prefix
+
+	// Timeout is the timeout of the element. It requires the set
+	// has the 'timeout' flag. Zero means the default timeout of the set.
+	Timeout time.Duration
+}
+
 // AddElems adds SetIPElem(s) to set in a single batch.
 func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
+	elems := make([]Elem, 0, len(es))
+	for _, e := range es {
+		elems = append(elems, Elem{Prefix: e})
+	}
+	return h.AddTimeoutElems(elems...)
+}
+
+// AddTimeoutElems adds Elem(s) to set in a single batch.
+func (h *NftSetHandler) AddTimeoutElems(es ...Elem) error {
 	set, err := h.getSet()
 	if err != nil {
 		return fmt.Errorf("failed to get set, %w", err)
@@ -98,16 +116,16 @@ func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
 
 	for _, e := range es {
 		if set.Interval {
-			r := netipx.RangeOfPrefix(e)
+			r := netipx.RangeOfPrefix(e.Prefix)
 			start := r.From()
 			end := r.To()
 			elems = append(
 				elems,
-				nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false},
+				nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false, Timeout: e.Timeout},
 				nftables.SetElement{Key: end.Next().AsSlice(), IntervalEnd: true},
 			)
 		} else {
-			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice()})
+			elems = append(elems, nftables.SetElement{Key: e.Prefix.Addr().AsSlice(), Timeout: e.Timeout})
 		}
 	}
 
@@ -24,6 +24,7 @@ import (
 	"net/netip"
 	"os"
 	"testing"
+	"time"
 )
 
 func skipCI(t *testing.T) {
@@ -32,7 +33,7 @@ func skipCI(t *testing.T) {
 	}
 }
 
-func prepareSet(t testing.TB, tableName, setName string, interval bool) {
+func prepareSet(t testing.TB, tableName, setName string, interval, timeout bool) {
 	t.Helper()
 	nc, err := nftables.New()
 	if err != nil {
@@ -41,7 +42,7 @@ func prepareSet(t testing.TB, tableName, setName string, interval bool) {
 
 	table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
 	nc.AddTable(table)
-	if err := nc.AddSet(&nftables.Set{Name: setName, Table: table, KeyType: nftables.TypeIPAddr, Interval: interval}, nil); err != nil {
+	if err := nc.AddSet(&nftables.Set{Name: setName, Table: table, KeyType: nftables.TypeIPAddr, Interval: interval, HasTimeout: timeout}, nil); err != nil {
 		t.Fatal(err)
 	}
 	if err := nc.Flush(); err != nil {
@@ -52,7 +53,7 @@ func prepareSet(t testing.TB, tableName, setName string, interval bool) {
 func Test_AddElems(t *testing.T) {
 	skipCI(t)
 	n := "test"
-	prepareSet(t, n, n, false)
+	prepareSet(t, n, n, false, false)
 
 	nc, err := nftables.New()
 	if err != nil {
@@ -77,3 +78,32 @@ func Test_AddElems(t *testing.T) {
 		t.Fatal("set is empty")
 	}
 }
+
+func Test_AddTimeoutElems(t *testing.T) {
+	skipCI(t)
+	n := "test_timeout"
+	prepareSet(t, n, n, false, true)
+
+	nc, err := nftables.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewNtSetHandler(HandlerOpts{
+		Conn:        nc,
+		TableFamily: nftables.TableFamilyINet,
+		TableName:   n,
+		SetName:     n,
+	})
+
+	if err := h.AddTimeoutElems(Elem{Prefix: netip.MustParsePrefix("127.0.0.1/32"), Timeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	elems, err := nc.GetSetElements(h.set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) == 0 || elems[0].Timeout != time.Minute {
+		t.Fatalf("unexpected elems %v", elems)
+	}
+}
@@ -37,24 +37,59 @@ type RequestMeta struct {
 	// It might be zero/invalid.
 	ClientAddr netip.Addr
 
+	// ClientPort contains the client port.
+	// It might be zero.
+	ClientPort uint16
+
+	// ServerAddr contains the local ip address that received the request.
+	// The response is sent from this address. It might be zero/invalid.
+	ServerAddr netip.Addr
+
 	// FromUDP indicates the request is from an udp socket.
 	FromUDP bool
+
+	// Protocol is the protocol of the request. See Protocol* consts.
+	// It might be empty.
+	Protocol string
+
+	// ServerName is the tls server name (SNI) that the client requested.
+	// It might be empty.
+	ServerName string
 }
 
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+)
+
 // Context is a query context that pass through plugins
 // A Context will always have a non-nil Q.
 // Context MUST be created using NewContext.
 // All Context funcs are not safe for concurrent use.
+//
+// The query and response msgs are copied on write. A copy of the Context
+// shares msgs with the original Context. The msg is copied only when a
+// Context calls Q or R while the msg is still shared. Plugins that only
+// read msgs should use QReadOnly and RReadOnly to avoid the copy.
 type Context struct {
 	// init at beginning
 	startTime     time.Time // when this Context was created
-	q             *dns.Msg
-	originalQuery *dns.Msg
+	q             *sharedMsg
+	originalQuery *sharedMsg
 	id            uint32 // additional uint to distinguish duplicated msg
 	reqMeta       *RequestMeta
 
-	r     *dns.Msg
-	marks map[uint]struct{}
+	r      *sharedMsg // nil if there is no response
+	marks  map[uint]struct{}
+	values map[string]string
+
+	dnssecPassthrough bool
+	trace             *Trace         // nil if the query is not traced
+	ede               *dns.EDNS0_EDE // nil if there is no extended error
+	execSteps         *uint32        // shared by copies
 }
 
 var contextUid uint32
@@ -62,6 +97,8 @@ var zeroRequestMeta = &RequestMeta{}
 
 // NewContext creates a new query Context.
 // q is the query dns msg. It cannot be nil, or NewContext will panic.
+// q will not be modified by the Context. It is copied once a plugin
+// wants to modify the query.
 // meta can be nil.
 func NewContext(q *dns.Msg, meta *RequestMeta) *Context {
 	if q == nil {
@@ -72,12 +109,14 @@ func NewContext(q *dns.Msg, meta *RequestMeta) *Context {
 		meta = zeroRequestMeta
 	}
 
+	sq := newSharedMsg(q, false)
 	ctx := &Context{
-		q:             q,
-		originalQuery: q.Copy(),
+		q:             sq,
+		originalQuery: sq.ref(),
 		reqMeta:       meta,
 		id:            atomic.AddUint32(&contextUid, 1),
 		startTime:     time.Now(),
+		execSteps:     new(uint32),
 	}
 
 	return ctx
@@ -88,8 +127,8 @@ func (ctx *Context) String() string {
 	var question string
 	var clientAddr string
 
-	if len(ctx.q.Question) >= 1 {
-		q := ctx.q.Question[0]
+	if q := ctx.q.m; len(q.Question) >= 1 {
+		q := q.Question[0]
 		question = fmt.Sprintf("%s %s %s", q.Name, dnsutils.QclassToString(q.Qclass), dnsutils.QtypeToString(q.Qtype))
 	} else {
 		question = "empty question"
@@ -100,19 +139,28 @@ func (ctx *Context) String() string {
 		clientAddr = "unknown client"
 	}
 
-	return fmt.Sprintf("%s %d %d %s", question, ctx.q.Id, ctx.id, clientAddr)
+	return fmt.Sprintf("%s %d %d %s", question, ctx.q.m.Id, ctx.id, clientAddr)
 }
 
-// Q returns the query msg. It always returns a non-nil msg.
+// Q returns the query msg for modification. It always returns a non-nil msg.
+// The msg is copied first if it is shared with other Contexts.
 func (ctx *Context) Q() *dns.Msg {
-	return ctx.q
+	ctx.q = ctx.q.writable(true)
+	return ctx.q.m
+}
+
+// QReadOnly returns the query msg. It always returns a non-nil msg.
+// The returned msg MUST NOT be modified and is only valid until the next
+// call of Q.
+func (ctx *Context) QReadOnly() *dns.Msg {
+	return ctx.q.m
 }
 
-// OriginalQuery returns the copied original query msg a that created the Context.
+// OriginalQuery returns the original query msg a that created the Context.
 // It always returns a non-nil msg.
-// The returned msg SHOULD NOT be modified.
+// The returned msg MUST NOT be modified.
 func (ctx *Context) OriginalQuery() *dns.Msg {
-	return ctx.originalQuery
+	return ctx.originalQuery.m
 }
 
 // ReqMeta returns the request metadata. It always returns a non-nil RequestMeta.
@@ -122,16 +170,38 @@ func (ctx *Context) ReqMeta() *RequestMeta {
 	return ctx.reqMeta
 }
 
-// R returns the response. It might be nil.
+// R returns the response for modification. It might be nil.
+// The msg is copied first if it is shared with other Contexts.
 func (ctx *Context) R() *dns.Msg {
-	return ctx.r
+	if ctx.r == nil {
+		return nil
+	}
+	ctx.r = ctx.r.writable(false)
+	return ctx.r.m
+}
+
+// RReadOnly returns the response. It might be nil.
+// The returned msg MUST NOT be modified and is only valid until the next
+// call of R or SetResponse.
+func (ctx *Context) RReadOnly() *dns.Msg {
+	if ctx.r == nil {
+		return nil
+	}
+	return ctx.r.m
 }
 
 // SetResponse stores the response r to the context.
 // Note: It just stores the pointer of r. So the caller
 // shouldn't modify or read r after the call.
 func (ctx *Context) SetResponse(r *dns.Msg) {
-	ctx.r = r
+	if ctx.r != nil {
+		ctx.r.unref()
+	}
+	if r == nil {
+		ctx.r = nil
+		return
+	}
+	ctx.r = newSharedMsg(r, false)
 }
 
 // Id returns the Context id.
@@ -152,30 +222,97 @@ func (ctx *Context) InfoField() zap.Field {
 	return zap.Stringer("query", ctx)
 }
 
-// Copy deep copies this Context.
+// Copy copies this Context. Msgs are shared and copied on write.
 func (ctx *Context) Copy() *Context {
 	newCtx := new(Context)
 	ctx.CopyTo(newCtx)
 	return newCtx
 }
 
-// CopyTo deep copies this Context to d.
+// CopyTo copies this Context to d. Msgs are shared and copied on write.
 func (ctx *Context) CopyTo(d *Context) *Context {
 	d.startTime = ctx.startTime
-	d.q = ctx.q.Copy()
-	d.originalQuery = ctx.originalQuery
+	d.q = ctx.q.ref()
+	d.originalQuery = ctx.originalQuery.ref()
 	d.reqMeta = ctx.reqMeta
 	d.id = ctx.id
+	d.dnssecPassthrough = ctx.dnssecPassthrough
+	d.trace = ctx.trace
+	d.ede = ctx.ede
+	d.execSteps = ctx.execSteps
 
 	if r := ctx.r; r != nil {
-		d.r = r.Copy()
+		d.r = r.ref()
 	}
 	for m := range ctx.marks {
 		d.AddMark(m)
 	}
+	for k, v := range ctx.values {
+		d.SetValue(k, v)
+	}
 	return d
 }
 
+// Release puts the query msgs that were copied by the Context back to
+// the pool once no Context shares them. The response is not released,
+// because it is usually sent to the client after the Context is done.
+// The Context and msgs from Q and OriginalQuery must not be used after
+// the call.
+func (ctx *Context) Release() {
+	// The msg from NewContext is owned by the caller. Its reference is
+	// never dropped, so no copy of the Context will modify it.
+	for _, s := range []*sharedMsg{ctx.q, ctx.originalQuery} {
+		if s.pooled {
+			s.unref()
+		}
+	}
+}
+
+// SetDNSSECPassthrough sets the DNSSEC pass-through mode.
+func (ctx *Context) SetDNSSECPassthrough(b bool) {
+	ctx.dnssecPassthrough = b
+}
+
+// DNSSECPassthrough reports whether the DNSSEC pass-through mode is enabled.
+// If so, plugins must not rewrite or strip records of the response, which
+// may invalidate DNSSEC signatures.
+func (ctx *Context) DNSSECPassthrough() bool {
+	return ctx.dnssecPassthrough
+}
+
+// SetTrace enables the tracing of the query. The Trace is shared by
+// copies of this Context.
+func (ctx *Context) SetTrace(t *Trace) {
+	ctx.trace = t
+}
+
+// Trace returns the Trace of the query. It returns nil if the query is
+// not traced.
+func (ctx *Context) Trace() *Trace {
+	return ctx.trace
+}
+
+// SetEDE sets the extended DNS error (RFC 8914) of the query, which tells
+// the client why the query failed or was answered this way. The server
+// attaches it to the response if the client supports EDNS0. It overwrites
+// the previous one.
+func (ctx *Context) SetEDE(code uint16, text string) {
+	ctx.ede = &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+}
+
+// EDE returns the extended DNS error of the query. It might be nil.
+// The returned option MUST NOT be modified.
+func (ctx *Context) EDE() *dns.EDNS0_EDE {
+	return ctx.ede
+}
+
+// AddExecStep increases the number of executed nodes of the query by one
+// and returns the new number. The number is shared by copies of this
+// Context and is safe for concurrent use.
+func (ctx *Context) AddExecStep() uint32 {
+	return atomic.AddUint32(ctx.execSteps, 1)
+}
+
 // AddMark adds mark m to this Context.
 func (ctx *Context) AddMark(m uint) {
 	if ctx.marks == nil {
@@ -190,6 +327,35 @@ func (ctx *Context) HasMark(m uint) bool {
 	return ok
 }
 
+// SetValue stores a key-value pair to this Context. It overwrites
+// the existing value of key.
+func (ctx *Context) SetValue(key, value string) {
+	if ctx.values == nil {
+		ctx.values = make(map[string]string)
+	}
+	ctx.values[key] = value
+}
+
+// GetValue returns the value of key and whether the key exists.
+func (ctx *Context) GetValue(key string) (string, bool) {
+	v, ok := ctx.values[key]
+	return v, ok
+}
+
+// Values returns a copy of all key-value pairs.
+func (ctx *Context) Values() map[string]string {
+	m := make(map[string]string, len(ctx.values))
+	for k, v := range ctx.values {
+		m[k] = v
+	}
+	return m
+}
+
+// DeleteValue deletes the value of key.
+func (ctx *Context) DeleteValue(key string) {
+	delete(ctx.values, key)
+}
+
 var allocatedMark struct {
 	sync.Mutex
 	u uint
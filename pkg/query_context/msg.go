@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+)
+
+var msgPool = sync.Pool{New: func() interface{} { return new(dns.Msg) }}
+
+// NewMsg returns an empty dns.Msg from the pool. The backing arrays of its
+// sections may be reused. It should be released by ReleaseMsg once it is
+// no longer used.
+func NewMsg() *dns.Msg {
+	return msgPool.Get().(*dns.Msg)
+}
+
+// ReleaseMsg resets m and puts it back to the pool. m and its sections
+// must not be used after the call.
+func ReleaseMsg(m *dns.Msg) {
+	question, answer, ns, extra := m.Question[:0], m.Answer[:0], m.Ns[:0], m.Extra[:0]
+	for i := range m.Answer {
+		m.Answer[i] = nil
+	}
+	for i := range m.Ns {
+		m.Ns[i] = nil
+	}
+	for i := range m.Extra {
+		m.Extra[i] = nil
+	}
+	*m = dns.Msg{Question: question, Answer: answer, Ns: ns, Extra: extra}
+	msgPool.Put(m)
+}
+
+// CopyMsg deep copies m to a dns.Msg from the pool.
+// It should be released by ReleaseMsg once it is no longer used.
+func CopyMsg(m *dns.Msg) *dns.Msg {
+	c := NewMsg()
+	c.MsgHdr = m.MsgHdr
+	c.Compress = m.Compress
+	c.Question = append(c.Question, m.Question...)
+	for _, rr := range m.Answer {
+		c.Answer = append(c.Answer, dns.Copy(rr))
+	}
+	for _, rr := range m.Ns {
+		c.Ns = append(c.Ns, dns.Copy(rr))
+	}
+	for _, rr := range m.Extra {
+		c.Extra = append(c.Extra, dns.Copy(rr))
+	}
+	return c
+}
+
+// sharedMsg is a dns.Msg shared by copies of a Context. It is copied on
+// write: a Context that wants to modify the msg copies it if other
+// Contexts still hold it.
+type sharedMsg struct {
+	m    *dns.Msg
+	refs int32
+
+	// pooled indicates m was created by CopyMsg and can be released to
+	// the pool once no Context holds it.
+	pooled bool
+}
+
+func newSharedMsg(m *dns.Msg, pooled bool) *sharedMsg {
+	return &sharedMsg{m: m, refs: 1, pooled: pooled}
+}
+
+func (s *sharedMsg) ref() *sharedMsg {
+	atomic.AddInt32(&s.refs, 1)
+	return s
+}
+
+// unref drops a reference. The msg is released if it is pooled and this
+// is the last reference.
+func (s *sharedMsg) unref() {
+	if atomic.AddInt32(&s.refs, -1) == 0 && s.pooled {
+		ReleaseMsg(s.m)
+	}
+}
+
+// writable returns s if the caller is the only holder. Otherwise, it
+// returns a private copy and drops the caller's reference of s.
+// The reference is dropped after the copy is done, so the last holder
+// will not modify the msg while it is being copied.
+func (s *sharedMsg) writable(pooledCopy bool) *sharedMsg {
+	if atomic.LoadInt32(&s.refs) == 1 {
+		return s
+	}
+	var c *sharedMsg
+	if pooledCopy {
+		c = newSharedMsg(CopyMsg(s.m), true)
+	} else {
+		c = newSharedMsg(s.m.Copy(), false)
+	}
+	s.unref()
+	return c
+}
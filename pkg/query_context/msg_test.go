@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestContext_CopyOnWrite(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+
+	qCtx := NewContext(q, nil)
+	if qCtx.QReadOnly() != q {
+		t.Fatal("query should not be copied before write")
+	}
+
+	c := qCtx.Copy()
+	c.Q().Id = 1
+	if q.Id == 1 || qCtx.QReadOnly().Id == 1 {
+		t.Fatal("modification of a copy leaked to the origin")
+	}
+
+	// The msg from NewContext is never modified.
+	qCtx.Q().Id = 2
+	if q.Id == 2 || qCtx.OriginalQuery() != q {
+		t.Fatal("original query was modified")
+	}
+	if c.QReadOnly().Id != 1 {
+		t.Fatal("modification of the origin leaked to a copy")
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	qCtx.SetResponse(r)
+	c2 := qCtx.Copy()
+	c2.R().Rcode = dns.RcodeNameError
+	if r.Rcode != dns.RcodeSuccess || qCtx.R() != r {
+		t.Fatal("modification of a copied response leaked to the origin")
+	}
+
+	c.Release()
+	c2.Release()
+	qCtx.Release()
+}
+
+func TestCopyMsg(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(1, 2, 3, 4)})
+	m.SetEdns0(1232, true)
+
+	for i := 0; i < 3; i++ {
+		c := CopyMsg(m)
+		if c.String() != m.String() {
+			t.Fatalf("copy mismatched, want %s, got %s", m, c)
+		}
+		c.Answer[0].Header().Ttl = 1
+		if m.Answer[0].Header().Ttl != 300 {
+			t.Fatal("CopyMsg did not deep copy")
+		}
+		ReleaseMsg(c)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// Trace records the plugins that a traced query passed through.
+// It is shared by all copies of the Context and is safe for concurrent
+// use, since copies may be executed by parallel branches.
+type Trace struct {
+	id      string
+	start   time.Time
+	sampled bool
+
+	mu     sync.Mutex
+	events []*TraceEvent
+}
+
+// TraceEvent is a plugin execution of a traced query.
+type TraceEvent struct {
+	// ID is the 1-based index of the event in Trace.Events. Parent is the
+	// ID of the event that executed this one, e.g. a sequence, or 0 if
+	// it was executed by the entry.
+	ID     int `json:"id"`
+	Parent int `json:"parent,omitempty"`
+
+	Tag  string `json:"tag"`
+	Type string `json:"type"`
+	Kind string `json:"kind"` // "exec", "match" or "upstream"
+
+	// StartUs is the start time since the trace was started.
+	// DurationUs is the time until the plugin returned or passed the
+	// query to the next plugin. Both in microseconds.
+	StartUs    int64 `json:"start_us"`
+	DurationUs int64 `json:"duration_us"`
+
+	Matched *bool  `json:"matched,omitempty"` // Result of a matcher.
+	Err     string `json:"error,omitempty"`
+
+	// Diff is the changes of the query and the response made by the
+	// plugin, in lines of "+ " or "- " prefixes.
+	Diff []string `json:"diff,omitempty"`
+
+	// Response is the new response set by the plugin, or nil if the
+	// plugin did not set one. The response may be modified by other
+	// plugins later.
+	Response *dns.Msg `json:"-"`
+}
+
+// NewTrace creates a Trace with id.
+func NewTrace(id string) *Trace {
+	return &Trace{id: id, start: time.Now()}
+}
+
+// NewSampledTrace creates a Trace with id for a query that is traced
+// by sampling rather than requested by the user.
+func NewSampledTrace(id string) *Trace {
+	return &Trace{id: id, start: time.Now(), sampled: true}
+}
+
+// Sampled reports whether the trace was created by NewSampledTrace.
+func (t *Trace) Sampled() bool {
+	return t.sampled
+}
+
+// ID returns the id of the trace.
+func (t *Trace) ID() string {
+	return t.id
+}
+
+// StartTime returns the time when the trace was started.
+func (t *Trace) StartTime() time.Time {
+	return t.start
+}
+
+type traceParentKey struct{}
+
+type traceParent struct {
+	t *Trace
+	e *TraceEvent
+}
+
+// WithTraceParent returns a ctx in which the events of t are children of
+// e. e can be nil, then the events are top level.
+func WithTraceParent(ctx context.Context, t *Trace, e *TraceEvent) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceParent{t: t, e: e})
+}
+
+// TraceParentEvent returns the parent event of the events of t in ctx.
+// It returns nil if the events are top level.
+func TraceParentEvent(ctx context.Context, t *Trace) *TraceEvent {
+	if p, ok := ctx.Value(traceParentKey{}).(traceParent); ok && p.t == t {
+		return p.e
+	}
+	return nil
+}
+
+// Begin adds a new event and returns it. The event is a child of the
+// event set to ctx by WithTraceParent. It must be modified by Update only.
+func (t *Trace) Begin(ctx context.Context, tag, typ, kind string) *TraceEvent {
+	e := &TraceEvent{
+		Tag:     tag,
+		Type:    typ,
+		Kind:    kind,
+		StartUs: time.Since(t.start).Microseconds(),
+	}
+	if p := TraceParentEvent(ctx, t); p != nil {
+		e.Parent = p.ID
+	}
+	t.mu.Lock()
+	e.ID = len(t.events) + 1
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+	return e
+}
+
+// Update calls f with e while holding the lock of t.
+func (t *Trace) Update(e *TraceEvent, f func(e *TraceEvent)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(e)
+}
+
+// Events returns a copy of the events in the order of their beginning.
+func (t *Trace) Events() []TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := make([]TraceEvent, 0, len(t.events))
+	for _, e := range t.events {
+		l = append(l, *e)
+	}
+	return l
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rdnss announces dns servers to the local network with the
+// RDNSS option of IPv6 router advertisements (RFC 8106).
+package rdnss
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	optTypeRDNSS = 25
+
+	// DefaultInterval is the default interval of unsolicited advertisements.
+	DefaultInterval = time.Second * 200
+)
+
+var allNodes = &net.IPAddr{IP: net.ParseIP("ff02::1")}
+
+// BuildRA builds a router advertisement ICMPv6 message that only carries
+// a RDNSS option. Its router lifetime is 0, so hosts will not use the
+// sender as a default router. A zero lifetime withdraws the servers.
+// The checksum is left to the kernel.
+func BuildRA(servers []netip.Addr, lifetime time.Duration) ([]byte, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no server")
+	}
+	// Cur hop limit, flags, router lifetime, reachable time and retrans
+	// timer are all 0 (unspecified).
+	b := make([]byte, 12, 12+8+16*len(servers))
+
+	opt := make([]byte, 8, 8+16*len(servers))
+	opt[0] = optTypeRDNSS
+	opt[1] = byte(1 + 2*len(servers)) // in units of 8 octets
+	binary.BigEndian.PutUint32(opt[4:8], uint32(lifetime/time.Second))
+	for _, s := range servers {
+		if !s.Is6() || s.Is4In6() {
+			return nil, fmt.Errorf("%s is not an ipv6 address", s)
+		}
+		a := s.As16()
+		opt = append(opt, a[:]...)
+	}
+	b = append(b, opt...)
+
+	m := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Body: &icmp.RawBody{Data: b},
+	}
+	return m.Marshal(nil)
+}
+
+// ParseRDNSS returns the servers and the lifetime of the RDNSS option in
+// the router advertisement ICMPv6 message b.
+func ParseRDNSS(b []byte) ([]netip.Addr, time.Duration, error) {
+	if len(b) < 16 || b[0] != byte(ipv6.ICMPTypeRouterAdvertisement) {
+		return nil, 0, errors.New("not a router advertisement")
+	}
+	opts := b[16:]
+	for len(opts) >= 8 {
+		l := int(opts[1]) * 8
+		if l == 0 || l > len(opts) {
+			return nil, 0, errors.New("invalid option length")
+		}
+		if opts[0] == optTypeRDNSS {
+			var servers []netip.Addr
+			for p := 8; p+16 <= l; p += 16 {
+				servers = append(servers, netip.AddrFrom16(*(*[16]byte)(opts[p : p+16])))
+			}
+			return servers, time.Duration(binary.BigEndian.Uint32(opts[4:8])) * time.Second, nil
+		}
+		opts = opts[l:]
+	}
+	return nil, 0, errors.New("no rdnss option")
+}
+
+// Announcer sends router advertisements with RDNSS options on an interface
+// periodically and in response to router solicitations.
+// It requires the CAP_NET_RAW capability.
+type Announcer struct {
+	Iface   string       // required
+	Servers []netip.Addr // required
+
+	// Interval is the interval of unsolicited advertisements.
+	// Default is DefaultInterval.
+	Interval time.Duration
+
+	// Lifetime is the lifetime of the servers. Default is 3 * Interval
+	// as RFC 8106 suggested.
+	Lifetime time.Duration
+
+	Logger *zap.Logger // Optional.
+}
+
+// Run announces the servers until ctx is done. Then it withdraws the
+// servers by an advertisement with zero lifetime.
+func (a *Announcer) Run(ctx context.Context) error {
+	logger := a.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	interval := a.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	lifetime := a.Lifetime
+	if lifetime <= 0 {
+		lifetime = interval * 3
+	}
+	ra, err := BuildRA(a.Servers, lifetime)
+	if err != nil {
+		return err
+	}
+	withdraw, err := BuildRA(a.Servers, 0)
+	if err != nil {
+		return err
+	}
+
+	iface, err := net.InterfaceByName(a.Iface)
+	if err != nil {
+		return err
+	}
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("failed to open icmpv6 socket, %w", err)
+	}
+	defer c.Close()
+	pc := c.IPv6PacketConn()
+	// Hosts drop neighbor discovery messages whose hop limit is not 255.
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := pc.SetHopLimit(255); err != nil {
+		return err
+	}
+	if err := pc.SetMulticastInterface(iface); err != nil {
+		return err
+	}
+	if err := pc.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return err
+	}
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := pc.SetICMPFilter(&f); err != nil {
+		return err
+	}
+	if err := pc.JoinGroup(iface, &net.IPAddr{IP: net.ParseIP("ff02::2")}); err != nil { // all routers
+		return fmt.Errorf("failed to join all-routers group, %w", err)
+	}
+
+	cm := &ipv6.ControlMessage{IfIndex: iface.Index, HopLimit: 255}
+	send := func(b []byte, dst net.Addr) {
+		if _, err := pc.WriteTo(b, cm, dst); err != nil {
+			logger.Warn("failed to send router advertisement", zap.Stringer("dst", dst), zap.Error(err))
+		}
+	}
+
+	// Answer router solicitations.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, rcm, src, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n == 0 || buf[0] != byte(ipv6.ICMPTypeRouterSolicitation) {
+				continue
+			}
+			if rcm != nil && rcm.IfIndex != iface.Index {
+				continue
+			}
+			logger.Debug("router solicitation received", zap.Stringer("from", src))
+			send(ra, allNodes)
+		}
+	}()
+
+	logger.Info("announcing dns servers", zap.String("iface", a.Iface), zap.Any("servers", a.Servers), zap.Duration("lifetime", lifetime))
+	send(ra, allNodes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			send(ra, allNodes)
+		case <-ctx.Done():
+			send(withdraw, allNodes)
+			return nil
+		}
+	}
+}
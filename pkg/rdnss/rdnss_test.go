@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rdnss
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildRA(t *testing.T) {
+	servers := []netip.Addr{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("2001:db8::53")}
+	b, err := BuildRA(servers, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header(4) + ra body(12) + option header(8) + 2 addrs(32)
+	if len(b) != 56 {
+		t.Fatalf("unexpected length %d", len(b))
+	}
+	if b[16] != optTypeRDNSS || b[17] != 5 {
+		t.Fatalf("invalid option header %v", b[16:18])
+	}
+	gotServers, gotLifetime, err := ParseRDNSS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotServers, servers) || gotLifetime != time.Minute {
+		t.Fatalf("got %v %s", gotServers, gotLifetime)
+	}
+
+	if _, err := BuildRA(nil, time.Minute); err == nil {
+		t.Fatal("empty servers should fail")
+	}
+	if _, err := BuildRA([]netip.Addr{netip.MustParseAddr("127.0.0.1")}, time.Minute); err == nil {
+		t.Fatal("ipv4 server should fail")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	servers := []netip.Addr{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")}
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{FormatDnsmasq, "enable-ra\ndhcp-option=option6:dns-server,[fd00::1],[fd00::2]\n", false},
+		{FormatOdhcpd, "uci -q delete dhcp.lan.dns\n" +
+			"uci add_list dhcp.lan.dns='fd00::1'\n" +
+			"uci add_list dhcp.lan.dns='fd00::2'\n" +
+			"uci commit dhcp\n" +
+			"/etc/init.d/odhcpd restart\n", false},
+		{"radvd", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := Snippet(tt.format, "", servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Snippet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Snippet() got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rdnss
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Supported snippet formats.
+const (
+	FormatOdhcpd  = "odhcpd"  // OpenWrt uci commands for odhcpd
+	FormatDnsmasq = "dnsmasq" // dnsmasq config lines
+)
+
+// Snippet returns a config snippet for the given format that makes the
+// local RA/DHCPv6 server announce servers as the dns servers of the
+// network. iface is the OpenWrt logical interface (e.g. "lan") and is
+// only used by FormatOdhcpd.
+func Snippet(format, iface string, servers []netip.Addr) (string, error) {
+	if len(servers) == 0 {
+		return "", errors.New("no server")
+	}
+	sb := new(strings.Builder)
+	switch format {
+	case FormatOdhcpd:
+		if len(iface) == 0 {
+			iface = "lan"
+		}
+		fmt.Fprintf(sb, "uci -q delete dhcp.%s.dns\n", iface)
+		for _, s := range servers {
+			fmt.Fprintf(sb, "uci add_list dhcp.%s.dns='%s'\n", iface, s)
+		}
+		sb.WriteString("uci commit dhcp\n")
+		sb.WriteString("/etc/init.d/odhcpd restart\n")
+	case FormatDnsmasq:
+		sb.WriteString("enable-ra\n")
+		addrs := make([]string, 0, len(servers))
+		for _, s := range servers {
+			addrs = append(addrs, "["+s.String()+"]")
+		}
+		fmt.Fprintf(sb, "dhcp-option=option6:dns-server,%s\n", strings.Join(addrs, ","))
+	default:
+		return "", fmt.Errorf("unsupported format %s", format)
+	}
+	return sb.String(), nil
+}
+
+// IfaceAddrs returns the global unicast (including ULA) ipv6 addresses of
+// the interface. They are the addresses that should be announced if the
+// dns server listens on all addresses.
+func IfaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, a := range ifAddrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(n.IP)
+		if !ok || !addr.Is6() || addr.Is4In6() || !addr.IsGlobalUnicast() {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("interface %s has no global ipv6 address", name)
+	}
+	return addrs, nil
+}
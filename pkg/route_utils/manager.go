@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route_utils
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// CleanInterval is the suggested interval to call Manager.Clean.
+	CleanInterval = time.Second * 10
+
+	queueSize = 1024
+)
+
+var errQueueFull = errors.New("route queue is full")
+
+// ManagerOpts configures a Manager.
+type ManagerOpts struct {
+	// Route is the template of the installed routes. Its Dst is ignored.
+	Route Route
+
+	// Logger is used to log route errors. Default is nop.
+	Logger *zap.Logger
+
+	// AddFunc and DelFunc install and remove routes. They must be set
+	// together. Default is a netlink socket owned by the Manager.
+	AddFunc func(r Route) error
+	DelFunc func(r Route) error
+}
+
+// router changes the routing table. It is only used by the worker
+// goroutine of a Manager.
+type router interface {
+	add(r Route) error
+	del(r Route) error
+
+	// flush deletes the routes that were installed with the template
+	// tmpl, e.g. by a previous process that did not exit cleanly.
+	flush(tmpl Route) error
+	Close() error
+}
+
+type funcRouter struct {
+	addFunc func(r Route) error
+	delFunc func(r Route) error
+}
+
+func (f funcRouter) add(r Route) error      { return f.addFunc(r) }
+func (f funcRouter) del(r Route) error      { return f.delFunc(r) }
+func (f funcRouter) flush(tmpl Route) error { return nil }
+func (f funcRouter) Close() error           { return nil }
+
+// Manager installs routes that expire. Expired routes are removed from
+// the routing table by Clean, which should be called periodically, e.g.
+// by a scheduler task. All routes are removed when the Manager is closed.
+// Routes are changed by a worker goroutine, so Add does not block on the
+// routing table. It is safe for concurrent use.
+type Manager struct {
+	opts   ManagerOpts
+	router router
+	queue  chan managerOp
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	workerDone  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	routes map[netip.Prefix]time.Time // expiration time
+}
+
+// managerOp is an add op if dst is valid, otherwise a clean op.
+type managerOp struct {
+	dst  netip.Prefix
+	now  time.Time     // for clean ops
+	done chan struct{} // for clean ops
+}
+
+// NewManager creates a Manager. The routes left with the template of
+// opts.Route, e.g. by a crash, are flushed.
+func NewManager(opts ManagerOpts) (*Manager, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	var r router
+	if opts.AddFunc != nil && opts.DelFunc != nil {
+		r = funcRouter{addFunc: opts.AddFunc, delFunc: opts.DelFunc}
+	} else if opts.AddFunc != nil || opts.DelFunc != nil {
+		return nil, errors.New("AddFunc and DelFunc must be set together")
+	} else {
+		var err error
+		r, err = newSysRouter()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := r.flush(opts.Route); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to flush routes, %w", err)
+	}
+
+	m := &Manager{
+		opts:        opts,
+		router:      r,
+		queue:       make(chan managerOp, queueSize),
+		closeNotify: make(chan struct{}),
+		workerDone:  make(chan struct{}),
+		routes:      make(map[netip.Prefix]time.Time),
+	}
+	go m.worker()
+	return m, nil
+}
+
+// Add installs the route to dst that expires after ttl. If the route
+// was installed, its expiration time is extended. The route is installed
+// asynchronously, failures are logged.
+func (m *Manager) Add(dst netip.Prefix, ttl time.Duration) error {
+	expire := time.Now().Add(ttl)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	if e, ok := m.routes[dst]; ok {
+		if expire.After(e) {
+			m.routes[dst] = expire
+		}
+		return nil
+	}
+	select {
+	case m.queue <- managerOp{dst: dst}:
+	default:
+		return errQueueFull
+	}
+	m.routes[dst] = expire
+	return nil
+}
+
+// Len returns the number of installed routes.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.routes)
+}
+
+// Clean removes routes that expired before now. It returns after the
+// queued routes are installed and the expired routes are removed.
+func (m *Manager) Clean(now time.Time) {
+	op := managerOp{now: now, done: make(chan struct{})}
+	select {
+	case m.queue <- op:
+	case <-m.closeNotify:
+		return
+	}
+	select {
+	case <-op.done:
+	case <-m.workerDone:
+	}
+}
+
+// Close removes all installed routes.
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		routes := m.routes
+		m.routes = nil
+		m.mu.Unlock()
+
+		close(m.closeNotify)
+		<-m.workerDone
+		// The worker has exited, so the router can be used here.
+		for dst := range routes {
+			m.delRoute(dst)
+		}
+		if err := m.router.Close(); err != nil {
+			m.opts.Logger.Warn("failed to close router", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+func (m *Manager) worker() {
+	defer close(m.workerDone)
+	for {
+		select {
+		case op := <-m.queue:
+			if op.dst.IsValid() {
+				m.addRoute(op.dst)
+			} else {
+				m.clean(op.now)
+				close(op.done)
+			}
+		case <-m.closeNotify:
+			return
+		}
+	}
+}
+
+func (m *Manager) route(dst netip.Prefix) Route {
+	r := m.opts.Route
+	r.Dst = dst
+	return r
+}
+
+func (m *Manager) addRoute(dst netip.Prefix) {
+	if err := m.router.add(m.route(dst)); err != nil {
+		m.opts.Logger.Warn("failed to add route", zap.Stringer("dst", dst), zap.Error(err))
+		// Forget the route, so the next Add retries it.
+		m.mu.Lock()
+		delete(m.routes, dst)
+		m.mu.Unlock()
+	}
+}
+
+func (m *Manager) delRoute(dst netip.Prefix) {
+	if err := m.router.del(m.route(dst)); err != nil {
+		m.opts.Logger.Warn("failed to delete route", zap.Stringer("dst", dst), zap.Error(err))
+	}
+}
+
+func (m *Manager) clean(now time.Time) {
+	var expired []netip.Prefix
+	m.mu.Lock()
+	for dst, e := range m.routes {
+		if e.Before(now) {
+			expired = append(expired, dst)
+			delete(m.routes, dst)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, dst := range expired {
+		m.delRoute(dst)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route_utils
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTable struct {
+	sync.Mutex
+	routes map[netip.Prefix]Route
+	adds   int
+}
+
+func (t *fakeTable) add(r Route) error {
+	t.Lock()
+	defer t.Unlock()
+	t.routes[r.Dst] = r
+	t.adds++
+	return nil
+}
+
+func (t *fakeTable) del(r Route) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.routes, r.Dst)
+	return nil
+}
+
+func (t *fakeTable) len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.routes)
+}
+
+func TestManager(t *testing.T) {
+	table := &fakeTable{routes: make(map[netip.Prefix]Route)}
+	gw := netip.MustParseAddr("10.0.0.1")
+	m, err := NewManager(ManagerOpts{
+		Route:   Route{Gateway: gw, Table: 100},
+		AddFunc: table.add,
+		DelFunc: table.del,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p1 := netip.MustParsePrefix("1.1.1.1/32")
+	p2 := netip.MustParsePrefix("2.2.2.2/32")
+	if err := m.Add(p1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(p1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(p2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	m.Clean(time.Now()) // waits for the queued adds
+	if table.adds != 2 || m.Len() != 2 {
+		t.Fatalf("adds = %d, len = %d, want 2, 2", table.adds, m.Len())
+	}
+	if r := table.routes[p1]; r.Gateway != gw || r.Table != 100 {
+		t.Fatalf("unexpected route %v", r)
+	}
+
+	// p1 was extended to an hour.
+	m.Clean(time.Now().Add(time.Minute * 2))
+	if m.Len() != 1 || table.len() != 1 {
+		t.Fatalf("len = %d, table len = %d, want 1, 1", m.Len(), table.len())
+	}
+	if _, ok := table.routes[p1]; !ok {
+		t.Fatal("p1 should not be removed")
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if table.len() != 0 {
+		t.Fatal("routes are not removed after close")
+	}
+	if err := m.Add(p1, time.Minute); err != nil || table.len() != 0 {
+		t.Fatal("closed manager should not add routes")
+	}
+}
+
+func TestManager_addFailure(t *testing.T) {
+	var adds int
+	m, err := NewManager(ManagerOpts{
+		Route: Route{Ifindex: 1},
+		AddFunc: func(r Route) error {
+			adds++
+			return errors.New("add failed")
+		},
+		DelFunc: func(r Route) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	p := netip.MustParsePrefix("1.1.1.1/32")
+	for i := 0; i < 2; i++ {
+		if err := m.Add(p, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		m.Clean(time.Now())
+	}
+	// The failed route is forgotten, so the second Add retries it.
+	if adds != 2 || m.Len() != 0 {
+		t.Fatalf("adds = %d, len = %d, want 2, 0", adds, m.Len())
+	}
+}
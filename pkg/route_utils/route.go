@@ -0,0 +1,38 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route_utils
+
+import (
+	"net/netip"
+)
+
+// DefaultProtocol is the rtm_protocol of the routes installed by mosdns.
+// It tells them apart from the routes of other daemons, so they can be
+// flushed after a crash.
+const DefaultProtocol = 109
+
+// Route is a route in the kernel routing table.
+type Route struct {
+	Dst      netip.Prefix // Required.
+	Gateway  netip.Addr   // Maybe invalid if Ifindex is set.
+	Ifindex  int          // Maybe zero if Gateway is set.
+	Table    uint32       // Zero means the main table.
+	Metric   uint32
+	Protocol uint8 // Zero means DefaultProtocol.
+}
@@ -0,0 +1,247 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route_utils
+
+import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/internal/netlink_utils"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	rtaDst      = 1
+	rtaOif      = 4
+	rtaGateway  = 5
+	rtaPriority = 6
+	rtaTable    = 15
+
+	rtTableMain = 254
+	rtScopeLink = 253
+	rtnUnicast  = 1
+	rtMsgLen    = 12 // sizeof(struct rtmsg)
+
+	netlinkTimeout = time.Second * 5
+)
+
+// AddRoute adds or replaces r in the kernel routing table.
+func AddRoute(r Route) error {
+	c, err := netlink_utils.Dial(netlinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return addRoute(c, r)
+}
+
+// DelRoute deletes r from the kernel routing table. It is not an error
+// if r does not exist.
+func DelRoute(r Route) error {
+	c, err := netlink_utils.Dial(netlinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return delRoute(c, r)
+}
+
+func addRoute(c *netlink_utils.Conn, r Route) error {
+	b, err := packRouteMsg(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, r)
+	if err != nil {
+		return err
+	}
+	return c.Execute(b)
+}
+
+func delRoute(c *netlink_utils.Conn, r Route) error {
+	b, err := packRouteMsg(syscall.RTM_DELROUTE, 0, r)
+	if err != nil {
+		return err
+	}
+	err = c.Execute(b)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// netlinkRouter is the router of the kernel routing table. It owns one
+// netlink socket.
+type netlinkRouter struct {
+	c *netlink_utils.Conn
+}
+
+func newSysRouter() (router, error) {
+	c, err := netlink_utils.Dial(netlinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkRouter{c: c}, nil
+}
+
+func (n *netlinkRouter) add(r Route) error {
+	return addRoute(n.c, r)
+}
+
+func (n *netlinkRouter) del(r Route) error {
+	return delRoute(n.c, r)
+}
+
+// flush deletes the routes that have the protocol, table, gateway and
+// interface of tmpl.
+func (n *netlinkRouter) flush(tmpl Route) error {
+	b := netlink_utils.NewMsg(syscall.RTM_GETROUTE, 0, rtMsgLen)
+	msgs, err := n.c.Dump(b)
+	if err != nil {
+		return err
+	}
+	tmpl = normalizeRoute(tmpl)
+
+	var routes []Route
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE {
+			continue
+		}
+		r, ok := parseRouteMsg(msg.Data)
+		if !ok || r.Protocol != tmpl.Protocol || r.Table != tmpl.Table || r.Gateway != tmpl.Gateway {
+			continue
+		}
+		if tmpl.Ifindex != 0 && r.Ifindex != tmpl.Ifindex {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	for _, r := range routes {
+		if err := delRoute(n.c, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *netlinkRouter) Close() error {
+	return n.c.Close()
+}
+
+// normalizeRoute replaces the zero Table and Protocol of r with their
+// defaults.
+func normalizeRoute(r Route) Route {
+	if r.Table == 0 {
+		r.Table = rtTableMain
+	}
+	if r.Protocol == 0 {
+		r.Protocol = DefaultProtocol
+	}
+	return r
+}
+
+// parseRouteMsg parses a struct rtmsg and its rtattrs.
+func parseRouteMsg(b []byte) (Route, bool) {
+	if len(b) < rtMsgLen {
+		return Route{}, false
+	}
+	var r Route
+	family, dstLen := b[0], int(b[1])
+	r.Table = uint32(b[4])
+	r.Protocol = b[5]
+	dst := netip.IPv4Unspecified()
+	if family == syscall.AF_INET6 {
+		dst = netip.IPv6Unspecified()
+	} else if family != syscall.AF_INET {
+		return Route{}, false
+	}
+	for _, attr := range netlink_utils.ParseAttrs(b[rtMsgLen:]) {
+		switch attr.Attr.Type {
+		case rtaDst:
+			dst, _ = netip.AddrFromSlice(attr.Value)
+		case rtaGateway:
+			r.Gateway, _ = netip.AddrFromSlice(attr.Value)
+		case rtaOif:
+			if len(attr.Value) == 4 {
+				r.Ifindex = int(netlink_utils.NativeEndian.Uint32(attr.Value))
+			}
+		case rtaTable:
+			if len(attr.Value) == 4 {
+				r.Table = netlink_utils.NativeEndian.Uint32(attr.Value)
+			}
+		case rtaPriority:
+			if len(attr.Value) == 4 {
+				r.Metric = netlink_utils.NativeEndian.Uint32(attr.Value)
+			}
+		}
+	}
+	p, err := dst.Prefix(dstLen)
+	if err != nil {
+		return Route{}, false
+	}
+	r.Dst = p
+	return r, true
+}
+
+// packRouteMsg packs a struct nlmsghdr, a struct rtmsg and the rtattrs of r.
+func packRouteMsg(typ uint16, flags uint16, r Route) ([]byte, error) {
+	if !r.Dst.IsValid() {
+		return nil, errors.New("invalid route destination")
+	}
+	dst := r.Dst.Masked()
+	family := byte(syscall.AF_INET6)
+	if dst.Addr().Is4() {
+		family = syscall.AF_INET
+	}
+	if r.Gateway.IsValid() && r.Gateway.Is4() != dst.Addr().Is4() {
+		return nil, errors.New("gateway and destination have different families")
+	}
+	if !r.Gateway.IsValid() && r.Ifindex == 0 {
+		return nil, errors.New("route requires a gateway or an interface")
+	}
+
+	r = normalizeRoute(r)
+	scope := byte(0) // RT_SCOPE_UNIVERSE
+	if !r.Gateway.IsValid() {
+		scope = rtScopeLink
+	}
+
+	b := netlink_utils.NewMsg(typ, flags, rtMsgLen)
+	rtm := b[netlink_utils.HdrLen:]
+	rtm[0] = family
+	rtm[1] = byte(dst.Bits())
+	if r.Table < 256 {
+		rtm[4] = byte(r.Table)
+	}
+	rtm[5] = r.Protocol
+	rtm[6] = scope
+	rtm[7] = rtnUnicast
+
+	b = netlink_utils.AppendAttr(b, rtaDst, dst.Addr().AsSlice())
+	b = netlink_utils.AppendAttr(b, rtaTable, netlink_utils.Uint32Bytes(r.Table))
+	if r.Gateway.IsValid() {
+		b = netlink_utils.AppendAttr(b, rtaGateway, r.Gateway.AsSlice())
+	}
+	if r.Ifindex != 0 {
+		b = netlink_utils.AppendAttr(b, rtaOif, netlink_utils.Uint32Bytes(uint32(r.Ifindex)))
+	}
+	if r.Metric != 0 {
+		b = netlink_utils.AppendAttr(b, rtaPriority, netlink_utils.Uint32Bytes(r.Metric))
+	}
+	netlink_utils.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	return b, nil
+}
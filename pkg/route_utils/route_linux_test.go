@@ -0,0 +1,77 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route_utils
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/internal/netlink_utils"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+func Test_packRouteMsg(t *testing.T) {
+	b, err := packRouteMsg(syscall.RTM_NEWROUTE, 0, Route{
+		Dst:     netip.MustParsePrefix("1.1.1.1/32"),
+		Gateway: netip.MustParseAddr("10.0.0.1"),
+		Table:   1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(netlink_utils.NativeEndian.Uint32(b[0:4])) != len(b) {
+		t.Fatal("invalid msg length")
+	}
+	// nlmsghdr + rtmsg + dst + table + gateway
+	if len(b) != netlink_utils.HdrLen+rtMsgLen+8*3 {
+		t.Fatalf("unexpected msg length %d", len(b))
+	}
+	if rtm := b[netlink_utils.HdrLen:]; rtm[0] != syscall.AF_INET || rtm[1] != 32 || rtm[4] != 0 || rtm[5] != DefaultProtocol {
+		t.Fatalf("unexpected rtmsg %v", rtm[:rtMsgLen])
+	}
+	r, ok := parseRouteMsg(b[netlink_utils.HdrLen:])
+	if !ok || r.Dst != netip.MustParsePrefix("1.1.1.1/32") || r.Gateway != netip.MustParseAddr("10.0.0.1") ||
+		r.Table != 1000 || r.Protocol != DefaultProtocol {
+		t.Fatalf("unexpected parsed route %+v", r)
+	}
+
+	if _, err := packRouteMsg(syscall.RTM_NEWROUTE, 0, Route{Dst: netip.MustParsePrefix("::1/128")}); err == nil {
+		t.Fatal("route without gateway and interface should be rejected")
+	}
+	if _, err := packRouteMsg(syscall.RTM_NEWROUTE, 0, Route{
+		Dst:     netip.MustParsePrefix("::1/128"),
+		Gateway: netip.MustParseAddr("10.0.0.1"),
+	}); err == nil {
+		t.Fatal("route with mixed families should be rejected")
+	}
+}
+
+func Test_netlinkRouter_flush(t *testing.T) {
+	r, err := newSysRouter()
+	if err != nil {
+		t.Skipf("netlink is not available, %v", err)
+	}
+	defer r.Close()
+
+	// No route is in this table, so nothing needs the privilege to be deleted.
+	if err := r.flush(Route{Ifindex: 1, Table: 4000}); err != nil {
+		t.Fatal(err)
+	}
+}
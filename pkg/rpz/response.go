@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Response generates the policy response of q.
+// It returns nil if the rule does not rewrite the response. That is,
+// ActionPassthru, ActionDrop, and ActionTCPOnly if the query is not
+// from udp.
+func (r *Rule) Response(q *dns.Msg, fromUDP bool) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+
+	switch r.Action {
+	case ActionNXDomain:
+		return dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+	case ActionNoData:
+		return dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	case ActionTCPOnly:
+		if !fromUDP {
+			return nil
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Truncated = true
+		return resp
+	case ActionLocalData:
+	default:
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = true
+	for _, rr := range r.Data {
+		h := rr.Header()
+		if h.Rrtype != question.Qtype && h.Rrtype != dns.TypeCNAME {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		if cname, ok := rr.(*dns.CNAME); ok {
+			// "*.example" rewrites the qname to "qname.example".
+			if strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = question.Name + cname.Target[2:]
+			}
+			if question.Qtype != dns.TypeCNAME {
+				// A CNAME cannot coexist with other data.
+				resp.Answer = []dns.RR{rr}
+				break
+			}
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{dnsutils.FakeSOA(question.Name)}
+	}
+	return resp
+}
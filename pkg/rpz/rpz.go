@@ -0,0 +1,416 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rpz implements DNS Response Policy Zones.
+// See https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz.
+package rpz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Action is the policy action of a Rule.
+type Action uint8
+
+const (
+	ActionLocalData Action = iota
+	ActionNXDomain
+	ActionNoData
+	ActionPassthru
+	ActionDrop
+	ActionTCPOnly
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionLocalData:
+		return "local_data"
+	case ActionNXDomain:
+		return "nxdomain"
+	case ActionNoData:
+		return "nodata"
+	case ActionPassthru:
+		return "passthru"
+	case ActionDrop:
+		return "drop"
+	case ActionTCPOnly:
+		return "tcp_only"
+	default:
+		return "unknown"
+	}
+}
+
+// Trigger is the trigger type of a Rule.
+type Trigger uint8
+
+const (
+	TriggerClientIP Trigger = iota
+	TriggerQName
+	TriggerIP
+	TriggerNSDName
+	TriggerNSIP
+)
+
+func (t Trigger) String() string {
+	switch t {
+	case TriggerClientIP:
+		return "client_ip"
+	case TriggerQName:
+		return "qname"
+	case TriggerIP:
+		return "ip"
+	case TriggerNSDName:
+		return "nsdname"
+	case TriggerNSIP:
+		return "nsip"
+	default:
+		return "unknown"
+	}
+}
+
+// Rule is a policy rule.
+type Rule struct {
+	// Owner is the owner name of the rule, relative to the zone origin.
+	Owner  string
+	Action Action
+	// Data contains the local data of ActionLocalData.
+	Data []dns.RR
+}
+
+// Zone is a parsed response policy zone.
+type Zone struct {
+	origin string
+
+	qname    nameRules
+	nsdname  nameRules
+	clientIP prefixRules
+	ip       prefixRules
+	nsip     prefixRules
+	len      int
+}
+
+// Origin returns the origin of this zone.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// Len returns the number of rules in this zone.
+func (z *Zone) Len() int {
+	return z.len
+}
+
+// LookupQName returns the rule of the query name. Exact rules take
+// precedence over wildcard rules, and closer wildcards take precedence
+// over farther ones. It returns nil if there is no such rule.
+func (z *Zone) LookupQName(name string) *Rule {
+	return z.qname.lookup(name)
+}
+
+// LookupNSDName returns the rule of the name server name.
+func (z *Zone) LookupNSDName(name string) *Rule {
+	return z.nsdname.lookup(name)
+}
+
+// LookupClientIP returns the rule of the client address.
+// The longest prefix wins.
+func (z *Zone) LookupClientIP(addr netip.Addr) *Rule {
+	return z.clientIP.lookup(addr)
+}
+
+// LookupIP returns the rule of the address in the answer section.
+func (z *Zone) LookupIP(addr netip.Addr) *Rule {
+	return z.ip.lookup(addr)
+}
+
+// LookupNSIP returns the rule of the name server address.
+func (z *Zone) LookupNSIP(addr netip.Addr) *Rule {
+	return z.nsip.lookup(addr)
+}
+
+type nameRules struct {
+	exact    map[string]*Rule
+	wildcard map[string]*Rule // key is the parent of the wildcard
+}
+
+func (n *nameRules) get(name string) *Rule {
+	m := &n.exact
+	if strings.HasPrefix(name, "*.") {
+		m = &n.wildcard
+		name = name[2:]
+		if len(name) == 0 {
+			name = "."
+		}
+	}
+	if *m == nil {
+		*m = make(map[string]*Rule)
+	}
+	r := (*m)[name]
+	if r == nil {
+		r = new(Rule)
+		(*m)[name] = r
+	}
+	return r
+}
+
+func (n *nameRules) lookup(name string) *Rule {
+	name = strings.ToLower(dns.Fqdn(name))
+	if r := n.exact[name]; r != nil {
+		return r
+	}
+	if len(n.wildcard) == 0 {
+		return nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if r := n.wildcard[name[off:]]; r != nil {
+			return r
+		}
+	}
+	return n.wildcard["."]
+}
+
+type prefixRules struct {
+	m    map[netip.Prefix]*Rule
+	bits []int // distinct prefix lengths, in descending order
+}
+
+func (p *prefixRules) get(prefix netip.Prefix) *Rule {
+	if p.m == nil {
+		p.m = make(map[netip.Prefix]*Rule)
+	}
+	r := p.m[prefix]
+	if r == nil {
+		r = new(Rule)
+		p.m[prefix] = r
+		i := sort.Search(len(p.bits), func(i int) bool { return p.bits[i] <= prefix.Bits() })
+		if i == len(p.bits) || p.bits[i] != prefix.Bits() {
+			p.bits = append(p.bits, 0)
+			copy(p.bits[i+1:], p.bits[i:])
+			p.bits[i] = prefix.Bits()
+		}
+	}
+	return r
+}
+
+func (p *prefixRules) lookup(addr netip.Addr) *Rule {
+	if len(p.m) == 0 || !addr.IsValid() {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, bits := range p.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if r := p.m[prefix]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// ParseZone parses a response policy zone from r. If origin is empty,
+// the zone must have a $ORIGIN directive or an absolute SOA owner name.
+// Rules with unsupported triggers are ignored and counted in skipped.
+func ParseZone(r io.Reader, origin string) (z *Zone, skipped int, err error) {
+	parser := dns.NewZoneParser(r, origin, "")
+	parser.SetDefaultTTL(300)
+
+	z = new(Zone)
+	if len(origin) > 0 {
+		z.origin = strings.ToLower(dns.Fqdn(origin))
+	}
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if h.Rrtype == dns.TypeSOA && len(z.origin) == 0 {
+			z.origin = owner
+		}
+		if len(z.origin) == 0 {
+			return nil, 0, errors.New("missing zone origin")
+		}
+		if owner == z.origin || h.Class != dns.ClassINET {
+			continue // apex records, SOA, NS, etc.
+		}
+		if !dns.IsSubDomain(z.origin, owner) {
+			return nil, 0, fmt.Errorf("record %s is out of zone %s", owner, z.origin)
+		}
+
+		rel := strings.TrimSuffix(owner[:len(owner)-len(z.origin)], ".")
+		if z.origin == "." {
+			rel = strings.TrimSuffix(owner, ".")
+		}
+		rule, ok, err := z.getRule(rel)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid trigger %s, %w", owner, err)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		if len(rule.Owner) == 0 {
+			rule.Owner = rel
+			z.len++
+		}
+		addRR(rule, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(z.origin) == 0 {
+		return nil, 0, errors.New("missing zone origin")
+	}
+	return z, skipped, nil
+}
+
+func (z *Zone) getRule(rel string) (*Rule, bool, error) {
+	i := strings.LastIndexByte(rel, '.')
+	if i < 0 || !strings.HasPrefix(rel[i+1:], "rpz-") {
+		return z.qname.get(rel + "."), true, nil
+	}
+
+	trigger, suffix := rel[:i], rel[i+1:]
+	switch suffix {
+	case "rpz-client-ip", "rpz-ip", "rpz-nsip":
+		prefix, err := parseIPTrigger(trigger)
+		if err != nil {
+			return nil, false, err
+		}
+		switch suffix {
+		case "rpz-client-ip":
+			return z.clientIP.get(prefix), true, nil
+		case "rpz-ip":
+			return z.ip.get(prefix), true, nil
+		default:
+			return z.nsip.get(prefix), true, nil
+		}
+	case "rpz-nsdname":
+		return z.nsdname.get(trigger + "."), true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+func addRR(rule *Rule, rr dns.RR) {
+	if rule.Action != ActionLocalData {
+		return // special actions override any local data.
+	}
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			rule.Action = ActionNXDomain
+		case "*.":
+			rule.Action = ActionNoData
+		case "rpz-passthru.":
+			rule.Action = ActionPassthru
+		case "rpz-drop.":
+			rule.Action = ActionDrop
+		case "rpz-tcp-only.":
+			rule.Action = ActionTCPOnly
+		}
+		if rule.Action != ActionLocalData {
+			rule.Data = nil
+			return
+		}
+	}
+	rule.Data = append(rule.Data, rr)
+}
+
+// parseIPTrigger parses the reversed ip trigger. e.g.
+// "24.0.2.0.192" is 192.0.2.0/24, "128.1.zz.db8.2001" is 2001:db8::1/128.
+func parseIPTrigger(s string) (netip.Prefix, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, errors.New("too few labels")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length, %w", err)
+	}
+
+	groups := labels[1:]
+	for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+		groups[i], groups[j] = groups[j], groups[i]
+	}
+	var addrStr string
+	if len(groups) == 4 && !strings.Contains(s, "zz") && bits <= 32 {
+		addrStr = strings.Join(groups, ".")
+	} else {
+		addrStr = strings.Join(groups, ":")
+		switch {
+		case addrStr == "zz":
+			addrStr = "::"
+		case strings.HasPrefix(addrStr, "zz:"):
+			addrStr = ":" + addrStr[2:]
+		case strings.HasSuffix(addrStr, ":zz"):
+			addrStr = addrStr[:len(addrStr)-2] + ":"
+		default:
+			addrStr = strings.Replace(addrStr, ":zz:", "::", 1)
+		}
+	}
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr() != addr {
+		return netip.Prefix{}, fmt.Errorf("%s is not a network address", addr)
+	}
+	return prefix, nil
+}
+
+// DynamicZone is a Zone that can be updated by a data_provider.DataProvider.
+type DynamicZone struct {
+	v atomic.Value
+}
+
+func NewDynamicZone() *DynamicZone {
+	return new(DynamicZone)
+}
+
+// Update implements data_provider.DataListener.
+func (d *DynamicZone) Update(newData []byte) error {
+	z, _, err := ParseZone(bytes.NewReader(newData), "")
+	if err != nil {
+		return err
+	}
+	d.v.Store(z)
+	return nil
+}
+
+// Zone returns the current zone. It returns nil if the zone
+// has never been loaded.
+func (d *DynamicZone) Zone() *Zone {
+	z, _ := d.v.Load().(*Zone)
+	return z
+}
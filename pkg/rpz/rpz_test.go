@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"github.com/miekg/dns"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+$TTL 300
+$ORIGIN rpz.example.
+@                         SOA  ns.rpz.example. admin.rpz.example. 1 3600 600 86400 300
+@                         NS   ns.rpz.example.
+nxdomain.com              CNAME .
+*.nxdomain.com            CNAME .
+nodata.com                CNAME *.
+passthru.nxdomain.com     CNAME rpz-passthru.
+drop.com                  CNAME rpz-drop.
+tcp.com                   CNAME rpz-tcp-only.
+local.com                 A    192.0.2.1
+local.com                 A    192.0.2.2
+local.com                 AAAA 2001:db8::1
+cname.com                 CNAME walled.garden.
+*.wild.com                CNAME *.garden.
+24.0.2.0.192.rpz-ip       CNAME .
+32.1.2.0.192.rpz-ip       CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip     CNAME *.
+32.1.0.0.127.rpz-client-ip CNAME rpz-drop.
+ns.evil.com.rpz-nsdname   CNAME .
+24.0.113.0.203.rpz-nsip   CNAME .
+unknown.rpz-foo           CNAME .
+`
+
+func mustParse(t *testing.T) *Zone {
+	t.Helper()
+	z, skipped, err := ParseZone(strings.NewReader(testZone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Fatalf("want 1 skipped rule, got %d", skipped)
+	}
+	if z.Origin() != "rpz.example." {
+		t.Fatalf("unexpected origin %s", z.Origin())
+	}
+	return z
+}
+
+func TestZone_Lookup(t *testing.T) {
+	z := mustParse(t)
+
+	nameTests := []struct {
+		name string
+		want Action
+		hit  bool
+	}{
+		{"nxdomain.com.", ActionNXDomain, true},
+		{"a.nxdomain.com.", ActionNXDomain, true},
+		{"PassThru.nxdomain.com.", ActionPassthru, true},
+		{"nodata.com.", ActionNoData, true},
+		{"a.nodata.com.", 0, false},
+		{"drop.com.", ActionDrop, true},
+		{"tcp.com.", ActionTCPOnly, true},
+		{"local.com.", ActionLocalData, true},
+		{"wild.com.", 0, false},
+		{"example.com.", 0, false},
+	}
+	for _, tt := range nameTests {
+		r := z.LookupQName(tt.name)
+		if (r != nil) != tt.hit || (r != nil && r.Action != tt.want) {
+			t.Errorf("LookupQName(%s) = %v, want hit %v action %s", tt.name, r, tt.hit, tt.want)
+		}
+	}
+
+	ipTests := []struct {
+		addr string
+		want Action
+		hit  bool
+	}{
+		{"192.0.2.1", ActionPassthru, true}, // longest prefix wins
+		{"192.0.2.2", ActionNXDomain, true},
+		{"::ffff:192.0.2.2", ActionNXDomain, true},
+		{"192.0.3.1", 0, false},
+		{"2001:db8::1", ActionNoData, true},
+		{"2001:db9::1", 0, false},
+	}
+	for _, tt := range ipTests {
+		r := z.LookupIP(netip.MustParseAddr(tt.addr))
+		if (r != nil) != tt.hit || (r != nil && r.Action != tt.want) {
+			t.Errorf("LookupIP(%s) = %v, want hit %v action %s", tt.addr, r, tt.hit, tt.want)
+		}
+	}
+
+	if r := z.LookupClientIP(netip.MustParseAddr("127.0.0.1")); r == nil || r.Action != ActionDrop {
+		t.Error("client ip trigger failed")
+	}
+	if r := z.LookupNSDName("ns.evil.com."); r == nil || r.Action != ActionNXDomain {
+		t.Error("nsdname trigger failed")
+	}
+	if r := z.LookupNSIP(netip.MustParseAddr("203.0.113.53")); r == nil || r.Action != ActionNXDomain {
+		t.Error("nsip trigger failed")
+	}
+}
+
+func TestRule_Response(t *testing.T) {
+	z := mustParse(t)
+	query := func(name string, typ uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		return q
+	}
+
+	r := z.LookupQName("nxdomain.com.").Response(query("nxdomain.com.", dns.TypeA), true)
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("want NXDOMAIN, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	r = z.LookupQName("nodata.com.").Response(query("nodata.com.", dns.TypeA), true)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+
+	rule := z.LookupQName("tcp.com.")
+	if r := rule.Response(query("tcp.com.", dns.TypeA), true); r == nil || !r.Truncated {
+		t.Fatal("want truncated response for udp query")
+	}
+	if r := rule.Response(query("tcp.com.", dns.TypeA), false); r != nil {
+		t.Fatal("want no rewrite for tcp query")
+	}
+
+	rule = z.LookupQName("local.com.")
+	if r := rule.Response(query("local.com.", dns.TypeA), true); len(r.Answer) != 2 {
+		t.Fatalf("want 2 A records, got %v", r.Answer)
+	}
+	if r := rule.Response(query("local.com.", dns.TypeTXT), true); len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Fatalf("want NODATA for missing type, got %v", r)
+	}
+
+	r = z.LookupQName("a.wild.com.").Response(query("a.wild.com.", dns.TypeA), true)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.CNAME).Target != "a.wild.com.garden." {
+		t.Fatalf("unexpected wildcard cname response %v", r.Answer)
+	}
+}
+
+func Test_parseIPTrigger(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32", false},
+		{"8.0.0.0.10", "10.0.0.0/8", false},
+		{"128.1.zz.db8.2001", "2001:db8::1/128", false},
+		{"128.1.zz", "::1/128", false},
+		{"64.zz.1.0.db8.2001", "2001:db8:0:1::/64", false},
+		{"24.1.2.0.192", "", true}, // not a network address
+		{"33.1.2.0.192", "", true},
+		{"abc.1.2.0.192", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseIPTrigger(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIPTrigger(%s) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseIPTrigger(%s) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDupTask = errors.New("duplicated task name")
+	ErrClosed  = errors.New("scheduler is closed")
+)
+
+// Func is a task function. ctx is canceled when the task is canceled.
+type Func func(ctx context.Context) error
+
+// Schedule returns the delay until the next run. err is the
+// result of the last run.
+type Schedule func(err error) time.Duration
+
+// Every returns a Schedule that runs the task every d.
+func Every(d time.Duration) Schedule {
+	return func(error) time.Duration { return d }
+}
+
+type TaskOpts struct {
+	Name     string
+	Func     Func
+	Schedule Schedule
+
+	// Delay is the delay of the first run. Default is Schedule(nil).
+	Delay time.Duration
+}
+
+// Scheduler runs periodic tasks and keeps their status.
+type Scheduler struct {
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	tasks  map[string]*Task
+	closed bool
+}
+
+// NewScheduler creates a Scheduler. lg can be nil.
+func NewScheduler(lg *zap.Logger) *Scheduler {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	return &Scheduler{
+		logger: lg,
+		tasks:  make(map[string]*Task),
+	}
+}
+
+// Add adds a task and starts it.
+func (s *Scheduler) Add(opts TaskOpts) (*Task, error) {
+	if len(opts.Name) == 0 || opts.Func == nil || opts.Schedule == nil {
+		return nil, errors.New("task name, func and schedule are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if _, dup := s.tasks[opts.Name]; dup {
+		return nil, fmt.Errorf("%w: %s", ErrDupTask, opts.Name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Task{
+		s:        s,
+		name:     opts.Name,
+		f:        opts.Func,
+		schedule: opts.Schedule,
+		ctx:      ctx,
+		cancel:   cancel,
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	delay := opts.Delay
+	if delay <= 0 {
+		delay = opts.Schedule(nil)
+	}
+	s.tasks[t.name] = t
+	go t.loop(delay)
+	return t, nil
+}
+
+// Get returns the task. It returns nil if there is no such task.
+func (s *Scheduler) Get(name string) *Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tasks[name]
+}
+
+// Status returns the status of all tasks, sorted by name.
+func (s *Scheduler) Status() []TaskStatus {
+	s.mu.Lock()
+	ts := make([]*Task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		ts = append(ts, t)
+	}
+	s.mu.Unlock()
+
+	out := make([]TaskStatus, 0, len(ts))
+	for _, t := range ts {
+		out = append(out, t.Status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// CancelPrefix cancels the tasks whose names have the prefix and returns
+// their options, so that they can be added back.
+func (s *Scheduler) CancelPrefix(prefix string) []TaskOpts {
+	s.mu.Lock()
+	var ts []*Task
+	for name, t := range s.tasks {
+		if strings.HasPrefix(name, prefix) {
+			ts = append(ts, t)
+		}
+	}
+	s.mu.Unlock()
+
+	opts := make([]TaskOpts, 0, len(ts))
+	for _, t := range ts {
+		t.Cancel()
+		opts = append(opts, TaskOpts{Name: t.name, Func: t.f, Schedule: t.schedule})
+	}
+	return opts
+}
+
+// Close cancels all tasks and waits for them to exit.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	ts := make([]*Task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		ts = append(ts, t)
+	}
+	s.mu.Unlock()
+
+	for _, t := range ts {
+		t.Cancel()
+	}
+}
+
+// ServeHTTP serves the task status api.
+//
+//	GET  .../tasks          lists the status of all tasks.
+//	POST .../run?task=name  runs the task now.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/tasks"):
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Status())
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/run"):
+		name := req.URL.Query().Get("task")
+		t := s.Get(name)
+		if t == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("task %s not found", name)))
+			return
+		}
+		t.Trigger()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type Task struct {
+	s        *Scheduler
+	name     string
+	f        Func
+	schedule Schedule
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	trigger chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	status TaskStatus
+}
+
+type TaskStatus struct {
+	Name         string        `json:"name"`
+	Running      bool          `json:"running"`
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+	NextRun      time.Time     `json:"next_run"`
+	RunTotal     uint64        `json:"run_total"`
+	ErrTotal     uint64        `json:"err_total"`
+}
+
+func (t *Task) Name() string {
+	return t.name
+}
+
+// Status returns a snapshot of the task status.
+func (t *Task) Status() TaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.status
+	s.Name = t.name
+	return s
+}
+
+// Trigger runs the task as soon as possible. If the task is running,
+// it will be run again after the current run.
+func (t *Task) Trigger() {
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel removes the task from its scheduler, cancels the running
+// run and waits for it to exit.
+func (t *Task) Cancel() {
+	t.s.mu.Lock()
+	if t.s.tasks[t.name] == t {
+		delete(t.s.tasks, t.name)
+	}
+	t.s.mu.Unlock()
+
+	t.cancel()
+	<-t.done
+}
+
+func (t *Task) loop(delay time.Duration) {
+	defer close(t.done)
+
+	t.setNextRun(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-t.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-t.ctx.Done():
+			return
+		}
+
+		err := t.run()
+		if t.ctx.Err() != nil {
+			return
+		}
+		delay := t.schedule(err)
+		t.setNextRun(delay)
+		timer.Reset(delay)
+	}
+}
+
+func (t *Task) setNextRun(delay time.Duration) {
+	t.mu.Lock()
+	t.status.NextRun = time.Now().Add(delay)
+	t.mu.Unlock()
+}
+
+func (t *Task) run() error {
+	start := time.Now()
+	t.mu.Lock()
+	t.status.Running = true
+	t.status.LastRun = start
+	t.mu.Unlock()
+
+	err := t.f(t.ctx)
+
+	t.mu.Lock()
+	t.status.Running = false
+	t.status.LastDuration = time.Since(start)
+	t.status.RunTotal++
+	if err != nil {
+		t.status.ErrTotal++
+		t.status.LastError = err.Error()
+	} else {
+		t.status.LastError = ""
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		t.s.logger.Debug("task failed", zap.String("task", t.name), zap.Error(err))
+	} else {
+		t.s.logger.Debug("task finished", zap.String("task", t.name))
+	}
+	return err
+}
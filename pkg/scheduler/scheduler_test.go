@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitRuns(t *testing.T, task *Task, want uint64) TaskStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if s := task.Status(); s.RunTotal >= want && !s.Running {
+			return s
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("task did not run %d times", want)
+	return TaskStatus{}
+}
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(nil)
+	defer s.Close()
+
+	var n int32
+	task, err := s.Add(TaskOpts{
+		Name: "t",
+		Func: func(ctx context.Context) error {
+			if atomic.AddInt32(&n, 1) == 1 {
+				return errors.New("first run failed")
+			}
+			return nil
+		},
+		Schedule: func(err error) time.Duration {
+			if err != nil {
+				return time.Millisecond * 10 // retry
+			}
+			return time.Hour
+		},
+		Delay: time.Millisecond * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(TaskOpts{Name: "t", Func: task.f, Schedule: Every(time.Hour)}); !errors.Is(err, ErrDupTask) {
+		t.Fatalf("want ErrDupTask, got %v", err)
+	}
+
+	st := waitRuns(t, task, 2)
+	if st.ErrTotal != 1 || len(st.LastError) != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if time.Until(st.NextRun) < time.Minute {
+		t.Fatalf("next run should follow the schedule, got %s", st.NextRun)
+	}
+
+	task.Trigger()
+	waitRuns(t, task, 3)
+
+	task.Cancel()
+	if s.Get("t") != nil {
+		t.Fatal("canceled task is still in the scheduler")
+	}
+}
+
+func TestScheduler_ServeHTTP(t *testing.T) {
+	s := NewScheduler(nil)
+	defer s.Close()
+	task, err := s.Add(TaskOpts{
+		Name:     "data_provider/a/fetch",
+		Func:     func(ctx context.Context) error { return nil },
+		Schedule: Every(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/scheduler/run?task=data_provider/a/fetch", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	waitRuns(t, task, 1)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scheduler/tasks", nil))
+	var status []TaskStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].Name != "data_provider/a/fetch" || status[0].RunTotal != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/scheduler/run?task=none", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
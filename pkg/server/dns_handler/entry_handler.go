@@ -21,7 +21,9 @@ package dns_handler
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
@@ -45,7 +47,8 @@ type Handler interface {
 	// Implements must not keep and use req after the ServeDNS returned.
 	// ServeDNS should handle dns errors by itself and return a proper error responses
 	// for clients.
-	// ServeDNS should always return a responses.
+	// ServeDNS should always return a responses, unless the query should
+	// be dropped silently. In this case, it returns a nil response.
 	// If ServeDNS returns an error, caller considers that the error is associated
 	// with the downstream connection and will close the downstream connection
 	// immediately.
@@ -65,6 +68,24 @@ type EntryHandlerOpts struct {
 
 	// RecursionAvailable sets the dns.Msg.RecursionAvailable flag globally.
 	RecursionAvailable bool
+
+	// Tracer selects queries to be traced. Optional.
+	Tracer QueryTracer
+
+	// NSID is the server identity that answers NSID requests (RFC 5001).
+	// Optional.
+	NSID string
+}
+
+// QueryTracer selects queries to be traced.
+type QueryTracer interface {
+	// StartTrace enables the tracing of qCtx by query_context.Context.SetTrace
+	// if the query should be traced.
+	StartTrace(qCtx *query_context.Context)
+
+	// FinishTrace is called with the final response and the error of
+	// the entry when a traced query is done.
+	FinishTrace(qCtx *query_context.Context, resp *dns.Msg, err error)
 }
 
 func (opts *EntryHandlerOpts) Init() error {
@@ -104,6 +125,10 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 
 	// exec entry
 	qCtx := query_context.NewContext(req, meta)
+	defer qCtx.Release()
+	if h.opts.Tracer != nil {
+		h.opts.Tracer.StartTrace(qCtx)
+	}
 	err := h.opts.Entry.Exec(ctx, qCtx, nil)
 	respMsg := qCtx.R()
 	if err != nil {
@@ -115,6 +140,12 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		h.opts.Logger.Error("entry returned an nil response", qCtx.InfoField())
 	}
 
+	// The EDE set by the entry is only attached to its response. A
+	// dropped response is replaced with a SERVFAIL without it.
+	ede := qCtx.EDE()
+	if respMsg == nil {
+		ede = nil
+	}
 	if respMsg == nil || err != nil {
 		respMsg = new(dns.Msg)
 		respMsg.SetReply(req)
@@ -124,9 +155,59 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	if h.opts.RecursionAvailable {
 		respMsg.RecursionAvailable = true
 	}
+	h.addEDNS0Options(req, respMsg, ede, err)
+	if h.opts.Tracer != nil && qCtx.Trace() != nil {
+		h.opts.Tracer.FinishTrace(qCtx, respMsg, err)
+	}
 	return respMsg, nil
 }
 
+// addEDNS0Options adds the NSID and the extended DNS error ede, which can
+// be nil, to r if the client supports EDNS0. err is the error from the
+// entry.
+func (h *EntryHandler) addEDNS0Options(req, r *dns.Msg, ede *dns.EDNS0_EDE, err error) {
+	qOpt := req.IsEdns0()
+	if qOpt == nil {
+		return
+	}
+
+	var options []dns.EDNS0
+	if len(h.opts.NSID) > 0 && dnsutils.GetEDNS0Option(qOpt, dns.EDNS0NSID) != nil {
+		options = append(options, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(h.opts.NSID))})
+	}
+	if ede == nil && errors.Is(err, context.DeadlineExceeded) {
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "query timeout"}
+	}
+	if ede != nil {
+		options = append(options, &dns.EDNS0_EDE{InfoCode: ede.InfoCode, ExtraText: ede.ExtraText})
+	}
+	if len(options) == 0 {
+		return
+	}
+
+	rOpt := r.IsEdns0()
+	if rOpt == nil {
+		rOpt = dnsutils.UpgradeEDNS0(r)
+		rOpt.SetUDPSize(qOpt.UDPSize())
+	}
+	// Keep the padding option, if any, at the end, and shrink it by the
+	// length of the new options, so the padded length is kept.
+	if n := len(rOpt.Option); n > 0 && rOpt.Option[n-1].Option() == dns.EDNS0PADDING {
+		padding := rOpt.Option[n-1]
+		l := r.Len()
+		rOpt.Option = append(append(rOpt.Option[:n-1], options...), padding)
+		if pd, ok := padding.(*dns.EDNS0_PADDING); ok {
+			paddingLen := len(pd.Padding) - (r.Len() - l)
+			if paddingLen < 0 {
+				paddingLen = 0
+			}
+			pd.Padding = make([]byte, paddingLen)
+		}
+		return
+	}
+	rOpt.Option = append(rOpt.Option, options...)
+}
+
 type DummyServerHandler struct {
 	T       *testing.T
 	WantMsg *dns.Msg
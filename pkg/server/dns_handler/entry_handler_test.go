@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+type edeExecutable struct {
+	code uint16
+	err  error
+	drop bool
+}
+
+func (e *edeExecutable) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.drop {
+		qCtx.SetEDE(e.code, "test")
+		qCtx.SetResponse(nil)
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+	dnsutils.PadToMinimum(r, 468)
+	qCtx.SetResponse(r)
+	qCtx.SetEDE(e.code, "test")
+	return nil
+}
+
+func TestEntryHandler_EDNS0Options(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    *edeExecutable
+		edns0    bool
+		wantNSID bool
+		wantEDE  int // -1 means no EDE
+	}{
+		{"no edns0", &edeExecutable{code: dns.ExtendedErrorCodeBlocked}, false, false, -1},
+		{"blocked", &edeExecutable{code: dns.ExtendedErrorCodeBlocked}, true, true, int(dns.ExtendedErrorCodeBlocked)},
+		{"timeout", &edeExecutable{err: context.DeadlineExceeded}, true, true, int(dns.ExtendedErrorCodeNoReachableAuthority)},
+		{"dropped", &edeExecutable{code: dns.ExtendedErrorCodeFiltered, drop: true}, true, true, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewEntryHandler(EntryHandlerOpts{Entry: tt.entry, NSID: "ns1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns0 {
+				opt := dnsutils.UpgradeEDNS0(q)
+				opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+			}
+			r, err := h.ServeDNS(context.Background(), q, new(query_context.RequestMeta))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opt := r.IsEdns0()
+			if opt == nil {
+				if tt.wantNSID || tt.wantEDE >= 0 {
+					t.Fatal("response has no OPT")
+				}
+				return
+			}
+			if padded := tt.entry.err == nil && !tt.entry.drop; padded {
+				if n := len(opt.Option); n == 0 || opt.Option[n-1].Option() != dns.EDNS0PADDING {
+					t.Fatal("padding should be the last option")
+				}
+				if r.Len() != 468 {
+					t.Fatalf("padded length is not kept, got %d", r.Len())
+				}
+			}
+			nsid, _ := dnsutils.GetEDNS0Option(opt, dns.EDNS0NSID).(*dns.EDNS0_NSID)
+			if tt.wantNSID != (nsid != nil && nsid.Nsid == "6e7331") {
+				t.Fatalf("unexpected NSID %v", nsid)
+			}
+			ede, _ := dnsutils.GetEDNS0Option(opt, dns.EDNS0EDE).(*dns.EDNS0_EDE)
+			if (tt.wantEDE < 0) != (ede == nil) || (ede != nil && int(ede.InfoCode) != tt.wantEDE) {
+				t.Fatalf("unexpected EDE %v", ede)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/netip"
+	"sync"
+)
+
+// Overflow policies of LimitHandler.
+const (
+	OverflowDrop     = "drop"
+	OverflowServFail = "servfail"
+	OverflowRefused  = "refused"
+)
+
+type LimitHandlerOpts struct {
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+
+	Handler Handler
+
+	// MaxQueries limits the number of queries that are being processed.
+	// MaxClientQueries limits it for each client address. Zero means
+	// no limit.
+	MaxQueries       int
+	MaxClientQueries int
+
+	// Overflow is the policy of queries that exceed the limits.
+	// Can be OverflowDrop, OverflowServFail or OverflowRefused.
+	// Default is OverflowDrop.
+	Overflow string
+}
+
+func (opts *LimitHandlerOpts) Init() error {
+	if opts.Logger == nil {
+		opts.Logger = nopLogger
+	}
+	if opts.Handler == nil {
+		return errors.New("nil handler")
+	}
+	if opts.MaxQueries < 0 || opts.MaxClientQueries < 0 {
+		return errors.New("negative limit")
+	}
+	switch opts.Overflow {
+	case "":
+		opts.Overflow = OverflowDrop
+	case OverflowDrop, OverflowServFail, OverflowRefused:
+	default:
+		return fmt.Errorf("invalid overflow policy %s", opts.Overflow)
+	}
+	return nil
+}
+
+// LimitHandler limits the number of concurrently processing queries of
+// the underlying Handler, so a misbehaving client cannot exhaust
+// goroutines or file descriptors.
+type LimitHandler struct {
+	opts LimitHandlerOpts
+
+	sem chan struct{} // nil if there is no global limit
+
+	m       sync.Mutex
+	clients map[netip.Addr]int
+}
+
+func NewLimitHandler(opts LimitHandlerOpts) (*LimitHandler, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	h := &LimitHandler{
+		opts:    opts,
+		clients: make(map[netip.Addr]int),
+	}
+	if opts.MaxQueries > 0 {
+		h.sem = make(chan struct{}, opts.MaxQueries)
+	}
+	return h, nil
+}
+
+// ServeDNS implements Handler.
+// If the query exceeds the limits, it returns a nil response if the
+// overflow policy is OverflowDrop. Otherwise, it returns a SERVFAIL or
+// REFUSED response.
+func (h *LimitHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+			defer func() { <-h.sem }()
+		default:
+			return h.overflow(req, meta)
+		}
+	}
+
+	if client := meta.ClientAddr; h.opts.MaxClientQueries > 0 && client.IsValid() {
+		if !h.acquireClient(client) {
+			return h.overflow(req, meta)
+		}
+		defer h.releaseClient(client)
+	}
+	return h.opts.Handler.ServeDNS(ctx, req, meta)
+}
+
+func (h *LimitHandler) acquireClient(client netip.Addr) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	n := h.clients[client]
+	if n >= h.opts.MaxClientQueries {
+		return false
+	}
+	h.clients[client] = n + 1
+	return true
+}
+
+func (h *LimitHandler) releaseClient(client netip.Addr) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if n := h.clients[client] - 1; n > 0 {
+		h.clients[client] = n
+	} else {
+		delete(h.clients, client)
+	}
+}
+
+func (h *LimitHandler) overflow(req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.opts.Logger.Debug("query limit exceeded", zap.Stringer("client", meta.ClientAddr))
+	var rcode int
+	switch h.opts.Overflow {
+	case OverflowServFail:
+		rcode = dns.RcodeServerFailure
+	case OverflowRefused:
+		rcode = dns.RcodeRefused
+	default:
+		return nil, nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(req, rcode)
+	return r, nil
+}
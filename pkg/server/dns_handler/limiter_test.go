@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) ServeDNS(_ context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	h.started <- struct{}{}
+	<-h.release
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestLimitHandler(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	clientA := &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("127.0.0.1")}
+	clientB := &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("127.0.0.2")}
+
+	tests := []struct {
+		name      string
+		opts      LimitHandlerOpts
+		meta      *query_context.RequestMeta
+		wantRcode int // -1 means dropped
+	}{
+		{"global drop", LimitHandlerOpts{MaxQueries: 1}, clientB, -1},
+		{"global refused", LimitHandlerOpts{MaxQueries: 1, Overflow: OverflowRefused}, clientB, dns.RcodeRefused},
+		{"client servfail", LimitHandlerOpts{MaxClientQueries: 1, Overflow: OverflowServFail}, clientA, dns.RcodeServerFailure},
+		{"other client", LimitHandlerOpts{MaxClientQueries: 1}, clientB, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bh := &blockingHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+			tt.opts.Handler = bh
+			h, err := NewLimitHandler(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Occupies the limits.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.ServeDNS(context.Background(), q, clientA)
+			}()
+			<-bh.started
+
+			resChan := make(chan *dns.Msg, 1)
+			go func() {
+				r, _ := h.ServeDNS(context.Background(), q, tt.meta)
+				resChan <- r
+			}()
+			if tt.wantRcode == dns.RcodeSuccess {
+				<-bh.started
+				close(bh.release)
+			}
+			r := <-resChan
+			switch {
+			case tt.wantRcode == -1 && r != nil:
+				t.Fatalf("want dropped, got %v", r)
+			case tt.wantRcode != -1 && (r == nil || r.Rcode != tt.wantRcode):
+				t.Fatalf("want rcode %d, got %v", tt.wantRcode, r)
+			}
+
+			if tt.wantRcode != dns.RcodeSuccess {
+				close(bh.release)
+			}
+			<-done
+			if len(h.clients) != 0 {
+				t.Fatal("client counter leaked")
+			}
+		})
+	}
+}
@@ -41,7 +41,7 @@ func (s *Server) ServeTLS(l net.Listener) error {
 		tlsConf.Certificates = append(tlsConf.Certificates, cert)
 	}
 
-	if len(tlsConf.Certificates) == 0 {
+	if len(tlsConf.Certificates) == 0 && tlsConf.GetCertificate == nil {
 		return errors.New("missing certificate for tls listener")
 	}
 
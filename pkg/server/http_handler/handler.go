@@ -20,16 +20,18 @@
 package http_handler
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
 	"strings"
@@ -43,14 +45,32 @@ type HandlerOpts struct {
 	// DNSHandler is required.
 	DNSHandler dns_handler.Handler
 
-	// Path specifies the query endpoint. If it is empty, Handler
-	// will ignore the request path.
+	// Path specifies the query endpoint. If both Path and Paths are
+	// empty, Handler will ignore the request path.
 	Path string
 
+	// Paths specifies additional query endpoints.
+	Paths []string
+
+	// AuthTokens and BasicAuth enable the client authentication. If any
+	// of them is not empty, requests must have a "Authorization: Bearer
+	// <token>" header with one of the AuthTokens, or a "Authorization: Basic"
+	// header with one of the BasicAuth credentials ("user:password").
+	AuthTokens []string
+	BasicAuth  []string
+
 	// SrcIPHeader specifies the header that contain client source address.
 	// e.g. "X-Forwarded-For".
 	SrcIPHeader string
 
+	// TrustedProxies is a list of ip addresses and CIDRs of the reverse
+	// proxies. If not empty, the client address is only read from headers
+	// of requests from these proxies. The header is SrcIPHeader, or the
+	// first one of "X-Forwarded-For", "Forwarded" (RFC 7239) and
+	// "X-Real-IP" that the request has. The client address is the last
+	// address in the header that is not a trusted proxy.
+	TrustedProxies []string
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
@@ -63,18 +83,54 @@ func (opts *HandlerOpts) Init() error {
 	if opts.Logger == nil {
 		opts.Logger = nopLogger
 	}
+	for _, p := range append([]string{opts.Path}, opts.Paths...) {
+		if len(p) > 0 && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid path %s, path must start with /", p)
+		}
+	}
+	for _, t := range opts.AuthTokens {
+		if len(t) == 0 {
+			return errors.New("empty auth token")
+		}
+	}
+	for _, c := range opts.BasicAuth {
+		if !strings.Contains(c, ":") {
+			return fmt.Errorf("invalid basic auth credential, want user:password")
+		}
+	}
 	return nil
 }
 
 type Handler struct {
-	opts HandlerOpts
+	opts           HandlerOpts
+	paths          map[string]struct{} // nil means any path
+	trustedProxies *netlist.List       // nil if no trusted proxy
 }
 
 func NewHandler(opts HandlerOpts) (*Handler, error) {
 	if err := opts.Init(); err != nil {
 		return nil, err
 	}
-	return &Handler{opts: opts}, nil
+	h := &Handler{opts: opts}
+	for _, p := range append([]string{opts.Path}, opts.Paths...) {
+		if len(p) == 0 {
+			continue
+		}
+		if h.paths == nil {
+			h.paths = make(map[string]struct{})
+		}
+		h.paths[p] = struct{}{}
+	}
+	if len(opts.TrustedProxies) > 0 {
+		h.trustedProxies = netlist.NewList()
+		for _, s := range opts.TrustedProxies {
+			if err := netlist.LoadFromText(h.trustedProxies, s); err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s, %w", s, err)
+			}
+		}
+		h.trustedProxies.Sort()
+	}
+	return h, nil
 }
 
 func (h *Handler) warnErr(req *http.Request, msg string, err error) {
@@ -89,9 +145,23 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	clientAddr := addrPort.Addr()
+	clientPort := addrPort.Port()
 
 	// read remote addr from header
-	if header := h.opts.SrcIPHeader; len(header) != 0 {
+	if h.trustedProxies != nil {
+		if h.isTrustedProxy(clientAddr) {
+			addr, ok, err := h.readClientAddrFromProxy(req)
+			if err != nil {
+				h.warnErr(req, "failed to get client ip from header", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if ok {
+				clientAddr = addr
+				clientPort = 0 // unknown
+			}
+		}
+	} else if header := h.opts.SrcIPHeader; len(header) != 0 {
 		if xff := req.Header.Get(header); len(xff) != 0 {
 			addr, err := readClientAddrFromXFF(xff)
 			if err != nil {
@@ -100,13 +170,28 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 			clientAddr = addr
+			clientPort = 0 // unknown
 		}
 	}
 
 	// check url path
-	if len(h.opts.Path) != 0 && req.URL.Path != h.opts.Path {
-		w.WriteHeader(http.StatusNotFound)
-		h.warnErr(req, "invalid request", fmt.Errorf("invalid request path %s", req.URL.Path))
+	if h.paths != nil {
+		if _, ok := h.paths[req.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			h.warnErr(req, "invalid request", fmt.Errorf("invalid request path %s", req.URL.Path))
+			return
+		}
+	}
+
+	if !h.authenticate(req) {
+		h.warnErr(req, "request denied", errUnauthorized)
+		if len(h.opts.AuthTokens) > 0 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		if len(h.opts.BasicAuth) > 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="mosdns"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
@@ -114,14 +199,37 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	q, err := ReadMsgFromReq(req)
 	if err != nil {
 		h.warnErr(req, "invalid request", err)
-		w.WriteHeader(http.StatusBadRequest)
+		switch {
+		case errors.Is(err, errUnsupportedMethod):
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case errors.Is(err, errInvalidMediaType):
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		return
 	}
 
-	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), q, &query_context.RequestMeta{ClientAddr: clientAddr})
+	meta := &query_context.RequestMeta{
+		ClientAddr: clientAddr,
+		ClientPort: clientPort,
+		Protocol:   query_context.ProtocolHTTP,
+	}
+	if req.TLS != nil {
+		meta.Protocol = query_context.ProtocolHTTPS
+		meta.ServerName = req.TLS.ServerName
+	}
+	if la, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		meta.ServerAddr = la.AddrPort().Addr().Unmap()
+	}
+	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), q, meta)
 	if err != nil {
 		panic(err.Error()) // Force http server to close connection.
 	}
+	if r == nil { // dropped
+		panic(http.ErrAbortHandler)
+	}
 
 	b, buf, err := pool.PackBuffer(r)
 	if err != nil {
@@ -131,14 +239,143 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	defer buf.Release()
 
-	w.Header().Set("Content-Type", "application/dns-message")
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dnsutils.GetMinimalTTL(r)))
+	w.Header().Set("Content-Type", mimeDNSMessage)
+	w.Header().Set("Cache-Control", cacheControl(r))
 	if _, err := w.Write(b); err != nil {
 		h.warnErr(req, "failed to write response", err)
 		return
 	}
 }
 
+var errUnauthorized = errors.New("missing or invalid credential")
+
+// authenticate reports whether req has a valid credential. It always
+// returns true if the authentication is disabled.
+func (h *Handler) authenticate(req *http.Request) bool {
+	if len(h.opts.AuthTokens)+len(h.opts.BasicAuth) == 0 {
+		return true
+	}
+
+	var got string
+	var credentials []string
+	auth := req.Header.Get("Authorization")
+	scheme, param, _ := strings.Cut(auth, " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		got, credentials = param, h.opts.AuthTokens
+	case strings.EqualFold(scheme, "Basic"):
+		b, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return false
+		}
+		got, credentials = string(b), h.opts.BasicAuth
+	default:
+		return false
+	}
+
+	ok := false
+	for _, c := range credentials {
+		// Always compare all credentials.
+		if subtle.ConstantTimeCompare([]byte(got), []byte(c)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (h *Handler) isTrustedProxy(addr netip.Addr) bool {
+	ok, _ := h.trustedProxies.Match(addr.Unmap())
+	return ok
+}
+
+// errUnknownNode is returned by parseForwardedFor if the node is "unknown"
+// or an obfuscated identifier (RFC 7239 6.2, 6.3).
+var errUnknownNode = errors.New("unknown or obfuscated node")
+
+// readClientAddrFromProxy reads the client address from the headers of a
+// request from a trusted proxy. ok is false if the request has no header,
+// or the nearest untrusted node in the Forwarded header is unknown or
+// obfuscated. The peer address should be used then.
+func (h *Handler) readClientAddrFromProxy(req *http.Request) (addr netip.Addr, ok bool, err error) {
+	headers := []string{"X-Forwarded-For", "Forwarded", "X-Real-IP"}
+	if len(h.opts.SrcIPHeader) > 0 {
+		headers = []string{h.opts.SrcIPHeader}
+	}
+	for _, header := range headers {
+		values := req.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		// Multiple headers are the same as one header with
+		// comma separated values.
+		var addrs []string
+		for _, v := range values {
+			for _, e := range strings.Split(v, ",") {
+				addrs = append(addrs, strings.TrimSpace(e))
+			}
+		}
+		var parse func(s string) (netip.Addr, error)
+		switch http.CanonicalHeaderKey(header) {
+		case "Forwarded":
+			parse = parseForwardedFor
+		default:
+			parse = parseAddrMaybePort
+		}
+
+		// Walk from the right, which is added by the nearest proxy.
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr, err = parse(addrs[i])
+			if err == errUnknownNode {
+				return netip.Addr{}, false, nil
+			}
+			if err != nil {
+				return netip.Addr{}, false, fmt.Errorf("invalid header %s: %s, %w", header, addrs[i], err)
+			}
+			if i == 0 || !h.isTrustedProxy(addr) {
+				return addr.Unmap(), true, nil
+			}
+		}
+	}
+	return netip.Addr{}, false, nil
+}
+
+// parseForwardedFor parses the "for" parameter of a forwarded-element
+// of the Forwarded header. e.g. `for=192.0.2.60;proto=https`,
+// `for="[2001:db8::1]:4711"`, `for="192.0.2.60:_port"`.
+// It returns errUnknownNode if the node is "unknown" or obfuscated.
+func parseForwardedFor(s string) (netip.Addr, error) {
+	for _, pair := range strings.Split(s, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if !strings.EqualFold(k, "for") {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		if strings.EqualFold(v, "unknown") || strings.HasPrefix(v, "_") {
+			return netip.Addr{}, errUnknownNode
+		}
+		// Remove the obfuscated port.
+		if i := strings.LastIndex(v, ":_"); i > 0 {
+			v = v[:i]
+		}
+		return parseAddrMaybePort(v)
+	}
+	return netip.Addr{}, errors.New("missing for parameter")
+}
+
+// parseAddrMaybePort parses an ip address that may have a port,
+// e.g. "192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80", "2001:db8::1".
+func parseAddrMaybePort(s string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr, nil
+	}
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addrPort.Addr(), nil
+}
+
 func readClientAddrFromXFF(s string) (netip.Addr, error) {
 	if i := strings.IndexRune(s, ','); i > 0 {
 		return netip.ParseAddr(s[:i])
@@ -146,7 +383,63 @@ func readClientAddrFromXFF(s string) (netip.Addr, error) {
 	return netip.ParseAddr(s)
 }
 
-var errInvalidMediaType = errors.New("missing or invalid media type header")
+// cacheControl returns the Cache-Control header value for r. As RFC 8484
+// 5.1 suggested, the freshness lifetime is the smallest ttl in the answer
+// section. For negative responses, it is the negative caching ttl from
+// the SOA record (RFC 2308). Other failures are not cacheable.
+func cacheControl(r *dns.Msg) string {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return "no-cache"
+	}
+
+	var maxAge uint32
+	if r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
+		maxAge = ^uint32(0)
+		for _, rr := range r.Answer {
+			if ttl := rr.Header().Ttl; ttl < maxAge {
+				maxAge = ttl
+			}
+		}
+	} else {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				maxAge = soa.Hdr.Ttl
+				if soa.Minttl < maxAge {
+					maxAge = soa.Minttl
+				}
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("max-age=%d", maxAge)
+}
+
+const mimeDNSMessage = "application/dns-message"
+
+var (
+	errInvalidMediaType  = errors.New("missing or invalid media type header")
+	errUnsupportedMethod = errors.New("unsupported method")
+)
+
+// acceptDNSMessage reports whether the Accept header value s accepts
+// "application/dns-message". An empty header accepts any type.
+func acceptDNSMessage(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, t := range strings.Split(s, ",") {
+		if i := strings.IndexByte(t, ';'); i >= 0 {
+			t = t[:i]
+		}
+		switch strings.TrimSpace(t) {
+		case mimeDNSMessage, "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
 
 var bufPool = pool.NewBytesBufPool(512)
 
@@ -156,7 +449,7 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 	switch req.Method {
 	case http.MethodGet:
 		// Check accept header
-		if req.Header.Get("Accept") != "application/dns-message" {
+		if !acceptDNSMessage(req.Header.Get("Accept")) {
 			return nil, errInvalidMediaType
 		}
 
@@ -177,7 +470,7 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 
 	case http.MethodPost:
 		// Check Content-Type header
-		if req.Header.Get("Content-Type") != "application/dns-message" {
+		if req.Header.Get("Content-Type") != mimeDNSMessage {
 			return nil, errInvalidMediaType
 		}
 
@@ -189,7 +482,7 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 		}
 		b = buf.Bytes()
 	default:
-		return nil, fmt.Errorf("unsupported method: %s", req.Method)
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMethod, req.Method)
 	}
 
 	m := new(dns.Msg)
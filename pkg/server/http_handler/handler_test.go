@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestHandler_ServeHTTP(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}},
+	}
+	h, err := NewHandler(HandlerOpts{
+		DNSHandler: &dns_handler.DummyServerHandler{T: t, WantMsg: resp},
+		Path:       "/dns-query",
+		Paths:      []string{"/resolve"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path, accept string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path+"?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		return req
+	}
+	post := func(path, contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(wire))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+	}{
+		{"get", get("/dns-query", mimeDNSMessage), http.StatusOK},
+		{"get without accept", get("/dns-query", ""), http.StatusOK},
+		{"get with wildcard accept", get("/dns-query", "text/html, */*;q=0.8"), http.StatusOK},
+		{"get with invalid accept", get("/dns-query", "text/html"), http.StatusUnsupportedMediaType},
+		{"get without dns param", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{"get with invalid base64", httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil), http.StatusBadRequest},
+		{"post", post("/dns-query", mimeDNSMessage), http.StatusOK},
+		{"post to additional path", post("/resolve", mimeDNSMessage), http.StatusOK},
+		{"post with invalid content type", post("/dns-query", "text/plain"), http.StatusUnsupportedMediaType},
+		{"invalid path", post("/", mimeDNSMessage), http.StatusNotFound},
+		{"invalid method", httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.RemoteAddr = "127.0.0.1:5353"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Cache-Control"); got != "max-age=60" {
+				t.Fatalf("unexpected Cache-Control %s", got)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_cacheControl(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 300}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}}
+	tests := []struct {
+		name  string
+		rcode int
+		ans   []dns.RR
+		ns    []dns.RR
+		want  string
+	}{
+		{"answer", dns.RcodeSuccess, []dns.RR{a}, []dns.RR{soa}, "max-age=30"},
+		{"nodata", dns.RcodeSuccess, nil, []dns.RR{soa}, "max-age=300"},
+		{"nxdomain", dns.RcodeNameError, nil, []dns.RR{soa}, "max-age=300"},
+		{"nxdomain without soa", dns.RcodeNameError, nil, nil, "max-age=0"},
+		{"servfail", dns.RcodeServerFailure, nil, nil, "no-cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.Rcode = tt.rcode
+			r.Answer = tt.ans
+			r.Ns = tt.ns
+			if got := cacheControl(r); got != tt.want {
+				t.Errorf("cacheControl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_authenticate(t *testing.T) {
+	h, err := NewHandler(HandlerOpts{
+		DNSHandler: &dns_handler.DummyServerHandler{T: t},
+		AuthTokens: []string{"token1", "token2"},
+		BasicAuth:  []string{"user:pass"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic := func(s string) string { return "Basic " + base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name string
+		auth string
+		want bool
+	}{
+		{"no header", "", false},
+		{"bearer", "Bearer token2", true},
+		{"bearer lower case scheme", "bearer token1", true},
+		{"invalid bearer", "Bearer token3", false},
+		{"basic", basic("user:pass"), true},
+		{"invalid basic", basic("user:wrong"), false},
+		{"token as basic", basic("token1"), false},
+		{"invalid base64", "Basic !!!", false},
+		{"unknown scheme", "Digest token1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			if len(tt.auth) > 0 {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			if got := h.authenticate(req); got != tt.want {
+				t.Fatalf("authenticate() = %v, want %v", got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+			req.RemoteAddr = "127.0.0.1:5353"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized || len(w.Header().Values("WWW-Authenticate")) != 2 {
+				t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+			}
+		})
+	}
+
+	if _, err := NewHandler(HandlerOpts{DNSHandler: &dns_handler.DummyServerHandler{T: t}, BasicAuth: []string{"user"}}); err == nil {
+		t.Fatal("invalid basic auth credential should fail")
+	}
+}
+
+func TestHandler_readClientAddrFromProxy(t *testing.T) {
+	h, err := NewHandler(HandlerOpts{
+		DNSHandler:     &dns_handler.DummyServerHandler{T: t},
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		header  map[string][]string
+		want    string // empty if no header
+		wantErr bool
+	}{
+		{"no header", nil, "", false},
+		{"xff", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.1", false},
+		{"xff spoofed", map[string][]string{"X-Forwarded-For": {"198.51.100.1, 192.0.2.1, 10.0.0.2"}}, "192.0.2.1", false},
+		{"xff multiple headers", map[string][]string{"X-Forwarded-For": {"198.51.100.1", "192.0.2.1"}}, "192.0.2.1", false},
+		{"xff all trusted", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3", false},
+		{"forwarded", map[string][]string{"Forwarded": {`for="[2001:db8::2]:4711";proto=https, for=2001:db8::1`}}, "2001:db8::2", false},
+		{"forwarded obfuscated", map[string][]string{"Forwarded": {"for=_hidden"}}, "", false},
+		{"forwarded unknown", map[string][]string{"Forwarded": {"for=192.0.2.1, for=unknown"}}, "", false},
+		{"forwarded unknown trusted", map[string][]string{"Forwarded": {"for=unknown, for=10.0.0.2"}}, "", false},
+		{"forwarded obfuscated port", map[string][]string{"Forwarded": {`for="192.0.2.1:_port"`, `for="[2001:db8::2]:_port"`}}, "2001:db8::2", false},
+		{"forwarded invalid", map[string][]string{"Forwarded": {"for=invalid"}}, "", true},
+		{"x-real-ip", map[string][]string{"X-Real-Ip": {"192.0.2.1"}}, "192.0.2.1", false},
+		{"xff first", map[string][]string{"X-Real-Ip": {"192.0.2.1"}, "X-Forwarded-For": {"192.0.2.2"}}, "192.0.2.2", false},
+		{"invalid", map[string][]string{"X-Forwarded-For": {"invalid"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			for k, vs := range tt.header {
+				for _, v := range vs {
+					req.Header.Add(k, v)
+				}
+			}
+			addr, ok, err := h.readClientAddrFromProxy(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected err %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ok != (len(tt.want) > 0) || (ok && addr.String() != tt.want) {
+				t.Fatalf("got %s %v, want %s", addr, ok, tt.want)
+			}
+		})
+	}
+	if !h.isTrustedProxy(netip.MustParseAddr("::ffff:10.1.2.3")) || h.isTrustedProxy(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatal("unexpected trusted proxy result")
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TCPOpts are the socket options of tcp listeners.
+type TCPOpts struct {
+	// FastOpen enables TCP Fast Open (RFC 7413) on the listener, so
+	// clients can send the first request within the SYN packet.
+	// Linux only.
+	FastOpen bool
+
+	// KeepAlive specifies the keep-alive period of accepted
+	// connections. If zero, the go default (15s) is used.
+	// If negative, keepalive probes are disabled.
+	KeepAlive time.Duration
+
+	// UserTimeout sets the TCP_USER_TIMEOUT option of accepted
+	// connections. Linux only.
+	UserTimeout time.Duration
+}
+
+// IsZero reports whether opts has no option set.
+func (opts TCPOpts) IsZero() bool {
+	return opts == TCPOpts{}
+}
+
+// ListenTCP opens a tcp listener on addr with opts.
+func ListenTCP(addr string, opts TCPOpts) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: opts.KeepAlive, Control: tcpListenerControl(false, opts)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
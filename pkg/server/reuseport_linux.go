@@ -0,0 +1,120 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"syscall"
+)
+
+// reusePortListenConfig sets SO_REUSEPORT on sockets, so multiple sockets
+// can be bound to the same address. The kernel distributes connections
+// and packets among them by the client address.
+var reusePortListenConfig = net.ListenConfig{
+	Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = os.NewSyscallError("setsockopt SO_REUSEPORT", unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1))
+		}); err != nil {
+			return err
+		}
+		return serr
+	},
+}
+
+// tfoQueueLen is the max number of pending TCP Fast Open requests.
+const tfoQueueLen = 256
+
+// tcpListenerControl returns the control func that sets SO_REUSEPORT and
+// opts on tcp listeners. Options of the listener are inherited by
+// accepted connections.
+func tcpListenerControl(reusePort bool, opts TCPOpts) func(string, string, syscall.RawConn) error {
+	if !reusePort && !opts.FastOpen && opts.UserTimeout <= 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			if reusePort {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); serr != nil {
+					serr = os.NewSyscallError("setsockopt SO_REUSEPORT", serr)
+					return
+				}
+			}
+			if opts.FastOpen {
+				if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLen); serr != nil {
+					serr = os.NewSyscallError("setsockopt TCP_FASTOPEN", serr)
+					return
+				}
+			}
+			if opts.UserTimeout > 0 {
+				if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(opts.UserTimeout.Milliseconds())); serr != nil {
+					serr = os.NewSyscallError("setsockopt TCP_USER_TIMEOUT", serr)
+					return
+				}
+			}
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// ListenReusePort opens n tcp listeners on addr with SO_REUSEPORT, so
+// each of them can be served by an independent accept loop. opts are
+// applied to all listeners.
+func ListenReusePort(addr string, n int, opts TCPOpts) ([]net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: opts.KeepAlive, Control: tcpListenerControl(true, opts)}
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// ListenPacketReusePort opens n udp sockets on addr with SO_REUSEPORT, so
+// each of them can be served by an independent read loop (and its own
+// hot cache).
+func ListenPacketReusePort(addr string, n int) ([]net.PacketConn, error) {
+	conns := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := reusePortListenConfig.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
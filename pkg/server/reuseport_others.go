@@ -0,0 +1,52 @@
+//go:build !linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var (
+	errReusePortNotSupported = errors.New("SO_REUSEPORT is not supported on this platform")
+	errTCPOptsNotSupported   = errors.New("tcp fast open and user timeout are not supported on this platform")
+)
+
+// tcpListenerControl returns a control func that fails if opts has
+// options that are only supported on linux.
+func tcpListenerControl(_ bool, opts TCPOpts) func(string, string, syscall.RawConn) error {
+	if opts.FastOpen || opts.UserTimeout > 0 {
+		return func(_, _ string, _ syscall.RawConn) error { return errTCPOptsNotSupported }
+	}
+	return nil
+}
+
+// ListenReusePort is only supported on linux.
+func ListenReusePort(_ string, _ int, _ TCPOpts) ([]net.Listener, error) {
+	return nil, errReusePortNotSupported
+}
+
+// ListenPacketReusePort is only supported on linux.
+func ListenPacketReusePort(_ string, _ int) ([]net.PacketConn, error) {
+	return nil, errReusePortNotSupported
+}
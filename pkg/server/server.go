@@ -20,6 +20,7 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
@@ -51,8 +52,8 @@ type ServerOpts struct {
 	HttpHandler http.Handler
 
 	// TLSConfig is required by DoT, DoH server.
-	// It must contain at least one certificate. If not, caller should use
-	// Cert, Key to load a certificate from disk.
+	// It must contain at least one certificate or a GetCertificate func.
+	// If not, caller should use Cert, Key to load a certificate from disk.
 	TLSConfig *tls.Config
 
 	// Certificate files to start DoT, DoH server.
@@ -62,6 +63,14 @@ type ServerOpts struct {
 	// IdleTimeout limits the maximum time period that a connection
 	// can idle. Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// UDPHotCacheSize enables a small cache of each UDP socket. Repeated
+	// queries are answered from it without running the DNSHandler, so it
+	// must only be used if responses do not depend on the client.
+	// UDPHotCacheTTL limits the lifetime of cached responses.
+	// Default is 5s. The TTLs of cached responses are not decreased.
+	UDPHotCacheSize int
+	UDPHotCacheTTL  time.Duration
 }
 
 func (opts *ServerOpts) init() {
@@ -85,6 +94,7 @@ type Server struct {
 	m             sync.Mutex
 	closed        bool
 	closerTracker map[*io.Closer]struct{}
+	drained       chan struct{} // closed when closerTracker becomes empty during Shutdown
 }
 
 func NewServer(opts ServerOpts) *Server {
@@ -118,6 +128,10 @@ func (s *Server) trackCloser(c *io.Closer, add bool) bool {
 		s.closerTracker[c] = struct{}{}
 	} else {
 		delete(s.closerTracker, c)
+		if len(s.closerTracker) == 0 && s.drained != nil {
+			close(s.drained)
+			s.drained = nil
+		}
 	}
 	return true
 }
@@ -127,13 +141,61 @@ func (s *Server) Close() {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	if s.closed {
-		return
-	}
-
 	s.closed = true
 	for closer := range s.closerTracker {
 		(*closer).Close()
 	}
 	return
 }
+
+// Shutdown stops the Server from accepting new queries, and waits for
+// in-flight queries to be answered. Listeners and connections are closed
+// after that. If ctx is done before all queries are answered, Shutdown
+// closes the Server and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	s.closed = true
+	drained := make(chan struct{})
+	if len(s.closerTracker) == 0 {
+		close(drained)
+	} else {
+		s.drained = drained
+	}
+	closers := make([]io.Closer, 0, len(s.closerTracker))
+	for c := range s.closerTracker {
+		closers = append(closers, *c)
+	}
+	s.m.Unlock()
+
+	// Serve funcs wait for in-flight queries before they close their
+	// sockets and connections.
+	wg := new(sync.WaitGroup)
+	for _, c := range closers {
+		switch c := c.(type) {
+		case interface{ Shutdown(ctx context.Context) error }: // http server
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = c.Shutdown(ctx)
+			}()
+		case interface{ SetReadDeadline(t time.Time) error }: // udp socket, tcp connection
+			_ = c.SetReadDeadline(time.Now())
+		default: // listener
+			_ = c.Close()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		<-drained
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
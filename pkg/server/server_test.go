@@ -20,9 +20,11 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/http_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
@@ -249,3 +251,65 @@ func TestDoHServer(t *testing.T) {
 		})
 	}
 }
+
+type slowHandler struct {
+	started chan struct{}
+}
+
+func (h *slowHandler) ServeDNS(_ context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	h.started <- struct{}{}
+	time.Sleep(time.Millisecond * 200)
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			h := &slowHandler{started: make(chan struct{}, 1)}
+			s := NewServer(ServerOpts{DNSHandler: h})
+			var addr string
+			if network == "udp" {
+				l := getUDPListener(t)
+				addr = l.LocalAddr().String()
+				go s.ServeUDP(l)
+			} else {
+				l := getListener(t)
+				addr = l.Addr().String()
+				go s.ServeTCP(l)
+			}
+
+			c, err := dns.Dial(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if err := c.WriteMsg(q); err != nil {
+				t.Fatal(err)
+			}
+			<-h.started
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				shutdownErr <- s.Shutdown(ctx)
+			}()
+
+			c.SetReadDeadline(time.Now().Add(time.Second * 3))
+			r, err := c.ReadMsg()
+			if err != nil {
+				t.Fatalf("in-flight query was not answered, %v", err)
+			}
+			if r.Id != q.Id {
+				t.Fatal("response id mismatched")
+			}
+			if err := <-shutdownErr; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
@@ -29,6 +30,7 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -54,6 +56,8 @@ func (s *Server) ServeTCP(l net.Listener) error {
 	// handle listener
 	listenerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	connWg := new(sync.WaitGroup)
+	defer connWg.Wait()
 	for {
 		c, err := l.Accept()
 		if err != nil {
@@ -65,7 +69,9 @@ func (s *Server) ServeTCP(l net.Listener) error {
 
 		// handle connection
 		tcpConnCtx, cancelConn := context.WithCancel(listenerCtx)
+		connWg.Add(1)
 		go func() {
+			defer connWg.Done()
 			defer c.Close()
 			defer cancelConn()
 
@@ -81,10 +87,26 @@ func (s *Server) ServeTCP(l net.Listener) error {
 				firstReadTimeout = idleTimeout
 			}
 
-			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 			meta := &query_context.RequestMeta{
-				ClientAddr: clientAddr,
+				ClientAddr: utils.GetAddrFromAddr(c.RemoteAddr()),
+				ClientPort: utils.GetPortFromAddr(c.RemoteAddr()),
+				ServerAddr: utils.GetAddrFromAddr(c.LocalAddr()).Unmap(),
+				Protocol:   query_context.ProtocolTCP,
 			}
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				// Handshake first to get the server name.
+				handshakeCtx, cancel := context.WithTimeout(tcpConnCtx, firstReadTimeout)
+				err := tlsConn.HandshakeContext(handshakeCtx)
+				cancel()
+				if err != nil {
+					return
+				}
+				meta.Protocol = query_context.ProtocolTLS
+				meta.ServerName = tlsConn.ConnectionState().ServerName
+			}
+
+			queryWg := new(sync.WaitGroup)
+			defer queryWg.Wait() // in-flight queries are answered before the connection is closed.
 
 			firstRead := true
 			for {
@@ -94,19 +116,28 @@ func (s *Server) ServeTCP(l net.Listener) error {
 				} else {
 					c.SetReadDeadline(time.Now().Add(idleTimeout))
 				}
+				// Shutdown sets the read deadline after the server is closed.
+				if s.Closed() {
+					return
+				}
 				req, _, err := dnsutils.ReadMsgFromTCP(c)
 				if err != nil {
 					return // read err, close the connection
 				}
 
 				// handle query
+				queryWg.Add(1)
 				go func() {
+					defer queryWg.Done()
 					r, err := handler.ServeDNS(tcpConnCtx, req, meta)
 					if err != nil {
 						s.opts.Logger.Warn("handler err", zap.Error(err))
 						c.Close()
 						return
 					}
+					if r == nil { // dropped
+						return
+					}
 
 					b, buf, err := pool.PackBuffer(r)
 					if err != nil {
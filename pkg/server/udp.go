@@ -29,6 +29,9 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 )
 
 // cmcUDPConn can read and write cmsg.
@@ -53,15 +56,21 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 
 	listenerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	queryWg := new(sync.WaitGroup)
+	defer queryWg.Wait() // in-flight queries are answered before the socket is closed.
 
 	readBuf := pool.GetBuf(64 * 1024)
 	defer readBuf.Release()
 	rb := readBuf.Bytes()
 
+	// If the socket is bound to a wildcard address, the destination address
+	// of each query is read from the cmsg, and the response is sent from it.
+	// Otherwise, a multi-homed host may reply from another address.
 	var cmc cmcUDPConn
 	var err error
+	listenAddr := utils.GetAddrFromAddr(c.LocalAddr())
 	uc, ok := c.(*net.UDPConn)
-	if ok && uc.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
+	if ok && listenAddr.IsUnspecified() {
 		cmc, err = newCmc(uc)
 		if err != nil {
 			return fmt.Errorf("failed to control socket cmsg, %w", err)
@@ -70,6 +79,11 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 		cmc = newDummyCmc(c)
 	}
 
+	var hc *hotCache
+	if s.opts.UDPHotCacheSize > 0 {
+		hc = newHotCache(s.opts.UDPHotCacheSize, s.opts.UDPHotCacheTTL)
+	}
+
 	for {
 		n, localAddr, ifIndex, remoteAddr, err := cmc.readFrom(rb)
 		if err != nil {
@@ -78,18 +92,44 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 			}
 			return fmt.Errorf("unexpected read err: %w", err)
 		}
+
+		if hc != nil {
+			if b := hc.get(rb[:n], time.Now()); b != nil {
+				if _, err := cmc.writeTo(b, localAddr, ifIndex, remoteAddr); err != nil {
+					s.opts.Logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+				}
+				continue
+			}
+		}
 		clientAddr := utils.GetAddrFromAddr(remoteAddr)
+		serverAddr := listenAddr
+		if localAddr != nil {
+			serverAddr, _ = netip.AddrFromSlice(localAddr)
+		}
+		if serverAddr.IsUnspecified() {
+			serverAddr = netip.Addr{}
+		}
 
 		q := new(dns.Msg)
 		if err := q.Unpack(rb[:n]); err != nil {
 			s.opts.Logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", rb[:n]), zap.Stringer("from", remoteAddr))
 			continue
 		}
+		var hotCacheKey string
+		if hc != nil && hotCacheableQuery(q) {
+			hotCacheKey = string(rb[2:n])
+		}
 
 		// handle query
+		queryWg.Add(1)
 		go func() {
+			defer queryWg.Done()
 			meta := &query_context.RequestMeta{
 				ClientAddr: clientAddr,
+				ClientPort: utils.GetPortFromAddr(remoteAddr),
+				ServerAddr: serverAddr.Unmap(),
+				FromUDP:    true,
+				Protocol:   query_context.ProtocolUDP,
 			}
 
 			r, err := handler.ServeDNS(listenerCtx, q, meta)
@@ -105,6 +145,9 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 					return
 				}
 				defer buf.Release()
+				if len(hotCacheKey) > 0 {
+					hc.put(hotCacheKey, r, b)
+				}
 				if _, err := cmc.writeTo(b, localAddr, ifIndex, remoteAddr); err != nil {
 					s.opts.Logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
 				}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+const (
+	defaultHotCacheTTL     = time.Second * 5
+	hotCachePendingBufSize = 1024
+)
+
+// hotCache caches packed responses of a udp socket by the raw query,
+// so repeated queries are answered without unpacking them or running
+// the plugins. It is owned by the read loop of the socket and is not
+// locked. Handler goroutines send new entries through a channel, and the
+// read loop adds them before the next lookup.
+type hotCache struct {
+	size    int
+	ttl     time.Duration
+	m       map[string]hotCacheEntry
+	pending chan hotCacheItem
+}
+
+type hotCacheEntry struct {
+	b      []byte // packed response
+	expire time.Time
+}
+
+type hotCacheItem struct {
+	key string
+	e   hotCacheEntry
+}
+
+func newHotCache(size int, ttl time.Duration) *hotCache {
+	if ttl <= 0 {
+		ttl = defaultHotCacheTTL
+	}
+	return &hotCache{
+		size:    size,
+		ttl:     ttl,
+		m:       make(map[string]hotCacheEntry, size),
+		pending: make(chan hotCacheItem, hotCachePendingBufSize),
+	}
+}
+
+// get returns the cached response of the raw query q with its id.
+// It returns nil if there is no valid entry. Called by the read loop.
+func (c *hotCache) get(q []byte, now time.Time) []byte {
+	c.addPending()
+	if len(q) < 12 {
+		return nil
+	}
+	e, ok := c.m[string(q[2:])]
+	if !ok {
+		return nil
+	}
+	if now.After(e.expire) {
+		delete(c.m, string(q[2:]))
+		return nil
+	}
+	b := make([]byte, len(e.b))
+	copy(b, e.b)
+	copy(b[:2], q[:2]) // id
+	return b
+}
+
+func (c *hotCache) addPending() {
+	for {
+		select {
+		case item := <-c.pending:
+			if len(c.m) >= c.size {
+				// Evict an arbitrary entry.
+				for k := range c.m {
+					delete(c.m, k)
+					break
+				}
+			}
+			c.m[item.key] = item.e
+		default:
+			return
+		}
+	}
+}
+
+// put stores the packed response b of r with key, which is the raw
+// query without its id. The query must be checked by hotCacheableQuery.
+// It is safe for concurrent use. Entries are dropped if the read loop is
+// too busy to add them.
+func (c *hotCache) put(key string, r *dns.Msg, b []byte) {
+	if r.Truncated || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := c.ttl
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	item := hotCacheItem{
+		key: key,
+		e:   hotCacheEntry{b: append([]byte(nil), b...), expire: time.Now().Add(ttl)},
+	}
+	select {
+	case c.pending <- item:
+	default:
+	}
+}
+
+// hotCacheableQuery reports whether responses of q can be reused for
+// all queries that are identical to q except the id. Queries with EDNS0
+// options (e.g. ecs, cookies) are client specific.
+func hotCacheableQuery(q *dns.Msg) bool {
+	if len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+		return false
+	}
+	if len(q.Extra) == 1 {
+		opt, ok := q.Extra[0].(*dns.OPT)
+		if !ok || len(opt.Option) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingHandler struct {
+	n int32
+}
+
+func (h *countingHandler) ServeDNS(_ context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	atomic.AddInt32(&h.n, 1)
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	return r, nil
+}
+
+func TestUDPServer_hotCache(t *testing.T) {
+	h := new(countingHandler)
+	l := getUDPListener(t)
+	s := NewServer(ServerOpts{DNSHandler: h, UDPHotCacheSize: 16})
+	go s.ServeUDP(l)
+	defer s.Close()
+
+	c, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exchange := func(q *dns.Msg) *dns.Msg {
+		t.Helper()
+		b, _ := q.Pack()
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second * 3))
+		buf := make([]byte, 512)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		q.Id = uint16(i)
+		r := exchange(q)
+		if r.Id != q.Id || len(r.Answer) != 1 {
+			t.Fatalf("unexpected response %s", r)
+		}
+	}
+	if n := atomic.LoadInt32(&h.n); n != 1 {
+		t.Fatalf("handler should be called once, got %d", n)
+	}
+
+	// Queries with EDNS0 options are not cached.
+	q.SetEdns0(1232, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	exchange(q)
+	exchange(q)
+	if n := atomic.LoadInt32(&h.n); n != 3 {
+		t.Fatalf("handler should be called 3 times, got %d", n)
+	}
+}
+
+func Test_hotCache_expire(t *testing.T) {
+	c := newHotCache(1, time.Second)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	raw, _ := q.Pack()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := r.Pack()
+
+	c.put(string(raw[2:]), r, b)
+	now := time.Now()
+	if c.get(raw, now) == nil {
+		t.Fatal("cache missed")
+	}
+	if c.get(raw, now.Add(time.Second*2)) != nil {
+		t.Fatal("expired entry should not be returned")
+	}
+
+	r.Rcode = dns.RcodeServerFailure
+	c.put(string(raw[2:]), r, b)
+	if c.get(raw, now) != nil {
+		t.Fatal("servfail should not be cached")
+	}
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type serverAddrHandler struct {
+	c chan netip.Addr
+}
+
+func (h *serverAddrHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.c <- meta.ServerAddr
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestUDPServer_wildcardAddr(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &serverAddrHandler{c: make(chan netip.Addr, 1)}
+	s := NewServer(ServerOpts{DNSHandler: h})
+	go s.ServeUDP(l)
+	defer s.Close()
+
+	// 127.0.0.2 is not the primary address of lo. A connected udp socket
+	// drops the response if it was sent from another address.
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	c, err := net.Dial("udp", net.JoinHostPort("127.0.0.2", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	buf := make([]byte, 512)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-h.c; addr != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("unexpected server addr %s", addr)
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ls, err := ListenReusePort(addr, 4, TCPOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		l.Close()
+	}
+	conns, err := ListenPacketReusePort(addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
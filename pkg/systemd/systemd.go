@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package systemd implements the socket activation and the service
+// notification protocols of systemd without linking libsystemd.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Files returns the files passed by systemd socket activation. Their
+// names are from LISTEN_FDNAMES, which is set by FileDescriptorName= of
+// the socket unit. It returns nil if the process is not activated by
+// systemd. The environment variables are unset, so the files will not
+// be passed to child processes, and the following calls return nil.
+func Files() []*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(listenFDsStart+i), name))
+	}
+	return files
+}
+
+// Notify sends state (e.g. "READY=1") to the service manager.
+// It returns false if NOTIFY_SOCKET is not set, which means the service
+// is not supervised by systemd or does not need notifications.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return false, nil
+	}
+	if addr[0] == '@' { // abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout of the service. The
+// service should send "WATCHDOG=1" at least once within it. It returns
+// 0 if the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if p := os.Getenv("WATCHDOG_PID"); len(p) > 0 {
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID, %w", err)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC, %w", err)
+	}
+	if usec == 0 {
+		return 0, errors.New("zero WATCHDOG_USEC")
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minTTL          = time.Second * 5
+	maxTTL          = time.Hour
+	negativeTTL     = time.Second * 30
+	exchangeTimeout = time.Second * 3
+)
+
+// ResolverOpts are options of Resolver.
+type ResolverOpts struct {
+	// Servers are the plain dns servers that resolve hostnames. They
+	// SHOULD be literal IP addresses with optional ports ("ip[:port]").
+	// They are tried in order. If empty, hostnames that are not in Hosts
+	// are resolved by the system resolver.
+	Servers []string
+
+	// Hosts maps hostnames to static addresses. Hostnames in Hosts are
+	// never sent to Servers.
+	Hosts map[string][]netip.Addr
+
+	// Control configures the sockets that connect to Servers. Optional.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// Logger is optional.
+	Logger *zap.Logger
+}
+
+// Resolver resolves hostnames of upstreams without the system resolver,
+// which might point back to mosdns itself. Results are cached and are
+// resolved again after their TTLs expired. If the re-resolution failed,
+// the expired result is used.
+// Resolvers that have the same servers share one cache, so upstreams
+// that use the same bootstrap servers don't resolve the same host twice.
+type Resolver struct {
+	servers []string
+	hosts   map[string][]netip.Addr
+	control func(network, address string, c syscall.RawConn) error
+	logger  *zap.Logger
+	cache   *cache
+}
+
+type cache struct {
+	sf      singleflight.Group
+	m       sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	addrs      []netip.Addr
+	expireTime time.Time
+}
+
+var sharedCaches = struct {
+	sync.Mutex
+	m map[string]*cache
+}{m: make(map[string]*cache)}
+
+// getSharedCache returns the cache of servers.
+func getSharedCache(servers []string) *cache {
+	key := strings.Join(servers, ",")
+	sharedCaches.Lock()
+	defer sharedCaches.Unlock()
+	c := sharedCaches.m[key]
+	if c == nil {
+		c = &cache{entries: make(map[string]*cacheEntry)}
+		sharedCaches.m[key] = c
+	}
+	return c
+}
+
+// NewResolver returns a Resolver. opts must have at least one server
+// or host.
+func NewResolver(opts ResolverOpts) (*Resolver, error) {
+	if len(opts.Servers) == 0 && len(opts.Hosts) == 0 {
+		return nil, errors.New("no bootstrap server or host")
+	}
+	r := &Resolver{
+		hosts:   make(map[string][]netip.Addr, len(opts.Hosts)),
+		control: opts.Control,
+		logger:  opts.Logger,
+	}
+	if r.logger == nil {
+		r.logger = zap.NewNop()
+	}
+	for _, s := range opts.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil { // no port, add it.
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		r.servers = append(r.servers, s)
+	}
+	if len(r.servers) > 0 {
+		r.cache = getSharedCache(r.servers)
+	}
+	for host, addrs := range opts.Hosts {
+		r.hosts[dns.CanonicalName(host)] = addrs
+	}
+	return r, nil
+}
+
+// LookupNetIP looks up host. network must be one of "ip", "ip4" or "ip6".
+// It has the same signature as net.Resolver.LookupNetIP.
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	fqdn := dns.CanonicalName(host)
+
+	var addrs []netip.Addr
+	if static, ok := r.hosts[fqdn]; ok {
+		addrs = static
+	} else if len(r.servers) == 0 {
+		return net.DefaultResolver.LookupNetIP(ctx, network, host)
+	} else {
+		var err error
+		addrs, err = r.lookup(ctx, fqdn)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host}
+		}
+	}
+
+	filtered := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		switch {
+		case network == "ip4" && !addr.Is4(),
+			network == "ip6" && !addr.Is6():
+			continue
+		}
+		filtered = append(filtered, addr)
+	}
+	if len(filtered) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return filtered, nil
+}
+
+// lookup returns the cached addresses of fqdn, or resolves it if the
+// cache is missing or expired.
+func (r *Resolver) lookup(ctx context.Context, fqdn string) ([]netip.Addr, error) {
+	c := r.cache
+	c.m.Lock()
+	e := c.entries[fqdn]
+	c.m.Unlock()
+	if e != nil && time.Now().Before(e.expireTime) {
+		return e.addrs, nil
+	}
+
+	v, err, _ := c.sf.Do(fqdn, func() (interface{}, error) {
+		addrs, ttl, err := r.resolve(ctx, fqdn)
+		if err != nil {
+			return nil, err
+		}
+		c.m.Lock()
+		c.entries[fqdn] = &cacheEntry{addrs: addrs, expireTime: time.Now().Add(ttl)}
+		c.m.Unlock()
+		return addrs, nil
+	})
+	if err != nil {
+		if e != nil {
+			r.logger.Warn("failed to resolve upstream host, using expired addresses", zap.String("host", fqdn), zap.Error(err))
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	return v.([]netip.Addr), nil
+}
+
+// resolve queries A and AAAA records of fqdn concurrently.
+func (r *Resolver) resolve(ctx context.Context, fqdn string) ([]netip.Addr, time.Duration, error) {
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	qtypes := [2]uint16{dns.TypeA, dns.TypeAAAA}
+	var results [2]result
+	var wg sync.WaitGroup
+	for i, qt := range qtypes {
+		i, qt := i, qt
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, ttl, err := r.resolveType(ctx, fqdn, qt)
+			results[i] = result{addrs: addrs, ttl: ttl, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	ttl := maxTTL
+	var errs []string
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, res.err.Error())
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if res.ttl < ttl {
+			ttl = res.ttl
+		}
+	}
+	if len(errs) == len(results) {
+		return nil, 0, errors.New(strings.Join(errs, "; "))
+	}
+	return addrs, ttl, nil
+}
+
+// resolveType queries fqdn with type qt. It tries servers in order.
+func (r *Resolver) resolveType(ctx context.Context, fqdn string, qt uint16) ([]netip.Addr, time.Duration, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(fqdn, qt)
+
+	var lastErr error
+	for _, server := range r.servers {
+		resp, err := r.exchange(ctx, q, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("server %s returned rcode %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var addrs []netip.Addr
+		ttl := maxTTL
+		for _, rr := range resp.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			if !addr.IsValid() {
+				continue
+			}
+			addrs = append(addrs, addr)
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+		if len(addrs) == 0 {
+			ttl = negativeTTL
+		}
+		if ttl < minTTL {
+			ttl = minTTL
+		}
+		return addrs, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+func (r *Resolver) exchange(ctx context.Context, q *dns.Msg, server string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{Control: r.control}}
+	resp, _, err := c.ExchangeContext(ctx, q, server)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, q, server)
+	}
+	return resp, err
+}
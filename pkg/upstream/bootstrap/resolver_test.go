@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, h dns.HandlerFunc) string {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: c, Handler: h}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return c.LocalAddr().String()
+}
+
+func TestResolver_LookupNetIP(t *testing.T) {
+	var queries uint32
+	var fail uint32
+	addr := startTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddUint32(&queries, 1)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if atomic.LoadUint32(&fail) == 1 {
+			r.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(r)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Question[0].Name, Class: dns.ClassINET, Rrtype: q.Question[0].Qtype, Ttl: 300}
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+		case dns.TypeAAAA:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(r)
+	})
+
+	r, err := NewResolver(ResolverOpts{
+		Servers: []string{addr},
+		Hosts:   map[string][]netip.Addr{"static.example": {netip.MustParseAddr("192.0.2.2")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	addrs, err := r.LookupNetIP(ctx, "ip", "dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("want 2 addrs, got %v", addrs)
+	}
+	addrs, err = r.LookupNetIP(ctx, "ip6", "dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("2001:db8::1") {
+		t.Fatalf("want ipv6 addr, got %v", addrs)
+	}
+	if n := atomic.LoadUint32(&queries); n != 2 {
+		t.Fatalf("the second lookup should be cached, got %d queries", n)
+	}
+
+	// Static hosts are not sent to the server.
+	addrs, err = r.LookupNetIP(ctx, "ip", "STATIC.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.2") {
+		t.Fatalf("want static addr, got %v", addrs)
+	}
+	if _, err := r.LookupNetIP(ctx, "ip6", "static.example"); err == nil {
+		t.Fatal("want not found err")
+	}
+
+	// Expired results are resolved again, and are still used if the
+	// server failed.
+	r.cache.m.Lock()
+	r.cache.entries["dns.example."].expireTime = time.Now()
+	r.cache.m.Unlock()
+	atomic.StoreUint32(&fail, 1)
+	addrs, err = r.LookupNetIP(ctx, "ip", "dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("want expired addrs, got %v", addrs)
+	}
+	if n := atomic.LoadUint32(&queries); n != 4 {
+		t.Fatalf("want 4 queries, got %d", n)
+	}
+}
+
+func TestResolver_sharedCache(t *testing.T) {
+	var queries uint32
+	addr := startTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddUint32(&queries, 1)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if q.Question[0].Qtype == dns.TypeA {
+			hdr := dns.RR_Header{Name: q.Question[0].Name, Class: dns.ClassINET, Rrtype: dns.TypeA, Ttl: 300}
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+		}
+		w.WriteMsg(r)
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		r, err := NewResolver(ResolverOpts{Servers: []string{addr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.LookupNetIP(ctx, "ip", "shared.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadUint32(&queries); n != 2 {
+		t.Fatalf("resolvers with the same servers should share the cache, got %d queries", n)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	dnscryptv2 "github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"net"
+	"strings"
+	"time"
+)
+
+// fetchResolverInfo fetches the certificate of the resolver through the udp
+// conn and returns a ResolverInfo with a new client key pair. It does the same
+// as dnscryptv2.Client.DialStamp, which cannot use a custom dialer.
+func fetchResolverInfo(ctx context.Context, conn net.Conn, stamp dnsstamps.ServerStamp) (*dnscryptv2.ResolverInfo, error) {
+	cert, err := fetchCert(ctx, conn, stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &dnscryptv2.ResolverInfo{
+		ServerPublicKey: stamp.ServerPk,
+		ServerAddress:   stamp.ServerAddrStr,
+		ProviderName:    stamp.ProviderName,
+		ResolverCert:    cert,
+	}
+	if _, err := rand.Read(ri.SecretKey[:]); err != nil {
+		return nil, err
+	}
+	pk, err := curve25519.X25519(ri.SecretKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(ri.PublicKey[:], pk)
+
+	switch cert.EsVersion {
+	case dnscryptv2.XChacha20Poly1305:
+		if ri.SharedKey, err = xsecretbox.SharedKey(ri.SecretKey, cert.ResolverPk); err != nil {
+			return nil, err
+		}
+	case dnscryptv2.XSalsa20Poly1305:
+		box.Precompute(&ri.SharedKey, &cert.ResolverPk, &ri.SecretKey)
+	default:
+		return nil, dnscryptv2.ErrEsVersion
+	}
+	return ri, nil
+}
+
+// fetchCert queries the certificates of the provider and returns the
+// valid one with the highest serial.
+func fetchCert(ctx context.Context, conn net.Conn, stamp dnsstamps.ServerStamp) (*dnscryptv2.Cert, error) {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultTimeout)
+	}
+	if err := conn.SetDeadline(ddl); err != nil {
+		return nil, err
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(stamp.ProviderName), dns.TypeTXT)
+	if _, err := dnsutils.WriteMsgToUDP(conn, q); err != nil {
+		return nil, err
+	}
+	r, _, err := dnsutils.ReadMsgFromUDP(conn, dns.MaxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != q.Id {
+		return nil, errors.New("certificate response id mismatched")
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, dnscryptv2.ErrFailedToFetchCert
+	}
+
+	var best *dnscryptv2.Cert
+	var certErr error = dnscryptv2.ErrFailedToFetchCert
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert := new(dnscryptv2.Cert)
+		if err := cert.Deserialize(unescapeTXT(strings.Join(txt.Txt, ""))); err != nil {
+			certErr = fmt.Errorf("invalid certificate, %w", err)
+			continue
+		}
+		if !cert.VerifyDate() {
+			certErr = dnscryptv2.ErrInvalidDate
+			continue
+		}
+		if !cert.VerifySignature(stamp.ServerPk) {
+			certErr = dnscryptv2.ErrInvalidCertSignature
+			continue
+		}
+		if best == nil || cert.Serial > best.Serial || (cert.Serial == best.Serial && cert.EsVersion > best.EsVersion) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, certErr
+	}
+	return best, nil
+}
+
+// unescapeTXT decodes the \DDD and \X escapes of a TXT string in the
+// presentation format of miekg/dns.
+func unescapeTXT(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			b = append(b, c)
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return b
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	dnscryptv2 "github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = time.Second * 5
+
+	// certRefreshInterval is the interval that the provider certificate
+	// will be re-fetched, so that rotated certificates can be picked up
+	// before the old ones expire.
+	certRefreshInterval = time.Hour
+
+	// udpSize is the size of udp queries. The resolver never sends
+	// a response larger than the query.
+	udpSize = 1252
+)
+
+// Upstream is a DNSCrypt v2 upstream.
+type Upstream struct {
+	// Stamp is the server stamp of the resolver. Its Proto must be
+	// dnsstamps.StampProtoTypeDNSCrypt.
+	Stamp dnsstamps.ServerStamp
+
+	// DialFunc dials udp and tcp connections to Stamp.ServerAddrStr.
+	// It is used by queries and certificate fetches.
+	// Optional. Default is a plain net.Dialer.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger is optional.
+	Logger *zap.Logger
+
+	sf          singleflight.Group
+	m           sync.Mutex
+	ri          *dnscryptv2.ResolverInfo
+	lastFetched time.Time
+}
+
+// NewUpstream parses the sdns:// stamp s and returns an Upstream.
+// If dialAddr is not empty, it overwrites the server address in the stamp.
+func NewUpstream(s string, dialAddr string, dialFunc func(ctx context.Context, network, addr string) (net.Conn, error), logger *zap.Logger) (*Upstream, error) {
+	stamp, err := dnsstamps.NewServerStampFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns stamp, %w", err)
+	}
+	if stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+		return nil, fmt.Errorf("unsupported stamp protocol %d", stamp.Proto)
+	}
+	if len(dialAddr) > 0 {
+		stamp.ServerAddrStr = dialAddr
+	}
+	return &Upstream{Stamp: stamp, DialFunc: dialFunc, Logger: logger}, nil
+}
+
+func (u *Upstream) logger() *zap.Logger {
+	if l := u.Logger; l != nil {
+		return l
+	}
+	return zap.NewNop()
+}
+
+// getResolverInfo returns the cached resolver info. If there is no valid
+// one, it waits for a new one. If the cached one is due to refresh, a
+// new one will be fetched in the background.
+func (u *Upstream) getResolverInfo(ctx context.Context) (*dnscryptv2.ResolverInfo, error) {
+	u.m.Lock()
+	ri, lastFetched := u.ri, u.lastFetched
+	u.m.Unlock()
+
+	now := time.Now()
+	valid := ri != nil && now.Unix() <= int64(ri.ResolverCert.NotAfter)
+	if valid {
+		if now.Sub(lastFetched) >= certRefreshInterval {
+			u.sf.DoChan("", u.refreshResolverInfo)
+		}
+		return ri, nil
+	}
+
+	select {
+	case res := <-u.sf.DoChan("", u.refreshResolverInfo):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*dnscryptv2.ResolverInfo), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refreshResolverInfo fetches a new resolver info. If the fetch failed but
+// the cached one is still valid, the cached one is kept and returned.
+func (u *Upstream) refreshResolverInfo() (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	ri, err := u.fetchResolverInfo(ctx)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	now := time.Now()
+	if err != nil {
+		if u.ri != nil && now.Unix() <= int64(u.ri.ResolverCert.NotAfter) { // Keep using the old one.
+			u.logger().Warn("failed to refresh dnscrypt certificate", zap.String("provider", u.Stamp.ProviderName), zap.Error(err))
+			u.lastFetched = now
+			return u.ri, nil
+		}
+		return nil, fmt.Errorf("failed to fetch dnscrypt certificate, %w", err)
+	}
+	u.logger().Debug("dnscrypt certificate fetched", zap.String("provider", u.Stamp.ProviderName), zap.Stringer("cert", ri.ResolverCert))
+	u.ri = ri
+	u.lastFetched = now
+	return ri, nil
+}
+
+func (u *Upstream) fetchResolverInfo(ctx context.Context) (*dnscryptv2.ResolverInfo, error) {
+	conn, err := u.dial(ctx, "udp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return fetchResolverInfo(ctx, conn, u.Stamp)
+}
+
+func (u *Upstream) dial(ctx context.Context, network string) (net.Conn, error) {
+	dial := u.DialFunc
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	return dial(ctx, network, u.Stamp.ServerAddrStr)
+}
+
+// invalidate removes the cached ri. The certificate will be fetched
+// again in the next query.
+func (u *Upstream) invalidate(ri *dnscryptv2.ResolverInfo) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.ri == ri {
+		u.ri = nil
+	}
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	ri, err := u.getResolverInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := u.exchange(ctx, "udp", q, ri)
+	if err == nil && r.Truncated {
+		r, err = u.exchange(ctx, "tcp", q, ri)
+	}
+	if err != nil {
+		if errors.Is(err, dnscryptv2.ErrInvalidResponse) || errors.Is(err, dnscryptv2.ErrInvalidResolverMagic) {
+			// The resolver may have rotated its keys.
+			u.invalidate(ri)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (u *Upstream) exchange(ctx context.Context, network string, q *dns.Msg, ri *dnscryptv2.ResolverInfo) (*dns.Msg, error) {
+	conn, err := u.dial(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := defaultTimeout
+	if ddl, ok := ctx.Deadline(); ok {
+		timeout = time.Until(ddl)
+	}
+	c := &dnscryptv2.Client{Net: network, Timeout: timeout, UDPSize: udpSize}
+	return c.ExchangeConn(conn, q, ri)
+}
+
+func (u *Upstream) Close() error {
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	dnscryptv2 "github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testHandler struct {
+	bigMsg bool
+}
+
+func (h *testHandler) ServeDNS(rw dnscryptv2.ResponseWriter, q *dns.Msg) error {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	n := 1
+	if h.bigMsg {
+		n = 100
+	}
+	for i := 0; i < n; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(127, 0, 0, byte(i)),
+		})
+	}
+	return rw.WriteMsg(r)
+}
+
+func newTestServer(t testing.TB, h dnscryptv2.Handler) dnsstamps.ServerStamp {
+	rc, err := dnscryptv2.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnscryptv2.Server{ProviderName: rc.ProviderName, ResolverCert: cert, Handler: h}
+
+	// Listen on the same port for udp and tcp. Retry if the port has been taken.
+	var uc *net.UDPConn
+	var l *net.TCPListener
+	for i := 0; i < 10 && l == nil; i++ {
+		uc, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := uc.LocalAddr().(*net.UDPAddr).Port
+		l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			uc.Close()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUDP(uc)
+	go s.ServeTCP(l)
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+
+	stamp, err := rc.CreateStamp(uc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stamp
+}
+
+func Test_Upstream(t *testing.T) {
+	for _, bigMsg := range [...]bool{false, true} {
+		stamp := newTestServer(t, &testHandler{bigMsg: bigMsg})
+		u, err := NewUpstream(stamp.String(), "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			r, err := u.ExchangeContext(ctx, q)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != q.Id || r.Truncated {
+				t.Fatalf("invalid response: %s", r)
+			}
+			wantAnswers := 1
+			if bigMsg {
+				wantAnswers = 100 // tcp fallback
+			}
+			if len(r.Answer) != wantAnswers {
+				t.Fatalf("want %d answers, got %d", wantAnswers, len(r.Answer))
+			}
+		}
+	}
+}
+
+func Test_Upstream_certRefresh(t *testing.T) {
+	stamp := newTestServer(t, &testHandler{})
+	var dials int32
+	dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}
+	u := &Upstream{Stamp: stamp, DialFunc: dialFunc}
+	ctx := context.Background()
+	ri, err := u.getResolverInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("cert should be fetched by DialFunc, got %d dials", n)
+	}
+	if ri2, _ := u.getResolverInfo(ctx); ri2 != ri {
+		t.Fatal("cert is not cached")
+	}
+
+	u.invalidate(ri)
+	ri2, err := u.getResolverInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri2 == ri {
+		t.Fatal("cert is not re-fetched")
+	}
+
+	// A cert that is due to refresh is still used while refreshing.
+	u.m.Lock()
+	u.lastFetched = time.Now().Add(-certRefreshInterval)
+	u.m.Unlock()
+	if ri3, err := u.getResolverInfo(ctx); err != nil || ri3 != ri2 {
+		t.Fatalf("want the cached cert, got %v", err)
+	}
+	u.sf.Do("", u.refreshResolverInfo) // wait for the background refresh
+	ri3, _ := u.getResolverInfo(ctx)
+	if ri3 == ri2 {
+		t.Fatal("cert is not refreshed in the background")
+	}
+
+	// The old cert is kept if the refresh failed.
+	u.Stamp.ServerAddrStr = "127.0.0.1:1"
+	if ri4, err := u.refreshResolverInfo(); err != nil || ri4 != ri3 {
+		t.Fatalf("want the old cert, got %v", err)
+	}
+}
+
+func Test_Upstream_concurrentFetch(t *testing.T) {
+	stamp := newTestServer(t, &testHandler{})
+	var dials int32
+	dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(time.Millisecond * 50)
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}
+	u := &Upstream{Stamp: stamp, DialFunc: dialFunc}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := u.getResolverInfo(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("concurrent fetches should be merged, got %d dials", n)
+	}
+}
+
+func Test_NewUpstream(t *testing.T) {
+	if _, err := NewUpstream("sdns://invalid", "", nil, nil); err == nil {
+		t.Fatal("want invalid stamp err")
+	}
+	// A DoH stamp.
+	doh := dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ServerAddrStr: "127.0.0.1", ProviderName: "example.org", Path: "/dns-query"}
+	if _, err := NewUpstream(doh.String(), "", nil, nil); err == nil {
+		t.Fatal("want unsupported protocol err")
+	}
+}
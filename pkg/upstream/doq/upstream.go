@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDoQTimeout = time.Second * 5
+
+	// DoQ error codes. See RFC 9250 4.3.
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+)
+
+var errUpstreamClosed = errors.New("upstream closed")
+
+// Upstream is a DNS-over-QUIC (RFC 9250) upstream.
+type Upstream struct {
+	// DialFunc dials a new quic connection. The connection MUST
+	// negotiate the "doq" ALPN.
+	DialFunc func(ctx context.Context) (quic.Connection, error)
+
+	// AddOnCloser will be closed when Upstream is closed.
+	AddOnCloser io.Closer
+
+	m      sync.Mutex
+	conn   quic.Connection
+	closed bool
+}
+
+// getConn returns the cached connection or dials a new one.
+func (u *Upstream) getConn(ctx context.Context) (quic.Connection, error) {
+	u.m.Lock()
+	if u.closed {
+		u.m.Unlock()
+		return nil, errUpstreamClosed
+	}
+	if c := u.conn; c != nil {
+		select {
+		case <-c.Context().Done(): // dead connection
+			u.conn = nil
+		default:
+			u.m.Unlock()
+			return c, nil
+		}
+	}
+	u.m.Unlock()
+
+	c, err := u.DialFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.closed {
+		c.CloseWithError(doqNoError, "")
+		return nil, errUpstreamClosed
+	}
+	if u.conn != nil { // another goroutine has dialed a connection.
+		c.CloseWithError(doqNoError, "")
+		return u.conn, nil
+	}
+	u.conn = c
+	return c, nil
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	// When sending queries over a QUIC connection, the DNS Message ID
+	// MUST be set to 0.
+	// https://www.rfc-editor.org/rfc/rfc9250#section-4.2.1
+	qCopy := *q
+	qCopy.Id = 0
+
+	conn, err := u.getConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial quic connection, %w", err)
+	}
+	r, err := exchange(ctx, conn, &qCopy)
+	if err != nil {
+		// A dead connection will be removed by the next getConn call.
+		return nil, err
+	}
+	r.Id = q.Id
+	return r, nil
+}
+
+func exchange(ctx context.Context, conn quic.Connection, q *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream, %w", err)
+	}
+	defer stream.CancelRead(doqNoError)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultDoQTimeout)
+	}
+	stream.SetDeadline(deadline)
+
+	if _, err := dnsutils.WriteMsgToTCP(stream, q); err != nil {
+		stream.CancelWrite(doqInternalError)
+		return nil, fmt.Errorf("failed to write query, %w", err)
+	}
+	// The client MUST send the DNS query over the selected stream, and
+	// MUST indicate through the STREAM FIN mechanism that no further
+	// data will be sent on that stream.
+	stream.Close()
+
+	r, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response, %w", err)
+	}
+	return r, nil
+}
+
+func (u *Upstream) Close() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.closed = true
+	if u.conn != nil {
+		u.conn.CloseWithError(doqNoError, "")
+		u.conn = nil
+	}
+	if u.AddOnCloser != nil {
+		u.AddOnCloser.Close()
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// downgradeAttemptTimeout is the timeout of a protocol that
+	// is not the last one in the downgrade chain.
+	downgradeAttemptTimeout = time.Second * 2
+
+	// downgradeProbeInterval is the interval of retrying the first
+	// protocol after the upstream was downgraded.
+	downgradeProbeInterval = time.Minute * 5
+)
+
+// downgradeUpstream exchanges queries over a chain of protocols
+// of the same server. It remembers the protocol that worked last
+// and starts from it. The first protocol will be probed again every
+// downgradeProbeInterval.
+type downgradeUpstream struct {
+	logger *zap.Logger
+	addrs  []string
+	us     []Upstream
+
+	m            sync.Mutex
+	preferred    int
+	downgradedAt time.Time
+}
+
+func newDowngradeUpstream(addr string, opt *Opt) (*downgradeUpstream, error) {
+	addrs, dialAddrs, err := downgradeAddrs(addr, opt.DialAddr, opt.Downgrade)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &downgradeUpstream{
+		logger: opt.Logger,
+		addrs:  addrs,
+	}
+	if d.logger == nil {
+		d.logger = zap.NewNop()
+	}
+	for i, a := range addrs {
+		o := *opt
+		o.Downgrade = nil
+		o.DialAddr = dialAddrs[i]
+		u, err := NewUpstream(a, &o)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("failed to init upstream %s, %w", a, err)
+		}
+		d.us = append(d.us, u)
+	}
+	return d, nil
+}
+
+// downgradeAddrs returns the addresses of the downgrade chain. The first
+// one is addr itself. Ports of addr and dialAddr are only kept by the first one.
+func downgradeAddrs(addr, dialAddr string, protocols []string) (addrs, dialAddrs []string, err error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	addrURL, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid server address, %w", err)
+	}
+	host := tryRemovePort(addrURL.Host)
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") { // ipv6
+		host = "[" + host + "]"
+	}
+	path := "/dns-query"
+	if addrURL.Scheme == "https" && len(addrURL.Path) > 0 {
+		path = addrURL.Path
+	}
+
+	addrs = append(addrs, addr)
+	dialAddrs = append(dialAddrs, dialAddr)
+	seen := map[string]struct{}{addrURL.Scheme: {}}
+	for _, p := range protocols {
+		switch p {
+		case "udp", "tcp", "tls", "quic":
+			addrs = append(addrs, p+"://"+host)
+		case "https":
+			addrs = append(addrs, p+"://"+host+path)
+		default:
+			return nil, nil, fmt.Errorf("unsupported downgrade protocol [%s]", p)
+		}
+		if _, dup := seen[p]; dup {
+			return nil, nil, fmt.Errorf("duplicated downgrade protocol [%s]", p)
+		}
+		seen[p] = struct{}{}
+		dialAddrs = append(dialAddrs, tryRemovePort(dialAddr))
+	}
+	return addrs, dialAddrs, nil
+}
+
+func (d *downgradeUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	var errs []string
+	var lastErr error
+	for i := d.startIndex(); i < len(d.us); i++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if i < len(d.us)-1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, downgradeAttemptTimeout)
+		}
+		r, err := d.us[i].ExchangeContext(attemptCtx, q)
+		cancel()
+		if err == nil {
+			d.setPreferred(i)
+			return r, nil
+		}
+		d.logger.Debug("upstream protocol failed", zap.String("addr", d.addrs[i]), zap.Error(err))
+		if lastErr != nil {
+			errs = append(errs, lastErr.Error())
+		}
+		lastErr = fmt.Errorf("%s: %w", d.addrs[i], err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// Only the last error is wrapped. Errors of the earlier protocols
+	// may be timeouts of their own attempts, not of the query.
+	if len(errs) == 0 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("%s; %w", strings.Join(errs, "; "), lastErr)
+}
+
+// startIndex returns the index of the protocol that a query should start with.
+func (d *downgradeUpstream) startIndex() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.preferred > 0 && time.Since(d.downgradedAt) > downgradeProbeInterval {
+		d.downgradedAt = time.Now() // only probe once per interval
+		return 0
+	}
+	return d.preferred
+}
+
+func (d *downgradeUpstream) setPreferred(i int) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.preferred != i {
+		if i > 0 {
+			d.downgradedAt = time.Now()
+		}
+		d.logger.Info(
+			"upstream protocol changed",
+			zap.String("from", d.addrs[d.preferred]),
+			zap.String("to", d.addrs[i]),
+		)
+		d.preferred = i
+	}
+}
+
+func (d *downgradeUpstream) Close() error {
+	for _, u := range d.us {
+		u.Close()
+	}
+	return nil
+}
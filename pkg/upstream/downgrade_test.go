@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_downgradeAddrs(t *testing.T) {
+	tests := []struct {
+		addr, dialAddr string
+		protocols      []string
+		wantAddrs      []string
+		wantDialAddrs  []string
+		wantErr        bool
+	}{
+		{
+			addr:          "quic://dns.example:8853",
+			dialAddr:      "192.0.2.1:8853",
+			protocols:     []string{"tls", "https", "tcp", "udp"},
+			wantAddrs:     []string{"quic://dns.example:8853", "tls://dns.example", "https://dns.example/dns-query", "tcp://dns.example", "udp://dns.example"},
+			wantDialAddrs: []string{"192.0.2.1:8853", "192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.1"},
+		},
+		{
+			addr:      "https://[2001:db8::1]:8443/q",
+			protocols: []string{"tcp", "https"},
+			wantErr:   true, // duplicated
+		},
+		{
+			addr:          "https://[2001:db8::1]:8443/q",
+			protocols:     []string{"quic", "tcp"},
+			wantAddrs:     []string{"https://[2001:db8::1]:8443/q", "quic://[2001:db8::1]", "tcp://[2001:db8::1]"},
+			wantDialAddrs: []string{"", "", ""},
+		},
+		{
+			addr:      "tls://dns.example",
+			protocols: []string{"sctp"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addrs, dialAddrs, err := downgradeAddrs(tt.addr, tt.dialAddr, tt.protocols)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downgradeAddrs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(addrs, tt.wantAddrs) {
+				t.Errorf("addrs = %v, want %v", addrs, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(dialAddrs, tt.wantDialAddrs) {
+				t.Errorf("dialAddrs = %v, want %v", dialAddrs, tt.wantDialAddrs)
+			}
+		})
+	}
+}
+
+func Test_downgradeUpstream(t *testing.T) {
+	// Only a tcp server is available. quic and tls will fail.
+	tcpAddr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+	_, port, _ := net.SplitHostPort(tcpAddr)
+
+	u, err := NewUpstream("quic://127.0.0.1:"+port, &Opt{
+		Downgrade: []string{"tls", "tcp"},
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	d := u.(*downgradeUpstream)
+
+	// Redirect the downgraded protocols to the test server.
+	d.us[2].Close()
+	d.us[2], err = NewUpstream("tcp://"+tcpAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	exchange := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		_, err := u.ExchangeContext(ctx, q)
+		return err
+	}
+
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+	if d.preferred != 2 {
+		t.Fatalf("preferred = %d, want 2", d.preferred)
+	}
+
+	// The next query should go to tcp directly.
+	start := time.Now()
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("downgraded upstream should not retry failed protocols")
+	}
+
+	// Probe the first protocol after the interval.
+	d.m.Lock()
+	d.downgradedAt = time.Now().Add(-downgradeProbeInterval - time.Second)
+	d.m.Unlock()
+	if i := d.startIndex(); i != 0 {
+		t.Fatalf("startIndex() = %d, want 0", i)
+	}
+	if i := d.startIndex(); i != 2 {
+		t.Fatalf("startIndex() = %d, want 2", i)
+	}
+
+	// All protocols failed.
+	shutdown()
+	err = exchange()
+	if err == nil || !strings.Contains(err.Error(), "tcp://") {
+		t.Fatalf("want a combined error, got %v", err)
+	}
+}
+
+// ctxUpstream returns err, or the error of ctx if err is nil.
+type ctxUpstream struct {
+	err error
+}
+
+func (u ctxUpstream) ExchangeContext(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (u ctxUpstream) Close() error { return nil }
+
+func Test_downgradeUpstream_err(t *testing.T) {
+	errRefused := errors.New("refused")
+	tests := []struct {
+		name         string
+		us           []Upstream
+		wantDeadline bool
+	}{
+		{"query timeout", []Upstream{ctxUpstream{err: errRefused}, ctxUpstream{}}, true},
+		{"attempt timeout", []Upstream{ctxUpstream{err: context.DeadlineExceeded}, ctxUpstream{err: errRefused}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &downgradeUpstream{
+				logger: zap.NewNop(),
+				addrs:  []string{"tls://127.0.0.1", "tcp://127.0.0.1"},
+				us:     tt.us,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, err := d.ExchangeContext(ctx, q)
+			if err == nil || !strings.Contains(err.Error(), "tls://") || !strings.Contains(err.Error(), "tcp://") {
+				t.Fatalf("want a combined error, got %v", err)
+			}
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.wantDeadline {
+				t.Fatalf("errors.Is(%v, context.DeadlineExceeded) = %v, want %v", err, got, tt.wantDeadline)
+			}
+		})
+	}
+}
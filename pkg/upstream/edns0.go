@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// paddingBlockLen is the block length of query padding that RFC 8467
+// recommends.
+const paddingBlockLen = 128
+
+// edns0Upstream adds EDNS0 padding and cookie options to queries.
+type edns0Upstream struct {
+	u       Upstream
+	padding bool
+	cookie  *dns_cookie.Client // nil if cookie is disabled
+}
+
+func newEDNS0Upstream(u Upstream, addr string, opt *Opt) *edns0Upstream {
+	e := &edns0Upstream{u: u}
+	if opt.EnablePadding {
+		// Padding is pointless on plain text protocols.
+		scheme, _, _ := strings.Cut(addr, "://")
+		switch scheme {
+		case "tls", "https", "quic", "odoh":
+			e.padding = true
+		}
+	}
+	if opt.EnableCookie {
+		e.cookie = dns_cookie.NewClient()
+	}
+	return e
+}
+
+func (e *edns0Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, upgraded, err := e.exchange(ctx, q)
+	if err == nil && e.cookie != nil && r.Rcode == dns.RcodeBadCookie {
+		// The BADCOOKIE response carries a new server cookie, which
+		// has been remembered. Retry once with it. RFC 7873 5.3.
+		r, upgraded, err = e.exchange(ctx, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if upgraded {
+		dnsutils.RemoveEDNS0(r)
+		if r.Rcode > 0xF { // Extended rcode cannot be sent without OPT.
+			r.Rcode = dns.RcodeServerFailure
+		}
+	}
+	return r, nil
+}
+
+// exchange sends a copy of q with the options. upgraded reports whether
+// q had no OPT.
+func (e *edns0Upstream) exchange(ctx context.Context, q *dns.Msg) (_ *dns.Msg, upgraded bool, _ error) {
+	q = q.Copy()
+	if e.cookie != nil {
+		opt := q.IsEdns0()
+		if opt == nil {
+			opt = dnsutils.UpgradeEDNS0(q)
+			upgraded = true
+		} else {
+			dnsutils.RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+		}
+		opt.Option = append(opt.Option, e.cookie.Option())
+	}
+	if e.padding { // Padding must be the last one.
+		if dnsutils.PadToBlock(q, paddingBlockLen) {
+			upgraded = true
+		}
+	}
+
+	r, err := e.u.ExchangeContext(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if opt := r.IsEdns0(); opt != nil && e.cookie != nil {
+		if c, ok := dnsutils.GetEDNS0Option(opt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE); ok {
+			if err := e.cookie.Update(c); err != nil {
+				return nil, false, fmt.Errorf("invalid cookie in response, %w", err)
+			}
+			dnsutils.RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+		}
+	}
+	return r, upgraded, nil
+}
+
+func (e *edns0Upstream) Close() error {
+	return e.u.Close()
+}
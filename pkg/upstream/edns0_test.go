@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// cookieServer is an Upstream that requires valid server cookies.
+type cookieServer struct {
+	s       *dns_cookie.Server
+	lastLen int
+	queries int
+}
+
+func (c *cookieServer) ExchangeContext(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c.queries++
+	c.lastLen = q.Len()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	opt := q.IsEdns0()
+	co, _ := dnsutils.GetEDNS0Option(opt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	client, server, err := dns_cookie.Parse(co)
+	if err != nil {
+		r.Rcode = dns.RcodeFormatError
+		return r, nil
+	}
+	ip := netip.MustParseAddr("127.0.0.1")
+	if valid, _ := c.s.Verify(client, server, ip, time.Now()); !valid {
+		r.Rcode = dns.RcodeBadCookie
+	}
+	ro := dnsutils.UpgradeEDNS0(r)
+	ro.Option = append(ro.Option, dns_cookie.NewOption(client, c.s.Generate(client, ip, time.Now())))
+	return r, nil
+}
+
+func (c *cookieServer) Close() error { return nil }
+
+func Test_edns0Upstream(t *testing.T) {
+	s := &cookieServer{s: dns_cookie.NewRandomServer()}
+	u := newEDNS0Upstream(s, "tls://127.0.0.1", &Opt{EnablePadding: true, EnableCookie: true})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := u.ExchangeContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || s.queries != 2 {
+		t.Fatalf("want a retry after BADCOOKIE, got rcode %d after %d queries", r.Rcode, s.queries)
+	}
+	if r.IsEdns0() != nil {
+		t.Fatal("OPT added by the upstream should be removed")
+	}
+	if s.lastLen%paddingBlockLen != 0 {
+		t.Fatalf("query is not padded, len %d", s.lastLen)
+	}
+	if q.IsEdns0() != nil {
+		t.Fatal("query is modified")
+	}
+
+	if _, err := u.ExchangeContext(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if s.queries != 3 {
+		t.Fatal("server cookie should be reused")
+	}
+}
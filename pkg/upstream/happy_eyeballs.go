@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// connectionAttemptDelay is the delay between two connection attempts.
+	// RFC 8305 5 recommends 250ms.
+	connectionAttemptDelay = time.Millisecond * 250
+
+	// familyFailureTTL is how long an address family that failed is
+	// tried after the other one.
+	familyFailureTTL = time.Minute * 10
+)
+
+const (
+	familyV4 = iota
+	familyV6
+)
+
+// happyEyeballsDialer dials tcp connections to dual-stack hosts as RFC 8305
+// suggested. It resolves both A and AAAA records of the host and races
+// connection attempts to the addresses, interleaved by family. A family
+// that recently failed or lost the race is tried after the other one, so a
+// broken ipv6 path won't delay every following dial.
+type happyEyeballsDialer struct {
+	resolver hostResolver
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// onFailure, if not nil, is called with addresses that failed to
+	// connect or lost the race to a later one.
+	onFailure func(addr netip.Addr)
+
+	// keepOrder tries addresses in the order of the resolver, e.g.
+	// the configured order of pinned addresses, instead of interleaving
+	// them by family.
+	keepOrder bool
+
+	m        sync.Mutex
+	failedAt [2]time.Time // last failure time of each family
+}
+
+func newHappyEyeballsDialer(d contextDialer, r hostResolver) *happyEyeballsDialer {
+	h := &happyEyeballsDialer{resolver: r, dial: d.DialContext}
+	if onFailure := failureReporter(r); onFailure != nil {
+		h.onFailure = onFailure
+		h.keepOrder = true
+	}
+	return h
+}
+
+func (h *happyEyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return h.dial(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return h.dial(ctx, network, addr)
+	}
+	ips, err := h.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return h.dialAddrs(ctx, network, port, h.sortAddrs(ips))
+}
+
+func addrFamily(addr netip.Addr) int {
+	if addr.Unmap().Is4() {
+		return familyV4
+	}
+	return familyV6
+}
+
+func (h *happyEyeballsDialer) familyFailed(f int) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	t := h.failedAt[f]
+	return !t.IsZero() && time.Since(t) < familyFailureTTL
+}
+
+func (h *happyEyeballsDialer) setFamilyFailed(f int, failed bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if failed {
+		h.failedAt[f] = time.Now()
+	} else {
+		h.failedAt[f] = time.Time{}
+	}
+}
+
+// sortAddrs interleaves addresses by family. The preferred family comes
+// first, which is ipv6 unless it failed recently. If h.keepOrder is set,
+// the order of addrs is kept.
+func (h *happyEyeballsDialer) sortAddrs(addrs []netip.Addr) []netip.Addr {
+	if h.keepOrder {
+		sorted := make([]netip.Addr, 0, len(addrs))
+		for _, addr := range addrs {
+			sorted = append(sorted, addr.Unmap())
+		}
+		return sorted
+	}
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	first, second := v6, v4
+	if h.familyFailed(familyV6) && !h.familyFailed(familyV4) {
+		first, second = v4, v6
+	}
+
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialAddrs starts a connection attempt to the next address every
+// connectionAttemptDelay, or once all started attempts failed. It returns
+// the first established connection.
+func (h *happyEyeballsDialer) dialAddrs(ctx context.Context, network, port string, addrs []netip.Addr) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: port}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c    net.Conn
+		err  error
+		addr netip.Addr
+	}
+	results := make(chan result, len(addrs))
+	started, failed := 0, 0
+	startNext := func() {
+		addr := addrs[started]
+		started++
+		go func() {
+			c, err := h.dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			results <- result{c: c, err: err, addr: addr}
+		}()
+	}
+	// closeLosers closes connections of the attempts that are still
+	// running.
+	closeLosers := func() {
+		pending := started - failed
+		go func() {
+			for i := 0; i < pending; i++ {
+				if res := <-results; res.c != nil {
+					res.c.Close()
+				}
+			}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer func() { timer.Stop() }()
+	var firstErr error
+	for {
+		var timerC <-chan time.Time
+		if started < len(addrs) {
+			timerC = timer.C
+		}
+		select {
+		case <-timerC:
+			startNext()
+			timer = time.NewTimer(connectionAttemptDelay)
+		case res := <-results:
+			if res.err == nil {
+				f := addrFamily(res.addr)
+				h.setFamilyFailed(f, false)
+				if pf := addrFamily(addrs[0]); pf != f {
+					// The preferred family failed or was too slow.
+					h.setFamilyFailed(pf, true)
+				}
+				if res.addr != addrs[0] && h.onFailure != nil {
+					h.onFailure(addrs[0])
+				}
+				failed++ // not pending anymore
+				closeLosers()
+				return res.c, nil
+			}
+			failed++
+			if ctx.Err() == nil {
+				h.setFamilyFailed(addrFamily(res.addr), true)
+				if h.onFailure != nil {
+					h.onFailure(res.addr)
+				}
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if failed == len(addrs) {
+				return nil, firstErr
+			}
+			if failed == started {
+				// No running attempt. Start the next one now.
+				timer.Stop()
+				startNext()
+				timer = time.NewTimer(connectionAttemptDelay)
+			}
+		case <-ctx.Done():
+			closeLosers()
+			return nil, ctx.Err()
+		}
+	}
+}
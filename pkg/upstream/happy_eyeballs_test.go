@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_happyEyeballsDialer(t *testing.T) {
+	// ipv6 is black-holed, ipv4 works.
+	h := &happyEyeballsDialer{
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "[") {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		},
+	}
+	addrs := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	sorted := h.sortAddrs(addrs)
+	if !sorted[0].Is6() {
+		t.Fatalf("ipv6 should be preferred, got %v", sorted)
+	}
+
+	start := time.Now()
+	c, err := h.dialAddrs(context.Background(), "tcp", "53", sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d := time.Since(start); d < connectionAttemptDelay || d > connectionAttemptDelay*4 {
+		t.Fatalf("unexpected dial time %s", d)
+	}
+	if !h.familyFailed(familyV6) || h.familyFailed(familyV4) {
+		t.Fatal("ipv6 should be marked as failed")
+	}
+
+	// Now ipv4 is tried first, and wins without delay.
+	sorted = h.sortAddrs(addrs)
+	if !sorted[0].Is4() {
+		t.Fatalf("ipv4 should be preferred, got %v", sorted)
+	}
+	start = time.Now()
+	c, err = h.dialAddrs(context.Background(), "tcp", "53", sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d := time.Since(start); d >= connectionAttemptDelay {
+		t.Fatalf("unexpected dial time %s", d)
+	}
+}
+
+func Test_happyEyeballsDialer_allFailed(t *testing.T) {
+	dialErr := errors.New("dial err")
+	h := &happyEyeballsDialer{
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dialErr
+		},
+	}
+	addrs := h.sortAddrs([]netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")})
+	start := time.Now()
+	_, err := h.dialAddrs(context.Background(), "tcp", "53", addrs)
+	if err != dialErr {
+		t.Fatalf("want dial err, got %v", err)
+	}
+	// Failed attempts should not wait for the attempt delay.
+	if d := time.Since(start); d >= connectionAttemptDelay {
+		t.Fatalf("unexpected dial time %s", d)
+	}
+}
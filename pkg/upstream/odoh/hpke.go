@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// A minimal HPKE (RFC 9180) implementation of the base mode with
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM, which is
+// the only suite that ODoH servers use in practice.
+
+const (
+	kemX25519HKDFSHA256 = 0x0020
+	kdfHKDFSHA256       = 0x0001
+	aeadAES128GCM       = 0x0001
+
+	nSecret = 32 // shared secret size of the kem
+	nPk     = 32 // public key size of the kem
+	nH      = 32 // output size of the kdf
+	nK      = 16 // key size of the aead
+	nN      = 12 // nonce size of the aead
+)
+
+var errInvalidPublicKey = errors.New("invalid public key")
+
+func kemSuiteID() []byte {
+	return []byte{'K', 'E', 'M', 0, kemX25519HKDFSHA256 & 0xff}
+}
+
+func hpkeSuiteID() []byte {
+	b := []byte("HPKE")
+	b = appendUint16(b, kemX25519HKDFSHA256)
+	b = appendUint16(b, kdfHKDFSHA256)
+	b = appendUint16(b, aeadAES128GCM)
+	return b
+}
+
+func appendUint16(b []byte, u uint16) []byte {
+	return append(b, byte(u>>8), byte(u))
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	labeledIKM = append(labeledIKM, "HPKE-v1"...)
+	labeledIKM = append(labeledIKM, suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	labeledInfo := make([]byte, 0, 9+len(suiteID)+len(label)+len(info))
+	labeledInfo = appendUint16(labeledInfo, uint16(l))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, l)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		panic(err) // l is always valid
+	}
+	return out
+}
+
+// encap generates a shared secret for pkR with the ephemeral private key skE.
+// It returns the shared secret and the encapsulated key (pkE).
+func encap(skE, pkR []byte) (sharedSecret, enc []byte, err error) {
+	if len(pkR) != nPk {
+		return nil, nil, errInvalidPublicKey
+	}
+	dh, err := curve25519.X25519(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, err = curve25519.X25519(skE, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return extractAndExpand(dh, enc, pkR), enc, nil
+}
+
+// decap is the receiver side of encap.
+func decap(enc, skR []byte) ([]byte, error) {
+	if len(enc) != nPk {
+		return nil, errInvalidPublicKey
+	}
+	dh, err := curve25519.X25519(skR, enc)
+	if err != nil {
+		return nil, err
+	}
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return extractAndExpand(dh, enc, pkR), nil
+}
+
+func extractAndExpand(dh, enc, pkR []byte) []byte {
+	kemContext := make([]byte, 0, len(enc)+len(pkR))
+	kemContext = append(kemContext, enc...)
+	kemContext = append(kemContext, pkR...)
+	prk := labeledExtract(kemSuiteID(), nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID(), prk, "shared_secret", kemContext, nSecret)
+}
+
+// hpkeContext is a base mode HPKE encryption context.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func newHPKEContext(sharedSecret, info []byte) *hpkeContext {
+	suiteID := hpkeSuiteID()
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	ksContext := make([]byte, 0, 1+len(pskIDHash)+len(infoHash))
+	ksContext = append(ksContext, 0) // mode_base
+	ksContext = append(ksContext, pskIDHash...)
+	ksContext = append(ksContext, infoHash...)
+
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(suiteID, secret, "key", ksContext, nK)
+	return &hpkeContext{
+		aead:           newAESGCM(key),
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", ksContext, nN),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", ksContext, nH),
+	}
+}
+
+// setupBaseS sets up a sender context for pkR.
+func setupBaseS(pkR, info []byte) (enc []byte, c *hpkeContext, err error) {
+	skE := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(skE); err != nil {
+		return nil, nil, err
+	}
+	return setupBaseSWithKey(skE, pkR, info)
+}
+
+func setupBaseSWithKey(skE, pkR, info []byte) (enc []byte, c *hpkeContext, err error) {
+	sharedSecret, enc, err := encap(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, newHPKEContext(sharedSecret, info), nil
+}
+
+// setupBaseR sets up a receiver context.
+func setupBaseR(enc, skR, info []byte) (*hpkeContext, error) {
+	sharedSecret, err := decap(enc, skR)
+	if err != nil {
+		return nil, err
+	}
+	return newHPKEContext(sharedSecret, info), nil
+}
+
+// nonce returns base_nonce xor seq.
+func (c *hpkeContext) nonce() []byte {
+	nonce := make([]byte, nN)
+	copy(nonce, c.baseNonce)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[nN-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.nonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nonce(), ct, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+	return pt, nil
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(hpkeSuiteID(), c.exporterSecret, "sec", exporterContext, l)
+}
+
+func newAESGCM(key []byte) cipher.AEAD {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // key size is always valid
+	}
+	a, err := cipher.NewGCM(b)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
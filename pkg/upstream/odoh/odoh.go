@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// Oblivious DNS over HTTPS, RFC 9230.
+
+const (
+	odohVersion = 0x0001
+
+	messageTypeQuery    = 0x01
+	messageTypeResponse = 0x02
+
+	// responseNonceSize is max(Nn, Nk).
+	responseNonceSize = nK
+)
+
+var errShortMsg = errors.New("message is too short")
+
+// Config is an ObliviousDoHConfigContents.
+type Config struct {
+	KemID     uint16
+	KdfID     uint16
+	AeadID    uint16
+	PublicKey []byte
+}
+
+func (c *Config) marshal() []byte {
+	b := make([]byte, 0, 8+len(c.PublicKey))
+	b = appendUint16(b, c.KemID)
+	b = appendUint16(b, c.KdfID)
+	b = appendUint16(b, c.AeadID)
+	b = appendUint16(b, uint16(len(c.PublicKey)))
+	return append(b, c.PublicKey...)
+}
+
+// supported reports whether the suite of c is supported.
+func (c *Config) supported() bool {
+	return c.KemID == kemX25519HKDFSHA256 &&
+		c.KdfID == kdfHKDFSHA256 &&
+		c.AeadID == aeadAES128GCM &&
+		len(c.PublicKey) == nPk
+}
+
+// KeyID returns the key identifier of c.
+func (c *Config) KeyID() []byte {
+	prk := hkdf.Extract(sha256.New, c.marshal(), nil)
+	id := make([]byte, nH)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("odoh key id")), id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// ParseConfigs parses an ObliviousDoHConfigs and returns the first
+// config that is supported.
+func ParseConfigs(b []byte) (*Config, error) {
+	l, b, err := readUint16(b)
+	if err != nil {
+		return nil, err
+	}
+	if int(l) != len(b) {
+		return nil, errors.New("invalid configs length")
+	}
+	for len(b) > 0 {
+		var version, cl uint16
+		if version, b, err = readUint16(b); err != nil {
+			return nil, err
+		}
+		if cl, b, err = readUint16(b); err != nil {
+			return nil, err
+		}
+		if int(cl) > len(b) {
+			return nil, errShortMsg
+		}
+		contents := b[:cl]
+		b = b[cl:]
+		if version != odohVersion {
+			continue
+		}
+		c, err := parseConfigContents(contents)
+		if err != nil {
+			return nil, err
+		}
+		if c.supported() {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no supported config")
+}
+
+func parseConfigContents(b []byte) (*Config, error) {
+	c := new(Config)
+	var err error
+	if c.KemID, b, err = readUint16(b); err != nil {
+		return nil, err
+	}
+	if c.KdfID, b, err = readUint16(b); err != nil {
+		return nil, err
+	}
+	if c.AeadID, b, err = readUint16(b); err != nil {
+		return nil, err
+	}
+	if c.PublicKey, b, err = readOpaque16(b); err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing data after config contents")
+	}
+	return c, nil
+}
+
+// message is an ObliviousDoHMessage.
+type message struct {
+	typ              uint8
+	keyID            []byte
+	encryptedMessage []byte
+}
+
+func (m *message) marshal() []byte {
+	b := make([]byte, 0, 5+len(m.keyID)+len(m.encryptedMessage))
+	b = append(b, m.typ)
+	b = appendUint16(b, uint16(len(m.keyID)))
+	b = append(b, m.keyID...)
+	b = appendUint16(b, uint16(len(m.encryptedMessage)))
+	return append(b, m.encryptedMessage...)
+}
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 1 {
+		return nil, errShortMsg
+	}
+	m := &message{typ: b[0]}
+	var err error
+	if m.keyID, b, err = readOpaque16(b[1:]); err != nil {
+		return nil, err
+	}
+	if m.encryptedMessage, b, err = readOpaque16(b); err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing data after message")
+	}
+	return m, nil
+}
+
+// marshalPlaintext marshals an ObliviousDoHMessagePlaintext. The dns message
+// is padded to a multiple of 128 bytes (RFC 8467 block-length padding).
+func marshalPlaintext(dnsMsg []byte) []byte {
+	padding := (128 - len(dnsMsg)%128) % 128
+	b := make([]byte, 0, 4+len(dnsMsg)+padding)
+	b = appendUint16(b, uint16(len(dnsMsg)))
+	b = append(b, dnsMsg...)
+	b = appendUint16(b, uint16(padding))
+	return append(b, make([]byte, padding)...)
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	dnsMsg, b, err := readOpaque16(b)
+	if err != nil {
+		return nil, err
+	}
+	padding, b, err := readOpaque16(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing data after plaintext")
+	}
+	for _, p := range padding {
+		if p != 0 {
+			return nil, errors.New("non-zero padding")
+		}
+	}
+	return dnsMsg, nil
+}
+
+// queryContext keeps the states to decrypt the response of a query.
+type queryContext struct {
+	hc     *hpkeContext
+	qPlain []byte
+}
+
+// encryptQuery encrypts the dns query msg to c.
+// It returns the marshaled ObliviousDoHMessage and a context to decrypt
+// the response.
+func encryptQuery(c *Config, dnsMsg []byte) ([]byte, *queryContext, error) {
+	keyID := c.KeyID()
+	enc, hc, err := setupBaseS(c.PublicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	qPlain := marshalPlaintext(dnsMsg)
+	ct := hc.seal(messageAAD(messageTypeQuery, keyID), qPlain)
+	m := &message{
+		typ:              messageTypeQuery,
+		keyID:            keyID,
+		encryptedMessage: append(enc, ct...),
+	}
+	return m.marshal(), &queryContext{hc: hc, qPlain: qPlain}, nil
+}
+
+// decryptResponse decrypts the marshaled ObliviousDoHMessage b and returns
+// the dns response msg.
+func (qc *queryContext) decryptResponse(b []byte) ([]byte, error) {
+	m, err := parseMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if m.typ != messageTypeResponse {
+		return nil, fmt.Errorf("unexpected message type %d", m.typ)
+	}
+	if len(m.keyID) != responseNonceSize {
+		return nil, fmt.Errorf("invalid response nonce length %d", len(m.keyID))
+	}
+	key, nonce := deriveResponseSecrets(qc.hc, qc.qPlain, m.keyID)
+	rPlain, err := newAESGCM(key).Open(nil, nonce, m.encryptedMessage, messageAAD(messageTypeResponse, m.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt response, %w", err)
+	}
+	return parsePlaintext(rPlain)
+}
+
+func deriveResponseSecrets(hc *hpkeContext, qPlain, respNonce []byte) (key, nonce []byte) {
+	secret := hc.export([]byte("odoh response"), nK)
+	salt := make([]byte, 0, len(qPlain)+2+len(respNonce))
+	salt = append(salt, qPlain...)
+	salt = appendUint16(salt, uint16(len(respNonce)))
+	salt = append(salt, respNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	key = make([]byte, nK)
+	nonce = make([]byte, nN)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("odoh key")), key)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("odoh nonce")), nonce)
+	return key, nonce
+}
+
+// messageAAD returns the aad of an ObliviousDoHMessage: type || len(id) || id.
+func messageAAD(typ uint8, id []byte) []byte {
+	b := make([]byte, 0, 3+len(id))
+	b = append(b, typ)
+	b = appendUint16(b, uint16(len(id)))
+	return append(b, id...)
+}
+
+func readUint16(b []byte) (uint16, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, errShortMsg
+	}
+	return binary.BigEndian.Uint16(b), b[2:], nil
+}
+
+func readOpaque16(b []byte) ([]byte, []byte, error) {
+	l, b, err := readUint16(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int(l) > len(b) {
+		return nil, nil, errShortMsg
+	}
+	return b[:l], b[l:], nil
+}
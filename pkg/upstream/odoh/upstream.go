@@ -0,0 +1,253 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	mimeType = "application/oblivious-dns-message"
+
+	// configRefreshInterval is the interval that the target config
+	// will be re-fetched, so that rotated keys can be picked up.
+	configRefreshInterval = time.Hour
+
+	defaultTimeout = time.Second * 5
+)
+
+// errKeyRejected indicates the target cannot decrypt the query,
+// most likely because its key was rotated.
+var errKeyRejected = errors.New("query rejected by target")
+
+// Upstream is an Oblivious DoH (RFC 9230) upstream. Queries are encrypted
+// to the target and relayed by the proxy, so that the target cannot see
+// the client address and the proxy cannot see the queries.
+type Upstream struct {
+	// Target is the DoH endpoint of the target, e.g.
+	// "https://odoh.cloudflare-dns.com/dns-query". Required.
+	Target *url.URL
+
+	// Proxy is the endpoint of the oblivious proxy. Required.
+	Proxy *url.URL
+
+	// Client sends queries to the proxy. Required.
+	Client *http.Client
+
+	// ConfigClient fetches the config of the target from
+	// "/.well-known/odohconfigs". Default is Client.
+	ConfigClient *http.Client
+
+	// Logger is optional.
+	Logger *zap.Logger
+
+	sf          singleflight.Group
+	m           sync.Mutex
+	config      *Config
+	lastFetched time.Time
+}
+
+func (u *Upstream) logger() *zap.Logger {
+	if l := u.Logger; l != nil {
+		return l
+	}
+	return zap.NewNop()
+}
+
+// getConfig returns the cached target config. If there is no cached
+// config, it waits for a new one. If the cached one is due to refresh,
+// a new one will be fetched in the background.
+func (u *Upstream) getConfig(ctx context.Context) (*Config, error) {
+	u.m.Lock()
+	c, lastFetched := u.config, u.lastFetched
+	u.m.Unlock()
+
+	if c != nil {
+		if time.Since(lastFetched) >= configRefreshInterval {
+			u.sf.DoChan("", u.refreshConfig)
+		}
+		return c, nil
+	}
+
+	select {
+	case res := <-u.sf.DoChan("", u.refreshConfig):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Config), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refreshConfig fetches a new target config. If the fetch failed, the
+// cached one is kept and returned.
+func (u *Upstream) refreshConfig() (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	c, err := u.fetchConfig(ctx)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	now := time.Now()
+	if err != nil {
+		if u.config != nil { // Keep using the old one.
+			u.logger().Warn("failed to refresh odoh config", zap.String("target", u.Target.Host), zap.Error(err))
+			u.lastFetched = now
+			return u.config, nil
+		}
+		return nil, fmt.Errorf("failed to fetch odoh config, %w", err)
+	}
+	u.logger().Debug("odoh config fetched", zap.String("target", u.Target.Host))
+	u.config = c
+	u.lastFetched = now
+	return c, nil
+}
+
+func (u *Upstream) fetchConfig(ctx context.Context) (*Config, error) {
+	configURL := url.URL{Scheme: u.Target.Scheme, Host: u.Target.Host, Path: "/.well-known/odohconfigs"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header["User-Agent"] = nil
+	c := u.ConfigClient
+	if c == nil {
+		c = u.Client
+	}
+	b, err := doRequest(c, req)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigs(b)
+}
+
+// invalidate removes the cached config c. The config will be fetched
+// again in the next query.
+func (u *Upstream) invalidate(c *Config) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.config == c {
+		u.config = nil
+	}
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	c, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := u.exchange(ctx, c, q)
+	if err != nil {
+		if errors.Is(err, errKeyRejected) {
+			u.invalidate(c)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (u *Upstream) exchange(ctx context.Context, c *Config, q *dns.Msg) (*dns.Msg, error) {
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query msg, %w", err)
+	}
+	body, qc, err := encryptQuery(c, wire)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt query, %w", err)
+	}
+
+	proxyURL := *u.Proxy
+	params := proxyURL.Query()
+	params.Set("targethost", u.Target.Host)
+	params.Set("targetpath", u.Target.EscapedPath())
+	proxyURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{mimeType}
+	req.Header["Accept"] = []string{mimeType}
+	req.Header["User-Agent"] = nil // Don't let go http send a default user agent header.
+	b, err := doRequest(u.Client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rWire, err := qc.decryptResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(rWire); err != nil {
+		return nil, fmt.Errorf("failed to unpack response, %w", err)
+	}
+	r.Id = q.Id
+	return r, nil
+}
+
+func doRequest(c *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("bad http status codes %d with body [%s]", resp.StatusCode, body1k)
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			err = fmt.Errorf("%w, %s", errKeyRejected, err)
+		}
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize*2))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	return b, nil
+}
+
+func (u *Upstream) Close() error {
+	u.Client.CloseIdleConnections()
+	if u.ConfigClient != nil {
+		u.ConfigClient.CloseIdleConnections()
+	}
+	return nil
+}
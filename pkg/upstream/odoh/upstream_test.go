@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9180 A.1.1. DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, Base Setup.
+func TestHPKEVector(t *testing.T) {
+	skE := mustHex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+	skR := mustHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := mustHex("4f6465206f6e2061204772656369616e2055726e")
+
+	enc, s, err := setupBaseSWithKey(skE, pkR, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, want) {
+		t.Fatalf("enc: got %x, want %x", enc, want)
+	}
+	if want := mustHex("56d890e5accaaf011cff4b7d"); !bytes.Equal(s.baseNonce, want) {
+		t.Fatalf("base_nonce: got %x, want %x", s.baseNonce, want)
+	}
+	if want := mustHex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(s.exporterSecret, want) {
+		t.Fatalf("exporter_secret: got %x, want %x", s.exporterSecret, want)
+	}
+
+	aad := mustHex("436f756e742d30")
+	pt := mustHex("4265617574792069732074727574682c20747275746820626561757479")
+	ct := s.seal(aad, pt)
+	if want := mustHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"); !bytes.Equal(ct, want) {
+		t.Fatalf("ct: got %x, want %x", ct, want)
+	}
+	if want := mustHex("3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"); !bytes.Equal(s.export(nil, 32), want) {
+		t.Fatalf("export: got %x, want %x", s.export(nil, 32), want)
+	}
+
+	r, err := setupBaseR(enc, skR, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.open(aad, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pt) {
+		t.Fatalf("open: got %x, want %x", got, pt)
+	}
+}
+
+func TestParseConfigs(t *testing.T) {
+	c := &Config{KemID: kemX25519HKDFSHA256, KdfID: kdfHKDFSHA256, AeadID: aeadAES128GCM, PublicKey: make([]byte, nPk)}
+	unsupported := &Config{KemID: 0x0010, KdfID: kdfHKDFSHA256, AeadID: aeadAES128GCM, PublicKey: make([]byte, 65)}
+
+	// An unsupported config followed by a supported one.
+	b1, b2 := marshalConfigs(unsupported), marshalConfigs(c)
+	b := appendUint16(nil, uint16(len(b1)-2+len(b2)-2))
+	b = append(b, b1[2:]...)
+	b = append(b, b2[2:]...)
+	got, err := ParseConfigs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KemID != c.KemID || !bytes.Equal(got.KeyID(), c.KeyID()) {
+		t.Fatalf("unexpected config %+v", got)
+	}
+
+	if _, err := ParseConfigs(b1); err == nil {
+		t.Fatal("unsupported config should fail")
+	}
+	if _, err := ParseConfigs(b[:len(b)-1]); err == nil {
+		t.Fatal("truncated configs should fail")
+	}
+}
+
+// marshalConfigs marshals c to an ObliviousDoHConfigs.
+func marshalConfigs(c *Config) []byte {
+	contents := c.marshal()
+	b := make([]byte, 0, 6+len(contents))
+	b = appendUint16(b, uint16(4+len(contents)))
+	b = appendUint16(b, odohVersion)
+	b = appendUint16(b, uint16(len(contents)))
+	return append(b, contents...)
+}
+
+// testTarget is an odoh target that answers every query with NXDOMAIN.
+type testTarget struct {
+	sk     []byte
+	config *Config
+}
+
+func newTestTarget() *testTarget {
+	sk := make([]byte, curve25519.ScalarSize)
+	rand.Read(sk)
+	pk, err := curve25519.X25519(sk, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	return &testTarget{
+		sk:     sk,
+		config: &Config{KemID: kemX25519HKDFSHA256, KdfID: kdfHKDFSHA256, AeadID: aeadAES128GCM, PublicKey: pk},
+	}
+}
+
+func (tt *testTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/.well-known/odohconfigs":
+		w.Write(marshalConfigs(tt.config))
+	case "/dns-query":
+		b, _ := io.ReadAll(req.Body)
+		m, err := parseMessage(b)
+		if err != nil || m.typ != messageTypeQuery || len(m.encryptedMessage) < nPk {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(m.keyID, tt.config.KeyID()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		hc, err := setupBaseR(m.encryptedMessage[:nPk], tt.sk, []byte("odoh query"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		qPlain, err := hc.open(messageAAD(messageTypeQuery, m.keyID), m.encryptedMessage[nPk:])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		qWire, err := parsePlaintext(qPlain)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(qWire); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		rWire, _ := r.Pack()
+		resp, err := encryptResponse(hc, qPlain, rWire)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mimeType)
+		w.Write(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// encryptResponse is the target side of queryContext.decryptResponse.
+func encryptResponse(hc *hpkeContext, qPlain, dnsMsg []byte) ([]byte, error) {
+	respNonce := make([]byte, responseNonceSize)
+	if _, err := rand.Read(respNonce); err != nil {
+		return nil, err
+	}
+	key, nonce := deriveResponseSecrets(hc, qPlain, respNonce)
+	ct := newAESGCM(key).Seal(nil, nonce, marshalPlaintext(dnsMsg), messageAAD(messageTypeResponse, respNonce))
+	m := &message{typ: messageTypeResponse, keyID: respNonce, encryptedMessage: ct}
+	return m.marshal(), nil
+}
+
+func Test_Upstream(t *testing.T) {
+	var target atomic.Value
+	target.Store(newTestTarget())
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target.Load().(*testTarget).ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	var relayed int32
+	ps := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&relayed, 1)
+		if req.Header.Get("Content-Type") != mimeType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		u := url.URL{Scheme: "https", Host: req.URL.Query().Get("targethost"), Path: req.URL.Query().Get("targetpath")}
+		fwd, _ := http.NewRequest(http.MethodPost, u.String(), req.Body)
+		fwd.Header.Set("Content-Type", mimeType)
+		resp, err := ts.Client().Do(fwd)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer ps.Close()
+
+	targetURL, _ := url.Parse(ts.URL + "/dns-query")
+	proxyURL, _ := url.Parse(ps.URL + "/proxy")
+	u := &Upstream{
+		Target:       targetURL,
+		Proxy:        proxyURL,
+		Client:       ps.Client(),
+		ConfigClient: ts.Client(),
+	}
+	defer u.Close()
+
+	exchange := func() (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		r, err := u.ExchangeContext(ctx, q)
+		if err == nil && r.Id != q.Id {
+			t.Fatalf("id mismatched")
+		}
+		return r, err
+	}
+
+	r, err := exchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected rcode %d", r.Rcode)
+	}
+	if atomic.LoadInt32(&relayed) != 1 {
+		t.Fatal("query was not relayed by the proxy")
+	}
+
+	// Key rotation. The first query fails and invalidates the cached config.
+	target.Store(newTestTarget())
+	if _, err := exchange(); !errors.Is(err, errKeyRejected) {
+		t.Fatalf("want errKeyRejected, got %v", err)
+	}
+	if _, err := exchange(); err != nil {
+		t.Fatalf("config was not refreshed, %v", err)
+	}
+}
+
+func Test_Upstream_configRefresh(t *testing.T) {
+	var target atomic.Value
+	target.Store(newTestTarget())
+	var fetched int32
+	block := make(chan struct{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		<-block
+		target.Load().(*testTarget).ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	targetURL, _ := url.Parse(ts.URL + "/dns-query")
+	u := &Upstream{Target: targetURL, Proxy: targetURL, Client: ts.Client()}
+	defer u.Close()
+	ctx := context.Background()
+
+	// Concurrent fetches are merged.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := u.getConfig(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(block)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Fatalf("want 1 fetch, got %d", n)
+	}
+
+	// The cached config is served while refreshing.
+	c, _ := u.getConfig(ctx)
+	u.m.Lock()
+	u.lastFetched = time.Now().Add(-configRefreshInterval)
+	u.m.Unlock()
+	target.Store(newTestTarget())
+	if c2, err := u.getConfig(ctx); err != nil || c2 != c {
+		t.Fatalf("want the cached config, got %v", err)
+	}
+	u.sf.Do("", u.refreshConfig) // wait for the background refresh
+	if c2, _ := u.getConfig(ctx); c2 == c {
+		t.Fatal("config is not refreshed in the background")
+	}
+}
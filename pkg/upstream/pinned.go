@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reResolveTimeout is the timeout of a re-resolution.
+const reResolveTimeout = time.Second * 10
+
+// pinnedResolver pins the addresses of the upstream host. Addresses that
+// failed are moved to the end, so following dials switch to the next one.
+// The pinned addresses are replaced by reResolve, which is run by the
+// scheduler if the upstream has a re-resolve interval.
+type pinnedResolver struct {
+	host     string
+	resolver hostResolver
+	logger   *zap.Logger
+
+	m     sync.Mutex
+	addrs []netip.Addr
+}
+
+func newPinnedResolver(host string, addrs []netip.Addr, r hostResolver, lg *zap.Logger) *pinnedResolver {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	return &pinnedResolver{
+		host:     host,
+		resolver: r,
+		logger:   lg,
+		addrs:    addrs,
+	}
+}
+
+func (p *pinnedResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if !strings.EqualFold(strings.TrimSuffix(host, "."), p.host) {
+		return p.resolver.LookupNetIP(ctx, network, host)
+	}
+
+	p.m.Lock()
+	if len(p.addrs) == 0 { // nothing pinned yet
+		p.m.Unlock()
+		if err := p.reResolve(ctx); err != nil {
+			return nil, err
+		}
+		p.m.Lock()
+	}
+	addrs := make([]netip.Addr, 0, len(p.addrs))
+	for _, addr := range p.addrs {
+		switch {
+		case network == "ip4" && !addr.Is4(),
+			network == "ip6" && !addr.Is6():
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	p.m.Unlock()
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// reResolve resolves the host and replaces the pinned addresses.
+// If resolving failed, the pinned addresses are kept.
+func (p *pinnedResolver) reResolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, reResolveTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupNetIP(ctx, "ip", p.host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) > 0 {
+		p.m.Lock()
+		p.addrs = addrs
+		p.m.Unlock()
+	}
+	return nil
+}
+
+// markFailed moves addr to the end of the pinned addresses.
+func (p *pinnedResolver) markFailed(addr netip.Addr) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for i, a := range p.addrs {
+		if a == addr {
+			if i != len(p.addrs)-1 {
+				p.logger.Debug("pinned address failed, switching to the next one", zap.String("host", p.host), zap.Stringer("addr", addr))
+			}
+			p.addrs = append(append(p.addrs[:i:i], p.addrs[i+1:]...), addr)
+			return
+		}
+	}
+}
+
+// failureReporter returns the markFailed of r if r is a *pinnedResolver.
+// Otherwise, it returns nil.
+func failureReporter(r hostResolver) func(addr netip.Addr) {
+	if p, ok := r.(*pinnedResolver); ok {
+		return p.markFailed
+	}
+	return nil
+}
+
+// failureReportingConn is a udp connection to addr. It reports addr to
+// onFailure if the connection was refused, or if a query that was sent
+// got no response before the read deadline.
+type failureReportingConn struct {
+	net.Conn
+	addr      netip.Addr
+	onFailure func(addr netip.Addr)
+	waiting   uint32 // a query was sent and has no response yet
+}
+
+func (c *failureReportingConn) Write(b []byte) (int, error) {
+	atomic.StoreUint32(&c.waiting, 1)
+	return c.Conn.Write(b)
+}
+
+func (c *failureReportingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		atomic.StoreUint32(&c.waiting, 0)
+		return n, nil
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return n, err
+	}
+	var netErr net.Error
+	if !(errors.As(err, &netErr) && netErr.Timeout()) || atomic.LoadUint32(&c.waiting) == 1 {
+		c.onFailure(c.addr)
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testResolver struct {
+	addrs []netip.Addr
+	n     uint32
+}
+
+func (r *testResolver) LookupNetIP(_ context.Context, _, _ string) ([]netip.Addr, error) {
+	atomic.AddUint32(&r.n, 1)
+	return r.addrs, nil
+}
+
+func Test_pinnedResolver(t *testing.T) {
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	a3 := netip.MustParseAddr("192.0.2.3")
+	tr := &testResolver{addrs: []netip.Addr{a3}}
+	p := newPinnedResolver("dns.example", []netip.Addr{a1, a2}, tr, nil)
+
+	h := &happyEyeballsDialer{
+		resolver: p,
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "192.0.2.1:") {
+				return nil, errors.New("unreachable")
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		},
+		onFailure: p.markFailed,
+	}
+	c, err := h.DialContext(context.Background(), "tcp", "dns.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Switched to the next address.
+	addrs, err := p.LookupNetIP(context.Background(), "ip", "DNS.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0] != a2 || addrs[1] != a1 {
+		t.Fatalf("unexpected addrs %v", addrs)
+	}
+	if n := atomic.LoadUint32(&tr.n); n != 0 {
+		t.Fatalf("pinned host should not be resolved, got %d lookups", n)
+	}
+
+	// Other hosts are resolved by the bootstrap.
+	if addrs, _ := p.LookupNetIP(context.Background(), "ip", "other.example"); len(addrs) != 1 || addrs[0] != a3 {
+		t.Fatalf("unexpected addrs %v", addrs)
+	}
+
+	// Re-resolve.
+	if err := p.reResolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = p.LookupNetIP(context.Background(), "ip", "dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != a3 {
+		t.Fatalf("addrs are not re-resolved, got %v", addrs)
+	}
+}
+
+func Test_happyEyeballsDialer_keepPinnedOrder(t *testing.T) {
+	a4 := netip.MustParseAddr("192.0.2.1")
+	a6 := netip.MustParseAddr("2001:db8::1")
+	p := newPinnedResolver("dns.example", []netip.Addr{a4, a6}, &testResolver{}, nil)
+	h := newHappyEyeballsDialer(new(net.Dialer), p)
+	if sorted := h.sortAddrs([]netip.Addr{a4, a6}); sorted[0] != a4 || sorted[1] != a6 {
+		t.Fatalf("pinned order is not kept, got %v", sorted)
+	}
+}
+
+func Test_failureReportingConn(t *testing.T) {
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	p := newPinnedResolver("dns.example", []netip.Addr{a1, a2}, &testResolver{}, nil)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := &failureReportingConn{Conn: c1, addr: a1, onFailure: p.markFailed}
+	defer c.Close()
+	go func() {
+		b := make([]byte, 1)
+		c2.Read(b) // no response
+	}()
+
+	// An idle timeout is not a failure.
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("want timeout err")
+	}
+	if addrs, _ := p.LookupNetIP(context.Background(), "ip", "dns.example"); addrs[0] != a1 {
+		t.Fatalf("idle timeout should not switch address, got %v", addrs)
+	}
+
+	// A query that timed out is.
+	if _, err := c.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("want timeout err")
+	}
+	if addrs, _ := p.LookupNetIP(context.Background(), "ip", "dns.example"); addrs[0] != a2 {
+		t.Fatalf("want switched to the next address, got %v", addrs)
+	}
+}
+
+func Test_NewUpstream_reResolveTask(t *testing.T) {
+	opt := &Opt{ServerIPs: []string{"127.0.0.1"}, ReResolveInterval: time.Hour}
+	if _, err := NewUpstream("tcp://dns.example", opt); err == nil {
+		t.Fatal("want missing scheduler err")
+	}
+
+	s := scheduler.NewScheduler(nil)
+	defer s.Close()
+	opt.Scheduler = s
+	opt.ReResolveTaskName = "re_resolve"
+	opt.Downgrade = []string{"udp"}
+	u, err := NewUpstream("tcp://dns.example", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Get("re_resolve") == nil {
+		t.Fatal("re-resolve task is not added")
+	}
+	u.Close()
+	if s.Get("re_resolve") != nil {
+		t.Fatal("re-resolve task is not canceled")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// contextDialer dials tcp connections.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyConfig is a parsed proxy url.
+type proxyConfig struct {
+	scheme string // "socks5" or "http"
+	addr   string
+	user   *url.Userinfo
+}
+
+// parseProxy parses s, which is "socks5://[user:pass@]host:port" or
+// "http://[user:pass@]host:port".
+func parseProxy(s string) (*proxyConfig, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url, %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		u.Scheme = "socks5"
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol %s", u.Scheme)
+	}
+	if len(u.Port()) == 0 {
+		return nil, fmt.Errorf("missing proxy port")
+	}
+	return &proxyConfig{scheme: u.Scheme, addr: u.Host, user: u.User}, nil
+}
+
+func (p *proxyConfig) socks5Auth() *proxy.Auth {
+	if p.user == nil {
+		return nil
+	}
+	pass, _ := p.user.Password()
+	return &proxy.Auth{User: p.user.Username(), Password: pass}
+}
+
+// tcpDialer returns a dialer that dials tcp connections through the proxy.
+// forward is used to connect to the proxy.
+func (p *proxyConfig) tcpDialer(forward contextDialer) (contextDialer, error) {
+	switch p.scheme {
+	case "socks5":
+		d, err := proxy.SOCKS5("tcp", p.addr, p.socks5Auth(), forwardDialer{forward})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init socks5 dialer, %w", err)
+		}
+		return d.(proxy.ContextDialer), nil
+	default:
+		return &httpConnectDialer{addr: p.addr, user: p.user, forward: forward}, nil
+	}
+}
+
+// forwardDialer makes a contextDialer a proxy.Dialer.
+type forwardDialer struct {
+	contextDialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// httpConnectDialer dials tcp connections through a http proxy
+// with the CONNECT method.
+type httpConnectDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward contextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("http proxy does not support network %s", network)
+	}
+	c, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(ddl)
+	} else {
+		c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		pass, _ := d.user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to write connect request, %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to read connect response, %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("http proxy returned status %s", resp.Status)
+	}
+	if br.Buffered() > 0 { // The server should not send anything before the client does.
+		c.Close()
+		return nil, errors.New("unexpected data from http proxy")
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
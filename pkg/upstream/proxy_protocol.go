@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/pires/go-proxyproto"
+	"net"
+	"net/netip"
+)
+
+type clientAddrKey struct{}
+
+// WithClientAddr returns a copy of ctx that carries the client address of
+// the query. Upstreams with Opt.ProxyProtocol send it in the PROXY protocol
+// header.
+func WithClientAddr(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+func clientAddrFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr)
+	return addr, ok && addr.IsValid()
+}
+
+// proxyProtocolDialer sends a PROXY protocol header on new connections.
+// The source address of the header is the client address in the dial ctx.
+// See WithClientAddr. If ctx has no client address, or its ip family is
+// different from the server's, the local address of the connection is used.
+// Connections must not be shared by queries from different clients.
+type proxyProtocolDialer struct {
+	d       contextDialer
+	version byte
+}
+
+func newProxyProtocolDialer(d contextDialer, version int) (*proxyProtocolDialer, error) {
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("invalid proxy protocol version %d", version)
+	}
+	return &proxyProtocolDialer{d: d, version: byte(version)}, nil
+}
+
+func (d *proxyProtocolDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := d.d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	src := c.LocalAddr()
+	if client, ok := clientAddrFromContext(ctx); ok {
+		if remote, ok := c.RemoteAddr().(*net.TCPAddr); ok && client.Unmap().Is4() == (remote.IP.To4() != nil) {
+			src = &net.TCPAddr{IP: client.Unmap().AsSlice()}
+		}
+	}
+	h := proxyproto.HeaderProxyFromAddrs(d.version, src, c.RemoteAddr())
+	if _, err := h.WriteTo(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to write proxy protocol header, %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/pires/go-proxyproto"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_proxyProtocolDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only connections with a PROXY header will be served.
+	ppl := &proxyproto.Listener{
+		Listener: l,
+		Policy: func(_ net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}
+	srcAddrs := make(chan string, 4)
+	s := dns.Server{
+		Listener: ppl,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			srcAddrs <- w.RemoteAddr().(*net.TCPAddr).IP.String()
+			r := new(dns.Msg)
+			r.SetReply(q)
+			w.WriteMsg(r)
+		}),
+	}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	for _, v := range []int{1, 2} {
+		u, err := NewUpstream("tcp://"+l.Addr().String(), &Opt{ProxyProtocol: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, client := range []string{"192.0.2.1", "192.0.2.2", "", "2001:db8::1"} {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			if len(client) > 0 {
+				ctx = WithClientAddr(ctx, netip.MustParseAddr(client))
+			}
+			_, err = u.ExchangeContext(ctx, q)
+			cancel()
+			if err != nil {
+				t.Fatalf("v%d: %v", v, err)
+			}
+			// Without a client address of the same ip family, the local
+			// address of the connection is sent.
+			want := client
+			if len(client) == 0 || client == "2001:db8::1" {
+				want = "127.0.0.1"
+			}
+			if got := <-srcAddrs; got != want {
+				t.Fatalf("v%d: want source %s, got %s", v, want, got)
+			}
+		}
+		u.Close()
+	}
+
+	if _, err := NewUpstream("tcp://127.0.0.1", &Opt{ProxyProtocol: 3}); err == nil {
+		t.Fatal("invalid version should be rejected")
+	}
+	if _, err := NewUpstream("quic://127.0.0.1", &Opt{ProxyProtocol: 2}); err == nil {
+		t.Fatal("doq should be rejected")
+	}
+	if _, err := NewUpstream("odoh://127.0.0.1/dns-query", &Opt{ProxyProtocol: 2, ODoHProxy: "https://127.0.0.1/proxy"}); err == nil {
+		t.Fatal("odoh should be rejected")
+	}
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// socks5TestServer is a minimal socks5 server that supports
+// CONNECT, UDP ASSOCIATE and username/password authentication.
+type socks5TestServer struct {
+	user, pass string
+	conns      int32
+}
+
+func newSocks5TestServer(t testing.TB, user, pass string) (s *socks5TestServer, addr string, shutdownFunc func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &socks5TestServer{user: user, pass: pass}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.handle(c)
+		}
+	}()
+	return s, l.Addr().String(), func() { l.Close() }
+}
+
+func (s *socks5TestServer) handle(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, 262)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+		return
+	}
+	if len(s.user) > 0 {
+		c.Write([]byte{5, 2})
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+		u := make([]byte, b[1])
+		io.ReadFull(c, u)
+		io.ReadFull(c, b[:1])
+		p := make([]byte, b[0])
+		io.ReadFull(c, p)
+		if string(u) != s.user || string(p) != s.pass {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	} else {
+		c.Write([]byte{5, 0})
+	}
+
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	cmd := b[1]
+	var host string
+	switch b[3] {
+	case socks5AtypIPv4:
+		io.ReadFull(c, b[:4])
+		host = net.IP(b[:4]).String()
+	case socks5AtypDomain:
+		io.ReadFull(c, b[:1])
+		l := int(b[0])
+		io.ReadFull(c, b[:l])
+		host = string(b[:l])
+	case socks5AtypIPv6:
+		io.ReadFull(c, b[:16])
+		host = net.IP(b[:16]).String()
+	}
+	io.ReadFull(c, b[:2])
+	dst := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2]))))
+
+	switch cmd {
+	case 1: // CONNECT
+		rc, err := net.Dial("tcp", dst)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer rc.Close()
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(rc, c)
+		io.Copy(c, rc)
+	case socks5CmdUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// Reply an unspecified address, the client should use the proxy address.
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		go s.relayUDP(relay)
+		io.Copy(io.Discard, c)
+	}
+}
+
+func (s *socks5TestServer) relayUDP(relay *net.UDPConn) {
+	b := make([]byte, 65535)
+	var client netip.AddrPort
+	for {
+		n, from, err := relay.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return
+		}
+		if from == client || !client.IsValid() && n > 10 {
+			// From client.
+			client = from
+			if b[3] != socks5AtypIPv4 {
+				continue
+			}
+			addr, _ := netip.AddrFromSlice(b[4:8])
+			dst := netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[8:10]))
+			relay.WriteToUDPAddrPort(b[10:n], dst)
+			continue
+		}
+		// From remote.
+		p := append([]byte{0, 0, 0, socks5AtypIPv4}, from.Addr().AsSlice()...)
+		p = append(p, byte(from.Port()>>8), byte(from.Port()))
+		p = append(p, b[:n]...)
+		relay.WriteToUDPAddrPort(p, client)
+	}
+}
+
+// newHTTPProxyTestServer starts a http proxy that only supports CONNECT.
+func newHTTPProxyTestServer(t testing.TB, user, pass string) (addr string, shutdownFunc func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAuth := ""
+	if len(user) > 0 {
+		wantAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect {
+					c.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != wantAuth {
+					c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer rc.Close()
+				c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func Test_upstream_socks5(t *testing.T) {
+	for _, auth := range [...]bool{false, true} {
+		user, pass := "", ""
+		if auth {
+			user, pass = "user", "pass"
+		}
+		ps, proxyAddr, shutdownProxy := newSocks5TestServer(t, user, pass)
+		proxyURL := "socks5://" + proxyAddr
+		if auth {
+			proxyURL = "socks5://user:pass@" + proxyAddr
+		}
+		for _, scheme := range [...]string{"udp", "tcp", "tls"} {
+			t.Run(scheme, func(t *testing.T) {
+				addr, shutdownServer := m[scheme](t, &vServer{})
+				defer shutdownServer()
+				u, err := NewUpstream(scheme+"://"+addr, &Opt{
+					Proxy:     proxyURL,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer u.Close()
+				before := atomic.LoadInt32(&ps.conns)
+				if err := testUpstream(u); err != nil {
+					t.Fatal(err)
+				}
+				if atomic.LoadInt32(&ps.conns) == before {
+					t.Fatal("query did not go through the proxy")
+				}
+			})
+		}
+
+		if auth {
+			u, err := NewUpstream("tcp://127.0.0.1:1", &Opt{Proxy: "socks5://user:bad@" + proxyAddr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := testUpstream(u); err == nil {
+				t.Fatal("want auth err")
+			}
+			u.Close()
+		}
+		shutdownProxy()
+	}
+}
+
+func Test_upstream_legacySocks5(t *testing.T) {
+	ps, proxyAddr, shutdownProxy := newSocks5TestServer(t, "", "")
+	defer shutdownProxy()
+	addr, shutdownServer := m["udp"](t, &vServer{})
+	defer shutdownServer()
+
+	for _, socks5UDP := range [...]bool{false, true} {
+		u, err := NewUpstream("udp://"+addr, &Opt{Socks5: proxyAddr, Socks5UDP: socks5UDP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := atomic.LoadInt32(&ps.conns)
+		if err := testUpstream(u); err != nil {
+			t.Fatal(err)
+		}
+		if proxied := atomic.LoadInt32(&ps.conns) != before; proxied != socks5UDP {
+			t.Fatalf("socks5_udp %v, but udp queries went through the proxy: %v", socks5UDP, proxied)
+		}
+		u.Close()
+	}
+}
+
+func Test_upstream_httpProxy(t *testing.T) {
+	proxyAddr, shutdownProxy := newHTTPProxyTestServer(t, "user", "pass")
+	defer shutdownProxy()
+
+	for _, scheme := range [...]string{"tcp", "tls"} {
+		t.Run(scheme, func(t *testing.T) {
+			addr, shutdownServer := m[scheme](t, &vServer{})
+			defer shutdownServer()
+			u, err := NewUpstream(scheme+"://"+addr, &Opt{
+				Proxy:     "http://user:pass@" + proxyAddr,
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			if err := testUpstream(u); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	u, err := NewUpstream("tcp://127.0.0.1:1", &Opt{Proxy: "http://" + proxyAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testUpstream(u); err == nil {
+		t.Fatal("want auth err")
+	}
+	u.Close()
+
+	for _, addr := range [...]string{"udp://127.0.0.1", "quic://127.0.0.1"} {
+		if _, err := NewUpstream(addr, &Opt{Proxy: "http://" + proxyAddr}); err == nil {
+			t.Fatalf("%s: want unsupported err", addr)
+		}
+	}
+	if _, err := NewUpstream("tcp://127.0.0.1", &Opt{Proxy: "ftp://127.0.0.1:21"}); err == nil {
+		t.Fatal("want invalid proxy err")
+	}
+}
+
+func Test_upstream_proxyBootstrapIPs(t *testing.T) {
+	_, proxyAddr, shutdownProxy := newSocks5TestServer(t, "", "")
+	defer shutdownProxy()
+
+	// The proxy cannot resolve dns.test. The upstream must send the
+	// bootstrap ip instead.
+	for _, scheme := range [...]string{"udp", "tcp"} {
+		t.Run(scheme, func(t *testing.T) {
+			addr, shutdownServer := m[scheme](t, &vServer{})
+			defer shutdownServer()
+			_, port, _ := net.SplitHostPort(addr)
+			u, err := NewUpstream(scheme+"://dns.test:"+port, &Opt{
+				Proxy:        "socks5://" + proxyAddr,
+				BootstrapIPs: []string{"127.0.0.1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			if err := testUpstream(u); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
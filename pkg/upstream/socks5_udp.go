@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// Socks5 constants. See RFC 1928 and RFC 1929.
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthNoAccept    = 0xff
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+
+	socks5MaxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+)
+
+// dialSocks5UDP creates a udp association on the socks5 server p and
+// returns a connection that exchanges udp packets with target through it.
+// The association is terminated when the connection is closed.
+func dialSocks5UDP(ctx context.Context, p *proxyConfig, tcpDialer contextDialer, udpDialer *net.Dialer, target string) (net.Conn, error) {
+	header, err := socks5UDPHeader(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := tcpDialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(ddl)
+	} else {
+		ctrl.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	}
+	relay, err := socks5UDPAssociate(ctrl, p)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5 udp associate, %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// The relay address may be unspecified. Use the address of the proxy.
+	if relay.Addr().IsUnspecified() {
+		if ta, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay = netip.AddrPortFrom(ta.AddrPort().Addr().Unmap(), relay.Port())
+		}
+	}
+	uc, err := udpDialer.DialContext(ctx, "udp", relay.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &socks5UDPConn{Conn: uc, ctrl: ctrl, header: header}
+	go func() {
+		// The association terminates when the control connection closes.
+		_, _ = io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// socks5UDPAssociate does the handshake on ctrl and returns the relay address.
+func socks5UDPAssociate(ctrl net.Conn, p *proxyConfig) (netip.AddrPort, error) {
+	auth := p.socks5Auth()
+	method := byte(socks5AuthNone)
+	if auth != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 1, method}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b[0] != socks5Version {
+		return netip.AddrPort{}, fmt.Errorf("unexpected socks version %d", b[0])
+	}
+	switch b[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if auth == nil {
+			return netip.AddrPort{}, errors.New("server requires authentication")
+		}
+		if len(auth.User) > 255 || len(auth.Password) > 255 {
+			return netip.AddrPort{}, errors.New("username or password is too long")
+		}
+		req := []byte{0x01, byte(len(auth.User))}
+		req = append(req, auth.User...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(ctrl, b); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if b[1] != 0x00 {
+			return netip.AddrPort{}, errors.New("authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return netip.AddrPort{}, errors.New("no acceptable authentication method")
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported authentication method %d", b[1])
+	}
+
+	// The client address is unknown before the udp socket is created.
+	req := []byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, hdr); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[1] != 0x00 {
+		return netip.AddrPort{}, fmt.Errorf("server replied %d", hdr[1])
+	}
+	var addrLen int
+	switch hdr[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported relay address type %d", hdr[3])
+	}
+	ap := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(ctrl, ap); err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(ap[:addrLen])
+	return netip.AddrPortFrom(addr.Unmap(), binary.BigEndian.Uint16(ap[addrLen:])), nil
+}
+
+// socks5UDPHeader returns the udp request header for target.
+func socks5UDPHeader(target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	h := []byte{0, 0, 0} // RSV, FRAG
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			h = append(h, socks5AtypIPv4)
+		} else {
+			h = append(h, socks5AtypIPv6)
+		}
+		h = append(h, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host %s is too long", host)
+		}
+		h = append(h, socks5AtypDomain, byte(len(host)))
+		h = append(h, host...)
+	}
+	return append(h, byte(port>>8), byte(port)), nil
+}
+
+// socks5UDPConn is a udp connection through a socks5 udp relay.
+type socks5UDPConn struct {
+	net.Conn // to the relay
+	ctrl     net.Conn
+	header   []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	buf := pool.GetBuf(len(c.header) + len(b))
+	defer buf.Release()
+	p := buf.Bytes()
+	n := copy(p, c.header)
+	copy(p[n:], b)
+	if _, err := c.Conn.Write(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := pool.GetBuf(len(b) + socks5MaxUDPHeaderLen)
+	defer buf.Release()
+	p := buf.Bytes()
+	for {
+		n, err := c.Conn.Read(p)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := socks5UDPPayload(p[:n])
+		if !ok {
+			continue // Invalid or fragmented packet, drop it.
+		}
+		return copy(b, payload), nil
+	}
+}
+
+// socks5UDPPayload strips the header of a udp packet from the relay.
+func socks5UDPPayload(p []byte) ([]byte, bool) {
+	if len(p) < 4 || p[2] != 0 { // no fragmentation support
+		return nil, false
+	}
+	var l int
+	switch p[3] {
+	case socks5AtypIPv4:
+		l = 4 + 4 + 2
+	case socks5AtypIPv6:
+		l = 4 + 16 + 2
+	case socks5AtypDomain:
+		if len(p) < 5 {
+			return nil, false
+		}
+		l = 4 + 1 + int(p[4]) + 2
+	default:
+		return nil, false
+	}
+	if len(p) < l {
+		return nil, false
+	}
+	return p[l:], true
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/ameshkov/dnsstamps"
+	"net"
+	"strings"
+)
+
+const stampScheme = "sdns://"
+
+// stampToAddr converts a stamp to an upstream address. It returns a copy
+// of opt that carries the server address and certificate hashes in the
+// stamp. Options that have been set in opt take precedence.
+// DNSCrypt stamps are returned as they are.
+func stampToAddr(s string, opt *Opt) (string, *Opt, error) {
+	stamp, err := dnsstamps.NewServerStampFromString(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid dns stamp, %w", err)
+	}
+
+	o := *opt
+	var addr string
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		return s, &o, nil
+	case dnsstamps.StampProtoTypePlain:
+		return "udp://" + stamp.ServerAddrStr, &o, nil
+	case dnsstamps.StampProtoTypeDoH:
+		addr = "https://" + stamp.ProviderName + stamp.Path
+	case dnsstamps.StampProtoTypeTLS:
+		addr = "tls://" + stamp.ProviderName
+	case dnsstamps.StampProtoTypeDoQ:
+		addr = "quic://" + stamp.ProviderName
+	default:
+		return "", nil, fmt.Errorf("unsupported stamp protocol %d", stamp.Proto)
+	}
+
+	if len(o.DialAddr) == 0 {
+		o.DialAddr = fixStampPort(stamp.Proto, stamp.ServerAddrStr)
+	}
+	if len(stamp.Hashes) > 0 {
+		if o.TLSConfig != nil {
+			o.TLSConfig = o.TLSConfig.Clone()
+		} else {
+			o.TLSConfig = new(tls.Config)
+		}
+		o.TLSConfig.VerifyPeerCertificate = verifyCertHashes(stamp.Hashes, o.TLSConfig.VerifyPeerCertificate)
+	}
+	return addr, &o, nil
+}
+
+// fixStampPort replaces the wrong default ports of DoT (843) and DoQ (784)
+// that dnsstamps adds to addresses without a port with 853.
+// Note: A custom port that equals to them will also be replaced.
+func fixStampPort(proto dnsstamps.StampProtoType, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if (proto == dnsstamps.StampProtoTypeTLS && port == "843") || (proto == dnsstamps.StampProtoTypeDoQ && port == "784") {
+		return net.JoinHostPort(host, "853")
+	}
+	return addr
+}
+
+// verifyCertHashes returns a tls.Config.VerifyPeerCertificate func that
+// requires the SHA256 digest of the TBS certificate of at least one
+// certificate in the chain to be in hashes. next will be called if it is
+// not nil.
+func verifyCertHashes(hashes [][]byte, next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			for _, want := range hashes {
+				if bytes.Equal(h[:], want) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate matches the hashes in the dns stamp")
+	}
+}
+
+func isStamp(addr string) bool {
+	return strings.HasPrefix(addr, stampScheme)
+}
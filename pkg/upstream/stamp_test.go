@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"github.com/ameshkov/dnsstamps"
+	"testing"
+)
+
+func Test_stampToAddr(t *testing.T) {
+	tests := []struct {
+		name         string
+		stamp        dnsstamps.ServerStamp
+		wantAddr     string
+		wantDialAddr string
+		wantErr      bool
+	}{
+		{
+			name:     "plain",
+			stamp:    dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: "1.1.1.1"},
+			wantAddr: "udp://1.1.1.1:53",
+		},
+		{
+			name:         "doh",
+			stamp:        dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ServerAddrStr: "1.1.1.1", ProviderName: "dns.example", Path: "/dns-query"},
+			wantAddr:     "https://dns.example/dns-query",
+			wantDialAddr: "1.1.1.1:443",
+		},
+		{
+			name:     "doh without addr",
+			stamp:    dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ProviderName: "dns.example", Path: "/dns-query"},
+			wantAddr: "https://dns.example/dns-query",
+		},
+		{
+			name:         "dot",
+			stamp:        dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: "1.1.1.1", ProviderName: "dns.example"},
+			wantAddr:     "tls://dns.example",
+			wantDialAddr: "1.1.1.1:853",
+		},
+		{
+			name:         "doq with custom port",
+			stamp:        dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoQ, ServerAddrStr: "1.1.1.1:8853", ProviderName: "dns.example"},
+			wantAddr:     "quic://dns.example",
+			wantDialAddr: "1.1.1.1:8853",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, o, err := stampToAddr(tt.stamp.String(), new(Opt))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stampToAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if addr != tt.wantAddr {
+				t.Errorf("stampToAddr() addr = %v, want %v", addr, tt.wantAddr)
+			}
+			if o.DialAddr != tt.wantDialAddr {
+				t.Errorf("stampToAddr() dial addr = %v, want %v", o.DialAddr, tt.wantDialAddr)
+			}
+		})
+	}
+
+	// User specified DialAddr takes precedence.
+	s := dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: "1.1.1.1", ProviderName: "dns.example"}
+	_, o, err := stampToAddr(s.String(), &Opt{DialAddr: "8.8.8.8"})
+	if err != nil || o.DialAddr != "8.8.8.8" {
+		t.Fatalf("unexpected dial addr %s, err %v", o.DialAddr, err)
+	}
+	if _, _, err := stampToAddr("sdns://invalid", new(Opt)); err == nil {
+		t.Fatal("want invalid stamp err")
+	}
+}
+
+func Test_upstream_stamp(t *testing.T) {
+	addr, shutdown := newUDPTestServer(t, &vServer{})
+	defer shutdown()
+	plain := dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: addr}
+	u, err := NewUpstream(plain.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+
+	dotAddr, shutdown := newDoTTestServer(t, &vServer{})
+	defer shutdown()
+	c, err := tls.Dial("tcp", dotAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(c.ConnectionState().PeerCertificates[0].RawTBSCertificate)
+	c.Close()
+
+	for _, hash := range [][]byte{h[:], make([]byte, 32)} {
+		dot := dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: dotAddr, ProviderName: "test", Hashes: [][]byte{hash}}
+		u, err := NewUpstream(dot.String(), &Opt{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = testUpstream(u)
+		u.Close()
+		matched := bytes.Equal(hash, h[:])
+		if matched && err != nil {
+			t.Fatal(err)
+		}
+		if !matched && err == nil {
+			t.Fatal("want hash mismatch err")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// sessionCache is shared by tls and https upstreams. Sessions are keyed
+// by the server name, so new connections resume the sessions of other
+// connections (and upstreams) to the same server.
+var sessionCache = tls.NewLRUClientSessionCache(1024)
+
+// sharedSessionCache stores sessions in sessionCache. Resumed sessions
+// skip most of the certificate verification, so sessions are only shared
+// by configs that trust the same roots. The session keys of crypto/tls
+// already have the server name.
+type sharedSessionCache struct {
+	prefix string
+}
+
+// newSharedSessionCache returns a cache for configs that trust the roots
+// of rootsDigest. Empty rootsDigest means the system roots.
+func newSharedSessionCache(rootsDigest string) sharedSessionCache {
+	return sharedSessionCache{prefix: rootsDigest + "|"}
+}
+
+func (c sharedSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return sessionCache.Get(c.prefix + sessionKey)
+}
+
+func (c sharedSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	sessionCache.Put(c.prefix+sessionKey, cs)
+}
+
+// newTLSConfig returns a copy of opt.TLSConfig for an upstream. It sets the
+// server name (if not empty), the session cache and the certificate pins.
+// Quic upstreams, upstreams that have custom verifications and upstreams
+// that have custom roots without Opt.RootCAsDigest use their own session
+// cache.
+func newTLSConfig(opt *Opt, serverName string, isQUIC bool) (*tls.Config, error) {
+	var c *tls.Config
+	if opt.TLSConfig != nil {
+		c = opt.TLSConfig.Clone()
+	} else {
+		c = new(tls.Config)
+	}
+	if len(c.ServerName) == 0 {
+		c.ServerName = serverName
+	}
+	if c.ClientSessionCache == nil {
+		customVerify := c.InsecureSkipVerify || c.VerifyPeerCertificate != nil || c.VerifyConnection != nil || len(opt.CertPinSHA256) > 0
+		unknownRoots := c.RootCAs != nil && len(opt.RootCAsDigest) == 0
+		if isQUIC || customVerify || unknownRoots {
+			c.ClientSessionCache = tls.NewLRUClientSessionCache(16)
+		} else {
+			c.ClientSessionCache = newSharedSessionCache(opt.RootCAsDigest)
+		}
+	}
+	if len(opt.CertPinSHA256) > 0 {
+		pins := make([][]byte, 0, len(opt.CertPinSHA256))
+		for _, s := range opt.CertPinSHA256 {
+			pin, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 pin %s", s)
+			}
+			pins = append(pins, pin)
+		}
+		// Pins replace the CA verification.
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = verifyPins(pins, c.VerifyConnection)
+	}
+	return c, nil
+}
+
+// verifyPins returns a func that accepts the connection if the public key
+// of the server certificate is pinned, or the certificate is issued by a
+// certificate that has a pinned public key.
+func verifyPins(pins [][]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	isPinned := func(cert *x509.Certificate) bool {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(h[:], pin) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server has no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		if isPinned(leaf) {
+			return nil
+		}
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		hasPinned := false
+		for _, cert := range cs.PeerCertificates[1:] {
+			if isPinned(cert) {
+				roots.AddCert(cert)
+				hasPinned = true
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if !hasPinned {
+			return errors.New("no certificate matches the pinned public keys")
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
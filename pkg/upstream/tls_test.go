@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func Test_newTLSConfig_pins(t *testing.T) {
+	ca, caKey := newTestCert(t, "ca", true, nil, nil)
+	leaf, _ := newTestCert(t, "dns.example", false, ca, caKey)
+	forged, _ := newTestCert(t, "dns.example", false, nil, nil)
+
+	tests := []struct {
+		name    string
+		pins    []string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{"pinned leaf", []string{spkiPin(leaf)}, []*x509.Certificate{leaf, ca}, false},
+		{"pinned issuer", []string{spkiPin(ca)}, []*x509.Certificate{leaf, ca}, false},
+		{"forged leaf with pinned issuer", []string{spkiPin(ca)}, []*x509.Certificate{forged, ca}, true},
+		{"not pinned", []string{spkiPin(forged)}, []*x509.Certificate{leaf, ca}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newTLSConfig(&Opt{CertPinSHA256: tt.pins}, "dns.example", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.InsecureSkipVerify {
+				t.Fatal("pins should replace the ca verification")
+			}
+			err = c.VerifyConnection(tls.ConnectionState{ServerName: "dns.example", PeerCertificates: tt.certs})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyConnection() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newTLSConfig(&Opt{CertPinSHA256: []string{"invalid"}}, "", false); err == nil {
+		t.Fatal("want invalid pin err")
+	}
+}
+
+func Test_newTLSConfig_sessionCache(t *testing.T) {
+	c1, _ := newTLSConfig(&Opt{}, "a.example", false)
+	c2, _ := newTLSConfig(&Opt{TLSConfig: &tls.Config{}}, "b.example", false)
+	if c1.ClientSessionCache != c2.ClientSessionCache {
+		t.Fatal("tls upstreams should share the session cache")
+	}
+	if c1.ServerName != "a.example" {
+		t.Fatalf("unexpected server name %s", c1.ServerName)
+	}
+
+	for _, opt := range []*Opt{
+		{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}},
+		{TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+		{CertPinSHA256: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}},
+	} {
+		c, _ := newTLSConfig(opt, "a.example", false)
+		if c.ClientSessionCache == nil || c.ClientSessionCache == c1.ClientSessionCache {
+			t.Fatal("upstreams that have different verifications should not share sessions")
+		}
+	}
+
+	// Pools are identified by their digests, not their addresses.
+	d1, _ := newTLSConfig(&Opt{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}, RootCAsDigest: "d1"}, "a.example", false)
+	d2, _ := newTLSConfig(&Opt{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}, RootCAsDigest: "d1"}, "b.example", false)
+	d3, _ := newTLSConfig(&Opt{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}, RootCAsDigest: "d2"}, "a.example", false)
+	if d1.ClientSessionCache != d2.ClientSessionCache {
+		t.Fatal("upstreams that trust the same roots should share the session cache")
+	}
+	if d1.ClientSessionCache == d3.ClientSessionCache || d1.ClientSessionCache == c1.ClientSessionCache {
+		t.Fatal("upstreams that trust different roots should not share sessions")
+	}
+
+	c3, _ := newTLSConfig(&Opt{}, "a.example", true)
+	if c3.ClientSessionCache == nil || c3.ClientSessionCache == c1.ClientSessionCache {
+		t.Fatal("quic upstreams should have their own session cache")
+	}
+}
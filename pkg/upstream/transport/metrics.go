@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics collects the connection pool metrics of Transports. A nil
+// Metrics or nil field is ignored. The collectors can be shared by
+// multiple Transports.
+type Metrics struct {
+	// OpenConns is the number of open connections, including the
+	// connections that are being dialed.
+	OpenConns prometheus.Gauge
+	// Dials counts the dialed connections.
+	Dials prometheus.Counter
+	// DialErrors counts the connections that failed to dial.
+	DialErrors prometheus.Counter
+	// ReusedQueries counts the queries that were sent through an
+	// existing connection.
+	ReusedQueries prometheus.Counter
+}
+
+func (m *Metrics) connOpened() {
+	if m == nil {
+		return
+	}
+	if m.OpenConns != nil {
+		m.OpenConns.Inc()
+	}
+	if m.Dials != nil {
+		m.Dials.Inc()
+	}
+}
+
+func (m *Metrics) connClosed() {
+	if m != nil && m.OpenConns != nil {
+		m.OpenConns.Dec()
+	}
+}
+
+func (m *Metrics) dialFailed() {
+	if m != nil && m.DialErrors != nil {
+		m.DialErrors.Inc()
+	}
+}
+
+func (m *Metrics) connReused() {
+	if m != nil && m.ReusedQueries != nil {
+		m.ReusedQueries.Inc()
+	}
+}
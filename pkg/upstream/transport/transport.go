@@ -22,8 +22,10 @@ package transport
 import (
 	"context"
 	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"io"
 	"net"
@@ -78,7 +80,9 @@ type Opts struct {
 	EnablePipeline bool
 
 	// MaxConns controls the maximum pipeline connections Transport can open.
-	// It includes dialing connections.
+	// It includes dialing connections. Queries are sent through the
+	// connection that has the fewest pending queries. A new connection is
+	// opened only if all connections are busy.
 	// Default is defaultMaxConns.
 	// Each connection can handle no more than 65535 queries concurrently.
 	// Typically, it is very rare reaching that limit.
@@ -88,6 +92,17 @@ type Opts struct {
 	// can handle. The connection will be closed if it reached the limit.
 	// Default is defaultMaxQueryPerConn.
 	MaxQueryPerConn uint16
+
+	// Metrics collects the connection pool metrics. Optional.
+	Metrics *Metrics
+
+	// MatchQuestionCase drops replies whose question names have a
+	// different letter case from the queries. Used by DNS 0x20.
+	MatchQuestionCase bool
+
+	// InvalidResponses counts the replies that were dropped because their
+	// ids or questions did not match the queries. Optional.
+	InvalidResponses prometheus.Counter
 }
 
 // init check and set defaults for this Opts.
@@ -130,8 +145,9 @@ type Transport struct {
 }
 
 type pipelineStatus struct {
-	wg     sync.WaitGroup
-	served int
+	wg      sync.WaitGroup
+	served  int
+	pending int // queries that are being exchanged, protected by Transport.m
 }
 
 func (t *Transport) isClosed() bool {
@@ -191,13 +207,13 @@ func (t *Transport) exchangeWithPipelineConn(ctx context.Context, m *dns.Msg) (*
 			t.opts.Logger.Debug("retrying pipeline connection", zap.NamedError("previous_err", latestErr), zap.Int("attempt", attempt))
 		}
 
-		conn, allocatedQid, isNewConn, wg, err := t.getPipelineConn()
+		conn, allocatedQid, isNewConn, status, err := t.getPipelineConn()
 		if err != nil {
 			return nil, err
 		}
 
 		r, err := conn.exchangePipeline(ctx, m, allocatedQid)
-		wg.Done()
+		t.releasePipelineConn(status)
 
 		if err != nil {
 			if !isNewConn && attempt <= maxRetry {
@@ -210,8 +226,11 @@ func (t *Transport) exchangeWithPipelineConn(ctx context.Context, m *dns.Msg) (*
 }
 
 func (t *Transport) exchangeWithoutConnReuse(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	t.opts.Metrics.connOpened()
+	defer t.opts.Metrics.connClosed()
 	conn, err := t.opts.DialFunc(ctx)
 	if err != nil {
+		t.opts.Metrics.dialFailed()
 		return nil, err
 	}
 	defer conn.Close()
@@ -230,8 +249,18 @@ func (t *Transport) exchangeWithoutConnReuse(ctx context.Context, m *dns.Msg) (*
 
 	resChan := make(chan *result, 1)
 	go func() {
-		b, _, err := t.opts.ReadFunc(conn)
-		resChan <- &result{b, err}
+		for {
+			r, _, err := t.opts.ReadFunc(conn)
+			if err != nil {
+				resChan <- &result{nil, err}
+				return
+			}
+			if r.Id == m.Id && t.questionMatched(m, r) {
+				resChan <- &result{r, nil}
+				return
+			}
+			t.invalidResponse()
+		}
 	}()
 
 	select {
@@ -291,6 +320,7 @@ func (t *Transport) getReusableConn() (c *dnsConn, reused bool, err error) {
 			delete(t.reusableConns, c)
 			continue
 		}
+		t.opts.Metrics.connReused()
 		return c, true, nil
 	}
 
@@ -329,12 +359,12 @@ func (t *Transport) releaseReusableConn(c *dnsConn, err error) {
 }
 
 // getPipelineConn returns a dnsConn for pipelining queries.
-// Caller must call wg.Done() after dnsConn.exchangePipeline.
+// Caller must call releasePipelineConn after dnsConn.exchangePipeline.
 func (t *Transport) getPipelineConn() (
 	conn *dnsConn,
 	allocatedQid uint16,
 	isNewConn bool,
-	wg *sync.WaitGroup,
+	status *pipelineStatus,
 	err error,
 ) {
 	t.m.Lock()
@@ -345,39 +375,42 @@ func (t *Transport) getPipelineConn() (
 		return
 	}
 
-	// Try to get an existing connection.
-	var connStatus *pipelineStatus
-	for c, status := range t.pipelineConns {
+	// Pick the connection that has the fewest pending queries.
+	for c, s := range t.pipelineConns {
 		if c.isClosed() || t.connTooOld(c) {
 			delete(t.pipelineConns, c)
 			continue
 		}
-		conn = c
-		connStatus = status
-		break
+		if conn == nil || s.pending < status.pending {
+			conn = c
+			status = s
+		}
 	}
 
-	// No conn available, create a new one.
-	if conn == nil || (conn.queueLen() > 0 && len(t.pipelineConns) < t.opts.MaxConns) {
+	// No conn available, or all conns are busy. Create a new one.
+	if conn == nil || (status.pending > 0 && len(t.pipelineConns) < t.opts.MaxConns) {
 		conn = newDNSConn(t)
 		isNewConn = true
 		if t.pipelineConns == nil {
 			t.pipelineConns = make(map[*dnsConn]*pipelineStatus)
 		}
-		connStatus = &pipelineStatus{}
-		t.pipelineConns[conn] = connStatus
+		status = &pipelineStatus{}
+		t.pipelineConns[conn] = status
+	} else {
+		t.opts.Metrics.connReused()
 	}
 
-	connStatus.served++
-	connStatus.wg.Add(1)
-	eol := connStatus.served >= int(t.opts.MaxQueryPerConn)
-	allocatedQid = uint16(connStatus.served)
-	wg = &connStatus.wg
+	status.served++
+	status.pending++
+	status.wg.Add(1)
+	eol := status.served >= int(t.opts.MaxQueryPerConn)
+	allocatedQid = uint16(status.served)
 	if eol {
 		// This connection has served too many queries.
 		// Note: the connection should be closed only after all its queries finished.
 		// We can't close it here. Some queries may still on that connection.
 		delete(t.pipelineConns, conn)
+		wg := &status.wg
 		defer func() {
 			go func() {
 				wg.Wait()
@@ -388,6 +421,15 @@ func (t *Transport) getPipelineConn() (
 	return
 }
 
+// releasePipelineConn releases a query slot of the connection from
+// getPipelineConn.
+func (t *Transport) releasePipelineConn(status *pipelineStatus) {
+	t.m.Lock()
+	status.pending--
+	t.m.Unlock()
+	status.wg.Done()
+}
+
 // connTooOld returns true if c's last read time is close to
 // its idle deadline.
 func (t *Transport) connTooOld(c *dnsConn) bool {
@@ -406,7 +448,7 @@ type dnsConn struct {
 	t *Transport
 
 	queueMu sync.Mutex // queue lock
-	queue   map[uint16]chan *dns.Msg
+	queue   map[uint16]*pendingQuery
 
 	connMu             sync.Mutex
 	dialFinishedNotify chan struct{}
@@ -423,9 +465,10 @@ func newDNSConn(t *Transport) *dnsConn {
 	dc := &dnsConn{
 		t:                  t,
 		dialFinishedNotify: make(chan struct{}),
-		queue:              make(map[uint16]chan *dns.Msg),
+		queue:              make(map[uint16]*pendingQuery),
 		closeNotify:        make(chan struct{}),
 	}
+	t.opts.Metrics.connOpened()
 	go dc.dialAndRead()
 	return dc
 }
@@ -456,7 +499,7 @@ func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 
 	qid := q.Id
 	resChan := make(chan *dns.Msg, 1)
-	dc.addQueueC(qid, resChan)
+	dc.addQueueC(qid, &pendingQuery{q: q, c: resChan})
 	defer dc.deleteQueueC(qid)
 
 	dc.c.SetWriteDeadline(time.Now().Add(writeTimeout))
@@ -482,6 +525,7 @@ func (dc *dnsConn) dialAndRead() {
 	defer cancel()
 	c, err := dc.t.opts.DialFunc(dialCtx)
 	if err != nil {
+		dc.t.opts.Metrics.dialFailed()
 		dc.closeWithErr(err)
 		return
 	}
@@ -510,14 +554,53 @@ func (dc *dnsConn) readLoop() {
 		}
 		dc.updateReadTime()
 
-		resChan := dc.getQueueC(r.Id)
-		if resChan != nil {
-			select {
-			case resChan <- r: // resChan has buffer
-			default:
+		pq := dc.getQueueC(r.Id)
+		if pq == nil {
+			continue
+		}
+		// A reply that has the correct id but a different question is
+		// probably forged. Drop it and keep waiting for the real one.
+		if !dc.t.questionMatched(pq.q, r) {
+			dc.t.invalidResponse()
+			dc.t.opts.Logger.Debug(
+				"dropping reply with mismatched question",
+				zap.Stringer("remote", dc.c.RemoteAddr()),
+				zap.Uint16("qid", r.Id),
+			)
+			continue
+		}
+		select {
+		case pq.c <- r: // pq.c has buffer
+		default:
+		}
+	}
+}
+
+func (t *Transport) invalidResponse() {
+	if c := t.opts.InvalidResponses; c != nil {
+		c.Inc()
+	}
+}
+
+// questionMatched reports whether r is the reply of q by their questions.
+func (t *Transport) questionMatched(q, r *dns.Msg) bool {
+	if !dnsutils.QuestionMatched(q, r) {
+		return false
+	}
+	if t.opts.MatchQuestionCase {
+		for i := range q.Question {
+			if q.Question[i].Name != r.Question[i].Name {
+				return false
 			}
 		}
 	}
+	return true
+}
+
+// pendingQuery is a query that is waiting for its reply.
+type pendingQuery struct {
+	q *dns.Msg
+	c chan *dns.Msg
 }
 
 func (dc *dnsConn) isClosed() bool {
@@ -536,6 +619,7 @@ func (dc *dnsConn) closeWithErr(err error) {
 	dc.closed = true
 	dc.closeErr = err
 	close(dc.closeNotify)
+	dc.t.opts.Metrics.connClosed()
 
 	if dc.c != nil {
 		dc.c.Close()
@@ -548,16 +632,16 @@ func (dc *dnsConn) queueLen() int {
 	return len(dc.queue)
 }
 
-func (dc *dnsConn) getQueueC(qid uint16) chan<- *dns.Msg {
+func (dc *dnsConn) getQueueC(qid uint16) *pendingQuery {
 	dc.queueMu.Lock()
 	defer dc.queueMu.Unlock()
 	return dc.queue[qid]
 }
 
-func (dc *dnsConn) addQueueC(qid uint16, c chan *dns.Msg) {
+func (dc *dnsConn) addQueueC(qid uint16, pq *pendingQuery) {
 	dc.queueMu.Lock()
 	defer dc.queueMu.Unlock()
-	dc.queue[qid] = c
+	dc.queue[qid] = pq
 }
 
 func (dc *dnsConn) deleteQueueC(qid uint16) {
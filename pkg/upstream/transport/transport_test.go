@@ -25,6 +25,8 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 	"io"
 	"math/rand"
@@ -340,14 +342,14 @@ func TestTransport_Exchange(t *testing.T) {
 			// Wait until all connections are timed out.
 			time.Sleep(tt.fields.IdleTimeout + time.Millisecond*200)
 
-			_, _, newConn, pipelineWg, err := transport.getPipelineConn()
+			_, _, newConn, status, err := transport.getPipelineConn()
 			if err != nil {
 				t.Fatal(err)
 			}
 			if !newConn {
 				t.Fatal("pipelineConn should be a new connection")
 			}
-			pipelineWg.Done()
+			transport.releasePipelineConn(status)
 			reusableConn, reused, err := transport.getReusableConn()
 			if err != nil {
 				t.Fatal(err)
@@ -369,3 +371,64 @@ func TestTransport_Exchange(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_pipelinePool(t *testing.T) {
+	m := &Metrics{
+		OpenConns:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "open_conns"}),
+		Dials:         prometheus.NewCounter(prometheus.CounterOpts{Name: "dials"}),
+		ReusedQueries: prometheus.NewCounter(prometheus.CounterOpts{Name: "reused"}),
+	}
+	transport, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, _ := net.Pipe()
+			return c1, nil
+		},
+		WriteFunc:      dnsutils.WriteMsgToTCP,
+		ReadFunc:       dnsutils.ReadMsgFromTCP,
+		EnablePipeline: true,
+		MaxConns:       2,
+		Metrics:        m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, _, isNew, s1, err := transport.getPipelineConn()
+	if err != nil || !isNew {
+		t.Fatalf("want a new conn, err %v", err)
+	}
+	c2, _, isNew, s2, err := transport.getPipelineConn()
+	if err != nil || !isNew || c2 == c1 {
+		t.Fatalf("want another new conn because the first one is busy, err %v", err)
+	}
+	transport.releasePipelineConn(s1)
+
+	// The least busy conn should be picked.
+	c, _, isNew, s, err := transport.getPipelineConn()
+	if err != nil || isNew || c != c1 {
+		t.Fatalf("want the idle conn, err %v", err)
+	}
+	transport.releasePipelineConn(s)
+
+	// MaxConns reached. Existing conns should be reused.
+	_, _, isNew, s3, err := transport.getPipelineConn()
+	if err != nil || isNew {
+		t.Fatalf("want an existing conn, err %v", err)
+	}
+	transport.releasePipelineConn(s3)
+	transport.releasePipelineConn(s2)
+
+	if v := testutil.ToFloat64(m.Dials); v != 2 {
+		t.Fatalf("want 2 dials, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.ReusedQueries); v != 2 {
+		t.Fatalf("want 2 reused queries, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.OpenConns); v != 2 {
+		t.Fatalf("want 2 open conns, got %v", v)
+	}
+	transport.Close()
+	if v := testutil.ToFloat64(m.OpenConns); v != 0 {
+		t.Fatalf("want 0 open conns after close, got %v", v)
+	}
+}
@@ -22,22 +22,31 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/bootstrap"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/dnscrypt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/doh"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/doq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/h3roundtripper"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/odoh"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/transport"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -57,19 +66,59 @@ type Upstream interface {
 type Opt struct {
 	// DialAddr specifies the address the upstream will
 	// actually dial to.
+	// For DNSCrypt upstreams, it overwrites the server address in the stamp
+	// and MUST include the port.
 	DialAddr string
 
 	// Socks5 specifies the socks5 proxy server that the upstream
-	// will connect though.
-	// Not implemented for udp upstreams and doh upstreams with http/3.
+	// will connect though. Udp queries are sent directly unless
+	// Socks5UDP is set.
+	// Deprecated: Use Proxy instead.
 	Socks5 string
 
+	// Socks5UDP sends the udp queries through the Socks5 proxy as well.
+	Socks5UDP bool
+
+	// Proxy specifies the proxy server url that the upstream will connect
+	// though. Supported formats are "socks5://[user:pass@]host:port" and
+	// "http://[user:pass@]host:port".
+	// Plain udp and dnscrypt upstreams require a socks5 proxy with UDP
+	// ASSOCIATE support.
+	// Not implemented for doq upstreams and doh upstreams with http/3.
+	Proxy string
+
+	// ODoHProxy specifies the url of the oblivious proxy that odoh upstreams
+	// relay queries through, e.g. "https://odoh-proxy.example/proxy".
+	// Required by odoh upstreams. For odoh upstreams, DialAddr overwrites
+	// the address of the proxy.
+	ODoHProxy string
+
 	// SoMark sets the socket SO_MARK option in unix system.
 	SoMark int
 
 	// BindToDevice sets the socket SO_BINDTODEVICE option in unix system.
 	BindToDevice string
 
+	// TCPFastOpen enables TCP Fast Open (RFC 7413) on tcp connections,
+	// which sends the first request within the SYN packet and saves a
+	// round trip on reconnections. Linux only (4.11+).
+	TCPFastOpen bool
+
+	// TCPKeepAlive specifies the keep-alive period of tcp connections.
+	// If zero, the go default (15s) is used. If negative, keepalive
+	// probes are disabled.
+	TCPKeepAlive time.Duration
+
+	// TCPUserTimeout sets the TCP_USER_TIMEOUT option of tcp sockets.
+	// Connections that have unacknowledged data (including keepalive
+	// probes) for this long are closed, so dead connections are detected
+	// quickly. Linux only.
+	TCPUserTimeout time.Duration
+
+	// LocalAddr specifies the local ip address that the upstream sockets
+	// will bind to. It SHOULD be a literal IP address.
+	LocalAddr string
+
 	// IdleTimeout specifies the idle timeout for long-connections.
 	// Available for TCP, DoT, DoH.
 	// If negative, TCP, DoT will not reuse connections.
@@ -89,27 +138,204 @@ type Opt struct {
 	// Default is 2.
 	MaxConns int
 
-	// Bootstrap specifies a plain dns server for the go runtime to solve the
-	// domain of the upstream server. It SHOULD be an IP address. Custom port
-	// is supported.
+	// MaxQueriesPerConn limits the number of queries that a pipeline
+	// connection can serve. The connection is closed once all its
+	// queries are done. It must not be larger than 65535.
+	// Available for TCP, DoT pipeline enabled upstreams. Default is 65535.
+	MaxQueriesPerConn int
+
+	// PoolMetrics collects the connection pool metrics of TCP, DoT upstreams.
+	PoolMetrics *transport.Metrics
+
+	// Bootstrap specifies a plain dns server to solve the domain of the
+	// upstream server. It SHOULD be an IP address. Custom port is supported.
+	// Results are cached. See bootstrap.Resolver.
 	// Note: Use a domain address may cause dead resolve loop and additional
 	// latency to dial upstream server.
-	// HTTP3 is not supported.
 	Bootstrap string
 
+	// BootstrapServers are more bootstrap servers. They are tried in order
+	// after Bootstrap.
+	BootstrapServers []string
+
+	// BootstrapIPs are the static ip addresses of the upstream server
+	// domain. If set, bootstrap servers are not used.
+	BootstrapIPs []string
+
+	// ServerIPs pins the ip addresses that the upstream connects to. The
+	// domain of the upstream server is still used as the tls server name.
+	// If an address failed to connect, following connections switch to the
+	// next one. Cannot be used with DialAddr.
+	ServerIPs []string
+
+	// ReResolveInterval re-resolves the domain of the upstream server by
+	// the bootstrap every this interval and replaces the pinned addresses
+	// with the result. If resolving failed, the pinned addresses are kept.
+	// If ServerIPs is empty, the domain is resolved on the first dial.
+	// The re-resolution is a task of Scheduler named ReResolveTaskName,
+	// which is canceled when the upstream is closed. Both are required.
+	ReResolveInterval time.Duration
+	Scheduler         *scheduler.Scheduler
+	ReResolveTaskName string
+
+	// CertPinSHA256 are the base64 encoded sha256 hashes of the pinned
+	// public keys (SPKI). If set, the server certificate must have a
+	// pinned public key or be issued by a certificate that has one. The
+	// system CA store is not used.
+	// Available for DoT, DoH, DoQ upstreams.
+	CertPinSHA256 []string
+
 	// TLSConfig specifies the tls.Config that the TLS client will use.
-	// Available for DoT, DoH upstreams.
+	// Available for DoT, DoH, DoQ upstreams.
 	TLSConfig *tls.Config
 
+	// RootCAsDigest is a digest of the certificates of TLSConfig.RootCAs,
+	// e.g. from utils.LoadCertPoolWithDigest. Upstreams that have the same
+	// digest share the tls session cache. If TLSConfig.RootCAs is set
+	// without a digest, the upstream has its own session cache.
+	RootCAsDigest string
+
+	// Downgrade specifies the protocols ("quic", "tls", "https", "tcp", "udp")
+	// that the upstream will fall back to, in order, if the protocol of
+	// addr does not work. They connect to the same server with their
+	// default ports. See NewUpstream.
+	Downgrade []string
+
+	// ProxyProtocol sends a PROXY protocol header of this version (1 or 2)
+	// on new connections, for servers behind listeners that require it.
+	// The header carries the client address of the query, see WithClientAddr.
+	// Connections are not reused then.
+	// Available for TCP, DoT, DoH (except http/3) upstreams and the tcp
+	// fallback of UDP upstreams.
+	ProxyProtocol int
+
+	// EnablePadding pads queries to a multiple of 128 bytes with the EDNS0
+	// padding option, as the block-length padding policy of RFC 8467.
+	// Available for DoT, DoH, DoQ and ODoH upstreams.
+	EnablePadding bool
+
+	// EnableCookie sends DNS cookies (RFC 7873) with queries and drops
+	// responses that do not carry the client cookie back.
+	EnableCookie bool
+
+	// Enable0x20 randomizes the letter case of query names (DNS 0x20) and
+	// drops responses whose question does not have the same case. The
+	// server must preserve the case of questions.
+	// Available for UDP upstreams.
+	Enable0x20 bool
+
+	// FreshUDPPort sends each query from a new socket, so every query has
+	// a random source port chosen by the system, instead of sharing
+	// sockets between queries.
+	// Available for UDP upstreams without proxy.
+	FreshUDPPort bool
+
+	// ValidateResponse checks that responses have no answer records that
+	// are unrelated to the query name and its CNAME chain. It can be
+	// "drop", which drops the responses that failed the checks, or "flag",
+	// which only logs them. Empty disables the checks. Responses that have
+	// a different id or question from the query are always dropped by the
+	// UDP, TCP and DoT transports.
+	ValidateResponse string
+
+	// InvalidResponses counts the responses that failed the checks of
+	// ValidateResponse, and the responses with a mismatched id or question
+	// that were dropped by the transports. Optional.
+	InvalidResponses prometheus.Counter
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
+
+	// pinned is shared by the upstreams of the downgrade chain.
+	pinned *pinnedResolver
 }
 
+// NewUpstream creates an Upstream. The protocol is specified by the scheme
+// of addr, which can be "udp" (default), "tcp", "tls", "https", "quic",
+// "odoh" and "sdns". The addr of an odoh upstream is the DoH endpoint of the
+// target with the "odoh" scheme, e.g. "odoh://odoh.cloudflare-dns.com/dns-query". The protocol and the server address of a "sdns" stamp are
+// extracted from the stamp.
+// If opt.Downgrade is not empty, the returned Upstream will try the protocols
+// of the downgrade chain when the current one fails, and remember the one
+// that worked.
 func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 	if opt == nil {
 		opt = new(Opt)
 	}
+	if isStamp(addr) {
+		var err error
+		addr, opt, err = stampToAddr(addr, opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var reResolveTask *scheduler.Task
+	if opt.pinned == nil && (len(opt.ServerIPs) > 0 || opt.ReResolveInterval > 0) {
+		o := *opt
+		opt = &o
+		p, err := newPinnedResolverFromOpt(addr, opt)
+		if err != nil {
+			return nil, err
+		}
+		opt.pinned = p
+		if opt.ReResolveInterval > 0 {
+			if opt.Scheduler == nil || len(opt.ReResolveTaskName) == 0 {
+				return nil, errors.New("re-resolve interval requires a scheduler and a task name")
+			}
+			reResolveTask, err = opt.Scheduler.Add(scheduler.TaskOpts{
+				Name:     opt.ReResolveTaskName,
+				Func:     p.reResolve,
+				Schedule: scheduler.Every(opt.ReResolveInterval),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to add re-resolve task, %w", err)
+			}
+		}
+	}
+
+	u, err := newUpstreamChain(addr, opt)
+	if err != nil {
+		if reResolveTask != nil {
+			reResolveTask.Cancel()
+		}
+		return nil, err
+	}
+	if reResolveTask != nil {
+		u = &taskUpstream{Upstream: u, task: reResolveTask}
+	}
+	return u, nil
+}
+
+// newUpstreamChain creates the upstream of addr with its downgrade chain
+// and query options of opt.
+func newUpstreamChain(addr string, opt *Opt) (Upstream, error) {
+	if len(opt.Downgrade) > 0 {
+		return newDowngradeUpstream(addr, opt)
+	}
+
+	u, err := newUpstream(addr, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Enable0x20 && isUDPAddr(addr) {
+		u = &x20Upstream{u: u}
+	}
+	if opt.EnablePadding || opt.EnableCookie {
+		u = newEDNS0Upstream(u, addr, opt)
+	}
+	if len(opt.ValidateResponse) > 0 {
+		v, err := newValidatingUpstream(u, opt)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u = v
+	}
+	return u, nil
+}
 
+func newUpstream(addr string, opt *Opt) (Upstream, error) {
 	// parse protocol and server addr
 	if !strings.Contains(addr, "://") {
 		addr = "udp://" + addr
@@ -119,43 +345,147 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		return nil, fmt.Errorf("invalid server address, %w", err)
 	}
 
-	dialer := &net.Dialer{
-		Resolver: bootstrap.NewPlainBootstrap(opt.Bootstrap),
-		Control: getSocketControlFunc(socketOpts{
-			so_mark:        opt.SoMark,
-			bind_to_device: opt.BindToDevice,
-		}),
+	if opt.MaxQueriesPerConn < 0 || opt.MaxQueriesPerConn > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid max queries per conn %d", opt.MaxQueriesPerConn)
+	}
+
+	dialer, err := NewDialer("tcp", opt)
+	if err != nil {
+		return nil, err
+	}
+	udpDialer, err := NewDialer("udp", opt)
+	if err != nil {
+		return nil, err
+	}
+	control := udpDialer.Control
+	listenAddr := "" // local addr for udp sockets of quic
+	if udpDialer.LocalAddr != nil {
+		listenAddr = udpDialer.LocalAddr.String()
+	}
+
+	bootstrapResolver, err := newBootstrapResolver(addrURL.Hostname(), opt, control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init bootstrap, %w", err)
+	}
+	resolver := bootstrapResolver
+	if opt.pinned != nil {
+		resolver = opt.pinned
+	}
+	reportFailure := failureReporter(resolver)
+
+	proxyURL := opt.Proxy
+	if len(proxyURL) == 0 && len(opt.Socks5) > 0 {
+		proxyURL = "socks5://" + opt.Socks5
+	}
+	var proxyCfg *proxyConfig
+	var proxyForward contextDialer // connects to the proxy server
+	var tcpDialer contextDialer = newHappyEyeballsDialer(dialer, resolver)
+	// If the upstream host has a bootstrap or pinned addresses, it is
+	// resolved locally instead of by the proxy.
+	_, resolveByProxy := resolver.(*net.Resolver)
+	if len(proxyURL) > 0 {
+		proxyCfg, err = parseProxy(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxyForward = newHappyEyeballsDialer(dialer, bootstrapResolver)
+		tcpDialer, err = proxyCfg.tcpDialer(proxyForward)
+		if err != nil {
+			return nil, err
+		}
+		if !resolveByProxy {
+			tcpDialer = newHappyEyeballsDialer(tcpDialer, resolver)
+		}
+	}
+	// With the PROXY protocol, a connection carries the address of one
+	// client. So connections are not reused.
+	proxyProtocol := opt.ProxyProtocol != 0
+	if proxyProtocol {
+		tcpDialer, err = newProxyProtocolDialer(tcpDialer, opt.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// dialUDP dials a udp conn to addr, through the socks5 proxy if
+	// there is one.
+	dialUDP := func(ctx context.Context, addr string) (net.Conn, error) {
+		ua, err := resolveUDPAddr(ctx, resolver, addr)
+		if err != nil {
+			return nil, err
+		}
+		c, err := udpDialer.DialContext(ctx, "udp", ua.String())
+		if reportFailure == nil {
+			return c, err
+		}
+		if err != nil {
+			reportFailure(ua.AddrPort().Addr())
+			return nil, err
+		}
+		return &failureReportingConn{Conn: c, addr: ua.AddrPort().Addr(), onFailure: reportFailure}, nil
+	}
+	var errUDPProxy error // not nil if the proxy does not support udp
+	// The legacy Socks5 option is tcp only unless Socks5UDP is set.
+	udpByProxy := proxyCfg != nil && (len(opt.Proxy) > 0 || opt.Socks5UDP)
+	if udpByProxy {
+		if proxyCfg.scheme != "socks5" {
+			errUDPProxy = fmt.Errorf("%s proxy does not support udp", proxyCfg.scheme)
+		}
+		dialUDP = func(ctx context.Context, addr string) (net.Conn, error) {
+			target := addr
+			if !resolveByProxy {
+				ua, err := resolveUDPAddr(ctx, resolver, addr)
+				if err != nil {
+					return nil, err
+				}
+				target = ua.String()
+			}
+			return dialSocks5UDP(ctx, proxyCfg, proxyForward, udpDialer, target)
+		}
 	}
 
 	switch addrURL.Scheme {
 	case "", "udp":
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
 
+		if errUDPProxy != nil {
+			return nil, errUDPProxy
+		}
+
 		uto := transport.Opts{
-			Logger: opt.Logger,
+			Logger:           opt.Logger,
+			InvalidResponses: opt.InvalidResponses,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialer.DialContext(ctx, "udp", dialAddr)
+				return dialUDP(ctx, dialAddr)
 			},
 			WriteFunc: dnsutils.WriteMsgToUDP,
 			ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
 				return dnsutils.ReadMsgFromUDP(c, 4096)
 			},
-			EnablePipeline: true,
-			MaxConns:       opt.MaxConns,
-			IdleTimeout:    time.Second * 60,
+			EnablePipeline:    true,
+			MaxConns:          opt.MaxConns,
+			IdleTimeout:       time.Second * 60,
+			MatchQuestionCase: opt.Enable0x20,
+		}
+		if opt.FreshUDPPort && !udpByProxy {
+			uto.IdleTimeout = -1 // no socket reuse
 		}
 		ut, err := transport.NewTransport(uto)
 		if err != nil {
 			return nil, fmt.Errorf("cannot init udp transport, %w", err)
 		}
 		tto := transport.Opts{
-			Logger: opt.Logger,
+			Logger:           opt.Logger,
+			InvalidResponses: opt.InvalidResponses,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialer.DialContext(ctx, "tcp", dialAddr)
+				return tcpDialer.DialContext(ctx, "tcp", dialAddr)
 			},
 			WriteFunc: dnsutils.WriteMsgToTCP,
 			ReadFunc:  dnsutils.ReadMsgFromTCP,
 		}
+		if proxyProtocol {
+			tto.IdleTimeout = -1
+		}
 		tt, err := transport.NewTransport(tto)
 		if err != nil {
 			return nil, fmt.Errorf("cannot init tcp transport, %w", err)
@@ -166,34 +496,41 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		}, nil
 	case "tcp":
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
+		idleTimeout := opt.IdleTimeout
+		if proxyProtocol {
+			idleTimeout = -1
+		}
 		to := transport.Opts{
-			Logger: opt.Logger,
+			Logger:           opt.Logger,
+			InvalidResponses: opt.InvalidResponses,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialTCP(ctx, dialAddr, opt.Socks5, dialer)
+				return tcpDialer.DialContext(ctx, "tcp", dialAddr)
 			},
-			WriteFunc:      dnsutils.WriteMsgToTCP,
-			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
-			EnablePipeline: opt.EnablePipeline,
-			MaxConns:       opt.MaxConns,
+			WriteFunc:       dnsutils.WriteMsgToTCP,
+			ReadFunc:        dnsutils.ReadMsgFromTCP,
+			IdleTimeout:     idleTimeout,
+			EnablePipeline:  opt.EnablePipeline,
+			MaxConns:        opt.MaxConns,
+			MaxQueryPerConn: uint16(opt.MaxQueriesPerConn),
+			Metrics:         opt.PoolMetrics,
 		}
 		return transport.NewTransport(to)
 	case "tls":
-		var tlsConfig *tls.Config
-		if opt.TLSConfig != nil {
-			tlsConfig = opt.TLSConfig.Clone()
-		} else {
-			tlsConfig = new(tls.Config)
-		}
-		if len(tlsConfig.ServerName) == 0 {
-			tlsConfig.ServerName = tryRemovePort(addrURL.Host)
+		tlsConfig, err := newTLSConfig(opt, tryRemovePort(addrURL.Host), false)
+		if err != nil {
+			return nil, err
 		}
 
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 853)
+		idleTimeout := opt.IdleTimeout
+		if proxyProtocol {
+			idleTimeout = -1
+		}
 		to := transport.Opts{
-			Logger: opt.Logger,
+			Logger:           opt.Logger,
+			InvalidResponses: opt.InvalidResponses,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				conn, err := dialTCP(ctx, dialAddr, opt.Socks5, dialer)
+				conn, err := tcpDialer.DialContext(ctx, "tcp", dialAddr)
 				if err != nil {
 					return nil, err
 				}
@@ -204,36 +541,84 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 				}
 				return tlsConn, nil
 			},
-			WriteFunc:      dnsutils.WriteMsgToTCP,
-			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
-			EnablePipeline: opt.EnablePipeline,
-			MaxConns:       opt.MaxConns,
+			WriteFunc:       dnsutils.WriteMsgToTCP,
+			ReadFunc:        dnsutils.ReadMsgFromTCP,
+			IdleTimeout:     idleTimeout,
+			EnablePipeline:  opt.EnablePipeline,
+			MaxConns:        opt.MaxConns,
+			MaxQueryPerConn: uint16(opt.MaxQueriesPerConn),
+			Metrics:         opt.PoolMetrics,
 		}
 		return transport.NewTransport(to)
-	case "https":
-		idleConnTimeout := time.Second * 30
+	case "quic":
+		if proxyCfg != nil {
+			return nil, errors.New("proxy is not supported by doq")
+		}
+		if proxyProtocol {
+			return nil, errors.New("proxy protocol is not supported by doq")
+		}
+		tlsConfig, err := newTLSConfig(opt, tryRemovePort(addrURL.Host), true)
+		if err != nil {
+			return nil, err
+		}
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"doq"}
+		}
+
+		idleTimeout := time.Second * 30
 		if opt.IdleTimeout > 0 {
-			idleConnTimeout = opt.IdleTimeout
+			idleTimeout = opt.IdleTimeout
 		}
-		maxConn := 2
-		if opt.MaxConns > 0 {
-			maxConn = opt.MaxConns
+		quicConfig := &quic.Config{
+			HandshakeIdleTimeout: tlsHandshakeTimeout,
+			MaxIdleTimeout:       idleTimeout,
+			KeepAlivePeriod:      idleTimeout / 2,
 		}
 
+		lc := net.ListenConfig{Control: control}
+		conn, err := lc.ListenPacket(context.Background(), "udp", listenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
+		}
+		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 853)
+		return &doq.Upstream{
+			DialFunc: func(ctx context.Context) (quic.Connection, error) {
+				ua, err := resolveUDPAddr(ctx, resolver, dialAddr)
+				if err != nil {
+					return nil, err
+				}
+				c, err := quic.DialContext(ctx, conn, ua, tlsConfig.ServerName, tlsConfig, quicConfig)
+				if err != nil && reportFailure != nil {
+					reportFailure(ua.AddrPort().Addr())
+				}
+				return c, err
+			},
+			AddOnCloser: conn,
+		}, nil
+	case "https":
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
 		var t http.RoundTripper
 		var addonCloser io.Closer // udpConn
+		tlsConfig, err := newTLSConfig(opt, "", opt.EnableHTTP3)
+		if err != nil {
+			return nil, err
+		}
 		if opt.EnableHTTP3 {
-			lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-			conn, err := lc.ListenPacket(context.Background(), "udp", "")
+			if proxyCfg != nil {
+				return nil, errors.New("proxy is not supported by http/3")
+			}
+			if proxyProtocol {
+				return nil, errors.New("proxy protocol is not supported by http/3")
+			}
+			lc := net.ListenConfig{Control: control}
+			conn, err := lc.ListenPacket(context.Background(), "udp", listenAddr)
 			if err != nil {
 				return nil, fmt.Errorf("failed to init udp socket for quic")
 			}
 			addonCloser = conn
 			t = &h3roundtripper.H3RTHelper{
 				Logger:    opt.Logger,
-				TLSConfig: opt.TLSConfig,
+				TLSConfig: tlsConfig,
 				QUICConfig: &quic.Config{
 					TokenStore:                     quic.NewLRUTokenStore(4, 8),
 					InitialStreamReceiveWindow:     4 * 1024,
@@ -242,35 +627,22 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 					MaxConnectionReceiveWindow:     64 * 1024,
 				},
 				DialFunc: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-					ua, err := net.ResolveUDPAddr("udp", dialAddr) // TODO: Support bootstrap.
+					ua, err := resolveUDPAddr(ctx, resolver, dialAddr)
 					if err != nil {
 						return nil, err
 					}
-					return quic.DialEarlyContext(ctx, conn, ua, addrURL.Host, tlsCfg, cfg)
+					c, err := quic.DialEarlyContext(ctx, conn, ua, addrURL.Host, tlsCfg, cfg)
+					if err != nil && reportFailure != nil {
+						reportFailure(ua.AddrPort().Addr())
+					}
+					return c, err
 				},
 			}
 		} else {
-			t1 := &http.Transport{
-				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
-					return dialTCP(ctx, dialAddr, opt.Socks5, dialer)
-				},
-				TLSClientConfig:     opt.TLSConfig,
-				TLSHandshakeTimeout: tlsHandshakeTimeout,
-				IdleConnTimeout:     idleConnTimeout,
-
-				// MaxConnsPerHost and MaxIdleConnsPerHost should be equal.
-				// Otherwise, it might seriously affect the efficiency of connection reuse.
-				MaxConnsPerHost:     maxConn,
-				MaxIdleConnsPerHost: maxConn,
-			}
-
-			t2, err := http2.ConfigureTransports(t1)
+			t, err = newHTTPTransport(tcpDialer, dialAddr, tlsConfig, opt)
 			if err != nil {
-				return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+				return nil, err
 			}
-			t2.ReadIdleTimeout = time.Second * 30
-			t2.PingTimeout = time.Second * 5
-			t = t1
 		}
 
 		return &doh.Upstream{
@@ -278,11 +650,144 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			Client:      &http.Client{Transport: t},
 			AddOnCloser: addonCloser,
 		}, nil
+	case "sdns":
+		if errUDPProxy != nil {
+			return nil, errUDPProxy
+		}
+		if proxyProtocol {
+			return nil, errors.New("proxy protocol is not supported by dnscrypt")
+		}
+		dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "udp" {
+				return dialUDP(ctx, addr)
+			}
+			return tcpDialer.DialContext(ctx, network, addr)
+		}
+		return dnscrypt.NewUpstream(addr, opt.DialAddr, dialFunc, opt.Logger)
+	case "odoh":
+		if proxyProtocol { // It would send the client address to the proxy.
+			return nil, errors.New("proxy protocol is not supported by odoh")
+		}
+		if len(opt.ODoHProxy) == 0 {
+			return nil, errors.New("odoh proxy is not set")
+		}
+		odohProxyURL, err := url.Parse(opt.ODoHProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid odoh proxy url, %w", err)
+		}
+		if odohProxyURL.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported odoh proxy scheme [%s]", odohProxyURL.Scheme)
+		}
+		proxyDialAddr := getDialAddrWithPort(odohProxyURL.Host, opt.DialAddr, 443)
+		// Pins are of the target. The proxy is verified by the roots.
+		proxyOpt := *opt
+		proxyOpt.CertPinSHA256 = nil
+		proxyTLSConfig, err := newTLSConfig(&proxyOpt, "", false)
+		if err != nil {
+			return nil, err
+		}
+		pt, err := newHTTPTransport(tcpDialer, proxyDialAddr, proxyTLSConfig, opt)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := newTLSConfig(opt, "", false)
+		if err != nil {
+			return nil, err
+		}
+		targetDialAddr := getDialAddrWithPort(addrURL.Host, "", 443)
+		tt, err := newHTTPTransport(tcpDialer, targetDialAddr, tlsConfig, opt)
+		if err != nil {
+			return nil, err
+		}
+		targetURL := *addrURL
+		targetURL.Scheme = "https"
+		return &odoh.Upstream{
+			Target:       &targetURL,
+			Proxy:        odohProxyURL,
+			Client:       &http.Client{Transport: pt},
+			ConfigClient: &http.Client{Transport: tt},
+			Logger:       opt.Logger,
+		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
 }
 
+// newHTTPTransport returns a http/1.1 and http/2 transport that always
+// connects to dialAddr using d.
+func newHTTPTransport(d contextDialer, dialAddr string, tlsConfig *tls.Config, opt *Opt) (*http.Transport, error) {
+	idleConnTimeout := time.Second * 30
+	if opt.IdleTimeout > 0 {
+		idleConnTimeout = opt.IdleTimeout
+	}
+	maxConn := 2
+	if opt.MaxConns > 0 {
+		maxConn = opt.MaxConns
+	}
+
+	t1 := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
+			return d.DialContext(ctx, "tcp", dialAddr)
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     idleConnTimeout,
+
+		// MaxConnsPerHost and MaxIdleConnsPerHost should be equal.
+		// Otherwise, it might seriously affect the efficiency of connection reuse.
+		MaxConnsPerHost:     maxConn,
+		MaxIdleConnsPerHost: maxConn,
+
+		// A connection with a PROXY protocol header belongs to one client.
+		DisableKeepAlives: opt.ProxyProtocol != 0,
+	}
+
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+	}
+	t2.ReadIdleTimeout = time.Second * 30
+	t2.PingTimeout = time.Second * 5
+	return t1, nil
+}
+
+// NewDialer returns a *net.Dialer for network "tcp" or "udp". The dialer
+// applies the SoMark, BindToDevice, LocalAddr and tcp options of opt.
+// Its addresses should be literal ips. Hostnames are resolved by the
+// bootstrap resolver of the upstream before dialing.
+func NewDialer(network string, opt *Opt) (*net.Dialer, error) {
+	d := &net.Dialer{
+		Control: getSocketControlFunc(socketOpts{
+			so_mark:        opt.SoMark,
+			bind_to_device: opt.BindToDevice,
+		}),
+	}
+	if network == "tcp" {
+		d.KeepAlive = opt.TCPKeepAlive
+		d.Control = getSocketControlFunc(socketOpts{
+			so_mark:          opt.SoMark,
+			bind_to_device:   opt.BindToDevice,
+			tcp_fast_open:    opt.TCPFastOpen,
+			tcp_user_timeout: opt.TCPUserTimeout,
+		})
+	}
+	if len(opt.LocalAddr) > 0 {
+		localAddr, err := netip.ParseAddr(opt.LocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local addr, %w", err)
+		}
+		switch network {
+		case "tcp":
+			d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(localAddr, 0))
+		case "udp":
+			d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(localAddr, 0))
+		default:
+			return nil, fmt.Errorf("unsupported network %s", network)
+		}
+	}
+	return d, nil
+}
+
 func getDialAddrWithPort(host, dialAddr string, defaultPort int) string {
 	addr := host
 	if len(dialAddr) > 0 {
@@ -295,6 +800,98 @@ func getDialAddrWithPort(host, dialAddr string, defaultPort int) string {
 	return addr
 }
 
+// newBootstrapResolver returns the resolver for the upstream domain host.
+// It returns the system resolver if opt has no bootstrap.
+func newBootstrapResolver(host string, opt *Opt, control func(string, string, syscall.RawConn) error) (hostResolver, error) {
+	servers := opt.BootstrapServers
+	if len(opt.Bootstrap) > 0 {
+		servers = append([]string{opt.Bootstrap}, servers...)
+	}
+	var hosts map[string][]netip.Addr
+	if len(opt.BootstrapIPs) > 0 {
+		addrs, err := parseAddrs(opt.BootstrapIPs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap ip, %w", err)
+		}
+		hosts = map[string][]netip.Addr{host: addrs}
+	}
+	if len(servers) == 0 && len(hosts) == 0 {
+		return net.DefaultResolver, nil
+	}
+	return bootstrap.NewResolver(bootstrap.ResolverOpts{
+		Servers: servers,
+		Hosts:   hosts,
+		Control: control,
+		Logger:  opt.Logger,
+	})
+}
+
+// newPinnedResolverFromOpt returns the pinnedResolver of the ServerIPs
+// of the upstream addr.
+func newPinnedResolverFromOpt(addr string, opt *Opt) (*pinnedResolver, error) {
+	if len(opt.DialAddr) > 0 {
+		return nil, errors.New("server ips cannot be used with dial addr")
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	addrURL, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address, %w", err)
+	}
+	addrs, err := parseAddrs(opt.ServerIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server ip, %w", err)
+	}
+	control := getSocketControlFunc(socketOpts{
+		so_mark:        opt.SoMark,
+		bind_to_device: opt.BindToDevice,
+	})
+	r, err := newBootstrapResolver(addrURL.Hostname(), opt, control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init bootstrap, %w", err)
+	}
+	return newPinnedResolver(addrURL.Hostname(), addrs, r, opt.Logger), nil
+}
+
+func parseAddrs(ss []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(ss))
+	for _, s := range ss {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// hostResolver resolves hostnames. *net.Resolver and *bootstrap.Resolver
+// implement it.
+type hostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// resolveUDPAddr resolves addr using r.
+func resolveUDPAddr(ctx context.Context, r hostResolver, addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	ips, err := r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no ip address for %s", host)
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(p))), nil
+}
+
 func tryRemovePort(s string) string {
 	host, _, err := net.SplitHostPort(s)
 	if err != nil {
@@ -303,6 +900,17 @@ func tryRemovePort(s string) string {
 	return host
 }
 
+// taskUpstream cancels task when it is closed.
+type taskUpstream struct {
+	Upstream
+	task *scheduler.Task
+}
+
+func (u *taskUpstream) Close() error {
+	u.task.Cancel()
+	return u.Upstream.Close()
+}
+
 type udpWithFallback struct {
 	u *transport.Transport
 	t *transport.Transport
@@ -24,9 +24,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -88,18 +92,76 @@ func newDoTTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownF
 	}
 }
 
+func newDoQTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func()) {
+	cert, err := utils.GenerateCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+	l, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := c.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						q, _, err := dnsutils.ReadMsgFromTCP(stream)
+						if err != nil {
+							return
+						}
+						w := &doqTestResponseWriter{remote: c.RemoteAddr(), local: c.LocalAddr()}
+						handler.ServeDNS(w, q)
+						if w.r != nil {
+							dnsutils.WriteMsgToTCP(stream, w.r)
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+	}
+}
+
+// doqTestResponseWriter implements dns.ResponseWriter.
+type doqTestResponseWriter struct {
+	remote, local net.Addr
+	r             *dns.Msg
+}
+
+func (w *doqTestResponseWriter) LocalAddr() net.Addr         { return w.local }
+func (w *doqTestResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *doqTestResponseWriter) WriteMsg(m *dns.Msg) error   { w.r = m; return nil }
+func (w *doqTestResponseWriter) Write(b []byte) (int, error) { return 0, errors.New("not supported") }
+func (w *doqTestResponseWriter) Close() error                { return nil }
+func (w *doqTestResponseWriter) TsigStatus() error           { return nil }
+func (w *doqTestResponseWriter) TsigTimersOnly(bool)         {}
+func (w *doqTestResponseWriter) Hijack()                     {}
+
 type newTestServerFunc func(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func())
 
 var m = map[string]newTestServerFunc{
-	"udp": newUDPTestServer,
-	"tcp": newTCPTestServer,
-	"tls": newDoTTestServer,
+	"udp":  newUDPTestServer,
+	"tcp":  newTCPTestServer,
+	"tls":  newDoTTestServer,
+	"quic": newDoQTestServer,
 }
 
 func Test_fastUpstream(t *testing.T) {
 
 	// TODO: add test for doh
-	// TODO: add test for socks5
 
 	// server config
 	for scheme, f := range m {
@@ -213,3 +275,119 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_udpUpstream_connRefused(t *testing.T) {
+	// Get a free port that nobody listens on.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+
+	u, err := NewUpstream("udp://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	start := time.Now()
+	if _, err := u.ExchangeContext(ctx, q); err == nil {
+		t.Fatal("want an error")
+	}
+	// The icmp port unreachable error should be reported by the connected
+	// socket instead of waiting for the timeout.
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("error took %s, should fail fast", d)
+	}
+}
+
+func Test_udpUpstream_mismatchedReply(t *testing.T) {
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		// A forged reply with the same id but a different question.
+		forged := new(dns.Msg)
+		forged.SetQuestion("forged.example.", dns.TypeA)
+		forged.Id = q.Id
+		forged.Response = true
+		w.WriteMsg(forged)
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	u, err := NewUpstream("udp://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Question[0].Name != "example.com." {
+		t.Fatalf("got reply of %s", r.Question[0].Name)
+	}
+}
+
+type remoteAddrServer struct {
+	mu    sync.Mutex
+	addrs []net.Addr
+}
+
+func (s *remoteAddrServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.mu.Lock()
+	s.addrs = append(s.addrs, w.RemoteAddr())
+	s.mu.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	w.WriteMsg(r)
+}
+
+func Test_upstream_localAddr(t *testing.T) {
+	if runtime.GOOS != "linux" { // 127.0.0.0/8 is not fully routed on other systems.
+		t.Skip()
+	}
+	for scheme, f := range m {
+		t.Run(scheme, func(t *testing.T) {
+			s := new(remoteAddrServer)
+			addr, shutdownServer := f(t, s)
+			defer shutdownServer()
+			u, err := NewUpstream(scheme+"://"+addr, &Opt{
+				LocalAddr: "127.0.0.2",
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			if err := testUpstream(u); err != nil {
+				t.Fatal(err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if len(s.addrs) == 0 {
+				t.Fatal("server received no query")
+			}
+			for _, a := range s.addrs {
+				if ip := a.String(); !strings.HasPrefix(ip, "127.0.0.2:") {
+					t.Fatalf("unexpected client addr %s", ip)
+				}
+			}
+		})
+	}
+
+	if _, err := NewUpstream("udp://127.0.0.1", &Opt{LocalAddr: "bad"}); err == nil {
+		t.Fatal("want invalid local addr err")
+	}
+}
@@ -24,11 +24,13 @@ package upstream
 import (
 	"golang.org/x/sys/unix"
 	"os"
+	"strings"
 	"syscall"
 )
 
 func getSocketControlFunc(opts socketOpts) func(string, string, syscall.RawConn) error {
-	return func(_, _ string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		isTCP := strings.HasPrefix(network, "tcp")
 		var sysCallErr error
 		if err := c.Control(func(fd uintptr) {
 			// SO_MARK
@@ -49,6 +51,23 @@ func getSocketControlFunc(opts socketOpts) func(string, string, syscall.RawConn)
 				}
 			}
 
+			// TCP_FASTOPEN_CONNECT
+			if isTCP && opts.tcp_fast_open {
+				sysCallErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+				if sysCallErr != nil {
+					sysCallErr = os.NewSyscallError("failed to set TCP_FASTOPEN_CONNECT", sysCallErr)
+					return
+				}
+			}
+
+			// TCP_USER_TIMEOUT
+			if isTCP && opts.tcp_user_timeout > 0 {
+				sysCallErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(opts.tcp_user_timeout.Milliseconds()))
+				if sysCallErr != nil {
+					sysCallErr = os.NewSyscallError("failed to set TCP_USER_TIMEOUT", sysCallErr)
+					return
+				}
+			}
 		}); err != nil {
 			return err
 		}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	validateDrop = "drop"
+	validateFlag = "flag"
+)
+
+var errInvalidResponse = errors.New("response failed the validation, it may be spoofed")
+
+// validatingUpstream checks responses against queries. See
+// Opt.ValidateResponse.
+type validatingUpstream struct {
+	u       Upstream
+	drop    bool
+	counter prometheus.Counter // optional
+	logger  *zap.Logger
+}
+
+func newValidatingUpstream(u Upstream, opt *Opt) (*validatingUpstream, error) {
+	v := &validatingUpstream{u: u, counter: opt.InvalidResponses, logger: opt.Logger}
+	switch opt.ValidateResponse {
+	case validateDrop:
+		v.drop = true
+	case validateFlag:
+	default:
+		return nil, fmt.Errorf("invalid response validation mode %s", opt.ValidateResponse)
+	}
+	if v.logger == nil {
+		v.logger = zap.NewNop()
+	}
+	return v, nil
+}
+
+func (v *validatingUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := v.u.ExchangeContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(q, r); err != nil {
+		if v.counter != nil {
+			v.counter.Inc()
+		}
+		var qName string
+		if len(q.Question) > 0 {
+			qName = q.Question[0].Name
+		}
+		v.logger.Warn("invalid response", zap.String("qname", qName), zap.Uint16("qid", q.Id), zap.Bool("dropped", v.drop), zap.Error(err))
+		if v.drop {
+			return nil, fmt.Errorf("%w, %s", errInvalidResponse, err)
+		}
+	}
+	return r, nil
+}
+
+func (v *validatingUpstream) Close() error {
+	return v.u.Close()
+}
+
+// validateResponse checks that the answer section of r has no record
+// that is unrelated to the query name and its CNAME chain. The id and the
+// question of r are checked by the transports.
+func validateResponse(q, r *dns.Msg) error {
+	if !r.Response {
+		return errors.New("not a response")
+	}
+	if len(q.Question) != 1 || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return nil
+	}
+
+	// Names in the CNAME chain. Records of the chain may be out of order.
+	chain := map[string]bool{strings.ToLower(q.Question[0].Name): true}
+	for added := true; added; {
+		added = false
+		for _, rr := range r.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && chain[strings.ToLower(c.Hdr.Name)] {
+				if t := strings.ToLower(c.Target); !chain[t] {
+					chain[t] = true
+					added = true
+				}
+			}
+		}
+	}
+
+	for _, rr := range r.Answer {
+		name := strings.ToLower(rr.Header().Name)
+		if chain[name] {
+			continue
+		}
+		if _, ok := rr.(*dns.DNAME); ok && dnameCovers(name, chain) {
+			continue
+		}
+		return fmt.Errorf("unsolicited record %s %s", rr.Header().Name, dns.TypeToString[rr.Header().Rrtype])
+	}
+	return nil
+}
+
+// dnameCovers reports whether the DNAME owner name is an ancestor of a name
+// in the chain.
+func dnameCovers(owner string, chain map[string]bool) bool {
+	for name := range chain {
+		if dns.IsSubDomain(owner, name) && owner != name {
+			return true
+		}
+	}
+	return false
+}
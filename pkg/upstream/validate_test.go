@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func Test_validateResponse(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	reply := func(answers ...string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for _, s := range answers {
+			r.Answer = append(r.Answer, rr(s))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		r       *dns.Msg
+		wantErr bool
+	}{
+		{"valid", reply("www.example.com. 300 IN A 1.1.1.1"), false},
+		{"case insensitive", reply("WWW.Example.com. 300 IN A 1.1.1.1"), false},
+		{"cname chain", reply(
+			"www.example.com. 300 IN CNAME a.example.net.",
+			"a.example.net. 300 IN CNAME b.example.org.",
+			"b.example.org. 300 IN A 1.1.1.1",
+		), false},
+		{"cname chain out of order", reply(
+			"b.example.org. 300 IN A 1.1.1.1",
+			"a.example.net. 300 IN CNAME b.example.org.",
+			"www.example.com. 300 IN CNAME a.example.net.",
+		), false},
+		{"dname", reply(
+			"example.com. 300 IN DNAME example.net.",
+			"www.example.com. 300 IN CNAME www.example.net.",
+			"www.example.net. 300 IN A 1.1.1.1",
+		), false},
+		{"unsolicited", reply("www.example.com. 300 IN A 1.1.1.1", "evil.example.org. 300 IN A 2.2.2.2"), true},
+		{"unsolicited dname", reply("example.org. 300 IN DNAME example.net."), true},
+		{"not a response", func() *dns.Msg { r := reply(); r.Response = false; return r }(), true},
+		{"servfail is not checked", func() *dns.Msg {
+			r := reply("evil.example.org. 300 IN A 2.2.2.2")
+			r.Rcode = dns.RcodeServerFailure
+			return r
+		}(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateResponse(q, tt.r); (err != nil) != tt.wantErr {
+				t.Fatalf("validateResponse() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type replyUpstream struct {
+	r *dns.Msg
+}
+
+func (u *replyUpstream) ExchangeContext(_ context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	return u.r.Copy(), nil
+}
+
+func (u *replyUpstream) Close() error {
+	return nil
+}
+
+func Test_validatingUpstream(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	forged, _ := dns.NewRR("evil.example.org. 300 IN A 2.2.2.2")
+	r.Answer = append(r.Answer, forged)
+
+	for _, mode := range []string{"drop", "flag"} {
+		c := prometheus.NewCounter(prometheus.CounterOpts{Name: "c"})
+		u, err := newValidatingUpstream(&replyUpstream{r: r}, &Opt{ValidateResponse: mode, InvalidResponses: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = u.ExchangeContext(context.Background(), q)
+		if (err != nil) != (mode == "drop") {
+			t.Fatalf("mode %s: unexpected err %v", mode, err)
+		}
+		if testutil.ToFloat64(c) != 1 {
+			t.Fatalf("mode %s: invalid response is not counted", mode)
+		}
+	}
+
+	if _, err := newValidatingUpstream(&replyUpstream{r: r}, &Opt{ValidateResponse: "invalid"}); err == nil {
+		t.Fatal("want invalid mode err")
+	}
+}
+
+func Test_upstream_invalidResponsesOfTransport(t *testing.T) {
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		forged := new(dns.Msg)
+		forged.SetReply(q)
+		forged.Question[0].Name = "evil.example.org."
+		w.WriteMsg(forged)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "c"})
+	u, err := NewUpstream("udp://"+addr, &Opt{InvalidResponses: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := u.ExchangeContext(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	if testutil.ToFloat64(c) != 1 {
+		t.Fatal("the dropped response is not counted")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+var errCaseMismatch = errors.New("question name of the response does not match the randomized case, the response may be spoofed")
+
+// x20Upstream randomizes the letter case of query names (DNS 0x20,
+// draft-vixie-dnsext-dns0x20). Spoofed responses must guess the case as
+// well as the id and the port. Responses with a different case are dropped.
+// The original case is restored in responses.
+type x20Upstream struct {
+	u Upstream
+}
+
+func (x *x20Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return x.u.ExchangeContext(ctx, q)
+	}
+
+	name := q.Question[0].Name
+	randomized, err := randomizeCase(name)
+	if err != nil {
+		return nil, err
+	}
+	qCopy := *q // shallow copy, only the question is changed.
+	qCopy.Question = []dns.Question{q.Question[0]}
+	qCopy.Question[0].Name = randomized
+
+	r, err := x.u.ExchangeContext(ctx, &qCopy)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Question) != 1 || r.Question[0].Name != randomized {
+		return nil, errCaseMismatch
+	}
+
+	r.Question[0].Name = name
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Name == randomized {
+				h.Name = name
+			}
+		}
+	}
+	return r, nil
+}
+
+func (x *x20Upstream) Close() error {
+	return x.u.Close()
+}
+
+// randomizeCase flips the case of each ascii letter of name randomly.
+func randomizeCase(name string) (string, error) {
+	b := []byte(name)
+	bits := make([]byte, (len(b)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return "", err
+	}
+	for i, c := range b {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b), nil
+}
+
+// isUDPAddr reports whether addr is a plain udp upstream address.
+func isUDPAddr(addr string) bool {
+	scheme, _, ok := strings.Cut(addr, "://")
+	return !ok || scheme == "udp"
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const x20TestName = "abcdefghijklmnopqrstuvwxyz.example.com."
+
+// flipCase flips the case of all letters of s.
+func flipCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return r
+	}, s)
+}
+
+func Test_x20Upstream(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		name := q.Question[0].Name
+		mu.Lock()
+		received = append(received, name)
+		mu.Unlock()
+
+		// A forged reply that has the right id but the wrong case.
+		forged := new(dns.Msg)
+		forged.SetReply(q)
+		forged.Question[0].Name = flipCase(name)
+		w.WriteMsg(forged)
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}})
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	u, err := NewUpstream("udp://"+addr, &Opt{Enable0x20: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion(x20TestName, dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0] == x20TestName || !strings.EqualFold(received[0], x20TestName) {
+		t.Fatalf("query name is not randomized, %v", received)
+	}
+	if r.Question[0].Name != x20TestName || r.Answer[0].Header().Name != x20TestName {
+		t.Fatalf("the case of the response is not restored, %s", r)
+	}
+	if q.Question[0].Name != x20TestName {
+		t.Fatal("query is modified")
+	}
+}
+
+func Test_x20Upstream_caseNotPreserved(t *testing.T) {
+	addr, shutdown := newUDPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	u, err := NewUpstream("udp://"+addr, &Opt{Enable0x20: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion(x20TestName, dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err := u.ExchangeContext(ctx, q); err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func Test_udpUpstream_freshPort(t *testing.T) {
+	s := new(remoteAddrServer)
+	addr, shutdown := newUDPTestServer(t, s)
+	defer shutdown()
+
+	u, err := NewUpstream("udp://"+addr, &Opt{FreshUDPPort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := u.ExchangeContext(ctx, q)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ports := make(map[string]bool)
+	for _, a := range s.addrs {
+		ports[a.String()] = true
+	}
+	if len(s.addrs) != 3 || len(ports) != 3 {
+		t.Fatalf("queries should be sent from different ports, %v", s.addrs)
+	}
+}
@@ -41,6 +41,19 @@ func GetIPFromAddr(addr net.Addr) (ip net.IP) {
 	return nil
 }
 
+// GetPortFromAddr returns the port of addr.
+// addr can be *net.TCPAddr, *net.UDPAddr.
+// Will return 0 otherwise.
+func GetPortFromAddr(addr net.Addr) uint16 {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return uint16(v.Port)
+	case *net.UDPAddr:
+		return uint16(v.Port)
+	}
+	return 0
+}
+
 // GetAddrFromAddr returns netip.Addr from net.Addr.
 // See also: GetIPFromAddr.
 func GetAddrFromAddr(addr net.Addr) netip.Addr {
@@ -23,9 +23,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -35,18 +37,37 @@ import (
 
 // LoadCertPool reads and loads certificates in certs.
 func LoadCertPool(certs []string) (*x509.CertPool, error) {
+	rootCAs, _, err := LoadCertPoolWithDigest(certs)
+	return rootCAs, err
+}
+
+// LoadCertPoolWithDigest is like LoadCertPool. It also returns the hex
+// sha256 digest of the certificates, which is the same for pools
+// loaded from the same certificates.
+func LoadCertPoolWithDigest(certs []string) (*x509.CertPool, string, error) {
 	rootCAs := x509.NewCertPool()
+	h := sha256.New()
 	for _, cert := range certs {
 		b, err := os.ReadFile(cert)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		if ok := rootCAs.AppendCertsFromPEM(b); !ok {
-			return nil, fmt.Errorf("no certificate was successfully parsed in %s", cert)
+			return nil, "", fmt.Errorf("no certificate was successfully parsed in %s", cert)
+		}
+		for rest := b; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				h.Write(block.Bytes)
+			}
 		}
 	}
-	return rootCAs, nil
+	return rootCAs, hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // GenerateCertificate generates an ecdsa certificate with given dnsName.
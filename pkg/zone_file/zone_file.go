@@ -20,9 +20,11 @@
 package zone_file
 
 import (
+	"bytes"
 	"github.com/miekg/dns"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
 type Matcher struct {
@@ -80,3 +82,26 @@ func (m *Matcher) Reply(q *dns.Msg) *dns.Msg {
 	}
 	return r
 }
+
+// DynamicMatcher is a Matcher that can be updated by a data_provider.DataProvider.
+type DynamicMatcher struct {
+	v atomic.Value
+}
+
+func NewDynamicMatcher() *DynamicMatcher {
+	return new(DynamicMatcher)
+}
+
+// Update implements data_provider.DataListener.
+func (d *DynamicMatcher) Update(newData []byte) error {
+	m := new(Matcher)
+	if err := m.Load(bytes.NewReader(newData)); err != nil {
+		return err
+	}
+	d.v.Store(m)
+	return nil
+}
+
+func (d *DynamicMatcher) Reply(q *dns.Msg) *dns.Msg {
+	return d.v.Load().(*Matcher).Reply(q)
+}
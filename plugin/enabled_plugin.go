@@ -21,29 +21,57 @@ package plugin
 
 // import all plugins
 import (
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/aaaa_filter"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/acme_challenge"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/answer_validator"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/arbitrary"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/blackhole"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/bufsize"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/cache"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/client_groups"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/client_limiter"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/cname_flatten"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/cookie"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dnssec_passthrough"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ecs"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/edns0_filter"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ext_plugin"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/fast_forward"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/filter_records"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/forward"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/hook"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/hosts"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ip_rewrite"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ipset"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/local_ptr"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/lua"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/marker"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/metadata"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/metrics_collector"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/misc_optm"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/nat_compat"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/nftset"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/padding"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/prefetch"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_events"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_stats"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_summary"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/rebind_protection"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/reverse_lookup"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/route"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/rpz"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/sleep"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/special_use"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/synthesize"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ttl"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/asn_matcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/client_matcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/expression"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/ip_set"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/query_matcher"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/response_matcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/time_matcher"
 )
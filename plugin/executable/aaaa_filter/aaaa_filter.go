@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package aaaa_filter
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+const PluginType = "aaaa_filter"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*aaaaFilter)(nil)
+
+// Args configures which AAAA queries are answered with NODATA, for
+// networks or clients that have broken IPv6. If neither Domain nor
+// Client is set, all AAAA queries are filtered. Otherwise, queries that
+// match Domain or Client are filtered.
+type Args struct {
+	// Domain is the domain matcher expressions, e.g. "domain:example.com",
+	// "provider:no_ipv6_domains".
+	Domain []string `yaml:"domain"`
+
+	// Client is the ip/cidr list of clients, e.g. "192.168.1.0/24",
+	// "provider:no_ipv6_clients".
+	Client []string `yaml:"client"`
+
+	// Smart filters the AAAA query only if the A query of the same name
+	// has A records, so domains that only have IPv6 addresses are still
+	// reachable. The A and AAAA queries are resolved by the rest of the
+	// sequence in parallel, like dual_selector.
+	Smart bool `yaml:"smart"`
+
+	// SmartWaitTimeout (ms) is how long the AAAA response waits for the
+	// A response in smart mode. Default is 250.
+	SmartWaitTimeout int `yaml:"smart_wait_timeout"`
+}
+
+const defaultSmartWaitTimeout = time.Millisecond * 250
+
+type aaaaFilter struct {
+	*coremain.BP
+	domain           *domain.MatcherGroup[struct{}] // nil if not set
+	client           *msg_matcher.ClientIPMatcher   // nil if not set
+	smart            bool
+	smartWaitTimeout time.Duration
+	closer           []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newAAAAFilter(bp, args.(*Args))
+}
+
+func newAAAAFilter(bp *coremain.BP, args *Args) (*aaaaFilter, error) {
+	p := &aaaaFilter{BP: bp, smart: args.Smart, smartWaitTimeout: defaultSmartWaitTimeout}
+	if args.SmartWaitTimeout > 0 {
+		p.smartWaitTimeout = time.Duration(args.SmartWaitTimeout) * time.Millisecond
+	}
+	if len(args.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Domain, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain, %w", err)
+		}
+		p.domain = mg
+		p.closer = append(p.closer, mg)
+	}
+	if len(args.Client) > 0 {
+		l, err := netlist.BatchLoadProvider(args.Client, bp.M().GetDataManager())
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load client, %w", err)
+		}
+		p.client = msg_matcher.NewClientIPMatcher(l)
+		p.closer = append(p.closer, l)
+	}
+	return p, nil
+}
+
+func (p *aaaaFilter) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if !p.matched(ctx, qCtx) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	if p.smart {
+		hasA, err := executable_seq.ProbeReference(ctx, qCtx, next, dns.TypeA, p.smartWaitTimeout, p.L())
+		if !hasA {
+			return err
+		}
+	}
+
+	q := qCtx.QReadOnly()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Ns = []dns.RR{dnsutils.FakeSOA(q.Question[0].Name)}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// matched reports whether qCtx is an AAAA query that should be filtered.
+func (p *aaaaFilter) matched(ctx context.Context, qCtx *query_context.Context) bool {
+	q := qCtx.QReadOnly()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	if p.domain == nil && p.client == nil {
+		return true
+	}
+	if p.domain != nil {
+		if _, ok := p.domain.Match(q.Question[0].Name); ok {
+			return true
+		}
+	}
+	if p.client != nil {
+		ok, err := p.client.Match(ctx, qCtx)
+		if err != nil {
+			p.L().Warn("failed to match client", qCtx.InfoField(), zap.Error(err))
+		}
+		return ok
+	}
+	return false
+}
+
+func (p *aaaaFilter) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
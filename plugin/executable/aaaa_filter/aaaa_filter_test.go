@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package aaaa_filter
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+// answerExec answers A queries of "v4.test." and AAAA queries of all names.
+type answerExec struct {
+	aQueries int32
+}
+
+func (e *answerExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		atomic.AddInt32(&e.aQueries, 1)
+		if q.Question[0].Name == "v4.test." {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(1, 1, 1, 1)})
+		}
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_aaaaFilter(t *testing.T) {
+	dm, err := domain.BatchLoadDomainProvider([]string{"v4.test", "v6.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := netlist.BatchLoadProvider([]string{"192.168.1.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		domain     bool
+		client     bool
+		smart      bool
+		qName      string
+		qtype      uint16
+		clientAddr string
+		wantNoData bool
+	}{
+		{"all", false, false, false, "other.test.", dns.TypeAAAA, "10.0.0.1", true},
+		{"a is not filtered", false, false, false, "v4.test.", dns.TypeA, "10.0.0.1", false},
+		{"domain matched", true, false, false, "v6.test.", dns.TypeAAAA, "10.0.0.1", true},
+		{"domain not matched", true, false, false, "other.test.", dns.TypeAAAA, "10.0.0.1", false},
+		{"client matched", true, true, false, "other.test.", dns.TypeAAAA, "192.168.1.2", true},
+		{"client not matched", false, true, false, "other.test.", dns.TypeAAAA, "10.0.0.1", false},
+		{"smart has a", true, false, true, "v4.test.", dns.TypeAAAA, "10.0.0.1", true},
+		{"smart has no a", true, false, true, "v6.test.", dns.TypeAAAA, "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &aaaaFilter{BP: coremain.NewBP("test", PluginType, nil, nil), smart: tt.smart, smartWaitTimeout: defaultSmartWaitTimeout}
+			if tt.domain {
+				p.domain = dm
+			}
+			if tt.client {
+				p.client = msg_matcher.NewClientIPMatcher(cl)
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qtype)
+			qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(tt.clientAddr)})
+			next := new(answerExec)
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if r == nil {
+				t.Fatal("nil response")
+			}
+			if gotNoData := r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0; gotNoData != tt.wantNoData {
+				t.Fatalf("got nodata %v, want %v, %s", gotNoData, tt.wantNoData, r)
+			}
+			if n := atomic.LoadInt32(&next.aQueries); tt.smart != (n > 0) && tt.qtype == dns.TypeAAAA {
+				t.Fatalf("unexpected A queries %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acme_challenge
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "acme_challenge"
+
+func init() {
+	coremain.RegNewPersetPluginFunc("_acme_challenge", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return &acmeChallenge{BP: bp}, nil
+	})
+}
+
+var _ coremain.ExecutablePlugin = (*acmeChallenge)(nil)
+
+// acmeChallenge answers TXT queries of pending ACME dns-01 challenges.
+// Other queries are passed to the next node.
+type acmeChallenge struct {
+	*coremain.BP
+}
+
+func (p *acmeChallenge) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookup(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *acmeChallenge) lookup(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeTXT || question.Qclass != dns.ClassINET {
+		return nil
+	}
+	records := p.M().ACMEChallengeTXT(question.Name)
+	if len(records) == 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	for _, v := range records {
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: []string{v},
+		})
+	}
+	return r
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package answer_validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/netip"
+	"sync"
+)
+
+const PluginType = "answer_validator"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	onMismatchPreferTrusted = "prefer_trusted"
+	onMismatchFlag          = "flag"
+)
+
+type Args struct {
+	// Primary and Trusted are tags of executable plugins that resolve the
+	// query independently, e.g. a plain upstream and an encrypted upstream.
+	Primary string `yaml:"primary"`
+	Trusted string `yaml:"trusted"`
+
+	// OnMismatch can be "prefer_trusted" (default), which replies the
+	// response from Trusted, or "flag", which replies the response from
+	// Primary. Either way, mismatches are logged and flagged by MetaKey.
+	OnMismatch string `yaml:"on_mismatch"`
+
+	// MetaKey is the metadata key that is set to "1" if the responses
+	// mismatched. Default is "answer_mismatch".
+	MetaKey string `yaml:"meta_key"`
+}
+
+var _ coremain.ExecutablePlugin = (*validator)(nil)
+
+// validator sends the query to two independent executables and compares
+// their responses. Responses mismatch if their rcodes are different, or
+// the A/AAAA answers have no address in common.
+// Note that CDNs may legitimately reply different addresses to different
+// resolvers, so this is a heuristic to detect dns hijacking.
+type validator struct {
+	*coremain.BP
+	args *Args
+
+	primary executable_seq.Executable
+	trusted executable_seq.Executable
+
+	queryTotal    prometheus.Counter
+	mismatchTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	a := args.(*Args)
+	execs := bp.M().GetExecutables()
+	primary, trusted := execs[a.Primary], execs[a.Trusted]
+	if primary == nil {
+		return nil, fmt.Errorf("cannot find executable %s", a.Primary)
+	}
+	if trusted == nil {
+		return nil, fmt.Errorf("cannot find executable %s", a.Trusted)
+	}
+	v, err := newValidator(bp, a, primary, trusted)
+	if err != nil {
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(v.queryTotal, v.mismatchTotal)
+	return v, nil
+}
+
+func newValidator(bp *coremain.BP, args *Args, primary, trusted executable_seq.Executable) (*validator, error) {
+	switch args.OnMismatch {
+	case "":
+		args.OnMismatch = onMismatchPreferTrusted
+	case onMismatchPreferTrusted, onMismatchFlag:
+	default:
+		return nil, fmt.Errorf("invalid on_mismatch %s", args.OnMismatch)
+	}
+	if len(args.MetaKey) == 0 {
+		args.MetaKey = "answer_mismatch"
+	}
+	return &validator{
+		BP:      bp,
+		args:    args,
+		primary: primary,
+		trusted: trusted,
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "query_total",
+			Help: "The total number of validated queries",
+		}),
+		mismatchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mismatch_total",
+			Help: "The total number of queries whose responses mismatched",
+		}),
+	}, nil
+}
+
+var errNoResponse = errors.New("no response")
+
+func (v *validator) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	v.queryTotal.Inc()
+
+	var wg sync.WaitGroup
+	resolve := func(e executable_seq.Executable, r **dns.Msg, err *error) {
+		defer wg.Done()
+		qCtxCopy := qCtx.Copy()
+		*err = e.Exec(ctx, qCtxCopy, nil)
+		*r = qCtxCopy.R()
+		if *err == nil && *r == nil {
+			*err = errNoResponse
+		}
+	}
+	var pr, tr *dns.Msg
+	var pErr, tErr error
+	wg.Add(2)
+	go resolve(v.primary, &pr, &pErr)
+	go resolve(v.trusted, &tr, &tErr)
+	wg.Wait()
+
+	switch {
+	case pErr != nil && tErr != nil:
+		return fmt.Errorf("both executables failed, primary: %v, trusted: %w", pErr, tErr)
+	case pErr != nil:
+		v.L().Warn("primary failed", qCtx.InfoField(), zap.Error(pErr))
+		qCtx.SetResponse(tr)
+	case tErr != nil:
+		v.L().Warn("trusted failed", qCtx.InfoField(), zap.Error(tErr))
+		qCtx.SetResponse(pr)
+	case !responsesMatch(pr, tr):
+		v.mismatchTotal.Inc()
+		v.L().Warn(
+			"responses mismatched",
+			qCtx.InfoField(),
+			zap.Stringer("primary", pr),
+			zap.Stringer("trusted", tr),
+		)
+		qCtx.SetValue(v.args.MetaKey, "1")
+		if v.args.OnMismatch == onMismatchFlag {
+			qCtx.SetResponse(pr)
+			qCtx.SetEDE(dns.ExtendedErrorCodeForgedAnswer, "answer mismatched with the trusted resolver")
+		} else {
+			qCtx.SetResponse(tr)
+		}
+	default:
+		qCtx.SetResponse(pr)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// responsesMatch reports whether a and b have the same rcode, and their
+// A/AAAA answers have at least one address in common if there is any.
+func responsesMatch(a, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode {
+		return false
+	}
+	ipsA, ipsB := answerIPs(a), answerIPs(b)
+	if len(ipsA) == 0 && len(ipsB) == 0 {
+		return true
+	}
+	for ip := range ipsA {
+		if _, ok := ipsB[ip]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func answerIPs(m *dns.Msg) map[netip.Addr]struct{} {
+	ips := make(map[netip.Addr]struct{})
+	for _, rr := range m.Answer {
+		var ip netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		if ip.IsValid() {
+			ips[ip] = struct{}{}
+		}
+	}
+	return ips
+}
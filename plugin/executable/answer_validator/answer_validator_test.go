@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package answer_validator
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func newMsg(rcode int, rrs ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.Rcode = rcode
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func Test_responsesMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *dns.Msg
+		want bool
+	}{
+		{"same", newMsg(0, "a. IN A 1.1.1.1"), newMsg(0, "a. IN A 1.1.1.1"), true},
+		{"overlap", newMsg(0, "a. IN A 1.1.1.1", "a. IN A 2.2.2.2"), newMsg(0, "a. IN A 2.2.2.2"), true},
+		{"disjoint", newMsg(0, "a. IN A 1.1.1.1"), newMsg(0, "a. IN A 2.2.2.2"), false},
+		{"rcode", newMsg(dns.RcodeNameError), newMsg(0, "a. IN A 2.2.2.2"), false},
+		{"no ip", newMsg(0, "a. IN TXT \"x\""), newMsg(0), true},
+		{"one empty", newMsg(0), newMsg(0, "a. IN AAAA ::1"), false},
+	}
+	for _, tt := range tests {
+		if got := responsesMatch(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func Test_validator_Exec(t *testing.T) {
+	plain := &executable_seq.DummyExecutable{WantR: newMsg(0, "a. IN A 10.0.0.1")}
+	encrypted := &executable_seq.DummyExecutable{WantR: newMsg(0, "a. IN A 1.1.1.1")}
+	failed := &executable_seq.DummyExecutable{WantErr: errNoResponse}
+
+	tests := []struct {
+		name       string
+		onMismatch string
+		primary    executable_seq.Executable
+		trusted    executable_seq.Executable
+		want       *dns.Msg
+		flagged    bool
+	}{
+		{"prefer trusted", "", plain, encrypted, encrypted.WantR, true},
+		{"flag", onMismatchFlag, plain, encrypted, plain.WantR, true},
+		{"match", "", plain, plain, plain.WantR, false},
+		{"primary failed", "", failed, encrypted, encrypted.WantR, false},
+		{"trusted failed", "", plain, failed, plain.WantR, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newValidator(coremain.NewBP("test", PluginType, nil, nil), &Args{OnMismatch: tt.onMismatch}, tt.primary, tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("a.", dns.TypeA)
+			qCtx := query_context.NewContext(q, nil)
+			if err := v.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			if qCtx.R() != tt.want {
+				t.Fatalf("unexpected response %v", qCtx.R())
+			}
+			if _, flagged := qCtx.GetValue("answer_mismatch"); flagged != tt.flagged {
+				t.Fatalf("want flagged %v, got %v", tt.flagged, flagged)
+			}
+		})
+	}
+
+	v, _ := newValidator(coremain.NewBP("test", PluginType, nil, nil), &Args{}, failed, failed)
+	q := new(dns.Msg)
+	q.SetQuestion("a.", dns.TypeA)
+	if err := v.Exec(context.Background(), query_context.NewContext(q, nil), nil); err == nil {
+		t.Fatal("want err")
+	}
+}
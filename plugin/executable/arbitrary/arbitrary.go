@@ -36,6 +36,8 @@ func init() {
 }
 
 type Args struct {
+	// RR can be a record or "provider:tag". The provider data
+	// is a zone file, e.g. a zone transferred over AXFR/IXFR.
 	RR []string `yaml:"rr"`
 }
 
@@ -43,7 +45,9 @@ var _ coremain.ExecutablePlugin = (*arbitraryPlugin)(nil)
 
 type arbitraryPlugin struct {
 	*coremain.BP
-	m *zone_file.Matcher
+	m       *zone_file.Matcher
+	dynamic []*zone_file.DynamicMatcher
+	closer  []func()
 }
 
 func (p *arbitraryPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -51,21 +55,50 @@ func (p *arbitraryPlugin) Exec(ctx context.Context, qCtx *query_context.Context,
 		qCtx.SetResponse(r)
 		return nil
 	}
+	for _, m := range p.dynamic {
+		if r := m.Reply(qCtx.Q()); r != nil {
+			qCtx.SetResponse(r)
+			return nil
+		}
+	}
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+func (p *arbitraryPlugin) Close() error {
+	for _, f := range p.closer {
+		f()
+	}
+	return nil
+}
+
 func Init(bp *coremain.BP, v interface{}) (p coremain.Plugin, err error) {
 	args := v.(*Args)
-	m := new(zone_file.Matcher)
+	ap := &arbitraryPlugin{
+		BP: bp,
+		m:  new(zone_file.Matcher),
+	}
 
-	//TODO: Support data provider
 	for i, s := range args.RR {
-		if err := m.Load(strings.NewReader(s)); err != nil {
+		if strings.HasPrefix(s, "provider:") {
+			providerName := strings.TrimPrefix(s, "provider:")
+			provider := bp.M().GetDataManager().GetDataProvider(providerName)
+			if provider == nil {
+				_ = ap.Close()
+				return nil, fmt.Errorf("cannot find provider %s", providerName)
+			}
+			m := zone_file.NewDynamicMatcher()
+			if err := provider.LoadAndAddListener(m); err != nil {
+				_ = ap.Close()
+				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerName, err)
+			}
+			ap.dynamic = append(ap.dynamic, m)
+			ap.closer = append(ap.closer, func() { provider.DeleteListener(m) })
+			continue
+		}
+		if err := ap.m.Load(strings.NewReader(s)); err != nil {
+			_ = ap.Close()
 			return nil, fmt.Errorf("failed to load rr #%d [%s], %w", i, s, err)
 		}
 	}
-	return &arbitraryPlugin{
-		BP: bp,
-		m:  m,
-	}, nil
+	return ap, nil
 }
@@ -21,12 +21,16 @@ package blackhole
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
 	"net/netip"
 )
 
@@ -51,18 +55,64 @@ func init() {
 
 var _ coremain.ExecutablePlugin = (*blackHole)(nil)
 
+const (
+	defaultAnswerTTL = 3600
+	defaultSOATTL    = 300
+)
+
 type blackHole struct {
 	*coremain.BP
-	args *Args
-
-	ipv4 []netip.Addr
-	ipv6 []netip.Addr
+	def       *response
+	rules     []*rule
+	answerTTL uint32
+	soaTTL    uint32
+	closer    []io.Closer
 }
 
 type Args struct {
 	IPv4  []string `yaml:"ipv4"` // block by responding specific IP
 	IPv6  []string `yaml:"ipv6"`
 	RCode int      `yaml:"rcode"` // block by responding specific RCode
+
+	// Response is a preset block response that overwrites the above.
+	// Can be "nxdomain", "nodata", "refused", "null_ip" (0.0.0.0 and ::)
+	// and "drop".
+	Response string `yaml:"response"`
+
+	// TTL is the ttl of answers and of the SOA in NXDOMAIN and NODATA
+	// responses, which clients cache the negative responses for.
+	// Default: answers 3600, SOA 300.
+	TTL uint32 `yaml:"ttl"`
+
+	// Rules select the block response by the query name. The first
+	// matched rule is used. Queries that match no rule get the response
+	// of the args above.
+	Rules []RuleArgs `yaml:"rules"`
+}
+
+type RuleArgs struct {
+	// Domain is the domain list of the rule. A rule without domain
+	// matches all queries.
+	Domain []string `yaml:"domain"`
+
+	// Response is the same as Args.Response.
+	Response string `yaml:"response"`
+
+	// IP are the ipv4 or ipv6 addresses that A/AAAA queries are answered
+	// with. Other queries get NODATA responses.
+	IP []string `yaml:"ip"`
+}
+
+// response is a block response.
+type response struct {
+	rcode int // negative means the response is dropped
+	ipv4  []netip.Addr
+	ipv6  []netip.Addr
+}
+
+type rule struct {
+	domain domain.Matcher[struct{}] // nil matches all
+	resp   *response
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -70,7 +120,35 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 }
 
 func newBlackHole(bp *coremain.BP, args *Args) (*blackHole, error) {
-	b := &blackHole{BP: bp, args: args}
+	b := &blackHole{BP: bp, answerTTL: defaultAnswerTTL, soaTTL: defaultSOATTL}
+	if args.TTL > 0 {
+		b.answerTTL = args.TTL
+		b.soaTTL = args.TTL
+	}
+
+	var err error
+	if len(args.Response) > 0 {
+		b.def, err = parseResponse(args.Response, nil)
+	} else {
+		b.def, err = parseLegacyResponse(args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ra := range args.Rules {
+		r, err := b.loadRule(ra)
+		if err != nil {
+			_ = b.Close()
+			return nil, fmt.Errorf("invalid rule #%d, %w", i, err)
+		}
+		b.rules = append(b.rules, r)
+	}
+	return b, nil
+}
+
+func parseLegacyResponse(args *Args) (*response, error) {
+	resp := &response{rcode: args.RCode}
 	for _, s := range args.IPv4 {
 		addr, err := netip.ParseAddr(s)
 		if err != nil {
@@ -79,7 +157,7 @@ func newBlackHole(bp *coremain.BP, args *Args) (*blackHole, error) {
 		if !addr.Is4() {
 			return nil, fmt.Errorf("invalid ipv4 addr %s", s)
 		}
-		b.ipv4 = append(b.ipv4, addr)
+		resp.ipv4 = append(resp.ipv4, addr)
 	}
 	for _, s := range args.IPv6 {
 		addr, err := netip.ParseAddr(s)
@@ -89,15 +167,71 @@ func newBlackHole(bp *coremain.BP, args *Args) (*blackHole, error) {
 		if !addr.Is6() {
 			return nil, fmt.Errorf("invalid ipv6 addr %s", s)
 		}
-		b.ipv6 = append(b.ipv6, addr)
+		resp.ipv6 = append(resp.ipv6, addr)
 	}
-	return b, nil
+	return resp, nil
+}
+
+// parseResponse parses a preset response and custom addresses.
+func parseResponse(preset string, ips []string) (*response, error) {
+	resp := new(response)
+	switch preset {
+	case "", "nodata":
+		resp.rcode = dns.RcodeSuccess
+	case "nxdomain":
+		resp.rcode = dns.RcodeNameError
+	case "refused":
+		resp.rcode = dns.RcodeRefused
+	case "drop":
+		resp.rcode = -1
+	case "null_ip":
+		resp.ipv4 = []netip.Addr{netip.IPv4Unspecified()}
+		resp.ipv6 = []netip.Addr{netip.IPv6Unspecified()}
+	default:
+		return nil, fmt.Errorf("invalid response [%s]", preset)
+	}
+	for _, s := range ips {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip addr %s, %w", s, err)
+		}
+		if addr.Is4() {
+			resp.ipv4 = append(resp.ipv4, addr)
+		} else {
+			resp.ipv6 = append(resp.ipv6, addr)
+		}
+	}
+	return resp, nil
+}
+
+func (b *blackHole) loadRule(ra RuleArgs) (*rule, error) {
+	if len(ra.Response) > 0 && len(ra.IP) > 0 {
+		return nil, errors.New("response and ip cannot be both set")
+	}
+	resp, err := parseResponse(ra.Response, ra.IP)
+	if err != nil {
+		return nil, err
+	}
+	r := &rule{resp: resp}
+	if len(ra.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(ra.Domain, b.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain, %w", err)
+		}
+		b.closer = append(b.closer, mg)
+		r.domain = mg
+		b.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
+	}
+	return r, nil
 }
 
 // Exec
-// sets qCtx.R() with IP response if query type is A/AAAA and Args.IPv4 / Args.IPv6 is not empty.
-// sets qCtx.R() with empty response with rcode = Args.RCode.
-// drops qCtx.R() if Args.RCode < 0
+// sets qCtx.R() with IP response if query type is A/AAAA and the block
+// response has addresses of the type.
+// sets qCtx.R() with empty response with rcode of the block response.
+// NXDOMAIN and NODATA responses have a SOA for negative caching.
+// drops qCtx.R() if the rcode < 0.
+// Responses are marked as filtered with the extended DNS error.
 // It never returns an error.
 func (b *blackHole) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	b.exec(qCtx)
@@ -105,57 +239,81 @@ func (b *blackHole) Exec(ctx context.Context, qCtx *query_context.Context, next
 }
 
 func (b *blackHole) exec(qCtx *query_context.Context) {
-	q := qCtx.Q()
+	q := qCtx.QReadOnly()
 	if len(q.Question) != 1 {
 		return
 	}
 
+	resp := b.def
+	for _, r := range b.rules {
+		if r.domain == nil {
+			resp = r.resp
+			break
+		}
+		if _, ok := r.domain.Match(q.Question[0].Name); ok {
+			resp = r.resp
+			break
+		}
+	}
+	r := b.makeResponse(q, resp)
+	if r != nil { // not dropped
+		qCtx.SetEDE(dns.ExtendedErrorCodeFiltered, "")
+	}
+	qCtx.SetResponse(r)
+}
+
+// makeResponse makes the block response of q. It returns nil if the
+// response should be dropped.
+func (b *blackHole) makeResponse(q *dns.Msg, resp *response) *dns.Msg {
 	qName := q.Question[0].Name
 	qtype := q.Question[0].Qtype
 
-	switch {
-	case qtype == dns.TypeA && len(b.ipv4) > 0:
-		r := new(dns.Msg)
-		r.SetRcode(q, dns.RcodeSuccess)
-		r.RecursionAvailable = true
-		for _, addr := range b.ipv4 {
-			rr := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   qName,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    3600,
-				},
-				A: addr.AsSlice(),
+	var addrs []netip.Addr
+	switch qtype {
+	case dns.TypeA:
+		addrs = resp.ipv4
+	case dns.TypeAAAA:
+		addrs = resp.ipv6
+	}
+	if len(addrs) == 0 && resp.rcode < 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeSuccess)
+	r.RecursionAvailable = true
+	if len(addrs) > 0 {
+		for _, addr := range addrs {
+			hdr := dns.RR_Header{
+				Name:   qName,
+				Rrtype: qtype,
+				Class:  dns.ClassINET,
+				Ttl:    b.answerTTL,
 			}
-			r.Answer = append(r.Answer, rr)
-		}
-		qCtx.SetResponse(r)
-
-	case qtype == dns.TypeAAAA && len(b.ipv6) > 0:
-		r := new(dns.Msg)
-		r.SetRcode(q, dns.RcodeSuccess)
-		r.RecursionAvailable = true
-		for _, addr := range b.ipv6 {
-			rr := &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   qName,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    3600,
-				},
-				AAAA: addr.AsSlice(),
+			if qtype == dns.TypeA {
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			} else {
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
 			}
-			r.Answer = append(r.Answer, rr)
 		}
-		qCtx.SetResponse(r)
+		return r
+	}
 
-	case b.args.RCode >= 0:
-		r := dnsutils.GenEmptyReply(q, b.args.RCode)
-		qCtx.SetResponse(r)
-	default:
-		qCtx.SetResponse(nil)
+	r.Rcode = resp.rcode
+	if r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError {
+		// Clients cache negative responses for min(SOA ttl, SOA minimum).
+		// RFC 2308 5.
+		soa := dnsutils.FakeSOA(qName)
+		soa.Hdr.Ttl = b.soaTTL
+		soa.Minttl = b.soaTTL
+		r.Ns = []dns.RR{soa}
 	}
+	return r
+}
 
-	return
+func (b *blackHole) Close() error {
+	for _, c := range b.closer {
+		_ = c.Close()
+	}
+	return nil
 }
@@ -22,6 +22,7 @@ package blackhole
 import (
 	"context"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
 	"net"
@@ -42,6 +43,11 @@ func Test_blackhole_Exec(t *testing.T) {
 		{"respond with ipv4 1", &Args{IPv4: []string{"127.0.0.1"}}, dns.TypeA, true, 0, "127.0.0.1"},
 		{"respond with ipv4 2", &Args{IPv4: []string{"127.0.0.1"}, RCode: 2}, dns.TypeAAAA, true, 2, ""},
 		{"respond with ipv6", &Args{IPv6: []string{"::1"}}, dns.TypeAAAA, true, 0, "::1"},
+		{"preset nxdomain", &Args{Response: "nxdomain", IPv4: []string{"127.0.0.1"}}, dns.TypeA, true, dns.RcodeNameError, ""},
+		{"preset null_ip", &Args{Response: "null_ip"}, dns.TypeAAAA, true, 0, "::"},
+		{"preset null_ip nodata", &Args{Response: "null_ip"}, dns.TypeTXT, true, 0, ""},
+		{"preset drop", &Args{Response: "drop"}, dns.TypeA, false, 0, ""},
+		{"rule without domain", &Args{Rules: []RuleArgs{{IP: []string{"10.0.0.1"}}}}, dns.TypeA, true, 0, "10.0.0.1"},
 	}
 
 	ctx := context.Background()
@@ -90,3 +96,43 @@ func Test_blackhole_Exec(t *testing.T) {
 		})
 	}
 }
+
+func Test_blackhole_rules(t *testing.T) {
+	b, err := newBlackHole(coremain.NewBP("test", PluginType, nil, nil), &Args{Response: "nxdomain", TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := domain.NewMixMatcher[struct{}]()
+	if err := m.Add("domain:refused.example", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := parseResponse("refused", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.rules = append(b.rules, &rule{domain: m, resp: resp})
+
+	exec := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		if err := b.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		if ede := qCtx.EDE(); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeFiltered {
+			t.Fatal("response should be marked as filtered")
+		}
+		return qCtx.R()
+	}
+
+	if r := exec("a.refused.example."); r.Rcode != dns.RcodeRefused || len(r.Ns) != 0 {
+		t.Fatalf("want REFUSED without SOA, got %v", r)
+	}
+	r := exec("other.example.")
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("want NXDOMAIN with SOA, got %v", r)
+	}
+	if soa := r.Ns[0].(*dns.SOA); soa.Hdr.Name != "other.example." || soa.Hdr.Ttl != 60 || soa.Minttl != 60 {
+		t.Fatalf("invalid SOA %v", soa)
+	}
+}
@@ -21,6 +21,7 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache"
@@ -28,14 +29,20 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache/redis_cache"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang/snappy"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -54,6 +61,11 @@ func init() {
 const (
 	defaultLazyUpdateTimeout = time.Second * 5
 	defaultEmptyAnswerTTL    = time.Second * 300
+
+	// sizeReportInterval is the interval of the size gauge updates.
+	// Len locks every shard of the memory cache and sends a command to
+	// redis, so it is not called on every scrape.
+	sizeReportInterval = time.Second * 10
 )
 
 var _ coremain.ExecutablePlugin = (*cachePlugin)(nil)
@@ -67,6 +79,42 @@ type Args struct {
 	CacheEverything   bool   `yaml:"cache_everything"`
 	CompressResp      bool   `yaml:"compress_resp"`
 	WhenHit           string `yaml:"when_hit"`
+
+	// LatencyBudget (ms) changes how expired responses are served. Instead
+	// of replying the expired response immediately, the query is sent to
+	// the next node first. If it does not respond within the budget, the
+	// expired response is replied, and the cache is updated in the
+	// background. Requires LazyCacheTTL.
+	LatencyBudget int `yaml:"latency_budget"`
+
+	// Coalesce makes concurrent identical queries that missed the cache
+	// share one execution of the next node. Only the first query runs the
+	// next node. Others wait for it and receive copies of its response.
+	Coalesce bool `yaml:"coalesce"`
+
+	// TTLRules limit the ttl of specific record types before
+	// responses are stored.
+	TTLRules []dnsutils.TTLRuleConfig `yaml:"ttl_rules"`
+
+	// DomainTTLRules limit the ttl of responses to specific domains
+	// before they are stored. They are applied after TTLRules.
+	DomainTTLRules []DomainTTLRule `yaml:"domain_ttl_rules"`
+}
+
+// DomainTTLRule limits the ttl of responses whose question matches Domain.
+// A non-zero TTL overrides the ttl of all records. Otherwise, the ttl is
+// clamped by MaximumTTL and MinimalTTL. Zero means no limit.
+// If a domain matches multiple rules, the first one wins.
+type DomainTTLRule struct {
+	Domain     []string `yaml:"domain"`
+	TTL        uint32   `yaml:"ttl"`
+	MaximumTTL uint32   `yaml:"maximum_ttl"`
+	MinimalTTL uint32   `yaml:"minimal_ttl"`
+}
+
+type domainTTLPolicy struct {
+	domain domain.Matcher[struct{}]
+	policy *dnsutils.TTLPolicy
 }
 
 type cachePlugin struct {
@@ -74,13 +122,22 @@ type cachePlugin struct {
 	args *Args
 
 	whenHit      executable_seq.Executable
+	ttlPolicy    *dnsutils.TTLPolicy // nil if no ttl rule is configured
+	domainTTL    []domainTTLPolicy
 	backend      cache.Backend
 	lazyUpdateSF singleflight.Group
 
+	missMu    sync.Mutex
+	missCalls map[string]*missCall // lazy init
+
 	queryTotal   prometheus.Counter
 	hitTotal     prometheus.Counter
 	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	overBudget   prometheus.Counter
+	coalesced    prometheus.Counter
+	size         prometheus.Gauge
+
+	closer []io.Closer
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -88,6 +145,49 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 }
 
 func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
+	var ttlPolicy *dnsutils.TTLPolicy
+	if len(args.TTLRules) > 0 {
+		var err error
+		ttlPolicy, err = dnsutils.NewTTLPolicy(args.TTLRules, 0, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl rules, %w", err)
+		}
+	}
+
+	if args.LatencyBudget > 0 && args.LazyCacheTTL <= 0 {
+		return nil, errors.New("latency_budget requires lazy_cache_ttl")
+	}
+
+	var domainTTL []domainTTLPolicy
+	var closer []io.Closer
+	closeAll := func() {
+		for _, c := range closer {
+			_ = c.Close()
+		}
+	}
+	for i, rule := range args.DomainTTLRules {
+		maxTTL, minTTL := rule.MaximumTTL, rule.MinimalTTL
+		if rule.TTL > 0 {
+			maxTTL, minTTL = rule.TTL, rule.TTL
+		}
+		if maxTTL > 0 && minTTL > maxTTL {
+			closeAll()
+			return nil, fmt.Errorf("domain ttl rule #%d: minimal_ttl is greater than maximum_ttl", i)
+		}
+		policy, err := dnsutils.NewTTLPolicy(nil, maxTTL, minTTL)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("domain ttl rule #%d: %w", i, err)
+		}
+		mg, err := domain.BatchLoadDomainProvider(rule.Domain, bp.M().GetDataManager())
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("domain ttl rule #%d: failed to load domains, %w", i, err)
+		}
+		closer = append(closer, mg)
+		domainTTL = append(domainTTL, domainTTLPolicy{domain: mg, policy: policy})
+	}
+
 	var c cache.Backend
 	if len(args.Redis) != 0 {
 		opt, err := redis.ParseURL(args.Redis)
@@ -104,11 +204,26 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		}
 		rc, err := redis_cache.NewRedisCache(rcOpts)
 		if err != nil {
+			closeAll()
 			return nil, fmt.Errorf("failed to init redis cache, %w", err)
 		}
 		c = rc
 	} else {
-		c = mem_cache.NewMemCache(args.Size, 0)
+		mc := mem_cache.NewMemCache(args.Size)
+		cleanTask, err := bp.M().GetScheduler().Add(scheduler.TaskOpts{
+			Name: fmt.Sprintf("plugin/%s/clean", bp.Tag()),
+			Func: func(context.Context) error {
+				mc.Clean()
+				return nil
+			},
+			Schedule: scheduler.Every(mem_cache.CleanInterval),
+		})
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closer = append(closer, taskCloser{cleanTask})
+		c = mc
 	}
 
 	if args.LazyCacheReplyTTL <= 0 {
@@ -120,15 +235,20 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		m := bp.M().GetExecutables()
 		whenHit = m[tag]
 		if whenHit == nil {
+			c.Close()
+			closeAll()
 			return nil, fmt.Errorf("cannot find exectable %s", tag)
 		}
 	}
 
 	p := &cachePlugin{
-		BP:      bp,
-		args:    args,
-		whenHit: whenHit,
-		backend: c,
+		BP:        bp,
+		args:      args,
+		whenHit:   whenHit,
+		ttlPolicy: ttlPolicy,
+		domainTTL: domainTTL,
+		backend:   c,
+		closer:    closer,
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "query_total",
@@ -142,20 +262,37 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 			Name: "lazy_hit_total",
 			Help: "The total number of queries that hit the expired cache",
 		}),
-		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		overBudget: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "over_budget_total",
+			Help: "The total number of queries that were replied with the expired cache because the latency budget was exceeded",
+		}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "coalesced_total",
+			Help: "The total number of queries that shared the response of an identical in-flight query",
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "cache_size",
 			Help: "Current cache size in records",
-		}, func() float64 {
-			return float64(c.Len())
 		}),
 	}
-	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.size)
+	sizeTask, err := bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name:     fmt.Sprintf("plugin/%s/size", bp.Tag()),
+		Func:     p.reportSize,
+		Schedule: scheduler.Every(sizeReportInterval),
+	})
+	if err != nil {
+		c.Close()
+		closeAll()
+		return nil, err
+	}
+	p.closer = append(p.closer, taskCloser{sizeTask})
+	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.overBudget, p.coalesced, p.size)
 	return p, nil
 }
 
 func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	c.queryTotal.Inc()
-	q := qCtx.Q()
+	q := qCtx.QReadOnly()
 
 	msgKey, err := c.getMsgKey(q)
 	if err != nil {
@@ -171,11 +308,21 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
-		c.doLazyUpdate(msgKey, qCtx, next)
+		updated := c.doLazyUpdate(msgKey, qCtx, next)
+		if c.args.LatencyBudget > 0 {
+			if r := c.waitUpdate(updated); r != nil {
+				r.Id = q.Id
+				setQuestion(r, q)
+				qCtx.SetResponse(r)
+				return nil
+			}
+			c.overBudget.Inc()
+		}
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
 		cachedResp.Id = q.Id // change msg id
+		setQuestion(cachedResp, q)
 		c.L().Debug("cache hit", qCtx.InfoField())
 		qCtx.SetResponse(cachedResp)
 		if c.whenHit != nil {
@@ -186,8 +333,15 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 
 	// cache miss, run the entry and try to store its response.
 	c.L().Debug("cache miss", qCtx.InfoField())
-	err = executable_seq.ExecChainNode(ctx, qCtx, next)
-	r := qCtx.R()
+	if c.args.Coalesce {
+		return c.execCoalesced(ctx, msgKey, qCtx, next)
+	}
+	return c.execAndStore(ctx, msgKey, qCtx, next)
+}
+
+func (c *cachePlugin) execAndStore(ctx context.Context, msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	r := qCtx.R() // ttl rules may modify r.
 	if r != nil {
 		if err := c.tryStoreMsg(msgKey, r); err != nil {
 			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
@@ -196,18 +350,88 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 	return err
 }
 
+// missCall is an in-flight execution of a cache miss.
+type missCall struct {
+	done chan struct{}
+	r    *dns.Msg // read only, valid after done is closed
+	err  error
+}
+
+// execCoalesced executes next node with qCtx if there is no in-flight
+// query that has the same msgKey. Otherwise, it waits for that query
+// and sets a copy of its response to qCtx. The wait is canceled by ctx.
+func (c *cachePlugin) execCoalesced(ctx context.Context, msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	c.missMu.Lock()
+	call, ok := c.missCalls[msgKey]
+	if !ok {
+		if c.missCalls == nil {
+			c.missCalls = make(map[string]*missCall)
+		}
+		call = &missCall{done: make(chan struct{})}
+		c.missCalls[msgKey] = call
+	}
+	c.missMu.Unlock()
+
+	if !ok { // leader
+		defer func() {
+			c.missMu.Lock()
+			delete(c.missCalls, msgKey)
+			c.missMu.Unlock()
+			close(call.done)
+		}()
+		err := c.execAndStore(ctx, msgKey, qCtx, next)
+		// qCtx.R() will be modified by following nodes, so others
+		// receive a snapshot.
+		if r := qCtx.RReadOnly(); r != nil {
+			call.r = r.Copy()
+		}
+		call.err = err
+		return err
+	}
+
+	c.coalesced.Inc()
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.r != nil {
+		r := call.r.Copy()
+		q := qCtx.QReadOnly()
+		r.Id = q.Id
+		setQuestion(r, q)
+		qCtx.SetResponse(r)
+	}
+	return call.err
+}
+
 // getMsgKey returns a string key for the query msg, or an empty
 // string if query should not be cached.
+// Only simple queries, which have no EDNS0 OPT, are cached by default.
 func (c *cachePlugin) getMsgKey(q *dns.Msg) (string, error) {
 	isSimpleQuery := len(q.Question) == 1 && len(q.Answer) == 0 && len(q.Ns) == 0 && len(q.Extra) == 0
-	if isSimpleQuery || c.args.CacheEverything {
-		msgKey, err := dnsutils.GetMsgKey(q, 0)
-		if err != nil {
-			return "", fmt.Errorf("failed to unpack query msg, %w", err)
-		}
-		return msgKey, nil
+	if !isSimpleQuery && !c.args.CacheEverything {
+		return "", nil
+	}
+	// Queries with a plain EDNS0 OPT, e.g. the DO bit or ECS, also have
+	// fast keys. Others are packed.
+	if key, ok := dnsutils.GetQueryKey(q); ok {
+		return key, nil
+	}
+	msgKey, err := dnsutils.GetMsgKey(q, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack query msg, %w", err)
+	}
+	return msgKey, nil
+}
+
+// setQuestion sets the question of r to q's. Queries that only differ in
+// the qname case share the same cache key, and clients may check the
+// case of the question.
+func setQuestion(r, q *dns.Msg) {
+	if len(r.Question) == len(q.Question) {
+		copy(r.Question, q.Question)
 	}
-	return "", nil
 }
 
 // lookupCache returns the cached response. The ttl of returned msg will be changed properly.
@@ -265,7 +489,8 @@ func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, lazyHit bool, err
 
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
 // It has an inner singleflight.Group to de-duplicate same msgKey.
-func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
+// The returned channel receives the response of the update.
+func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) <-chan singleflight.Result {
 	lazyQCtx := qCtx.Copy()
 	lazyUpdateFunc := func() (interface{}, error) {
 		c.L().Debug("start lazy cache update", lazyQCtx.InfoField())
@@ -285,17 +510,47 @@ func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, n
 			}
 		}
 		c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
-		return nil, nil
+		return r, err
+	}
+	return c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+}
+
+// waitUpdate waits the lazy update within the latency budget. It returns
+// a copy of the updated response, or nil if the update is failed or
+// not finished in time.
+func (c *cachePlugin) waitUpdate(updated <-chan singleflight.Result) *dns.Msg {
+	timer := pool.GetTimer(time.Duration(c.args.LatencyBudget) * time.Millisecond)
+	defer pool.ReleaseTimer(timer)
+	select {
+	case res := <-updated:
+		if r, _ := res.Val.(*dns.Msg); res.Err == nil && r != nil {
+			return r.Copy()
+		}
+		return nil
+	case <-timer.C:
+		return nil
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 // tryStoreMsg tries to store r to cache. If r should be cached.
+// The ttl rules will be applied to r before it is stored.
 func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 	if r.Rcode != dns.RcodeSuccess || r.Truncated != false {
 		return nil
 	}
 
+	if c.ttlPolicy != nil {
+		c.ttlPolicy.Apply(r)
+	}
+	if len(c.domainTTL) > 0 && len(r.Question) == 1 {
+		for _, rule := range c.domainTTL {
+			if _, ok := rule.domain.Match(r.Question[0].Name); ok {
+				rule.policy.Apply(r)
+				break
+			}
+		}
+	}
+
 	v, err := r.Pack()
 	if err != nil {
 		return fmt.Errorf("failed to pack response msg, %w", err)
@@ -321,6 +576,59 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 	return nil
 }
 
+// reportSize updates the size gauge.
+func (c *cachePlugin) reportSize(context.Context) error {
+	c.size.Set(float64(c.backend.Len()))
+	return nil
+}
+
 func (c *cachePlugin) Shutdown() error {
+	for _, cl := range c.closer {
+		_ = cl.Close()
+	}
 	return c.backend.Close()
 }
+
+// taskCloser cancels the task when it is closed.
+type taskCloser struct {
+	t *scheduler.Task
+}
+
+func (c taskCloser) Close() error {
+	c.t.Cancel()
+	return nil
+}
+
+// flusher is implemented by cache backends that can be flushed.
+type flusher interface {
+	Flush()
+}
+
+// ServeHTTP serves the cache api.
+//
+//	POST /plugins/<tag>/flush  removes all cached responses.
+func (c *cachePlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/plugins/%s/", c.Tag())), "/")
+	if req.Method != http.MethodPost || op != "flush" {
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown api %s %s", req.Method, req.URL.Path))
+		return
+	}
+	f, ok := c.backend.(flusher)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, errors.New("the cache backend does not support flush"))
+		return
+	}
+	f.Flush()
+	_ = c.reportSize(req.Context())
+	c.L().Info("cache flushed")
+}
+
+// RequiredAPIPermission implements coremain.APIPermissionRequirer.
+func (c *cachePlugin) RequiredAPIPermission(_ *http.Request) coremain.APIPermission {
+	return coremain.APIPermCacheFlush
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
@@ -0,0 +1,361 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cache/mem_cache"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_cachePlugin_domainTTL(t *testing.T) {
+	newPolicy := func(expr string, max, min uint32) domainTTLPolicy {
+		m := domain.NewDomainMixMatcher()
+		if err := domain.Load[struct{}](m, expr, nil); err != nil {
+			t.Fatal(err)
+		}
+		policy, err := dnsutils.NewTTLPolicy(nil, max, min)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return domainTTLPolicy{domain: m, policy: policy}
+	}
+	c := &cachePlugin{
+		args: new(Args),
+		domainTTL: []domainTTLPolicy{
+			newPolicy("full:time.windows.com", 30, 0),
+			newPolicy("domain:cn", 0, 300),
+		},
+		backend: mem_cache.NewMemCache(1024),
+	}
+	defer c.backend.Close()
+
+	tests := []struct {
+		name    string
+		ttl     uint32
+		wantTTL uint32
+	}{
+		{"time.windows.com.", 600, 30},
+		{"sub.time.windows.com.", 600, 600},
+		{"example.cn.", 10, 300},
+		{"example.cn.", 600, 600},
+		{"example.com.", 10, 10},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: tt.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: tt.ttl},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+		if err := c.tryStoreMsg("key", r); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Answer[0].Header().Ttl; got != tt.wantTTL {
+			t.Errorf("%s: want ttl %d, got %d", tt.name, tt.wantTTL, got)
+		}
+	}
+}
+
+type countingExecutable struct {
+	n int32
+}
+
+func (e *countingExecutable) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	atomic.AddInt32(&e.n, 1)
+	time.Sleep(time.Millisecond * 100)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.QReadOnly())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_coalesce(t *testing.T) {
+	c := &cachePlugin{
+		BP:         coremain.NewBP("test", PluginType, nil, nil),
+		args:       &Args{Coalesce: true},
+		backend:    mem_cache.NewMemCache(1024),
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+		coalesced:  prometheus.NewCounter(prometheus.CounterOpts{Name: "coalesced_total"}),
+	}
+	defer c.backend.Close()
+
+	e := new(countingExecutable)
+	next := executable_seq.WrapExecutable(e)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			q.Id = uint16(i)
+			qCtx := query_context.NewContext(q, nil)
+			if err := c.Exec(context.Background(), qCtx, next); err != nil {
+				t.Error(err)
+				return
+			}
+			if r := qCtx.R(); r == nil || r.Id != q.Id {
+				t.Errorf("query #%d: invalid response %v", i, r)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&e.n); n != 1 {
+		t.Fatalf("want 1 execution, got %d", n)
+	}
+}
+
+func Test_cachePlugin_coalesceCanceled(t *testing.T) {
+	c := &cachePlugin{
+		BP:         coremain.NewBP("test", PluginType, nil, nil),
+		args:       &Args{Coalesce: true},
+		backend:    mem_cache.NewMemCache(1024),
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+		coalesced:  prometheus.NewCounter(prometheus.CounterOpts{Name: "coalesced_total"}),
+	}
+	defer c.backend.Close()
+
+	e := &updateExecutable{ip: net.IPv4(1, 1, 1, 1), delay: time.Millisecond * 500}
+	next := executable_seq.WrapExecutable(e)
+	newQCtx := func() *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		return query_context.NewContext(q, nil)
+	}
+
+	leaderDone := make(chan error, 1)
+	leaderQCtx := newQCtx()
+	go func() {
+		leaderDone <- c.Exec(context.Background(), leaderQCtx, next)
+	}()
+	for atomic.LoadInt32(&e.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	followerQCtx := newQCtx()
+	err := c.Exec(ctx, followerQCtx, next)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Millisecond*250 {
+		t.Fatalf("follower returned after %s, it should not wait for the leader", d)
+	}
+	if followerQCtx.R() != nil {
+		t.Fatal("canceled follower should not have a response")
+	}
+
+	if err := <-leaderDone; err != nil || leaderQCtx.R() == nil {
+		t.Fatalf("leader failed, err %v, response %v", err, leaderQCtx.R())
+	}
+	if n := atomic.LoadInt32(&e.n); n != 1 {
+		t.Fatalf("want 1 execution, got %d", n)
+	}
+}
+
+// updateExecutable responds with IP after delay, or returns err.
+type updateExecutable struct {
+	n     int32
+	delay time.Duration
+	ip    net.IP
+	err   error
+}
+
+func (e *updateExecutable) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	atomic.AddInt32(&e.n, 1)
+	time.Sleep(e.delay)
+	if e.err != nil {
+		return e.err
+	}
+	qCtx.SetResponse(newTestResponse(qCtx.QReadOnly(), e.ip, 300))
+	return nil
+}
+
+func newTestResponse(q *dns.Msg, ip net.IP, ttl uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   ip,
+	})
+	return r
+}
+
+func Test_cachePlugin_latencyBudget(t *testing.T) {
+	expiredIP, updatedIP := net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)
+	tests := []struct {
+		name           string
+		next           *updateExecutable
+		wantIP         net.IP
+		wantOverBudget bool
+	}{
+		{"updated within budget", &updateExecutable{ip: updatedIP}, updatedIP, false},
+		{"budget exhausted", &updateExecutable{ip: updatedIP, delay: time.Millisecond * 200}, expiredIP, true},
+		{"update failed", &updateExecutable{err: errors.New("failed")}, expiredIP, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cachePlugin{
+				BP:           coremain.NewBP("test", PluginType, nil, nil),
+				args:         &Args{LazyCacheTTL: 3600, LazyCacheReplyTTL: 5, LatencyBudget: 50},
+				backend:      mem_cache.NewMemCache(1024),
+				queryTotal:   prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+				hitTotal:     prometheus.NewCounter(prometheus.CounterOpts{Name: "hit_total"}),
+				lazyHitTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "lazy_hit_total"}),
+				overBudget:   prometheus.NewCounter(prometheus.CounterOpts{Name: "over_budget_total"}),
+			}
+			defer c.backend.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			key, err := c.getMsgKey(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A zero ttl response is expired once it is stored.
+			if err := c.tryStoreMsg(key, newTestResponse(q, expiredIP, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			exec := func() *dns.Msg {
+				t.Helper()
+				qCtx := query_context.NewContext(q.Copy(), nil)
+				if err := c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(tt.next)); err != nil {
+					t.Fatal(err)
+				}
+				return qCtx.R()
+			}
+			r := exec()
+			if r == nil || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(tt.wantIP) {
+				t.Fatalf("want response of %s, got %v", tt.wantIP, r)
+			}
+			if overBudget := testutil.ToFloat64(c.overBudget) > 0; overBudget != tt.wantOverBudget {
+				t.Fatalf("want over budget %v, got %v", tt.wantOverBudget, overBudget)
+			}
+			if !tt.wantOverBudget {
+				return
+			}
+
+			// The update is carried over to the next query after the
+			// budget was exhausted.
+			time.Sleep(tt.next.delay + time.Millisecond*100)
+			r = exec()
+			if tt.next.err != nil {
+				if n := atomic.LoadInt32(&tt.next.n); n != 2 {
+					t.Fatalf("want a new update after the failed one, got %d updates", n)
+				}
+				return
+			}
+			if r == nil || !r.Answer[0].(*dns.A).A.Equal(updatedIP) {
+				t.Fatalf("want the updated response, got %v", r)
+			}
+			if n := atomic.LoadInt32(&tt.next.n); n != 1 {
+				t.Fatalf("want the updated response from the cache, got %d updates", n)
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_reportSize(t *testing.T) {
+	c := &cachePlugin{
+		BP:      coremain.NewBP("test", PluginType, nil, nil),
+		args:    new(Args),
+		backend: mem_cache.NewMemCache(1024),
+		size:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "cache_size"}),
+	}
+	defer c.backend.Close()
+
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		c.backend.Store(key, []byte{}, now, now.Add(time.Minute))
+	}
+	// The gauge is updated by the report only.
+	if v := testutil.ToFloat64(c.size); v != 0 {
+		t.Fatalf("want size 0 before the report, got %v", v)
+	}
+	if err := c.reportSize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(c.size); v != 3 {
+		t.Fatalf("want size 3, got %v", v)
+	}
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/plugins/test/flush", nil))
+	if v := testutil.ToFloat64(c.size); v != 0 {
+		t.Fatalf("want size 0 after flush, got %v", v)
+	}
+}
+
+func Test_cachePlugin_getMsgKey(t *testing.T) {
+	simple := new(dns.Msg)
+	simple.SetQuestion("example.com.", dns.TypeA)
+	withDO := simple.Copy()
+	withDO.SetEdns0(1232, true)
+	withECS := simple.Copy()
+	withECS.SetEdns0(1232, false)
+	withECS.IsEdns0().Option = append(withECS.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(1, 2, 3, 0)})
+
+	tests := []struct {
+		name            string
+		q               *dns.Msg
+		cacheEverything bool
+		wantCached      bool
+	}{
+		{"simple", simple, false, true},
+		{"do", withDO, false, false},
+		{"ecs", withECS, false, false},
+		{"do cache_everything", withDO, true, true},
+		{"ecs cache_everything", withECS, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cachePlugin{args: &Args{CacheEverything: tt.cacheEverything}}
+			key, err := c.getMsgKey(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := len(key) > 0; cached != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strings"
+)
+
+const PluginType = "client_groups"
+
+// GroupKey is the key of the query context value that stores the name
+// of the client group.
+const GroupKey = "client_group"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*clientGroups)(nil)
+
+type Args struct {
+	// Groups are checked in order. A client belongs to the first group
+	// that it matches.
+	Groups []GroupArgs `yaml:"groups"`
+
+	// Default is executed for clients that belong to no group. Optional.
+	Default interface{} `yaml:"default"`
+
+	// Leases is the dnsmasq lease file, or "provider:tag" to use a data
+	// provider. Required by Hostname of groups. Also used to lookup macs.
+	Leases string `yaml:"leases"`
+}
+
+// GroupArgs defines a client group. A client is in the group if it
+// matches any of IP, MAC, Hostname and Ident.
+type GroupArgs struct {
+	Name     string   `yaml:"name"`     // required
+	IP       []string `yaml:"ip"`       // client ip ranges, e.g. "192.168.1.0/28"
+	MAC      []string `yaml:"mac"`      // only for clients in the same lan
+	Hostname []string `yaml:"hostname"` // hostnames in the dhcp leases, case-insensitive
+	// Ident is the client id, which is the first label of the tls server
+	// name of DoT/DoH queries, e.g. "kids" of "kids.dns.example".
+	Ident []string `yaml:"ident"`
+
+	// Exec is the sequence executed for the group, which has the same
+	// format as the exec of the sequence plugin. Required.
+	Exec interface{} `yaml:"exec"`
+}
+
+// clientGroups executes different sequences for groups of clients.
+// The rest of the sequence is executed after the sequence of the group.
+type clientGroups struct {
+	*coremain.BP
+	groups []*group
+	def    executable_seq.ExecutableChainNode // maybe nil
+
+	table  *neighbor.Table  // nil if no group has mac
+	leases *neighbor.Leases // maybe nil
+	closer []io.Closer
+}
+
+type group struct {
+	name     string
+	ip       netlist.Matcher // maybe nil
+	mac      map[string]struct{}
+	hostname map[string]struct{}
+	ident    map[string]struct{}
+	exec     executable_seq.ExecutableChainNode
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newClientGroups(bp, args.(*Args))
+}
+
+func newClientGroups(bp *coremain.BP, args *Args) (*clientGroups, error) {
+	if len(args.Groups) == 0 {
+		return nil, errors.New("no group")
+	}
+	p := &clientGroups{BP: bp}
+	if len(args.Leases) > 0 {
+		leases, err := neighbor.LoadLeases(args.Leases, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.leases = leases
+		p.closer = append(p.closer, leases)
+	}
+
+	names := make(map[string]struct{})
+	for i, ga := range args.Groups {
+		g, err := p.loadGroup(ga)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("invalid group #%d, %w", i, err)
+		}
+		if _, dup := names[g.name]; dup {
+			_ = p.Close()
+			return nil, fmt.Errorf("duplicated group name %s", g.name)
+		}
+		names[g.name] = struct{}{}
+		p.groups = append(p.groups, g)
+	}
+
+	if args.Default != nil {
+		def, err := executable_seq.BuildExecutableLogicTree(args.Default, bp.L(), bp.M().GetExecutables(), bp.M().GetMatchers())
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("cannot build default sequence: %w", err)
+		}
+		p.def = def
+	}
+	return p, nil
+}
+
+func (p *clientGroups) loadGroup(ga GroupArgs) (*group, error) {
+	if len(ga.Name) == 0 {
+		return nil, errors.New("missing name")
+	}
+	if ga.Exec == nil {
+		return nil, errors.New("missing exec")
+	}
+	if len(ga.Hostname) > 0 && p.leases == nil {
+		return nil, errors.New("hostname requires leases")
+	}
+
+	g := &group{
+		name:     ga.Name,
+		mac:      make(map[string]struct{}),
+		hostname: make(map[string]struct{}),
+		ident:    make(map[string]struct{}),
+	}
+	if len(ga.IP) > 0 {
+		mg, err := netlist.BatchLoadProvider(ga.IP, p.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip, %w", err)
+		}
+		p.closer = append(p.closer, mg)
+		g.ip = mg
+	}
+	for _, s := range ga.MAC {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac %s, %w", s, err)
+		}
+		g.mac[mac.String()] = struct{}{}
+		p.table = neighbor.DefaultTable()
+	}
+	for _, s := range ga.Hostname {
+		g.hostname[strings.ToLower(s)] = struct{}{}
+	}
+	for _, s := range ga.Ident {
+		g.ident[strings.ToLower(s)] = struct{}{}
+	}
+
+	exec, err := executable_seq.BuildExecutableLogicTree(ga.Exec, p.L(), p.M().GetExecutables(), p.M().GetMatchers())
+	if err != nil {
+		return nil, fmt.Errorf("cannot build sequence: %w", err)
+	}
+	g.exec = exec
+	return g, nil
+}
+
+func (p *clientGroups) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	exec := p.def
+	if g := p.groupOf(qCtx); g != nil {
+		qCtx.SetValue(GroupKey, g.name)
+		exec = g.exec
+	}
+	if exec != nil {
+		if err := executable_seq.ExecChainNode(ctx, qCtx, exec); err != nil {
+			return err
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// groupOf returns the group of the client. It returns nil if the client
+// belongs to no group.
+func (p *clientGroups) groupOf(qCtx *query_context.Context) *group {
+	meta := qCtx.ReqMeta()
+	addr := meta.ClientAddr.Unmap()
+	ident, _, _ := strings.Cut(strings.ToLower(meta.ServerName), ".")
+
+	var hostname string
+	if p.leases != nil && addr.IsValid() {
+		if l := p.leases.Lookup(addr); l != nil {
+			hostname = l.Hostname
+		}
+	}
+	var mac string
+	if p.table != nil && addr.IsValid() {
+		hw, err := neighbor.ClientMAC(addr, p.leases, p.table)
+		if err != nil {
+			p.L().Debug("failed to lookup neighbor table", qCtx.InfoField(), zap.Error(err))
+		} else if hw != nil {
+			mac = hw.String()
+		}
+	}
+
+	for _, g := range p.groups {
+		if g.ip != nil && addr.IsValid() {
+			if ok, _ := g.ip.Match(addr); ok {
+				return g
+			}
+		}
+		if hasKey(g.mac, mac) || hasKey(g.hostname, hostname) || hasKey(g.ident, ident) {
+			return g
+		}
+	}
+	return nil
+}
+
+func hasKey(m map[string]struct{}, k string) bool {
+	if len(k) == 0 {
+		return false
+	}
+	_, ok := m[k]
+	return ok
+}
+
+func (p *clientGroups) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
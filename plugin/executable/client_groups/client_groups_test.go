@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_groups
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+type recorder struct {
+	executed bool
+}
+
+func (r *recorder) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r.executed = true
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func Test_clientGroups_Exec(t *testing.T) {
+	leases := new(neighbor.Leases)
+	if err := leases.Update([]byte("1667900000 aa:bb:cc:dd:ee:01 192.168.1.20 kids-ipad *\n")); err != nil {
+		t.Fatal(err)
+	}
+	ipList := netlist.NewList()
+	if err := netlist.LoadFromText(ipList, "192.168.1.0/28"); err != nil {
+		t.Fatal(err)
+	}
+	ipList.Sort()
+
+	newGroup := func(name string) (*group, *recorder) {
+		r := new(recorder)
+		return &group{
+			name:     name,
+			mac:      map[string]struct{}{},
+			hostname: map[string]struct{}{},
+			ident:    map[string]struct{}{},
+			exec:     executable_seq.WrapExecutable(r),
+		}, r
+	}
+	iot, iotRec := newGroup("iot")
+	iot.ip = ipList
+	kids, kidsRec := newGroup("kids")
+	kids.hostname["kids-ipad"] = struct{}{}
+	kids.ident["kids"] = struct{}{}
+	defRec := new(recorder)
+
+	p := &clientGroups{
+		BP:     coremain.NewBP("test", PluginType, nil, nil),
+		groups: []*group{iot, kids},
+		def:    executable_seq.WrapExecutable(defRec),
+		leases: leases,
+	}
+
+	tests := []struct {
+		name       string
+		meta       *query_context.RequestMeta
+		wantGroup  string
+		wantRecord *recorder
+	}{
+		{"ip", &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("192.168.1.5")}, "iot", iotRec},
+		{"hostname", &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("192.168.1.20")}, "kids", kidsRec},
+		{"ident", &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("10.0.0.1"), ServerName: "Kids.dns.example"}, "kids", kidsRec},
+		{"default", &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("10.0.0.1"), ServerName: "dns.example"}, "", defRec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range []*recorder{iotRec, kidsRec, defRec} {
+				r.executed = false
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, tt.meta)
+			nextRec := new(recorder)
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(nextRec)); err != nil {
+				t.Fatal(err)
+			}
+			if g, _ := qCtx.GetValue(GroupKey); g != tt.wantGroup {
+				t.Fatalf("want group %s, got %s", tt.wantGroup, g)
+			}
+			if !tt.wantRecord.executed || !nextRec.executed {
+				t.Fatal("sequence of the group or next is not executed")
+			}
+		})
+	}
+}
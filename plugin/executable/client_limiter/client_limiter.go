@@ -21,12 +21,13 @@ package client_limiter
 
 import (
 	"context"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/concurrent_limiter"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
 	"github.com/miekg/dns"
-	"sync"
 	"time"
 )
 
@@ -47,9 +48,8 @@ var _ coremain.ExecutablePlugin = (*Limiter)(nil)
 type Limiter struct {
 	*coremain.BP
 
-	closeOnce   sync.Once
-	closeNotify chan struct{}
-	hpLimiter   *concurrent_limiter.HPClientLimiter
+	hpLimiter *concurrent_limiter.HPClientLimiter
+	gcTask    *scheduler.Task
 }
 
 func NewLimiter(bp *coremain.BP, args *Args) (*Limiter, error) {
@@ -61,11 +61,20 @@ func NewLimiter(bp *coremain.BP, args *Args) (*Limiter, error) {
 		return nil, err
 	}
 	l := &Limiter{
-		BP:          bp,
-		hpLimiter:   hpl,
-		closeNotify: make(chan struct{}),
+		BP:        bp,
+		hpLimiter: hpl,
+	}
+	l.gcTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/gc", bp.Tag()),
+		Func: func(context.Context) error {
+			hpl.GC(time.Now())
+			return nil
+		},
+		Schedule: scheduler.Every(time.Second * 5),
+	})
+	if err != nil {
+		return nil, err
 	}
-	go l.cleanerLoop()
 	return l, nil
 }
 
@@ -84,25 +93,10 @@ func (l *Limiter) Exec(ctx context.Context, qCtx *query_context.Context, next ex
 }
 
 func (l *Limiter) Close() error {
-	l.closeOnce.Do(func() {
-		close(l.closeNotify)
-	})
+	l.gcTask.Cancel()
 	return nil
 }
 
-func (l *Limiter) cleanerLoop() {
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
-	for {
-		select {
-		case now := <-ticker.C:
-			l.hpLimiter.GC(now)
-		case <-l.closeNotify:
-			return
-		}
-	}
-}
-
 // Init is a handler.NewPluginFunc.
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 	return NewLimiter(bp, args.(*Args))
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cname_flatten
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "cname_flatten"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const defaultMaxDepth = 8
+
+var _ coremain.ExecutablePlugin = (*cnameFlatten)(nil)
+
+type Args struct {
+	// Resolver is the tag of an executable plugin, e.g. a forward plugin,
+	// that resolves the end of the CNAME chain if the response does not
+	// contain its A/AAAA records. If empty, incomplete chains are not
+	// flattened.
+	Resolver string `yaml:"resolver"`
+
+	// MaxDepth is the max number of CNAME records to follow. Default is 8.
+	MaxDepth int `yaml:"max_depth"`
+}
+
+// cnameFlatten replaces the CNAME chain of an A/AAAA response with the
+// final A/AAAA records, owned by the query name. The ttl of the new records
+// is the lowest ttl of the chain.
+type cnameFlatten struct {
+	*coremain.BP
+	resolver executable_seq.Executable // maybe nil
+	maxDepth int
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	a := args.(*Args)
+	var resolver executable_seq.Executable
+	if len(a.Resolver) > 0 {
+		resolver = bp.M().GetExecutables()[a.Resolver]
+		if resolver == nil {
+			return nil, fmt.Errorf("cannot find executable %s", a.Resolver)
+		}
+	}
+	return newCNAMEFlatten(bp, a, resolver), nil
+}
+
+func newCNAMEFlatten(bp *coremain.BP, args *Args, resolver executable_seq.Executable) *cnameFlatten {
+	maxDepth := args.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	return &cnameFlatten{BP: bp, resolver: resolver, maxDepth: maxDepth}
+}
+
+// Exec flattens the response. Responses are left untouched in DNSSEC
+// pass-through mode, or if the chain cannot be resolved.
+func (p *cnameFlatten) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	p.flatten(ctx, qCtx)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *cnameFlatten) flatten(ctx context.Context, qCtx *query_context.Context) {
+	r := qCtx.RReadOnly()
+	q := qCtx.QReadOnly()
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(q.Question) != 1 || qCtx.DNSSECPassthrough() {
+		return
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA || question.Qclass != dns.ClassINET {
+		return
+	}
+
+	name, minTTL, addrs, depth := followChain(r.Answer, question.Name, question.Qtype, ^uint32(0), p.maxDepth)
+	if depth == 0 { // no CNAME
+		return
+	}
+	for len(addrs) == 0 && p.resolver != nil && depth < p.maxDepth {
+		fr, err := p.resolve(ctx, qCtx, name, question.Qtype)
+		if err != nil {
+			p.L().Warn("failed to resolve cname target", qCtx.InfoField(), zap.String("target", name), zap.Error(err))
+			return
+		}
+		if fr == nil || fr.Rcode != dns.RcodeSuccess {
+			return
+		}
+		var n int
+		name, minTTL, addrs, n = followChain(fr.Answer, name, question.Qtype, minTTL, p.maxDepth-depth)
+		if n == 0 && len(addrs) == 0 { // NODATA
+			return
+		}
+		depth += n
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	answer := make([]dns.RR, 0, len(addrs))
+	for _, rr := range addrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		rr.Header().Ttl = minTTL
+		answer = append(answer, rr)
+	}
+	qCtx.R().Answer = answer
+	p.L().Debug("cname chain flattened", qCtx.InfoField(), zap.Int("depth", depth))
+}
+
+// resolve sends a query of name to the resolver. The query inherits the
+// EDNS0 options of the original query.
+func (p *cnameFlatten) resolve(ctx context.Context, qCtx *query_context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	fq := qCtx.QReadOnly().Copy()
+	fq.Id = dns.Id()
+	fq.Question[0] = dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	fqCtx := query_context.NewContext(fq, qCtx.ReqMeta())
+	// The response is not released by Release, so it can be returned.
+	defer fqCtx.Release()
+	if err := p.resolver.Exec(ctx, fqCtx, nil); err != nil {
+		return nil, err
+	}
+	return fqCtx.RReadOnly(), nil
+}
+
+// followChain follows the CNAME records in answer from name, up to
+// maxDepth records. It returns the end of the chain, the lowest ttl of the
+// followed records and the qtype records of the end, and the number of
+// followed CNAME records.
+func followChain(answer []dns.RR, name string, qtype uint16, minTTL uint32, maxDepth int) (string, uint32, []dns.RR, int) {
+	depth := 0
+	for {
+		var target string
+		var addrs []dns.RR
+		for _, rr := range answer {
+			h := rr.Header()
+			if h.Class != dns.ClassINET || !equalName(h.Name, name) {
+				continue
+			}
+			switch {
+			case h.Rrtype == dns.TypeCNAME && len(target) == 0:
+				target = rr.(*dns.CNAME).Target
+				minTTL = minUint32(minTTL, h.Ttl)
+			case h.Rrtype == qtype:
+				addrs = append(addrs, rr)
+			}
+		}
+		if len(target) == 0 || depth >= maxDepth {
+			for _, rr := range addrs {
+				minTTL = minUint32(minTTL, rr.Header().Ttl)
+			}
+			return name, minTTL, addrs, depth
+		}
+		name = target
+		depth++
+	}
+}
+
+func equalName(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
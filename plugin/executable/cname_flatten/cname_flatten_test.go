@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cname_flatten
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+)
+
+// mapResolver replies the answer of the query name.
+type mapResolver map[string][]string
+
+func (m mapResolver) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	q := qCtx.QReadOnly()
+	rrs, ok := m[q.Question[0].Name]
+	if !ok {
+		return errors.New("unexpected query")
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = mustRRs(rrs)
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func mustRRs(ss []string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func Test_cnameFlatten_flatten(t *testing.T) {
+	resolver := mapResolver{
+		"edge.cdn.":  {"edge.cdn. 30 IN CNAME node.cdn.", "node.cdn. 20 IN A 1.1.1.1", "node.cdn. 20 IN A 1.1.1.2"},
+		"empty.cdn.": {},
+	}
+
+	tests := []struct {
+		name     string
+		qType    uint16
+		answer   []string
+		resolver bool
+		dnssec   bool
+		want     []string
+	}{
+		{"no cname", dns.TypeA,
+			[]string{"a.com. 60 IN A 1.1.1.1"}, false, false,
+			[]string{"a.com.\t60\tIN\tA\t1.1.1.1"}},
+		{"complete chain", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME b.com.", "b.com. 100 IN CNAME c.com.", "C.com. 200 IN A 1.1.1.1"}, false, false,
+			[]string{"a.com.\t100\tIN\tA\t1.1.1.1"}},
+		{"dnssec", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME b.com.", "b.com. 200 IN A 1.1.1.1"}, false, true,
+			[]string{"a.com.\t300\tIN\tCNAME\tb.com.", "b.com.\t200\tIN\tA\t1.1.1.1"}},
+		{"incomplete chain", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME edge.cdn."}, false, false,
+			[]string{"a.com.\t300\tIN\tCNAME\tedge.cdn."}},
+		{"resolve", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME edge.cdn."}, true, false,
+			[]string{"a.com.\t20\tIN\tA\t1.1.1.1", "a.com.\t20\tIN\tA\t1.1.1.2"}},
+		{"resolve nodata", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME empty.cdn."}, true, false,
+			[]string{"a.com.\t300\tIN\tCNAME\tempty.cdn."}},
+		{"resolve failed", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME unknown.cdn."}, true, false,
+			[]string{"a.com.\t300\tIN\tCNAME\tunknown.cdn."}},
+		{"loop", dns.TypeA,
+			[]string{"a.com. 300 IN CNAME b.com.", "b.com. 300 IN CNAME a.com."}, true, false,
+			[]string{"a.com.\t300\tIN\tCNAME\tb.com.", "b.com.\t300\tIN\tCNAME\ta.com."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newCNAMEFlatten(coremain.NewBP("test", PluginType, nil, nil), &Args{}, nil)
+			if tt.resolver {
+				p.resolver = resolver
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("a.com.", tt.qType)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = mustRRs(tt.answer)
+			qCtx := query_context.NewContext(q, nil)
+			qCtx.SetDNSSECPassthrough(tt.dnssec)
+			qCtx.SetResponse(r)
+			p.flatten(context.Background(), qCtx)
+
+			var got []string
+			for _, rr := range qCtx.R().Answer {
+				got = append(got, rr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
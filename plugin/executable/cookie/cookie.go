@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cookie
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"time"
+)
+
+const PluginType = "cookie"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*cookie)(nil)
+
+type Args struct {
+	// Secret is the hex encoded 16 bytes secret of server cookies.
+	// Servers that share the secret accept cookies of each other.
+	// If empty, a random secret is used.
+	Secret string `yaml:"secret"`
+
+	// BadCookie replies BADCOOKIE to udp queries that have a client cookie
+	// but no valid server cookie. Clients will retry with the server cookie
+	// in the BADCOOKIE response, which prevents spoofed source addresses.
+	BadCookie bool `yaml:"bad_cookie"`
+}
+
+// cookie is the server side of DNS cookies (RFC 7873). It answers cookies
+// of queries and removes them before the query goes to next plugins.
+// It should be placed after the response padding plugins, so that the
+// padding option is the last one.
+type cookie struct {
+	*coremain.BP
+	s         *dns_cookie.Server
+	badCookie bool
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newCookie(bp, args.(*Args))
+}
+
+func newCookie(bp *coremain.BP, args *Args) (*cookie, error) {
+	c := &cookie{BP: bp, badCookie: args.BadCookie}
+	if len(args.Secret) > 0 {
+		secret, err := hex.DecodeString(args.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret, %w", err)
+		}
+		c.s, err = dns_cookie.NewServer(secret)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.s = dns_cookie.NewRandomServer()
+	}
+	return c, nil
+}
+
+func (c *cookie) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.QReadOnly()
+	var co *dns.EDNS0_COOKIE
+	if opt := q.IsEdns0(); opt != nil {
+		co, _ = dnsutils.GetEDNS0Option(opt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	}
+	if co == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	client, server, err := dns_cookie.Parse(co)
+	if err != nil { // RFC 7873 5.2.2
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeFormatError)
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	meta := qCtx.ReqMeta()
+	now := time.Now()
+	var valid, fresh bool
+	if server != nil {
+		valid, fresh = c.s.Verify(client, server, meta.ClientAddr, now)
+	}
+	if !fresh {
+		server = c.s.Generate(client, meta.ClientAddr, now)
+	}
+	if !valid && c.badCookie && meta.FromUDP {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeBadCookie)
+		setCookie(r, client, server)
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	dnsutils.RemoveEDNS0Option(qCtx.Q().IsEdns0(), dns.EDNS0COOKIE)
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		setCookie(r, client, server)
+	}
+	return nil
+}
+
+// setCookie replaces the cookie of r.
+func setCookie(r *dns.Msg, client, server []byte) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		opt = dnsutils.UpgradeEDNS0(r)
+	} else {
+		dnsutils.RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+	}
+	opt.Option = append(opt.Option, dns_cookie.NewOption(client, server))
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cookie
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func Test_cookie_Exec(t *testing.T) {
+	c, err := newCookie(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		Secret:    "e5e973e5a6b2a43f48e7dc849e37bfcf",
+		BadCookie: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("198.51.100.100"), FromUDP: true}
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	exec := func(o *dns.EDNS0_COOKIE) (*dns.Msg, bool) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if o != nil {
+			opt := dnsutils.UpgradeEDNS0(q)
+			opt.Option = append(opt.Option, o)
+		}
+		qCtx := query_context.NewContext(q, meta)
+		var reached bool
+		if err := c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(execFunc(func(qCtx *query_context.Context) {
+			reached = true
+			if opt := qCtx.QReadOnly().IsEdns0(); opt != nil && dnsutils.GetEDNS0Option(opt, dns.EDNS0COOKIE) != nil {
+				t.Fatal("cookie should be removed from the query")
+			}
+			r := new(dns.Msg)
+			r.SetReply(qCtx.QReadOnly())
+			qCtx.SetResponse(r)
+		}))); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R(), reached
+	}
+
+	// No cookie, passed through.
+	r, reached := exec(nil)
+	if !reached || r.IsEdns0() != nil {
+		t.Fatal("query without cookie should not be changed")
+	}
+
+	// Only client cookie, BADCOOKIE with a server cookie.
+	r, reached = exec(dns_cookie.NewOption(client, nil))
+	if reached || r.Rcode != dns.RcodeBadCookie {
+		t.Fatalf("want BADCOOKIE, got %d", r.Rcode)
+	}
+	co := dnsutils.GetEDNS0Option(r.IsEdns0(), dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	gotClient, server, err := dns_cookie.Parse(co)
+	if err != nil || string(gotClient) != string(client) || len(server) != dns_cookie.ServerCookieLen {
+		t.Fatalf("invalid cookie in response, %v", co)
+	}
+
+	// Valid server cookie.
+	r, reached = exec(dns_cookie.NewOption(client, server))
+	if !reached || r.Rcode != dns.RcodeSuccess {
+		t.Fatal("query with valid cookie should pass")
+	}
+	if dnsutils.GetEDNS0Option(r.IsEdns0(), dns.EDNS0COOKIE) == nil {
+		t.Fatal("response should have cookie")
+	}
+
+	// Malformed cookie.
+	r, reached = exec(&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102"})
+	if reached || r.Rcode != dns.RcodeFormatError {
+		t.Fatal("want FORMERR")
+	}
+}
+
+type execFunc func(qCtx *query_context.Context)
+
+func (f execFunc) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	f(qCtx)
+	return nil
+}
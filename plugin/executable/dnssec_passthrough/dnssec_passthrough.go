@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_passthrough
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+)
+
+const presetTag = "_dnssec_passthrough"
+
+func init() {
+	coremain.RegNewPersetPluginFunc(presetTag, func(bp *coremain.BP) (coremain.Plugin, error) {
+		return &passthrough{BP: bp}, nil
+	})
+}
+
+var _ coremain.ExecutablePlugin = (*passthrough)(nil)
+var _ coremain.DNSSECPassthroughEnabler = (*passthrough)(nil)
+
+// passthrough enables the DNSSEC pass-through mode if the client
+// sets the DO bit. In this mode, DNSSEC records are forwarded untouched,
+// plugins that would rewrite or strip records of the response will
+// skip the rewrite or block the response instead.
+type passthrough struct {
+	*coremain.BP
+}
+
+func (p *passthrough) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if opt := qCtx.OriginalQuery().IsEdns0(); opt != nil && opt.Do() {
+		qCtx.SetDNSSECPassthrough(true)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *passthrough) EnablesDNSSECPassthrough() bool {
+	return true
+}
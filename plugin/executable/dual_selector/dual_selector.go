@@ -24,10 +24,8 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
-	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
-	"go.uber.org/zap"
 	"time"
 )
 
@@ -37,8 +35,7 @@ const (
 	modePreferIPv4 = iota
 	modePreferIPv6
 
-	defaultWaitTimeout      = time.Millisecond * 250
-	defaultSubRoutineTimout = time.Second * 5
+	defaultWaitTimeout = time.Millisecond * 250
 )
 
 func init() {
@@ -84,77 +81,18 @@ func (s *Selector) Exec(ctx context.Context, qCtx *query_context.Context, next e
 		return executable_seq.ExecChainNode(ctx, qCtx, next)
 	}
 
-	// start reference goroutine
-	qCtxRef := qCtx.Copy()
 	var refQtype uint16
 	if qtype == dns.TypeA {
 		refQtype = dns.TypeAAAA
 	} else {
 		refQtype = dns.TypeA
 	}
-	qCtxRef.Q().Question[0].Qtype = refQtype
-
-	ddl, ok := ctx.Deadline()
-	if !ok {
-		ddl = time.Now().Add(defaultSubRoutineTimout)
-	}
-
-	shouldBlock := make(chan struct{}, 0)
-	shouldPass := make(chan struct{}, 0)
-	ctxRef, cancelRef := context.WithDeadline(context.Background(), ddl)
-	go func() {
-		defer cancelRef()
-		err := executable_seq.ExecChainNode(ctxRef, qCtxRef, next)
-		if err != nil {
-			s.L().Warn("reference query routine err", qCtxRef.InfoField(), zap.Error(err))
-			close(shouldPass)
-			return
-		}
-		if r := qCtxRef.R(); r != nil && msgAnsHasRR(r, refQtype) {
-			// Target domain has reference type.
-			close(shouldBlock)
-			return
-		}
-		close(shouldPass)
-		return
-	}()
-
-	// start original query goroutine
-	doneChan := make(chan error, 1)
-	qCtxSub := qCtx.Copy()
-	ctxSub, cancelSub := context.WithDeadline(context.Background(), ddl)
-	defer cancelSub()
-	go func() {
-		doneChan <- executable_seq.ExecChainNode(ctxSub, qCtxSub, next)
-	}()
-
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-shouldBlock: // Reference indicates we should block this query before the original query finished.
-		r := dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
-		qCtx.SetResponse(r)
+	hasRef, err := executable_seq.ProbeReference(ctx, qCtx, next, refQtype, s.getWaitTimeout(), s.L())
+	if hasRef {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
 		return nil
-	case err := <-doneChan: // The original query finished. Waiting for reference.
-		waitTimeoutTimer := pool.GetTimer(s.getWaitTimeout())
-		defer pool.ReleaseTimer(waitTimeoutTimer)
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-shouldBlock:
-			r := dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
-			qCtx.SetResponse(r)
-			return nil
-		case <-shouldPass:
-			*qCtx = *qCtxSub
-			return err
-		case <-waitTimeoutTimer.C:
-			// We have been waiting the reference query for too long.
-			// Something may go wrong. We accept the original reply.
-			*qCtx = *qCtxSub
-			return err
-		}
 	}
+	return err
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -168,16 +106,3 @@ func NewDualSelector(bp *coremain.BP, args *Args) *Selector {
 		waitTimeout: time.Duration(args.WaitTimeout) * time.Millisecond,
 	}
 }
-
-func msgAnsHasRR(m *dns.Msg, t uint16) bool {
-	if len(m.Answer) == 0 {
-		return false
-	}
-
-	for _, rr := range m.Answer {
-		if rr.Header().Rrtype == t {
-			return true
-		}
-	}
-	return false
-}
@@ -164,7 +164,7 @@ func TestSelector_Exec(t *testing.T) {
 			}
 
 			r := qCtx.R()
-			if hasReply := msgAnsHasRR(r, tt.qtype); hasReply != tt.wantReply {
+			if hasReply := len(r.Answer) > 0; hasReply != tt.wantReply {
 				t.Errorf("Exec() hasReply = %v, wantReply %v", hasReply, tt.wantReply)
 			}
 		})
@@ -102,7 +102,7 @@ func Test_ecsPlugin(t *testing.T) {
 			}
 
 			var qECS net.IP
-			e := dnsutils.GetMsgECS(q)
+			e := dnsutils.GetMsgECS(qCtx.QReadOnly())
 			if e != nil {
 				qECS = e.Address
 			}
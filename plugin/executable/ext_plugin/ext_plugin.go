@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extplugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/ext_plugin"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"go.uber.org/zap"
+	"time"
+)
+
+const PluginType = "ext_plugin"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*extPlugin)(nil)
+var _ coremain.MatcherPlugin = (*extPlugin)(nil)
+
+type Args struct {
+	// Addr is the gRPC target of the plugin, e.g. "127.0.0.1:5000"
+	// or "unix:///run/plugin.sock". See pkg/ext_plugin/plugin.proto
+	// for the protocol.
+	Addr string `yaml:"addr"`
+	TLS  bool   `yaml:"tls"`
+
+	Timeout             int `yaml:"timeout"`               // (ms) The deadline of each call. Default is 1000.
+	HealthCheckInterval int `yaml:"health_check_interval"` // (sec) Default is 10.
+
+	// FailOpen ignores errors of the plugin. If the plugin is failed or
+	// unhealthy, the query goes on as if the plugin was not there, and
+	// the matcher does not match.
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// extPlugin runs an out-of-process plugin. It can be used as an
+// executable plugin and a matcher.
+type extPlugin struct {
+	*coremain.BP
+	args *Args
+
+	c          *ext_plugin.Client
+	healthTask *scheduler.Task
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	ep, err := newExtPlugin(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(ep.args.HealthCheckInterval) * time.Second
+	ep.healthTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/health_check", bp.Tag()),
+		Func: func(ctx context.Context) error {
+			err := ep.c.CheckHealth(ctx)
+			if err != nil {
+				ep.L().Warn("plugin health check failed", zap.Error(err))
+			}
+			return err
+		},
+		Schedule: scheduler.Every(interval),
+	})
+	if err != nil {
+		ep.Close()
+		return nil, err
+	}
+	return ep, nil
+}
+
+func newExtPlugin(bp *coremain.BP, args *Args) (*extPlugin, error) {
+	if args.Timeout <= 0 {
+		args.Timeout = 1000
+	}
+	if args.HealthCheckInterval <= 0 {
+		args.HealthCheckInterval = 10
+	}
+	c, err := ext_plugin.NewClient(ext_plugin.ClientOpts{
+		Addr:    args.Addr,
+		TLS:     args.TLS,
+		Tag:     bp.Tag(),
+		Timeout: time.Duration(args.Timeout) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init plugin client, %w", err)
+	}
+	return &extPlugin{BP: bp, args: args, c: c}, nil
+}
+
+func (p *extPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	stop, err := p.c.Exec(ctx, qCtx)
+	if err != nil {
+		if !p.args.FailOpen {
+			return fmt.Errorf("plugin exec, %w", err)
+		}
+		p.L().Warn("plugin exec failed", qCtx.InfoField(), zap.Error(err))
+	}
+	if stop {
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *extPlugin) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	matched, err := p.c.Match(ctx, qCtx)
+	if err != nil {
+		if !p.args.FailOpen {
+			return false, fmt.Errorf("plugin match, %w", err)
+		}
+		p.L().Warn("plugin match failed", qCtx.InfoField(), zap.Error(err))
+		return false, nil
+	}
+	return matched, nil
+}
+
+func (p *extPlugin) Close() error {
+	if p.healthTask != nil {
+		p.healthTask.Cancel()
+	}
+	return p.c.Close()
+}
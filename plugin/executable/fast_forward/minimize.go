@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+// clientSpecificOptions are EDNS0 options that only make sense between the
+// client and mosdns, and can be used to fingerprint the client.
+var clientSpecificOptions = []uint16{
+	dns.EDNS0COOKIE,
+	dns.EDNS0TCPKEEPALIVE,
+	dns.EDNS0PADDING,
+}
+
+// minimumPaddedLen is the block length of padded queries, RFC 8467.
+const minimumPaddedLen = 128
+
+// queryMinimizer strips client specific data from outbound queries.
+type queryMinimizer struct {
+	strip    map[uint16]struct{} // EDNS0 options to strip
+	keepADCD bool
+}
+
+func newQueryMinimizer(keepOptions []uint16, keepADCD bool) *queryMinimizer {
+	m := &queryMinimizer{strip: make(map[uint16]struct{}), keepADCD: keepADCD}
+	for _, o := range clientSpecificOptions {
+		m.strip[o] = struct{}{}
+	}
+	for _, o := range keepOptions {
+		delete(m.strip, o)
+	}
+	return m
+}
+
+// minimize returns q if there is nothing to strip. Otherwise, it returns
+// a stripped copy of q. q is never modified.
+// AD and CD bits are kept if the DO bit is set, because the client is
+// validating DNSSEC itself. A stripped padding option is replaced by a
+// new one that pads the query to 128 octets, so queries padded by the
+// client or the "_pad_query" plugin are still padded.
+func (m *queryMinimizer) minimize(q *dns.Msg) *dns.Msg {
+	opt := q.IsEdns0()
+	clearBits := !m.keepADCD && (opt == nil || !opt.Do()) && (q.AuthenticatedData || q.CheckingDisabled)
+	stripOpt := false
+	if opt != nil {
+		for _, o := range opt.Option {
+			if _, ok := m.strip[o.Option()]; ok {
+				stripOpt = true
+				break
+			}
+		}
+	}
+	if !clearBits && !stripOpt {
+		return q
+	}
+
+	q = q.Copy()
+	if clearBits {
+		q.AuthenticatedData = false
+		q.CheckingDisabled = false
+	}
+	if stripOpt {
+		opt := q.IsEdns0()
+		padded := false
+		opts := opt.Option[:0]
+		for _, o := range opt.Option {
+			if _, ok := m.strip[o.Option()]; ok {
+				padded = padded || o.Option() == dns.EDNS0PADDING
+				continue
+			}
+			opts = append(opts, o)
+		}
+		opt.Option = opts
+		if padded {
+			dnsutils.PadToMinimum(q, minimumPaddedLen)
+		}
+	}
+	return q
+}
+
+// minimizedUpstream sends minimized queries to the underlying Upstream.
+type minimizedUpstream struct {
+	bundled_upstream.Upstream
+	m *queryMinimizer
+}
+
+func (u *minimizedUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return u.Upstream.Exchange(ctx, u.m.minimize(q))
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func newQuery(do bool, options ...dns.EDNS0) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.AuthenticatedData = true
+	q.CheckingDisabled = true
+	if do || len(options) > 0 {
+		q.SetEdns0(1232, do)
+		q.IsEdns0().Option = options
+	}
+	return q
+}
+
+func Test_queryMinimizer_minimize(t *testing.T) {
+	cookie := func() dns.EDNS0 { return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"} }
+	ecs := func() dns.EDNS0 { return dnsutils.NewEDNS0Subnet([]byte{1, 2, 3, 0}, 24, false) }
+	padding := func() dns.EDNS0 { return &dns.EDNS0_PADDING{Padding: make([]byte, 7)} }
+
+	tests := []struct {
+		name        string
+		m           *queryMinimizer
+		q           *dns.Msg
+		wantSame    bool
+		wantADCD    bool
+		wantOptions []uint16
+	}{
+		{"strip all", newQueryMinimizer(nil, false), newQuery(false, cookie(), ecs()), false, false, []uint16{dns.EDNS0SUBNET}},
+		{"keep cookie", newQueryMinimizer([]uint16{dns.EDNS0COOKIE}, false), newQuery(false, cookie(), ecs()), false, false, []uint16{dns.EDNS0COOKIE, dns.EDNS0SUBNET}},
+		{"keep ad cd", newQueryMinimizer(nil, true), newQuery(false, ecs()), true, true, []uint16{dns.EDNS0SUBNET}},
+		{"do bit keeps ad cd", newQueryMinimizer(nil, false), newQuery(true), true, true, nil},
+		{"repad", newQueryMinimizer(nil, false), newQuery(false, cookie(), padding()), false, false, []uint16{dns.EDNS0PADDING}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := tt.q.Copy()
+			got := tt.m.minimize(tt.q)
+			if (got == tt.q) != tt.wantSame {
+				t.Fatalf("same msg: got %v, want %v", got == tt.q, tt.wantSame)
+			}
+			if tt.q.String() != orig.String() {
+				t.Fatal("the input query was modified")
+			}
+			if got.AuthenticatedData != tt.wantADCD || got.CheckingDisabled != tt.wantADCD {
+				t.Fatalf("unexpected AD %v CD %v", got.AuthenticatedData, got.CheckingDisabled)
+			}
+			var gotOptions []uint16
+			if opt := got.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					gotOptions = append(gotOptions, o.Option())
+				}
+			}
+			if len(gotOptions) != len(tt.wantOptions) {
+				t.Fatalf("got options %v, want %v", gotOptions, tt.wantOptions)
+			}
+			for i := range gotOptions {
+				if gotOptions[i] != tt.wantOptions[i] {
+					t.Fatalf("got options %v, want %v", gotOptions, tt.wantOptions)
+				}
+			}
+		})
+	}
+
+	// Padded queries are re-padded to the block length.
+	got := newQueryMinimizer(nil, false).minimize(newQuery(false, cookie(), padding()))
+	if got.Len() != minimumPaddedLen {
+		t.Fatalf("unexpected padded length %d", got.Len())
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// TLSArgs are the tls settings of an upstream. Used by dot, doh and doq.
+type TLSArgs struct {
+	// MinVersion and MaxVersion are "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+
+	// CipherSuites are the names of the enabled cipher suites of tls 1.0-1.2,
+	// e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Cipher suites of
+	// tls 1.3 are not configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+
+	// CurvePreferences are the key exchanges in preference order. e.g.
+	// "X25519", "P256", "P384", "P521" and the post-quantum
+	// "X25519MLKEM768" (go1.24+) or "X25519Kyber768Draft00" (go1.23 only).
+	// A key exchange that is not supported by the go runtime is an error.
+	CurvePreferences []string `yaml:"curve_preferences"`
+
+	// ALPN overrides the application protocols.
+	ALPN []string `yaml:"alpn"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// newTLSConfig returns the tls.Config of upstream c.
+func newTLSConfig(c *UpstreamConfig, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		RootCAs:            rootCAs,
+		NextProtos:         c.TLS.ALPN,
+	}
+
+	var err error
+	if tlsConfig.MinVersion, err = parseTLSVersion(c.TLS.MinVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.MaxVersion, err = parseTLSVersion(c.TLS.MaxVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.MaxVersion != 0 && tlsConfig.MinVersion > tlsConfig.MaxVersion {
+		return nil, fmt.Errorf("tls min version %s is higher than max version %s", c.TLS.MinVersion, c.TLS.MaxVersion)
+	}
+
+	for _, name := range c.TLS.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	for _, name := range c.TLS.CurvePreferences {
+		id, ok := curveID(name)
+		if !ok {
+			return nil, fmt.Errorf("curve %s is unknown or not supported by %s", name, runtime.Version())
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, id)
+	}
+	return tlsConfig, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("invalid tls version %s", s)
+	}
+	return v, nil
+}
+
+func curveID(name string) (tls.CurveID, bool) {
+	name = strings.ToLower(name)
+	if id, ok := tlsCurves[name]; ok {
+		return id, true
+	}
+	id, ok := pqCurves[name]
+	return id, ok
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,30 @@
+//go:build go1.24
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import "crypto/tls"
+
+// pqCurves are the post-quantum key exchanges supported by the go runtime.
+// go1.24 replaced X25519Kyber768Draft00 with X25519MLKEM768.
+var pqCurves = map[string]tls.CurveID{
+	"x25519mlkem768": 0x11ec,
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func Test_newTLSConfig(t *testing.T) {
+	c := &UpstreamConfig{TLS: TLSArgs{
+		MinVersion:       "1.2",
+		MaxVersion:       "TLS1.3",
+		CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		CurvePreferences: []string{"P256", "x25519"},
+		ALPN:             []string{"dot"},
+	}}
+	tlsConfig, err := newTLSConfig(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS13 {
+		t.Fatalf("unexpected versions %x %x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if len(tlsConfig.CurvePreferences) != 2 || tlsConfig.CurvePreferences[1] != tls.X25519 {
+		t.Fatalf("unexpected curves %v", tlsConfig.CurvePreferences)
+	}
+	if len(tlsConfig.NextProtos) != 1 || tlsConfig.NextProtos[0] != "dot" {
+		t.Fatalf("unexpected alpn %v", tlsConfig.NextProtos)
+	}
+
+	for _, args := range []TLSArgs{
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"invalid"}},
+		{CurvePreferences: []string{"invalid"}},
+	} {
+		if _, err := newTLSConfig(&UpstreamConfig{TLS: args}, nil); err == nil {
+			t.Fatalf("want err for %+v", args)
+		}
+	}
+
+	// Post-quantum key exchanges depend on the go runtime.
+	for _, name := range []string{"X25519MLKEM768", "X25519Kyber768Draft00"} {
+		_, supported := pqCurves[strings.ToLower(name)]
+		_, err := newTLSConfig(&UpstreamConfig{TLS: TLSArgs{CurvePreferences: []string{name}}}, nil)
+		if supported != (err == nil) {
+			t.Fatalf("%s: supported %v, but got err %v", name, supported, err)
+		}
+	}
+}
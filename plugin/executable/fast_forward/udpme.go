@@ -31,13 +31,15 @@ import (
 type udpmeUpstream struct {
 	addr    string
 	trusted bool
+	dialer  *net.Dialer
 }
 
-func newUDPME(addr string, trusted bool) *udpmeUpstream {
+// newUDPME creates a udpme upstream. dialer must be a udp dialer.
+func newUDPME(addr string, trusted bool, dialer *net.Dialer) *udpmeUpstream {
 	if _, _, err := net.SplitHostPort(addr); err != nil {
 		addr = net.JoinHostPort(addr, "53")
 	}
-	return &udpmeUpstream{addr: addr, trusted: trusted}
+	return &udpmeUpstream{addr: addr, trusted: trusted, dialer: dialer}
 }
 
 func (u *udpmeUpstream) Address() string {
@@ -68,10 +70,11 @@ func (u *udpmeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, err
 }
 
 func (u *udpmeUpstream) exchangeOPTM(m *dns.Msg, ddl time.Time) (*dns.Msg, error) {
-	c, err := dns.Dial("udp", u.addr)
+	conn, err := u.dialer.Dial("udp", u.addr)
 	if err != nil {
 		return nil, err
 	}
+	c := &dns.Conn{Conn: conn}
 	defer c.Close()
 	c.SetDeadline(ddl)
 	if opt := m.IsEdns0(); opt != nil {
@@ -87,7 +90,9 @@ func (u *udpmeUpstream) exchangeOPTM(m *dns.Msg, ddl time.Time) (*dns.Msg, error
 		if err != nil {
 			return nil, err
 		}
-		if r.IsEdns0() == nil {
+		// Drop replies that are not for this query, and replies that
+		// have no edns0 (probably forged by a middlebox).
+		if r.Id != m.Id || !dnsutils.QuestionMatched(m, r) || r.IsEdns0() == nil {
 			continue
 		}
 		return r, nil
@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filter_records
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+)
+
+const PluginType = "filter_records"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*filterRecords)(nil)
+
+type Args struct {
+	Rules []RuleArgs `yaml:"rules"`
+
+	// NoData replaces the response with an empty NODATA response if no
+	// record of the query type is left in the answer after filtering.
+	NoData bool `yaml:"nodata"`
+}
+
+type RuleArgs struct {
+	// Domain is the query names that the rule applies to. If empty, the
+	// rule applies to all queries.
+	Domain []string `yaml:"domain"`
+
+	// Type is the rr types to be removed from the answer, e.g. "HTTPS",
+	// "AAAA" or "65". RRSIG records that cover them are removed too.
+	Type []string `yaml:"type"`
+
+	// IP removes A/AAAA records whose addresses are in these ranges.
+	IP []string `yaml:"ip"`
+
+	// SVCBParam is the params to be removed from HTTPS/SVCB records, e.g.
+	// "ech" or "ipv6hint".
+	SVCBParam []string `yaml:"svcb_param"`
+}
+
+type rule struct {
+	domain    domain.Matcher[struct{}] // nil matches all
+	types     map[uint16]struct{}
+	ip        netlist.Matcher // maybe nil
+	svcbParam map[dns.SVCBKey]struct{}
+}
+
+// filterRecords removes records or HTTPS/SVCB params from the answer of
+// responses. This invalidates DNSSEC signatures. In DNSSEC pass-through
+// mode, a response that has records to be removed or modified is replaced
+// with an empty NODATA response.
+type filterRecords struct {
+	*coremain.BP
+	rules  []*rule
+	noData bool
+	closer []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newFilterRecords(bp, args.(*Args))
+}
+
+func newFilterRecords(bp *coremain.BP, args *Args) (*filterRecords, error) {
+	p := &filterRecords{BP: bp, noData: args.NoData}
+	for i, ra := range args.Rules {
+		r, err := p.loadRule(&ra)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load rule #%d, %w", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (p *filterRecords) loadRule(ra *RuleArgs) (*rule, error) {
+	if len(ra.Type) == 0 && len(ra.IP) == 0 && len(ra.SVCBParam) == 0 {
+		return nil, errors.New("rule has no type, ip or svcb_param")
+	}
+	r := &rule{types: make(map[uint16]struct{}), svcbParam: make(map[dns.SVCBKey]struct{})}
+	for _, s := range ra.Type {
+		t, err := dnsutils.ParseRRType(s)
+		if err != nil {
+			return nil, err
+		}
+		r.types[t] = struct{}{}
+	}
+	for _, s := range ra.SVCBParam {
+		k, err := dnsutils.ParseSVCBKey(s)
+		if err != nil {
+			return nil, err
+		}
+		r.svcbParam[k] = struct{}{}
+	}
+	if len(ra.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(ra.Domain, p.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain, %w", err)
+		}
+		p.closer = append(p.closer, mg)
+		r.domain = mg
+		p.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
+	}
+	if len(ra.IP) > 0 {
+		mg, err := netlist.BatchLoadProvider(ra.IP, p.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip, %w", err)
+		}
+		p.closer = append(p.closer, mg)
+		r.ip = mg
+	}
+	return r, nil
+}
+
+func (p *filterRecords) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := p.filter(qCtx); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *filterRecords) filter(qCtx *query_context.Context) error {
+	r := qCtx.RReadOnly()
+	q := qCtx.QReadOnly()
+	if r == nil || len(q.Question) != 1 || len(r.Answer) == 0 {
+		return nil
+	}
+
+	var rules []*rule
+	for _, rl := range p.rules {
+		if rl.domain != nil {
+			if _, ok := rl.domain.Match(q.Question[0].Name); !ok {
+				continue
+			}
+		}
+		rules = append(rules, rl)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var svcbParam map[dns.SVCBKey]struct{}
+	for _, rl := range rules {
+		for k := range rl.svcbParam {
+			if svcbParam == nil {
+				svcbParam = make(map[dns.SVCBKey]struct{})
+			}
+			svcbParam[k] = struct{}{}
+		}
+	}
+
+	keep := make([]bool, len(r.Answer))
+	removed, modified := 0, 0
+	for i, rr := range r.Answer {
+		drop, err := shouldRemove(rules, rr)
+		if err != nil {
+			return err
+		}
+		keep[i] = !drop
+		if drop {
+			removed++
+		} else if dnsutils.HasSVCBParams(rr, svcbParam) {
+			modified++
+		}
+	}
+	if removed == 0 && modified == 0 {
+		return nil
+	}
+
+	qtype := q.Question[0].Qtype
+	if qCtx.DNSSECPassthrough() {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
+		p.L().Debug("response replaced with nodata in dnssec pass-through mode", qCtx.InfoField())
+		return nil
+	}
+
+	r = qCtx.R()
+	answer := r.Answer[:0]
+	hasQtype := false
+	for i, rr := range r.Answer {
+		if keep[i] {
+			if modified > 0 {
+				dnsutils.StripSVCBParams(rr, svcbParam)
+			}
+			answer = append(answer, rr)
+			hasQtype = hasQtype || rr.Header().Rrtype == qtype
+		}
+	}
+	r.Answer = answer
+	p.L().Debug("records filtered", qCtx.InfoField(), zap.Int("removed", removed), zap.Int("modified", modified))
+	if p.noData && !hasQtype {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
+	}
+	return nil
+}
+
+func shouldRemove(rules []*rule, rr dns.RR) (bool, error) {
+	t := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		t = sig.TypeCovered
+	}
+	var addr netip.Addr
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(rr.AAAA.To16())
+	}
+	for _, rl := range rules {
+		if _, ok := rl.types[t]; ok {
+			return true, nil
+		}
+		if rl.ip != nil && addr.IsValid() {
+			ok, err := rl.ip.Match(addr.Unmap())
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (p *filterRecords) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
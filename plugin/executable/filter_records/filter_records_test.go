@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filter_records
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+)
+
+func newTestPlugin(t *testing.T, noData bool) *filterRecords {
+	t.Helper()
+	d := domain.NewDomainMixMatcher()
+	if err := domain.Load[struct{}](d, "v4only.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	l := netlist.NewList()
+	if err := netlist.Load(l, "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	l.Sort()
+	return &filterRecords{
+		BP:     coremain.NewBP("test", PluginType, nil, nil),
+		noData: noData,
+		rules: []*rule{
+			{types: map[uint16]struct{}{dns.TypeHTTPS: {}}},
+			{domain: d, types: map[uint16]struct{}{dns.TypeAAAA: {}}},
+			{types: map[uint16]struct{}{}, ip: l},
+			{domain: d, svcbParam: map[dns.SVCBKey]struct{}{dns.SVCB_ECHCONFIG: {}}},
+		},
+	}
+}
+
+func Test_filterRecords_filter(t *testing.T) {
+	tests := []struct {
+		name      string
+		noData    bool
+		dnssec    bool
+		qName     string
+		qType     uint16
+		answer    []string
+		wantRcode int
+		want      []string
+	}{
+		{"https", false, false, "a.com.", dns.TypeHTTPS,
+			[]string{"a.com. 60 IN HTTPS 1 . alpn=h3", "a.com. 60 IN RRSIG HTTPS 13 2 60 20300101000000 20200101000000 1 a.com. AAAA"},
+			dns.RcodeSuccess, nil},
+		{"aaaa of other domain", false, false, "a.com.", dns.TypeAAAA,
+			[]string{"a.com. 60 IN AAAA ::1"},
+			dns.RcodeSuccess, []string{"a.com.\t60\tIN\tAAAA\t::1"}},
+		{"aaaa", false, false, "www.v4only.com.", dns.TypeAAAA,
+			[]string{"www.v4only.com. 60 IN CNAME b.com.", "b.com. 60 IN AAAA ::1"},
+			dns.RcodeSuccess, []string{"www.v4only.com.\t60\tIN\tCNAME\tb.com."}},
+		{"aaaa nodata", true, false, "www.v4only.com.", dns.TypeAAAA,
+			[]string{"www.v4only.com. 60 IN CNAME b.com.", "b.com. 60 IN AAAA ::1"},
+			dns.RcodeSuccess, nil},
+		{"ip", true, false, "a.com.", dns.TypeA,
+			[]string{"a.com. 60 IN A 10.0.0.1", "a.com. 60 IN A 1.1.1.1"},
+			dns.RcodeSuccess, []string{"a.com.\t60\tIN\tA\t1.1.1.1"}},
+		{"svcb param", false, false, "www.v4only.com.", dns.TypeSVCB,
+			[]string{"www.v4only.com. 60 IN SVCB 1 . alpn=h2 ech=AEX+DQBB"},
+			dns.RcodeSuccess, []string{"www.v4only.com.\t60\tIN\tSVCB\t1 . alpn=\"h2\""}},
+		{"svcb param dnssec", false, true, "www.v4only.com.", dns.TypeSVCB,
+			[]string{"www.v4only.com. 60 IN SVCB 1 . alpn=h2 ech=AEX+DQBB"},
+			dns.RcodeSuccess, nil},
+		{"dnssec", false, true, "a.com.", dns.TypeA,
+			[]string{"a.com. 60 IN A 10.0.0.1", "a.com. 60 IN A 1.1.1.1"},
+			dns.RcodeSuccess, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, tt.noData)
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qType)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			for _, s := range tt.answer {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Answer = append(r.Answer, rr)
+			}
+			qCtx := query_context.NewContext(q, nil)
+			qCtx.SetDNSSECPassthrough(tt.dnssec)
+			qCtx.SetResponse(r)
+			if err := p.filter(qCtx); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := qCtx.R()
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("want rcode %d, got %d", tt.wantRcode, resp.Rcode)
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				got = append(got, rr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -129,7 +129,7 @@ func (f *forwardPlugin) exec(ctx context.Context, qCtx *query_context.Context) e
 	}
 	// Remainder: Always makes a copy of q. dnsproxy/upstream may keep or even modify the q in their
 	// Exchange() calls.
-	q := qCtx.Q().Copy()
+	q := qCtx.QReadOnly().Copy()
 	c := make(chan res, 1)
 	go func() {
 		r, _, err := upstream.ExchangeParallel(f.upstreams, q)
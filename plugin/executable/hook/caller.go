@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"os/exec"
+	"strings"
+)
+
+// programCaller runs the program once per call.
+type programCaller struct {
+	name string
+	args []string
+}
+
+func newProgramCaller(cmd string) (*programCaller, error) {
+	ss := strings.Fields(cmd)
+	if len(ss) == 0 {
+		return nil, errors.New("empty exec")
+	}
+	path, err := exec.LookPath(ss[0])
+	if err != nil {
+		return nil, err
+	}
+	return &programCaller{name: path, args: ss[1:]}, nil
+}
+
+func (c *programCaller) call(ctx context.Context, payload []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("program err: %w, stderr: %s", err, stderr.String())
+		}
+		return nil, fmt.Errorf("program err: %w", err)
+	}
+	return out, nil
+}
+
+func (c *programCaller) Close() error {
+	return nil
+}
+
+const grpcMethod = "/mosdns.hook.v1.Hook/Process"
+
+// grpcCaller calls a gRPC endpoint that implements
+//
+//	service Hook {
+//	  rpc Process(google.protobuf.BytesValue) returns (google.protobuf.BytesValue);
+//	}
+//
+// in package mosdns.hook.v1.
+type grpcCaller struct {
+	conn *grpc.ClientConn
+}
+
+func newGrpcCaller(addr string, useTLS bool) (*grpcCaller, error) {
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcCaller{conn: conn}, nil
+}
+
+func (c *grpcCaller) call(ctx context.Context, payload []byte) ([]byte, error) {
+	out := new(wrapperspb.BytesValue)
+	if err := c.conn.Invoke(ctx, grpcMethod, wrapperspb.Bytes(payload), out); err != nil {
+		return nil, err
+	}
+	return out.GetValue(), nil
+}
+
+func (c *grpcCaller) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+const PluginType = "hook"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	formatWire = "wire"
+	formatJSON = "json"
+)
+
+type Args struct {
+	// Exec is the command line of the program. The payload is written
+	// to its stdin, and the output is read from its stdout.
+	Exec string `yaml:"exec"`
+
+	// Grpc is the address of the gRPC endpoint. The payload is sent to
+	// the unary method "/mosdns.hook.v1.Hook/Process" as a
+	// google.protobuf.BytesValue, and the output is a BytesValue as well.
+	Grpc    string `yaml:"grpc"`
+	GrpcTLS bool   `yaml:"grpc_tls"`
+
+	// Format is the payload format, "wire" or "json". Default is "wire".
+	// With "wire", the payload is the packed query and the output should be
+	// a packed response. See jsonRequest and jsonResponse for "json".
+	// An empty output means the hook has no response.
+	Format string `yaml:"format"`
+
+	// Substitute replaces the response of the query with the response
+	// from the hook. If false, the hook is called asynchronously and its
+	// output is ignored.
+	Substitute bool `yaml:"substitute"`
+
+	// MaxAsync is the max number of concurrent asynchronous calls when
+	// Substitute is false. Calls over the limit are dropped. Default is 64.
+	MaxAsync int `yaml:"max_async"`
+
+	Timeout          int `yaml:"timeout"`           // (ms) Default is 500.
+	FailureThreshold int `yaml:"failure_threshold"` // Consecutive failures that open the circuit breaker. Default is 5.
+	BreakerCooldown  int `yaml:"breaker_cooldown"`  // (sec) How long the hook is skipped once the breaker is open. Default is 30.
+}
+
+func (a *Args) initDefault() *Args {
+	if len(a.Format) == 0 {
+		a.Format = formatWire
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = 500
+	}
+	if a.MaxAsync <= 0 {
+		a.MaxAsync = 64
+	}
+	if a.FailureThreshold <= 0 {
+		a.FailureThreshold = 5
+	}
+	if a.BreakerCooldown <= 0 {
+		a.BreakerCooldown = 30
+	}
+	return a
+}
+
+// caller calls the hook with the payload and returns its output.
+type caller interface {
+	call(ctx context.Context, payload []byte) ([]byte, error)
+	io.Closer
+}
+
+var _ coremain.ExecutablePlugin = (*hook)(nil)
+
+// hook calls an external program or gRPC endpoint for each query.
+// Failed hooks never fail the query, the query just goes on as if
+// the hook was not there.
+type hook struct {
+	*coremain.BP
+	args    *Args
+	timeout time.Duration
+	caller  caller
+	breaker *breaker
+
+	asyncSem chan struct{} // bounds the asynchronous calls
+	asyncWg  sync.WaitGroup
+
+	callTotal    prometheus.Counter
+	errTotal     prometheus.Counter
+	skippedTotal prometheus.Counter
+	droppedTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	h, err := newHook(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(h.callTotal, h.errTotal, h.skippedTotal, h.droppedTotal)
+	return h, nil
+}
+
+func newHook(bp *coremain.BP, args *Args) (*hook, error) {
+	args.initDefault()
+	switch args.Format {
+	case formatWire, formatJSON:
+	default:
+		return nil, fmt.Errorf("invalid format %s", args.Format)
+	}
+
+	var c caller
+	var err error
+	switch {
+	case len(args.Exec) > 0 && len(args.Grpc) > 0:
+		return nil, errors.New("exec and grpc cannot be both set")
+	case len(args.Exec) > 0:
+		c, err = newProgramCaller(args.Exec)
+	case len(args.Grpc) > 0:
+		c, err = newGrpcCaller(args.Grpc, args.GrpcTLS)
+	default:
+		return nil, errors.New("missing exec or grpc")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook{
+		BP:      bp,
+		args:    args,
+		timeout: time.Duration(args.Timeout) * time.Millisecond,
+		caller:  c,
+		breaker: newBreaker(args.FailureThreshold, time.Duration(args.BreakerCooldown)*time.Second),
+
+		asyncSem: make(chan struct{}, args.MaxAsync),
+
+		callTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "call_total",
+			Help: "The total number of hook calls",
+		}),
+		errTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "err_total",
+			Help: "The total number of failed hook calls",
+		}),
+		skippedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "skipped_total",
+			Help: "The total number of queries that skipped the hook because the circuit breaker was open",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of asynchronous hook calls that were dropped because max_async was reached",
+		}),
+	}, nil
+}
+
+func (h *hook) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if !h.breaker.allow(time.Now()) {
+		h.skippedTotal.Inc()
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	payload, err := h.encode(qCtx)
+	if err != nil {
+		return fmt.Errorf("failed to encode hook payload, %w", err)
+	}
+
+	if !h.args.Substitute {
+		h.callAsync(payload)
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	r, err := h.call(callCtx, qCtx.Q(), payload)
+	cancel()
+	if err == nil && r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// callAsync calls the hook in a new goroutine and ignores its output.
+// The call is dropped if there are already max_async calls running.
+func (h *hook) callAsync(payload []byte) {
+	select {
+	case h.asyncSem <- struct{}{}:
+	default:
+		h.droppedTotal.Inc()
+		return
+	}
+	h.asyncWg.Add(1)
+	go func() {
+		defer func() {
+			<-h.asyncSem
+			h.asyncWg.Done()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		_, _ = h.call(ctx, nil, payload)
+	}()
+}
+
+// call calls the hook. If q is not nil, the output is decoded as the
+// response of q. It returns a nil msg if the hook has no response.
+func (h *hook) call(ctx context.Context, q *dns.Msg, payload []byte) (*dns.Msg, error) {
+	h.callTotal.Inc()
+	out, err := h.caller.call(ctx, payload)
+	var r *dns.Msg
+	if err == nil && q != nil {
+		r, err = h.decode(q, out)
+	}
+	h.breaker.report(err == nil, time.Now())
+	if err != nil {
+		h.errTotal.Inc()
+		h.L().Warn("hook failed", zap.Error(err))
+		return nil, err
+	}
+	return r, nil
+}
+
+func (h *hook) encode(qCtx *query_context.Context) ([]byte, error) {
+	if h.args.Format == formatJSON {
+		return encodeJSON(qCtx)
+	}
+	return qCtx.Q().Pack()
+}
+
+func (h *hook) decode(q *dns.Msg, out []byte) (*dns.Msg, error) {
+	if h.args.Format == formatJSON {
+		return decodeJSON(q, out)
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(out); err != nil {
+		return nil, fmt.Errorf("invalid hook response, %w", err)
+	}
+	if !dnsutils.QuestionMatched(q, r) {
+		return nil, errors.New("hook response does not match the query")
+	}
+	r.Id = q.Id
+	return r, nil
+}
+
+func (h *hook) Close() error {
+	h.asyncWg.Wait() // Calls are bounded by the timeout.
+	return h.caller.Close()
+}
+
+// breaker is a consecutive failure circuit breaker. Once open, calls
+// are rejected for the cooldown duration. After that, calls are allowed
+// again, and the breaker opens again immediately if the next call fails.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	m         sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return !now.Before(b.openUntil)
+}
+
+func (b *breaker) report(ok bool, now time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
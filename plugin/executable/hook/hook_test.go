@@ -0,0 +1,232 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hook
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHook(t *testing.T, args *Args) *hook {
+	t.Helper()
+	h, err := newHook(coremain.NewBP("test", PluginType, nil, nil), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func newQCtx() *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	return query_context.NewContext(q, nil)
+}
+
+// runHook runs h and reports whether the next node was executed.
+func runHook(t *testing.T, h *hook, qCtx *query_context.Context) bool {
+	t.Helper()
+	ran := false
+	if err := h.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(execFunc(func() { ran = true }))); err != nil {
+		t.Fatal(err)
+	}
+	return ran
+}
+
+type execFunc func()
+
+func (f execFunc) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	f()
+	return nil
+}
+
+func Test_hook_program(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	// wire, cat echoes the query back as the response.
+	h := newTestHook(t, &Args{Exec: "cat", Substitute: true})
+	qCtx := newQCtx()
+	if runHook(t, h, qCtx) {
+		t.Fatal("next node should be skipped")
+	}
+	if r := qCtx.R(); r == nil || r.Question[0].Name != "example.com." {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// A response to another question is an error.
+	other := new(dns.Msg)
+	other.SetQuestion("other.com.", dns.TypeA)
+	b, err := other.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := filepath.Join(t.TempDir(), "resp")
+	if err := os.WriteFile(resp, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h = newTestHook(t, &Args{Exec: "cat " + resp, Substitute: true, FailureThreshold: 1})
+	qCtx = newQCtx()
+	if !runHook(t, h, qCtx) || qCtx.R() != nil {
+		t.Fatal("next node should be executed without response")
+	}
+	if n := testutil.ToFloat64(h.errTotal); n != 1 {
+		t.Fatalf("want 1 failed call, got %v", n)
+	}
+	if h.breaker.allow(time.Now()) {
+		t.Fatal("breaker should be open")
+	}
+
+	// json
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	err = os.WriteFile(script, []byte(`read req
+case "$req" in
+  *'"name":"example.com."'*) echo '{"rcode":"NOERROR","answer":["example.com. 60 IN A 1.2.3.4"]}' ;;
+esac
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newTestHook(t, &Args{Exec: "sh " + script, Format: formatJSON, Substitute: true})
+	qCtx = newQCtx()
+	if runHook(t, h, qCtx) {
+		t.Fatal("next node should be skipped")
+	}
+	if r := qCtx.R(); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// Empty output means no response.
+	q := new(dns.Msg)
+	q.SetQuestion("other.com.", dns.TypeA)
+	qCtx = query_context.NewContext(q, nil)
+	if !runHook(t, h, qCtx) || qCtx.R() != nil {
+		t.Fatal("next node should be executed without response")
+	}
+}
+
+func Test_hook_async(t *testing.T) {
+	h := newTestHook(t, &Args{Exec: "sleep 1", Timeout: 200, FailureThreshold: 100, MaxAsync: 1})
+	for i := 0; i < 3; i++ {
+		if !runHook(t, h, newQCtx()) {
+			t.Fatal("next node should be executed")
+		}
+	}
+	if n := testutil.ToFloat64(h.droppedTotal); n != 2 {
+		t.Fatalf("want 2 dropped calls, got %v", n)
+	}
+
+	h.asyncWg.Wait()
+	runHook(t, h, newQCtx())
+	if n := testutil.ToFloat64(h.droppedTotal); n != 2 {
+		t.Fatalf("call should not be dropped after the running calls are done, got %v dropped", n)
+	}
+}
+
+func Test_hook_breaker(t *testing.T) {
+	h := newTestHook(t, &Args{Exec: "sleep 1", Substitute: true, Timeout: 10, FailureThreshold: 2})
+	for i := 0; i < 2; i++ {
+		if !runHook(t, h, newQCtx()) {
+			t.Fatal("failed hook should not stop the query")
+		}
+	}
+	if h.breaker.allow(time.Now()) {
+		t.Fatal("breaker should be open")
+	}
+	start := time.Now()
+	if !runHook(t, h, newQCtx()) {
+		t.Fatal("next node should be executed")
+	}
+	if time.Since(start) > time.Millisecond*5 {
+		t.Fatal("hook should be skipped when breaker is open")
+	}
+
+	b := newBreaker(2, time.Second)
+	now := time.Now()
+	b.report(false, now)
+	b.report(true, now)
+	b.report(false, now)
+	if !b.allow(now) {
+		t.Fatal("failures are not consecutive")
+	}
+	b.report(false, now)
+	if b.allow(now) || !b.allow(now.Add(time.Second)) {
+		t.Fatal("unexpected breaker state")
+	}
+	b.report(false, now.Add(time.Second))
+	if b.allow(now.Add(time.Second)) {
+		t.Fatal("breaker should open again after a failed trial")
+	}
+}
+
+func Test_hook_grpc(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "mosdns.hook.v1.Hook",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Process",
+			Handler: func(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(wrapperspb.BytesValue)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				q := new(dns.Msg)
+				if err := q.Unpack(in.GetValue()); err != nil {
+					return nil, err
+				}
+				r := new(dns.Msg)
+				r.SetRcode(q, dns.RcodeRefused)
+				b, err := r.Pack()
+				if err != nil {
+					return nil, err
+				}
+				return wrapperspb.Bytes(b), nil
+			},
+		}},
+	}, struct{}{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	h := newTestHook(t, &Args{Grpc: l.Addr().String(), Substitute: true, Timeout: 2000})
+	qCtx := newQCtx()
+	if runHook(t, h, qCtx) {
+		t.Fatal("next node should be skipped")
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeRefused || r.Id != qCtx.Q().Id {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// jsonRequest is the json payload.
+type jsonRequest struct {
+	ID         uint16         `json:"id"`
+	ClientIP   string         `json:"client_ip,omitempty"`
+	ClientPort uint16         `json:"client_port,omitempty"`
+	Protocol   string         `json:"protocol,omitempty"`
+	Question   []jsonQuestion `json:"question"`
+
+	// Response is the current response of the query, if any.
+	Response *jsonResponse `json:"response,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+// jsonResponse is the json output of the hook. Records are
+// in the zone file format. If Rcode is empty, NOERROR is used.
+type jsonResponse struct {
+	Rcode  string   `json:"rcode,omitempty"`
+	Answer []string `json:"answer,omitempty"`
+	Ns     []string `json:"ns,omitempty"`
+	Extra  []string `json:"extra,omitempty"`
+}
+
+func encodeJSON(qCtx *query_context.Context) ([]byte, error) {
+	q := qCtx.Q()
+	meta := qCtx.ReqMeta()
+	req := jsonRequest{
+		ID:         q.Id,
+		ClientPort: meta.ClientPort,
+		Protocol:   meta.Protocol,
+	}
+	if meta.ClientAddr.IsValid() {
+		req.ClientIP = meta.ClientAddr.String()
+	}
+	for _, question := range q.Question {
+		req.Question = append(req.Question, jsonQuestion{
+			Name:  question.Name,
+			Type:  dnsutils.QtypeToString(question.Qtype),
+			Class: dnsutils.QclassToString(question.Qclass),
+		})
+	}
+	if r := qCtx.R(); r != nil {
+		req.Response = &jsonResponse{
+			Rcode:  dns.RcodeToString[r.Rcode],
+			Answer: rrStrings(r.Answer),
+			Ns:     rrStrings(r.Ns),
+			Extra:  rrStrings(r.Extra),
+		}
+	}
+	return json.Marshal(req)
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	ss := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		ss = append(ss, rr.String())
+	}
+	return ss
+}
+
+func decodeJSON(q *dns.Msg, out []byte) (*dns.Msg, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	resp := new(jsonResponse)
+	if err := json.Unmarshal(out, resp); err != nil {
+		return nil, fmt.Errorf("invalid hook response, %w", err)
+	}
+
+	rcode := dns.RcodeSuccess
+	if len(resp.Rcode) > 0 {
+		var ok bool
+		rcode, ok = dns.StringToRcode[resp.Rcode]
+		if !ok {
+			return nil, fmt.Errorf("invalid rcode %s", resp.Rcode)
+		}
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	r.RecursionAvailable = true
+
+	var err error
+	if r.Answer, err = parseRRs(resp.Answer); err != nil {
+		return nil, err
+	}
+	if r.Ns, err = parseRRs(resp.Ns); err != nil {
+		return nil, err
+	}
+	if r.Extra, err = parseRRs(resp.Extra); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseRRs(ss []string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %q, %w", s, err)
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
 	"io"
 )
 
@@ -40,12 +41,16 @@ var _ coremain.ExecutablePlugin = (*hostsPlugin)(nil)
 
 type Args struct {
 	Hosts []string `yaml:"hosts"`
+
+	// HTTPS is the HTTPS records that are replied to HTTPS queries. The
+	// format is "domain rdata", e.g. "example.com 1 . alpn=h2,h3".
+	HTTPS []string `yaml:"https"`
 }
 
 type hostsPlugin struct {
 	*coremain.BP
 	h             *hosts.Hosts
-	matcherCloser io.Closer
+	matcherCloser []io.Closer
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -72,11 +77,37 @@ func newHostsContainer(bp *coremain.BP, args *Args) (*hostsPlugin, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &hostsPlugin{
+	p := &hostsPlugin{
 		BP:            bp,
 		h:             hosts.NewHosts(m),
-		matcherCloser: m,
-	}, nil
+		matcherCloser: []io.Closer{m},
+	}
+
+	if len(args.HTTPS) > 0 {
+		staticHTTPS := domain.NewMixMatcher[*dns.HTTPS]()
+		staticHTTPS.SetDefaultMatcher(domain.MatcherFull)
+		hm, err := domain.BatchLoadProvider[*dns.HTTPS](
+			args.HTTPS,
+			staticHTTPS,
+			hosts.ParseHTTPS,
+			bp.M().GetDataManager(),
+			func(b []byte) (domain.Matcher[*dns.HTTPS], error) {
+				mixMatcher := domain.NewMixMatcher[*dns.HTTPS]()
+				mixMatcher.SetDefaultMatcher(domain.MatcherFull)
+				if err := domain.LoadFromTextReader[*dns.HTTPS](mixMatcher, bytes.NewReader(b), hosts.ParseHTTPS); err != nil {
+					return nil, err
+				}
+				return mixMatcher, nil
+			},
+		)
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		p.h.SetHTTPS(hm)
+		p.matcherCloser = append(p.matcherCloser, hm)
+	}
+	return p, nil
 }
 
 func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -90,6 +121,8 @@ func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (h *hostsPlugin) Close() error {
-	_ = h.matcherCloser.Close()
+	for _, c := range h.matcherCloser {
+		_ = c.Close()
+	}
 	return nil
 }
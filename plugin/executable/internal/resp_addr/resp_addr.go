@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package resp_addr implements the args and query matching shared by the
+// plugins that add the addresses of responses to the system, e.g. ipset,
+// nftset and route.
+package resp_addr
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+const defaultMinTimeout = 60
+
+// Args is squashed into the args of the plugins.
+type Args struct {
+	// Domain limits the responses to the queries that match these domain
+	// matcher expressions, e.g. "domain:netflix.com". If empty, the
+	// addresses of all responses are added.
+	Domain []string `yaml:"domain"`
+
+	// MinTimeout is the lower bound of the timeouts in seconds, which are
+	// the ttl of the records. Default is 60.
+	MinTimeout uint32 `yaml:"min_timeout"`
+}
+
+// Helper matches the queries and computes the timeouts of the addresses
+// with Args.
+type Helper struct {
+	minTimeout uint32
+	domain     *domain.MatcherGroup[struct{}] // nil if not set
+}
+
+// NewHelper loads the domain of args with the data providers of bp.
+func NewHelper(bp *coremain.BP, args Args) (*Helper, error) {
+	h := &Helper{minTimeout: args.MinTimeout}
+	if h.minTimeout == 0 {
+		h.minTimeout = defaultMinTimeout
+	}
+	if len(args.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Domain, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain, %w", err)
+		}
+		h.domain = mg
+	}
+	return h, nil
+}
+
+// MatchDomain reports whether the query of qCtx matches the domain.
+func (h *Helper) MatchDomain(qCtx *query_context.Context) bool {
+	if h.domain == nil {
+		return true
+	}
+	q := qCtx.QReadOnly()
+	if len(q.Question) != 1 {
+		return false
+	}
+	_, ok := h.domain.Match(q.Question[0].Name)
+	return ok
+}
+
+// Timeout returns the timeout of the address of rr in seconds.
+func (h *Helper) Timeout(rr dns.RR) uint32 {
+	if ttl := rr.Header().Ttl; ttl > h.minTimeout {
+		return ttl
+	}
+	return h.minTimeout
+}
+
+func (h *Helper) Close() error {
+	if h.domain != nil {
+		return h.domain.Close()
+	}
+	return nil
+}
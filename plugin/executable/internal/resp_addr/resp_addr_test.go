@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package resp_addr
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestArgs_squash(t *testing.T) {
+	var args struct {
+		Args `yaml:",squash"`
+		Mask int `yaml:"mask"`
+	}
+	in := map[string]interface{}{"domain": []string{"domain:example.com"}, "min_timeout": 30, "mask": 24}
+	if err := utils.WeakDecode(in, &args); err != nil {
+		t.Fatal(err)
+	}
+	if len(args.Domain) != 1 || args.MinTimeout != 30 || args.Mask != 24 {
+		t.Fatalf("unexpected args %+v", args)
+	}
+}
+
+func TestHelper(t *testing.T) {
+	h, err := NewHelper(coremain.NewBP("test", "test", nil, nil), Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if !h.MatchDomain(query_context.NewContext(q, nil)) {
+		t.Fatal("all queries should match without domain")
+	}
+	for _, tt := range []struct{ ttl, want uint32 }{{10, defaultMinTimeout}, {300, 300}} {
+		rr := &dns.A{Hdr: dns.RR_Header{Ttl: tt.ttl}}
+		if got := h.Timeout(rr); got != tt.want {
+			t.Fatalf("Timeout() with ttl %d = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+const PluginType = "ip_rewrite"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*ipRewrite)(nil)
+
+type Args struct {
+	// Map rewrites answer addresses. Each rule is "from to". from and to
+	// are both addresses, or both CIDRs of the same family and prefix
+	// length, e.g. "203.0.113.0/24 10.1.0.0/24". A CIDR rule keeps the
+	// host bits of the address. The rule with the longest from prefix
+	// wins.
+	Map []string `yaml:"map"`
+
+	// Replace replaces all A/AAAA answers of matched domains.
+	Replace []ReplaceRule `yaml:"replace"`
+}
+
+type ReplaceRule struct {
+	Domain []string `yaml:"domain"`
+
+	// IP is the addresses that the answers are replaced with. A queries
+	// get the ipv4 ones, AAAA queries get the ipv6 ones. If there is no
+	// address of the family, the A/AAAA answers are removed.
+	IP []string `yaml:"ip"`
+
+	// TTL of the new records. Default is the lowest ttl of the replaced
+	// records.
+	TTL uint32 `yaml:"ttl"`
+}
+
+type mapRule struct {
+	from netip.Prefix
+	to   netip.Prefix
+}
+
+type replaceRule struct {
+	m   domain.Matcher[struct{}]
+	v4  []netip.Addr
+	v6  []netip.Addr
+	ttl uint32
+}
+
+type ipRewrite struct {
+	*coremain.BP
+	mapRules     []mapRule // sorted by prefix length, longest first
+	replaceRules []*replaceRule
+	closer       []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newIPRewrite(bp, args.(*Args))
+}
+
+func newIPRewrite(bp *coremain.BP, args *Args) (*ipRewrite, error) {
+	p := &ipRewrite{BP: bp}
+	for _, s := range args.Map {
+		r, err := parseMapRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid map rule %q, %w", s, err)
+		}
+		p.mapRules = append(p.mapRules, r)
+	}
+	sort.SliceStable(p.mapRules, func(i, j int) bool {
+		return p.mapRules[i].from.Bits() > p.mapRules[j].from.Bits()
+	})
+
+	for i, ra := range args.Replace {
+		r := &replaceRule{ttl: ra.TTL}
+		for _, s := range ra.IP {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("invalid ip of replace rule #%d, %w", i, err)
+			}
+			if addr.Unmap().Is4() {
+				r.v4 = append(r.v4, addr.Unmap())
+			} else {
+				r.v6 = append(r.v6, addr)
+			}
+		}
+		mg, err := domain.BatchLoadDomainProvider(ra.Domain, bp.M().GetDataManager())
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load domain of replace rule #%d, %w", i, err)
+		}
+		r.m = mg
+		p.closer = append(p.closer, mg)
+		p.replaceRules = append(p.replaceRules, r)
+		bp.L().Info("replace rule loaded", zap.Int("rule", i), zap.Int("length", mg.Len()))
+	}
+	return p, nil
+}
+
+func parseMapRule(s string) (mapRule, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return mapRule{}, fmt.Errorf("map rule must have 2 fields, but got %d", len(f))
+	}
+	from, err := parsePrefix(f[0])
+	if err != nil {
+		return mapRule{}, err
+	}
+	to, err := parsePrefix(f[1])
+	if err != nil {
+		return mapRule{}, err
+	}
+	if from.Addr().Is4() != to.Addr().Is4() || from.Bits() != to.Bits() {
+		return mapRule{}, fmt.Errorf("%s and %s are not of the same family and prefix length", from, to)
+	}
+	return mapRule{from: from, to: to}, nil
+}
+
+// parsePrefix parses a CIDR or an address, which is a single address
+// prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if p.Addr().Is4In6() {
+			return netip.Prefix{}, fmt.Errorf("4in6 prefix %s is not supported", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// translate returns the address that addr is mapped to.
+func (p *ipRewrite) translate(addr netip.Addr) (netip.Addr, bool) {
+	for _, r := range p.mapRules {
+		if !r.from.Contains(addr) {
+			continue
+		}
+		a := addr.AsSlice()
+		to := r.to.Addr().AsSlice()
+		bits := r.to.Bits()
+		for i := range a {
+			switch {
+			case bits >= 8:
+				a[i] = to[i]
+				bits -= 8
+			case bits > 0:
+				mask := byte(0xff << (8 - bits))
+				a[i] = to[i]&mask | a[i]&^mask
+				bits = 0
+			}
+		}
+		n, _ := netip.AddrFromSlice(a)
+		return n, true
+	}
+	return netip.Addr{}, false
+}
+
+// Exec rewrites the A/AAAA answers of the response. Responses are left
+// untouched in DNSSEC pass-through mode.
+func (p *ipRewrite) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	p.rewrite(qCtx)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *ipRewrite) rewrite(qCtx *query_context.Context) {
+	r := qCtx.RReadOnly()
+	q := qCtx.QReadOnly()
+	if r == nil || len(q.Question) != 1 || !hasAddrAnswer(r) {
+		return
+	}
+	if qCtx.DNSSECPassthrough() {
+		return
+	}
+
+	if qt := q.Question[0].Qtype; qt == dns.TypeA || qt == dns.TypeAAAA {
+		if rule := p.matchReplaceRule(q.Question[0].Name); rule != nil {
+			p.replace(qCtx.R(), qt, rule)
+			p.L().Debug("answers replaced", qCtx.InfoField())
+			return
+		}
+	}
+	if len(p.mapRules) == 0 {
+		return
+	}
+
+	rewritten := 0
+	for _, rr := range qCtx.R().Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok {
+				continue
+			}
+			if n, ok := p.translate(addr); ok {
+				rr.A = n.AsSlice()
+				rewritten++
+			}
+		case *dns.AAAA:
+			addr, ok := netip.AddrFromSlice(rr.AAAA.To16())
+			if !ok || addr.Is4In6() {
+				continue
+			}
+			if n, ok := p.translate(addr); ok {
+				rr.AAAA = n.AsSlice()
+				rewritten++
+			}
+		}
+	}
+	if rewritten > 0 {
+		p.L().Debug("answers rewritten", qCtx.InfoField(), zap.Int("num", rewritten))
+	}
+}
+
+func (p *ipRewrite) matchReplaceRule(name string) *replaceRule {
+	for _, rr := range p.replaceRules {
+		if _, ok := rr.m.Match(name); ok {
+			return rr
+		}
+	}
+	return nil
+}
+
+// replace removes the A/AAAA answers of r and adds the addresses of rule
+// that match qtype, which is A or AAAA. The new records are owned by the last removed record,
+// which is the end of the CNAME chain.
+func (p *ipRewrite) replace(r *dns.Msg, qtype uint16, rule *replaceRule) {
+	var owner string
+	ttl := rule.ttl
+	minTTL := ^uint32(0)
+	answer := r.Answer[:0]
+	for _, rr := range r.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			owner = rr.Header().Name
+			if rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+		default:
+			answer = append(answer, rr)
+		}
+	}
+	if ttl == 0 {
+		ttl = minTTL
+	}
+
+	hdr := dns.RR_Header{Name: owner, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch qtype {
+	case dns.TypeA:
+		for _, addr := range rule.v4 {
+			answer = append(answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		}
+	case dns.TypeAAAA:
+		for _, addr := range rule.v6 {
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	r.Answer = answer
+}
+
+func hasAddrAnswer(r *dns.Msg) bool {
+	for _, rr := range r.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ipRewrite) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func Test_ipRewrite_translate(t *testing.T) {
+	p := &ipRewrite{}
+	for _, s := range []string{
+		"203.0.113.0/24 10.1.0.0/24",
+		"203.0.113.5 192.168.1.1",
+		"198.51.100.0/22 10.2.4.0/22",
+		"2001:db8::/32 fd00:1::/32",
+	} {
+		r, err := parseMapRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.mapRules = append(p.mapRules, r)
+	}
+	p.mapRules[0], p.mapRules[1] = p.mapRules[1], p.mapRules[0] // longest first
+
+	tests := []struct {
+		in   string
+		want string // empty if not mapped
+	}{
+		{"203.0.113.7", "10.1.0.7"},
+		{"203.0.113.5", "192.168.1.1"},
+		{"198.51.102.9", "10.2.6.9"},
+		{"2001:db8::1", "fd00:1::1"},
+		{"1.1.1.1", ""},
+	}
+	for _, tt := range tests {
+		got, ok := p.translate(netip.MustParseAddr(tt.in))
+		if (tt.want == "" && ok) || (tt.want != "" && got.String() != tt.want) {
+			t.Errorf("translate(%s) = %s, %v, want %s", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func Test_parseMapRule(t *testing.T) {
+	for _, s := range []string{
+		"1.1.1.1",
+		"1.1.1.0/24 10.0.0.0/16",
+		"1.1.1.1 ::1",
+		"1.1.1.1 x",
+	} {
+		if _, err := parseMapRule(s); err == nil {
+			t.Errorf("parseMapRule(%q) should fail", s)
+		}
+	}
+}
+
+func Test_ipRewrite_rewrite(t *testing.T) {
+	mr, err := parseMapRule("203.0.113.0/24 10.1.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := domain.NewDomainMixMatcher()
+	if err := domain.Load[struct{}](m, "cdn.example", nil); err != nil {
+		t.Fatal(err)
+	}
+	p := &ipRewrite{
+		BP:       coremain.NewBP("test", PluginType, nil, nil),
+		mapRules: []mapRule{mr},
+		replaceRules: []*replaceRule{{
+			m:  m,
+			v4: []netip.Addr{netip.MustParseAddr("192.168.1.10")},
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		qName  string
+		qType  uint16
+		dnssec bool
+		answer []string
+		want   []string
+	}{
+		{"map", "example.com.", dns.TypeA, false,
+			[]string{"example.com. 60 IN A 203.0.113.1", "example.com. 60 IN A 1.1.1.1"},
+			[]string{"example.com.\t60\tIN\tA\t10.1.0.1", "example.com.\t60\tIN\tA\t1.1.1.1"}},
+		{"dnssec", "example.com.", dns.TypeA, true,
+			[]string{"example.com. 60 IN A 203.0.113.1"},
+			[]string{"example.com.\t60\tIN\tA\t203.0.113.1"}},
+		{"replace", "www.cdn.example.", dns.TypeA, false,
+			[]string{"www.cdn.example. 300 IN CNAME edge.net.", "edge.net. 30 IN A 1.1.1.1", "edge.net. 20 IN A 1.1.1.2"},
+			[]string{"www.cdn.example.\t300\tIN\tCNAME\tedge.net.", "edge.net.\t20\tIN\tA\t192.168.1.10"}},
+		{"replace no v6", "www.cdn.example.", dns.TypeAAAA, false,
+			[]string{"www.cdn.example. 60 IN AAAA 2001:db8::1"},
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qType)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			for _, s := range tt.answer {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Answer = append(r.Answer, rr)
+			}
+			qCtx := query_context.NewContext(q, nil)
+			qCtx.SetDNSSECPassthrough(tt.dnssec)
+			qCtx.SetResponse(r)
+			p.rewrite(qCtx)
+
+			var got []string
+			for _, rr := range qCtx.R().Answer {
+				got = append(got, rr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
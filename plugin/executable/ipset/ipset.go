@@ -21,6 +21,7 @@ package ipset
 
 import (
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/plugin/executable/internal/resp_addr"
 )
 
 const PluginType = "ipset"
@@ -34,6 +35,13 @@ type Args struct {
 	SetName6 string `yaml:"set_name6"`
 	Mask4    int    `yaml:"mask4"` // default 24
 	Mask6    int    `yaml:"mask6"` // default 32
+
+	resp_addr.Args `yaml:",squash"`
+
+	// TTLTimeout adds entries with the ttl of their records as the
+	// timeout, so entries expire with the dns records. The set must be
+	// created with the timeout option.
+	TTLTimeout bool `yaml:"ttl_timeout"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
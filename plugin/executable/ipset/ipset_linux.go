@@ -27,6 +27,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/plugin/executable/internal/resp_addr"
 	"github.com/miekg/dns"
 	"github.com/nadoo/ipset"
 	"go.uber.org/zap"
@@ -39,6 +40,7 @@ type ipsetPlugin struct {
 	*coremain.BP
 	args *Args
 	nl   *ipset.NetLink
+	h    *resp_addr.Helper
 }
 
 func newIpsetPlugin(bp *coremain.BP, args *Args) (*ipsetPlugin, error) {
@@ -48,22 +50,28 @@ func newIpsetPlugin(bp *coremain.BP, args *Args) (*ipsetPlugin, error) {
 	if args.Mask6 == 0 {
 		args.Mask6 = 32
 	}
-
-	nl, err := ipset.Init()
+	h, err := resp_addr.NewHelper(bp, args.Args)
 	if err != nil {
 		return nil, err
 	}
-
-	return &ipsetPlugin{
+	p := &ipsetPlugin{
 		BP:   bp,
 		args: args,
-		nl:   nl,
-	}, nil
+		h:    h,
+	}
+
+	nl, err := ipset.Init()
+	if err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	p.nl = nl
+	return p, nil
 }
 
 func (p *ipsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	r := qCtx.R()
-	if r != nil {
+	if r != nil && p.h.MatchDomain(qCtx) {
 		er := p.addIPSet(r)
 		if er != nil {
 			p.L().Warn("failed to add response IP to ipset", qCtx.InfoField(), zap.Error(er))
@@ -74,7 +82,19 @@ func (p *ipsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (p *ipsetPlugin) Close() error {
-	return p.nl.Close()
+	_ = p.h.Close()
+	if p.nl != nil {
+		return p.nl.Close()
+	}
+	return nil
+}
+
+// entryOpts returns the options to add the address of rr.
+func (p *ipsetPlugin) entryOpts(rr dns.RR) []ipset.Option {
+	if !p.args.TTLTimeout {
+		return nil
+	}
+	return []ipset.Option{ipset.OptTimeout(p.h.Timeout(rr))}
 }
 
 func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
@@ -88,7 +108,7 @@ func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid A record with ip: %s", rr.A)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4)); err != nil {
+			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4), p.entryOpts(rr)...); err != nil {
 				return err
 			}
 
@@ -100,7 +120,7 @@ func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6)); err != nil {
+			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6), p.entryOpts(rr)...); err != nil {
 				return err
 			}
 		default:
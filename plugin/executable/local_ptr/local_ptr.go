@@ -0,0 +1,452 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package local_ptr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const PluginType = "local_ptr"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*localPTR)(nil)
+
+// defaultZones are the reverse zones of private and special-use ranges
+// that must not be forwarded to the internet (RFC 6303, RFC 7793).
+var defaultZones = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fd00::/8",
+	"fe80::/10",
+	"2001:db8::/32",
+}
+
+const defaultTTL = 60
+
+// Args configures the reverse zones that are answered locally. Names in
+// these zones are answered from the hosts and the dhcp leases. Names
+// that cannot be resolved are answered with NXDOMAIN instead of being
+// forwarded. Queries outside these zones are passed to the rest of the
+// sequence.
+type Args struct {
+	// Prefixes are the local prefixes, e.g. a delegated ipv6 prefix
+	// "2001:db8:1::/48", in addition to the default private zones.
+	Prefixes []string `yaml:"prefixes"`
+
+	// NoDefaultZones disables the default private and special-use zones
+	// of RFC 6303 and RFC 7793.
+	NoDefaultZones bool `yaml:"no_default_zones"`
+
+	// Hosts are hosts lines "domain ip ip ...", or "provider:tag" to use
+	// a data provider of the same format.
+	Hosts []string `yaml:"hosts"`
+
+	// Leases is the dnsmasq lease file, or "provider:tag" to use a data
+	// provider.
+	Leases string `yaml:"leases"`
+
+	// Domain is the domain suffix of the lease hostnames, e.g. "lan".
+	Domain string `yaml:"domain"`
+
+	// TTL is the ttl of the ptr records. Default is 60.
+	TTL uint32 `yaml:"ttl"`
+}
+
+type localPTR struct {
+	*coremain.BP
+	zones  []netip.Prefix // aligned to label boundaries
+	tables []*ptrTable
+	leases *neighbor.Leases // maybe nil
+	domain string           // fqdn suffix of lease hostnames, maybe empty
+	ttl    uint32
+	closer []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newLocalPTR(bp, args.(*Args))
+}
+
+func newLocalPTR(bp *coremain.BP, args *Args) (*localPTR, error) {
+	p := &localPTR{BP: bp, ttl: args.TTL}
+	if p.ttl == 0 {
+		p.ttl = defaultTTL
+	}
+	if len(args.Domain) > 0 {
+		p.domain = dns.Fqdn(strings.ToLower(strings.Trim(args.Domain, ".")))
+	}
+
+	zones := append([]string(nil), args.Prefixes...)
+	if !args.NoDefaultZones {
+		zones = append(zones, defaultZones...)
+	}
+	for _, s := range zones {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %s, %w", s, err)
+		}
+		p.zones = append(p.zones, alignPrefix(prefix.Masked())...)
+	}
+
+	var static []string
+	for _, s := range args.Hosts {
+		if !strings.HasPrefix(s, "provider:") {
+			static = append(static, s)
+			continue
+		}
+		providerName := strings.TrimPrefix(s, "provider:")
+		provider := bp.M().GetDataManager().GetDataProvider(providerName)
+		if provider == nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("cannot find provider %s", providerName)
+		}
+		t := new(ptrTable)
+		if err := provider.LoadAndAddListener(t); err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load hosts from provider %s, %w", providerName, err)
+		}
+		p.tables = append(p.tables, t)
+		p.closer = append(p.closer, closerFunc(func() { provider.DeleteListener(t) }))
+	}
+	if len(static) > 0 {
+		t := new(ptrTable)
+		if err := t.Update([]byte(strings.Join(static, "\n"))); err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load hosts, %w", err)
+		}
+		p.tables = append(p.tables, t)
+	}
+
+	if len(args.Leases) > 0 {
+		leases, err := neighbor.LoadLeases(args.Leases, bp.M().GetDataManager())
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load leases, %w", err)
+		}
+		p.leases = leases
+		p.closer = append(p.closer, leases)
+	}
+	return p, nil
+}
+
+func (p *localPTR) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r := p.lookup(qCtx.QReadOnly())
+	if r == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// lookup returns the response of q. It returns nil if q is not in the
+// local zones.
+func (p *localPTR) lookup(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	prefix, below, ok := parseReverseName(strings.ToLower(question.Name))
+	if !ok {
+		return nil
+	}
+	zone, ok := p.zoneOf(prefix)
+	if !ok {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	switch {
+	case below:
+		r.Rcode = dns.RcodeNameError
+	case prefix.IsSingleIP():
+		name, ok := p.ptrName(prefix.Addr())
+		if !ok {
+			r.Rcode = dns.RcodeNameError
+		} else if question.Qtype == dns.TypePTR {
+			r.Answer = []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    p.ttl,
+				},
+				Ptr: name,
+			}}
+			return r
+		}
+	case prefix.Bits() == zone.Bits() || p.hasNameIn(prefix):
+		// Zone apex or an empty non-terminal, NODATA.
+	default:
+		r.Rcode = dns.RcodeNameError
+	}
+	r.Ns = []dns.RR{dnsutils.FakeSOA(reverseName(zone))}
+	return r
+}
+
+// zoneOf returns the local zone that contains prefix.
+func (p *localPTR) zoneOf(prefix netip.Prefix) (netip.Prefix, bool) {
+	for _, zone := range p.zones {
+		if zone.Bits() <= prefix.Bits() && zone.Contains(prefix.Addr()) {
+			return zone, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// ptrName returns the name of addr from the hosts and the leases.
+func (p *localPTR) ptrName(addr netip.Addr) (string, bool) {
+	for _, t := range p.tables {
+		if name, ok := t.lookup(addr); ok {
+			return name, true
+		}
+	}
+	if p.leases != nil {
+		if lease := p.leases.Lookup(addr); lease != nil && len(lease.Hostname) > 0 {
+			if len(p.domain) > 0 {
+				return lease.Hostname + "." + p.domain, true
+			}
+			return dns.Fqdn(lease.Hostname), true
+		}
+	}
+	return "", false
+}
+
+// hasNameIn reports whether any address in prefix has a name.
+func (p *localPTR) hasNameIn(prefix netip.Prefix) bool {
+	for _, t := range p.tables {
+		if t.hasAddrIn(prefix) {
+			return true
+		}
+	}
+	found := false
+	if p.leases != nil {
+		p.leases.Range(func(addr netip.Addr, lease *neighbor.Lease) bool {
+			found = len(lease.Hostname) > 0 && prefix.Contains(addr)
+			return !found
+		})
+	}
+	return found
+}
+
+func (p *localPTR) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// ptrTable maps addresses to names. It implements data_provider.DataListener.
+// It is safe for concurrent use.
+type ptrTable struct {
+	mu sync.RWMutex
+	m  map[netip.Addr]string
+}
+
+// Update replaces the table with hosts lines b. If an address has
+// multiple names, the first one is used.
+func (t *ptrTable) Update(b []byte) error {
+	m := make(map[netip.Addr]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		text := utils.RemoveComment(s.Text(), "#")
+		if len(strings.TrimSpace(text)) == 0 {
+			continue
+		}
+		pattern, ips, err := hosts.ParseIPs(text)
+		if err != nil {
+			return fmt.Errorf("invalid hosts at line %d, %w", line, err)
+		}
+		if i := strings.IndexByte(pattern, ':'); i >= 0 {
+			if pattern[:i] != "full" {
+				continue // not a single name
+			}
+			pattern = pattern[i+1:]
+		}
+		name := dns.Fqdn(strings.ToLower(pattern))
+		for _, addr := range append(ips.IPv4, ips.IPv6...) {
+			if _, dup := m[addr.Unmap()]; !dup {
+				m[addr.Unmap()] = name
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.m = m
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *ptrTable) lookup(addr netip.Addr) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	name, ok := t.m[addr]
+	return name, ok
+}
+
+func (t *ptrTable) hasAddrIn(prefix netip.Prefix) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for addr := range t.m {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelBits returns the number of address bits of a reverse name label.
+func labelBits(addr netip.Addr) int {
+	if addr.Is4() {
+		return 8
+	}
+	return 4
+}
+
+// alignPrefix splits prefix into prefixes whose lengths are multiples of
+// labelBits, e.g. 172.16.0.0/12 into 172.16.0.0/16 ... 172.31.0.0/16.
+func alignPrefix(prefix netip.Prefix) []netip.Prefix {
+	step := labelBits(prefix.Addr())
+	aligned := (prefix.Bits() + step - 1) / step * step
+	if aligned == prefix.Bits() {
+		return []netip.Prefix{prefix}
+	}
+	n := 1 << (aligned - prefix.Bits())
+	ps := make([]netip.Prefix, 0, n)
+	b := prefix.Addr().AsSlice()
+	for i := 0; i < n; i++ {
+		// The added bits are within the last label, which never crosses a byte.
+		shift := (8 - aligned%8) % 8
+		c := make([]byte, len(b))
+		copy(c, b)
+		c[(aligned-1)/8] |= byte(i << shift)
+		addr, _ := netip.AddrFromSlice(c)
+		ps = append(ps, netip.PrefixFrom(addr, aligned))
+	}
+	return ps
+}
+
+// parseReverseName parses the lower case reverse name of an address or a
+// prefix, e.g. "1.168.192.in-addr.arpa." to 192.168.1.0/24. Labels that
+// are not part of an address make below true, e.g.
+// "_dns-sd._udp.1.168.192.in-addr.arpa." is below 192.168.1.0/24.
+func parseReverseName(name string) (prefix netip.Prefix, below bool, ok bool) {
+	var s string
+	var is4 bool
+	switch {
+	case name == utils.IP4arpa[1:]:
+		is4 = true
+	case name == utils.IP6arpa[1:]:
+	case strings.HasSuffix(name, utils.IP4arpa):
+		s, is4 = strings.TrimSuffix(name, utils.IP4arpa), true
+	case strings.HasSuffix(name, utils.IP6arpa):
+		s = strings.TrimSuffix(name, utils.IP6arpa)
+	default:
+		return netip.Prefix{}, false, false
+	}
+
+	var labels []string
+	if len(s) > 0 {
+		labels = strings.Split(s, ".")
+	}
+	var b [16]byte
+	n := 0
+	for i := len(labels) - 1; i >= 0; i-- {
+		l := labels[i]
+		if is4 {
+			v, err := strconv.ParseUint(l, 10, 8)
+			if n == 4 || err != nil || (len(l) > 1 && l[0] == '0') {
+				below = true
+				break
+			}
+			b[n] = byte(v)
+		} else {
+			v, err := strconv.ParseUint(l, 16, 4)
+			if n == 32 || err != nil || len(l) != 1 {
+				below = true
+				break
+			}
+			b[n/2] |= byte(v) << (4 * (1 - n%2))
+		}
+		n++
+	}
+	if is4 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte{b[0], b[1], b[2], b[3]}), n*8), below, true
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(b), n*4), below, true
+}
+
+// reverseName returns the reverse name of an aligned prefix.
+func reverseName(prefix netip.Prefix) string {
+	sb := new(strings.Builder)
+	b := prefix.Addr().AsSlice()
+	if prefix.Addr().Is4() {
+		for i := prefix.Bits()/8 - 1; i >= 0; i-- {
+			sb.WriteString(strconv.Itoa(int(b[i])))
+			sb.WriteByte('.')
+		}
+		sb.WriteString(utils.IP4arpa[1:])
+		return sb.String()
+	}
+	for i := prefix.Bits()/4 - 1; i >= 0; i-- {
+		sb.WriteString(strconv.FormatUint(uint64(b[i/2]>>(4*(1-i%2))&0xf), 16))
+		sb.WriteByte('.')
+	}
+	sb.WriteString(utils.IP6arpa[1:])
+	return sb.String()
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package local_ptr
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+type nextExec struct {
+	called bool
+}
+
+func (e *nextExec) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	e.called = true
+	return nil
+}
+
+func Test_localPTR(t *testing.T) {
+	p, err := newLocalPTR(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		Prefixes: []string{"2001:db8:1::/48"},
+		Hosts:    []string{"nas.lan 192.168.1.10 2001:db8:1::10", "domain:ads.lan 192.168.1.11"},
+		Domain:   "lan",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.leases = new(neighbor.Leases)
+	err = p.leases.Update([]byte("1700000000 00:11:22:33:44:55 192.168.1.20 laptop 01:00:11:22:33:44:55\n" +
+		"1700000000 00:11:22:33:44:66 192.168.1.21 * *\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		qName     string
+		qType     uint16
+		wantNext  bool
+		wantRcode int
+		wantPTR   string
+		wantSOA   string
+	}{
+		{"hosts v4", "10.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "nas.lan.", ""},
+		{"hosts v6", "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "nas.lan.", ""},
+		{"lease", "20.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "laptop.lan.", ""},
+		{"mixed case", "20.1.168.192.IN-ADDR.ARPA.", dns.TypePTR, false, dns.RcodeSuccess, "laptop.lan.", ""},
+		{"other type", "10.1.168.192.in-addr.arpa.", dns.TypeA, false, dns.RcodeSuccess, "", "168.192.in-addr.arpa."},
+		{"lease without hostname", "21.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "168.192.in-addr.arpa."},
+		{"pattern is not a name", "11.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "168.192.in-addr.arpa."},
+		{"unknown private", "1.0.0.10.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "10.in-addr.arpa."},
+		{"unaligned zone", "1.0.20.172.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "20.172.in-addr.arpa."},
+		{"zone apex", "168.192.in-addr.arpa.", dns.TypeSOA, false, dns.RcodeSuccess, "", "168.192.in-addr.arpa."},
+		{"empty non-terminal", "1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "", "168.192.in-addr.arpa."},
+		{"empty branch", "2.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "168.192.in-addr.arpa."},
+		{"below an address", "b._dns-sd._udp.0.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "168.192.in-addr.arpa."},
+		{"local prefix", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"link local", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "8.e.f.ip6.arpa."},
+		{"public", "8.8.8.8.in-addr.arpa.", dns.TypePTR, true, 0, "", ""},
+		{"above zones", "172.in-addr.arpa.", dns.TypePTR, true, 0, "", ""},
+		{"not reverse", "example.com.", dns.TypeA, true, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qType)
+			qCtx := query_context.NewContext(q, nil)
+			next := new(nextExec)
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+			if next.called != tt.wantNext {
+				t.Fatalf("next called = %v, want %v", next.called, tt.wantNext)
+			}
+			if tt.wantNext {
+				return
+			}
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %d, want %d", r.Rcode, tt.wantRcode)
+			}
+			if len(tt.wantPTR) > 0 {
+				if len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != tt.wantPTR {
+					t.Fatalf("unexpected answer %v", r.Answer)
+				}
+				return
+			}
+			if len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Name != tt.wantSOA {
+				t.Fatalf("unexpected response %v", r)
+			}
+		})
+	}
+}
+
+func Test_alignPrefix(t *testing.T) {
+	ps := alignPrefix(netip.MustParsePrefix("fe80::/10"))
+	want := []string{"fe80::/12", "fe90::/12", "fea0::/12", "feb0::/12"}
+	if len(ps) != len(want) {
+		t.Fatalf("got %v", ps)
+	}
+	for i := range want {
+		if ps[i].String() != want[i] {
+			t.Fatalf("got %v", ps)
+		}
+	}
+	if got := len(alignPrefix(netip.MustParsePrefix("100.64.0.0/10"))); got != 64 {
+		t.Fatalf("got %d prefixes", got)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package luaplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"os"
+	"strings"
+)
+
+const PluginType = "lua"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*luaPlugin)(nil)
+
+const (
+	execFuncName = "exec" // called before the next node
+	postFuncName = "post" // called after the next node, optional
+
+	maxIdleStates = 64
+)
+
+type Args struct {
+	// Script is the lua script. Either Script or File is required.
+	Script string `yaml:"script"`
+	// File is the path of the lua script file.
+	File string `yaml:"file"`
+}
+
+// luaPlugin runs a lua script. The script must define a global function
+// "exec(qctx)", which is called before the next node. If it returns false,
+// the next node will be skipped. An optional function "post(qctx)" is
+// called after the next node, e.g. to rewrite the response.
+// See qctxMethods for the methods of qctx.
+type luaPlugin struct {
+	*coremain.BP
+
+	proto    *lua.FunctionProto
+	hasPost  bool
+	execs    map[string]executable_seq.Executable
+	matchers map[string]executable_seq.Matcher
+
+	idleStates chan *lua.LState
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newLuaPlugin(bp, args.(*Args), bp.M().GetExecutables(), bp.M().GetMatchers())
+}
+
+func newLuaPlugin(
+	bp *coremain.BP,
+	args *Args,
+	execs map[string]executable_seq.Executable,
+	matchers map[string]executable_seq.Matcher,
+) (*luaPlugin, error) {
+	script, name := args.Script, "script"
+	if len(args.File) > 0 {
+		if len(script) > 0 {
+			return nil, errors.New("script and file cannot be both set")
+		}
+		b, err := os.ReadFile(args.File)
+		if err != nil {
+			return nil, err
+		}
+		script, name = string(b), args.File
+	}
+	if len(script) == 0 {
+		return nil, errors.New("missing script")
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(script), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse script, %w", err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile script, %w", err)
+	}
+
+	p := &luaPlugin{
+		BP:         bp,
+		proto:      proto,
+		execs:      execs,
+		matchers:   matchers,
+		idleStates: make(chan *lua.LState, maxIdleStates),
+	}
+
+	// Check the script by loading it once.
+	L, err := p.newState()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := L.GetGlobal(execFuncName).(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("script does not define function %s", execFuncName)
+	}
+	_, p.hasPost = L.GetGlobal(postFuncName).(*lua.LFunction)
+	p.putState(L)
+	return p, nil
+}
+
+// newState creates a sandboxed lua state and runs the script in it.
+func (p *luaPlugin) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		f    lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.f), NRet: 0, Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+	// No file access.
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	mt := L.NewTypeMetatable(qctxTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), p.qctxMethods()))
+
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run script, %w", err)
+	}
+	return L, nil
+}
+
+func (p *luaPlugin) getState() (*lua.LState, error) {
+	select {
+	case L := <-p.idleStates:
+		return L, nil
+	default:
+		return p.newState()
+	}
+}
+
+func (p *luaPlugin) putState(L *lua.LState) {
+	select {
+	case p.idleStates <- L:
+	default:
+		L.Close()
+	}
+}
+
+func (p *luaPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	goNext, err := p.call(ctx, qCtx, execFuncName)
+	if err != nil {
+		return err
+	}
+	if !goNext {
+		return nil
+	}
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	if p.hasPost {
+		_, err = p.call(ctx, qCtx, postFuncName)
+	}
+	return err
+}
+
+// call calls the global function fn with qctx. It returns false
+// if the function returns false.
+func (p *luaPlugin) call(ctx context.Context, qCtx *query_context.Context, fn string) (bool, error) {
+	L, err := p.getState()
+	if err != nil {
+		return false, err
+	}
+
+	ud := L.NewUserData()
+	ud.Value = &callState{ctx: ctx, qCtx: qCtx}
+	L.SetMetatable(ud, L.GetTypeMetatable(qctxTypeName))
+
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: L.GetGlobal(fn), NRet: 1, Protect: true}, ud)
+	L.RemoveContext()
+	if err != nil {
+		// The state may be in an inconsistent state after an error.
+		L.Close()
+		return false, fmt.Errorf("lua %s: %w", fn, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	ud.Value = nil
+	p.putState(L)
+	return ret != lua.LFalse, nil
+}
+
+func (p *luaPlugin) Close() error {
+	for {
+		select {
+		case L := <-p.idleStates:
+			L.Close()
+		default:
+			return nil
+		}
+	}
+}
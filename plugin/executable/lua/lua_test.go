@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package luaplugin
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func newTestPlugin(t *testing.T, script string, execs map[string]executable_seq.Executable, matchers map[string]executable_seq.Matcher) *luaPlugin {
+	t.Helper()
+	p, err := newLuaPlugin(coremain.NewBP("test", PluginType, nil, nil), &Args{Script: script}, execs, matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+func newQCtx(name string, qtype uint16) *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	return query_context.NewContext(q, &query_context.RequestMeta{Protocol: query_context.ProtocolUDP})
+}
+
+type execFunc func()
+
+func (f execFunc) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	f()
+	return nil
+}
+
+func Test_luaPlugin_respond(t *testing.T) {
+	script := `
+function exec(qctx)
+	if qctx:qname() == "blocked.example." then
+		qctx:respond("NXDOMAIN")
+		return false
+	end
+	if qctx:qtype() == "A" and qctx:protocol() == "udp" then
+		qctx:set("route", "local")
+		qctx:respond(0, {qctx:qname() .. " 300 IN A 127.0.0.1"})
+		return false
+	end
+	return true
+end
+`
+	p := newTestPlugin(t, script, nil, nil)
+	ctx := context.Background()
+
+	qCtx := newQCtx("blocked.example.", dns.TypeA)
+	next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: new(dns.Msg)})
+	if err := p.Exec(ctx, qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("want NXDOMAIN, got %v", r)
+	}
+
+	qCtx = newQCtx("a.example.", dns.TypeA)
+	if err := p.Exec(ctx, qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if v, _ := qCtx.GetValue("route"); v != "local" {
+		t.Fatalf("want metadata route=local, got %q", v)
+	}
+
+	qCtx = newQCtx("a.example.", dns.TypeAAAA)
+	if err := p.Exec(ctx, qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() == nil || len(qCtx.R().Answer) != 0 {
+		t.Fatal("next node should be executed")
+	}
+}
+
+func Test_luaPlugin_post_and_tags(t *testing.T) {
+	script := `
+function exec(qctx)
+	if qctx:match("m") then
+		qctx:exec("e")
+	end
+	return true
+end
+
+function post(qctx)
+	local answers = qctx:answers()
+	table.insert(answers, "post.example. 60 IN TXT \"hello\"")
+	qctx:set_answers(answers)
+end
+`
+	ran := false
+	execs := map[string]executable_seq.Executable{
+		"e": execFunc(func() { ran = true }),
+	}
+	matchers := map[string]executable_seq.Matcher{"m": &executable_seq.DummyMatcher{Matched: true}}
+	p := newTestPlugin(t, script, execs, matchers)
+
+	qCtx := newQCtx("a.example.", dns.TypeA)
+	next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: new(dns.Msg)})
+	if err := p.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Fatal("executable e was not executed")
+	}
+	if r := qCtx.R(); r == nil || len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeTXT {
+		t.Fatalf("post was not applied, %v", r)
+	}
+}
+
+func Test_newLuaPlugin_err(t *testing.T) {
+	bp := coremain.NewBP("test", PluginType, nil, nil)
+	for name, script := range map[string]string{
+		"syntax error": "function exec(qctx",
+		"missing exec": "function post(qctx) end",
+		"no file io":   "dofile('/etc/passwd')",
+	} {
+		if _, err := newLuaPlugin(bp, &Args{Script: script}, nil, nil); err == nil {
+			t.Errorf("%s: want err", name)
+		}
+	}
+
+	p := newTestPlugin(t, `function exec(qctx) qctx:exec("missing") end`, nil, nil)
+	if err := p.Exec(context.Background(), newQCtx("a.example.", dns.TypeA), nil); err == nil {
+		t.Fatal("want err")
+	}
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package luaplugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/yuin/gopher-lua"
+)
+
+const qctxTypeName = "qctx"
+
+// callState is the value of the qctx userdata.
+type callState struct {
+	ctx  context.Context
+	qCtx *query_context.Context
+}
+
+// qctxMethods returns the methods of the qctx object that is passed
+// to the script functions.
+func (p *luaPlugin) qctxMethods() map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		// Query.
+		"qname":     withState(luaQName),
+		"qtype":     withState(luaQType),
+		"qclass":    withState(luaQClass),
+		"set_qname": withState(luaSetQName),
+
+		// Client info.
+		"client_ip":   withState(luaClientIP),
+		"client_port": withState(luaClientPort),
+		"protocol":    withState(luaProtocol),
+
+		// Metadata.
+		"get":    withState(luaGet),
+		"set":    withState(luaSet),
+		"delete": withState(luaDelete),
+
+		// Response.
+		"has_response":  withState(luaHasResponse),
+		"rcode":         withState(luaRcode),
+		"set_rcode":     withState(luaSetRcode),
+		"answers":       withState(luaAnswers),
+		"set_answers":   withState(luaSetAnswers),
+		"respond":       withState(luaRespond),
+		"drop_response": withState(luaDropResponse),
+
+		// Other plugins.
+		"exec":  withState(p.luaExec),
+		"match": withState(p.luaMatch),
+
+		"log": withState(p.luaLog),
+	}
+}
+
+type stateFunc func(L *lua.LState, s *callState) int
+
+func withState(f stateFunc) lua.LGFunction {
+	return func(L *lua.LState) int {
+		ud := L.CheckUserData(1)
+		s, ok := ud.Value.(*callState)
+		if !ok {
+			L.ArgError(1, "qctx expected")
+			return 0
+		}
+		return f(L, s)
+	}
+}
+
+func question(L *lua.LState, s *callState) *dns.Question {
+	q := s.qCtx.Q()
+	if len(q.Question) == 0 {
+		L.RaiseError("query has no question")
+		return nil
+	}
+	return &q.Question[0]
+}
+
+func luaQName(L *lua.LState, s *callState) int {
+	L.Push(lua.LString(question(L, s).Name))
+	return 1
+}
+
+func luaQType(L *lua.LState, s *callState) int {
+	L.Push(lua.LString(dnsutils.QtypeToString(question(L, s).Qtype)))
+	return 1
+}
+
+func luaQClass(L *lua.LState, s *callState) int {
+	L.Push(lua.LString(dnsutils.QclassToString(question(L, s).Qclass)))
+	return 1
+}
+
+func luaSetQName(L *lua.LState, s *callState) int {
+	name := L.CheckString(2)
+	if _, ok := dns.IsDomainName(name); !ok {
+		L.ArgError(2, "invalid domain name")
+		return 0
+	}
+	question(L, s).Name = dns.Fqdn(name)
+	return 0
+}
+
+func luaClientIP(L *lua.LState, s *callState) int {
+	addr := s.qCtx.ReqMeta().ClientAddr
+	if !addr.IsValid() {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(addr.String()))
+	return 1
+}
+
+func luaClientPort(L *lua.LState, s *callState) int {
+	L.Push(lua.LNumber(s.qCtx.ReqMeta().ClientPort))
+	return 1
+}
+
+func luaProtocol(L *lua.LState, s *callState) int {
+	L.Push(lua.LString(s.qCtx.ReqMeta().Protocol))
+	return 1
+}
+
+func luaGet(L *lua.LState, s *callState) int {
+	v, ok := s.qCtx.GetValue(L.CheckString(2))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(v))
+	return 1
+}
+
+func luaSet(L *lua.LState, s *callState) int {
+	s.qCtx.SetValue(L.CheckString(2), L.CheckString(3))
+	return 0
+}
+
+func luaDelete(L *lua.LState, s *callState) int {
+	s.qCtx.DeleteValue(L.CheckString(2))
+	return 0
+}
+
+func luaHasResponse(L *lua.LState, s *callState) int {
+	L.Push(lua.LBool(s.qCtx.R() != nil))
+	return 1
+}
+
+func luaRcode(L *lua.LState, s *callState) int {
+	r := s.qCtx.R()
+	if r == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(dns.RcodeToString[r.Rcode]))
+	return 1
+}
+
+func checkRcode(L *lua.LState, n int) int {
+	v := L.CheckAny(n)
+	switch v := v.(type) {
+	case lua.LNumber:
+		return int(v)
+	case lua.LString:
+		if rcode, ok := dns.StringToRcode[string(v)]; ok {
+			return rcode
+		}
+	}
+	L.ArgError(n, "invalid rcode")
+	return 0
+}
+
+func luaSetRcode(L *lua.LState, s *callState) int {
+	rcode := checkRcode(L, 2)
+	r := s.qCtx.R()
+	if r == nil {
+		L.RaiseError("no response")
+		return 0
+	}
+	r.Rcode = rcode
+	return 0
+}
+
+func luaAnswers(L *lua.LState, s *callState) int {
+	t := L.NewTable()
+	if r := s.qCtx.R(); r != nil {
+		for _, rr := range r.Answer {
+			t.Append(lua.LString(rr.String()))
+		}
+	}
+	L.Push(t)
+	return 1
+}
+
+// checkRRs parses the table at n as a list of records.
+func checkRRs(L *lua.LState, n int) []dns.RR {
+	t := L.OptTable(n, nil)
+	if t == nil {
+		return nil
+	}
+	var rrs []dns.RR
+	var parseErr error
+	t.ForEach(func(_ lua.LValue, v lua.LValue) {
+		if parseErr != nil {
+			return
+		}
+		rr, err := dns.NewRR(v.String())
+		if err != nil {
+			parseErr = fmt.Errorf("invalid record %q, %w", v.String(), err)
+			return
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	})
+	if parseErr != nil {
+		L.ArgError(n, parseErr.Error())
+		return nil
+	}
+	return rrs
+}
+
+func luaSetAnswers(L *lua.LState, s *callState) int {
+	rrs := checkRRs(L, 2)
+	r := s.qCtx.R()
+	if r == nil {
+		L.RaiseError("no response")
+		return 0
+	}
+	r.Answer = rrs
+	return 0
+}
+
+func luaRespond(L *lua.LState, s *callState) int {
+	rcode := checkRcode(L, 2)
+	rrs := checkRRs(L, 3)
+	r := new(dns.Msg)
+	r.SetRcode(s.qCtx.Q(), rcode)
+	r.RecursionAvailable = true
+	r.Answer = rrs
+	s.qCtx.SetResponse(r)
+	return 0
+}
+
+func luaDropResponse(_ *lua.LState, s *callState) int {
+	s.qCtx.SetResponse(nil)
+	return 0
+}
+
+func (p *luaPlugin) luaExec(L *lua.LState, s *callState) int {
+	tag := L.CheckString(2)
+	e := p.execs[tag]
+	if e == nil {
+		L.ArgError(2, fmt.Sprintf("can not find executable %s", tag))
+		return 0
+	}
+	if err := e.Exec(s.ctx, s.qCtx, nil); err != nil {
+		L.RaiseError("exec %s: %s", tag, err)
+	}
+	return 0
+}
+
+func (p *luaPlugin) luaMatch(L *lua.LState, s *callState) int {
+	tag := L.CheckString(2)
+	m := p.matchers[tag]
+	if m == nil {
+		L.ArgError(2, fmt.Sprintf("can not find matcher %s", tag))
+		return 0
+	}
+	ok, err := m.Match(s.ctx, s.qCtx)
+	if err != nil {
+		L.RaiseError("match %s: %s", tag, err)
+		return 0
+	}
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+func (p *luaPlugin) luaLog(L *lua.LState, s *callState) int {
+	p.L().Info(L.CheckString(2), s.qCtx.InfoField())
+	return 0
+}
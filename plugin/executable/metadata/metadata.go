@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metadata
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"strings"
+)
+
+const PluginType = "metadata"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*metadataPlugin)(nil)
+var _ coremain.MatcherPlugin = (*metadataPlugin)(nil)
+
+type Args struct {
+	// Set sets key-value pairs to the query context when this plugin
+	// is executed.
+	Set map[string]string `yaml:"set"`
+	// Delete deletes keys from the query context when this plugin
+	// is executed.
+	Delete []string `yaml:"delete"`
+
+	// Match contains "key=value" or "key" conditions. This plugin matches
+	// the query context when all conditions are met. A "key" condition
+	// is met if the key exists.
+	Match []string `yaml:"match"`
+}
+
+type condition struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+type metadataPlugin struct {
+	*coremain.BP
+	args *Args
+
+	conditions []condition
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newMetadataPlugin(bp, args.(*Args))
+}
+
+func newMetadataPlugin(bp *coremain.BP, args *Args) (*metadataPlugin, error) {
+	p := &metadataPlugin{BP: bp, args: args}
+	for k := range args.Set {
+		if len(k) == 0 {
+			return nil, errors.New("empty key in set")
+		}
+	}
+	for _, s := range args.Match {
+		var c condition
+		c.key, c.value, c.hasValue = utils.SplitString2(s, "=")
+		if !c.hasValue {
+			c.key = s
+		}
+		c.key = strings.TrimSpace(c.key)
+		if len(c.key) == 0 {
+			return nil, errors.New("empty key in match")
+		}
+		p.conditions = append(p.conditions, c)
+	}
+	return p, nil
+}
+
+// Exec implements handler.Executable.
+func (p *metadataPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	for _, k := range p.args.Delete {
+		qCtx.DeleteValue(k)
+	}
+	for k, v := range p.args.Set {
+		qCtx.SetValue(k, v)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *metadataPlugin) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	if len(p.conditions) == 0 {
+		return false, nil
+	}
+	for _, c := range p.conditions {
+		v, ok := qCtx.GetValue(c.key)
+		if !ok || c.hasValue && v != c.value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
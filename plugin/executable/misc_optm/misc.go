@@ -77,8 +77,10 @@ func (t *optm) Exec(ctx context.Context, qCtx *query_context.Context, next execu
 	}
 
 	// Trim and shuffle answers for A and AAAA.
-	switch qt := q.Question[0].Qtype; qt {
-	case dns.TypeA, dns.TypeAAAA:
+	// Signed answers must be kept untouched in DNSSEC pass-through mode.
+	switch qt := q.Question[0].Qtype; {
+	case qCtx.DNSSECPassthrough():
+	case qt == dns.TypeA, qt == dns.TypeAAAA:
 		rr := r.Answer[:0]
 		for _, ar := range r.Answer {
 			if ar.Header().Rrtype == qt {
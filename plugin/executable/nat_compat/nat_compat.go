@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nat_compat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const PluginType = "nat_compat"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*natCompat)(nil)
+
+const defaultTTL = 5
+
+// Args configures local answers for lookups that consoles and UPnP/NAT-PMP
+// clients use to find the gateway or detect the NAT type. Their public
+// answers are often filtered or unreachable, which leads to "strict NAT".
+type Args struct {
+	Rules []RuleArgs `yaml:"rules"`
+
+	// TTL is short by default, so clients will notice address changes
+	// quickly. Default is 5.
+	TTL uint32 `yaml:"ttl"`
+}
+
+// RuleArgs answers queries of Domain with Answer.
+type RuleArgs struct {
+	// Domain is the domain matcher expressions, e.g. "full:upnp.lan",
+	// "provider:console_domains".
+	Domain []string `yaml:"domain"`
+
+	// Answer is a list of templates. A template can be
+	//  - an ip address, e.g. "192.168.1.1",
+	//  - "{iface:<name>}", all global unicast and private addresses of
+	//    the interface, e.g. "{iface:br-lan}". Addresses are resolved for
+	//    each query, so they are always up to date,
+	//  - "{client}", the address of the client.
+	Answer []string `yaml:"answer"`
+}
+
+type template struct {
+	addr   netip.Addr // valid if the template is an ip
+	iface  string
+	client bool
+}
+
+type rule struct {
+	domain  domain.Matcher[struct{}]
+	answers []template
+}
+
+type natCompat struct {
+	*coremain.BP
+	ttl    uint32
+	rules  []*rule
+	closer []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newNATCompat(bp, args.(*Args))
+}
+
+func newNATCompat(bp *coremain.BP, args *Args) (*natCompat, error) {
+	if len(args.Rules) == 0 {
+		return nil, errors.New("no rule is configured")
+	}
+	p := &natCompat{BP: bp, ttl: args.TTL}
+	if p.ttl == 0 {
+		p.ttl = defaultTTL
+	}
+	for i, ra := range args.Rules {
+		r, err := p.parseRule(&ra)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("invalid rule #%d, %w", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (p *natCompat) parseRule(ra *RuleArgs) (*rule, error) {
+	if len(ra.Domain) == 0 {
+		return nil, errors.New("missing domain")
+	}
+	if len(ra.Answer) == 0 {
+		return nil, errors.New("missing answer")
+	}
+	r := new(rule)
+	for _, s := range ra.Answer {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		r.answers = append(r.answers, t)
+	}
+	mg, err := domain.BatchLoadDomainProvider(ra.Domain, p.M().GetDataManager())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load domain, %w", err)
+	}
+	r.domain = mg
+	p.closer = append(p.closer, mg)
+	return r, nil
+}
+
+func parseTemplate(s string) (template, error) {
+	switch {
+	case s == "{client}":
+		return template{client: true}, nil
+	case strings.HasPrefix(s, "{iface:") && strings.HasSuffix(s, "}"):
+		name := strings.TrimSuffix(strings.TrimPrefix(s, "{iface:"), "}")
+		if len(name) == 0 {
+			return template{}, fmt.Errorf("invalid answer %s, missing interface name", s)
+		}
+		return template{iface: name}, nil
+	default:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return template{}, fmt.Errorf("invalid answer %s, %w", s, err)
+		}
+		return template{addr: addr.Unmap()}, nil
+	}
+}
+
+func (p *natCompat) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookup(qCtx); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// lookup returns the local response of the query. It returns nil if the
+// query does not match any rule.
+func (p *natCompat) lookup(qCtx *query_context.Context) *dns.Msg {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+
+	for _, rule := range p.rules {
+		if _, ok := rule.domain.Match(question.Name); !ok {
+			continue
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		r.RecursionAvailable = true
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: p.ttl}
+		for _, addr := range p.expand(rule.answers, qCtx) {
+			switch {
+			case question.Qtype == dns.TypeA && addr.Is4():
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			case question.Qtype == dns.TypeAAAA && addr.Is6():
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+		if len(r.Answer) == 0 {
+			r.Ns = []dns.RR{dnsutils.FakeSOA(question.Name)}
+		}
+		return r
+	}
+	return nil
+}
+
+// expand expands the templates to addresses.
+func (p *natCompat) expand(ts []template, qCtx *query_context.Context) []netip.Addr {
+	var addrs []netip.Addr
+	for _, t := range ts {
+		switch {
+		case t.addr.IsValid():
+			addrs = append(addrs, t.addr)
+		case t.client:
+			if addr := qCtx.ReqMeta().ClientAddr; addr.IsValid() {
+				addrs = append(addrs, addr.Unmap())
+			}
+		case len(t.iface) > 0:
+			ifaceAddrs, err := ifaceAddrs(t.iface)
+			if err != nil {
+				p.L().Warn("failed to get interface addresses", qCtx.InfoField(), zap.String("iface", t.iface), zap.Error(err))
+				continue
+			}
+			addrs = append(addrs, ifaceAddrs...)
+		}
+	}
+	return addrs
+}
+
+// ifaceAddrs returns the global unicast and private addresses of the
+// interface. Link-local addresses are excluded, since they are useless
+// without a zone.
+func ifaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, a := range ifAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsGlobalUnicast() || addr.IsPrivate() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func (p *natCompat) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
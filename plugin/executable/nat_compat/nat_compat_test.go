@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nat_compat
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func newTestPlugin(t *testing.T) *natCompat {
+	t.Helper()
+	m := domain.NewDomainMixMatcher()
+	if err := domain.Load[struct{}](m, "full:upnp.lan", nil); err != nil {
+		t.Fatal(err)
+	}
+	var answers []template
+	for _, s := range []string{"192.168.1.1", "fd00::1", "{client}"} {
+		a, err := parseTemplate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, a)
+	}
+	return &natCompat{
+		BP:    coremain.NewBP("test", PluginType, nil, nil),
+		ttl:   defaultTTL,
+		rules: []*rule{{domain: m, answers: answers}},
+	}
+}
+
+func Test_natCompat_lookup(t *testing.T) {
+	p := newTestPlugin(t)
+	tests := []struct {
+		name       string
+		qName      string
+		qtype      uint16
+		wantNil    bool
+		wantAnswer []string
+	}{
+		{"a", "upnp.lan.", dns.TypeA, false, []string{"192.168.1.1", "192.168.1.100"}},
+		{"aaaa", "upnp.lan.", dns.TypeAAAA, false, []string{"fd00::1"}},
+		{"nodata", "upnp.lan.", dns.TypeTXT, false, nil},
+		{"not matched", "sub.upnp.lan.", dns.TypeA, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qtype)
+			qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("::ffff:192.168.1.100")})
+			r := p.lookup(qCtx)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatal("unexpected response")
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("nil response")
+			}
+			var got []string
+			for _, rr := range r.Answer {
+				if rr.Header().Ttl != defaultTTL {
+					t.Fatalf("unexpected ttl %d", rr.Header().Ttl)
+				}
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+			if len(got) != len(tt.wantAnswer) {
+				t.Fatalf("want %v, got %v", tt.wantAnswer, got)
+			}
+			for i := range got {
+				if got[i] != tt.wantAnswer[i] {
+					t.Fatalf("want %v, got %v", tt.wantAnswer, got)
+				}
+			}
+			if len(got) == 0 && len(r.Ns) == 0 {
+				t.Fatal("missing soa")
+			}
+		})
+	}
+}
+
+func Test_parseTemplate(t *testing.T) {
+	for _, s := range []string{"{iface:}", "{foo}", "1.1.1", ""} {
+		if _, err := parseTemplate(s); err == nil {
+			t.Fatalf("%s: expect an error", s)
+		}
+	}
+	if tp, err := parseTemplate("{iface:br-lan}"); err != nil || tp.iface != "br-lan" {
+		t.Fatalf("unexpected template %+v, %v", tp, err)
+	}
+}
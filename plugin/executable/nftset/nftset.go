@@ -21,6 +21,7 @@ package nftset
 
 import (
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/plugin/executable/internal/resp_addr"
 )
 
 const PluginType = "nftset"
@@ -40,6 +41,13 @@ type Args struct {
 	SetName6     string `yaml:"set_name6"`
 	Mask4        int    `yaml:"mask4"` // default 24
 	Mask6        int    `yaml:"mask6"` // default 32
+
+	resp_addr.Args `yaml:",squash"`
+
+	// TTLTimeout adds elements with the ttl of their records as the
+	// timeout, so elements expire with the dns records. The set must have
+	// the timeout flag.
+	TTLTimeout bool `yaml:"ttl_timeout"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -28,10 +28,12 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/nftset_utils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/plugin/executable/internal/resp_addr"
 	"github.com/google/nftables"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"net/netip"
+	"time"
 )
 
 type nftsetPlugin struct {
@@ -40,6 +42,7 @@ type nftsetPlugin struct {
 	v4set *nftset_utils.NftSetHandler
 	v6set *nftset_utils.NftSetHandler
 	nc    *nftables.Conn
+	h     *resp_addr.Helper
 }
 
 func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
@@ -49,9 +52,14 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 	if m := args.Mask6; m <= 0 || m > 128 {
 		args.Mask6 = 32
 	}
+	h, err := resp_addr.NewHelper(bp, args.Args)
+	if err != nil {
+		return nil, err
+	}
 
 	nc, err := nftables.New(nftables.AsLasting())
 	if err != nil {
+		_ = h.Close()
 		return nil, fmt.Errorf("failed to connecet netlink, %w", err)
 	}
 
@@ -59,11 +67,13 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 		BP:   bp,
 		args: args,
 		nc:   nc,
+		h:    h,
 	}
 
 	if len(args.TableFamily4) > 0 && len(args.TableName4) > 0 && len(args.SetName4) > 0 {
 		f, ok := parseTableFamily(args.TableFamily4)
 		if !ok {
+			_ = nftPlugin.Close()
 			return nil, fmt.Errorf("unsupported nftables family for set4 [%s]", args.TableFamily4)
 		}
 		nftPlugin.v4set = nftset_utils.NewNtSetHandler(nftset_utils.HandlerOpts{
@@ -77,6 +87,7 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 	if len(args.TableFamily6) > 0 && len(args.TableName6) > 0 && len(args.SetName6) > 0 {
 		f, ok := parseTableFamily(args.TableFamily6)
 		if !ok {
+			_ = nftPlugin.Close()
 			return nil, fmt.Errorf("unsupported nftables family for set6 [%s]", args.TableFamily6)
 		}
 		nftPlugin.v6set = nftset_utils.NewNtSetHandler(nftset_utils.HandlerOpts{
@@ -95,7 +106,7 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 // Therefore, Exec will never raise its own error.
 func (p *nftsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	r := qCtx.R()
-	if r != nil {
+	if r != nil && p.h.MatchDomain(qCtx) {
 		er := p.addElems(r)
 		if er != nil {
 			p.L().Warn("failed to add elems to nftables", qCtx.InfoField(), zap.Error(er))
@@ -106,8 +117,8 @@ func (p *nftsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, ne
 }
 
 func (p *nftsetPlugin) addElems(r *dns.Msg) error {
-	var v4Elems []netip.Prefix
-	var v6Elems []netip.Prefix
+	var v4Elems []nftset_utils.Elem
+	var v6Elems []nftset_utils.Elem
 
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
@@ -120,7 +131,7 @@ func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 			if !ok || !addr.Is4() {
 				return fmt.Errorf("internel: dns.A record [%s] is not a ipv4 address", rr.A)
 			}
-			v4Elems = append(v4Elems, netip.PrefixFrom(addr, p.args.Mask4))
+			v4Elems = append(v4Elems, nftset_utils.Elem{Prefix: netip.PrefixFrom(addr, p.args.Mask4), Timeout: p.elemTimeout(rr)})
 
 		case *dns.AAAA:
 			if p.v6set == nil {
@@ -133,27 +144,36 @@ func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 			if addr.Is4() {
 				addr = netip.AddrFrom16(addr.As16())
 			}
-			v6Elems = append(v6Elems, netip.PrefixFrom(addr, p.args.Mask6))
+			v6Elems = append(v6Elems, nftset_utils.Elem{Prefix: netip.PrefixFrom(addr, p.args.Mask6), Timeout: p.elemTimeout(rr)})
 		default:
 			continue
 		}
 	}
 
 	if p.v4set != nil && len(v4Elems) > 0 {
-		if err := p.v4set.AddElems(v4Elems...); err != nil {
+		if err := p.v4set.AddTimeoutElems(v4Elems...); err != nil {
 			return fmt.Errorf("failed to add ipv4 elems %s: %w", v4Elems, err)
 		}
 	}
 
 	if p.v6set != nil && len(v6Elems) > 0 {
-		if err := p.v6set.AddElems(v6Elems...); err != nil {
+		if err := p.v6set.AddTimeoutElems(v6Elems...); err != nil {
 			return fmt.Errorf("failed to add ipv6 elems %s: %w", v6Elems, err)
 		}
 	}
 	return nil
 }
 
+// elemTimeout returns the timeout of the element of rr.
+func (p *nftsetPlugin) elemTimeout(rr dns.RR) time.Duration {
+	if !p.args.TTLTimeout {
+		return 0
+	}
+	return time.Duration(p.h.Timeout(rr)) * time.Second
+}
+
 func (p *nftsetPlugin) Close() error {
+	_ = p.h.Close()
 	return p.nc.CloseLasting()
 }
 
@@ -0,0 +1,327 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package prefetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PluginType = "prefetch"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+type Args struct {
+	// Entry is the tag of the executable plugin that resolves the prefetch
+	// queries. It should contain a cache plugin. Prefetch queries are plain
+	// queries without EDNS0, the entry should normalize queries before the
+	// cache so that clients can reuse the prefetched responses.
+	Entry string `yaml:"entry"`
+
+	QType       []string `yaml:"qtype"`        // Default is A and AAAA.
+	Concurrency int      `yaml:"concurrency"`  // Default is 4.
+	QueueSize   int      `yaml:"queue_size"`   // Default is 1024.
+	Timeout     int      `yaml:"timeout"`      // (sec) Default is 5.
+	MinInterval int      `yaml:"min_interval"` // (sec) Hints of a domain within the interval are skipped. Default is 60.
+}
+
+func (a *Args) initDefault() *Args {
+	if len(a.QType) == 0 {
+		a.QType = []string{"A", "AAAA"}
+	}
+	if a.Concurrency <= 0 {
+		a.Concurrency = 4
+	}
+	if a.QueueSize <= 0 {
+		a.QueueSize = 1024
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = 5
+	}
+	if a.MinInterval <= 0 {
+		a.MinInterval = 60
+	}
+	return a
+}
+
+type job struct {
+	name  string
+	qtype uint16
+}
+
+// prefetch pre-resolves domains that are likely to be queried soon, e.g.
+// assets of a web page that is being loaded. Hints are accepted via the
+// http api at "/plugins/<tag>/".
+//
+//	GET  /plugins/<tag>/                    shows the stats.
+//	POST /plugins/<tag>/hint?domain=&qtype= queues domains, both can be repeated.
+type prefetch struct {
+	*coremain.BP
+	args *Args
+
+	entry       executable_seq.Executable
+	qtypes      []uint16
+	timeout     time.Duration
+	minInterval time.Duration
+
+	queue       chan job
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	wg          sync.WaitGroup
+	gcTask      *scheduler.Task
+
+	m    sync.Mutex
+	seen map[job]time.Time // last time the job was queued
+
+	hintTotal     prometheus.Counter
+	prefetchTotal prometheus.Counter
+	droppedTotal  prometheus.Counter
+	errTotal      prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	a := args.(*Args)
+	entry := bp.M().GetExecutables()[a.Entry]
+	if entry == nil {
+		return nil, fmt.Errorf("cannot find executable %s", a.Entry)
+	}
+	pf, err := newPrefetch(bp, a, entry)
+	if err != nil {
+		return nil, err
+	}
+	pf.gcTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/gc", bp.Tag()),
+		Func: func(context.Context) error {
+			pf.gc(time.Now())
+			return nil
+		},
+		Schedule: scheduler.Every(pf.minInterval),
+	})
+	if err != nil {
+		pf.Close()
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(pf.hintTotal, pf.prefetchTotal, pf.droppedTotal, pf.errTotal)
+	return pf, nil
+}
+
+func newPrefetch(bp *coremain.BP, args *Args, entry executable_seq.Executable) (*prefetch, error) {
+	args.initDefault()
+	p := &prefetch{
+		BP:          bp,
+		args:        args,
+		entry:       entry,
+		timeout:     time.Duration(args.Timeout) * time.Second,
+		minInterval: time.Duration(args.MinInterval) * time.Second,
+		queue:       make(chan job, args.QueueSize),
+		closeNotify: make(chan struct{}),
+		seen:        make(map[job]time.Time),
+
+		hintTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hint_total",
+			Help: "The total number of received domain hints",
+		}),
+		prefetchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_total",
+			Help: "The total number of prefetch queries",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_dropped_total",
+			Help: "The total number of prefetch queries that were dropped because the queue was full",
+		}),
+		errTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_err_total",
+			Help: "The total number of failed prefetch queries",
+		}),
+	}
+	for _, s := range args.QType {
+		t, err := dnsutils.ParseRRType(s)
+		if err != nil {
+			return nil, err
+		}
+		p.qtypes = append(p.qtypes, t)
+	}
+
+	for i := 0; i < args.Concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p, nil
+}
+
+func (p *prefetch) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case j := <-p.queue:
+			p.resolve(j)
+		}
+	}
+}
+
+func (p *prefetch) resolve(j job) {
+	p.prefetchTotal.Inc()
+	q := new(dns.Msg)
+	q.SetQuestion(j.name, j.qtype)
+	qCtx := query_context.NewContext(q, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	if err := p.entry.Exec(ctx, qCtx, nil); err != nil {
+		p.errTotal.Inc()
+		p.L().Debug("prefetch failed", qCtx.InfoField(), zap.Error(err))
+	}
+}
+
+type hintResult struct {
+	Accepted int `json:"accepted"`
+	Skipped  int `json:"skipped"` // prefetched within min_interval
+	Dropped  int `json:"dropped"` // queue is full
+}
+
+// hint queues the prefetch jobs of domains.
+func (p *prefetch) hint(domains []string, qtypes []uint16, now time.Time) hintResult {
+	var res hintResult
+	for _, d := range domains {
+		p.hintTotal.Inc()
+		for _, t := range qtypes {
+			j := job{name: dns.Fqdn(strings.ToLower(d)), qtype: t}
+			p.m.Lock()
+			last, ok := p.seen[j]
+			if ok && now.Sub(last) < p.minInterval {
+				p.m.Unlock()
+				res.Skipped++
+				continue
+			}
+			p.seen[j] = now
+			p.m.Unlock()
+
+			select {
+			case p.queue <- j:
+				res.Accepted++
+			default:
+				p.m.Lock()
+				delete(p.seen, j)
+				p.m.Unlock()
+				p.droppedTotal.Inc()
+				res.Dropped++
+			}
+		}
+	}
+	return res
+}
+
+func (p *prefetch) gc(now time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for j, last := range p.seen {
+		if now.Sub(last) >= p.minInterval {
+			delete(p.seen, j)
+		}
+	}
+}
+
+type statsJSON struct {
+	Queued int `json:"queued"`
+}
+
+func (p *prefetch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/plugins/%s/", p.Tag())), "/")
+
+	if req.Method == http.MethodGet && len(op) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(statsJSON{Queued: len(p.queue)})
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+		return
+	}
+	if op != "hint" {
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown operation %s", op))
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	domains := req.Form["domain"]
+	if len(domains) == 0 {
+		httpError(w, http.StatusBadRequest, errors.New("missing domain"))
+		return
+	}
+	for _, d := range domains {
+		if _, ok := dns.IsDomainName(d); !ok {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("invalid domain %s", d))
+			return
+		}
+	}
+	qtypes := p.qtypes
+	if ss := req.Form["qtype"]; len(ss) > 0 {
+		qtypes = make([]uint16, 0, len(ss))
+		for _, s := range ss {
+			t, err := dnsutils.ParseRRType(s)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err)
+				return
+			}
+			qtypes = append(qtypes, t)
+		}
+	}
+
+	res := p.hint(domains, qtypes, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
+
+func (p *prefetch) Close() error {
+	p.closeOnce.Do(func() {
+		if p.gcTask != nil {
+			p.gcTask.Cancel()
+		}
+		close(p.closeNotify)
+	})
+	p.wg.Wait()
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package prefetch
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder records the questions it has executed.
+type recorder struct {
+	sync.Mutex
+	q    []string
+	done chan struct{}
+}
+
+func (r *recorder) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r.Lock()
+	defer r.Unlock()
+	q := qCtx.Q().Question[0]
+	r.q = append(r.q, q.Name+" "+dns.TypeToString[q.Qtype])
+	r.done <- struct{}{}
+	return nil
+}
+
+func Test_prefetch(t *testing.T) {
+	rec := &recorder{done: make(chan struct{}, 16)}
+	p, err := newPrefetch(coremain.NewBP("pf", PluginType, nil, nil), &Args{}, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	post := func(query string) (int, hintResult) {
+		req := httptest.NewRequest(http.MethodPost, "/plugins/pf/hint?"+query, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		var res hintResult
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res
+	}
+
+	code, res := post("domain=Example.com&domain=cdn.example.com")
+	if code != http.StatusOK || res.Accepted != 4 {
+		t.Fatalf("unexpected result %d %+v", code, res)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-rec.done:
+		case <-time.After(time.Second):
+			t.Fatal("prefetch timeout")
+		}
+	}
+	sort.Strings(rec.q)
+	want := "cdn.example.com. A|cdn.example.com. AAAA|example.com. A|example.com. AAAA"
+	if got := strings.Join(rec.q, "|"); got != want {
+		t.Fatalf("got queries %s, want %s", got, want)
+	}
+
+	// Within min_interval.
+	if _, res := post("domain=example.com&qtype=A&qtype=HTTPS"); res.Accepted != 1 || res.Skipped != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	<-rec.done
+
+	if code, _ := post("domain=a..b"); code != http.StatusBadRequest {
+		t.Fatalf("invalid domain, got code %d", code)
+	}
+	if code, _ := post("domain=a.com&qtype=NOTATYPE"); code != http.StatusBadRequest {
+		t.Fatalf("invalid qtype, got code %d", code)
+	}
+	if code, _ := post(""); code != http.StatusBadRequest {
+		t.Fatalf("missing domain, got code %d", code)
+	}
+
+	p.gc(time.Now().Add(p.minInterval))
+	if len(p.seen) != 0 {
+		t.Fatalf("gc failed, %d entries left", len(p.seen))
+	}
+}
+
+// blocker blocks until release is closed.
+type blocker struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blocker) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	b.started <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func Test_prefetch_queueFull(t *testing.T) {
+	b := &blocker{started: make(chan struct{}, 1), release: make(chan struct{})}
+	p, err := newPrefetch(coremain.NewBP("pf", PluginType, nil, nil), &Args{Concurrency: 1, QueueSize: 1}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	defer close(b.release)
+
+	qtypes := []uint16{dns.TypeA}
+	if res := p.hint([]string{"a.com"}, qtypes, time.Now()); res.Accepted != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	<-b.started // the worker is busy now
+	res := p.hint([]string{"b.com", "c.com"}, qtypes, time.Now())
+	if res.Accepted != 1 || res.Dropped != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	// Dropped jobs can be hinted again.
+	if res := p.hint([]string{"c.com"}, qtypes, time.Now()); res.Dropped != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PluginType = "query_events"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*queryEvents)(nil)
+
+const (
+	defaultBlockKey   = "blocked"
+	defaultBufferSize = 256
+	heartbeatInterval = time.Second * 15
+)
+
+type Args struct {
+	// BlockKey is the query metadata key that marks a query as blocked.
+	// It can be set by the metadata plugin in blocking branches.
+	// Default is "blocked".
+	BlockKey string `yaml:"block_key"`
+
+	// BufferSize is the number of events that can be buffered for each
+	// subscriber. Events are dropped if the subscriber is too slow.
+	// Default is 256.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// event is a query event.
+type event struct {
+	Time      time.Time         `json:"time"`
+	ID        uint32            `json:"id"`
+	Client    string            `json:"client,omitempty"`
+	Qname     string            `json:"qname"`
+	Qtype     string            `json:"qtype"`
+	Rcode     string            `json:"rcode,omitempty"` // Empty if there is no response.
+	Answers   []string          `json:"answers,omitempty"`
+	Blocked   bool              `json:"blocked"`
+	ElapsedMs int64             `json:"elapsed_ms"`
+	Error     string            `json:"error,omitempty"`
+	Values    map[string]string `json:"values,omitempty"`
+
+	client netip.Addr
+}
+
+type subscriber struct {
+	f    *filter
+	c    chan *event
+	ping chan struct{} // heartbeats
+}
+
+type queryEvents struct {
+	*coremain.BP
+	blockKey   string
+	bufferSize int
+
+	m           sync.Mutex
+	subscribers map[*subscriber]struct{}
+	n           int32 // len(subscribers), for the fast path
+
+	droppedTotal  prometheus.Counter
+	heartbeatTask *scheduler.Task
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	qe := newQueryEvents(bp, args.(*Args))
+	var err error
+	qe.heartbeatTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/heartbeat", bp.Tag()),
+		Func: func(context.Context) error {
+			qe.heartbeat()
+			return nil
+		},
+		Schedule: scheduler.Every(heartbeatInterval),
+	})
+	if err != nil {
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(qe.droppedTotal)
+	return qe, nil
+}
+
+func newQueryEvents(bp *coremain.BP, args *Args) *queryEvents {
+	p := &queryEvents{
+		BP:          bp,
+		blockKey:    args.BlockKey,
+		bufferSize:  args.BufferSize,
+		subscribers: make(map[*subscriber]struct{}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_events_total",
+			Help: "The total number of events that were dropped because subscribers were too slow",
+		}),
+	}
+	if len(p.blockKey) == 0 {
+		p.blockKey = defaultBlockKey
+	}
+	if p.bufferSize <= 0 {
+		p.bufferSize = defaultBufferSize
+	}
+	return p
+}
+
+func (p *queryEvents) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	if atomic.LoadInt32(&p.n) > 0 {
+		p.publish(p.newEvent(qCtx, err))
+	}
+	return err
+}
+
+func (p *queryEvents) newEvent(qCtx *query_context.Context, err error) *event {
+	e := &event{
+		Time:      qCtx.StartTime(),
+		ID:        qCtx.Id(),
+		ElapsedMs: time.Since(qCtx.StartTime()).Milliseconds(),
+		client:    qCtx.ReqMeta().ClientAddr,
+	}
+	if e.client.IsValid() {
+		e.Client = e.client.String()
+	}
+	if q := qCtx.Q(); len(q.Question) == 1 {
+		e.Qname = q.Question[0].Name
+		e.Qtype = dnsutils.QtypeToString(q.Question[0].Qtype)
+	}
+	if r := qCtx.R(); r != nil {
+		e.Rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				e.Answers = append(e.Answers, rr.A.String())
+			case *dns.AAAA:
+				e.Answers = append(e.Answers, rr.AAAA.String())
+			case *dns.CNAME:
+				e.Answers = append(e.Answers, rr.Target)
+			}
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if values := qCtx.Values(); len(values) > 0 {
+		e.Values = values
+		_, e.Blocked = values[p.blockKey]
+	}
+	return e
+}
+
+func (p *queryEvents) publish(e *event) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for s := range p.subscribers {
+		if !s.f.match(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			p.droppedTotal.Inc()
+		}
+	}
+}
+
+// heartbeat asks all subscribers to send a heartbeat, so idle streams
+// are not closed by proxies.
+func (p *queryEvents) heartbeat() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for s := range p.subscribers {
+		select {
+		case s.ping <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *queryEvents) subscribe(f *filter) *subscriber {
+	s := &subscriber{f: f, c: make(chan *event, p.bufferSize), ping: make(chan struct{}, 1)}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.subscribers[s] = struct{}{}
+	atomic.StoreInt32(&p.n, int32(len(p.subscribers)))
+	return s
+}
+
+func (p *queryEvents) unsubscribe(s *subscriber) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.subscribers, s)
+	atomic.StoreInt32(&p.n, int32(len(p.subscribers)))
+}
+
+// filter filters events. All non-empty conditions must match.
+type filter struct {
+	clients     []netip.Prefix
+	domains     []string // fqdn, lower case
+	blockedOnly bool
+}
+
+func parseFilter(req *http.Request) (*filter, error) {
+	q := req.URL.Query()
+	f := &filter{blockedOnly: q.Get("blocked") == "true"}
+	for _, s := range q["client"] {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid client %s, %w", s, err)
+		}
+		f.clients = append(f.clients, prefix.Masked())
+	}
+	for _, s := range q["domain"] {
+		if _, ok := dns.IsDomainName(s); !ok {
+			return nil, fmt.Errorf("invalid domain %s", s)
+		}
+		f.domains = append(f.domains, dns.Fqdn(strings.ToLower(s)))
+	}
+	return f, nil
+}
+
+func (f *filter) match(e *event) bool {
+	if f.blockedOnly && !e.Blocked {
+		return false
+	}
+	if len(f.clients) > 0 {
+		ok := false
+		for _, prefix := range f.clients {
+			if prefix.Contains(e.client.Unmap()) || prefix.Contains(e.client) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(f.domains) > 0 {
+		name := strings.ToLower(e.Qname)
+		ok := false
+		for _, d := range f.domains {
+			if dns.IsSubDomain(d, name) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP streams query events as Server-Sent Events.
+//
+//	GET /plugins/<tag>/?client=<ip|cidr>&domain=<domain>&blocked=true
+//
+// client and domain can be repeated. A domain matches its subdomains.
+func (p *queryEvents) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+		return
+	}
+	f, err := parseFilter(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	s := p.subscribe(f)
+	defer p.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx buffering.
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-s.c:
+			b, err := json.Marshal(e)
+			if err != nil {
+				p.L().Error("failed to marshal event", zap.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: query\ndata: %s\n\n", b); err != nil {
+				return
+			}
+		case <-s.ping:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (p *queryEvents) Close() error {
+	if p.heartbeatTask != nil {
+		p.heartbeatTask.Cancel()
+	}
+	return nil
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
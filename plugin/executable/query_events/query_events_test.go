@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newQCtx(name string, client string, blocked bool) *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+	if blocked {
+		qCtx.SetValue("blocked", "")
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	qCtx.SetResponse(r)
+	return qCtx
+}
+
+func Test_queryEvents_ServeHTTP(t *testing.T) {
+	p := newQueryEvents(coremain.NewBP("test", PluginType, nil, nil), &Args{})
+	s := httptest.NewServer(p)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/?client=192.168.1.0/24&domain=example.com&blocked=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for _, qCtx := range []*query_context.Context{
+		newQCtx("example.com.", "10.0.0.1", true),       // client mismatched
+		newQCtx("example.org.", "192.168.1.1", true),    // domain mismatched
+		newQCtx("a.example.com.", "192.168.1.1", false), // not blocked
+		newQCtx("a.example.com.", "192.168.1.2", true),  // matched
+	} {
+		if err := p.Exec(ctx, qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if !strings.HasPrefix(sc.Text(), "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(sc.Text(), "data: ")
+		e := new(event)
+		if err := json.Unmarshal([]byte(data), e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Qname != "a.example.com." || e.Client != "192.168.1.2" || !e.Blocked || e.Rcode != "NOERROR" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		return
+	}
+	t.Fatal("no event received", sc.Err())
+}
+
+func Test_parseFilter(t *testing.T) {
+	for _, s := range []string{"client=bad", "client=1.1.1.1/33", "domain=..a"} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+s, nil)
+		if _, err := parseFilter(req); err == nil {
+			t.Fatalf("%s: expect an error", s)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package query_stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// adguardStatsJSON is the response of the /control/stats api of
+// AdGuard Home. mosdns has no safe browsing, safe search or parental
+// control, their numbers are always zero.
+type adguardStatsJSON struct {
+	TimeUnits               string              `json:"time_units"`
+	NumDNSQueries           uint64              `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64              `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64              `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64              `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64              `json:"num_replaced_parental"`
+	AvgProcessingTime       float64             `json:"avg_processing_time"` // seconds
+	TopQueriedDomains       []map[string]uint64 `json:"top_queried_domains"`
+	TopClients              []map[string]uint64 `json:"top_clients"`
+	TopBlockedDomains       []map[string]uint64 `json:"top_blocked_domains"`
+	DNSQueries              []uint64            `json:"dns_queries"`
+	BlockedFiltering        []uint64            `json:"blocked_filtering"`
+	ReplacedSafebrowsing    []uint64            `json:"replaced_safebrowsing"`
+	ReplacedParental        []uint64            `json:"replaced_parental"`
+}
+
+func adguardStats(s *summary) *adguardStatsJSON {
+	v := &adguardStatsJSON{
+		TimeUnits:            "hours",
+		NumDNSQueries:        s.queries,
+		NumBlockedFiltering:  s.blocked,
+		TopQueriedDomains:    adguardTop(s.domains),
+		TopClients:           adguardTop(s.clients),
+		TopBlockedDomains:    adguardTop(s.blockedDomains),
+		ReplacedSafebrowsing: make([]uint64, len(s.hours)),
+		ReplacedParental:     make([]uint64, len(s.hours)),
+	}
+	if s.queries > 0 {
+		v.AvgProcessingTime = s.elapsed.Seconds() / float64(s.queries)
+	}
+	for _, h := range s.hours {
+		v.DNSQueries = append(v.DNSQueries, h.queries)
+		v.BlockedFiltering = append(v.BlockedFiltering, h.blocked)
+	}
+	return v
+}
+
+// adguardTop converts es to a list of single entry objects.
+func adguardTop(es []entry) []map[string]uint64 {
+	l := make([]map[string]uint64, 0, len(es))
+	for _, e := range es {
+		l = append(l, map[string]uint64{e.key: e.count})
+	}
+	return l
+}
+
+// piholeStatsJSON is the responses of the summaryRaw, topItems,
+// getQuerySources and overTimeData apis of Pi-hole.
+type piholeStatsJSON struct {
+	DNSQueriesToday    uint64  `json:"dns_queries_today"`
+	AdsBlockedToday    uint64  `json:"ads_blocked_today"`
+	AdsPercentageToday float64 `json:"ads_percentage_today"`
+	UniqueClients      int     `json:"unique_clients"`
+
+	TopQueries      orderedCounts `json:"top_queries"`
+	TopAds          orderedCounts `json:"top_ads"`
+	TopSources      orderedCounts `json:"top_sources"`
+	DomainsOverTime orderedCounts `json:"domains_over_time"` // unix timestamps
+	AdsOverTime     orderedCounts `json:"ads_over_time"`
+}
+
+func piholeStats(s *summary) *piholeStatsJSON {
+	v := &piholeStatsJSON{
+		DNSQueriesToday: s.queries,
+		AdsBlockedToday: s.blocked,
+		UniqueClients:   s.uniqueClients,
+		TopQueries:      s.domains,
+		TopAds:          s.blockedDomains,
+		TopSources:      s.clients,
+	}
+	if s.queries > 0 {
+		v.AdsPercentageToday = float64(s.blocked) * 100 / float64(s.queries)
+	}
+	for _, h := range s.hours {
+		ts := strconv.FormatInt(h.start.Unix(), 10)
+		v.DomainsOverTime = append(v.DomainsOverTime, entry{key: ts, count: h.queries})
+		v.AdsOverTime = append(v.AdsOverTime, entry{key: ts, count: h.blocked})
+	}
+	return v
+}
+
+// orderedCounts is marshalled to a json object that keeps the order of
+// its entries.
+type orderedCounts []entry
+
+func (c orderedCounts) MarshalJSON() ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte('{')
+	for i, e := range c {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(e.key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatUint(e.count, 10))
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
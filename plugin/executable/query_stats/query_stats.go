@@ -0,0 +1,401 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package query_stats
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PluginType = "query_stats"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*queryStats)(nil)
+
+const (
+	defaultBlockKey   = "blocked"
+	defaultHours      = 24
+	defaultMaxEntries = 1000
+	defaultTop        = 10
+
+	// shardNum is the number of shards of the statistics. Queries are
+	// sharded by their domains, so they can be recorded concurrently.
+	shardNum = 16
+)
+
+// Args configures the query statistics. The statistics are kept in
+// memory in hourly buckets and are served by the api in the formats of
+// AdGuard Home and Pi-hole, so their dashboards can be used.
+type Args struct {
+	// BlockKey is the query metadata key that marks a query as blocked.
+	// Default is "blocked".
+	BlockKey string `yaml:"block_key"`
+
+	// Hours is the number of hours that are kept. Default is 24.
+	Hours int `yaml:"hours"`
+
+	// MaxEntries is the maximum number of domains or clients that are
+	// counted in each hour. Rare entries are evicted first. Default is 1000.
+	MaxEntries int `yaml:"max_entries"`
+
+	// Top is the number of entries of the top lists. Default is 10.
+	Top int `yaml:"top"`
+}
+
+type queryStats struct {
+	*coremain.BP
+	blockKey   string
+	maxEntries int // of each shard
+	top        int
+	now        func() time.Time
+
+	shards [shardNum]statsShard
+}
+
+type statsShard struct {
+	m       sync.Mutex
+	buckets []*bucket // ring of hourly buckets
+}
+
+// bucket is the statistics of an hour.
+type bucket struct {
+	start          time.Time // zero if the bucket is unused
+	queries        uint64
+	blocked        uint64
+	elapsed        time.Duration
+	domains        *topCounter
+	blockedDomains *topCounter
+	clients        *topCounter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newQueryStats(bp, args.(*Args)), nil
+}
+
+func newQueryStats(bp *coremain.BP, args *Args) *queryStats {
+	p := &queryStats{
+		BP:         bp,
+		blockKey:   args.BlockKey,
+		maxEntries: args.MaxEntries,
+		top:        args.Top,
+		now:        time.Now,
+	}
+	if len(p.blockKey) == 0 {
+		p.blockKey = defaultBlockKey
+	}
+	if p.maxEntries <= 0 {
+		p.maxEntries = defaultMaxEntries
+	}
+	p.maxEntries = (p.maxEntries + shardNum - 1) / shardNum
+	if p.top <= 0 {
+		p.top = defaultTop
+	}
+	hours := args.Hours
+	if hours <= 0 {
+		hours = defaultHours
+	}
+	for i := range p.shards {
+		sd := &p.shards[i]
+		sd.buckets = make([]*bucket, hours)
+		for j := range sd.buckets {
+			sd.buckets[j] = new(bucket)
+		}
+	}
+	return p
+}
+
+func (p *queryStats) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	var domain, client string
+	if q := qCtx.QReadOnly(); len(q.Question) == 1 {
+		domain = strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+	}
+	if addr := qCtx.ReqMeta().ClientAddr; addr.IsValid() {
+		client = addr.String()
+	}
+	_, blocked := qCtx.GetValue(p.blockKey)
+	p.record(domain, client, blocked, time.Since(qCtx.StartTime()))
+	return err
+}
+
+func (p *queryStats) record(domain, client string, blocked bool, elapsed time.Duration) {
+	sd := &p.shards[shardOf(domain)]
+	sd.m.Lock()
+	defer sd.m.Unlock()
+	b := p.currentBucket(sd)
+	b.queries++
+	b.elapsed += elapsed
+	if len(domain) > 0 {
+		b.domains.add(domain)
+	}
+	if len(client) > 0 {
+		b.clients.add(client)
+	}
+	if blocked {
+		b.blocked++
+		if len(domain) > 0 {
+			b.blockedDomains.add(domain)
+		}
+	}
+}
+
+// shardOf returns the shard index of domain (fnv-1a).
+func shardOf(domain string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(domain); i++ {
+		h ^= uint32(domain[i])
+		h *= 16777619
+	}
+	return int(h % shardNum)
+}
+
+// currentBucket returns the bucket of the current hour of sd. It resets
+// the bucket if it has the statistics of a previous hour.
+// Caller must hold sd.m.
+func (p *queryStats) currentBucket(sd *statsShard) *bucket {
+	start := p.now().Truncate(time.Hour)
+	b := sd.buckets[int(start.Unix()/3600)%len(sd.buckets)]
+	if !b.start.Equal(start) {
+		*b = bucket{
+			start:          start,
+			domains:        newTopCounter(p.maxEntries),
+			blockedDomains: newTopCounter(p.maxEntries),
+			clients:        newTopCounter(p.maxEntries),
+		}
+	}
+	return b
+}
+
+// hourStats is the statistics of an hour in the summary.
+type hourStats struct {
+	start   time.Time
+	queries uint64
+	blocked uint64
+}
+
+// summary is the merged statistics of all buckets.
+type summary struct {
+	queries        uint64
+	blocked        uint64
+	elapsed        time.Duration
+	hours          []hourStats // from the oldest to the current hour
+	domains        []entry
+	blockedDomains []entry
+	clients        []entry
+	uniqueClients  int
+}
+
+func (p *queryStats) summary() *summary {
+	current := p.now().Truncate(time.Hour)
+	s := new(summary)
+	hours := len(p.shards[0].buckets)
+	for i := hours - 1; i >= 0; i-- {
+		s.hours = append(s.hours, hourStats{start: current.Add(-time.Duration(i) * time.Hour)})
+	}
+	domains := make(map[string]uint64)
+	blockedDomains := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	for i := range p.shards {
+		sd := &p.shards[i]
+		sd.m.Lock()
+		for j := range s.hours {
+			h := &s.hours[j]
+			b := sd.buckets[int(h.start.Unix()/3600)%hours]
+			if !b.start.Equal(h.start) {
+				continue
+			}
+			h.queries += b.queries
+			h.blocked += b.blocked
+			s.queries += b.queries
+			s.blocked += b.blocked
+			s.elapsed += b.elapsed
+			b.domains.mergeTo(domains)
+			b.blockedDomains.mergeTo(blockedDomains)
+			b.clients.mergeTo(clients)
+		}
+		sd.m.Unlock()
+	}
+	s.domains = topEntries(domains, p.top)
+	s.blockedDomains = topEntries(blockedDomains, p.top)
+	s.clients = topEntries(clients, p.top)
+	s.uniqueClients = len(clients)
+	return s
+}
+
+func (p *queryStats) reset() {
+	for i := range p.shards {
+		sd := &p.shards[i]
+		sd.m.Lock()
+		for _, b := range sd.buckets {
+			*b = bucket{}
+		}
+		sd.m.Unlock()
+	}
+}
+
+// ServeHTTP serves the statistics.
+//
+//	GET /plugins/<tag>/ or /plugins/<tag>/adguard: the format of the
+//	    /control/stats api of AdGuard Home.
+//	GET /plugins/<tag>/pihole: the format of the summaryRaw, topItems,
+//	    getQuerySources and overTimeData apis of Pi-hole in one object.
+//	POST /plugins/<tag>/reset: clears the statistics.
+func (p *queryStats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/plugins/%s/", p.Tag())), "/")
+	if op == "reset" {
+		if req.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+			return
+		}
+		p.reset()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+		return
+	}
+	var v interface{}
+	switch op {
+	case "", "adguard":
+		v = adguardStats(p.summary())
+	case "pihole":
+		v = piholeStats(p.summary())
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown operation %s", op))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
+
+// topCounter counts keys with at most max keys. If it is full, the key
+// with the smallest count is replaced by the new key, which inherits its
+// count (the space-saving algorithm), so frequent keys are kept and
+// their counts are upper bounds. Counters are kept in a min-heap, so
+// add is O(log max).
+type topCounter struct {
+	max int
+	m   map[string]*counter
+	h   counterHeap
+}
+
+type counter struct {
+	key   string
+	count uint64
+	index int // in the heap
+}
+
+func newTopCounter(max int) *topCounter {
+	return &topCounter{max: max, m: make(map[string]*counter)}
+}
+
+func (c *topCounter) add(key string) {
+	if e, ok := c.m[key]; ok {
+		e.count++
+		heap.Fix(&c.h, e.index)
+		return
+	}
+	if len(c.h) < c.max {
+		e := &counter{key: key, count: 1}
+		c.m[key] = e
+		heap.Push(&c.h, e)
+		return
+	}
+	e := c.h[0]
+	delete(c.m, e.key)
+	e.key = key
+	e.count++
+	c.m[key] = e
+	heap.Fix(&c.h, 0)
+}
+
+func (c *topCounter) mergeTo(m map[string]uint64) {
+	for k, e := range c.m {
+		m[k] += e.count
+	}
+}
+
+// counterHeap is a min-heap of counters by count.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	e := x.(*counter)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+type entry struct {
+	key   string
+	count uint64
+}
+
+// topEntries returns the n entries of m with the largest counts.
+func topEntries(m map[string]uint64, n int) []entry {
+	es := make([]entry, 0, len(m))
+	for k, c := range m {
+		es = append(es, entry{key: k, count: c})
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].count != es[j].count {
+			return es[i].count > es[j].count
+		}
+		return es[i].key < es[j].key
+	})
+	if len(es) > n {
+		es = es[:n]
+	}
+	return es
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package query_stats
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockExec struct{}
+
+func (blockExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	if qCtx.QReadOnly().Question[0].Name == "ads.example." {
+		qCtx.SetValue("blocked", "1")
+	}
+	return nil
+}
+
+func Test_queryStats(t *testing.T) {
+	p := newQueryStats(coremain.NewBP("test", PluginType, nil, nil), &Args{Hours: 3})
+	now := time.Unix(1700000000, 0)
+	p.now = func() time.Time { return now }
+
+	exec := func(name, client string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+		if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(blockExec{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("ads.example.", "192.168.1.2")
+	now = now.Add(time.Hour)
+	exec("Example.com.", "192.168.1.2")
+	exec("example.com.", "192.168.1.3")
+	exec("ads.example.", "192.168.1.2")
+
+	s := p.summary()
+	if s.queries != 4 || s.blocked != 2 || s.uniqueClients != 2 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	if len(s.hours) != 3 || s.hours[1].queries != 1 || s.hours[2].queries != 3 {
+		t.Fatalf("unexpected hours %+v", s.hours)
+	}
+	if s.domains[1] != (entry{key: "example.com", count: 2}) || s.clients[0] != (entry{key: "192.168.1.2", count: 3}) {
+		t.Fatalf("unexpected top lists %+v %+v", s.domains, s.clients)
+	}
+
+	// The first hour is out of the window.
+	now = now.Add(time.Hour * 2)
+	if s := p.summary(); s.queries != 3 || s.hours[0].queries != 3 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+
+	get := func(path string) map[string]json.RawMessage {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, rw.Code)
+		}
+		m := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(rw.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if m := get("/plugins/test/"); string(m["num_dns_queries"]) != "3" || string(m["top_blocked_domains"]) != `[{"ads.example":1}]` {
+		t.Fatalf("unexpected adguard stats %v", m)
+	}
+	if m := get("/plugins/test/pihole"); string(m["top_queries"]) != `{"example.com":2,"ads.example":1}` {
+		t.Fatalf("unexpected pihole stats %s", m["top_queries"])
+	}
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/plugins/test/reset", strings.NewReader("")))
+	if rw.Code != http.StatusOK || p.summary().queries != 0 {
+		t.Fatal("failed to reset")
+	}
+}
+
+func Test_topCounter(t *testing.T) {
+	c := newTopCounter(2)
+	for _, k := range []string{"a", "a", "a", "b", "c"} {
+		c.add(k)
+	}
+	m := make(map[string]uint64)
+	c.mergeTo(m)
+	if len(m) != 2 || m["a"] != 3 || m["c"] != 2 {
+		t.Fatalf("unexpected counts %v", m)
+	}
+
+	// "c" has the smallest count, so it is replaced by "d".
+	c.add("a")
+	c.add("d")
+	m = make(map[string]uint64)
+	c.mergeTo(m)
+	if len(m) != 2 || m["a"] != 4 || m["d"] != 3 {
+		t.Fatalf("unexpected counts %v", m)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rebind_protection
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+)
+
+const PluginType = "rebind_protection"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*rebindProtection)(nil)
+
+const (
+	modeStrip = "strip"
+	modeBlock = "block"
+)
+
+// defaultReservedNets are the ranges that should not appear in
+// answers of external domains.
+var defaultReservedNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type Args struct {
+	// Mode can be "strip" or "block". Default is "strip".
+	// strip: removes the reserved addresses from the answer.
+	// block: replaces the response with an empty response with RCode.
+	// strip acts as block if the DNSSEC pass-through mode is enabled.
+	Mode  string `yaml:"mode"`
+	RCode int    `yaml:"rcode"` // Used by block mode. Default is 5 (REFUSED).
+
+	// IP sets the reserved ranges. Default is private, loopback,
+	// link-local, CGNAT and unspecified ranges.
+	IP []string `yaml:"ip"`
+
+	// AllowDomain is the domains that are allowed to be resolved to
+	// reserved addresses. e.g. local domains.
+	AllowDomain []string `yaml:"allow_domain"`
+}
+
+type rebindProtection struct {
+	*coremain.BP
+	mode  string
+	rcode int
+
+	reserved    netlist.Matcher
+	allowDomain domain.Matcher[struct{}]
+	closer      []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRebindProtection(bp, args.(*Args))
+}
+
+func newRebindProtection(bp *coremain.BP, args *Args) (*rebindProtection, error) {
+	p := &rebindProtection{BP: bp, mode: args.Mode, rcode: args.RCode}
+	switch p.mode {
+	case "":
+		p.mode = modeStrip
+	case modeStrip, modeBlock:
+	default:
+		return nil, fmt.Errorf("invalid mode %s", args.Mode)
+	}
+	if p.rcode == 0 {
+		p.rcode = dns.RcodeRefused
+	}
+
+	ip := args.IP
+	if len(ip) == 0 {
+		ip = defaultReservedNets
+	}
+	reserved, err := netlist.BatchLoadProvider(ip, bp.M().GetDataManager())
+	if err != nil {
+		_ = p.Close()
+		return nil, fmt.Errorf("failed to load ip, %w", err)
+	}
+	p.reserved = reserved
+	p.closer = append(p.closer, reserved)
+
+	if len(args.AllowDomain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.AllowDomain, bp.M().GetDataManager())
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to load allow_domain, %w", err)
+		}
+		p.allowDomain = mg
+		p.closer = append(p.closer, mg)
+		bp.L().Info("allow domain matcher loaded", zap.Int("length", mg.Len()))
+	}
+	return p, nil
+}
+
+// Exec checks the A/AAAA records in the response. Responses of allowed
+// domains are untouched.
+func (p *rebindProtection) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := p.exec(qCtx); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *rebindProtection) exec(qCtx *query_context.Context) error {
+	r := qCtx.R()
+	q := qCtx.Q()
+	if r == nil || len(q.Question) != 1 {
+		return nil
+	}
+	if p.allowDomain != nil {
+		if _, ok := p.allowDomain.Match(q.Question[0].Name); ok {
+			return nil
+		}
+	}
+
+	answer := r.Answer[:0]
+	stripped := 0
+	for _, rr := range r.Answer {
+		reserved, err := p.isReserved(rr)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			stripped++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if stripped == 0 {
+		return nil
+	}
+
+	p.L().Warn(
+		"reserved addresses found in response",
+		qCtx.InfoField(),
+		zap.Int("num", stripped),
+		zap.String("mode", p.mode),
+	)
+	// Stripping records from a signed rrset invalidates its signature.
+	// Block the response instead in DNSSEC pass-through mode.
+	switch {
+	case p.mode == modeBlock || qCtx.DNSSECPassthrough():
+		resp := new(dns.Msg)
+		resp.SetRcode(q, p.rcode)
+		resp.RecursionAvailable = true
+		qCtx.SetResponse(resp)
+		qCtx.SetEDE(dns.ExtendedErrorCodeBlocked, "reserved address in answer")
+	default:
+		r.Answer = answer
+	}
+	return nil
+}
+
+func (p *rebindProtection) isReserved(rr dns.RR) (bool, error) {
+	var addr netip.Addr
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(rr.AAAA.To16())
+	default:
+		return false, nil
+	}
+	if !addr.IsValid() {
+		return false, nil
+	}
+	return p.reserved.Match(addr.Unmap())
+}
+
+func (p *rebindProtection) Close() error {
+	for _, c := range p.closer {
+		_ = c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rebind_protection
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func newTestPlugin(t *testing.T, mode string) *rebindProtection {
+	t.Helper()
+	l := netlist.NewList()
+	for _, s := range defaultReservedNets {
+		if err := netlist.Load(l, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Sort()
+	allow := domain.NewDomainMixMatcher()
+	if err := domain.Load[struct{}](allow, "lan", nil); err != nil {
+		t.Fatal(err)
+	}
+	return &rebindProtection{
+		BP:          coremain.NewBP("test", PluginType, nil, nil),
+		mode:        mode,
+		rcode:       dns.RcodeRefused,
+		reserved:    l,
+		allowDomain: allow,
+	}
+}
+
+func Test_rebindProtection_exec(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		dnssec     bool
+		qName      string
+		answer     []string
+		wantRcode  int
+		wantAnswer int
+	}{
+		{"public", modeStrip, false, "example.com.", []string{"1.1.1.1", "2606:4700::1111"}, dns.RcodeSuccess, 2},
+		{"strip", modeStrip, false, "example.com.", []string{"1.1.1.1", "192.168.1.1", "::1"}, dns.RcodeSuccess, 1},
+		{"strip mapped", modeStrip, false, "example.com.", []string{"::ffff:127.0.0.1"}, dns.RcodeSuccess, 0},
+		{"strip dnssec", modeStrip, true, "example.com.", []string{"1.1.1.1", "10.0.0.1"}, dns.RcodeRefused, 0},
+		{"public dnssec", modeStrip, true, "example.com.", []string{"1.1.1.1"}, dns.RcodeSuccess, 1},
+		{"block", modeBlock, false, "example.com.", []string{"1.1.1.1", "10.0.0.1"}, dns.RcodeRefused, 0},
+		{"allowed", modeBlock, false, "nas.lan.", []string{"10.0.0.1"}, dns.RcodeSuccess, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, tt.mode)
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, dns.TypeA)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			for _, s := range tt.answer {
+				typ := "AAAA"
+				if netip.MustParseAddr(s).Is4() {
+					typ = "A"
+				}
+				rr, err := dns.NewRR(tt.qName + " 300 IN " + typ + " " + s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Answer = append(r.Answer, rr)
+			}
+			qCtx := query_context.NewContext(q, nil)
+			qCtx.SetResponse(r)
+			qCtx.SetDNSSECPassthrough(tt.dnssec)
+
+			if err := p.exec(qCtx); err != nil {
+				t.Fatal(err)
+			}
+			if got := qCtx.R().Rcode; got != tt.wantRcode {
+				t.Errorf("want rcode %d, got %d", tt.wantRcode, got)
+			}
+			if got := len(qCtx.R().Answer); got != tt.wantAnswer {
+				t.Errorf("want %d answers, got %d", tt.wantAnswer, got)
+			}
+		})
+	}
+}
@@ -39,6 +39,7 @@ func init() {
 }
 
 var _ coremain.ExecutablePlugin = (*redirectPlugin)(nil)
+var _ coremain.AnswerModifier = (*redirectPlugin)(nil)
 
 type Args struct {
 	Rule []string `yaml:"rule"`
@@ -126,6 +127,12 @@ func (r *redirectPlugin) Exec(ctx context.Context, qCtx *query_context.Context,
 	return err
 }
 
+// ModifiesAnswer implements coremain.AnswerModifier. The inserted CNAME
+// record is never signed.
+func (r *redirectPlugin) ModifiesAnswer() bool {
+	return true
+}
+
 func (r *redirectPlugin) Close() error {
 	_ = r.m.Close()
 	return nil
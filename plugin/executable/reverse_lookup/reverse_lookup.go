@@ -28,6 +28,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache/redis_cache"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/go-redis/redis/v8"
 	"github.com/miekg/dns"
@@ -66,8 +67,9 @@ func (a *Args) initDefault() *Args {
 
 type reverseLookup struct {
 	*coremain.BP
-	args *Args
-	c    cache.Backend
+	args      *Args
+	c         cache.Backend
+	cleanTask *scheduler.Task // of the memory cache
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -92,14 +94,28 @@ func newReverseLookup(bp *coremain.BP, args *Args) (coremain.Plugin, error) {
 			return nil, fmt.Errorf("failed to init redis cache, %w", err)
 		}
 		c = rc
-	} else {
-		c = mem_cache.NewMemCache(args.Size, 0)
 	}
 	p := &reverseLookup{
 		BP:   bp,
 		args: args,
-		c:    c,
 	}
+	if c == nil {
+		mc := mem_cache.NewMemCache(args.Size)
+		var err error
+		p.cleanTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+			Name: fmt.Sprintf("plugin/%s/clean", bp.Tag()),
+			Func: func(context.Context) error {
+				mc.Clean()
+				return nil
+			},
+			Schedule: scheduler.Every(mem_cache.CleanInterval),
+		})
+		if err != nil {
+			return nil, err
+		}
+		c = mc
+	}
+	p.c = c
 	return p, nil
 }
 
@@ -118,6 +134,9 @@ func (p *reverseLookup) Exec(ctx context.Context, qCtx *query_context.Context, n
 }
 
 func (p *reverseLookup) Close() error {
+	if p.cleanTask != nil {
+		p.cleanTask.Cancel()
+	}
 	return p.c.Close()
 }
 
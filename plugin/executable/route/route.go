@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/route_utils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/IrineSistiana/mosdns/v4/plugin/executable/internal/resp_addr"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const PluginType = "route"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*routePlugin)(nil)
+
+// Args configures the routes that are installed for the addresses of
+// responses, e.g. to route some domains through a tunnel. Routes expire
+// with the ttl of their records and are removed when the plugin is
+// closed.
+type Args struct {
+	resp_addr.Args `yaml:",squash"`
+
+	// Gateway is the gateway of the routes. If it is set, only addresses
+	// of the same family are routed.
+	Gateway string `yaml:"gateway"`
+
+	// Interface is the outgoing interface of the routes, e.g. "wg0".
+	// At least one of Gateway and Interface is required.
+	Interface string `yaml:"interface"`
+
+	Table  uint32 `yaml:"table"` // default is the main table
+	Metric uint32 `yaml:"metric"`
+	Mask4  int    `yaml:"mask4"` // default 32
+	Mask6  int    `yaml:"mask6"` // default 128
+}
+
+type routePlugin struct {
+	*coremain.BP
+	args *Args
+	gw   netip.Addr // maybe invalid
+	h    *resp_addr.Helper
+	m    *route_utils.Manager
+
+	cleanTask *scheduler.Task // nil in tests
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	p, err := newRoutePlugin(bp, args.(*Args), route_utils.ManagerOpts{})
+	if err != nil {
+		return nil, err
+	}
+	p.cleanTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/clean", bp.Tag()),
+		Func: func(context.Context) error {
+			p.m.Clean(time.Now())
+			return nil
+		},
+		Schedule: scheduler.Every(route_utils.CleanInterval),
+	})
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// newRoutePlugin creates a routePlugin. The Route and Logger of opts are
+// set from args and bp.
+func newRoutePlugin(bp *coremain.BP, args *Args, opts route_utils.ManagerOpts) (*routePlugin, error) {
+	if m := args.Mask4; m <= 0 || m > 32 {
+		args.Mask4 = 32
+	}
+	if m := args.Mask6; m <= 0 || m > 128 {
+		args.Mask6 = 128
+	}
+	p := &routePlugin{BP: bp, args: args}
+	if len(args.Gateway) > 0 {
+		gw, err := netip.ParseAddr(args.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway, %w", err)
+		}
+		p.gw = gw.Unmap()
+		opts.Route.Gateway = p.gw
+	}
+	if len(args.Interface) > 0 {
+		iface, err := net.InterfaceByName(args.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface, %w", err)
+		}
+		opts.Route.Ifindex = iface.Index
+	}
+	if !opts.Route.Gateway.IsValid() && opts.Route.Ifindex == 0 {
+		return nil, errors.New("route requires a gateway or an interface")
+	}
+	opts.Route.Table = args.Table
+	opts.Route.Metric = args.Metric
+	opts.Logger = bp.L()
+
+	h, err := resp_addr.NewHelper(bp, args.Args)
+	if err != nil {
+		return nil, err
+	}
+	m, err := route_utils.NewManager(opts)
+	if err != nil {
+		_ = h.Close()
+		return nil, fmt.Errorf("failed to init route manager, %w", err)
+	}
+	p.h = h
+	p.m = m
+	return p, nil
+}
+
+// Exec tries to add routes for all qCtx.R() IPs.
+// If an error occurred, Exec will just log it.
+func (p *routePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := qCtx.RReadOnly(); r != nil && p.h.MatchDomain(qCtx) {
+		if err := p.addRoutes(r); err != nil {
+			p.L().Warn("failed to add routes", qCtx.InfoField(), zap.Error(err))
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *routePlugin) addRoutes(r *dns.Msg) error {
+	for _, rr := range r.Answer {
+		var dst netip.Prefix
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok {
+				return fmt.Errorf("invalid A record with ip: %s", rr.A)
+			}
+			dst = netip.PrefixFrom(addr, p.args.Mask4).Masked()
+		case *dns.AAAA:
+			addr, ok := netip.AddrFromSlice(rr.AAAA.To16())
+			if !ok {
+				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
+			}
+			dst = netip.PrefixFrom(addr, p.args.Mask6).Masked()
+		default:
+			continue
+		}
+		if p.gw.IsValid() && p.gw.Is4() != dst.Addr().Is4() {
+			continue
+		}
+
+		if err := p.m.Add(dst, time.Duration(p.h.Timeout(rr))*time.Second); err != nil {
+			return fmt.Errorf("failed to add route to %s, %w", dst, err)
+		}
+	}
+	return nil
+}
+
+func (p *routePlugin) Close() error {
+	if p.cleanTask != nil {
+		p.cleanTask.Cancel()
+	}
+	_ = p.h.Close()
+	return p.m.Close()
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package route
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/route_utils"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_routePlugin(t *testing.T) {
+	var mu sync.Mutex
+	routes := make(map[netip.Prefix]route_utils.Route)
+	opts := route_utils.ManagerOpts{
+		AddFunc: func(r route_utils.Route) error {
+			mu.Lock()
+			defer mu.Unlock()
+			routes[r.Dst] = r
+			return nil
+		},
+		DelFunc: func(r route_utils.Route) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delete(routes, r.Dst)
+			return nil
+		},
+	}
+	p, err := newRoutePlugin(coremain.NewBP("test", PluginType, nil, nil), &Args{Gateway: "10.0.0.1", Mask4: 24}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: "example.com.", Class: dns.ClassINET, Ttl: 300}
+	r.Answer = []dns.RR{
+		&dns.A{Hdr: hdr, A: net.ParseIP("1.1.1.1")},
+		&dns.A{Hdr: hdr, A: net.ParseIP("1.1.1.2")},
+		&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")},
+	}
+	qCtx := query_context.NewContext(q, nil)
+	qCtx.SetResponse(r)
+	if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p.m.Clean(time.Now()) // waits for the queued adds
+	mu.Lock()
+	if len(routes) != 1 {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+	rt, ok := routes[netip.MustParsePrefix("1.1.1.0/24")]
+	mu.Unlock()
+	if !ok || rt.Gateway != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("unexpected route %v", rt)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 0 {
+		t.Fatal("routes are not removed after close")
+	}
+
+	if _, err := newRoutePlugin(coremain.NewBP("test", PluginType, nil, nil), &Args{}, opts); err == nil {
+		t.Fatal("expect an error without gateway and interface")
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/rpz"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const PluginType = "rpz"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*rpzPlugin)(nil)
+var _ coremain.AnswerModifier = (*rpzPlugin)(nil)
+
+type Args struct {
+	// Zones are the policy zones, in order of precedence. Each zone can be
+	// a file path or "provider:tag".
+	Zones []string `yaml:"zones"`
+}
+
+// rpzPlugin applies response policy zones.
+// Client ip and qname triggers are checked before the query is forwarded.
+// Ip, nsdname and nsip triggers are checked against the response. As a
+// forwarder, nsdname and nsip can only be checked against the NS records
+// in the response and their glue records.
+type rpzPlugin struct {
+	*coremain.BP
+	zones  []func() *rpz.Zone
+	closer []func()
+
+	hitTotal *prometheus.CounterVec
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	r, err := newRPZ(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(r.hitTotal)
+	return r, nil
+}
+
+func newRPZ(bp *coremain.BP, args *Args) (*rpzPlugin, error) {
+	p := &rpzPlugin{
+		BP: bp,
+		hitTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hit_total",
+			Help: "The total number of policy hits",
+		}, []string{"trigger", "action"}),
+	}
+
+	for _, s := range args.Zones {
+		if strings.HasPrefix(s, "provider:") {
+			providerName := strings.TrimPrefix(s, "provider:")
+			provider := bp.M().GetDataManager().GetDataProvider(providerName)
+			if provider == nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("cannot find provider %s", providerName)
+			}
+			dz := rpz.NewDynamicZone()
+			if err := provider.LoadAndAddListener(dz); err != nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("failed to load zone from provider %s, %w", providerName, err)
+			}
+			p.zones = append(p.zones, dz.Zone)
+			p.closer = append(p.closer, func() { provider.DeleteListener(dz) })
+			bp.L().Info("zone loaded", zap.String("origin", dz.Zone().Origin()), zap.Int("length", dz.Zone().Len()))
+		} else {
+			z, err := loadZoneFile(s)
+			if err != nil {
+				_ = p.Close()
+				return nil, err
+			}
+			p.zones = append(p.zones, func() *rpz.Zone { return z })
+			bp.L().Info("zone loaded", zap.String("origin", z.Origin()), zap.Int("length", z.Len()))
+		}
+	}
+	return p, nil
+}
+
+func loadZoneFile(s string) (*rpz.Zone, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, _, err := rpz.ParseZone(f, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load zone file %s, %w", s, err)
+	}
+	return z, nil
+}
+
+type hit struct {
+	z       *rpz.Zone
+	trigger rpz.Trigger
+	rule    *rpz.Rule
+}
+
+func (p *rpzPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	if h := p.lookupQuery(qCtx); h != nil {
+		if done := p.apply(qCtx, h); done {
+			return nil
+		}
+		if h.rule.Action == rpz.ActionPassthru {
+			return executable_seq.ExecChainNode(ctx, qCtx, next)
+		}
+	}
+
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+
+	if r := qCtx.R(); r != nil {
+		if h := p.lookupResponse(r); h != nil {
+			p.apply(qCtx, h)
+		}
+	}
+	return nil
+}
+
+func (p *rpzPlugin) lookupQuery(qCtx *query_context.Context) *hit {
+	clientAddr := qCtx.ReqMeta().ClientAddr
+	qName := qCtx.Q().Question[0].Name
+	for _, zf := range p.zones {
+		z := zf()
+		if rule := z.LookupClientIP(clientAddr); rule != nil {
+			return &hit{z: z, trigger: rpz.TriggerClientIP, rule: rule}
+		}
+		if rule := z.LookupQName(qName); rule != nil {
+			return &hit{z: z, trigger: rpz.TriggerQName, rule: rule}
+		}
+	}
+	return nil
+}
+
+func (p *rpzPlugin) lookupResponse(r *dns.Msg) *hit {
+	for _, zf := range p.zones {
+		z := zf()
+		// qname triggers also apply to the names in the cname chain.
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				if rule := z.LookupQName(cname.Target); rule != nil {
+					return &hit{z: z, trigger: rpz.TriggerQName, rule: rule}
+				}
+			}
+		}
+		for _, rr := range r.Answer {
+			if rule := z.LookupIP(rrAddr(rr)); rule != nil {
+				return &hit{z: z, trigger: rpz.TriggerIP, rule: rule}
+			}
+		}
+
+		nsNames := make(map[string]struct{})
+		for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+			for _, rr := range section {
+				if ns, ok := rr.(*dns.NS); ok {
+					if rule := z.LookupNSDName(ns.Ns); rule != nil {
+						return &hit{z: z, trigger: rpz.TriggerNSDName, rule: rule}
+					}
+					nsNames[strings.ToLower(ns.Ns)] = struct{}{}
+				}
+			}
+		}
+		for _, rr := range r.Extra {
+			if _, ok := nsNames[strings.ToLower(rr.Header().Name)]; !ok {
+				continue
+			}
+			if rule := z.LookupNSIP(rrAddr(rr)); rule != nil {
+				return &hit{z: z, trigger: rpz.TriggerNSIP, rule: rule}
+			}
+		}
+	}
+	return nil
+}
+
+// apply applies the policy of h to qCtx. It reports whether the
+// response has been determined by the policy.
+func (p *rpzPlugin) apply(qCtx *query_context.Context, h *hit) bool {
+	p.hitTotal.WithLabelValues(h.trigger.String(), h.rule.Action.String()).Inc()
+	p.L().Info(
+		"policy hit",
+		qCtx.InfoField(),
+		zap.String("zone", h.z.Origin()),
+		zap.Stringer("trigger", h.trigger),
+		zap.String("rule", h.rule.Owner),
+		zap.Stringer("action", h.rule.Action),
+	)
+
+	ede := "rpz " + h.z.Origin()
+	switch h.rule.Action {
+	case rpz.ActionPassthru:
+		return false
+	case rpz.ActionDrop:
+		// mosdns always replies. The query will be answered with SERVFAIL.
+		qCtx.SetResponse(nil)
+		qCtx.SetEDE(dns.ExtendedErrorCodeBlocked, ede)
+		return true
+	}
+	r := h.rule.Response(qCtx.Q(), qCtx.ReqMeta().FromUDP)
+	if r == nil {
+		return false
+	}
+	qCtx.SetResponse(r)
+	qCtx.SetEDE(dns.ExtendedErrorCodeBlocked, ede)
+	return true
+}
+
+func rrAddr(rr dns.RR) netip.Addr {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
+
+// ModifiesAnswer implements coremain.AnswerModifier. Policy actions
+// replace responses with unsigned data.
+func (p *rpzPlugin) ModifiesAnswer() bool {
+	return true
+}
+
+func (p *rpzPlugin) Close() error {
+	for _, f := range p.closer {
+		f()
+	}
+	return nil
+}
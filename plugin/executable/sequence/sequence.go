@@ -25,6 +25,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
 )
 
 const PluginType = "sequence"
@@ -36,10 +37,16 @@ func init() {
 	})
 }
 
+var _ coremain.AnswerModifier = (*sequence)(nil)
+var _ coremain.DNSSECPassthroughEnabler = (*sequence)(nil)
+
 type sequence struct {
 	*coremain.BP
 
 	ecs executable_seq.ExecutableChainNode
+
+	modifiesAnswer    bool
+	dnssecPassthrough bool
 }
 
 type Args struct {
@@ -56,10 +63,70 @@ func newSequencePlugin(bp *coremain.BP, args *Args) (*sequence, error) {
 		return nil, fmt.Errorf("cannot build sequence: %w", err)
 	}
 
-	return &sequence{
+	s := &sequence{
 		BP:  bp,
 		ecs: ecs,
-	}, nil
+	}
+	s.checkDNSSEC(args.Exec, bp.M().GetExecutables())
+	return s, nil
+}
+
+// checkDNSSEC warns if the DNSSEC pass-through mode is enabled in this
+// sequence but some plugins may still modify answers.
+func (s *sequence) checkDNSSEC(exec interface{}, execs map[string]executable_seq.Executable) {
+	var modifiers []string
+	walkTags(exec, func(tag string) {
+		switch e := execs[tag].(type) {
+		case *sequence:
+			s.dnssecPassthrough = s.dnssecPassthrough || e.dnssecPassthrough
+			if e.modifiesAnswer {
+				s.modifiesAnswer = true
+				modifiers = append(modifiers, tag)
+			}
+			return
+		case coremain.DNSSECPassthroughEnabler:
+			if e.EnablesDNSSECPassthrough() {
+				s.dnssecPassthrough = true
+			}
+		}
+		if m, ok := execs[tag].(coremain.AnswerModifier); ok && m.ModifiesAnswer() {
+			s.modifiesAnswer = true
+			modifiers = append(modifiers, tag)
+		}
+	})
+	if s.dnssecPassthrough && len(modifiers) > 0 {
+		s.L().Warn(
+			"dnssec pass-through is enabled, but these plugins may still modify answers and invalidate signatures",
+			zap.Strings("plugins", modifiers),
+		)
+	}
+}
+
+// walkTags calls f with every string in the exec config, except
+// conditions of if blocks.
+func walkTags(in interface{}, f func(tag string)) {
+	switch v := in.(type) {
+	case string:
+		f(v)
+	case []interface{}:
+		for _, e := range v {
+			walkTags(e, f)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if k != "if" {
+				walkTags(e, f)
+			}
+		}
+	}
+}
+
+func (s *sequence) ModifiesAnswer() bool {
+	return s.modifiesAnswer
+}
+
+func (s *sequence) EnablesDNSSECPassthrough() bool {
+	return s.dnssecPassthrough
 }
 
 func (s *sequence) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package special_use
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+const PluginType = "special_use"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*specialUse)(nil)
+
+// Args configures the special-use domains that are answered locally.
+// By default, all of them are answered.
+type Args struct {
+	// Exclude are the special-use domains that are passed to the rest of
+	// the sequence, e.g. "home.arpa" if it is served by a local server.
+	Exclude []string `yaml:"exclude"`
+}
+
+const localhostTTL = 300
+
+// specialDomain is a special-use domain and how it is answered.
+type specialDomain struct {
+	zone string
+
+	// localhost names have loopback addresses (RFC 6761 6.3).
+	localhost bool
+
+	// The zone is an empty local zone (RFC 8375). Its apex exists
+	// and has no record but the SOA.
+	emptyZone bool
+}
+
+var specialDomains = []specialDomain{
+	{zone: "localhost.", localhost: true}, // RFC 6761
+	{zone: "invalid."},                    // RFC 6761
+	{zone: "test."},                       // RFC 6761
+	{zone: "onion."},                      // RFC 7686
+	{zone: "local."},                      // RFC 6762, mDNS only
+	{zone: "home.arpa.", emptyZone: true}, // RFC 8375
+}
+
+type specialUse struct {
+	*coremain.BP
+	domains []specialDomain
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newSpecialUse(bp, args.(*Args))
+}
+
+func newSpecialUse(bp *coremain.BP, args *Args) (*specialUse, error) {
+	exclude := make(map[string]struct{})
+	for _, s := range args.Exclude {
+		zone := dns.Fqdn(strings.ToLower(strings.Trim(s, ".")))
+		if !isSpecialDomain(zone) {
+			return nil, fmt.Errorf("%s is not a special-use domain", s)
+		}
+		exclude[zone] = struct{}{}
+	}
+	p := &specialUse{BP: bp}
+	for _, d := range specialDomains {
+		if _, ok := exclude[d.zone]; !ok {
+			p.domains = append(p.domains, d)
+		}
+	}
+	return p, nil
+}
+
+func isSpecialDomain(zone string) bool {
+	for _, d := range specialDomains {
+		if d.zone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *specialUse) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r := p.lookup(qCtx.QReadOnly())
+	if r == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// lookup returns the response of q. It returns nil if q is not a
+// special-use name.
+func (p *specialUse) lookup(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	for _, d := range p.domains {
+		if name != d.zone && !strings.HasSuffix(name, "."+d.zone) {
+			continue
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.RecursionAvailable = true
+		switch {
+		case d.localhost:
+			if rr := localhostRR(question); rr != nil {
+				r.Answer = []dns.RR{rr}
+				return r
+			}
+		case d.emptyZone && name == d.zone:
+		default:
+			r.Rcode = dns.RcodeNameError
+		}
+		r.Ns = []dns.RR{dnsutils.FakeSOA(d.zone)}
+		return r
+	}
+	return nil
+}
+
+// localhostRR returns the loopback address record of question. It returns
+// nil if question is not an A or AAAA question.
+func localhostRR(question dns.Question) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    localhostTTL,
+	}
+	switch question.Qtype {
+	case dns.TypeA:
+		return &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}
+	case dns.TypeAAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package special_use
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_specialUse(t *testing.T) {
+	p, err := newSpecialUse(coremain.NewBP("test", PluginType, nil, nil), &Args{Exclude: []string{"Local."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		qName     string
+		qType     uint16
+		wantNil   bool
+		wantRcode int
+		wantAns   string
+	}{
+		{"localhost A", "localhost.", dns.TypeA, false, dns.RcodeSuccess, "127.0.0.1"},
+		{"localhost AAAA", "a.LocalHost.", dns.TypeAAAA, false, dns.RcodeSuccess, "::1"},
+		{"localhost MX", "localhost.", dns.TypeMX, false, dns.RcodeSuccess, ""},
+		{"invalid", "a.invalid.", dns.TypeA, false, dns.RcodeNameError, ""},
+		{"test", "test.", dns.TypeA, false, dns.RcodeNameError, ""},
+		{"onion", "abc.onion.", dns.TypeA, false, dns.RcodeNameError, ""},
+		{"home.arpa apex", "home.arpa.", dns.TypeSOA, false, dns.RcodeSuccess, ""},
+		{"home.arpa", "nas.home.arpa.", dns.TypeA, false, dns.RcodeNameError, ""},
+		{"excluded", "printer.local.", dns.TypeA, true, 0, ""},
+		{"not special", "mytest.", dns.TypeA, true, 0, ""},
+		{"not special subdomain", "localhost.example.com.", dns.TypeA, true, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qType)
+			r := p.lookup(q)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatalf("unexpected response %v", r)
+				}
+				return
+			}
+			if r == nil || r.Rcode != tt.wantRcode {
+				t.Fatalf("unexpected response %v", r)
+			}
+			if len(tt.wantAns) > 0 {
+				if len(r.Answer) != 1 {
+					t.Fatalf("unexpected answer %v", r.Answer)
+				}
+				var got string
+				switch rr := r.Answer[0].(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.AAAA:
+					got = rr.AAAA.String()
+				}
+				if got != tt.wantAns {
+					t.Fatalf("got answer %s, want %s", got, tt.wantAns)
+				}
+				return
+			}
+			if len(r.Answer) != 0 || len(r.Ns) != 1 {
+				t.Fatalf("unexpected response %v", r)
+			}
+		})
+	}
+
+	if _, err := newSpecialUse(coremain.NewBP("test", PluginType, nil, nil), &Args{Exclude: []string{"example.com"}}); err == nil {
+		t.Fatal("expect an error for a non special-use domain")
+	}
+}
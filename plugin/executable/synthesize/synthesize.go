@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package synthesize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strings"
+)
+
+const PluginType = "synthesize"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*synthesize)(nil)
+
+const defaultTTL = 300
+
+type Args struct {
+	Rules []RuleArgs `yaml:"rules"`
+}
+
+// RuleArgs synthesizes records for all names under Suffix. The suffix
+// itself is not included. Exactly one of IP, CNAME and EmbeddedIP
+// must be set.
+type RuleArgs struct {
+	Suffix string `yaml:"suffix"` // required, e.g. "apps.lan"
+
+	// IP answers A/AAAA queries with these addresses.
+	// e.g. "*.apps.lan -> 192.168.1.10".
+	IP []string `yaml:"ip"`
+
+	// CNAME answers all queries with a CNAME record to this name.
+	CNAME string `yaml:"cname"`
+
+	// EmbeddedIP answers A/AAAA queries with the address embedded in the
+	// name, like sslip.io and nip.io. Supported forms are
+	// "10.1.2.3.<suffix>", "10-1-2-3.<suffix>", "app-10-1-2-3.<suffix>",
+	// "app.10-1-2-3.<suffix>" and "2001-db8--1.<suffix>" (ipv6).
+	// Names without an address are passed to the next node.
+	EmbeddedIP bool `yaml:"embedded_ip"`
+
+	TTL uint32 `yaml:"ttl"` // Default is 300.
+}
+
+type rule struct {
+	suffix     string // fqdn, lower case
+	ipv4, ipv6 []netip.Addr
+	cname      string
+	embeddedIP bool
+	ttl        uint32
+}
+
+type synthesize struct {
+	*coremain.BP
+	rules []*rule
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newSynthesize(bp, args.(*Args))
+}
+
+func newSynthesize(bp *coremain.BP, args *Args) (*synthesize, error) {
+	if len(args.Rules) == 0 {
+		return nil, errors.New("no rule is configured")
+	}
+	p := &synthesize{BP: bp}
+	for i, ra := range args.Rules {
+		r, err := parseRule(&ra)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule #%d, %w", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func parseRule(ra *RuleArgs) (*rule, error) {
+	if len(ra.Suffix) == 0 {
+		return nil, errors.New("missing suffix")
+	}
+	if _, ok := dns.IsDomainName(ra.Suffix); !ok {
+		return nil, fmt.Errorf("invalid suffix %s", ra.Suffix)
+	}
+	r := &rule{
+		suffix:     dns.Fqdn(strings.ToLower(ra.Suffix)),
+		embeddedIP: ra.EmbeddedIP,
+		ttl:        ra.TTL,
+	}
+	if r.ttl == 0 {
+		r.ttl = defaultTTL
+	}
+
+	set := 0
+	if len(ra.IP) > 0 {
+		set++
+		for _, s := range ra.IP {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip %s, %w", s, err)
+			}
+			addr = addr.Unmap()
+			if addr.Is4() {
+				r.ipv4 = append(r.ipv4, addr)
+			} else {
+				r.ipv6 = append(r.ipv6, addr)
+			}
+		}
+	}
+	if len(ra.CNAME) > 0 {
+		set++
+		if _, ok := dns.IsDomainName(ra.CNAME); !ok {
+			return nil, fmt.Errorf("invalid cname %s", ra.CNAME)
+		}
+		r.cname = dns.Fqdn(ra.CNAME)
+	}
+	if ra.EmbeddedIP {
+		set++
+	}
+	if set != 1 {
+		return nil, errors.New("one and only one of ip, cname and embedded_ip must be set")
+	}
+	return r, nil
+}
+
+func (p *synthesize) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookup(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// lookup returns the synthesized response of q. It returns nil if q
+// does not match any rule.
+func (p *synthesize) lookup(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+
+	for _, rule := range p.rules {
+		sub, ok := trimSuffix(name, rule.suffix)
+		if !ok {
+			continue
+		}
+
+		ipv4, ipv6 := rule.ipv4, rule.ipv6
+		if rule.embeddedIP {
+			addr, ok := parseEmbeddedIP(sub)
+			if !ok {
+				return nil
+			}
+			ipv4, ipv6 = nil, nil
+			if addr.Is4() {
+				ipv4 = []netip.Addr{addr}
+			} else {
+				ipv6 = []netip.Addr{addr}
+			}
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		r.RecursionAvailable = true
+		hdr := func(typ uint16) dns.RR_Header {
+			return dns.RR_Header{Name: question.Name, Rrtype: typ, Class: dns.ClassINET, Ttl: rule.ttl}
+		}
+		switch {
+		case len(rule.cname) > 0:
+			r.Answer = append(r.Answer, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: rule.cname})
+		case question.Qtype == dns.TypeA:
+			for _, addr := range ipv4 {
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr(dns.TypeA), A: addr.AsSlice()})
+			}
+		case question.Qtype == dns.TypeAAAA:
+			for _, addr := range ipv6 {
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: addr.AsSlice()})
+			}
+		}
+		if len(r.Answer) == 0 {
+			r.Ns = []dns.RR{dnsutils.FakeSOA(question.Name)}
+		}
+		return r
+	}
+	return nil
+}
+
+// trimSuffix returns the labels of name before suffix, without the
+// trailing dot. ok is false if name is not a subdomain of suffix.
+func trimSuffix(name, suffix string) (string, bool) {
+	if suffix == "." {
+		if name == "." {
+			return "", false
+		}
+		return strings.TrimSuffix(name, "."), true
+	}
+	if len(name) <= len(suffix) || !strings.HasSuffix(name, suffix) || name[len(name)-len(suffix)-1] != '.' {
+		return "", false
+	}
+	return name[:len(name)-len(suffix)-1], true
+}
+
+// parseEmbeddedIP parses the ip address embedded in sub, the labels of the
+// name before the suffix. The address in the labels closer to the suffix
+// takes precedence.
+func parseEmbeddedIP(sub string) (netip.Addr, bool) {
+	labels := strings.Split(sub, ".")
+
+	// Dotted ipv4, "10.1.2.3".
+	if len(labels) >= 4 {
+		if addr, err := netip.ParseAddr(strings.Join(labels[len(labels)-4:], ".")); err == nil && addr.Is4() {
+			return addr, true
+		}
+	}
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		l := labels[i]
+
+		// Dashed ipv4 with an optional prefix, "10-1-2-3", "app-10-1-2-3".
+		if parts := strings.Split(l, "-"); len(parts) >= 4 {
+			s := strings.Join(parts[len(parts)-4:], ".")
+			if addr, err := netip.ParseAddr(s); err == nil && addr.Is4() {
+				return addr, true
+			}
+		}
+
+		// Dashed ipv6, "2001-db8--1".
+		if strings.Count(l, "-") >= 2 {
+			if addr, err := netip.ParseAddr(strings.ReplaceAll(l, "-", ":")); err == nil && addr.Is6() && addr.Zone() == "" {
+				return addr, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
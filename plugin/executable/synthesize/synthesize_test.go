@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package synthesize
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func Test_parseEmbeddedIP(t *testing.T) {
+	tests := []struct {
+		sub  string
+		want string
+	}{
+		{"10.1.2.3", "10.1.2.3"},
+		{"app.10.1.2.3", "10.1.2.3"},
+		{"10-1-2-3", "10.1.2.3"},
+		{"ip-10-1-2-3", "10.1.2.3"},
+		{"app.10-1-2-3", "10.1.2.3"},
+		{"10-1-2-3.app", "10.1.2.3"},
+		{"2001-db8--1", "2001:db8::1"},
+		{"app.2001-db8--1", "2001:db8::1"},
+		{"app", ""},
+		{"1.2.3", ""},
+		{"10-1-2-256", ""},
+		{"a-b-c", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			got, ok := parseEmbeddedIP(tt.sub)
+			if len(tt.want) == 0 {
+				if ok {
+					t.Fatalf("want no ip, got %s", got)
+				}
+				return
+			}
+			if !ok || got != netip.MustParseAddr(tt.want) {
+				t.Fatalf("got %s %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func Test_synthesize_lookup(t *testing.T) {
+	p, err := newSynthesize(coremain.NewBP("test", PluginType, nil, nil), &Args{Rules: []RuleArgs{
+		{Suffix: "apps.lan", IP: []string{"192.168.1.10", "fd00::10"}},
+		{Suffix: "sslip.lan", EmbeddedIP: true, TTL: 60},
+		{Suffix: "svc.lan", CNAME: "ingress.lan"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		qtype      uint16
+		wantNil    bool
+		wantAnswer []string // rdata
+	}{
+		{"a.apps.lan.", dns.TypeA, false, []string{"192.168.1.10"}},
+		{"x.y.APPS.lan.", dns.TypeAAAA, false, []string{"fd00::10"}},
+		{"a.apps.lan.", dns.TypeMX, false, nil},
+		{"apps.lan.", dns.TypeA, true, nil},
+		{"xapps.lan.", dns.TypeA, true, nil},
+		{"ip-10-1-2-3.sslip.lan.", dns.TypeA, false, []string{"10.1.2.3"}},
+		{"ip-10-1-2-3.sslip.lan.", dns.TypeAAAA, false, nil},
+		{"2001-db8--1.sslip.lan.", dns.TypeAAAA, false, []string{"2001:db8::1"}},
+		{"app.sslip.lan.", dns.TypeA, true, nil},
+		{"a.svc.lan.", dns.TypeA, false, []string{"ingress.lan."}},
+		{"example.com.", dns.TypeA, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.name, tt.qtype)
+			r := p.lookup(q)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatalf("want nil, got %s", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("want response, got nil")
+			}
+			if len(r.Answer) != len(tt.wantAnswer) {
+				t.Fatalf("unexpected answer %v", r.Answer)
+			}
+			for i, rr := range r.Answer {
+				var got string
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.AAAA:
+					got = rr.AAAA.String()
+				case *dns.CNAME:
+					got = rr.Target
+				}
+				if got != tt.wantAnswer[i] || rr.Header().Name != tt.name {
+					t.Fatalf("unexpected answer %s", rr)
+				}
+			}
+			if len(r.Answer) == 0 && len(r.Ns) == 0 {
+				t.Fatal("empty response should have a soa")
+			}
+		})
+	}
+}
+
+func Test_parseRule(t *testing.T) {
+	for _, ra := range []RuleArgs{
+		{IP: []string{"1.1.1.1"}},
+		{Suffix: "lan"},
+		{Suffix: "lan", IP: []string{"1.1.1.1"}, EmbeddedIP: true},
+		{Suffix: "lan", IP: []string{"not an ip"}},
+	} {
+		if _, err := parseRule(&ra); err == nil {
+			t.Fatalf("%+v should be invalid", ra)
+		}
+	}
+}
@@ -40,32 +40,34 @@ var _ coremain.ExecutablePlugin = (*ttl)(nil)
 type Args struct {
 	MaximumTTL uint32 `yaml:"maximum_ttl"`
 	MinimalTTL uint32 `yaml:"minimal_ttl"`
+
+	// Rules overwrite MaximumTTL and MinimalTTL for specific record types.
+	Rules []dnsutils.TTLRuleConfig `yaml:"rules"`
 }
 
 type ttl struct {
 	*coremain.BP
-	args *Args
+	policy *dnsutils.TTLPolicy
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
-	return newTTL(bp, args.(*Args)), nil
+	return newTTL(bp, args.(*Args))
 }
 
-func newTTL(bp *coremain.BP, args *Args) coremain.Plugin {
-	return &ttl{
-		BP:   bp,
-		args: args,
+func newTTL(bp *coremain.BP, args *Args) (coremain.Plugin, error) {
+	policy, err := dnsutils.NewTTLPolicy(args.Rules, args.MaximumTTL, args.MinimalTTL)
+	if err != nil {
+		return nil, err
 	}
+	return &ttl{
+		BP:     bp,
+		policy: policy,
+	}, nil
 }
 
 func (t *ttl) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	if r := qCtx.R(); r != nil {
-		if t.args.MaximumTTL > 0 {
-			dnsutils.ApplyMaximumTTL(r, t.args.MaximumTTL)
-		}
-		if t.args.MinimalTTL > 0 {
-			dnsutils.ApplyMinimalTTL(r, t.args.MinimalTTL)
-		}
+		t.policy.Apply(r)
 	}
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
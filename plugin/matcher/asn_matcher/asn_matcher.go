@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package asnmatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+)
+
+const PluginType = "asn_matcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*asnMatcher)(nil)
+
+type Args struct {
+	// Database is the tag of the data provider of the asn database.
+	// It can be a MaxMind GeoLite2-ASN mmdb or an ip2asn TSV file.
+	Database string `yaml:"database"`
+
+	// ASN contains the AS numbers to match, e.g. "13335" or "AS13335".
+	ASN []string `yaml:"asn"`
+}
+
+// asnMatcher matches the A/AAAA records in the response by
+// their origin AS numbers.
+type asnMatcher struct {
+	*coremain.BP
+	matcher executable_seq.Matcher
+	closer  io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newASNMatcher(bp, args.(*Args), bp.M().GetDataManager())
+}
+
+func newASNMatcher(bp *coremain.BP, args *Args, dm *data_provider.DataManager) (*asnMatcher, error) {
+	if len(args.Database) == 0 {
+		return nil, errors.New("database is required")
+	}
+	if len(args.ASN) == 0 {
+		return nil, errors.New("asn is required")
+	}
+
+	l, err := netlist.BatchLoadProvider(
+		[]string{fmt.Sprintf("provider:%s:%s", args.Database, strings.Join(args.ASN, ","))},
+		dm,
+	)
+	if err != nil {
+		return nil, err
+	}
+	bp.L().Info("asn matcher loaded", zap.Int("length", l.Len()))
+	return &asnMatcher{
+		BP:      bp,
+		matcher: msg_matcher.NewAAAAAIPMatcher(l),
+		closer:  l,
+	}, nil
+}
+
+func (m *asnMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	return m.matcher.Match(ctx, qCtx)
+}
+
+func (m *asnMatcher) Close() error {
+	return m.closer.Close()
+}
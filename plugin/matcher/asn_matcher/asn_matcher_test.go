@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package asnmatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+)
+
+func Test_asnMatcher(t *testing.T) {
+	dm := data_provider.NewDataManager()
+	dp, err := data_provider.NewDataProvider(zap.NewNop(), nil, data_provider.DataProviderConfig{
+		Tag:  "ip2asn",
+		File: "testdata/ip2asn.tsv",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	dm.AddDataProvider("ip2asn", dp)
+
+	newResp := func(rrs ...dns.RR) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = rrs
+		qCtx.SetResponse(r)
+		return qCtx
+	}
+	a := func(ip string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)}
+	}
+	aaaa := func(ip string) dns.RR {
+		return &dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP(ip)}
+	}
+
+	tests := []struct {
+		name string
+		asn  []string
+		resp *query_context.Context
+		want bool
+	}{
+		{"a", []string{"13335"}, newResp(a("1.0.0.1")), true},
+		{"aaaa", []string{"AS13335"}, newResp(aaaa("2606:4700::1")), true},
+		{"any record", []string{"15169"}, newResp(a("1.0.0.1"), a("8.8.8.8")), true},
+		{"multiple asn", []string{"as13335", "15169"}, newResp(a("8.8.8.8")), true},
+		{"other asn", []string{"13335"}, newResp(a("8.8.8.8")), false},
+		{"not routed", []string{"13335"}, newResp(a("1.0.1.1")), false},
+		{"not in database", []string{"13335"}, newResp(a("192.168.1.1")), false},
+		{"no answer", []string{"13335"}, newResp(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newASNMatcher(coremain.NewBP("test", PluginType, nil, nil), &Args{Database: "ip2asn", ASN: tt.asn}, dm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			got, err := m.Match(context.Background(), tt.resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, args := range []*Args{
+		{ASN: []string{"13335"}},
+		{Database: "ip2asn"},
+		{Database: "not_exist", ASN: []string{"13335"}},
+	} {
+		if _, err := newASNMatcher(coremain.NewBP("test", PluginType, nil, nil), args, dm); err == nil {
+			t.Fatalf("want err for args %+v", args)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_matcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const PluginType = "client_matcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*clientMatcher)(nil)
+
+type Args struct {
+	// MAC is a list of mac addresses, e.g. "aa:bb:cc:dd:ee:ff".
+	MAC []string `yaml:"mac"`
+
+	// Hostname is a list of hostnames in the dhcp leases. Case-insensitive.
+	// It requires Leases.
+	Hostname []string `yaml:"hostname"`
+
+	// Leases is the dnsmasq lease file, or "provider:tag" to use a data
+	// provider, which can reload the leases when the file changes.
+	// Mac addresses in the leases take precedence over the neighbor table.
+	Leases string `yaml:"leases"`
+}
+
+// clientMatcher matches queries from the lan clients with the mac
+// addresses or the dhcp hostnames. The client mac is looked up in the
+// dhcp leases and the neighbor table of the system (linux only), so
+// it only works for clients in the same lan.
+type clientMatcher struct {
+	*coremain.BP
+	mac      map[string]struct{}
+	hostname map[string]struct{}
+	table    *neighbor.Table
+	leases   *neighbor.Leases // nil if no leases
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newClientMatcher(bp, args.(*Args))
+}
+
+func newClientMatcher(bp *coremain.BP, args *Args) (*clientMatcher, error) {
+	if len(args.MAC) == 0 && len(args.Hostname) == 0 {
+		return nil, errors.New("no mac or hostname")
+	}
+	if len(args.Hostname) > 0 && len(args.Leases) == 0 {
+		return nil, errors.New("hostname requires leases")
+	}
+
+	m := &clientMatcher{
+		BP:       bp,
+		mac:      make(map[string]struct{}),
+		hostname: make(map[string]struct{}),
+		table:    neighbor.DefaultTable(),
+	}
+	for _, s := range args.MAC {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac %s, %w", s, err)
+		}
+		m.mac[mac.String()] = struct{}{}
+	}
+	for _, s := range args.Hostname {
+		m.hostname[strings.ToLower(s)] = struct{}{}
+	}
+
+	if len(args.Leases) > 0 {
+		leases, err := neighbor.LoadLeases(args.Leases, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		m.leases = leases
+	}
+	if len(m.mac) > 0 {
+		if _, err := m.table.Lookup(netip.IPv4Unspecified()); err != nil {
+			bp.L().Warn("neighbor table is unavailable, only mac addresses in leases are used", zap.Error(err))
+		}
+	}
+	return m, nil
+}
+
+func (m *clientMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	addr := qCtx.ReqMeta().ClientAddr
+	if !addr.IsValid() {
+		return false, nil
+	}
+
+	if m.leases != nil && len(m.hostname) > 0 {
+		if lease := m.leases.Lookup(addr); lease != nil && len(lease.Hostname) > 0 {
+			if _, ok := m.hostname[lease.Hostname]; ok {
+				return true, nil
+			}
+		}
+	}
+	if len(m.mac) == 0 {
+		return false, nil
+	}
+	mac, err := neighbor.ClientMAC(addr, m.leases, m.table)
+	if err != nil {
+		m.L().Debug("failed to lookup neighbor table", qCtx.InfoField(), zap.Error(err))
+		return false, nil
+	}
+	_, ok := m.mac[mac.String()]
+	return ok, nil
+}
+
+func (m *clientMatcher) Close() error {
+	if m.leases != nil {
+		return m.leases.Close()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_matcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func Test_clientMatcher_Match(t *testing.T) {
+	leases := new(neighbor.Leases)
+	data := `1667900000 aa:bb:cc:dd:ee:01 192.168.1.10 kids-ipad *
+1667900000 aa:bb:cc:dd:ee:02 192.168.1.11 * *
+1667900000 aa:bb:cc:dd:ee:03 192.168.1.12 laptop *
+`
+	if err := leases.Update([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	m := &clientMatcher{
+		BP:       coremain.NewBP("test", PluginType, nil, nil),
+		mac:      map[string]struct{}{"aa:bb:cc:dd:ee:02": {}},
+		hostname: map[string]struct{}{"kids-ipad": {}},
+		table:    neighbor.DefaultTable(),
+		leases:   leases,
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.1.11", true},
+		{"192.168.1.12", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		meta := new(query_context.RequestMeta)
+		if len(tt.addr) > 0 {
+			meta.ClientAddr = netip.MustParseAddr(tt.addr)
+		}
+		got, err := m.Match(context.Background(), query_context.NewContext(q, meta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
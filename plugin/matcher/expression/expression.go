@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package expression
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+)
+
+const PluginType = "expression"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*expression)(nil)
+
+type Args struct {
+	// Expr is a condition expression, which has the same syntax as
+	// the "if" condition in sequences.
+	Expr string `yaml:"expr"`
+}
+
+// expression is a named condition expression. It can be referenced
+// by its tag in other expressions.
+type expression struct {
+	*coremain.BP
+	m executable_seq.Matcher
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newExpression(bp, args.(*Args))
+}
+
+func newExpression(bp *coremain.BP, args *Args) (*expression, error) {
+	if len(args.Expr) == 0 {
+		return nil, errors.New("expr is empty")
+	}
+	m, err := executable_seq.NewConditionMatcher(bp.L(), args.Expr, bp.M().GetMatchers())
+	if err != nil {
+		return nil, err
+	}
+	return &expression{BP: bp, m: m}, nil
+}
+
+func (e *expression) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	return e.m.Match(ctx, qCtx)
+}
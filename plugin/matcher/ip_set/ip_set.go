@@ -0,0 +1,278 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_set
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PluginType = "ip_set"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	matchClientIP = "client_ip"
+	matchECS      = "ecs"
+	matchRespIP   = "resp_ip"
+)
+
+var _ coremain.MatcherPlugin = (*ipSet)(nil)
+
+type Args struct {
+	// Match specifies which address is matched against the set.
+	// Can be "client_ip", "ecs" or "resp_ip". Default is "client_ip".
+	Match string `yaml:"match"`
+
+	// IP contains static entries (ip or cidr) that never expire.
+	IP []string `yaml:"ip"`
+
+	DefaultTTL int `yaml:"default_ttl"` // (sec) Default TTL of entries added via api. 0 means no expiry.
+	MaxSize    int `yaml:"max_size"`    // Default is 65536.
+}
+
+func (a *Args) initDefault() *Args {
+	if len(a.Match) == 0 {
+		a.Match = matchClientIP
+	}
+	if a.MaxSize <= 0 {
+		a.MaxSize = 65536
+	}
+	return a
+}
+
+// ipSet is an in-memory ip set that can be modified at runtime via
+// the http api at "/plugins/<tag>/".
+//
+//	GET  /plugins/<tag>/            lists all entries.
+//	POST /plugins/<tag>/add?ip=&ttl= adds entries, ip can be repeated.
+//	POST /plugins/<tag>/del?ip=      deletes entries, ip can be repeated.
+//	POST /plugins/<tag>/flush        deletes all entries.
+type ipSet struct {
+	*coremain.BP
+	args *Args
+
+	s       *set
+	matcher executable_seq.Matcher
+	gcTask  *scheduler.Task
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	s, err := newIPSet(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	s.gcTask, err = bp.M().GetScheduler().Add(scheduler.TaskOpts{
+		Name: fmt.Sprintf("plugin/%s/gc", bp.Tag()),
+		Func: func(context.Context) error {
+			s.s.gc(time.Now())
+			return nil
+		},
+		Schedule: scheduler.Every(time.Second * 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	bp.GetMetricsReg().MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ip_set_size",
+		Help: "Current number of entries in the ip set",
+	}, func() float64 {
+		return float64(s.s.Len())
+	}))
+	return s, nil
+}
+
+func newIPSet(bp *coremain.BP, args *Args) (*ipSet, error) {
+	args.initDefault()
+	p := &ipSet{
+		BP:   bp,
+		args: args,
+		s:    newSet(args.MaxSize),
+	}
+
+	switch args.Match {
+	case matchClientIP:
+		p.matcher = msg_matcher.NewClientIPMatcher(p.s)
+	case matchECS:
+		p.matcher = msg_matcher.NewClientECSMatcher(p.s)
+	case matchRespIP:
+		p.matcher = msg_matcher.NewAAAAAIPMatcher(p.s)
+	default:
+		return nil, fmt.Errorf("invalid match mode %s", args.Match)
+	}
+
+	for _, s := range args.IP {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.s.add(prefix, time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to add %s, %w", s, err)
+		}
+	}
+	return p, nil
+}
+
+// Match implements coremain.MatcherPlugin.
+func (p *ipSet) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	return p.matcher.Match(ctx, qCtx)
+}
+
+func (p *ipSet) Close() error {
+	if p.gcTask != nil {
+		p.gcTask.Cancel()
+	}
+	return nil
+}
+
+type entryJSON struct {
+	IP       string `json:"ip"`
+	ExpireAt string `json:"expire_at,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+}
+
+func (p *ipSet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/plugins/%s/", p.Tag())), "/")
+
+	if req.Method == http.MethodGet && len(op) == 0 {
+		now := time.Now()
+		entries := p.s.entries(now)
+		out := make([]entryJSON, 0, len(entries))
+		for _, e := range entries {
+			ej := entryJSON{IP: e.Prefix.String()}
+			if !e.Expire.IsZero() {
+				ej.ExpireAt = e.Expire.Format(time.RFC3339)
+				ej.TTL = int(e.Expire.Sub(now).Round(time.Second) / time.Second)
+			}
+			out = append(out, ej)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch op {
+	case "add":
+		ttl := p.args.DefaultTTL
+		if s := req.Form.Get("ttl"); len(s) > 0 {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %s", s))
+				return
+			}
+			ttl = i
+		}
+		prefixes, err := parsePrefixes(req.Form["ip"])
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		var expire time.Time
+		if ttl > 0 {
+			expire = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+		for _, prefix := range prefixes {
+			if err := p.s.add(prefix, expire); err != nil {
+				httpError(w, http.StatusInsufficientStorage, fmt.Errorf("failed to add %s, %w", prefix, err))
+				return
+			}
+		}
+		p.L().Info("entries added", zap.Stringers("ip", prefixes), zap.Int("ttl", ttl))
+	case "del":
+		prefixes, err := parsePrefixes(req.Form["ip"])
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, prefix := range prefixes {
+			p.s.del(prefix)
+		}
+		p.L().Info("entries deleted", zap.Stringers("ip", prefixes))
+	case "flush":
+		p.s.flush()
+		p.L().Info("entries flushed")
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown operation %s", op))
+	}
+}
+
+// RequiredAPIPermission implements coremain.APIPermissionRequirer.
+func (p *ipSet) RequiredAPIPermission(req *http.Request) coremain.APIPermission {
+	if req.Method == http.MethodGet {
+		return coremain.APIPermRead
+	}
+	return coremain.APIPermRuleOverride
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
+
+func parsePrefixes(ss []string) ([]netip.Prefix, error) {
+	if len(ss) == 0 {
+		return nil, fmt.Errorf("missing ip")
+	}
+	out := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+// parsePrefix parses an ip or a cidr.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
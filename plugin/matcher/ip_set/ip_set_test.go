@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_set
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_set(t *testing.T) {
+	s := newSet(3)
+	now := time.Now()
+	mustAdd := func(p string, expire time.Time) {
+		t.Helper()
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.add(prefix, expire); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustAdd("1.1.1.1", time.Time{})
+	mustAdd("::ffff:10.0.0.0/104", time.Time{}) // same as 10.0.0.0/8
+	mustAdd("2001:db8::/32", now.Add(time.Second))
+
+	tests := []struct {
+		addr string
+		now  time.Time
+		want bool
+	}{
+		{"1.1.1.1", now, true},
+		{"::ffff:1.1.1.1", now, true},
+		{"1.1.1.2", now, false},
+		{"10.1.2.3", now, true},
+		{"2001:db8::1", now, true},
+		{"2001:db8::1", now.Add(time.Second), false},
+		{"2001:db9::1", now, false},
+	}
+	for _, tt := range tests {
+		if got := s.contains(netip.MustParseAddr(tt.addr), tt.now); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if err := s.add(netip.MustParsePrefix("192.168.0.0/16"), time.Time{}); err != errSetFull {
+		t.Fatalf("want errSetFull, got %v", err)
+	}
+
+	s.gc(now.Add(time.Second))
+	if s.Len() != 2 {
+		t.Fatalf("want 2 entries after gc, got %d", s.Len())
+	}
+	if !s.del(netip.MustParsePrefix("10.0.0.0/8")) || s.contains(netip.MustParseAddr("10.1.2.3"), now) {
+		t.Fatal("failed to delete entry")
+	}
+}
+
+func Test_ipSet_api(t *testing.T) {
+	p, err := newIPSet(coremain.NewBP("test", PluginType, nil, nil), &Args{IP: []string{"192.168.1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	do := func(method, target string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w.Code
+	}
+	match := func(client string) bool {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+		ok, err := p.Match(context.Background(), qCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !match("192.168.1.1") || match("10.0.0.1") {
+		t.Fatal("unexpected initial match result")
+	}
+
+	if c := do(http.MethodPost, "/plugins/test/add?ip=10.0.0.0/24&ip=2001:db8::1&ttl=60"); c != http.StatusOK {
+		t.Fatalf("add: unexpected status %d", c)
+	}
+	if !match("10.0.0.1") || !match("2001:db8::1") {
+		t.Fatal("added entries are not matched")
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/plugins/test/", nil))
+	var entries []entryJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("want 3 entries, got %v", entries)
+	}
+
+	if c := do(http.MethodPost, "/plugins/test/del?ip=10.0.0.0/24"); c != http.StatusOK {
+		t.Fatalf("del: unexpected status %d", c)
+	}
+	if match("10.0.0.1") {
+		t.Fatal("deleted entry is still matched")
+	}
+
+	if c := do(http.MethodPost, "/plugins/test/flush"); c != http.StatusOK {
+		t.Fatalf("flush: unexpected status %d", c)
+	}
+	if match("192.168.1.1") {
+		t.Fatal("flushed entry is still matched")
+	}
+
+	for _, target := range []string{"/plugins/test/add", "/plugins/test/add?ip=bad", "/plugins/test/add?ip=1.1.1.1&ttl=-1"} {
+		if c := do(http.MethodPost, target); c != http.StatusBadRequest {
+			t.Fatalf("%s: want bad request, got %d", target, c)
+		}
+	}
+}
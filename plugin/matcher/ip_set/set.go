@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_set
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errSetFull = errors.New("ip set is full")
+
+// set is a concurrent safe set of netip.Prefix(s) with optional expiry.
+// Lookups cost one map access per distinct prefix length in the set.
+type set struct {
+	maxSize int // <= 0 means no limit
+
+	mu   sync.RWMutex
+	m    map[netip.Prefix]time.Time // zero time means the entry never expires
+	bits map[int]int                // prefix length -> number of entries
+}
+
+func newSet(maxSize int) *set {
+	return &set{
+		maxSize: maxSize,
+		m:       make(map[netip.Prefix]time.Time),
+		bits:    make(map[int]int),
+	}
+}
+
+// normPrefix unmaps v4-in-v6 addresses and masks the prefix.
+func normPrefix(p netip.Prefix) (netip.Prefix, error) {
+	addr := p.Addr()
+	bits := p.Bits()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+	}
+	return addr.Prefix(bits)
+}
+
+// add adds p to the set. If p is already in the set, its expiry
+// is replaced. A zero expire means p never expires.
+func (s *set) add(p netip.Prefix, expire time.Time) error {
+	p, err := normPrefix(p)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[p]; !ok {
+		if s.maxSize > 0 && len(s.m) >= s.maxSize {
+			return errSetFull
+		}
+		s.bits[p.Bits()]++
+	}
+	s.m[p] = expire
+	return nil
+}
+
+// del deletes p from the set. It reports whether p was in the set.
+func (s *set) del(p netip.Prefix) bool {
+	p, err := normPrefix(p)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[p]; !ok {
+		return false
+	}
+	s.delLocked(p)
+	return true
+}
+
+func (s *set) delLocked(p netip.Prefix) {
+	delete(s.m, p)
+	if s.bits[p.Bits()]--; s.bits[p.Bits()] <= 0 {
+		delete(s.bits, p.Bits())
+	}
+}
+
+func (s *set) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = make(map[netip.Prefix]time.Time)
+	s.bits = make(map[int]int)
+}
+
+// contains reports whether addr is covered by an unexpired entry.
+func (s *set) contains(addr netip.Addr, now time.Time) bool {
+	addr = addr.Unmap()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for bits := range s.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if expire, ok := s.m[p]; ok && (expire.IsZero() || now.Before(expire)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match and Len implement netlist.Matcher.
+func (s *set) Match(addr netip.Addr) (bool, error) {
+	return s.contains(addr, time.Now()), nil
+}
+
+func (s *set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
+
+// gc removes expired entries.
+func (s *set) gc(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, expire := range s.m {
+		if !expire.IsZero() && !now.Before(expire) {
+			s.delLocked(p)
+		}
+	}
+}
+
+type setEntry struct {
+	Prefix netip.Prefix
+	Expire time.Time
+}
+
+// entries returns all unexpired entries, sorted by prefix.
+func (s *set) entries(now time.Time) []setEntry {
+	s.mu.RLock()
+	out := make([]setEntry, 0, len(s.m))
+	for p, expire := range s.m {
+		if expire.IsZero() || now.Before(expire) {
+			out = append(out, setEntry{Prefix: p, Expire: expire})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Prefix, out[j].Prefix
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+	return out
+}
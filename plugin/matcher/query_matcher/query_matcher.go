@@ -24,13 +24,13 @@ import (
 	"io"
 
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/elem"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
-	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
@@ -42,13 +42,13 @@ func init() {
 	coremain.RegNewPersetPluginFunc(
 		"_qtype_A_AAAA",
 		func(bp *coremain.BP) (coremain.Plugin, error) {
-			return newQueryMatcher(bp, &Args{QType: []int{int(dns.TypeA), int(dns.TypeAAAA)}})
+			return newQueryMatcher(bp, &Args{QType: []string{"A", "AAAA"}})
 		},
 	)
 	coremain.RegNewPersetPluginFunc(
 		"_qtype_AAAA",
 		func(bp *coremain.BP) (coremain.Plugin, error) {
-			return newQueryMatcher(bp, &Args{QType: []int{int(dns.TypeAAAA)}})
+			return newQueryMatcher(bp, &Args{QType: []string{"AAAA"}})
 		},
 	)
 
@@ -64,9 +64,10 @@ var _ coremain.MatcherPlugin = (*queryMatcher)(nil)
 
 type Args struct {
 	ClientIP []string `yaml:"client_ip"`
+	ServerIP []string `yaml:"server_ip"` // The local address that received the query.
 	ECS      []string `yaml:"ecs"`
 	Domain   []string `yaml:"domain"`
-	QType    []int    `yaml:"qtype"`
+	QType    []string `yaml:"qtype"` // Type names (e.g. "https") or numbers.
 	QClass   []int    `yaml:"qclass"`
 	// TODO: Add PTR matcher.
 }
@@ -100,6 +101,15 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		m.closer = append(m.closer, l)
 		bp.L().Info("client ip matcher loaded", zap.Int("length", l.Len()))
 	}
+	if len(args.ServerIP) > 0 {
+		l, err := netlist.BatchLoadProvider(args.ServerIP, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewServerIPMatcher(l))
+		m.closer = append(m.closer, l)
+		bp.L().Info("server ip matcher loaded", zap.Int("length", l.Len()))
+	}
 	if len(args.ECS) > 0 {
 		l, err := netlist.BatchLoadProvider(args.ECS, bp.M().GetDataManager())
 		if err != nil {
@@ -122,7 +132,15 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
 	}
 	if len(args.QType) > 0 {
-		elemMatcher := elem.NewIntMatcher(args.QType)
+		qtypes := make([]int, 0, len(args.QType))
+		for _, s := range args.QType {
+			t, err := dnsutils.ParseRRType(s)
+			if err != nil {
+				return nil, err
+			}
+			qtypes = append(qtypes, int(t))
+		}
+		elemMatcher := elem.NewIntMatcher(qtypes)
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQTypeMatcher(elemMatcher))
 	}
 	if len(args.QClass) > 0 {
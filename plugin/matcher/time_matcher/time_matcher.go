@@ -0,0 +1,247 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package time_matcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PluginType = "time_matcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*timeMatcher)(nil)
+
+type Args struct {
+	// TimeZone is an IANA time zone name, e.g. "Asia/Shanghai", or a fixed
+	// offset from UTC, e.g. "+08:00". Fixed offsets also work on systems
+	// without the time zone database. Default is the local time zone.
+	TimeZone string `yaml:"time_zone"`
+
+	// Schedules are the time ranges to match. The matcher matches if
+	// any of them matches.
+	Schedules []ScheduleArgs `yaml:"schedules"`
+}
+
+type ScheduleArgs struct {
+	// Weekdays are the days of the schedule, e.g. ["mon", "wed"],
+	// ["mon-fri"]. Empty means every day.
+	Weekdays []string `yaml:"weekdays"`
+
+	// Time is the time range of the day, e.g. "08:00-18:00". The range
+	// can cross midnight, e.g. "22:00-07:00", in which case the part
+	// after midnight belongs to the day it starts. Empty means all day.
+	Time string `yaml:"time"`
+}
+
+type timeMatcher struct {
+	*coremain.BP
+	loc       *time.Location
+	schedules []*schedule
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newTimeMatcher(bp, args.(*Args))
+}
+
+func newTimeMatcher(bp *coremain.BP, args *Args) (*timeMatcher, error) {
+	if len(args.Schedules) == 0 {
+		return nil, errors.New("no schedule")
+	}
+	loc, err := parseTimeZone(args.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	m := &timeMatcher{BP: bp, loc: loc}
+	for i, sa := range args.Schedules {
+		s, err := parseSchedule(sa)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule #%d, %w", i, err)
+		}
+		m.schedules = append(m.schedules, s)
+	}
+	return m, nil
+}
+
+func (m *timeMatcher) Match(_ context.Context, _ *query_context.Context) (bool, error) {
+	return m.match(time.Now()), nil
+}
+
+func (m *timeMatcher) match(t time.Time) bool {
+	t = t.In(m.loc)
+	for _, s := range m.schedules {
+		if s.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type schedule struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes of the day, end is excluded. start == end means all day.
+}
+
+func (s *schedule) match(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	d := t.Weekday()
+	switch {
+	case s.start == s.end:
+		return s.days[d]
+	case s.start < s.end:
+		return s.days[d] && m >= s.start && m < s.end
+	default: // crosses midnight
+		if m >= s.start {
+			return s.days[d]
+		}
+		return m < s.end && s.days[(d+6)%7]
+	}
+}
+
+func parseSchedule(sa ScheduleArgs) (*schedule, error) {
+	s := new(schedule)
+	if len(sa.Weekdays) == 0 {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+	for _, w := range sa.Weekdays {
+		from, to, isRange := strings.Cut(w, "-")
+		fd, err := parseWeekday(from)
+		if err != nil {
+			return nil, err
+		}
+		td := fd
+		if isRange {
+			if td, err = parseWeekday(to); err != nil {
+				return nil, err
+			}
+		}
+		for d := fd; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == td {
+				break
+			}
+		}
+	}
+
+	if len(sa.Time) > 0 {
+		from, to, ok := strings.Cut(sa.Time, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range [%s]", sa.Time)
+		}
+		var err error
+		if s.start, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if s.end, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		s.start %= 24 * 60
+		s.end %= 24 * 60
+	}
+	return s, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekday parses a weekday name, e.g. "mon" or "Monday".
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) >= 3 {
+		if d, ok := weekdays[s[:3]]; ok && strings.HasPrefix(strings.ToLower(d.String()), s) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday [%s]", s)
+}
+
+// parseClock parses "hh:mm" to minutes of the day. "24:00" is allowed.
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	hs, ms, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time [%s]", s)
+	}
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time [%s]", s)
+	}
+	m, err := strconv.Atoi(ms)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time [%s]", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time [%s]", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseTimeZone parses an IANA time zone name or a fixed offset
+// like "+08:00", "-0530", "UTC+8".
+func parseTimeZone(s string) (*time.Location, error) {
+	if len(s) == 0 {
+		return time.Local, nil
+	}
+	offset := strings.TrimPrefix(strings.TrimPrefix(s, "UTC"), "GMT")
+	if len(offset) > 0 && (offset[0] == '+' || offset[0] == '-') {
+		sign := 1
+		if offset[0] == '-' {
+			sign = -1
+		}
+		hs, ms, ok := strings.Cut(offset[1:], ":")
+		if !ok && len(hs) == 4 {
+			hs, ms = hs[:2], hs[2:]
+		}
+		h, err := strconv.Atoi(hs)
+		if err != nil || h > 14 {
+			return nil, fmt.Errorf("invalid time zone offset [%s]", s)
+		}
+		m := 0
+		if len(ms) > 0 {
+			if m, err = strconv.Atoi(ms); err != nil || m > 59 {
+				return nil, fmt.Errorf("invalid time zone offset [%s]", s)
+			}
+		}
+		return time.FixedZone(s, sign*(h*3600+m*60)), nil
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load time zone, %w", err)
+	}
+	return loc, nil
+}
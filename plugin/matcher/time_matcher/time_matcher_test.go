@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package time_matcher
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"testing"
+	"time"
+)
+
+func Test_timeMatcher_match(t *testing.T) {
+	m, err := newTimeMatcher(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		TimeZone: "+08:00",
+		Schedules: []ScheduleArgs{
+			{Weekdays: []string{"mon-thu", "sunday"}, Time: "22:00-07:00"},
+			{Weekdays: []string{"sat"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tz := time.FixedZone("", 8*3600)
+	tests := []struct {
+		t    string // 2022-11-07 is a Monday.
+		want bool
+	}{
+		{"2022-11-07 21:59", false},
+		{"2022-11-07 22:00", true},
+		{"2022-11-08 06:59", true}, // Monday night
+		{"2022-11-08 07:00", false},
+		{"2022-11-11 23:00", false}, // Friday night
+		{"2022-11-12 06:00", true},  // Saturday
+		{"2022-11-13 23:30", true},  // Sunday night
+		{"2022-11-06 06:00", false}, // Sunday morning
+	}
+	for _, tt := range tests {
+		ts, err := time.ParseInLocation("2006-01-02 15:04", tt.t, tz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.match(ts.UTC()); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func Test_parseArgs(t *testing.T) {
+	for _, s := range []string{"UTC+8", "-05:30", "+0800"} {
+		if _, err := parseTimeZone(s); err != nil {
+			t.Errorf("parseTimeZone(%s): %v", s, err)
+		}
+	}
+	for _, s := range []string{"+25", "UTC+8:99"} {
+		if _, err := parseTimeZone(s); err == nil {
+			t.Errorf("parseTimeZone(%s) should fail", s)
+		}
+	}
+	for _, sa := range []ScheduleArgs{
+		{Weekdays: []string{"monday-xyz"}},
+		{Weekdays: []string{"mo"}},
+		{Time: "25:00-01:00"},
+		{Time: "08:00"},
+	} {
+		if _, err := parseSchedule(sa); err == nil {
+			t.Errorf("parseSchedule(%v) should fail", sa)
+		}
+	}
+}
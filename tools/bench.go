@@ -0,0 +1,421 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"io"
+	"math/bits"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type benchOpts struct {
+	upstreamFlags
+	file        string
+	queries     []string
+	qps         int
+	concurrency int
+	duration    time.Duration
+	requests    int
+	timeout     time.Duration
+}
+
+func newBenchCmd() *cobra.Command {
+	opts := new(benchOpts)
+	c := &cobra.Command{
+		Use:   "bench <upstream> [-f query_file] [-q name[:type]]...",
+		Args:  cobra.ExactArgs(1),
+		Short: "Replay queries against an upstream and report the latency.",
+		Long: `Replay queries against an upstream and report the latency.
+
+The upstream uses the same address format and transports as the forward
+plugin. The query file is in dnsperf format, one "name [type]" per line.
+Queries are sent in order and replayed from the beginning until --duration
+or --requests is reached. A --qps of 0 sends queries as fast as the
+concurrency allows.`,
+		Example: `  mosdns bench 127.0.0.1:53 -f queries.txt --qps 1000 --duration 30s
+  mosdns bench tls://127.0.0.1 -q example.com -q example.com:AAAA -n 1000`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runBench(cmd.OutOrStdout(), args[0], opts); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&opts.file, "file", "f", "", "dnsperf-style query file")
+	fs.StringArrayVarP(&opts.queries, "query", "q", nil, "query in name[:type] format")
+	fs.IntVar(&opts.qps, "qps", 0, "queries per second, 0 means unlimited")
+	fs.IntVarP(&opts.concurrency, "concurrency", "j", 16, "max in-flight queries")
+	fs.DurationVarP(&opts.duration, "duration", "l", time.Second*10, "run time, 0 means no limit")
+	fs.IntVarP(&opts.requests, "requests", "n", 0, "total queries to send, 0 means no limit")
+	fs.DurationVar(&opts.timeout, "timeout", time.Second*2, "query timeout")
+	opts.upstreamFlags.register(c)
+	c.MarkFlagFilename("file")
+	return c
+}
+
+// loadBenchQueries loads queries from a dnsperf-style file and from
+// "name[:type]" strings.
+func loadBenchQueries(file string, queries []string) ([]dns.Question, error) {
+	var qs []dns.Question
+	parse := func(name, typ string) error {
+		qt := dns.TypeA
+		if len(typ) > 0 {
+			t, err := dnsutils.ParseRRType(typ)
+			if err != nil {
+				return err
+			}
+			qt = t
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("invalid domain %s", name)
+		}
+		qs = append(qs, dns.Question{Name: dns.Fqdn(name), Qtype: qt, Qclass: dns.ClassINET})
+		return nil
+	}
+
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for ln := 1; s.Scan(); ln++ {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			typ := ""
+			if len(fields) > 1 {
+				typ = fields[1]
+			}
+			if err := parse(fields[0], typ); err != nil {
+				return nil, fmt.Errorf("line %d: %w", ln, err)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, q := range queries {
+		name, typ, _ := strings.Cut(q, ":")
+		if err := parse(name, typ); err != nil {
+			return nil, err
+		}
+	}
+	if len(qs) == 0 {
+		return nil, errors.New("no query, use --file or --query")
+	}
+	return qs, nil
+}
+
+type benchResult struct {
+	mu        sync.Mutex
+	sent      int
+	latencies latencyHistogram // of completed queries
+	buckets   []int            // counts of benchBuckets, the last one is the overflow
+	rcodes    map[int]int
+	errs      map[string]int
+}
+
+func newBenchResult() *benchResult {
+	return &benchResult{
+		buckets: make([]int, len(benchBuckets)+1),
+		rcodes:  make(map[int]int),
+		errs:    make(map[string]int),
+	}
+}
+
+func (r *benchResult) add(rtt time.Duration, resp *dns.Msg, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			r.errs["timeout"]++
+		} else {
+			r.errs[err.Error()]++
+		}
+		return
+	}
+	r.latencies.add(rtt)
+	r.buckets[sort.Search(len(benchBuckets), func(i int) bool { return rtt <= benchBuckets[i] })]++
+	r.rcodes[resp.Rcode]++
+}
+
+func runBench(w io.Writer, addr string, opts *benchOpts) error {
+	qs, err := loadBenchQueries(opts.file, opts.queries)
+	if err != nil {
+		return err
+	}
+	u, err := opts.newUpstream(addr, nil)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if opts.duration > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, opts.duration)
+		defer cancelTimeout()
+	}
+
+	concurrency := opts.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	r := newBenchResult()
+	jobs := make(chan dns.Question)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for question := range jobs {
+				benchOne(u, question, opts.timeout, r)
+			}
+		}()
+	}
+
+	start := time.Now()
+	mlog.S().Infof("sending %d distinct queries to %s", len(qs), addr)
+send:
+	for i := 0; opts.requests <= 0 || i < opts.requests; i++ {
+		if opts.qps > 0 {
+			next := start.Add(time.Duration(i) * time.Second / time.Duration(opts.qps))
+			if d := time.Until(next); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					break send
+				}
+			}
+		}
+		select {
+		case jobs <- qs[i%len(qs)]:
+			r.mu.Lock()
+			r.sent++
+			r.mu.Unlock()
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	writeBenchResult(w, r, time.Since(start))
+	return nil
+}
+
+func benchOne(u upstream.Upstream, question dns.Question, timeout time.Duration, r *benchResult) {
+	q := new(dns.Msg)
+	q.Id = dns.Id()
+	q.RecursionDesired = true
+	q.Question = []dns.Question{question}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := u.ExchangeContext(ctx, q)
+	r.add(time.Since(start), resp, err)
+}
+
+// benchBuckets are the upper bounds of the latency histogram.
+var benchBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 2,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 20,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 200,
+	time.Millisecond * 500,
+	time.Second,
+}
+
+func writeBenchResult(w io.Writer, r *benchResult, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := &r.latencies
+	completed := int(l.count)
+	failed := 0
+	for _, n := range r.errs {
+		failed += n
+	}
+	fmt.Fprintf(w, "Queries sent:       %d\n", r.sent)
+	fmt.Fprintf(w, "Queries completed:  %d (%.2f%%)\n", completed, percent(completed, r.sent))
+	fmt.Fprintf(w, "Queries failed:     %d (%.2f%%)\n", failed, percent(failed, r.sent))
+	fmt.Fprintf(w, "Run time:           %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Queries per second: %.1f\n", float64(completed)/elapsed.Seconds())
+
+	if len(r.rcodes) > 0 {
+		rcodes := make([]int, 0, len(r.rcodes))
+		for rc := range r.rcodes {
+			rcodes = append(rcodes, rc)
+		}
+		sort.Ints(rcodes)
+		fmt.Fprintln(w, "\nResponse codes:")
+		for _, rc := range rcodes {
+			fmt.Fprintf(w, "  %-10s %d\n", dns.RcodeToString[rc], r.rcodes[rc])
+		}
+	}
+	if len(r.errs) > 0 {
+		errs := make([]string, 0, len(r.errs))
+		for e := range r.errs {
+			errs = append(errs, e)
+		}
+		sort.Strings(errs)
+		fmt.Fprintln(w, "\nErrors:")
+		for _, e := range errs {
+			fmt.Fprintf(w, "  %d  %s\n", r.errs[e], e)
+		}
+	}
+	if completed == 0 {
+		return
+	}
+
+	p := l.quantile
+	fmt.Fprintln(w, "\nLatency:")
+	fmt.Fprintf(w, "  min %s, avg %s, max %s\n", fmtLatency(l.min), fmtLatency(l.sum/time.Duration(l.count)), fmtLatency(l.max))
+	fmt.Fprintf(w, "  p50 %s, p90 %s, p99 %s, p99.9 %s\n", fmtLatency(p(0.5)), fmtLatency(p(0.9)), fmtLatency(p(0.99)), fmtLatency(p(0.999)))
+
+	counts := r.buckets
+	maxCount := 0
+	for _, n := range counts {
+		if n > maxCount {
+			maxCount = n
+		}
+	}
+	fmt.Fprintln(w, "\nHistogram:")
+	for i, n := range counts {
+		label := "> " + benchBuckets[len(benchBuckets)-1].String()
+		if i < len(benchBuckets) {
+			label = "<= " + benchBuckets[i].String()
+		}
+		line := fmt.Sprintf("  %-8s %8d %6.2f%% %s", label, n, percent(n, completed), strings.Repeat("#", n*40/maxCount))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
+
+// latencySubBits is the number of bits of the sub buckets of a
+// latencyHistogram. The relative error of quantiles is less than
+// 1/2^latencySubBits.
+const latencySubBits = 7
+
+// latencyHistogram is a log-linear histogram of latencies in microseconds.
+// Values in [2^n, 2^(n+1)) are split into 2^latencySubBits buckets, so it
+// takes constant memory regardless of the number of queries.
+type latencyHistogram struct {
+	counts   []uint64
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, (64-latencySubBits+1)<<latencySubBits)
+	}
+	us := uint64(0)
+	if d > 0 {
+		us = uint64(d / time.Microsecond)
+	}
+	h.counts[latencyBucket(us)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// quantile returns the upper bound of the bucket of quantile q. The
+// result is clamped to the min and max latency.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.count-1)) + 1
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		if n >= rank {
+			d := time.Duration(latencyBucketUpper(i)) * time.Microsecond
+			if d < h.min {
+				return h.min
+			}
+			if d > h.max {
+				return h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+func latencyBucket(us uint64) int {
+	if us < 1<<latencySubBits {
+		return int(us)
+	}
+	shift := bits.Len64(us) - latencySubBits - 1
+	return (shift+1)<<latencySubBits + int(us>>shift) - 1<<latencySubBits
+}
+
+// latencyBucketUpper returns the max value of bucket i.
+func latencyBucketUpper(i int) uint64 {
+	if i < 1<<latencySubBits {
+		return uint64(i)
+	}
+	shift := i>>latencySubBits - 1
+	m := uint64(i&(1<<latencySubBits-1) + 1<<latencySubBits)
+	return (m+1)<<shift - 1
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func fmtLatency(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_latencyBucket(t *testing.T) {
+	prev := -1
+	for _, us := range []uint64{0, 1, 127, 128, 255, 256, 257, 511, 512, 1000, 1 << 20, 1<<63 - 1, 1<<64 - 1} {
+		i := latencyBucket(us)
+		if i < prev {
+			t.Fatalf("bucket of %d is %d, less than the previous one %d", us, i, prev)
+		}
+		prev = i
+		if upper := latencyBucketUpper(i); us > upper {
+			t.Fatalf("%d is greater than the upper bound %d of its bucket %d", us, upper, i)
+		}
+		if i > 0 {
+			if lower := latencyBucketUpper(i-1) + 1; us < lower {
+				t.Fatalf("%d is less than the lower bound %d of its bucket %d", us, lower, i)
+			}
+		}
+	}
+}
+
+func Test_latencyHistogram(t *testing.T) {
+	h := new(latencyHistogram)
+	if h.quantile(0.5) != 0 {
+		t.Fatal("empty histogram should return 0")
+	}
+
+	l := make([]time.Duration, 100000)
+	for i := range l {
+		l[i] = time.Duration(rand.Int63n(int64(time.Second)))
+		h.add(l[i])
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	if h.min != l[0] || h.max != l[len(l)-1] || h.count != uint64(len(l)) {
+		t.Fatalf("invalid min %s, max %s or count %d", h.min, h.max, h.count)
+	}
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 0.999, 1} {
+		want := l[int(q*float64(len(l)-1))]
+		got := h.quantile(q)
+		if diff := got - want; diff < -time.Microsecond || diff > want>>latencySubBits+time.Microsecond {
+			t.Errorf("quantile %v: want %s, got %s", q, want, got)
+		}
+	}
+}
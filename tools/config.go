@@ -20,9 +20,12 @@
 package tools
 
 import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/mlog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
+	"os"
 	"strings"
 )
 
@@ -67,6 +70,42 @@ func newGenCmd() *cobra.Command {
 	return c
 }
 
+func newSchemaCmd() *cobra.Command {
+	var out string
+	c := &cobra.Command{
+		Use:   "schema [-o output_file]",
+		Args:  cobra.NoArgs,
+		Short: "Print the JSON Schema of the config, including args of all plugins in this build.",
+		Long: "Print the JSON Schema of the config, including args of all plugins in this build. " +
+			"It can be used by editors for autocompletion and by other tools to validate configs. " +
+			"e.g. add \"# yaml-language-server: $schema=./mosdns.schema.json\" to the top of the yaml config.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := writeSchema(cmd.OutOrStdout(), out); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&out, "out", "o", "", "output file, default is stdout")
+	c.MarkFlagFilename("out", "json")
+	return c
+}
+
+func writeSchema(stdout io.Writer, out string) error {
+	if len(out) == 0 {
+		return coremain.WriteConfigJSONSchema(stdout)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := coremain.WriteConfigJSONSchema(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func convCfg(in, out string) error {
 	v := viper.New()
 	v.SetConfigFile(in)
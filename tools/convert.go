@@ -0,0 +1,388 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Supported rule formats.
+const (
+	formatText    = "text"    // mosdns text list
+	formatV2dat   = "v2dat"   // v2ray geosite.dat / geoip.dat
+	formatAdblock = "adblock" // AdBlock / AdGuard style list, domain rules only
+)
+
+// Supported rule kinds.
+const (
+	kindDomain = "domain"
+	kindIP     = "ip"
+)
+
+type convertFlags struct {
+	in, out  string
+	from, to string
+	kind     string
+	tag      string
+}
+
+func newConvertCmd() *cobra.Command {
+	f := new(convertFlags)
+	c := &cobra.Command{
+		Use:   "convert -i input[:tag1[,tag2]...] -o output [--from format] [--to format] [--kind domain|ip] [--tag tag]",
+		Args:  cobra.NoArgs,
+		Short: "Convert rule lists between formats. Supported formats: text, v2dat, adblock (domain only).",
+		Long: `Convert rule lists between formats.
+
+Formats are detected by file extension (".dat" is v2dat, others are text)
+unless --from/--to is given. Tags can be appended to a v2dat input to extract
+specific categories. Multiple categories will be merged into one output.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := convertRules(f); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&f.in, "in", "i", "", "input file")
+	fs.StringVarP(&f.out, "out", "o", "", "output file")
+	fs.StringVar(&f.from, "from", "", "input format")
+	fs.StringVar(&f.to, "to", "", "output format")
+	fs.StringVar(&f.kind, "kind", kindDomain, "rule kind, domain or ip")
+	fs.StringVar(&f.tag, "tag", "", "category tag of the v2dat output, default is the output file name")
+	c.MarkFlagRequired("in")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("in")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func guessFormat(file string) string {
+	if strings.EqualFold(filepath.Ext(file), ".dat") {
+		return formatV2dat
+	}
+	return formatText
+}
+
+// convertRules converts rule file f.in to f.out.
+func convertRules(f *convertFlags) error {
+	inFile, tags := splitTags(f.in)
+	from, to := f.from, f.to
+	if len(from) == 0 {
+		from = guessFormat(inFile)
+	}
+	if len(to) == 0 {
+		to = guessFormat(f.out)
+	}
+	if len(tags) > 0 && from != formatV2dat {
+		return fmt.Errorf("category tags are only supported by %s input", formatV2dat)
+	}
+	outTag := f.tag
+	if len(outTag) == 0 {
+		outTag = fileName(f.out)
+	}
+
+	b, err := os.ReadFile(inFile)
+	if err != nil {
+		return err
+	}
+	out := new(bytes.Buffer)
+
+	switch f.kind {
+	case kindDomain:
+		domains, err := readDomainRules(b, from, tags)
+		if err != nil {
+			return fmt.Errorf("failed to read input, %w", err)
+		}
+		if err := writeDomainRules(out, domains, to, outTag); err != nil {
+			return fmt.Errorf("failed to write output, %w", err)
+		}
+		mlog.S().Infof("%d domain rules converted", len(domains))
+	case kindIP:
+		cidrs, err := readIPRules(b, from, tags)
+		if err != nil {
+			return fmt.Errorf("failed to read input, %w", err)
+		}
+		if err := writeIPRules(out, cidrs, to, outTag); err != nil {
+			return fmt.Errorf("failed to write output, %w", err)
+		}
+		mlog.S().Infof("%d ip rules converted", len(cidrs))
+	default:
+		return fmt.Errorf("invalid rule kind %s", f.kind)
+	}
+	return os.WriteFile(f.out, out.Bytes(), 0644)
+}
+
+func readDomainRules(b []byte, format string, tags []string) ([]*v2data.Domain, error) {
+	switch format {
+	case formatText:
+		return parseTextDomainRules(bytes.NewReader(b))
+	case formatAdblock:
+		return parseAdblockDomainRules(bytes.NewReader(b))
+	case formatV2dat:
+		geoSiteList, err := domain.LoadGeoSiteList(b)
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string][]*v2data.Domain)
+		for _, geoSite := range geoSiteList.GetEntry() {
+			entries[strings.ToLower(geoSite.GetCountryCode())] = geoSite.GetDomain()
+		}
+		return selectEntries(entries, tags)
+	default:
+		return nil, fmt.Errorf("unsupported domain format %s", format)
+	}
+}
+
+func writeDomainRules(w io.Writer, domains []*v2data.Domain, format, tag string) error {
+	switch format {
+	case formatText:
+		return convertV2DomainToText(domains, w)
+	case formatAdblock:
+		return convertV2DomainToAdblock(domains, w)
+	case formatV2dat:
+		l := &v2data.GeoSiteList{Entry: []*v2data.GeoSite{{CountryCode: strings.ToUpper(tag), Domain: domains}}}
+		b, err := proto.Marshal(l)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	default:
+		return fmt.Errorf("unsupported domain format %s", format)
+	}
+}
+
+func readIPRules(b []byte, format string, tags []string) ([]*v2data.CIDR, error) {
+	switch format {
+	case formatText:
+		return parseTextIPRules(bytes.NewReader(b))
+	case formatV2dat:
+		geoIPList, err := netlist.LoadGeoIPListFromDAT(b)
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string][]*v2data.CIDR)
+		for _, geoIP := range geoIPList.GetEntry() {
+			entries[strings.ToLower(geoIP.GetCountryCode())] = geoIP.GetCidr()
+		}
+		return selectEntries(entries, tags)
+	default:
+		return nil, fmt.Errorf("unsupported ip format %s", format)
+	}
+}
+
+func writeIPRules(w io.Writer, cidrs []*v2data.CIDR, format, tag string) error {
+	switch format {
+	case formatText:
+		return convertV2CidrToText(cidrs, w)
+	case formatV2dat:
+		l := &v2data.GeoIPList{Entry: []*v2data.GeoIP{{CountryCode: strings.ToUpper(tag), Cidr: cidrs}}}
+		b, err := proto.Marshal(l)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	default:
+		return fmt.Errorf("unsupported ip format %s", format)
+	}
+}
+
+// selectEntries merges entries that are selected by tags.
+// If tags is empty, all entries will be merged in the order of their tags.
+func selectEntries[T any](entries map[string][]T, tags []string) ([]T, error) {
+	var out []T
+	if len(tags) == 0 {
+		for tag := range entries {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+	}
+	for _, tag := range tags {
+		e, ok := entries[strings.ToLower(tag)]
+		if !ok {
+			return nil, fmt.Errorf("cannot find entry %s", tag)
+		}
+		out = append(out, e...)
+	}
+	return out, nil
+}
+
+// parseTextDomainRules parses a mosdns domain text list.
+// Rules without a type prefix are domain rules.
+func parseTextDomainRules(r io.Reader) ([]*v2data.Domain, error) {
+	var out []*v2data.Domain
+	err := scanRuleLines(r, "#", func(s string) error {
+		typ, pattern, ok := utils.SplitString2(s, ":")
+		if !ok {
+			typ, pattern = domain.MatcherDomain, s
+		}
+		var dt v2data.Domain_Type
+		switch typ {
+		case domain.MatcherDomain:
+			dt = v2data.Domain_Domain
+		case domain.MatcherFull:
+			dt = v2data.Domain_Full
+		case domain.MatcherKeyword:
+			dt = v2data.Domain_Plain
+		case domain.MatcherRegexp:
+			dt = v2data.Domain_Regex
+		default:
+			return fmt.Errorf("unsupported match type [%s]", typ)
+		}
+		out = append(out, &v2data.Domain{Type: dt, Value: pattern})
+		return nil
+	})
+	return out, err
+}
+
+// parseAdblockDomainRules parses the DNS subset of the AdBlock syntax.
+// Exception (@@), cosmetic and modifier rules can not be represented
+// by a plain domain list. They are skipped.
+func parseAdblockDomainRules(r io.Reader) ([]*v2data.Domain, error) {
+	var out []*v2data.Domain
+	skipped := 0
+	err := scanRuleLines(r, "!", func(s string) error {
+		if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "#") {
+			return nil // header or hosts style comment
+		}
+		s = strings.TrimSpace(utils.RemoveComment(s, " #"))
+		d := parseAdblockRule(s)
+		if d == nil {
+			skipped++
+			return nil
+		}
+		out = append(out, d)
+		return nil
+	})
+	if skipped > 0 {
+		mlog.S().Warnf("%d adblock rules can not be converted and were skipped", skipped)
+	}
+	return out, err
+}
+
+// parseAdblockRule converts a blocking rule to a v2data.Domain. It returns
+// nil if s is an exception or can not be converted.
+func parseAdblockRule(s string) *v2data.Domain {
+	r, ok := domain.ParseAdblockRule(s)
+	if !ok || r.Exception {
+		return nil
+	}
+	return adblockRuleToV2Domain(r)
+}
+
+func adblockRuleToV2Domain(r *domain.AdblockRule) *v2data.Domain {
+	d := &v2data.Domain{Value: r.Pattern}
+	switch r.Type {
+	case domain.MatcherFull:
+		d.Type = v2data.Domain_Full
+	case domain.MatcherDomain:
+		d.Type = v2data.Domain_Domain
+	case domain.MatcherRegexp:
+		d.Type = v2data.Domain_Regex
+	case domain.MatcherKeyword:
+		d.Type = v2data.Domain_Plain
+	default:
+		return nil
+	}
+	return d
+}
+
+func convertV2DomainToAdblock(domains []*v2data.Domain, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range domains {
+		var s string
+		switch r.Type {
+		case v2data.Domain_Domain:
+			s = "||" + r.Value + "^"
+		case v2data.Domain_Full:
+			s = "|" + r.Value + "^"
+		case v2data.Domain_Plain:
+			s = r.Value
+		case v2data.Domain_Regex:
+			s = "/" + r.Value + "/"
+		default:
+			return fmt.Errorf("invalid domain type %d", r.Type)
+		}
+		if _, err := bw.WriteString(s + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func parseTextIPRules(r io.Reader) ([]*v2data.CIDR, error) {
+	var out []*v2data.CIDR
+	err := scanRuleLines(r, "#", func(s string) error {
+		var prefix netip.Prefix
+		if strings.ContainsRune(s, '/') {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return err
+			}
+			prefix = p
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, &v2data.CIDR{Ip: prefix.Addr().AsSlice(), Prefix: uint32(prefix.Bits())})
+		return nil
+	})
+	return out, err
+}
+
+// scanRuleLines calls f for every non-empty line in r with comments
+// (started by commentSymbol) and spaces removed.
+func scanRuleLines(r io.Reader, commentSymbol string, f func(s string) error) error {
+	lineCounter := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineCounter++
+		s := utils.RemoveComment(scanner.Text(), commentSymbol)
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if err := f(s); err != nil {
+			return fmt.Errorf("line %d: %w", lineCounter, err)
+		}
+	}
+	return scanner.Err()
+}
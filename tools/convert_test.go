@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_convertRules(t *testing.T) {
+	geoSite, err := proto.Marshal(&v2data.GeoSiteList{Entry: []*v2data.GeoSite{
+		{CountryCode: "B", Domain: []*v2data.Domain{{Type: v2data.Domain_Full, Value: "b.com"}}},
+		{CountryCode: "A", Domain: []*v2data.Domain{{Type: v2data.Domain_Domain, Value: "a.com"}}},
+		{CountryCode: "C", Domain: []*v2data.Domain{{Type: v2data.Domain_Regex, Value: "^c"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoIP, err := proto.Marshal(&v2data.GeoIPList{Entry: []*v2data.GeoIP{
+		{CountryCode: "Y", Cidr: []*v2data.CIDR{{Ip: []byte{2, 2, 2, 0}, Prefix: 24}}},
+		{CountryCode: "X", Cidr: []*v2data.CIDR{{Ip: []byte{1, 1, 1, 1}, Prefix: 32}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		in      string // file name, tags can be appended
+		input   []byte
+		out     string
+		flags   convertFlags
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "text to adblock",
+			in:    "in.txt",
+			input: []byte("a.com\nfull:b.com # comment\nkeyword:c\nregexp:^d\n"),
+			out:   "out.txt",
+			flags: convertFlags{to: formatAdblock},
+			want:  "||a.com^\n|b.com^\nc\n/^d/\n",
+		},
+		{
+			name:  "adblock to text",
+			in:    "in.txt",
+			input: []byte("! title\n[Adblock Plus]\n||a.com^\n|b.com^\n@@||c.com^\n"),
+			out:   "out.txt",
+			flags: convertFlags{from: formatAdblock},
+			want:  "a.com\nfull:b.com\n",
+		},
+		{
+			name:  "v2dat all categories in order",
+			in:    "geosite.dat",
+			input: geoSite,
+			out:   "out.txt",
+			want:  "a.com\nfull:b.com\nregexp:^c\n",
+		},
+		{
+			name:  "v2dat selected categories",
+			in:    "geosite.dat:c,b",
+			input: geoSite,
+			out:   "out.txt",
+			want:  "regexp:^c\nfull:b.com\n",
+		},
+		{
+			name:    "v2dat category not found",
+			in:      "geosite.dat:d",
+			input:   geoSite,
+			out:     "out.txt",
+			wantErr: true,
+		},
+		{
+			name:  "v2dat ip all categories in order",
+			in:    "geoip.dat",
+			input: geoIP,
+			out:   "out.txt",
+			flags: convertFlags{kind: kindIP},
+			want:  "1.1.1.1/32\n2.2.2.0/24\n",
+		},
+		{
+			name:  "text ip",
+			in:    "in.txt",
+			input: []byte("1.1.1.1\n2.2.2.0/24\n::1\n"),
+			out:   "out.txt",
+			flags: convertFlags{kind: kindIP},
+			want:  "1.1.1.1/32\n2.2.2.0/24\n::1/128\n",
+		},
+		{
+			name:    "invalid text ip",
+			in:      "in.txt",
+			input:   []byte("1.1.1\n"),
+			out:     "out.txt",
+			flags:   convertFlags{kind: kindIP},
+			wantErr: true,
+		},
+		{
+			name:    "tags of text input",
+			in:      "in.txt:a",
+			input:   []byte("a.com\n"),
+			out:     "out.txt",
+			wantErr: true,
+		},
+		{
+			name:    "adblock ip",
+			in:      "in.txt",
+			input:   []byte("1.1.1.1\n"),
+			out:     "out.txt",
+			flags:   convertFlags{kind: kindIP, to: formatAdblock},
+			wantErr: true,
+		},
+		{
+			name:    "invalid kind",
+			in:      "in.txt",
+			input:   []byte("a.com\n"),
+			out:     "out.txt",
+			flags:   convertFlags{kind: "asn"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			inFile, _ := splitTags(tt.in)
+			if err := os.WriteFile(filepath.Join(dir, inFile), tt.input, 0644); err != nil {
+				t.Fatal(err)
+			}
+			f := tt.flags
+			f.in = filepath.Join(dir, tt.in)
+			f.out = filepath.Join(dir, tt.out)
+			if len(f.kind) == 0 {
+				f.kind = kindDomain
+			}
+			err := convertRules(&f)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			b, err := os.ReadFile(f.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Fatalf("want output %q, got %q", tt.want, b)
+			}
+		})
+	}
+}
+
+func Test_convertRules_v2datOutput(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(in, []byte("a.com\nfull:b.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dat := filepath.Join(dir, "ads.dat")
+	if err := convertRules(&convertFlags{in: in, out: dat, kind: kindDomain}); err != nil {
+		t.Fatal(err)
+	}
+	// The category tag defaults to the output file name.
+	out := filepath.Join(dir, "out.txt")
+	if err := convertRules(&convertFlags{in: dat + ":ads", out: out, kind: kindDomain}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a.com\nfull:b.com\n"; string(b) != want {
+		t.Fatalf("want output %q, got %q", want, b)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Supported import sources.
+const (
+	importFromAdGuard = "adguard" // AdGuard Home AdGuardHome.yaml
+	importFromPihole  = "pihole"  // Pi-hole teleporter archive or its extracted dir
+	importFromDnsmasq = "dnsmasq" // dnsmasq conf file or a dir of conf files
+)
+
+const (
+	importedConfigFile = "config.yaml"
+	importedBlockFile  = "block.txt"
+	importedAllowFile  = "allow.txt"
+	importedHostsFile  = "hosts.txt"
+
+	// Domains of a domain specific upstream will be written to a
+	// rule file instead of the config if there are too many of them.
+	importedMaxInlineDomains = 32
+)
+
+// importedSettings is the common intermediate representation of
+// the imported settings.
+type importedSettings struct {
+	listen          []string // "host:port"
+	upstreams       []*importedUpstream
+	bootstrap       string
+	domainUpstreams []*importedDomainUpstream
+	clients         []*importedClient
+	cacheSize       int
+
+	block []*v2data.Domain
+	allow []*v2data.Domain
+
+	// URLs of remote AdBlock style filter lists.
+	remoteBlock []string
+	remoteAllow []string
+	hosts       *importedHosts
+}
+
+type importedUpstream struct {
+	Addr        string `yaml:"addr"`
+	Bootstrap   string `yaml:"bootstrap,omitempty"`
+	EnableHTTP3 bool   `yaml:"enable_http3,omitempty"`
+}
+
+// importedDomainUpstream forwards queries of domains to upstreams.
+type importedDomainUpstream struct {
+	domains   []string // mosdns domain rules
+	upstreams []*importedUpstream
+	file      string // rule file of domains, set by ImportConfig
+}
+
+// importedClient uses its own upstreams for queries from ips.
+type importedClient struct {
+	name      string
+	ips       []string // ip or cidr
+	upstreams []*importedUpstream
+}
+
+// importedHosts keeps the order of the domains.
+type importedHosts struct {
+	domains []string
+	ips     map[string][]string
+}
+
+func (h *importedHosts) add(domain, ip string) {
+	if h.ips == nil {
+		h.ips = make(map[string][]string)
+	}
+	if _, ok := h.ips[domain]; !ok {
+		h.domains = append(h.domains, domain)
+	}
+	h.ips[domain] = append(h.ips[domain], ip)
+}
+
+func (h *importedHosts) len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.domains)
+}
+
+func newImportCmd() *cobra.Command {
+	var (
+		from   string
+		in     string
+		outDir string
+		prefix string
+	)
+	c := &cobra.Command{
+		Use:   "import --from adguard|pihole|dnsmasq -i input -o output_dir [--prefix tag_prefix]",
+		Args:  cobra.NoArgs,
+		Short: "Generate mosdns config fragments from AdGuard Home, Pi-hole or dnsmasq configs.",
+		Long: `Generate mosdns config fragments from AdGuard Home, Pi-hole or dnsmasq configs.
+
+For AdGuard Home, the input is the AdGuardHome.yaml file. For Pi-hole, the input
+is a teleporter archive (.tar.gz) or the directory it was extracted to. For
+dnsmasq, the input is a conf file or a directory of conf files, e.g. the
+dnsmasq-china-list.
+
+A config fragment and the generated rule files will be written to the output
+dir. The fragment can be included by the main config or started directly.
+Settings that mosdns can not express are reported and skipped.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := ImportConfig(from, in, outDir, prefix); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVar(&from, "from", "", "input source, adguard, pihole or dnsmasq")
+	fs.StringVarP(&in, "in", "i", "", "input file")
+	fs.StringVarP(&outDir, "out", "o", "", "output dir")
+	fs.StringVar(&prefix, "prefix", "imported", "prefix of generated tags")
+	c.MarkFlagRequired("from")
+	c.MarkFlagRequired("in")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("in")
+	c.MarkFlagDirname("out")
+	return c
+}
+
+// ImportConfig reads settings from in and writes a mosdns config fragment
+// and its rule files to outDir.
+func ImportConfig(from, in, outDir, prefix string) error {
+	var s *importedSettings
+	var err error
+	switch from {
+	case importFromAdGuard:
+		s, err = importAdGuard(in)
+	case importFromPihole:
+		s, err = importPihole(in)
+	case importFromDnsmasq:
+		s, err = importDnsmasq(in)
+	default:
+		return fmt.Errorf("invalid import source %s", from)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read input, %w", err)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	absOutDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+
+	if len(s.block) > 0 {
+		if err := convertV2DomainToTextFile(s.block, filepath.Join(outDir, importedBlockFile)); err != nil {
+			return err
+		}
+	}
+	if len(s.allow) > 0 {
+		if err := convertV2DomainToTextFile(s.allow, filepath.Join(outDir, importedAllowFile)); err != nil {
+			return err
+		}
+	}
+	for i, du := range s.domainUpstreams {
+		if len(du.domains) <= importedMaxInlineDomains {
+			continue
+		}
+		du.file = fmt.Sprintf("domain_%d.txt", i)
+		b := []byte(strings.Join(du.domains, "\n") + "\n")
+		if err := os.WriteFile(filepath.Join(outDir, du.file), b, 0644); err != nil {
+			return err
+		}
+	}
+	if s.hosts.len() > 0 {
+		b := new(bytes.Buffer)
+		for _, d := range s.hosts.domains {
+			fmt.Fprintf(b, "%s %s\n", d, strings.Join(s.hosts.ips[d], " "))
+		}
+		if err := os.WriteFile(filepath.Join(outDir, importedHostsFile), b.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	cfg := new(bytes.Buffer)
+	enc := yaml.NewEncoder(cfg)
+	enc.SetIndent(2)
+	if err := enc.Encode(s.genConfig(absOutDir, prefix)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, importedConfigFile), cfg.Bytes(), 0644); err != nil {
+		return err
+	}
+	mlog.S().Infof(
+		"imported %d upstreams, %d domain upstreams, %d clients, %d block rules, %d allow rules, %d remote lists, %d hosts",
+		len(s.upstreams), len(s.domainUpstreams), len(s.clients), len(s.block), len(s.allow),
+		len(s.remoteBlock)+len(s.remoteAllow), s.hosts.len(),
+	)
+	return nil
+}
+
+// importedConfig is a subset of coremain.Config that only has the
+// sections generated by the importer.
+type importedConfig struct {
+	DataProviders []map[string]interface{} `yaml:"data_providers,omitempty"`
+	Plugins       []coremain.PluginConfig  `yaml:"plugins"`
+	Servers       []map[string]interface{} `yaml:"servers,omitempty"`
+}
+
+func (s *importedSettings) genConfig(dir, prefix string) *importedConfig {
+	cfg := new(importedConfig)
+	tag := func(name string) string {
+		return prefix + "_" + name
+	}
+	addProvider := func(name, file string) string {
+		t := tag(name)
+		cfg.DataProviders = append(cfg.DataProviders, map[string]interface{}{
+			"tag":         t,
+			"file":        filepath.Join(dir, file),
+			"auto_reload": true,
+		})
+		return "provider:" + t
+	}
+	addPlugin := func(name, typ string, args interface{}) string {
+		t := tag(name)
+		cfg.Plugins = append(cfg.Plugins, coremain.PluginConfig{Tag: t, Type: typ, Args: args})
+		return t
+	}
+	forwardArgs := func(ups []*importedUpstream) map[string]interface{} {
+		return map[string]interface{}{"upstream": ups}
+	}
+
+	addRemoteProvider := func(kind, name, url string) string {
+		t := tag(name)
+		cfg.DataProviders = append(cfg.DataProviders, map[string]interface{}{
+			"tag":  t,
+			"file": filepath.Join(dir, name+".txt"),
+			"url":  url,
+		})
+		return kind + ":" + t
+	}
+
+	var seq []interface{}
+	if s.hosts.len() > 0 {
+		p := addProvider("hosts", importedHostsFile)
+		seq = append(seq, addPlugin("hosts", "hosts", map[string]interface{}{"hosts": []string{p}}))
+	}
+
+	var blockDomains, allowDomains []string
+	if len(s.block) > 0 {
+		blockDomains = append(blockDomains, addProvider("block", importedBlockFile))
+	}
+	for i, u := range s.remoteBlock {
+		blockDomains = append(blockDomains, addRemoteProvider("adblock", "filter_"+strconv.Itoa(i), u))
+	}
+	if len(s.allow) > 0 {
+		allowDomains = append(allowDomains, addProvider("allow", importedAllowFile))
+	}
+	// Remote allowlists are matched with the remote filter lists as one
+	// list, so they un-block the domains of any filter list.
+	for i, u := range s.remoteAllow {
+		blockDomains = append(blockDomains, addRemoteProvider("adblock_allow", "allow_filter_"+strconv.Itoa(i), u))
+	}
+	if len(blockDomains) > 0 {
+		cond := addPlugin("block", "query_matcher", map[string]interface{}{"domain": blockDomains})
+		if len(allowDomains) > 0 {
+			cond = fmt.Sprintf("%s && !%s", cond, addPlugin("allow", "query_matcher", map[string]interface{}{"domain": allowDomains}))
+		}
+		seq = append(seq, map[string]interface{}{
+			"if":   cond,
+			"exec": []string{"_new_nxdomain_response", "_return"},
+		})
+	}
+	if s.cacheSize > 0 {
+		seq = append(seq, addPlugin("cache", "cache", map[string]interface{}{"size": s.cacheSize}))
+	}
+	for i, du := range s.domainUpstreams {
+		domains := du.domains
+		if len(du.file) > 0 {
+			domains = []string{addProvider("domain_"+strconv.Itoa(i), du.file)}
+		}
+		m := addPlugin("domain_"+strconv.Itoa(i), "query_matcher", map[string]interface{}{"domain": domains})
+		f := addPlugin("domain_forward_"+strconv.Itoa(i), "fast_forward", forwardArgs(du.upstreams))
+		seq = append(seq, map[string]interface{}{"if": m, "exec": []string{f, "_return"}})
+	}
+	for i, c := range s.clients {
+		m := addPlugin("client_"+strconv.Itoa(i), "query_matcher", map[string]interface{}{"client_ip": c.ips})
+		f := addPlugin("client_forward_"+strconv.Itoa(i), "fast_forward", forwardArgs(c.upstreams))
+		seq = append(seq, map[string]interface{}{"if": m, "exec": []string{f, "_return"}})
+	}
+	if len(s.upstreams) > 0 {
+		seq = append(seq, addPlugin("forward", "fast_forward", forwardArgs(s.upstreams)))
+	}
+	mainTag := addPlugin("main", "sequence", map[string]interface{}{"exec": seq})
+
+	if len(s.listen) > 0 {
+		var listeners []map[string]interface{}
+		for _, addr := range s.listen {
+			listeners = append(listeners,
+				map[string]interface{}{"protocol": "udp", "addr": addr},
+				map[string]interface{}{"protocol": "tcp", "addr": addr},
+			)
+		}
+		cfg.Servers = append(cfg.Servers, map[string]interface{}{"exec": mainTag, "listeners": listeners})
+	}
+	return cfg
+}
+
+// parseImportedUpstream converts an AdGuard Home or Pi-hole upstream
+// address to a mosdns upstream. It returns nil if addr is not supported.
+func parseImportedUpstream(addr string) *importedUpstream {
+	scheme, rest, hasScheme := strings.Cut(addr, "://")
+	if !hasScheme {
+		return &importedUpstream{Addr: addr}
+	}
+	switch scheme {
+	case "udp", "tcp", "tls", "https":
+		return &importedUpstream{Addr: addr}
+	case "h3":
+		return &importedUpstream{Addr: "https://" + rest, EnableHTTP3: true}
+	default:
+		mlog.S().Warnf("upstream %s is not supported and was skipped", addr)
+		return nil
+	}
+}
+
+// parseImportedClientID returns a mosdns client_ip rule from a client id.
+// It returns an empty string if id is not an ip or a cidr.
+func parseImportedClientID(id string) string {
+	if _, err := netip.ParseAddr(id); err == nil {
+		return id
+	}
+	if _, err := netip.ParsePrefix(id); err == nil {
+		return id
+	}
+	return ""
+}
+
+// joinHostPort is like net.JoinHostPort but an empty host means
+// all interfaces.
+func joinHostPort(host string, port int) string {
+	if len(host) == 0 {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,374 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"gopkg.in/yaml.v3"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adGuardConfig is the subset of AdGuardHome.yaml that can be imported.
+type adGuardConfig struct {
+	DNS struct {
+		BindHosts        []string          `yaml:"bind_hosts"`
+		Port             int               `yaml:"port"`
+		UpstreamDNS      []string          `yaml:"upstream_dns"`
+		UpstreamDNSFile  string            `yaml:"upstream_dns_file"`
+		BootstrapDNS     []string          `yaml:"bootstrap_dns"`
+		CacheSize        int               `yaml:"cache_size"`
+		Rewrites         []*adGuardRewrite `yaml:"rewrites"`
+		FilteringEnabled *bool             `yaml:"filtering_enabled"`
+	} `yaml:"dns"`
+
+	// Since schema version 20, rewrites were moved to here.
+	Filtering struct {
+		Rewrites []*adGuardRewrite `yaml:"rewrites"`
+	} `yaml:"filtering"`
+
+	Filters          []*adGuardFilter `yaml:"filters"`
+	WhitelistFilters []*adGuardFilter `yaml:"whitelist_filters"`
+	UserRules        []string         `yaml:"user_rules"`
+
+	// Clients is a list in old versions and a map that has a
+	// "persistent" list in new versions.
+	Clients yaml.Node `yaml:"clients"`
+}
+
+type adGuardRewrite struct {
+	Domain string `yaml:"domain"`
+	Answer string `yaml:"answer"`
+}
+
+type adGuardFilter struct {
+	Enabled bool   `yaml:"enabled"`
+	URL     string `yaml:"url"`
+	Name    string `yaml:"name"`
+}
+
+type adGuardClient struct {
+	Name      string   `yaml:"name"`
+	IDs       []string `yaml:"ids"`
+	Upstreams []string `yaml:"upstreams"`
+}
+
+func importAdGuard(file string) (*importedSettings, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(adGuardConfig)
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+
+	s := &importedSettings{hosts: new(importedHosts)}
+	port := cfg.DNS.Port
+	if port == 0 {
+		port = 53
+	}
+	for _, h := range cfg.DNS.BindHosts {
+		s.listen = append(s.listen, joinHostPort(h, port))
+	}
+	if len(s.listen) == 0 {
+		s.listen = append(s.listen, joinHostPort("", port))
+	}
+
+	for _, addr := range cfg.DNS.BootstrapDNS {
+		if bs := adGuardBootstrap(addr); len(bs) > 0 {
+			s.bootstrap = bs
+			break
+		}
+	}
+
+	upstreams := cfg.DNS.UpstreamDNS
+	if f := cfg.DNS.UpstreamDNSFile; len(f) > 0 {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(filepath.Dir(file), f)
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream file, %w", err)
+		}
+		upstreams = strings.Split(string(b), "\n")
+	}
+	if err := s.parseAdGuardUpstreams(upstreams); err != nil {
+		return nil, err
+	}
+
+	if cfg.DNS.CacheSize > 0 {
+		// AdGuard Home sets the cache size in bytes. mosdns sets it in entries.
+		// Assume ~1KB per entry.
+		s.cacheSize = cfg.DNS.CacheSize / 1024
+		if s.cacheSize < 1024 {
+			s.cacheSize = 1024
+		}
+	}
+
+	for _, r := range append(cfg.DNS.Rewrites, cfg.Filtering.Rewrites...) {
+		s.addAdGuardRewrite(r)
+	}
+
+	if cfg.DNS.FilteringEnabled == nil || *cfg.DNS.FilteringEnabled {
+		for _, f := range cfg.Filters {
+			if err := s.loadAdGuardFilter(f, file, false); err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range cfg.WhitelistFilters {
+			if err := s.loadAdGuardFilter(f, file, true); err != nil {
+				return nil, err
+			}
+		}
+		skipped := 0
+		for _, r := range cfg.UserRules {
+			if !s.addAdGuardUserRule(r) {
+				skipped++
+			}
+		}
+		if skipped > 0 {
+			mlog.S().Warnf("%d user rules can not be converted and were skipped", skipped)
+		}
+	}
+
+	clients, err := decodeAdGuardClients(&cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode clients, %w", err)
+	}
+	for _, c := range clients {
+		if err := s.addAdGuardClient(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseAdGuardUpstreams parses upstream lines, including the domain
+// specific ones like "[/example.com/]1.1.1.1".
+func (s *importedSettings) parseAdGuardUpstreams(lines []string) error {
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if !strings.HasPrefix(l, "[/") {
+			s.upstreams = s.appendUpstreams(s.upstreams, strings.Fields(l))
+			continue
+		}
+
+		domainsStr, addrs, ok := strings.Cut(l[2:], "/]")
+		if !ok {
+			return fmt.Errorf("invalid domain specific upstream %s", l)
+		}
+		if f := strings.Fields(addrs); len(f) == 0 || f[0] == "#" {
+			mlog.S().Warnf("domain specific upstream %s uses default upstreams and was skipped", l)
+			continue
+		}
+		du := new(importedDomainUpstream)
+		for _, d := range strings.Split(domainsStr, "/") {
+			if d = strings.TrimPrefix(d, "*."); len(d) > 0 {
+				du.domains = append(du.domains, d)
+			}
+		}
+		du.upstreams = s.appendUpstreams(nil, strings.Fields(addrs))
+		if len(du.domains) > 0 && len(du.upstreams) > 0 {
+			s.domainUpstreams = append(s.domainUpstreams, du)
+		}
+	}
+	return nil
+}
+
+func (s *importedSettings) appendUpstreams(ups []*importedUpstream, addrs []string) []*importedUpstream {
+	for _, addr := range addrs {
+		u := parseImportedUpstream(addr)
+		if u == nil {
+			continue
+		}
+		if len(s.bootstrap) > 0 && upstreamNeedsBootstrap(u.Addr) {
+			u.Bootstrap = s.bootstrap
+		}
+		ups = append(ups, u)
+	}
+	return ups
+}
+
+func (s *importedSettings) addAdGuardRewrite(r *adGuardRewrite) {
+	// The hosts plugin uses full match by default.
+	d := "full:" + r.Domain
+	if strings.HasPrefix(r.Domain, "*.") {
+		d = "domain:" + strings.TrimPrefix(r.Domain, "*.")
+	}
+	if _, err := netip.ParseAddr(r.Answer); err != nil {
+		mlog.S().Warnf("rewrite %s -> %s is not an ip rewrite and was skipped", r.Domain, r.Answer)
+		return
+	}
+	s.hosts.add(d, r.Answer)
+}
+
+func (s *importedSettings) loadAdGuardFilter(f *adGuardFilter, cfgFile string, allow bool) error {
+	if !f.Enabled {
+		return nil
+	}
+	if u, err := url.Parse(f.URL); err == nil && len(u.Scheme) > 1 {
+		if allow {
+			s.remoteAllow = append(s.remoteAllow, f.URL)
+		} else {
+			s.remoteBlock = append(s.remoteBlock, f.URL)
+		}
+		return nil
+	}
+	p := f.URL
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(cfgFile), p)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("failed to read filter %s, %w", f.Name, err)
+	}
+	if allow {
+		b = bytes.ReplaceAll(b, []byte("@@"), nil)
+	}
+	rules, err := parseAdblockDomainRules(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to parse filter %s, %w", f.Name, err)
+	}
+	if allow {
+		s.allow = append(s.allow, rules...)
+	} else {
+		s.block = append(s.block, rules...)
+	}
+	return nil
+}
+
+// addAdGuardUserRule adds a user rule. It reports whether r was converted.
+func (s *importedSettings) addAdGuardUserRule(r string) bool {
+	r = strings.TrimSpace(r)
+	if len(r) == 0 || strings.HasPrefix(r, "!") || strings.HasPrefix(r, "#") {
+		return true
+	}
+
+	// A hosts style rule with a real address is a rewrite.
+	if f := strings.Fields(r); len(f) >= 2 {
+		if addr, err := netip.ParseAddr(f[0]); err == nil && !addr.IsUnspecified() && !addr.IsLoopback() {
+			for _, d := range f[1:] {
+				s.hosts.add("full:"+d, f[0])
+			}
+			return true
+		}
+	}
+
+	rule, ok := domain.ParseAdblockRule(r)
+	if !ok {
+		return false
+	}
+	d := adblockRuleToV2Domain(rule)
+	if d == nil {
+		return false
+	}
+	if rule.Exception {
+		s.allow = append(s.allow, d)
+	} else {
+		s.block = append(s.block, d)
+	}
+	return true
+}
+
+func (s *importedSettings) addAdGuardClient(c *adGuardClient) error {
+	if len(c.Upstreams) == 0 {
+		return nil
+	}
+	ic := &importedClient{name: c.Name}
+	for _, id := range c.IDs {
+		if ip := parseImportedClientID(id); len(ip) > 0 {
+			ic.ips = append(ic.ips, ip)
+		} else {
+			mlog.S().Warnf("client %s: id %s is not an ip or cidr and was skipped", c.Name, id)
+		}
+	}
+	for _, l := range c.Upstreams {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "[/") {
+			mlog.S().Warnf("client %s: domain specific upstream %s is not supported and was skipped", c.Name, l)
+			continue
+		}
+		ic.upstreams = s.appendUpstreams(ic.upstreams, strings.Fields(l))
+	}
+	if len(ic.ips) > 0 && len(ic.upstreams) > 0 {
+		s.clients = append(s.clients, ic)
+	}
+	return nil
+}
+
+func decodeAdGuardClients(n *yaml.Node) ([]*adGuardClient, error) {
+	var clients []*adGuardClient
+	switch n.Kind {
+	case 0:
+		return nil, nil
+	case yaml.SequenceNode:
+		if err := n.Decode(&clients); err != nil {
+			return nil, err
+		}
+	default:
+		v := new(struct {
+			Persistent []*adGuardClient `yaml:"persistent"`
+		})
+		if err := n.Decode(v); err != nil {
+			return nil, err
+		}
+		clients = v.Persistent
+	}
+	return clients, nil
+}
+
+// adGuardBootstrap returns a mosdns bootstrap address from an AdGuard
+// Home bootstrap address. Only plain dns servers are supported.
+func adGuardBootstrap(addr string) string {
+	addr = strings.TrimPrefix(addr, "udp://")
+	if _, err := netip.ParseAddr(addr); err == nil {
+		return addr
+	}
+	if _, err := netip.ParseAddrPort(addr); err == nil {
+		return addr
+	}
+	return ""
+}
+
+// upstreamNeedsBootstrap reports whether the host of addr is a domain.
+func upstreamNeedsBootstrap(addr string) bool {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	_, err = netip.ParseAddr(u.Hostname())
+	return err != nil
+}
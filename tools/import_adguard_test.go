@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_importAdGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string // AdGuardHome.yaml and the files it refers to
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "upstreams",
+			files: map[string]string{"AdGuardHome.yaml": `
+dns:
+  bind_hosts: [127.0.0.1, "::1"]
+  port: 5353
+  upstream_dns:
+    - tls://dns.google
+    - "# comment"
+    - 8.8.8.8 h3://dns.example
+    - quic://dns.example
+    - "[/lan/*.home/]192.168.1.1"
+    - "[/ads.com/]#"
+  bootstrap_dns: [https://1.1.1.1/dns-query, 9.9.9.9]
+  cache_size: 4194304
+`},
+			want: "listen: 127.0.0.1:5353 [::1]:5353\n" +
+				"upstream: tls://dns.google(bootstrap 9.9.9.9) 8.8.8.8 https://dns.example(bootstrap 9.9.9.9)(h3)\n" +
+				"domain upstream: lan home -> 192.168.1.1\n" +
+				"cache: 4096",
+		},
+		{
+			name: "upstream file",
+			files: map[string]string{
+				"AdGuardHome.yaml": "dns:\n  upstream_dns: [1.1.1.1]\n  upstream_dns_file: upstreams.txt\n",
+				"upstreams.txt":    "# comment\n8.8.8.8\n[/lan/]192.168.1.1\n",
+			},
+			want: "listen: 0.0.0.0:53\n" +
+				"upstream: 8.8.8.8\n" +
+				"domain upstream: lan -> 192.168.1.1",
+		},
+		{
+			name: "rewrites",
+			files: map[string]string{"AdGuardHome.yaml": `
+dns:
+  rewrites:
+    - {domain: nas.lan, answer: 192.168.1.2}
+    - {domain: "*.example.com", answer: "::1"}
+    - {domain: a.com, answer: b.com}
+filtering:
+  rewrites:
+    - {domain: nas.lan, answer: 192.168.1.3}
+`},
+			want: "listen: 0.0.0.0:53\n" +
+				"hosts full:nas.lan: 192.168.1.2 192.168.1.3\n" +
+				"hosts domain:example.com: ::1",
+		},
+		{
+			name: "filters and user rules",
+			files: map[string]string{
+				"AdGuardHome.yaml": `
+filters:
+  - {enabled: true, url: filters/block.txt, name: local}
+  - {enabled: false, url: filters/not_exist.txt, name: disabled}
+  - {enabled: true, url: "https://example.com/filter.txt", name: remote}
+whitelist_filters:
+  - {enabled: true, url: filters/allow.txt, name: local_allow}
+  - {enabled: true, url: "https://example.com/allow.txt", name: remote_allow}
+user_rules:
+  - "! comment"
+  - "||user.ads.com^"
+  - "@@||good.ads.com^"
+  - 192.168.1.2 nas.lan router.lan
+  - example.com##.banner
+`,
+				"filters/block.txt": "! comment\n||ads.com^\n|full.ads.com^\n",
+				"filters/allow.txt": "@@||good.com^\n",
+			},
+			want: "listen: 0.0.0.0:53\n" +
+				"block: ads.com full:full.ads.com user.ads.com\n" +
+				"allow: good.com good.ads.com\n" +
+				"remote block: https://example.com/filter.txt\n" +
+				"remote allow: https://example.com/allow.txt\n" +
+				"hosts full:nas.lan: 192.168.1.2\n" +
+				"hosts full:router.lan: 192.168.1.2",
+		},
+		{
+			name: "filtering disabled",
+			files: map[string]string{"AdGuardHome.yaml": `
+dns:
+  filtering_enabled: false
+filters:
+  - {enabled: true, url: filters/not_exist.txt}
+user_rules: ["||ads.com^"]
+`},
+			want: "listen: 0.0.0.0:53",
+		},
+		{
+			name: "clients list",
+			files: map[string]string{"AdGuardHome.yaml": `
+clients:
+  - name: kid
+    ids: [192.168.1.10, "aa:bb:cc:dd:ee:ff", 192.168.2.0/24]
+    upstreams: [8.8.8.8, "[/lan/]192.168.1.1"]
+  - name: default
+    ids: [192.168.1.11]
+`},
+			want: "listen: 0.0.0.0:53\n" +
+				"client kid: 192.168.1.10 192.168.2.0/24 -> 8.8.8.8",
+		},
+		{
+			name: "clients map",
+			files: map[string]string{"AdGuardHome.yaml": `
+clients:
+  runtime_sources: {whois: true}
+  persistent:
+    - name: kid
+      ids: [192.168.1.10]
+      upstreams: [8.8.8.8]
+`},
+			want: "listen: 0.0.0.0:53\n" +
+				"client kid: 192.168.1.10 -> 8.8.8.8",
+		},
+		{
+			name:    "invalid domain upstream",
+			files:   map[string]string{"AdGuardHome.yaml": "dns:\n  upstream_dns: [\"[/lan 1.1.1.1\"]\n"},
+			wantErr: true,
+		},
+		{
+			name:    "missing filter",
+			files:   map[string]string{"AdGuardHome.yaml": "filters:\n  - {enabled: true, url: not_exist.txt}\n"},
+			wantErr: true,
+		},
+		{
+			name:    "missing upstream file",
+			files:   map[string]string{"AdGuardHome.yaml": "dns:\n  upstream_dns_file: not_exist.txt\n"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeImportFiles(t, dir, tt.files)
+			s, err := importAdGuard(filepath.Join(dir, "AdGuardHome.yaml"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importAdGuard() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := dumpImported(t, s); got != tt.want {
+				t.Fatalf("importAdGuard() got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dnsmasqParser collects the settings from dnsmasq conf files.
+type dnsmasqParser struct {
+	s *importedSettings
+
+	port          int
+	listenAddrs   []string
+	domains       []string            // domains of "server=", in order
+	domainServers map[string][]string // domain -> servers
+	unsupported   map[string]int      // directive -> count
+}
+
+// importDnsmasq imports a dnsmasq conf file or all "*.conf" files in a dir.
+// server=, local=, address=, listen-address=, port= and cache-size= are
+// supported.
+func importDnsmasq(in string) (*importedSettings, error) {
+	p := &dnsmasqParser{
+		s:             &importedSettings{hosts: new(importedHosts)},
+		port:          53,
+		domainServers: make(map[string][]string),
+		unsupported:   make(map[string]int),
+	}
+
+	files := []string{in}
+	fi, err := os.Stat(in)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(in, "*.conf"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		// "#" is also used in values, e.g. "server=1.1.1.1#53". So only
+		// lines that begin with "#" are comments.
+		for i, l := range strings.Split(string(b), "\n") {
+			l = strings.TrimSpace(l)
+			if len(l) == 0 || strings.HasPrefix(l, "#") {
+				continue
+			}
+			if err := p.parseLine(l); err != nil {
+				return nil, fmt.Errorf("failed to parse %s, line %d: %w", f, i+1, err)
+			}
+		}
+	}
+	p.finish()
+	return p.s, nil
+}
+
+func (p *dnsmasqParser) parseLine(l string) error {
+	k, v, ok := strings.Cut(l, "=")
+	if !ok {
+		return nil // boolean options
+	}
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	switch k {
+	case "server", "local":
+		return p.parseServer(v)
+	case "address":
+		return p.parseAddress(v)
+	case "listen-address":
+		p.listenAddrs = append(p.listenAddrs, strings.Split(v, ",")...)
+	case "port":
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid port %s", v)
+		}
+		p.port = port
+	case "cache-size":
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid cache-size %s", v)
+		}
+		p.s.cacheSize = size
+	default:
+		p.unsupported[k]++
+	}
+	return nil
+}
+
+// splitDnsmasqDomains splits "/d1/d2/value" to domains and value.
+// It returns hasDomain = false if s does not begin with "/".
+func splitDnsmasqDomains(s string) (domains []string, value string, hasDomain bool, err error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, s, false, nil
+	}
+	i := strings.LastIndexByte(s, '/')
+	if i == 0 {
+		return nil, "", true, fmt.Errorf("missing closing / in %s", s)
+	}
+	for _, d := range strings.Split(s[1:i], "/") {
+		d = strings.TrimPrefix(d, "*.")
+		if len(d) > 0 {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, "", true, fmt.Errorf("no domain in %s", s)
+	}
+	return domains, s[i+1:], true, nil
+}
+
+func (p *dnsmasqParser) parseServer(v string) error {
+	domains, addr, hasDomain, err := splitDnsmasqDomains(v)
+	if err != nil {
+		return err
+	}
+	if len(addr) > 0 && addr != "#" {
+		if i := strings.IndexByte(addr, '@'); i >= 0 {
+			mlog.S().Warnf("source address or interface of server %s is not supported and was ignored", v)
+			addr = addr[:i]
+		}
+		addr = piholeUpstream(addr)
+	}
+	if !hasDomain {
+		if len(addr) > 0 {
+			p.s.upstreams = p.s.appendUpstreams(p.s.upstreams, []string{addr})
+		}
+		return nil
+	}
+
+	for _, d := range domains {
+		switch {
+		case d == "#":
+			mlog.S().Warnf("server %s for all domains is not supported and was skipped", v)
+		case addr == "#":
+			// Use the default upstreams, nothing to do.
+		case len(addr) == 0:
+			// Local only domain.
+			p.s.block = append(p.s.block, &v2data.Domain{Type: v2data.Domain_Domain, Value: d})
+		default:
+			if _, ok := p.domainServers[d]; !ok {
+				p.domains = append(p.domains, d)
+			}
+			p.domainServers[d] = append(p.domainServers[d], addr)
+		}
+	}
+	return nil
+}
+
+func (p *dnsmasqParser) parseAddress(v string) error {
+	domains, addr, hasDomain, err := splitDnsmasqDomains(v)
+	if err != nil {
+		return err
+	}
+	if !hasDomain {
+		return fmt.Errorf("invalid address %s", v)
+	}
+	for _, d := range domains {
+		if d == "#" {
+			mlog.S().Warnf("address %s for all domains is not supported and was skipped", v)
+			continue
+		}
+		switch addr {
+		case "", "#":
+			// NXDOMAIN or null address, both are blocked with NXDOMAIN here.
+			p.s.block = append(p.s.block, &v2data.Domain{Type: v2data.Domain_Domain, Value: d})
+		default:
+			if _, err := netip.ParseAddr(addr); err != nil {
+				return fmt.Errorf("invalid address %s", v)
+			}
+			p.s.hosts.add("domain:"+d, addr)
+		}
+	}
+	return nil
+}
+
+// finish groups domains that have the same servers.
+func (p *dnsmasqParser) finish() {
+	groups := make(map[string]*importedDomainUpstream)
+	for _, d := range p.domains {
+		servers := p.domainServers[d]
+		key := strings.Join(servers, " ")
+		du, ok := groups[key]
+		if !ok {
+			du = &importedDomainUpstream{upstreams: p.s.appendUpstreams(nil, servers)}
+			groups[key] = du
+			if len(du.upstreams) > 0 {
+				p.s.domainUpstreams = append(p.s.domainUpstreams, du)
+			}
+		}
+		du.domains = append(du.domains, d)
+	}
+
+	if p.port > 0 {
+		if len(p.listenAddrs) == 0 {
+			p.listenAddrs = []string{""}
+		}
+		for _, addr := range p.listenAddrs {
+			p.s.listen = append(p.s.listen, joinHostPort(strings.TrimSpace(addr), p.port))
+		}
+	}
+
+	keys := make([]string, 0, len(p.unsupported))
+	for k := range p.unsupported {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mlog.S().Warnf("%d %s directives are not supported and were skipped", p.unsupported[k], k)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_splitDnsmasqDomains(t *testing.T) {
+	tests := []struct {
+		s             string
+		wantDomains   []string
+		wantValue     string
+		wantHasDomain bool
+		wantErr       bool
+	}{
+		{s: "1.1.1.1", wantValue: "1.1.1.1"},
+		{s: "/example.com/1.1.1.1", wantDomains: []string{"example.com"}, wantValue: "1.1.1.1", wantHasDomain: true},
+		{s: "/a.com/*.b.com/", wantDomains: []string{"a.com", "b.com"}, wantHasDomain: true},
+		{s: "/", wantHasDomain: true, wantErr: true},
+		{s: "//1.1.1.1", wantHasDomain: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			domains, value, hasDomain, err := splitDnsmasqDomains(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitDnsmasqDomains() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(domains, tt.wantDomains) || value != tt.wantValue || hasDomain != tt.wantHasDomain {
+				t.Errorf("splitDnsmasqDomains() = %v, %q, %v", domains, value, hasDomain)
+			}
+		})
+	}
+}
+
+func Test_dnsmasqParser_parseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{"server=/", true},
+		{"server=//1.1.1.1", true},
+		{"address=/", true},
+		{"address=1.1.1.1", true},
+		{"server=/example.com/1.1.1.1", false},
+		{"address=/example.com/127.0.0.1", false},
+		{"local=/lan/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			p := &dnsmasqParser{
+				s:             &importedSettings{hosts: new(importedHosts)},
+				domainServers: make(map[string][]string),
+				unsupported:   make(map[string]int),
+			}
+			if err := p.parseLine(tt.line); (err != nil) != tt.wantErr {
+				t.Errorf("parseLine() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_importDnsmasq(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		in      string // file or dir in the test dir
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "file",
+			files: map[string]string{"dnsmasq.conf": `
+# comment
+no-resolv
+port=5353
+listen-address=127.0.0.1,::1
+cache-size=4096
+server=1.1.1.1#53
+server=/lan/192.168.1.1
+server=/a.com/*.b.com/8.8.8.8
+server=/c.com/#
+local=/local/
+address=/ads.com/
+address=/nas.lan/192.168.1.2
+`},
+			in: "dnsmasq.conf",
+			want: "listen: 127.0.0.1:5353 [::1]:5353\n" +
+				"upstream: 1.1.1.1:53\n" +
+				"domain upstream: lan -> 192.168.1.1\n" +
+				"domain upstream: a.com b.com -> 8.8.8.8\n" +
+				"cache: 4096\n" +
+				"block: local ads.com\n" +
+				"hosts domain:nas.lan: 192.168.1.2",
+		},
+		{
+			name: "dir",
+			files: map[string]string{
+				"b.conf":      "server=/b.com/114.114.114.114\nserver=/c.com/8.8.8.8\n",
+				"a.conf":      "server=/a.com/114.114.114.114\n",
+				"ignored.txt": "server=/d.com/114.114.114.114\n",
+			},
+			in: ".",
+			want: "listen: 0.0.0.0:53\n" +
+				"domain upstream: a.com b.com -> 114.114.114.114\n" +
+				"domain upstream: c.com -> 8.8.8.8",
+		},
+		{
+			name: "server source address",
+			files: map[string]string{
+				"dnsmasq.conf": "server=/lan/192.168.1.1#5353@eth0\n",
+			},
+			in: "dnsmasq.conf",
+			want: "listen: 0.0.0.0:53\n" +
+				"domain upstream: lan -> 192.168.1.1:5353",
+		},
+		{
+			name:    "invalid port",
+			files:   map[string]string{"dnsmasq.conf": "port=x\n"},
+			in:      "dnsmasq.conf",
+			wantErr: true,
+		},
+		{
+			name:    "invalid address",
+			files:   map[string]string{"dnsmasq.conf": "address=/a.com/x\n"},
+			in:      "dnsmasq.conf",
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			in:      "not_exist.conf",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeImportFiles(t, dir, tt.files)
+			s, err := importDnsmasq(filepath.Join(dir, tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importDnsmasq() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := dumpImported(t, s); got != tt.want {
+				t.Fatalf("importDnsmasq() got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// piholeListEntry is an entry of the domain list or the adlist
+// tables exported by Pi-hole v5.
+type piholeListEntry struct {
+	Domain  string `json:"domain"`
+	Address string `json:"address"`
+	Enabled int    `json:"enabled"`
+}
+
+// importPihole imports a teleporter archive or its extracted dir. Both
+// the v5 (json tables) and the v4 (plain lists) layouts are supported.
+func importPihole(in string) (*importedSettings, error) {
+	files, err := readPiholeFiles(in)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &importedSettings{hosts: new(importedHosts), listen: []string{joinHostPort("", 53)}}
+	if b, ok := files["setupVars.conf"]; ok {
+		if err := s.parsePiholeSetupVars(b); err != nil {
+			return nil, fmt.Errorf("failed to parse setupVars.conf, %w", err)
+		}
+	}
+
+	// v5
+	for _, t := range [...]struct {
+		file  string
+		allow bool
+		regex bool
+	}{
+		{"blacklist.exact.json", false, false},
+		{"blacklist.regex.json", false, true},
+		{"whitelist.exact.json", true, false},
+		{"whitelist.regex.json", true, true},
+	} {
+		b, ok := files[t.file]
+		if !ok {
+			continue
+		}
+		var entries []piholeListEntry
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse %s, %w", t.file, err)
+		}
+		for _, e := range entries {
+			if e.Enabled != 0 {
+				s.addPiholeDomain(e.Domain, t.allow, t.regex)
+			}
+		}
+	}
+	if b, ok := files["adlist.json"]; ok {
+		var entries []piholeListEntry
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse adlist.json, %w", err)
+		}
+		for _, e := range entries {
+			if e.Enabled != 0 {
+				s.remoteBlock = append(s.remoteBlock, e.Address)
+			}
+		}
+	}
+	if _, ok := files["client.json"]; ok {
+		mlog.S().Warn("Pi-hole clients and groups can not be converted and were skipped")
+	}
+
+	// v4
+	for _, t := range [...]struct {
+		file  string
+		allow bool
+		regex bool
+	}{
+		{"blacklist.txt", false, false},
+		{"regex.list", false, true},
+		{"whitelist.txt", true, false},
+	} {
+		if b, ok := files[t.file]; ok {
+			_ = scanRuleLines(bytes.NewReader(b), "#", func(l string) error {
+				s.addPiholeDomain(l, t.allow, t.regex)
+				return nil
+			})
+		}
+	}
+	if b, ok := files["adlists.list"]; ok {
+		_ = scanRuleLines(bytes.NewReader(b), "#", func(l string) error {
+			s.remoteBlock = append(s.remoteBlock, l)
+			return nil
+		})
+	}
+
+	// Local dns records.
+	if b, ok := files["custom.list"]; ok {
+		_ = scanRuleLines(bytes.NewReader(b), "#", func(l string) error {
+			f := strings.Fields(l)
+			if len(f) < 2 {
+				return nil
+			}
+			if _, err := netip.ParseAddr(f[0]); err != nil {
+				mlog.S().Warnf("invalid local dns record %s was skipped", l)
+				return nil
+			}
+			for _, d := range f[1:] {
+				s.hosts.add("full:"+d, f[0])
+			}
+			return nil
+		})
+	}
+	if _, ok := files["05-pihole-custom-cname.conf"]; ok {
+		mlog.S().Warn("Pi-hole local cname records can not be converted and were skipped")
+	}
+	return s, nil
+}
+
+// readPiholeFiles reads all regular files in a teleporter archive or a dir.
+// The returned map is keyed by file base name.
+func readPiholeFiles(in string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	fi, err := os.Stat(in)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		err := filepath.Walk(in, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[filepath.Base(path)] = b
+			return nil
+		})
+		return files, err
+	}
+
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(h.Name)] = b
+	}
+	return files, nil
+}
+
+func (s *importedSettings) parsePiholeSetupVars(b []byte) error {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "="); ok {
+			vars[k] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i := 1; ; i++ {
+		v, ok := vars[fmt.Sprintf("PIHOLE_DNS_%d", i)]
+		if !ok {
+			break
+		}
+		if len(v) > 0 {
+			s.upstreams = s.appendUpstreams(s.upstreams, []string{piholeUpstream(v)})
+		}
+	}
+
+	// Conditional forwarding.
+	if vars["REV_SERVER"] == "true" && len(vars["REV_SERVER_TARGET"]) > 0 {
+		du := &importedDomainUpstream{
+			upstreams: s.appendUpstreams(nil, []string{piholeUpstream(vars["REV_SERVER_TARGET"])}),
+		}
+		if d := vars["REV_SERVER_DOMAIN"]; len(d) > 0 {
+			du.domains = append(du.domains, d)
+		}
+		if cidr := vars["REV_SERVER_CIDR"]; len(cidr) > 0 {
+			if d, ok := reverseZone(cidr); ok {
+				du.domains = append(du.domains, d)
+			}
+		}
+		if len(du.domains) > 0 && len(du.upstreams) > 0 {
+			s.domainUpstreams = append(s.domainUpstreams, du)
+		}
+	}
+	return nil
+}
+
+func (s *importedSettings) addPiholeDomain(d string, allow, regex bool) {
+	var rule *v2data.Domain
+	if regex {
+		if _, err := regexp.Compile(d); err != nil {
+			mlog.S().Warnf("regex %s is not supported and was skipped, %s", d, err)
+			return
+		}
+		rule = &v2data.Domain{Type: v2data.Domain_Regex, Value: d}
+	} else {
+		rule = &v2data.Domain{Type: v2data.Domain_Full, Value: d}
+	}
+	if allow {
+		s.allow = append(s.allow, rule)
+	} else {
+		s.block = append(s.block, rule)
+	}
+}
+
+// piholeUpstream converts Pi-hole's "ip#port" notation to "ip:port".
+func piholeUpstream(s string) string {
+	host, port, ok := strings.Cut(s, "#")
+	if !ok {
+		return s
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() {
+		return "[" + host + "]:" + port
+	}
+	return host + ":" + port
+}
+
+// reverseZone returns the in-addr.arpa/ip6.arpa zone of a cidr.
+// It only supports prefixes that are aligned to the label boundary.
+func reverseZone(cidr string) (string, bool) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", false
+	}
+	b := p.Masked().Addr().AsSlice()
+	var labels []string
+	if p.Addr().Is4() {
+		if p.Bits()%8 != 0 {
+			return "", false
+		}
+		for i := p.Bits()/8 - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", b[i]))
+		}
+		return strings.Join(append(labels, "in-addr.arpa"), "."), true
+	}
+	if p.Bits()%4 != 0 {
+		return "", false
+	}
+	for i := p.Bits()/4 - 1; i >= 0; i-- {
+		nibble := b[i/2] >> 4
+		if i%2 == 1 {
+			nibble = b[i/2] & 0xf
+		}
+		labels = append(labels, fmt.Sprintf("%x", nibble))
+	}
+	return strings.Join(append(labels, "ip6.arpa"), "."), true
+}
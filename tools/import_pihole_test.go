@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writePiholeArchive writes files to a teleporter archive.
+func writePiholeArchive(t *testing.T, file string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := []byte(files[name])
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_importPihole(t *testing.T) {
+	v5 := map[string]string{
+		"etc/pihole/setupVars.conf": "PIHOLE_DNS_1=1.1.1.1\nPIHOLE_DNS_2=::1#5353\n" +
+			"REV_SERVER=true\nREV_SERVER_CIDR=192.168.0.0/16\nREV_SERVER_TARGET=192.168.1.1#53\nREV_SERVER_DOMAIN=lan\n",
+		"blacklist.exact.json": `[{"domain":"ads.com","enabled":1},{"domain":"disabled.com","enabled":0}]`,
+		"blacklist.regex.json": `[{"domain":"^ad[0-9]+\\.","enabled":1},{"domain":"(","enabled":1}]`,
+		"whitelist.exact.json": `[{"domain":"good.ads.com","enabled":1}]`,
+		"whitelist.regex.json": `[]`,
+		"adlist.json":          `[{"address":"https://example.com/hosts","enabled":1},{"address":"https://example.com/disabled","enabled":0}]`,
+		"custom.list":          "192.168.1.2 nas.lan router.lan\ninvalid nas2.lan\n",
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		archive bool
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "v5 dir",
+			files: v5,
+			want: "listen: 0.0.0.0:53\n" +
+				"upstream: 1.1.1.1 [::1]:5353\n" +
+				"domain upstream: lan 168.192.in-addr.arpa -> 192.168.1.1:53\n" +
+				"block: full:ads.com regexp:^ad[0-9]+\\.\n" +
+				"allow: full:good.ads.com\n" +
+				"remote block: https://example.com/hosts\n" +
+				"hosts full:nas.lan: 192.168.1.2\n" +
+				"hosts full:router.lan: 192.168.1.2",
+		},
+		{
+			name:    "v5 archive",
+			files:   v5,
+			archive: true,
+			want: "listen: 0.0.0.0:53\n" +
+				"upstream: 1.1.1.1 [::1]:5353\n" +
+				"domain upstream: lan 168.192.in-addr.arpa -> 192.168.1.1:53\n" +
+				"block: full:ads.com regexp:^ad[0-9]+\\.\n" +
+				"allow: full:good.ads.com\n" +
+				"remote block: https://example.com/hosts\n" +
+				"hosts full:nas.lan: 192.168.1.2\n" +
+				"hosts full:router.lan: 192.168.1.2",
+		},
+		{
+			name: "v4 dir",
+			files: map[string]string{
+				"setupVars.conf": "PIHOLE_DNS_1=8.8.8.8\nREV_SERVER=false\nREV_SERVER_TARGET=192.168.1.1\n",
+				"blacklist.txt":  "# comment\nads.com\n",
+				"regex.list":     "^tracker\\.\n",
+				"whitelist.txt":  "good.ads.com\n",
+				"adlists.list":   "https://example.com/hosts\n",
+			},
+			want: "listen: 0.0.0.0:53\n" +
+				"upstream: 8.8.8.8\n" +
+				"block: full:ads.com regexp:^tracker\\.\n" +
+				"allow: full:good.ads.com\n" +
+				"remote block: https://example.com/hosts",
+		},
+		{
+			name:    "invalid json",
+			files:   map[string]string{"blacklist.exact.json": "{"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := filepath.Join(dir, "in")
+			if tt.archive {
+				in = filepath.Join(dir, "teleporter.tar.gz")
+				writePiholeArchive(t, in, tt.files)
+			} else {
+				writeImportFiles(t, in, tt.files)
+			}
+			s, err := importPihole(in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importPihole() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := dumpImported(t, s); got != tt.want {
+				t.Fatalf("importPihole() got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	// Neither a dir nor a teleporter archive.
+	dir := t.TempDir()
+	writeImportFiles(t, dir, map[string]string{"teleporter.tar.gz": "x"})
+	if _, err := importPihole(filepath.Join(dir, "teleporter.tar.gz")); err == nil {
+		t.Fatal("want invalid archive err")
+	}
+}
+
+func Test_reverseZone(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		want   string
+		wantOk bool
+	}{
+		{"192.168.0.0/16", "168.192.in-addr.arpa", true},
+		{"10.0.0.0/8", "10.in-addr.arpa", true},
+		{"192.168.1.0/20", "", false},
+		{"fd00::/8", "d.f.ip6.arpa", true},
+		{"fd00::/10", "", false},
+		{"invalid", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			got, ok := reverseZone(tt.cidr)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("reverseZone() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"github.com/IrineSistiana/mosdns/v4/pkg/scheduler"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeImportFiles writes files (name -> content) to dir.
+func writeImportFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// dumpImported returns s in lines for comparison. Empty settings are
+// omitted.
+func dumpImported(t *testing.T, s *importedSettings) string {
+	t.Helper()
+	var l []string
+	add := func(k string, v ...string) {
+		if len(v) > 0 {
+			l = append(l, k+": "+strings.Join(v, " "))
+		}
+	}
+	ups := func(ups []*importedUpstream) []string {
+		var out []string
+		for _, u := range ups {
+			s := u.Addr
+			if len(u.Bootstrap) > 0 {
+				s += "(bootstrap " + u.Bootstrap + ")"
+			}
+			if u.EnableHTTP3 {
+				s += "(h3)"
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	rules := func(domains []*v2data.Domain) []string {
+		b := new(bytes.Buffer)
+		if err := convertV2DomainToText(domains, b); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(b.String())
+	}
+
+	add("listen", s.listen...)
+	add("upstream", ups(s.upstreams)...)
+	for _, du := range s.domainUpstreams {
+		add("domain upstream", append(du.domains, append([]string{"->"}, ups(du.upstreams)...)...)...)
+	}
+	for _, c := range s.clients {
+		add("client "+c.name, append(c.ips, append([]string{"->"}, ups(c.upstreams)...)...)...)
+	}
+	if s.cacheSize > 0 {
+		add("cache", fmt.Sprint(s.cacheSize))
+	}
+	add("block", rules(s.block)...)
+	add("allow", rules(s.allow)...)
+	add("remote block", s.remoteBlock...)
+	add("remote allow", s.remoteAllow...)
+	if s.hosts != nil {
+		for _, d := range s.hosts.domains {
+			add("hosts "+d, s.hosts.ips[d]...)
+		}
+	}
+	return strings.Join(l, "\n")
+}
+
+// loadImportedConfig reads the config generated by ImportConfig.
+func loadImportedConfig(t *testing.T, dir string) *importedConfig {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, importedConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(importedConfig)
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func Test_ImportConfig_remoteAllowlist(t *testing.T) {
+	lists := map[string]string{
+		"/block.txt": "||ads.example.com^\n||tracker.example.org^\n",
+		"/allow.txt": "@@||good.ads.example.com^\n||tracker.example.org^\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, lists[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "AdGuardHome.yaml")
+	agh := fmt.Sprintf(`
+dns:
+  upstream_dns: [8.8.8.8]
+filters:
+  - enabled: true
+    url: %[1]s/block.txt
+whitelist_filters:
+  - enabled: true
+    url: %[1]s/allow.txt
+`, srv.URL)
+	if err := os.WriteFile(in, []byte(agh), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := ImportConfig(importFromAdGuard, in, out, "imported"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := loadImportedConfig(t, out)
+
+	sched := scheduler.NewScheduler(nil)
+	defer sched.Close()
+	dm := data_provider.NewDataManager()
+	for _, dpArgs := range cfg.DataProviders {
+		dpc := data_provider.DataProviderConfig{
+			Tag:  dpArgs["tag"].(string),
+			File: dpArgs["file"].(string),
+		}
+		dpc.URL, _ = dpArgs["url"].(string)
+		dp, err := data_provider.NewDataProvider(zap.NewNop(), sched, dpc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dp.Close()
+		dm.AddDataProvider(dpc.Tag, dp)
+	}
+
+	var blockDomains []string
+	for _, pc := range cfg.Plugins {
+		if pc.Tag == "imported_block" {
+			for _, d := range pc.Args.(map[string]interface{})["domain"].([]interface{}) {
+				blockDomains = append(blockDomains, d.(string))
+			}
+		}
+	}
+	m, err := domain.BatchLoadDomainProvider(blockDomains, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"ads.example.com.", true},
+		{"x.ads.example.com.", true},
+		{"good.ads.example.com.", false},
+		{"tracker.example.org.", false},
+		{"example.com.", false},
+	}
+	for _, tt := range tests {
+		if _, ok := m.Match(tt.domain); ok != tt.want {
+			t.Errorf("blocked(%s) = %v, want %v", tt.domain, ok, tt.want)
+		}
+	}
+}
@@ -25,10 +25,7 @@ import (
 )
 
 func init() {
-	probeCmd := &cobra.Command{
-		Use:   "probe",
-		Short: "Run some server tests.",
-	}
+	probeCmd := newProbeCmd()
 	probeCmd.AddCommand(
 		newConnReuseCmd(),
 		newIdleTimeoutCmd(),
@@ -50,6 +47,16 @@ func init() {
 		Use:   "config",
 		Short: "Tools that can generate/convert mosdns config file.",
 	}
-	configCmd.AddCommand(newGenCmd(), newConvCmd())
+	configCmd.AddCommand(newGenCmd(), newConvCmd(), newImportCmd(), newSchemaCmd())
 	coremain.AddSubCmd(configCmd)
+
+	coremain.AddSubCmd(newConvertCmd())
+	coremain.AddSubCmd(newBenchCmd())
+
+	raCmd := &cobra.Command{
+		Use:   "ra",
+		Short: "Tools that can publish mosdns as the dns server of an IPv6 network.",
+	}
+	raCmd.AddCommand(newRAAnnounceCmd(), newRASnippetCmd())
+	coremain.AddSubCmd(raCmd)
 }
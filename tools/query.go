@@ -0,0 +1,266 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamFlags are the upstream options shared by commands that send
+// queries to an upstream.
+type upstreamFlags struct {
+	insecure  bool
+	http3     bool
+	bootstrap string
+	dialAddr  string
+	proxy     string
+}
+
+func (f *upstreamFlags) register(c *cobra.Command) {
+	fs := c.Flags()
+	fs.BoolVar(&f.insecure, "insecure", false, "skip the tls certificate verification")
+	fs.BoolVar(&f.http3, "http3", false, "use http/3 for doh upstreams")
+	fs.StringVar(&f.bootstrap, "bootstrap", "", "bootstrap server that resolves the upstream domain")
+	fs.StringVar(&f.dialAddr, "dial-addr", "", "address that the upstream actually dials to")
+	fs.StringVar(&f.proxy, "proxy", "", "socks5:// or http:// proxy url")
+}
+
+// newUpstream creates the upstream of addr. verifyConnection is optional.
+func (f *upstreamFlags) newUpstream(addr string, verifyConnection func(tls.ConnectionState) error) (upstream.Upstream, error) {
+	u, err := upstream.NewUpstream(addr, &upstream.Opt{
+		DialAddr:    f.dialAddr,
+		Proxy:       f.proxy,
+		Bootstrap:   f.bootstrap,
+		EnableHTTP3: f.http3,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: f.insecure,
+			VerifyConnection:   verifyConnection,
+		},
+		Logger: mlog.L(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init upstream, %w", err)
+	}
+	return u, nil
+}
+
+type queryOpts struct {
+	upstreamFlags
+	timeout time.Duration
+	count   int
+	dnssec  bool
+}
+
+func newProbeCmd() *cobra.Command {
+	opts := new(queryOpts)
+	c := &cobra.Command{
+		Use:   "probe <name> [@upstream] [type]",
+		Args:  cobra.RangeArgs(1, 3),
+		Short: "Send a query to an upstream and print the response, or run some server tests.",
+		Long: `Send a query to an upstream and print the response, like dig.
+
+The upstream uses the same address format and transports as the forward
+plugin, e.g. "@8.8.8.8", "@tls://dns.google", "@https://1.1.1.1/dns-query",
+"@quic://dns.adguard.com". Default is the first nameserver in
+/etc/resolv.conf. Default type is A.`,
+		Example: `  mosdns probe example.com @tls://1.1.1.1 AAAA
+  mosdns probe example.com @https://dns.google/dns-query --http3`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runQuery(cmd.OutOrStdout(), args, opts); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+	}
+	fs := c.Flags()
+	fs.DurationVar(&opts.timeout, "timeout", time.Second*5, "query timeout")
+	fs.IntVarP(&opts.count, "count", "c", 1, "send the query this many times over the same upstream")
+	fs.BoolVar(&opts.dnssec, "dnssec", false, "set the DO bit")
+	opts.upstreamFlags.register(c)
+	return c
+}
+
+// parseQueryArgs parses dig-like args. An arg with a "@" prefix is the
+// upstream. An arg that is a rr type is the query type. addr is
+// empty if no upstream is given.
+func parseQueryArgs(args []string) (name string, qtype uint16, addr string, err error) {
+	for _, a := range args {
+		if strings.HasPrefix(a, "@") {
+			if len(addr) > 0 {
+				return "", 0, "", errors.New("multiple upstreams")
+			}
+			addr = a[1:]
+			continue
+		}
+		if t, err := dnsutils.ParseRRType(a); err == nil && qtype == 0 {
+			qtype = t
+			continue
+		}
+		if len(name) > 0 {
+			return "", 0, "", fmt.Errorf("unexpected arg %s", a)
+		}
+		name = a
+	}
+	if len(name) == 0 {
+		return "", 0, "", errors.New("missing query name")
+	}
+	if qtype == 0 {
+		qtype = dns.TypeA
+	}
+	return dns.Fqdn(name), qtype, addr, nil
+}
+
+// defaultUpstream returns the first nameserver in resolv.conf file.
+func defaultUpstream(file string) (string, error) {
+	cc, err := dns.ClientConfigFromFile(file)
+	if err != nil || len(cc.Servers) == 0 {
+		return "", fmt.Errorf("no upstream is given and no nameserver is found in %s", file)
+	}
+	return net.JoinHostPort(cc.Servers[0], cc.Port), nil
+}
+
+// tlsStateRecorder keeps the state of the last tls handshake.
+type tlsStateRecorder struct {
+	mu sync.Mutex
+	s  *tls.ConnectionState
+}
+
+func (r *tlsStateRecorder) verifyConnection(s tls.ConnectionState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s = &s
+	return nil
+}
+
+func (r *tlsStateRecorder) take() *tls.ConnectionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.s
+	r.s = nil
+	return s
+}
+
+func runQuery(w io.Writer, args []string, opts *queryOpts) error {
+	name, qtype, addr, err := parseQueryArgs(args)
+	if err != nil {
+		return err
+	}
+	if len(addr) == 0 {
+		addr, err = defaultUpstream("/etc/resolv.conf")
+		if err != nil {
+			return err
+		}
+	}
+
+	tr := new(tlsStateRecorder)
+	u, err := opts.newUpstream(addr, tr.verifyConnection)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(1232, opts.dnssec)
+
+	count := opts.count
+	if count <= 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		q.Id = dns.Id()
+		ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		start := time.Now()
+		r, err := u.ExchangeContext(ctx, q)
+		rtt := time.Since(start)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("query #%d failed after %d ms, %w", i, rtt.Milliseconds(), err)
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, r.String())
+		fmt.Fprintf(w, ";; Query time: %d ms\n", rtt.Milliseconds())
+		fmt.Fprintf(w, ";; SERVER: %s\n", addr)
+		fmt.Fprintf(w, ";; MSG SIZE  rcvd: %d\n", r.Len())
+		if s := tr.take(); s != nil {
+			writeTLSState(w, s)
+		}
+	}
+	return nil
+}
+
+func writeTLSState(w io.Writer, s *tls.ConnectionState) {
+	fmt.Fprintf(w, ";; TLS: %s, %s", tlsVersionString(s.Version), tls.CipherSuiteName(s.CipherSuite))
+	if len(s.NegotiatedProtocol) > 0 {
+		fmt.Fprintf(w, ", alpn %s", s.NegotiatedProtocol)
+	}
+	if len(s.ServerName) > 0 {
+		fmt.Fprintf(w, ", sni %s", s.ServerName)
+	}
+	if s.DidResume {
+		fmt.Fprint(w, ", resumed")
+	}
+	fmt.Fprintln(w)
+	for i, c := range s.PeerCertificates {
+		fmt.Fprintf(w, ";; CERT #%d: subject %q, issuer %q, expires %s%s\n",
+			i, c.Subject.String(), c.Issuer.String(), c.NotAfter.Format(time.RFC3339), certNames(c))
+	}
+}
+
+func certNames(c *x509.Certificate) string {
+	names := append([]string(nil), c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return ", names " + strings.Join(names, " ")
+}
+
+func tlsVersionString(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("TLS(0x%04x)", v)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseQueryArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantName string
+		wantType uint16
+		wantAddr string
+		wantErr  bool
+	}{
+		{"name only", []string{"example.com"}, "example.com.", dns.TypeA, "", false},
+		{"dig order", []string{"example.com", "@1.1.1.1", "aaaa"}, "example.com.", dns.TypeAAAA, "1.1.1.1", false},
+		{"any order", []string{"@tls://dns.google", "MX", "example.com."}, "example.com.", dns.TypeMX, "tls://dns.google", false},
+		{"name is a type", []string{"A", "a"}, "a.", dns.TypeA, "", false},
+		{"type number", []string{"example.com", "TYPE65"}, "example.com.", dns.TypeHTTPS, "", false},
+		{"missing name", []string{"@1.1.1.1", "A"}, "", 0, "", true},
+		{"multiple names", []string{"a.com", "b.com"}, "", 0, "", true},
+		{"multiple upstreams", []string{"a.com", "@1.1.1.1", "@8.8.8.8"}, "", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, qtype, addr, err := parseQueryArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQueryArgs() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName || qtype != tt.wantType || addr != tt.wantAddr {
+				t.Errorf("parseQueryArgs() = %s, %d, %s, want %s, %d, %s", name, qtype, addr, tt.wantName, tt.wantType, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func Test_defaultUpstream(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(f, []byte("# comment\nnameserver 192.168.1.1\nnameserver ::1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := defaultUpstream(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "192.168.1.1:53" {
+		t.Fatalf("want 192.168.1.1:53, got %s", addr)
+	}
+
+	if err := os.WriteFile(f, []byte("search lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defaultUpstream(f); err == nil {
+		t.Fatal("want no nameserver err")
+	}
+}
+
+func Test_runQuery(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 300 IN A 1.2.3.4")
+		r.Answer = append(r.Answer, rr)
+		w.WriteMsg(r)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	addr := pc.LocalAddr().String()
+	out := new(bytes.Buffer)
+	opts := &queryOpts{timeout: time.Second, count: 2}
+	if err := runQuery(out, []string{"example.com", "@" + addr}, opts); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+	if n := strings.Count(s, ";; Query time:"); n != 2 {
+		t.Fatalf("want 2 responses, got %d:\n%s", n, s)
+	}
+	for _, want := range []string{"example.com.\t300\tIN\tA\t1.2.3.4", ";; SERVER: " + addr} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, s)
+		}
+	}
+
+	if err := runQuery(out, []string{"example.com", "@1.1.1.1", "@8.8.8.8"}, opts); err == nil {
+		t.Fatal("want args err")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/rdnss"
+	"github.com/spf13/cobra"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func newRAAnnounceCmd() *cobra.Command {
+	var (
+		iface    string
+		dns      []string
+		interval int
+		lifetime int
+	)
+	c := &cobra.Command{
+		Use:   "announce --iface eth0 [--dns addr]...",
+		Args:  cobra.NoArgs,
+		Short: "Announce dns servers to the network via RDNSS options of router advertisements.",
+		Long: `Announce dns servers to the network via RDNSS options (RFC 8106) of
+router advertisements. The router lifetime of the advertisements is 0, so
+hosts will not use this host as their default router.
+
+If no --dns is given, the global ipv6 addresses of the interface will be
+announced. Servers are withdrawn on exit. Requires CAP_NET_RAW.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			servers, err := raServers(iface, dns)
+			if err != nil {
+				mlog.S().Fatal(err)
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			a := &rdnss.Announcer{
+				Iface:    iface,
+				Servers:  servers,
+				Interval: time.Duration(interval) * time.Second,
+				Lifetime: time.Duration(lifetime) * time.Second,
+				Logger:   mlog.L(),
+			}
+			if err := a.Run(ctx); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVar(&iface, "iface", "", "network interface to announce on")
+	fs.StringSliceVar(&dns, "dns", nil, "ipv6 address of the dns server")
+	fs.IntVar(&interval, "interval", 0, "interval of unsolicited advertisements in seconds (default 200)")
+	fs.IntVar(&lifetime, "lifetime", 0, "lifetime of the servers in seconds (default 3*interval)")
+	c.MarkFlagRequired("iface")
+	return c
+}
+
+func newRASnippetCmd() *cobra.Command {
+	var (
+		format string
+		iface  string
+		dns    []string
+		out    string
+	)
+	c := &cobra.Command{
+		Use:   "snippet --format odhcpd|dnsmasq --dns addr... [--iface lan] [-o file]",
+		Args:  cobra.NoArgs,
+		Short: "Print a odhcpd (OpenWrt) or dnsmasq snippet that announces dns servers via RA/DHCPv6.",
+		Long: `Print a odhcpd (OpenWrt) or dnsmasq snippet that announces dns servers via RA/DHCPv6.
+
+For odhcpd, the snippet is a list of uci commands and --iface is the logical
+interface (default "lan"). For dnsmasq, the snippet is config lines.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			servers, err := raServers("", dns)
+			if err != nil {
+				mlog.S().Fatal(err)
+			}
+			s, err := rdnss.Snippet(format, iface, servers)
+			if err != nil {
+				mlog.S().Fatal(err)
+			}
+			if len(out) == 0 {
+				fmt.Print(s)
+				return
+			}
+			if err := os.WriteFile(out, []byte(s), 0644); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVar(&format, "format", "", "snippet format, odhcpd or dnsmasq")
+	fs.StringVar(&iface, "iface", "", "OpenWrt logical interface, odhcpd only")
+	fs.StringSliceVar(&dns, "dns", nil, "ipv6 address of the dns server")
+	fs.StringVarP(&out, "out", "o", "", "output file, default is stdout")
+	c.MarkFlagRequired("format")
+	c.MarkFlagRequired("dns")
+	return c
+}
+
+// raServers parses dns. If dns is empty, it returns the global ipv6
+// addresses of iface.
+func raServers(iface string, dns []string) ([]netip.Addr, error) {
+	if len(dns) == 0 {
+		return rdnss.IfaceAddrs(iface)
+	}
+	servers := make([]netip.Addr, 0, len(dns))
+	for _, s := range dns {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns address %s, %w", s, err)
+		}
+		if !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("%s is not an ipv6 address", s)
+		}
+		servers = append(servers, addr)
+	}
+	return servers, nil
+}